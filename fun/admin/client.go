@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"fun/container"
+	"fun/events"
+	"fun/fleet"
+	"fun/tasks"
+)
+
+// Client talks to the daemon's admin API over its unix socket
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates an admin API client for the socket at socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request to the admin API and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://fun"+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("admin API error: %s (status: %d)", apiErr.Error, resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetLogLevel returns the daemon's current log level
+func (c *Client) GetLogLevel(ctx context.Context) (string, error) {
+	var resp logLevelRequest
+	if err := c.do(ctx, http.MethodGet, "/v1/log-level", nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Level, nil
+}
+
+// SetLogLevel changes the daemon's log level without restarting it
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	return c.do(ctx, http.MethodPut, "/v1/log-level", logLevelRequest{Level: level}, nil)
+}
+
+// DebugDump has the daemon write its diagnostic dump to its log and returns it
+func (c *Client) DebugDump(ctx context.Context) (string, error) {
+	var resp dumpResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/debug/dump", nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Dump, nil
+}
+
+// UpgradeContainerd has the daemon restart its embedded containerd on the
+// bundled binaries this release ships in newer versions and returns them
+func (c *Client) UpgradeContainerd(ctx context.Context) ([]container.BundleUpgrade, error) {
+	var resp upgradeResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/containerd/upgrade", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Upgrades, nil
+}
+
+// DiffDesiredState asks the daemon which actions would bring the host to the
+// desired state, without applying them
+func (c *Client) DiffDesiredState(ctx context.Context, desired container.DesiredState) (*container.StateDiff, error) {
+	var diff container.StateDiff
+	if err := c.do(ctx, http.MethodPost, "/v1/desired-state/diff", desired, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// ApplyDesiredState applies a desired state on the daemon and returns the recorded revision
+func (c *Client) ApplyDesiredState(ctx context.Context, desired container.DesiredState, appliedBy, message string) (*container.DeploymentRevision, error) {
+	var revision container.DeploymentRevision
+	req := applyRequest{State: desired, AppliedBy: appliedBy, Message: message}
+	if err := c.do(ctx, http.MethodPost, "/v1/desired-state", req, &revision); err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// DeploymentHistory returns the revisions applied on the daemon, oldest first
+func (c *Client) DeploymentHistory(ctx context.Context) ([]container.DeploymentRevision, error) {
+	var revisions []container.DeploymentRevision
+	if err := c.do(ctx, http.MethodGet, "/v1/desired-state/history", nil, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Fleet returns the peer group of the daemon's host
+func (c *Client) Fleet(ctx context.Context) (*fleet.Group, error) {
+	var group fleet.Group
+	if err := c.do(ctx, http.MethodGet, "/v1/fleet", nil, &group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// Events returns the events of the daemon's journal selected by filter, oldest first
+func (c *Client) Events(ctx context.Context, filter events.Filter) ([]events.Event, error) {
+	query := url.Values{}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	for _, t := range filter.Types {
+		query.Add("type", t)
+	}
+	if filter.Subject != "" {
+		query.Set("subject", filter.Subject)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var result []events.Event
+	if err := c.do(ctx, http.MethodGet, "/v1/events?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Tasks returns the maintenance tasks of the daemon
+func (c *Client) Tasks(ctx context.Context) ([]tasks.Status, error) {
+	var statuses []tasks.Status
+	if err := c.do(ctx, http.MethodGet, "/v1/tasks", nil, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// RunTask runs a maintenance task on the daemon and returns its status once it finished
+func (c *Client) RunTask(ctx context.Context, name string) (*tasks.Status, error) {
+	var status tasks.Status
+	if err := c.do(ctx, http.MethodPost, "/v1/tasks/"+url.PathEscape(name)+"/run", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Rollback restores an earlier revision on the daemon, the previous one if revision is 0
+func (c *Client) Rollback(ctx context.Context, project string, revision int, appliedBy string) (*container.DeploymentRevision, error) {
+	var result container.DeploymentRevision
+	req := rollbackRequest{Project: project, Revision: revision, AppliedBy: appliedBy}
+	if err := c.do(ctx, http.MethodPost, "/v1/desired-state/rollback", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Profile downloads a pprof profile such as "profile" (CPU), "heap" or "goroutine"
+// CPU profiles and traces are collected for the given number of seconds
+func (c *Client) Profile(ctx context.Context, name string, seconds int, w io.Writer) error {
+	query := url.Values{}
+	if seconds > 0 {
+		query.Set("seconds", fmt.Sprint(seconds))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://fun/debug/pprof/"+name+"?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to get profile: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,473 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"fun/container"
+	"fun/events"
+	"fun/fleet"
+	"fun/health"
+	"fun/logging"
+	"fun/sockets"
+	"fun/tasks"
+)
+
+// Server is the local admin API of the daemon, served on a unix socket that only
+// the owner and the socket group can access
+type Server struct {
+	// client is used by the container endpoints, which are unavailable without it
+	client *container.Client
+	// fleet is the host's peer group, /v1/fleet is unavailable without it
+	fleet *fleet.Store
+	// tasks are the daemon's maintenance tasks, /v1/tasks is unavailable without them
+	tasks *tasks.Scheduler
+	// journal holds the daemon's events, /v1/events is empty without it
+	journal *events.Journal
+	// health runs the daemon's checks, /healthz and /readyz only report the API is up without it
+	health *health.Checker
+	// dump logs and returns the daemon's diagnostic dump, /v1/debug/dump is unavailable without it
+	dump func() string
+	// upgrade restarts the embedded containerd on upgraded bundled binaries,
+	// /v1/containerd/upgrade is unavailable without it
+	upgrade func(ctx context.Context) ([]container.BundleUpgrade, error)
+	// socketGID is the group given access to the socket, -1 keeps the daemon's group
+	socketGID int
+}
+
+// applyRequest is the body of POST /v1/desired-state
+type applyRequest struct {
+	State     container.DesiredState `json:"state"`
+	AppliedBy string                 `json:"applied_by"`
+	Message   string                 `json:"message,omitempty"`
+}
+
+// rollbackRequest is the body of POST /v1/desired-state/rollback
+type rollbackRequest struct {
+	// Project is the project to roll back, empty for the global state
+	Project   string `json:"project,omitempty"`
+	Revision  int    `json:"revision"`
+	AppliedBy string `json:"applied_by"`
+}
+
+// dumpResponse is the body of the response to POST /v1/debug/dump
+type dumpResponse struct {
+	Dump string `json:"dump"`
+}
+
+// upgradeResponse is the body of the response to POST /v1/containerd/upgrade
+type upgradeResponse struct {
+	Upgrades []container.BundleUpgrade `json:"upgrades"`
+}
+
+// logLevelRequest is the body of GET and PUT /v1/log-level
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// NewServer creates an admin API server
+func NewServer() *Server {
+	return &Server{socketGID: -1}
+}
+
+// SetSocketGroup gives members of gid access to the socket, like the docker group
+func (s *Server) SetSocketGroup(gid int) {
+	s.socketGID = gid
+}
+
+// SetContainerClient enables the endpoints that need containerd
+func (s *Server) SetContainerClient(client *container.Client) {
+	s.client = client
+}
+
+// SetFleet enables the peer group endpoint
+func (s *Server) SetFleet(store *fleet.Store) {
+	s.fleet = store
+}
+
+// SetTasks enables the maintenance task endpoints
+func (s *Server) SetTasks(scheduler *tasks.Scheduler) {
+	s.tasks = scheduler
+}
+
+// SetJournal enables the event journal endpoint
+func (s *Server) SetJournal(journal *events.Journal) {
+	s.journal = journal
+}
+
+// SetHealth enables the liveness and readiness checks
+func (s *Server) SetHealth(checker *health.Checker) {
+	s.health = checker
+}
+
+// SetDiagnostics enables the diagnostic dump endpoint, dump writes the dump to
+// the daemon's log and returns it
+func (s *Server) SetDiagnostics(dump func() string) {
+	s.dump = dump
+}
+
+// SetContainerdUpgrade enables the containerd upgrade endpoint, upgrade restarts
+// the embedded containerd on the upgraded bundled binaries
+func (s *Server) SetContainerdUpgrade(upgrade func(ctx context.Context) ([]container.BundleUpgrade, error)) {
+	s.upgrade = upgrade
+}
+
+// Handler returns the HTTP handler implementing the admin API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Liveness and readiness of the daemon itself, for external monitoring
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+
+	mux.HandleFunc("GET /v1/log-level", s.handleGetLogLevel)
+	mux.HandleFunc("PUT /v1/log-level", s.handleSetLogLevel)
+	// Logs the state of the daemon like SIGUSR1, which Windows lacks
+	mux.HandleFunc("POST /v1/debug/dump", s.handleDebugDump)
+	mux.HandleFunc("POST /v1/containerd/upgrade", s.handleUpgradeContainerd)
+
+	// Plans changes for a desired-state document without applying them
+	mux.HandleFunc("POST /v1/desired-state/diff", s.handleDiffDesiredState)
+	mux.HandleFunc("POST /v1/desired-state", s.handleApplyDesiredState)
+	mux.HandleFunc("GET /v1/desired-state/history", s.handleDeploymentHistory)
+	mux.HandleFunc("POST /v1/desired-state/rollback", s.handleRollback)
+	mux.HandleFunc("GET /v1/fleet", s.handleFleet)
+	// Lists images a page at a time, also used by the web UI
+	mux.HandleFunc("GET /v1/images", s.handleListImages)
+	mux.HandleFunc("GET /v1/tasks", s.handleListTasks)
+	// Queries the event journal, also used by the web UI and support bundles
+	mux.HandleFunc("GET /v1/events", s.handleEvents)
+	mux.HandleFunc("POST /v1/tasks/{name}/run", s.handleRunTask)
+
+	// Profiling endpoints, usable with go tool pprof
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// ListenAndServe serves the admin API on a unix socket until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, socketPath string) error {
+	// pprof exposes process internals, so restrict the socket to the daemon's user and group
+	listener, err := sockets.Listen(socketPath, s.socketGID)
+	if err != nil {
+		return fmt.Errorf("failed to serve the admin API: %w", err)
+	}
+
+	log.Printf("Admin API listening on %s", socketPath)
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves the admin API on listener until ctx is cancelled
+// The listener may come from systemd socket activation.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	httpServer := &http.Server{Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("admin API failed: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelRequest{Level: logging.GetLevel().String()})
+}
+
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := logging.SetLevel(req.Level); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevelRequest{Level: logging.GetLevel().String()})
+}
+
+func (s *Server) handleDiffDesiredState(w http.ResponseWriter, r *http.Request) {
+	if s.client == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("containerd is not available"))
+		return
+	}
+
+	var desired container.DesiredState
+	if err := json.NewDecoder(r.Body).Decode(&desired); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := desired.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	diff, err := s.client.DiffDesiredState(r.Context(), desired)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+func (s *Server) handleApplyDesiredState(w http.ResponseWriter, r *http.Request) {
+	if s.client == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("containerd is not available"))
+		return
+	}
+
+	var req applyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.State.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	revision, err := s.client.ApplyDesiredState(r.Context(), req.State, req.AppliedBy, req.Message)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, revision)
+}
+
+func (s *Server) handleDeploymentHistory(w http.ResponseWriter, r *http.Request) {
+	if s.client == nil || s.client.GetDeploymentHistory() == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("deployment history is not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.client.GetDeploymentHistory().List())
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if s.client == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("containerd is not available"))
+		return
+	}
+
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	revision, err := s.client.Rollback(r.Context(), req.Project, req.Revision, req.AppliedBy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, revision)
+}
+
+// handleHealthz reports whether the daemon makes progress, 503 means it is
+// wedged and should be restarted
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := health.Report{OK: true, Time: time.Now()}
+	if s.health != nil {
+		report = s.health.Live(r.Context())
+	}
+	writeHealth(w, report)
+}
+
+// handleReadyz reports whether containerd, the backend VM and the orchestrator
+// can be reached, 503 means the daemon can't do its work
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := health.Report{OK: true, Time: time.Now()}
+	if s.health != nil {
+		report = s.health.Ready(r.Context())
+	}
+	writeHealth(w, report)
+}
+
+// writeHealth writes a health report with the status code monitors look at
+func writeHealth(w http.ResponseWriter, report health.Report) {
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func (s *Server) handleFleet(w http.ResponseWriter, r *http.Request) {
+	if s.fleet == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("fleet information is not available"))
+		return
+	}
+	group, ok := s.fleet.Group()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("the orchestrator hasn't assigned this host to a group"))
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+// defaultImagePageSize and maxImagePageSize bound the images of a page of GET /v1/images
+const (
+	defaultImagePageSize = 100
+	maxImagePageSize     = 1000
+)
+
+// handleListImages returns a page of the images selected by the name, label
+// and after query parameters. name is a glob pattern, label is key or
+// key=value and may repeat, and after is the next value of the previous page.
+func (s *Server) handleListImages(w http.ResponseWriter, r *http.Request) {
+	if s.client == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("containerd is not available"))
+		return
+	}
+
+	query := r.URL.Query()
+	labels, err := container.ParseImageLabelFilters(query["label"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts := container.ImageListOptions{Name: query.Get("name"), Labels: labels, After: query.Get("after"), Limit: defaultImagePageSize}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxImagePageSize {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q, expected 1 to %d", value, maxImagePageSize))
+			return
+		}
+		opts.Limit = limit
+	}
+	if err := opts.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := s.client.ListImagePage(r.Context(), opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleEvents returns the journal events selected by the since, until, type,
+// subject and limit query parameters. Times are RFC 3339 and type may repeat.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var filter events.Filter
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*t = parsed
+		}
+	}
+	filter.Types = query["type"]
+	filter.Subject = query.Get("subject")
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	result, err := s.journal.Query(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if result == nil {
+		result = []events.Event{}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleListTasks(w http.ResponseWriter, r *http.Request) {
+	if s.tasks == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("maintenance tasks are not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tasks.List())
+}
+
+// handleRunTask runs a task and responds once it finished, the status holds
+// the outcome of the run
+func (s *Server) handleRunTask(w http.ResponseWriter, r *http.Request) {
+	if s.tasks == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("maintenance tasks are not available"))
+		return
+	}
+	status, err := s.tasks.Trigger(r.Context(), r.PathValue("name"))
+	switch {
+	case errors.Is(err, tasks.ErrUnknownTask):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, tasks.ErrTaskRunning):
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleDebugDump(w http.ResponseWriter, r *http.Request) {
+	if s.dump == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("diagnostic dumps are not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, dumpResponse{Dump: s.dump()})
+}
+
+// upgradeDrainTimeout bounds how long a containerd upgrade waits for in-flight operations
+const upgradeDrainTimeout = 30 * time.Second
+
+// handleUpgradeContainerd restarts the embedded containerd on the bundled
+// binaries this release ships in newer versions, in-flight operations are
+// given upgradeDrainTimeout to finish
+func (s *Server) handleUpgradeContainerd(w http.ResponseWriter, r *http.Request) {
+	if s.upgrade == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("only the embedded containerd can be upgraded, see embedded_containerd"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), upgradeDrainTimeout)
+	defer cancel()
+	upgrades, err := s.upgrade(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, upgradeResponse{Upgrades: upgrades})
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,386 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/download"
+)
+
+const (
+	// manifestName is the file in the cache directory listing the cached artifacts
+	manifestName = "manifest.json"
+	// lockName is the file locked while the manifest is read or updated, so the
+	// daemon and CLI commands such as fun artifacts prune don't race on it
+	lockName = "manifest.lock"
+)
+
+// DefaultDir returns the cache directory used unless the daemon's
+// configuration moves it
+func DefaultDir() string {
+	userConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		userConfigDir = os.TempDir()
+	}
+	return filepath.Join(userConfigDir, "funserver", "artifacts")
+}
+
+// Entry is a cached artifact, such as a kernel, a rootfs tarball or a binary
+type Entry struct {
+	URL string `json:"url"`
+	// Digest is the sha256 of the content as "sha256:<hex>", the file it is
+	// stored in is named after it so identical downloads are kept once
+	Digest   string    `json:"digest"`
+	Version  string    `json:"version,omitempty"`
+	Size     int64     `json:"size"`
+	Fetched  time.Time `json:"fetched"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Request describes an artifact to fetch
+type Request struct {
+	URL string
+	// Digest is the expected "sha256:<hex>" of the content, empty trusts the download
+	Digest string
+	// Version is refetched when it changes, for URLs such as "latest" that
+	// serve new content under the same name
+	Version string
+	// Progress, if set, is called as the artifact downloads
+	Progress download.Progress
+}
+
+// PrunePolicy bounds the artifacts Prune keeps
+type PrunePolicy struct {
+	// MaxAge drops the artifacts not used for that long, 0 keeps them until MaxBytes is reached
+	MaxAge time.Duration
+	// MaxBytes drops the least recently used artifacts beyond it, 0 doesn't limit the size
+	MaxBytes int64
+}
+
+// PruneResult lists what Prune dropped
+type PruneResult struct {
+	Removed        []Entry `json:"removed"`
+	ReclaimedBytes int64   `json:"reclaimed_bytes"`
+}
+
+// Cache keeps downloaded artifacts by the digest of their content, with a
+// manifest recording where each came from and when it was last used, so
+// downloads are reused across reinstalls and old versions can be pruned
+type Cache struct {
+	dir        string
+	downloader *download.Downloader
+
+	// mutex serializes manifest updates within the process, the lock file
+	// between processes
+	mutex sync.Mutex
+}
+
+// Open opens the cache in dir, creating it if needed
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact cache: %w", err)
+	}
+	return &Cache{dir: dir, downloader: download.Shared()}, nil
+}
+
+// Dir returns the cache directory
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Fetch returns the path of the cached artifact for req, downloading it if it
+// isn't cached in that version or its file went missing. The file must not be
+// modified, copy it to change it.
+func (c *Cache) Fetch(ctx context.Context, req Request) (string, error) {
+	if path, ok := c.lookup(req); ok {
+		return path, nil
+	}
+
+	entry, err := c.download(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if err := c.update(func(manifest map[string]Entry) { manifest[req.URL] = entry }); err != nil {
+		return "", err
+	}
+	return c.blobPath(entry.Digest), nil
+}
+
+// FetchAll fetches reqs like Fetch, using up to the downloader's Workers
+// connections at a time, and returns the paths in the order of reqs. It stops
+// at the first failure, cancelling the other downloads.
+func (c *Cache) FetchAll(ctx context.Context, reqs []Request) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	paths := make([]string, len(reqs))
+	var mutex sync.Mutex
+	var first error
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(c.downloader.Workers, 1), len(reqs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				path, err := c.Fetch(ctx, reqs[i])
+				mutex.Lock()
+				paths[i] = path
+				// The downloads cancelled by a failure fail later, keep the cause
+				if err != nil && first == nil {
+					first = err
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range reqs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return paths, first
+}
+
+// lookup returns the cached file for req and marks it used
+func (c *Cache) lookup(req Request) (string, bool) {
+	unlock, err := c.lock()
+	if err != nil {
+		return "", false
+	}
+	defer unlock()
+
+	manifest, err := c.readManifest()
+	if err != nil {
+		return "", false
+	}
+	entry, ok := manifest[req.URL]
+	if !ok || entry.Version != req.Version || (req.Digest != "" && entry.Digest != req.Digest) {
+		return "", false
+	}
+	path := c.blobPath(entry.Digest)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	// A failed update only makes the artifact look older to Prune
+	entry.LastUsed = time.Now()
+	manifest[req.URL] = entry
+	c.writeManifest(manifest)
+	return path, true
+}
+
+// download fetches req into the cache, the content is hashed once complete
+// since retried downloads continue where they stopped
+func (c *Cache) download(ctx context.Context, req Request) (Entry, error) {
+	tmp, err := os.CreateTemp(c.dir, ".download-*")
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to create download file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	downloader := c.downloader
+	if req.Progress != nil {
+		downloader = downloader.WithProgress(req.Progress)
+	}
+	stats, err := downloader.Fetch(ctx, download.File{URL: req.URL, Path: tmp.Name()})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to read download of %s: %w", req.URL, err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to read download of %s: %w", req.URL, err)
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if req.Digest != "" && digest != req.Digest {
+		return Entry{}, fmt.Errorf("download of %s is corrupt (%s, expected %s)", req.URL, digest, req.Digest)
+	}
+	// Content already cached under another URL is kept once
+	if _, err := os.Stat(c.blobPath(digest)); os.IsNotExist(err) {
+		if err := os.Rename(tmp.Name(), c.blobPath(digest)); err != nil {
+			return Entry{}, fmt.Errorf("failed to store %s: %w", req.URL, err)
+		}
+	}
+
+	now := time.Now()
+	return Entry{URL: req.URL, Digest: digest, Version: req.Version, Size: stats.Bytes, Fetched: now, LastUsed: now}, nil
+}
+
+// Entries returns the cached artifacts, most recently used first
+func (c *Cache) Entries() ([]Entry, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := c.readManifest()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(manifest))
+	for _, entry := range manifest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+	return entries, nil
+}
+
+// Prune drops the artifacts not used within the policy's age, then the least
+// recently used ones until the cache fits its size. Files shared by entries
+// are only removed with the last of them, files no entry refers to, such as
+// those left by an interrupted download, are removed as well.
+func (c *Cache) Prune(policy PrunePolicy) (PruneResult, error) {
+	var result PruneResult
+	err := c.update(func(manifest map[string]Entry) {
+		entries := make([]Entry, 0, len(manifest))
+		for _, entry := range manifest {
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+
+		// Shared files count once towards the size
+		size := int64(0)
+		users := make(map[string]int)
+		for _, entry := range entries {
+			if users[entry.Digest] == 0 {
+				size += entry.Size
+			}
+			users[entry.Digest]++
+		}
+
+		cutoff := time.Now().Add(-policy.MaxAge)
+		dropped := make(map[string]bool)
+		for _, entry := range entries {
+			expired := policy.MaxAge > 0 && entry.LastUsed.Before(cutoff)
+			oversized := policy.MaxBytes > 0 && size > policy.MaxBytes
+			if !expired && !oversized {
+				continue
+			}
+			delete(manifest, entry.URL)
+			result.Removed = append(result.Removed, entry)
+			users[entry.Digest]--
+			if users[entry.Digest] == 0 {
+				size -= entry.Size
+				dropped[entry.Digest] = true
+			}
+		}
+
+		blobs, _ := filepath.Glob(filepath.Join(c.dir, "sha256", "*"))
+		temps, _ := filepath.Glob(filepath.Join(c.dir, ".download-*"))
+		for _, path := range append(blobs, temps...) {
+			digest := "sha256:" + filepath.Base(path)
+			if users[digest] > 0 {
+				continue
+			}
+			// Other recent files may belong to a download not recorded yet
+			info, err := os.Stat(path)
+			if err != nil || (!dropped[digest] && time.Since(info.ModTime()) < time.Hour) {
+				continue
+			}
+			if os.Remove(path) == nil {
+				result.ReclaimedBytes += info.Size()
+			}
+		}
+	})
+	return result, err
+}
+
+// update applies change to the manifest and writes it back
+func (c *Cache) update(change func(manifest map[string]Entry)) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	manifest, err := c.readManifest()
+	if err != nil {
+		// A corrupt manifest only loses track of the cached files, Prune removes them
+		manifest = map[string]Entry{}
+	}
+	change(manifest)
+	return c.writeManifest(manifest)
+}
+
+// lock waits until no other goroutine or process uses the manifest, returning
+// the function that releases the lock
+func (c *Cache) lock() (func(), error) {
+	c.mutex.Lock()
+	f, err := os.OpenFile(filepath.Join(c.dir, lockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("failed to open artifact cache lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("failed to lock artifact cache: %w", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		c.mutex.Unlock()
+	}, nil
+}
+
+// readManifest reads the manifest, the caller must hold the lock
+func (c *Cache) readManifest() (map[string]Entry, error) {
+	manifest := map[string]Entry{}
+	data, err := os.ReadFile(filepath.Join(c.dir, manifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact cache manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse artifact cache manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// writeManifest replaces the manifest atomically, the caller must hold the lock
+func (c *Cache) writeManifest(manifest map[string]Entry) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal artifact cache manifest: %w", err)
+	}
+	path := filepath.Join(c.dir, manifestName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write artifact cache manifest: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("failed to write artifact cache manifest: %w", err)
+	}
+	return nil
+}
+
+// blobPath returns the file holding the content with digest
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.dir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
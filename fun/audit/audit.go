@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// EventTrustDenied is recorded when the content trust policy refuses an image
+	EventTrustDenied = "trust_denied"
+	// EventTrustPolicyUpdated is recorded when a new content trust policy is installed
+	EventTrustPolicyUpdated = "trust_policy_updated"
+	// EventBinaryTampered is recorded when a bundled binary no longer matches its recorded checksum
+	EventBinaryTampered = "binary_tampered"
+	// EventManifestRejected is recorded when a desired-state manifest has no valid signature
+	EventManifestRejected = "manifest_rejected"
+)
+
+// Event is a single audit log entry
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Subject string    `json:"subject"`
+	Reason  string    `json:"reason,omitempty"`
+	Actor   string    `json:"actor,omitempty"`
+}
+
+// Logger appends audit events as JSON lines to a file
+// A nil Logger discards events, so callers don't need to check whether auditing is enabled.
+type Logger struct {
+	path    string
+	mutex   sync.Mutex
+	forward func(Event)
+}
+
+// NewLogger creates an audit logger writing to path
+func NewLogger(path string) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	return &Logger{path: path}, nil
+}
+
+// SetForwarder passes every recorded event to forward as well, such as to
+// ship the audit trail off the host
+func (l *Logger) SetForwarder(forward func(Event)) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	l.forward = forward
+	l.mutex.Unlock()
+}
+
+// Record appends an event, setting its time if unset
+func (l *Logger) Record(event Event) error {
+	if l == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Audit entries may reveal what is deployed, keep them private to the daemon
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if l.forward != nil {
+		l.forward(event)
+	}
+	return nil
+}
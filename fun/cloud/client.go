@@ -3,47 +3,243 @@ package cloud
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"sync"
 	"time"
+
+	"fun/tlsconfig"
 )
 
 // Client represents a Fun cloud client
 type Client struct {
-	baseURL    string
 	apiKey     string
 	httpClient *http.Client
+	transport  *http.Transport
+	// hostID identifies the host across hostname changes
+	hostID string
+
+	// endpoints are the primary URL and its fallbacks, requests go to the active one
+	mutex     sync.Mutex
+	endpoints []string
+	active    int
+	// endpointPath keeps the URL of the active endpoint across restarts
+	endpointPath string
+	// lastContact is when the orchestrator last responded
+	lastContact time.Time
+
+	// desiredState is the last fetched desired state, cached in desiredStatePath
+	desiredState     *DesiredState
+	desiredStatePath string
+
+	// compression is the request body encoding, limits what the orchestrator announced
+	compression string
+	limits      *UploadLimits
 }
 
+// HostIDHeader carries the persistent host ID on every request
+const HostIDHeader = "X-Fun-Host-ID"
+
 // RegistrationRequest represents a host registration request
 type RegistrationRequest struct {
-	Hostname     string   `json:"hostname"`
+	HostID   string `json:"host_id,omitempty"`
+	Hostname string `json:"hostname"`
+	// PreviousHostname is set when the host re-registers after a hostname change
+	PreviousHostname string `json:"previous_hostname,omitempty"`
+
 	IPAddress    string   `json:"ip_address"`
 	Architecture string   `json:"architecture"`
 	OS           string   `json:"os"`
 	Labels       []string `json:"labels"`
 	Version      string   `json:"version"`
+
+	Capacity    *Resources `json:"capacity,omitempty"`
+	Allocatable *Resources `json:"allocatable,omitempty"`
+	// Topology lets the orchestrator pin workloads to CPUs and NUMA nodes
+	Topology *Topology `json:"topology,omitempty"`
+}
+
+// Resources is an amount of CPU and memory
+type Resources struct {
+	CPUs        float64 `json:"cpus"`
+	MemoryBytes int64   `json:"memory_bytes"`
+}
+
+// Topology is the NUMA layout of a host
+type Topology struct {
+	NUMANodes []NUMANode `json:"numa_nodes"`
+}
+
+// NUMANode is a memory node and the CPUs local to it
+type NUMANode struct {
+	ID   int   `json:"id"`
+	CPUs []int `json:"cpus"`
 }
 
 // StatusUpdateRequest represents a status update request
 type StatusUpdateRequest struct {
+	HostID      string  `json:"host_id,omitempty"`
 	Hostname    string  `json:"hostname"`
 	Status      string  `json:"status"`
 	MemoryUsage float64 `json:"memory_usage"`
 	CPUUsage    float64 `json:"cpu_usage"`
 	DiskUsage   float64 `json:"disk_usage"`
+
+	// Allocatable is what remains for workloads after the host reservation,
+	// Allocated is the sum of the running containers' limits
+	Allocatable *Resources `json:"allocatable,omitempty"`
+	Allocated   *Resources `json:"allocated,omitempty"`
+
+	Containers []ContainerReport `json:"containers,omitempty"`
+
+	// Usage is the per-project consumption since the previous status update
+	Usage *UsageReport `json:"usage,omitempty"`
+
+	// Endpoint is the orchestrator URL the host currently talks to
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// GitOps is the outcome of the last sync, for hosts that follow a repository
+	GitOps *GitOpsStatus `json:"gitops,omitempty"`
+
+	// FleetUpdatedAt is when the host's peer group was last sent, the
+	// orchestrator resends it when it is outdated
+	FleetUpdatedAt *time.Time `json:"fleet_updated_at,omitempty"`
+}
+
+// GitOpsStatus is the outcome of the last sync from a Git repository
+type GitOpsStatus struct {
+	Repo     string          `json:"repo"`
+	Branch   string          `json:"branch"`
+	Commit   string          `json:"commit,omitempty"`
+	LastSync time.Time       `json:"last_sync"`
+	Error    string          `json:"error,omitempty"`
+	Projects []GitOpsProject `json:"projects,omitempty"`
+}
+
+// GitOpsProject is the sync outcome of one project, Drift lists the containers
+// that differed from the repository and were reconciled
+type GitOpsProject struct {
+	Project  string   `json:"project"`
+	Drift    []string `json:"drift,omitempty"`
+	Revision int      `json:"revision,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// UsageReport is the resource consumption of each project over a period
+type UsageReport struct {
+	PeriodStart time.Time      `json:"period_start"`
+	PeriodEnd   time.Time      `json:"period_end"`
+	Projects    []ProjectUsage `json:"projects"`
+}
+
+// ProjectUsage is the consumption of a single project, for billing and chargeback
+type ProjectUsage struct {
+	Project         string  `json:"project"`
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	MemoryByteHours float64 `json:"memory_byte_hours"`
+	NetworkRxBytes  uint64  `json:"network_rx_bytes"`
+	NetworkTxBytes  uint64  `json:"network_tx_bytes"`
+}
+
+// ContainerReport describes the state of a single container in a status update
+type ContainerReport struct {
+	ID           string `json:"id"`
+	Image        string `json:"image"`
+	Status       string `json:"status"`
+	RestartCount int    `json:"restart_count"`
+	CrashLooping bool   `json:"crash_looping"`
+	Priority     string `json:"priority,omitempty"`
+	// Preempted is why the container was stopped to relieve resource pressure
+	Preempted string `json:"preempted,omitempty"`
+
+	// Last termination, so OOM kills can be told apart from application crashes
+	ExitCode          *uint32 `json:"exit_code,omitempty"`
+	OOMKilled         bool    `json:"oom_killed"`
+	TerminationReason string  `json:"termination_reason,omitempty"`
+
+	// Critical containers also report their uptime and probe state in every update
+	Critical      bool             `json:"critical,omitempty"`
+	UptimeSeconds int64            `json:"uptime_seconds,omitempty"`
+	Health        *ContainerHealth `json:"health,omitempty"`
+}
+
+// ContainerHealth is the probe state of a container, for containers with a health check
+type ContainerHealth struct {
+	Started   bool      `json:"started"`
+	Ready     bool      `json:"ready"`
+	Live      bool      `json:"live"`
+	LastProbe time.Time `json:"last_probe"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Alert types
+const (
+	// AlertCriticalContainerExit is sent when a critical container exits
+	AlertCriticalContainerExit = "critical_container_exit"
+	// AlertCrashLoop is sent when a container starts crash-looping
+	AlertCrashLoop = "crash_loop"
+	// AlertPreemption is sent when a container was stopped to relieve resource pressure
+	AlertPreemption = "preemption"
+	// AlertHostPressure is sent when the host runs low on memory or disk, or the OOM killer ran
+	AlertHostPressure = "host_pressure"
+)
+
+// Alert is an event sent out of band, without waiting for the next status update
+type Alert struct {
+	Type        string    `json:"type"`
+	ContainerID string    `json:"container_id,omitempty"`
+	ExitCode    *uint32   `json:"exit_code,omitempty"`
+	OOMKilled   bool      `json:"oom_killed"`
+	Reason      string    `json:"reason,omitempty"`
+	Time        time.Time `json:"time"`
+	// DebugBundle is the directory on the host holding the debug bundle of the container
+	DebugBundle string `json:"debug_bundle,omitempty"`
+	// Pressure is the kind of host pressure alerts: oom, memory or disk
+	Pressure string `json:"pressure,omitempty"`
 }
 
 // New creates a new cloud client
 func New(baseURL, apiKey string) *Client {
+	transport := tlsconfig.NewTransport(nil)
 	return &Client{
-		baseURL: baseURL,
-		apiKey:  apiKey,
+		apiKey:    apiKey,
+		endpoints: []string{baseURL},
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: transport,
 		},
+		transport: transport,
+	}
+}
+
+// SetTLSConfig restricts the TLS versions and cipher suites used to reach the cloud
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.transport.TLSClientConfig = config
+}
+
+// SetDialContext routes connections to the cloud through dial, such as a tunnel
+// through a jump host. Proxies from the environment are ignored then.
+func (c *Client) SetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	c.transport.DialContext = dial
+	c.transport.Proxy = nil
+}
+
+// SetHostID sends the persistent host ID with every request, so the orchestrator
+// tracks the host even if its hostname collides with another or changes
+func (c *Client) SetHostID(id string) {
+	c.hostID = id
+}
+
+// authorize sets the API key and host ID headers of a request
+func (c *Client) authorize(httpReq *http.Request) {
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	if c.hostID != "" {
+		httpReq.Header.Set(HostIDHeader, c.hostID)
 	}
 }
 
@@ -56,7 +252,7 @@ func (c *Client) RegisterHost(ctx context.Context, req *RegistrationRequest) err
 	}
 
 	// Create HTTP request
-	url := fmt.Sprintf("%s/api/v1/hosts/register", c.baseURL)
+	url := fmt.Sprintf("%s/api/v1/hosts/register", c.Endpoint())
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("failed to create HTTP request: %w", err)
@@ -64,10 +260,10 @@ func (c *Client) RegisterHost(ctx context.Context, req *RegistrationRequest) err
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	c.authorize(httpReq)
 
 	// Send request
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send HTTP request: %w", err)
 	}
@@ -91,7 +287,7 @@ func (c *Client) UpdateStatus(ctx context.Context, req *StatusUpdateRequest) err
 	}
 
 	// Create HTTP request
-	url := fmt.Sprintf("%s/api/v1/hosts/%s/status", c.baseURL, req.Hostname)
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/status", c.Endpoint(), req.Hostname)
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("failed to create HTTP request: %w", err)
@@ -99,10 +295,10 @@ func (c *Client) UpdateStatus(ctx context.Context, req *StatusUpdateRequest) err
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	c.authorize(httpReq)
 
 	// Send request
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send HTTP request: %w", err)
 	}
@@ -116,3 +312,412 @@ func (c *Client) UpdateStatus(ctx context.Context, req *StatusUpdateRequest) err
 
 	return nil
 }
+
+// Command types the orchestrator can send to a host
+const (
+	// CommandRollback restores an earlier deployment revision, the previous one if Revision is 0
+	CommandRollback = "rollback"
+	// CommandReboot drains the host's containers and reboots it within the maintenance window
+	CommandReboot = "reboot"
+	// CommandShutdown drains the host's containers and powers it off within the maintenance window
+	CommandShutdown = "shutdown"
+	// CommandTrustPolicy replaces the host's content trust policy with Policy
+	CommandTrustPolicy = "trust_policy"
+	// CommandCriticalContainers replaces the set of critical containers with Containers
+	CommandCriticalContainers = "critical_containers"
+	// CommandDeploy applies the desired state State as a new deployment revision
+	CommandDeploy = "deploy"
+	// CommandFleet replaces the host's peer group with Fleet
+	CommandFleet = "fleet"
+	// CommandPrePull hints at Images the orchestrator plans to schedule on the
+	// host, which pulls them while idle until WindowEnd
+	CommandPrePull = "pre_pull"
+)
+
+// Command is an action queued by the orchestrator for a host
+type Command struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Revision int    `json:"revision,omitempty"`
+	// Project is the project a deploy or rollback command is for, empty for
+	// the host's global state
+	Project string `json:"project,omitempty"`
+
+	// Maintenance window of power commands, zero values leave it open. Pre-pull
+	// hints are dropped after WindowEnd.
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	// DrainTimeout is how long containers get to stop, in seconds
+	DrainTimeout int `json:"drain_timeout,omitempty"`
+
+	// Policy is the content trust policy of trust policy commands
+	Policy json.RawMessage `json:"policy,omitempty"`
+
+	// Containers are the IDs of critical container commands, alerts are sent as soon as they exit
+	Containers []string `json:"containers,omitempty"`
+
+	// State is the desired state of deploy commands
+	State json.RawMessage `json:"state,omitempty"`
+	// Message describes the deployment in the host's deployment history
+	Message string `json:"message,omitempty"`
+
+	// Fleet is the peer group of fleet commands
+	Fleet *FleetGroup `json:"fleet,omitempty"`
+
+	// Images are the image references of pre-pull commands
+	Images []string `json:"images,omitempty"`
+
+	// Signed is the SignedCommand the orchestrator signed for this command and
+	// Signature its base64 detached signature. Hosts configured with manifest
+	// signing keys require them and execute the signed command, whatever the
+	// other fields say.
+	Signed    json.RawMessage `json:"signed,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// SignedCommand is the document the orchestrator signs for a command. Besides
+// the command and its project it names the host the command is for, and a
+// nonce and expiry so the command is only executed once.
+type SignedCommand struct {
+	Command
+	// Host is the ID of the host the command is for
+	Host    string    `json:"host"`
+	Nonce   string    `json:"nonce"`
+	Expires time.Time `json:"expires"`
+}
+
+// FleetGroup is the group of funserver hosts a host belongs to, such as the hosts of a project
+type FleetGroup struct {
+	Name    string `json:"name"`
+	Project string `json:"project,omitempty"`
+	// Peers are the other hosts of the group
+	Peers     []FleetPeer `json:"peers"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// FleetPeer is another host of a fleet group
+type FleetPeer struct {
+	HostID    string   `json:"host_id"`
+	Hostname  string   `json:"hostname"`
+	Addresses []string `json:"addresses,omitempty"`
+	// MeshPublicKey and MeshEndpoint are the WireGuard public key and host:port of the peer
+	MeshPublicKey string    `json:"mesh_public_key,omitempty"`
+	MeshEndpoint  string    `json:"mesh_endpoint,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// CommandProgress reports an intermediate stage of a long running command
+type CommandProgress struct {
+	Stage   string `json:"stage"`
+	Message string `json:"message,omitempty"`
+}
+
+// commandConfirmation is the response to a confirmation request
+type commandConfirmation struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+// CommandResult reports the outcome of a command back to the orchestrator
+type CommandResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	// Rejection is set when a container was refused for lack of resources
+	Rejection *AdmissionRejection `json:"rejection,omitempty"`
+	// Violations are the rules of the host's command policy the command broke
+	Violations []PolicyViolation `json:"violations,omitempty"`
+}
+
+// PolicyViolation is a rule of the host's command policy a command broke
+type PolicyViolation struct {
+	// Rule is "command", "registry" or "device"
+	Rule    string `json:"rule"`
+	Subject string `json:"subject"`
+	Reason  string `json:"reason"`
+}
+
+// AdmissionRejection describes why the host refused to place a container
+type AdmissionRejection struct {
+	// Resource is "cpu", "memory" or "disk"
+	Resource string `json:"resource"`
+	// Requested and Available are in CPUs for cpu and bytes otherwise
+	Requested float64 `json:"requested"`
+	Available float64 `json:"available"`
+	Reason    string  `json:"reason"`
+}
+
+// FetchCommands returns the commands queued for the host
+func (c *Client) FetchCommands(ctx context.Context, hostname string) ([]Command, error) {
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/commands", c.Endpoint(), hostname)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch commands: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	var commands []Command
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, fmt.Errorf("failed to decode commands: %w", err)
+	}
+	return commands, nil
+}
+
+// ReportCommandResult tells the orchestrator how a command ended
+func (c *Client) ReportCommandResult(ctx context.Context, hostname, commandID string, result *CommandResult) error {
+	// Marshal request to JSON
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command result: %w", err)
+	}
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/commands/%s/result", c.Endpoint(), hostname, commandID)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to report command result: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ConfirmCommand asks the orchestrator whether a command should still be carried out
+func (c *Client) ConfirmCommand(ctx context.Context, hostname, commandID string) (bool, error) {
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/commands/%s/confirm", c.Endpoint(), hostname, commandID)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return false, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("failed to confirm command: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	var confirmation commandConfirmation
+	if err := json.NewDecoder(resp.Body).Decode(&confirmation); err != nil {
+		return false, fmt.Errorf("failed to decode confirmation: %w", err)
+	}
+	return confirmation.Confirmed, nil
+}
+
+// ReportCommandProgress reports the current stage of a command to the orchestrator
+func (c *Client) ReportCommandProgress(ctx context.Context, hostname, commandID string, progress *CommandProgress) error {
+	// Marshal request to JSON
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command progress: %w", err)
+	}
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/commands/%s/progress", c.Endpoint(), hostname, commandID)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to report command progress: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// HostInventory lists the host software the orchestrator checks for known vulnerabilities
+type HostInventory struct {
+	CollectedAt     time.Time         `json:"collected_at"`
+	OS              string            `json:"os"`
+	OSVersion       string            `json:"os_version"`
+	KernelVersion   string            `json:"kernel_version"`
+	PackageManager  string            `json:"package_manager,omitempty"`
+	SecurityUpdates []PackageUpdate   `json:"security_updates"`
+	Runtimes        map[string]string `json:"runtimes"`
+	AgentVersion    string            `json:"agent_version"`
+	Devices         []HostDevice      `json:"devices,omitempty"`
+}
+
+// HostDevice is a USB or serial device plugged into the host
+type HostDevice struct {
+	Path         string `json:"path"`
+	Kind         string `json:"kind"`
+	VendorID     string `json:"vendor_id,omitempty"`
+	ProductID    string `json:"product_id,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	ByID         string `json:"by_id,omitempty"`
+}
+
+// PackageUpdate is a pending security update of an installed package
+type PackageUpdate struct {
+	Name             string `json:"name"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	AvailableVersion string `json:"available_version,omitempty"`
+}
+
+// ReportInventory sends the host software inventory to the orchestrator
+func (c *Client) ReportInventory(ctx context.Context, hostname string, inventory *HostInventory) error {
+	// Marshal request to JSON
+	data, err := json.Marshal(inventory)
+	if err != nil {
+		return fmt.Errorf("failed to marshal inventory: %w", err)
+	}
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/inventory", c.Endpoint(), hostname)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to report inventory: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// AttachSBOM attaches a container's SBOM to a deployment record for compliance
+func (c *Client) AttachSBOM(ctx context.Context, hostname string, revision int, containerID, format string, document []byte) error {
+	// Documents over the request limit are uploaded in chunks first and referred to
+	query := neturl.Values{"container": {containerID}, "format": {format}}
+	if int64(len(document)) > c.UploadLimits(ctx).MaxRequestBytes {
+		id, err := c.Upload(ctx, hostname, "sbom", document)
+		if err != nil {
+			return err
+		}
+		query.Set("upload", id)
+		document = nil
+	}
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/deployments/%d/sbom?%s", c.Endpoint(), hostname, revision, query.Encode())
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(document))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to attach SBOM: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SendAlert sends an alert about the host to the orchestrator
+func (c *Client) SendAlert(ctx context.Context, hostname string, alert *Alert) error {
+	// Marshal request to JSON
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %w", err)
+	}
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/alerts", c.Endpoint(), hostname)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.authorize(httpReq)
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to send alert: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SignatureHeader carries the base64 detached signature of a desired-state document
+const SignatureHeader = "X-Fun-Signature"
+
+// maxDesiredState bounds the size of desired-state documents
+const maxDesiredState = 16 << 20
+
+// DesiredState is the desired-state document the orchestrator serves for a host
+type DesiredState struct {
+	// ETag identifies the version, unchanged documents aren't sent again
+	ETag string `json:"etag,omitempty"`
+	// State is the document exactly as served, so its Signature can be verified
+	State     json.RawMessage `json:"state"`
+	Signature string          `json:"signature,omitempty"`
+	FetchedAt time.Time       `json:"fetched_at"`
+}
+
+// SetDesiredStateCache keeps the last fetched desired state in path, so it
+// survives restarts and can be reconciled against while the orchestrator is down
+func (c *Client) SetDesiredStateCache(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.desiredStatePath = path
+	c.desiredState = nil
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read desired state cache: %w", err)
+	}
+	var cached DesiredState
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return fmt.Errorf("failed to parse desired state cache: %w", err)
+	}
+	c.desiredState = &cached
+	return nil
+}
+
+// CachedDesiredState returns the last fetched desired state, nil if there is none
+func (c *Client) CachedDesiredState() *DesiredState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.desiredState
+}
+
+// FetchDesiredState returns the desired state of the host and whether it
+// changed since the last fetch. Unchanged states are answered with 304 Not
+// Modified and served from the cache. It returns nil if the orchestrator has no
+// desired state for the host, and forgets the cached one.
+func (c *Client) FetchDesiredState(ctx context.Context, hostname string) (*DesiredState, bool, error) {
+	cached := c.CachedDesiredState()
+
+	// Create HTTP request
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/desired-state", c.Endpoint(), hostname)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	c.authorize(httpReq)
+	if cached != nil && cached.ETag != "" {
+		httpReq.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	// Send request
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if cached == nil {
+			return nil, false, fmt.Errorf("orchestrator answered not modified without a cached desired state")
+		}
+		return cached, false, nil
+	case http.StatusNotFound, http.StatusNoContent:
+		// A withdrawn state must not be reconciled against after a restart
+		if err := c.cacheDesiredState(nil); err != nil {
+			return nil, false, err
+		}
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, false, fmt.Errorf("failed to fetch desired state: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDesiredState+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read desired state: %w", err)
+	}
+	if len(data) > maxDesiredState {
+		return nil, false, fmt.Errorf("desired state exceeds %d bytes", maxDesiredState)
+	}
+	if !json.Valid(data) {
+		return nil, false, fmt.Errorf("desired state is not valid JSON")
+	}
+
+	fetched := &DesiredState{
+		ETag:      resp.Header.Get("ETag"),
+		State:     data,
+		Signature: resp.Header.Get(SignatureHeader),
+		FetchedAt: time.Now(),
+	}
+	changed := cached == nil || fetched.ETag != cached.ETag
+	if cached != nil && fetched.ETag == "" {
+		// Servers without ETags send the full document on every poll, compare it instead
+		changed = string(cached.State) != string(data) || cached.Signature != fetched.Signature
+	}
+	if !changed {
+		return cached, false, nil
+	}
+	if err := c.cacheDesiredState(fetched); err != nil {
+		return nil, false, err
+	}
+	return fetched, true, nil
+}
+
+// cacheDesiredState remembers state and writes it to the cache file
+// atomically, a nil state removes the cache file
+func (c *Client) cacheDesiredState(state *DesiredState) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.desiredState = state
+	if c.desiredStatePath == "" {
+		return nil
+	}
+	if state == nil {
+		if err := os.Remove(c.desiredStatePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove desired state cache: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal desired state cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.desiredStatePath), 0700); err != nil {
+		return fmt.Errorf("failed to create desired state cache directory: %w", err)
+	}
+	tmpPath := c.desiredStatePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write desired state cache: %w", err)
+	}
+	return os.Rename(tmpPath, c.desiredStatePath)
+}
@@ -0,0 +1,222 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// healthPath is probed to tell whether an orchestrator endpoint is reachable
+const healthPath = "/api/v1/health"
+
+// SetFallbackURLs adds orchestrator endpoints, such as other regions, that are
+// tried in order when the primary one fails
+func (c *Client) SetFallbackURLs(urls []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.endpoints = append(c.endpoints[:1], urls...)
+	c.active = 0
+}
+
+// SetEndpointState keeps the active endpoint in path, and resumes on the one
+// recorded there if it is still configured, so a restarted agent doesn't go
+// back to an endpoint it already failed over from. Call it after SetFallbackURLs.
+func (c *Client) SetEndpointState(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.endpointPath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cloud endpoint state: %w", err)
+	}
+	endpoint := strings.TrimSpace(string(data))
+	for i, url := range c.endpoints {
+		if url == endpoint {
+			c.active = i
+			return nil
+		}
+	}
+	return nil
+}
+
+// saveEndpoint writes the active endpoint to the state file, c.mutex is held
+func (c *Client) saveEndpoint() error {
+	if c.endpointPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.endpointPath), 0700); err != nil {
+		return fmt.Errorf("failed to create cloud endpoint state directory: %w", err)
+	}
+	tmpPath := c.endpointPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(c.endpoints[c.active]+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write cloud endpoint state: %w", err)
+	}
+	return os.Rename(tmpPath, c.endpointPath)
+}
+
+// Endpoint returns the URL requests currently go to
+// It stays on the last endpoint that worked until that one fails too.
+func (c *Client) Endpoint() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.endpoints[c.active]
+}
+
+// CheckEndpoints probes the endpoints preferred over the active one and fails
+// back to the first healthy one, so hosts return to the primary once it recovers
+func (c *Client) CheckEndpoints(ctx context.Context) {
+	c.mutex.Lock()
+	endpoints, active := c.endpoints, c.active
+	c.mutex.Unlock()
+
+	for i := 0; i < active; i++ {
+		if c.healthy(ctx, endpoints[i]) {
+			c.switchEndpoint(active, i)
+			return
+		}
+	}
+}
+
+// healthy reports whether an endpoint answers, any response below 500 counts
+func (c *Client) healthy(ctx context.Context, endpoint string) bool {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", endpoint+healthPath, nil)
+	if err != nil {
+		return false
+	}
+	c.authorize(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// switchEndpoint moves requests from one endpoint to another, unless another request switched already
+func (c *Client) switchEndpoint(from, to int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active != from {
+		return
+	}
+	log.Printf("Switching cloud endpoint from %s to %s", c.endpoints[from], c.endpoints[to])
+	c.active = to
+	if err := c.saveEndpoint(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// do sends a request built for the active endpoint, compressing its body if
+// the orchestrator accepts that. If that endpoint can't be
+// reached or its gateway fails, idempotent requests are retried on the other
+// endpoints in order and the first one that answers becomes the active one.
+// Others, such as alerts and command results, fail instead of risking being
+// handled twice; CheckEndpoints and the next idempotent request move them.
+func (c *Client) do(httpReq *http.Request) (*http.Response, error) {
+	resp, err := c.send(httpReq)
+	// Any answer short of a server error shows the orchestrator can be reached
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		c.mutex.Lock()
+		c.lastContact = time.Now()
+		c.mutex.Unlock()
+	}
+	return resp, err
+}
+
+// LastContact returns when the orchestrator last responded, zero if it never did
+func (c *Client) LastContact() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastContact
+}
+
+// send sends a request to the active endpoint, failing over to the fallbacks
+func (c *Client) send(httpReq *http.Request) (*http.Response, error) {
+	if err := c.compressRequest(httpReq); err != nil {
+		return nil, fmt.Errorf("failed to compress request: %w", err)
+	}
+
+	c.mutex.Lock()
+	endpoints, active := c.endpoints, c.active
+	c.mutex.Unlock()
+
+	resp, err := c.httpClient.Do(httpReq)
+	if len(endpoints) == 1 || !idempotent(httpReq) || !endpointFailed(httpReq, resp, err) {
+		return resp, err
+	}
+
+	path := strings.TrimPrefix(httpReq.URL.String(), endpoints[active])
+	for i := 1; i < len(endpoints); i++ {
+		next := (active + i) % len(endpoints)
+		retry, retryErr := rebaseRequest(httpReq, endpoints[next]+path)
+		if retryErr != nil {
+			break
+		}
+		retryResp, retryErr := c.httpClient.Do(retry)
+		if endpointFailed(retry, retryResp, retryErr) {
+			if retryResp != nil {
+				retryResp.Body.Close()
+			}
+			continue
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.switchEndpoint(active, next)
+		return retryResp, retryErr
+	}
+	return resp, err
+}
+
+// idempotent reports whether a request can be sent again without its effect
+// applying twice, should the endpoint that failed have handled it after all
+func idempotent(httpReq *http.Request) bool {
+	switch httpReq.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// endpointFailed tells endpoint failures apart from errors of the request itself
+func endpointFailed(httpReq *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return httpReq.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// rebaseRequest copies a request for another endpoint, with a fresh body
+func rebaseRequest(httpReq *http.Request, url string) (*http.Request, error) {
+	target, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	retry := httpReq.Clone(httpReq.Context())
+	retry.URL = target
+	retry.Host = ""
+	if httpReq.Body != nil {
+		if httpReq.GetBody == nil {
+			return nil, fmt.Errorf("request body can't be sent again")
+		}
+		if retry.Body, err = httpReq.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return retry, nil
+}
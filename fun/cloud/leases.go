@@ -0,0 +1,52 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Lease is a named lock the orchestrator grants to one host of a fleet group at a time
+type Lease struct {
+	Name string `json:"name"`
+	// HolderID and Holder are the host ID and hostname of the holder
+	HolderID  string    `json:"holder_id"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// leaseRequest is the body of lease acquisitions
+type leaseRequest struct {
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// AcquireLease acquires or renews a lease of the host's fleet group for ttl.
+// The orchestrator grants it if it is free, expired or already held by the
+// host, and otherwise returns the current holder.
+func (c *Client) AcquireLease(ctx context.Context, hostname, name string, ttl time.Duration) (*Lease, error) {
+	var lease Lease
+	err := c.postJSON(ctx, c.leaseURL(hostname, name), leaseRequest{TTLSeconds: int(ttl / time.Second)}, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease %s: %w", name, err)
+	}
+	return &lease, nil
+}
+
+// ReleaseLease gives up a lease the host holds, so another host can take over right away
+func (c *Client) ReleaseLease(ctx context.Context, hostname, name string) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "DELETE", c.leaseURL(hostname, name), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if err := c.doJSON(httpReq, nil); err != nil {
+		return fmt.Errorf("failed to release lease %s: %w", name, err)
+	}
+	return nil
+}
+
+// leaseURL returns the URL of a lease of the host's group
+func (c *Client) leaseURL(hostname, name string) string {
+	return fmt.Sprintf("%s/api/v1/hosts/%s/leases/%s", c.Endpoint(), hostname, url.PathEscape(name))
+}
@@ -0,0 +1,597 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Simulator is an in-memory orchestrator implementing the host API, for testing
+// cloud driven flows of the agent without a real orchestrator. Commands are queued
+// through its control API under /sim/v1.
+type Simulator struct {
+	mutex  sync.Mutex
+	hosts  map[string]*SimulatedHost
+	nextID int
+	// confirm is the answer to command confirmations
+	confirm bool
+	// uploads are the chunked uploads by ID
+	uploads map[string]*simulatedUpload
+	// leases are granted by name, all simulated hosts form one group
+	leases map[string]*Lease
+}
+
+// simulatedUpload is a chunked upload in progress or completed
+type simulatedUpload struct {
+	start    uploadStart
+	data     []byte
+	complete bool
+}
+
+// SimulatedHost is what the simulator knows about a host
+type SimulatedHost struct {
+	Registration *RegistrationRequest         `json:"registration,omitempty"`
+	Status       *StatusUpdateRequest         `json:"status,omitempty"`
+	Inventory    *HostInventory               `json:"inventory,omitempty"`
+	LastSeen     time.Time                    `json:"last_seen"`
+	Pending      []Command                    `json:"pending"`
+	Results      map[string]*CommandResult    `json:"results"`
+	Progress     map[string][]CommandProgress `json:"progress"`
+	SBOMs        []SimulatedSBOM              `json:"sboms"`
+	Alerts       []Alert                      `json:"alerts"`
+	// Telemetry are the forwarded records, TelemetryDropped those the host discarded
+	Telemetry        []TelemetryRecord `json:"telemetry"`
+	TelemetryDropped uint64            `json:"telemetry_dropped,omitempty"`
+	// DesiredState is served to the host, DesiredStateVersion is its ETag
+	DesiredState        json.RawMessage `json:"desired_state,omitempty"`
+	DesiredStateVersion int             `json:"desired_state_version,omitempty"`
+}
+
+// SimulatedSBOM is an SBOM attached to a deployment record
+type SimulatedSBOM struct {
+	Revision    int    `json:"revision"`
+	ContainerID string `json:"container_id"`
+	Format      string `json:"format"`
+	Size        int    `json:"size"`
+}
+
+// NewSimulator creates a simulator that confirms all commands
+func NewSimulator() *Simulator {
+	return &Simulator{
+		hosts:   make(map[string]*SimulatedHost),
+		confirm: true,
+		uploads: make(map[string]*simulatedUpload),
+		leases:  make(map[string]*Lease),
+	}
+}
+
+// Enqueue queues a command for a host, assigning an ID if it has none
+func (s *Simulator) Enqueue(hostname string, command Command) Command {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if command.ID == "" {
+		s.nextID++
+		command.ID = fmt.Sprintf("sim-%d", s.nextID)
+	}
+	host := s.host(hostname)
+	host.Pending = append(host.Pending, command)
+	return command
+}
+
+// SetConfirm sets the answer to command confirmations, to simulate cancellations
+func (s *Simulator) SetConfirm(confirm bool) {
+	s.mutex.Lock()
+	s.confirm = confirm
+	s.mutex.Unlock()
+}
+
+// Hosts returns what the simulator knows about the hosts, as JSON
+func (s *Simulator) Hosts() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return json.MarshalIndent(s.hosts, "", "  ")
+}
+
+// host returns the state of a host, creating it on first contact
+// The caller must hold the mutex.
+func (s *Simulator) host(hostname string) *SimulatedHost {
+	host, ok := s.hosts[hostname]
+	if !ok {
+		host = &SimulatedHost{
+			Pending:  []Command{},
+			Results:  make(map[string]*CommandResult),
+			Progress: make(map[string][]CommandProgress),
+			SBOMs:    []SimulatedSBOM{},
+			Alerts:   []Alert{},
+		}
+		s.hosts[hostname] = host
+	}
+	host.LastSeen = time.Now()
+	return host
+}
+
+// Handler returns the HTTP handler implementing the host and control APIs
+func (s *Simulator) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/v1/health", s.handleHealth)
+	mux.HandleFunc("GET /api/v1/uploads/limits", s.handleUploadLimits)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/uploads", s.handleStartUpload)
+	mux.HandleFunc("GET /api/v1/hosts/{hostname}/uploads/{id}", s.handleUploadState)
+	mux.HandleFunc("PUT /api/v1/hosts/{hostname}/uploads/{id}", s.handleUploadChunk)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/uploads/{id}/complete", s.handleCompleteUpload)
+	mux.HandleFunc("POST /api/v1/hosts/register", s.handleRegister)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/status", s.handleStatus)
+	mux.HandleFunc("GET /api/v1/hosts/{hostname}/commands", s.handleFetchCommands)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/commands/{id}/result", s.handleCommandResult)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/commands/{id}/confirm", s.handleConfirm)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/commands/{id}/progress", s.handleProgress)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/inventory", s.handleInventory)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/deployments/{revision}/sbom", s.handleSBOM)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/alerts", s.handleAlert)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/telemetry", s.handleTelemetry)
+	mux.HandleFunc("POST /api/v1/hosts/{hostname}/leases/{name}", s.handleAcquireLease)
+	mux.HandleFunc("DELETE /api/v1/hosts/{hostname}/leases/{name}", s.handleReleaseLease)
+	mux.HandleFunc("GET /api/v1/hosts/{hostname}/desired-state", s.handleDesiredState)
+
+	mux.HandleFunc("GET /sim/v1/hosts", s.handleListHosts)
+	mux.HandleFunc("POST /sim/v1/hosts/{hostname}/commands", s.handleEnqueue)
+	mux.HandleFunc("PUT /sim/v1/confirm", s.handleSetConfirm)
+	mux.HandleFunc("PUT /sim/v1/hosts/{hostname}/desired-state", s.handleSetDesiredState)
+
+	return decompressBodies(mux)
+}
+
+func (s *Simulator) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleUploadLimits(w http.ResponseWriter, r *http.Request) {
+	writeSimJSON(w, UploadLimits{
+		MaxRequestBytes: 1 << 20,
+		ChunkSize:       256 << 10,
+		Encodings:       []string{EncodingGzip, EncodingZstd},
+	})
+}
+
+func (s *Simulator) handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	var start uploadStart
+	if !decodeSimRequest(w, r, &start) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &simulatedUpload{start: start}
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: %s upload %s of %d bytes started by %s", start.Kind, id, start.Size, r.PathValue("hostname"))
+	writeSimJSON(w, upload{ID: id})
+}
+
+func (s *Simulator) handleUploadState(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, ok := s.uploads[r.PathValue("id")]
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	writeSimJSON(w, upload{ID: r.PathValue("id"), Offset: int64(len(u.data))})
+}
+
+func (s *Simulator) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, ok := s.uploads[r.PathValue("id")]
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	// Chunks must continue where the upload stands, resent chunks are ignored
+	if start != int64(len(u.data)) || end-start+1 != int64(len(data)) {
+		http.Error(w, fmt.Sprintf("expected a chunk starting at byte %d", len(u.data)), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	u.data = append(u.data, data...)
+	writeSimJSON(w, upload{ID: r.PathValue("id"), Offset: int64(len(u.data))})
+}
+
+func (s *Simulator) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, ok := s.uploads[r.PathValue("id")]
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	sum := sha256.Sum256(u.data)
+	if int64(len(u.data)) != u.start.Size || hex.EncodeToString(sum[:]) != u.start.SHA256 {
+		http.Error(w, "upload is incomplete or corrupted", http.StatusBadRequest)
+		return
+	}
+	u.complete = true
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadedData returns the decompressed payload of a completed upload
+func (s *Simulator) uploadedData(id string) ([]byte, error) {
+	s.mutex.Lock()
+	u, ok := s.uploads[id]
+	s.mutex.Unlock()
+	if !ok || !u.complete {
+		return nil, fmt.Errorf("upload %s not found or incomplete", id)
+	}
+	reader, err := decompress(bytes.NewReader(u.data), u.start.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (s *Simulator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegistrationRequest
+	if !decodeSimRequest(w, r, &req) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.host(req.Hostname).Registration = &req
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: host %s registered (%s/%s, agent %s)", req.Hostname, req.OS, req.Architecture, req.Version)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var req StatusUpdateRequest
+	if !decodeSimRequest(w, r, &req) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.host(r.PathValue("hostname")).Status = &req
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: status of %s: %s, %d containers", r.PathValue("hostname"), req.Status, len(req.Containers))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleFetchCommands(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	commands := host.Pending
+	host.Pending = []Command{}
+	s.mutex.Unlock()
+
+	for _, command := range commands {
+		log.Printf("Simulator: delivering command %s (%s) to %s", command.ID, command.Type, r.PathValue("hostname"))
+	}
+	writeSimJSON(w, commands)
+}
+
+func (s *Simulator) handleCommandResult(w http.ResponseWriter, r *http.Request) {
+	var result CommandResult
+	if !decodeSimRequest(w, r, &result) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.host(r.PathValue("hostname")).Results[r.PathValue("id")] = &result
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: command %s finished: success=%t %s", r.PathValue("id"), result.Success, result.Message)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.host(r.PathValue("hostname"))
+	confirmed := s.confirm
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: confirmation of command %s: %t", r.PathValue("id"), confirmed)
+	writeSimJSON(w, commandConfirmation{Confirmed: confirmed})
+}
+
+func (s *Simulator) handleProgress(w http.ResponseWriter, r *http.Request) {
+	var progress CommandProgress
+	if !decodeSimRequest(w, r, &progress) {
+		return
+	}
+
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	host.Progress[r.PathValue("id")] = append(host.Progress[r.PathValue("id")], progress)
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: command %s progress: %s %s", r.PathValue("id"), progress.Stage, progress.Message)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleInventory(w http.ResponseWriter, r *http.Request) {
+	var inventory HostInventory
+	if !decodeSimRequest(w, r, &inventory) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.host(r.PathValue("hostname")).Inventory = &inventory
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: inventory of %s: %s, %d security updates", r.PathValue("hostname"), inventory.OSVersion, len(inventory.SecurityUpdates))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleSBOM(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id := r.URL.Query().Get("upload"); id != "" {
+		if data, err = s.uploadedData(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var revision int
+	fmt.Sscanf(r.PathValue("revision"), "%d", &revision)
+	sbom := SimulatedSBOM{
+		Revision:    revision,
+		ContainerID: r.URL.Query().Get("container"),
+		Format:      r.URL.Query().Get("format"),
+		Size:        len(data),
+	}
+
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	host.SBOMs = append(host.SBOMs, sbom)
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: %s SBOM of %s attached to revision %d", sbom.Format, sbom.ContainerID, revision)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleAlert(w http.ResponseWriter, r *http.Request) {
+	var alert Alert
+	if !decodeSimRequest(w, r, &alert) {
+		return
+	}
+
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	host.Alerts = append(host.Alerts, alert)
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: alert from %s: %s %s (%s)", r.PathValue("hostname"), alert.Type, alert.ContainerID, alert.Reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	var batch TelemetryBatch
+	if !decodeSimRequest(w, r, &batch) {
+		return
+	}
+
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	var last uint64
+	if len(host.Telemetry) > 0 {
+		last = host.Telemetry[len(host.Telemetry)-1].Seq
+	}
+	received := 0
+	for _, record := range batch.Records {
+		// Batches are resent when the response got lost
+		if record.Seq <= last {
+			continue
+		}
+		host.Telemetry = append(host.Telemetry, record)
+		last = record.Seq
+		received++
+	}
+	host.TelemetryDropped += batch.Dropped
+	s.mutex.Unlock()
+
+	log.Printf("Simulator: %d telemetry records from %s (%d duplicates, %d dropped)", received, r.PathValue("hostname"), len(batch.Records)-received, batch.Dropped)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleAcquireLease(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if !decodeSimRequest(w, r, &req) {
+		return
+	}
+	if req.TTLSeconds <= 0 {
+		http.Error(w, "ttl_seconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	hostname, name := r.PathValue("hostname"), r.PathValue("name")
+	s.mutex.Lock()
+	lease := s.leases[name]
+	if lease == nil || lease.Holder == hostname || time.Now().After(lease.ExpiresAt) {
+		if lease == nil || lease.Holder != hostname {
+			log.Printf("Simulator: lease %s granted to %s", name, hostname)
+		}
+		lease = &Lease{
+			Name:      name,
+			HolderID:  r.Header.Get(HostIDHeader),
+			Holder:    hostname,
+			ExpiresAt: time.Now().Add(time.Duration(req.TTLSeconds) * time.Second),
+		}
+		s.leases[name] = lease
+	}
+	result := *lease
+	s.mutex.Unlock()
+
+	writeSimJSON(w, result)
+}
+
+func (s *Simulator) handleReleaseLease(w http.ResponseWriter, r *http.Request) {
+	hostname, name := r.PathValue("hostname"), r.PathValue("name")
+	s.mutex.Lock()
+	if lease := s.leases[name]; lease != nil && lease.Holder == hostname {
+		delete(s.leases, name)
+		log.Printf("Simulator: lease %s released by %s", name, hostname)
+	}
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Simulator) handleListHosts(w http.ResponseWriter, r *http.Request) {
+	data, err := s.Hosts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Simulator) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	var command Command
+	if !decodeSimRequest(w, r, &command) {
+		return
+	}
+	if command.Type == "" {
+		http.Error(w, "command type is required", http.StatusBadRequest)
+		return
+	}
+	writeSimJSON(w, s.Enqueue(r.PathValue("hostname"), command))
+}
+
+func (s *Simulator) handleDesiredState(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	state, etag := host.DesiredState, fmt.Sprintf("\"%d\"", host.DesiredStateVersion)
+	s.mutex.Unlock()
+
+	if state == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	log.Printf("Simulator: delivering desired state %s to %s", etag, r.PathValue("hostname"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	w.Write(state)
+}
+
+func (s *Simulator) handleSetDesiredState(w http.ResponseWriter, r *http.Request) {
+	var state json.RawMessage
+	if !decodeSimRequest(w, r, &state) {
+		return
+	}
+
+	s.mutex.Lock()
+	host := s.host(r.PathValue("hostname"))
+	host.DesiredState = state
+	host.DesiredStateVersion++
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Simulator) handleSetConfirm(w http.ResponseWriter, r *http.Request) {
+	var confirmation commandConfirmation
+	if !decodeSimRequest(w, r, &confirmation) {
+		return
+	}
+	s.SetConfirm(confirmation.Confirmed)
+	writeSimJSON(w, confirmation)
+}
+
+// decodeSimRequest decodes a JSON request body, writing an error response if it's invalid
+func decodeSimRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeSimJSON writes a JSON response
+func writeSimJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// decompressBodies decodes compressed request bodies before handler reads them
+func decompressBodies(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		if encoding != "" && encoding != "identity" {
+			body, err := decompress(r.Body, encoding)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// decompress decodes r compressed with encoding
+func decompress(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingNone:
+		return io.NopCloser(r), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// handlerTransport serves requests with an in-process handler instead of the network
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
+// SetHandler sends all requests to handler in-process, such as a Simulator's,
+// instead of the cloud URL
+func (c *Client) SetHandler(handler http.Handler) {
+	c.httpClient.Transport = &handlerTransport{handler: handler}
+}
@@ -0,0 +1,33 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TelemetryRecord is a metrics sample, event or audit record buffered on the host
+type TelemetryRecord struct {
+	// Seq orders the records of a host, records already received are sent again
+	// when an acknowledgement got lost and must be ignored
+	Seq  uint64          `json:"seq"`
+	Kind string          `json:"kind"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// TelemetryBatch is a batch of buffered telemetry, in order
+type TelemetryBatch struct {
+	Records []TelemetryRecord `json:"records"`
+	// Dropped counts the records the host discarded since the previous batch to bound its disk usage
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// SendTelemetry uploads a batch of buffered telemetry to the orchestrator
+func (c *Client) SendTelemetry(ctx context.Context, hostname string, batch *TelemetryBatch) error {
+	if err := c.postJSON(ctx, fmt.Sprintf("%s/api/v1/hosts/%s/telemetry", c.Endpoint(), hostname), batch, nil); err != nil {
+		return fmt.Errorf("failed to send telemetry: %w", err)
+	}
+	return nil
+}
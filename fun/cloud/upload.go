@@ -0,0 +1,331 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Request body encodings
+const (
+	EncodingNone = ""
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// minCompressSize is the body size below which compression isn't worth it
+const minCompressSize = 1024
+
+// uploadRetries is how often a failed chunk is resumed before the upload fails
+const uploadRetries = 3
+
+// UploadLimits are the request limits the orchestrator announces
+type UploadLimits struct {
+	// MaxRequestBytes is the largest request body, larger payloads are uploaded in chunks
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	// ChunkSize is the size of the chunks of chunked uploads
+	ChunkSize int64 `json:"chunk_size"`
+	// Encodings are the request body encodings the orchestrator accepts
+	Encodings []string `json:"encodings"`
+}
+
+// defaultUploadLimits apply when the orchestrator doesn't announce its limits
+var defaultUploadLimits = UploadLimits{
+	MaxRequestBytes: 8 << 20,
+	ChunkSize:       4 << 20,
+}
+
+// upload is the state of a chunked upload on the orchestrator
+type upload struct {
+	ID string `json:"id"`
+	// Offset is how many bytes the orchestrator received, uploads resume from it
+	Offset int64 `json:"offset"`
+}
+
+// uploadStart describes a chunked upload to the orchestrator
+type uploadStart struct {
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// SetCompression compresses request bodies with encoding once the orchestrator
+// announced that it accepts it, bodies to others are sent as they are
+func (c *Client) SetCompression(encoding string) error {
+	switch encoding {
+	case EncodingNone, EncodingGzip, EncodingZstd:
+	default:
+		return fmt.Errorf("unknown compression %q, expected gzip or zstd", encoding)
+	}
+	c.mutex.Lock()
+	c.compression = encoding
+	c.mutex.Unlock()
+	return nil
+}
+
+// UploadLimits returns the request limits of the orchestrator, fetched once
+func (c *Client) UploadLimits(ctx context.Context) UploadLimits {
+	c.mutex.Lock()
+	limits := c.limits
+	c.mutex.Unlock()
+	if limits != nil {
+		return *limits
+	}
+
+	// The defaults are only remembered once the orchestrator answered
+	fetched, answered := c.fetchUploadLimits(ctx)
+	if answered {
+		c.mutex.Lock()
+		c.limits = &fetched
+		c.mutex.Unlock()
+	}
+	return fetched
+}
+
+// fetchUploadLimits asks the orchestrator for its limits, falling back to the
+// defaults. It returns whether the orchestrator answered.
+func (c *Client) fetchUploadLimits(ctx context.Context) (UploadLimits, bool) {
+	limits := defaultUploadLimits
+	url := fmt.Sprintf("%s/api/v1/uploads/limits", c.Endpoint())
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return limits, false
+	}
+	c.authorize(httpReq)
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return limits, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return limits, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		return limits, true
+	}
+
+	var announced UploadLimits
+	if err := json.NewDecoder(resp.Body).Decode(&announced); err != nil {
+		log.Printf("Warning: Invalid upload limits from the orchestrator: %v", err)
+		return limits, true
+	}
+	if announced.MaxRequestBytes > 0 {
+		limits.MaxRequestBytes = announced.MaxRequestBytes
+	}
+	if announced.ChunkSize > 0 {
+		limits.ChunkSize = min(announced.ChunkSize, limits.MaxRequestBytes)
+	}
+	limits.Encodings = announced.Encodings
+	return limits, true
+}
+
+// encoding returns the compression to use, if the orchestrator announced it accepts it
+func (c *Client) encoding(ctx context.Context) string {
+	c.mutex.Lock()
+	compression := c.compression
+	c.mutex.Unlock()
+	if compression == EncodingNone || !slices.Contains(c.UploadLimits(ctx).Encodings, compression) {
+		return EncodingNone
+	}
+	return compression
+}
+
+// compressRequest compresses the body of a request in place
+func (c *Client) compressRequest(httpReq *http.Request) error {
+	if httpReq.GetBody == nil || httpReq.ContentLength < minCompressSize || httpReq.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	encoding := c.encoding(httpReq.Context())
+	if encoding == EncodingNone {
+		return nil
+	}
+
+	body, err := httpReq.GetBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	compressed, err := compress(body, encoding)
+	if err != nil {
+		return err
+	}
+
+	httpReq.Body = io.NopCloser(bytes.NewReader(compressed))
+	httpReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	httpReq.ContentLength = int64(len(compressed))
+	httpReq.Header.Set("Content-Encoding", encoding)
+	return nil
+}
+
+// compress reads r and returns it compressed with encoding
+func compress(r io.Reader, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingZstd:
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = encoder
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Upload sends a payload too large for a single request in chunks and returns
+// its upload ID, which other requests refer to. A failed chunk is resumed from
+// the offset the orchestrator received.
+func (c *Client) Upload(ctx context.Context, hostname, kind string, payload []byte) (string, error) {
+	encoding := c.encoding(ctx)
+	if encoding != EncodingNone {
+		compressed, err := compress(bytes.NewReader(payload), encoding)
+		if err != nil {
+			return "", fmt.Errorf("failed to compress upload: %w", err)
+		}
+		payload = compressed
+	}
+	sum := sha256.Sum256(payload)
+
+	var state upload
+	err := c.postJSON(ctx, fmt.Sprintf("%s/api/v1/hosts/%s/uploads", c.Endpoint(), hostname), uploadStart{
+		Kind:     kind,
+		Size:     int64(len(payload)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Encoding: encoding,
+	}, &state)
+	if err != nil {
+		return "", fmt.Errorf("failed to start upload: %w", err)
+	}
+
+	chunkSize := c.UploadLimits(ctx).ChunkSize
+	failures := 0
+	for state.Offset < int64(len(payload)) {
+		end := min(state.Offset+chunkSize, int64(len(payload)))
+		offset, err := c.uploadChunk(ctx, hostname, state.ID, payload, state.Offset, end)
+		if err == nil && offset <= state.Offset {
+			err = fmt.Errorf("upload %s didn't advance past byte %d", state.ID, offset)
+		}
+		if err == nil {
+			state.Offset = offset
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > uploadRetries {
+			return "", err
+		}
+		log.Printf("Warning: Upload %s failed at byte %d, resuming: %v", state.ID, state.Offset, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(failures) * time.Second):
+		}
+		if err := c.getJSON(ctx, fmt.Sprintf("%s/api/v1/hosts/%s/uploads/%s", c.Endpoint(), hostname, state.ID), &state); err != nil {
+			log.Printf("Warning: Failed to query upload %s: %v", state.ID, err)
+		}
+	}
+
+	if err := c.postJSON(ctx, fmt.Sprintf("%s/api/v1/hosts/%s/uploads/%s/complete", c.Endpoint(), hostname, state.ID), nil, nil); err != nil {
+		return "", fmt.Errorf("failed to complete upload: %w", err)
+	}
+	return state.ID, nil
+}
+
+// uploadChunk sends payload[start:end] and returns the offset the orchestrator received
+func (c *Client) uploadChunk(ctx context.Context, hostname, id string, payload []byte, start, end int64) (int64, error) {
+	url := fmt.Sprintf("%s/api/v1/hosts/%s/uploads/%s", c.Endpoint(), hostname, id)
+	httpReq, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(payload[start:end]))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	// The payload was compressed as a whole before it was split
+	httpReq.Header.Set("Content-Encoding", "identity")
+	httpReq.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(payload)))
+	c.authorize(httpReq)
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("failed to upload chunk: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	var state upload
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return 0, fmt.Errorf("failed to decode upload state: %w", err)
+	}
+	return state.Offset, nil
+}
+
+// postJSON posts request as JSON and decodes the response into response, if not nil
+func (c *Client) postJSON(ctx context.Context, url string, request, response interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return c.doJSON(httpReq, response)
+}
+
+// getJSON decodes the response of a GET request into response
+func (c *Client) getJSON(ctx context.Context, url string, response interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	return c.doJSON(httpReq, response)
+}
+
+// doJSON sends a request and decodes the response into response, if not nil
+func (c *Client) doJSON(httpReq *http.Request, response interface{}) error {
+	c.authorize(httpReq)
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s (status: %d)", string(body), resp.StatusCode)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -14,27 +14,257 @@ type Config struct {
 	CloudURL     string `json:"cloud_url"`
 	APIKey       string `json:"api_key"`
 	PollInterval int    `json:"poll_interval"` // In seconds
+	HostIDPath   string `json:"host_id_path"`  // Persistent host ID, generated on first run from the OS machine ID
+	// CloudFallbackURLs are tried in order when cloud_url fails, e.g. other regions.
+	// The agent stays on the last one that worked and returns to cloud_url once it recovers.
+	CloudFallbackURLs []string `json:"cloud_fallback_urls,omitempty"`
+	// CloudEndpointStatePath keeps the endpoint the agent last switched to, so
+	// a restart resumes on it rather than on an endpoint known to be down
+	CloudEndpointStatePath string `json:"cloud_endpoint_state_path"`
+	// DesiredStateCachePath keeps the last desired state fetched from the orchestrator,
+	// hosts keep reconciling against it while the orchestrator is unreachable
+	DesiredStateCachePath string `json:"desired_state_cache_path"`
+	// CloudCompression is "gzip" or "zstd" for request bodies the orchestrator announced it accepts
+	// compressed, empty sends them uncompressed
+	CloudCompression string `json:"cloud_compression"`
+
+	// Telemetry store-and-forward settings, for hosts that lose connectivity.
+	// Metrics samples, alerts and audit records are buffered in the spool and
+	// uploaded in order once the orchestrator is reachable.
+	TelemetrySpoolDir      string `json:"telemetry_spool_dir"`        // Empty sends alerts directly and keeps metrics and audit records local
+	TelemetrySpoolMaxMB    int    `json:"telemetry_spool_max_mb"`     // The oldest records are dropped beyond it
+	TelemetryMinFreeDiskMB int    `json:"telemetry_min_free_disk_mb"` // New metrics are refused while the disk has less free space
+
+	// Event journal settings. State changes, orchestrator commands and errors
+	// are kept on the host for fun events and support bundles.
+	EventJournalDir     string `json:"event_journal_dir"`      // Empty disables the journal
+	EventJournalMaxMB   int    `json:"event_journal_max_mb"`   // The oldest events are dropped beyond it
+	EventJournalMaxDays int    `json:"event_journal_max_days"` // Events are kept at most this long, 0 keeps them until the size limit
+
+	// Artifact cache settings. Downloaded kernels, rootfs tarballs and binaries
+	// are kept by content digest and reused until they are pruned.
+	ArtifactCacheDir     string `json:"artifact_cache_dir"`      // Empty keeps the cache next to the extracted binaries
+	ArtifactCacheMaxMB   int    `json:"artifact_cache_max_mb"`   // The least recently used artifacts are pruned beyond it, 0 doesn't limit the size
+	ArtifactCacheMaxDays int    `json:"artifact_cache_max_days"` // Artifacts unused for this long are pruned, 0 keeps them until the size limit
 
 	// Logging settings
 	LogLevel string `json:"log_level"`
 	LogFile  string `json:"log_file"`
+	// SystemLog also sends logs to the Windows Event Log or the macOS unified log
+	SystemLog bool `json:"system_log"`
+
+	// Admin API settings
+	AdminSocket string `json:"admin_socket"` // Local socket for runtime log level changes and pprof
+	SocketGroup string `json:"socket_group"` // Group whose members may use the daemon and containerd sockets, e.g. "fun"
 
 	// Container settings
 	ContainerdSocket    string `json:"containerd_socket"`
 	ContainerdNamespace string `json:"containerd_namespace"`
+	EmbeddedContainerd  bool   `json:"embedded_containerd"` // Run the bundled containerd on containerd_socket instead of using the system one
 	ContainerRoot       string `json:"container_root"`
+	ContainerIDScheme   string `json:"container_id_scheme"` // "name" uses names as IDs, "generated" adds a random suffix so names can be reused
+	EnableCRI           bool   `json:"enable_cri"`          // Expose the Kubernetes CRI API of the embedded containerd for kubelets such as k3s
+	CgroupDriver        string `json:"cgroup_driver"`       // "systemd" or "cgroupfs", empty detects from the cgroup mode
+	ContainerTimezone   string `json:"container_timezone"`  // "host", "none" or a zone such as Europe/Berlin, containers can override it
+	ContainerLocale     string `json:"container_locale"`    // "host", "none" or a locale such as de_DE.UTF-8, empty keeps the image's
+	SecretsDir          string `json:"secrets_dir"`         // Files config file templates read with {{ secret "name" }}
+	DebugBundleDir      string `json:"debug_bundle_dir"`    // Debug bundles of crash-looping containers are captured here, empty disables them
+	DebugBundleCores    bool   `json:"debug_bundle_cores"`  // Also copy core dumps into debug bundles
+
+	// Retention of debug bundles, the core dumps in them make them large
+	DebugBundleMaxMB   int `json:"debug_bundle_max_mb"`   // The oldest bundles are removed beyond it, 0 doesn't limit the size
+	DebugBundleMaxDays int `json:"debug_bundle_max_days"` // Bundles older than this are removed, 0 keeps them until the size limit
+
+	// ContainerdSockets are other containerd instances by name, e.g. {"system": "/run/containerd/containerd.sock"}
+	// next to the embedded one, selected for CLI commands with --containerd <name>
+	ContainerdSockets map[string]string `json:"containerd_sockets,omitempty"`
+
+	// Container log settings, containers can override them with log options
+	ContainerLogMaxMB    int    `json:"container_log_max_mb"`    // Size at which a container's log file is rotated, 0 never rotates
+	ContainerLogMaxFiles int    `json:"container_log_max_files"` // Rotated log files kept per container
+	ContainerLogRateKB   int    `json:"container_log_rate_kb"`   // Output per second a container may log, 0 doesn't limit it
+	ContainerLogRateMode string `json:"container_log_rate_mode"` // "block" holds back output beyond the rate, "drop" discards it
+
+	// Host reservation settings, kept free for the OS and funserver itself
+	ReservedCPUs     float64 `json:"reserved_cpus"`
+	ReservedMemoryMB int     `json:"reserved_memory_mb"`
+
+	// Admission settings, placements are checked against the current utilization of the host
+	AdmissionMinFreeDiskMB int `json:"admission_min_free_disk_mb"` // Free space the container root must keep, 0 disables the check
+	AdmissionQueueTimeout  int `json:"admission_queue_timeout"`    // In seconds, how long placements wait for resources before they are rejected
+
+	// Preemption settings, lower-priority containers are stopped when the host runs low on memory
+	PreemptionMinMemoryMB int `json:"preemption_min_memory_mb"` // Available memory below which a container is preempted, 0 disables preemption
+
+	// Host watchdog settings, alerts and reclaims resources before the host becomes unusable
+	WatchdogInterval    int    `json:"watchdog_interval"`      // In seconds, 0 disables the watchdog
+	WatchdogMinMemoryMB int    `json:"watchdog_min_memory_mb"` // Available memory below which the host is under memory pressure
+	WatchdogMinDiskMB   int    `json:"watchdog_min_disk_mb"`   // Free space of the container root below which images and logs are collected
+	WatchdogAction      string `json:"watchdog_action"`        // "none", "throttle" or "stop" low-priority containers under memory pressure
+
+	// GitOps settings, the daemon keeps the projects in a Git repository applied
+	GitOpsRepo      string `json:"gitops_repo"`       // Clone URL, empty disables GitOps
+	GitOpsBranch    string `json:"gitops_branch"`     // Branch to follow
+	GitOpsPath      string `json:"gitops_path"`       // Directory in the repository with a <project>/desired-state.json per project
+	GitOpsInterval  int    `json:"gitops_interval"`   // In seconds, how often the repository is pulled
+	GitOpsSSHKey    string `json:"gitops_ssh_key"`    // SSH private key for SSH remotes, empty uses the ssh defaults
+	GitOpsTokenFile string `json:"gitops_token_file"` // File with an access token for HTTPS remotes
+
+	// Startup gating settings, the daemon may be started at boot before its dependencies are ready
+	StartupWaitForNetwork  bool     `json:"startup_wait_for_network"`   // Wait for a routable network address
+	StartupWaitForTimeSync bool     `json:"startup_wait_for_time_sync"` // Wait for the clock to be synchronized, TLS needs a correct clock
+	StartupWaitForPaths    []string `json:"startup_wait_for_paths"`     // Wait for files or sockets, such as the containerd socket
+	StartupTimeout         int      `json:"startup_timeout"`            // In seconds, per gate; the daemon starts anyway afterwards
+	SystemdWatchdogSec     int      `json:"systemd_watchdog_sec"`       // WatchdogSec of the installed systemd unit, 0 disables the watchdog
+
+	// Restart supervisor settings
+	RestartMaxAttempts int `json:"restart_max_attempts"` // Restarts within the window before a container is marked crash-looping
+	RestartWindow      int `json:"restart_window"`       // In seconds
+	RestartMaxBackoff  int `json:"restart_max_backoff"`  // In seconds, upper bound of the exponential backoff
+
+	// Shutdown settings, what happens to running containers when the daemon stops
+	ShutdownPolicy  string `json:"shutdown_policy"`  // "leave-running", "stop" or "checkpoint" (stops containers CRIU can't checkpoint)
+	ShutdownTimeout int    `json:"shutdown_timeout"` // In seconds, how long a container gets to stop before it is killed
+
+	// Usage accounting settings
+	UsageSampleInterval int `json:"usage_sample_interval"` // In seconds, how often container usage is sampled for reports
+
+	// Compliance settings
+	AttachSBOMs bool   `json:"attach_sboms"` // Attach container SBOMs to cloud deployment records
+	SBOMFormat  string `json:"sbom_format"`  // "spdx" or "cyclonedx"
+
+	// TLS settings, applied to the cloud connection and registry downloads
+	TLSMinVersion   string   `json:"tls_min_version"`   // "1.2" or "1.3", empty keeps the Go default
+	TLSCipherSuites []string `json:"tls_cipher_suites"` // Go cipher suite names, empty keeps the Go defaults
+	FIPSMode        bool     `json:"fips_mode"`         // Only FIPS 140-3 approved crypto, requires a FIPS build or GODEBUG=fips140=on
+
+	// Cloud connectivity settings, for hosts that reach the orchestrator only through a jump host
+	CloudProxy          string `json:"cloud_proxy"`           // socks5://[user:password@]host:port or ssh://[user@]host[:port]
+	CloudProxyIdentity  string `json:"cloud_proxy_identity"`  // SSH private key for ssh:// proxies, empty uses the ssh defaults
+	CloudProxyKeepAlive int    `json:"cloud_proxy_keepalive"` // In seconds
+
+	// Content trust settings
+	TrustPolicyPath string `json:"trust_policy_path"` // Allowed registries, required signers and banned tags, pushable from the cloud
+	AuditLogPath    string `json:"audit_log_path"`    // Trust policy denials and updates
+
+	// CommandPolicyPath restricts what the orchestrator may do, e.g. no privileged
+	// containers or host mounts outside /srv/data; a missing file allows everything
+	CommandPolicyPath string `json:"command_policy_path"`
+
+	// FleetPath keeps the peer group the orchestrator assigned the host to
+	FleetPath string `json:"fleet_path"`
+	// SingletonLeaseTTL is how long the orchestrator grants the lease of a singleton
+	// container for, in seconds. A host that can't renew it stops the singleton
+	// before it expires, and another host of the group takes over after it expired.
+	SingletonLeaseTTL int `json:"singleton_lease_ttl"`
+
+	// ManifestSigningKeys are PEM public keys desired states from the cloud and Git
+	// and the orchestrator's commands must carry a detached signature of, empty
+	// applies unsigned manifests. They are only configured on the host so an
+	// orchestrator account can't replace them.
+	ManifestSigningKeys []string `json:"manifest_signing_keys,omitempty"`
+	// CommandNoncePath keeps the nonces of the signed commands executed, so they can't be replayed
+	CommandNoncePath string `json:"command_nonce_path"`
+	// DesiredStateIssuedPath keeps the issue time of the last signed desired state
+	// applied, so older ones can't be replayed
+	DesiredStateIssuedPath string `json:"desired_state_issued_path"`
+
+	// Inventory settings
+	InventoryInterval int `json:"inventory_interval"` // In seconds, 0 disables OS package and runtime version reports
+
+	// Host device settings
+	DeviceScanInterval int `json:"device_scan_interval"` // In seconds, rescans between hotplug events, 0 disables attaching USB and serial devices
+
+	// Image pull settings
+	MaxConcurrentDownloads int `json:"max_concurrent_downloads"` // Parallel layer downloads per pull
+	PullRetries            int `json:"pull_retries"`             // Retries for failed pulls, resuming partial layers
+	MaxHeavyOperations     int `json:"max_heavy_operations"`     // Concurrent pulls, imports and snapshot creations
+	// PrePullWindow is the daily local time window, such as "01:00-06:00", for
+	// pulling the images the orchestrator hints at, empty allows any time
+	PrePullWindow string `json:"pre_pull_window"`
+
+	// Image garbage collection settings
+	ImageGCInterval    int  `json:"image_gc_interval"`     // In seconds, 0 disables scheduled GC
+	ImageGCPruneUnused bool `json:"image_gc_prune_unused"` // Delete images not used by any container
+	// ImageGCKeep are patterns of image names, such as "docker.io/library/*",
+	// pruning never deletes
+	ImageGCKeep   []string `json:"image_gc_keep"`
+	ImageGCMinAge int      `json:"image_gc_min_age"` // In seconds, unused images pulled more recently are kept
+
+	// Registry settings
+	DockerConfigPath string `json:"docker_config_path"` // Docker client config used for registry credentials
+	CredentialHelper string `json:"credential_helper"`  // Overrides credsStore, e.g. "osxkeychain", "wincred", "pass"
+
+	// Docker API compatibility settings
+	DockerAPISocket string `json:"docker_api_socket"` // Empty disables the Docker-compatible endpoint
+
+	// Windows VM settings
+	WSLAgent bool `json:"wsl_agent"` // Run the Linux daemon inside the WSL2 distribution, the Windows one only controls it
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() *Config {
 	return &Config{
-		CloudURL:            "https://api.thefunserver.com",
-		PollInterval:        60,
-		LogLevel:            "info",
-		LogFile:             getDefaultLogFile(),
-		ContainerdSocket:    getDefaultContainerdSocket(),
-		ContainerdNamespace: "funserver",
-		ContainerRoot:       getDefaultContainerRoot(),
+		CloudURL:               "https://api.thefunserver.com",
+		PollInterval:           60,
+		HostIDPath:             filepath.Join(GetConfigDir(), "host-id"),
+		DesiredStateCachePath:  filepath.Join(GetConfigDir(), "cache", "desired-state.json"),
+		CloudEndpointStatePath: filepath.Join(GetConfigDir(), "cache", "cloud-endpoint"),
+		CommandNoncePath:       filepath.Join(GetConfigDir(), "cache", "command-nonces.json"),
+		DesiredStateIssuedPath: filepath.Join(GetConfigDir(), "cache", "desired-state-issued"),
+		TelemetrySpoolDir:      filepath.Join(GetConfigDir(), "spool"),
+		TelemetrySpoolMaxMB:    64,
+		TelemetryMinFreeDiskMB: 512,
+		EventJournalDir:        filepath.Join(GetConfigDir(), "events"),
+		EventJournalMaxMB:      32,
+		EventJournalMaxDays:    30,
+		ArtifactCacheDir:       filepath.Join(GetConfigDir(), "artifacts"),
+		ArtifactCacheMaxMB:     4096,
+		ArtifactCacheMaxDays:   90,
+		DebugBundleMaxMB:       2048,
+		DebugBundleMaxDays:     30,
+		LogLevel:               "info",
+		LogFile:                getDefaultLogFile(),
+		SystemLog:              true,
+		AdminSocket:            getDefaultAdminSocket(),
+		ContainerdSocket:       getDefaultContainerdSocket(),
+		ContainerdNamespace:    "funserver",
+		ContainerRoot:          getDefaultContainerRoot(),
+		ContainerTimezone:      "host",
+		SecretsDir:             filepath.Join(GetConfigDir(), "secrets"),
+		ContainerLogMaxMB:      100,
+		ContainerLogMaxFiles:   3,
+		ContainerLogRateMode:   "block",
+		ReservedCPUs:           0.5,
+		ReservedMemoryMB:       512,
+		AdmissionMinFreeDiskMB: 1024,
+		WatchdogInterval:       15,
+		WatchdogMinMemoryMB:    256,
+		WatchdogMinDiskMB:      2048,
+		WatchdogAction:         "none",
+		GitOpsBranch:           "main",
+		GitOpsInterval:         300,
+		StartupWaitForNetwork:  true,
+		StartupTimeout:         60,
+		SystemdWatchdogSec:     60,
+		RestartMaxAttempts:     5,
+		RestartWindow:          600,
+		RestartMaxBackoff:      300,
+		ShutdownPolicy:         "leave-running",
+		ShutdownTimeout:        10,
+		UsageSampleInterval:    30,
+		DeviceScanInterval:     30,
+		SBOMFormat:             "spdx",
+		CloudProxyKeepAlive:    30,
+		TrustPolicyPath:        filepath.Join(GetConfigDir(), "trust-policy.json"),
+		AuditLogPath:           filepath.Join(GetConfigDir(), "logs", "audit.log"),
+		CommandPolicyPath:      filepath.Join(GetConfigDir(), "command-policy.json"),
+		FleetPath:              filepath.Join(GetConfigDir(), "fleet.json"),
+		SingletonLeaseTTL:      60,
+		MaxConcurrentDownloads: 3,
+		PullRetries:            3,
+		MaxHeavyOperations:     2,
+		ImageGCMinAge:          86400,
 	}
 }
 
@@ -131,5 +361,28 @@ func getDefaultContainerdSocket() string {
 
 // getDefaultContainerRoot returns the default path for container data
 func getDefaultContainerRoot() string {
+	if systemLocations() {
+		return "/var/lib/fun/containers"
+	}
 	return filepath.Join(GetConfigDir(), "containers")
 }
+
+// getDefaultAdminSocket returns the default path of the admin socket
+func getDefaultAdminSocket() string {
+	if systemLocations() {
+		return "/run/fun/admin.sock"
+	}
+	return filepath.Join(GetConfigDir(), "admin.sock")
+}
+
+// systemLocations reports whether sockets and state default to /run and
+// /var/lib rather than the config directory. SELinux denies the daemon and
+// containers access to sockets and files labeled as a home directory, e.g.
+// /root/.config when running as root.
+func systemLocations() bool {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		return false
+	}
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
@@ -0,0 +1,208 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/defaults"
+)
+
+// Resources an admission check can reject a placement for
+const (
+	// AdmissionCPU is measured in CPUs
+	AdmissionCPU = "cpu"
+	// AdmissionMemory is measured in bytes
+	AdmissionMemory = "memory"
+	// AdmissionDisk is measured in bytes
+	AdmissionDisk = "disk"
+)
+
+// admissionRetryInterval is how often a queued placement is checked again
+const admissionRetryInterval = 5 * time.Second
+
+// AdmissionError is returned when a container is refused because the host
+// lacks the resources to run it
+type AdmissionError struct {
+	// Resource is AdmissionCPU, AdmissionMemory or AdmissionDisk
+	Resource  string
+	Requested float64
+	Available float64
+	Reason    string
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("insufficient %s: %s", e.Resource, e.Reason)
+}
+
+// AdmissionPolicy configures the checks against the current utilization of
+// the host, on top of the limits checked against the allocatable resources
+type AdmissionPolicy struct {
+	// MinFreeDiskBytes is the free space the container root must keep, 0 disables the check
+	MinFreeDiskBytes int64
+	// QueueTimeout is how long placements wait for resources to free up before
+	// they are rejected, 0 rejects them right away
+	QueueTimeout time.Duration
+}
+
+// SetAdmissionPolicy sets the admission policy of container placements
+func (c *Client) SetAdmissionPolicy(policy AdmissionPolicy) {
+	c.mu.Lock()
+	c.admission = policy
+	c.mu.Unlock()
+}
+
+// admit waits until a placement fits on the host, up to the queue timeout, and
+// records a reservation for it so concurrent creates see each other. The caller
+// must call release once the container exists or its creation failed.
+// placementMutex is only held while checking, so creates don't block each other.
+func (c *Client) admit(ctx context.Context, limits ResourceLimits) (func(), error) {
+	c.mu.RLock()
+	policy := c.admission
+	c.mu.RUnlock()
+	deadline := time.Now().Add(policy.QueueTimeout)
+
+	queued := false
+	for {
+		c.placementMutex.Lock()
+		err := c.checkAllocatable(ctx, limits)
+		if err == nil {
+			err = c.checkUtilization(ctx, limits, policy)
+		}
+		if err == nil {
+			release := c.reservePlacement(limits)
+			c.placementMutex.Unlock()
+			if queued {
+				log.Printf("Queued placement admitted")
+			}
+			return release, nil
+		}
+		c.placementMutex.Unlock()
+
+		var admissionErr *AdmissionError
+		if !errors.As(err, &admissionErr) || !time.Now().Before(deadline) {
+			return nil, err
+		}
+		if !queued {
+			log.Printf("Placement queued for up to %s: %v", policy.QueueTimeout, err)
+			queued = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(admissionRetryInterval):
+		}
+	}
+}
+
+// reservePlacement records the limits of an admitted placement until the
+// returned function is called. The caller must hold placementMutex.
+func (c *Client) reservePlacement(limits ResourceLimits) func() {
+	if c.placements == nil {
+		c.placements = map[uint64]ResourceLimits{}
+	}
+	c.nextPlacement++
+	id := c.nextPlacement
+	c.placements[id] = limits
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.placementMutex.Lock()
+			delete(c.placements, id)
+			c.placementMutex.Unlock()
+		})
+	}
+}
+
+// pendingPlacements sums the limits of admitted placements whose containers
+// don't exist yet. The caller must hold placementMutex.
+func (c *Client) pendingPlacements() HostResources {
+	var pending HostResources
+	for _, limits := range c.placements {
+		pending.CPUs += limits.CPUs
+		pending.MemoryBytes += limits.Memory
+	}
+	return pending
+}
+
+// checkUtilization refuses placements whose memory limit exceeds the memory
+// currently available, or that would leave the container root short of disk
+// Checks are skipped where the utilization can't be determined.
+func (c *Client) checkUtilization(ctx context.Context, limits ResourceLimits, policy AdmissionPolicy) error {
+	c.mu.RLock()
+	reserved := c.reserved
+	c.mu.RUnlock()
+
+	if limits.Memory > 0 {
+		if available := hostMemoryAvailable(); available > 0 {
+			available -= reserved.MemoryBytes + c.pendingPlacements().MemoryBytes
+			if available < 0 {
+				available = 0
+			}
+			if limits.Memory > available {
+				return &AdmissionError{
+					Resource:  AdmissionMemory,
+					Requested: float64(limits.Memory),
+					Available: float64(available),
+					Reason: fmt.Sprintf("requested %d bytes, %d bytes currently available after the host reservation",
+						limits.Memory, available),
+				}
+			}
+		}
+	}
+
+	if policy.MinFreeDiskBytes > 0 {
+		root := c.diskRoot(ctx)
+		if free, ok := DiskFree(root); ok && free < policy.MinFreeDiskBytes {
+			return &AdmissionError{
+				Resource:  AdmissionDisk,
+				Requested: float64(policy.MinFreeDiskBytes),
+				Available: float64(free),
+				Reason: fmt.Sprintf("%d bytes free under %s, %d bytes must be kept free",
+					free, root, policy.MinFreeDiskBytes),
+			}
+		}
+	}
+	return nil
+}
+
+// diskRoot returns the directory of the snapshotter the namespace uses, whose
+// filesystem holds the image layers and container filesystems. It falls back
+// to the state directory when containerd doesn't report it, or runs in a VM
+// whose paths the host can't see.
+func (c *Client) diskRoot(ctx context.Context) string {
+	name, err := c.client.GetLabel(c.withNamespace(ctx), defaultSnapshotterLabel)
+	if err != nil || name == "" {
+		name = defaults.DefaultSnapshotter
+	}
+	c.mu.RLock()
+	root := c.capabilities.SnapshotterRoots[name]
+	c.mu.RUnlock()
+	if root == "" {
+		return c.containerStateDir("")
+	}
+	if _, err := os.Stat(root); err != nil {
+		return c.containerStateDir("")
+	}
+	return root
+}
+
+// existingParent returns p or its closest ancestor that exists
+func existingParent(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
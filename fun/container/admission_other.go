@@ -0,0 +1,15 @@
+//go:build !windows
+
+package container
+
+import "golang.org/x/sys/unix"
+
+// DiskFree returns the bytes available to unprivileged users on the filesystem
+// holding path, or false if it can't be determined
+func DiskFree(path string) (int64, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(existingParent(path), &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
@@ -0,0 +1,17 @@
+package container
+
+import "golang.org/x/sys/windows"
+
+// DiskFree returns the bytes available to the daemon on the volume holding
+// path, or false if it can't be determined
+func DiskFree(path string) (int64, bool) {
+	dir, err := windows.UTF16PtrFromString(existingParent(path))
+	if err != nil {
+		return 0, false
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &available, &total, &free); err != nil {
+		return 0, false
+	}
+	return int64(available), true
+}
@@ -0,0 +1,35 @@
+package container
+
+import (
+	"context"
+	"fmt"
+
+	"fun/artifacts"
+)
+
+// ArtifactCacheDir is the content-addressed cache shared by the downloads of
+// kernels, rootfs tarballs and binaries, next to BundledBinaryDir unless the
+// daemon's configuration moves it
+var ArtifactCacheDir = artifacts.DefaultDir()
+
+// fetchArtifact returns the cached file downloaded from url, fetching it if
+// it isn't cached in that version and printing how far the download got
+func fetchArtifact(ctx context.Context, url, version string) (string, error) {
+	cache, err := artifacts.Open(ArtifactCacheDir)
+	if err != nil {
+		return "", err
+	}
+	return cache.Fetch(ctx, artifacts.Request{URL: url, Version: version, Progress: printProgress})
+}
+
+// printProgress prints the progress of a download on a single line
+func printProgress(url string, done, total int64) {
+	if total < 0 {
+		fmt.Printf("\r  %d MB", done>>20)
+		return
+	}
+	fmt.Printf("\r  %d/%d MB", done>>20, total>>20)
+	if done == total {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,418 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BundleManifestName is the file listing the versions of the bundled components
+// The dependency download writes it next to the binaries shipped with a release,
+// and extraction keeps a copy in BundledBinaryDir for what was extracted.
+const BundleManifestName = "versions.json"
+
+// BundleChecksumsName is the file in BundledBinaryDir recording the sha256 of
+// every extracted binary, so modified binaries are detected before they are run.
+// Releases may ship one next to the manifest, which extraction verifies against.
+const BundleChecksumsName = "checksums.json"
+
+// Bundled component names, as used in the manifest
+const (
+	ComponentContainerd = "containerd"
+	ComponentRunc       = "runc"
+	ComponentCNI        = "cni"
+	ComponentHyperKit   = "hyperkit"
+)
+
+// BundleManifest maps bundled component names to their versions
+type BundleManifest map[string]string
+
+// BundleUpgrade is a component whose shipped version differs from the extracted one
+type BundleUpgrade struct {
+	Component string `json:"component"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// ReadBundleManifest reads a manifest, returning an empty one if it doesn't exist
+func ReadBundleManifest(path string) (BundleManifest, error) {
+	manifest := BundleManifest{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// Save writes the manifest to path, replacing it atomically
+func (m BundleManifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle manifest: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write bundle manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write bundle manifest: %w", err)
+	}
+	return nil
+}
+
+// TamperedBinaryError is returned when an extracted binary no longer matches the
+// checksum recorded when it was installed
+type TamperedBinaryError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *TamperedBinaryError) Error() string {
+	return fmt.Sprintf("bundled binary %s was modified after extraction (sha256 %s, expected %s)", e.Path, e.Actual, e.Expected)
+}
+
+// bundleFilesMutex serializes updates of the checksum and manifest files by
+// the components extracted concurrently, lockBundledBinaryDir only keeps other
+// fun processes out
+var bundleFilesMutex sync.Mutex
+
+// readBundleChecksums returns the recorded checksums by path relative to BundledBinaryDir
+func readBundleChecksums() (map[string]string, error) {
+	return readChecksumsFile(filepath.Join(BundledBinaryDir, BundleChecksumsName))
+}
+
+// readChecksumsFile reads a checksum file, returning no checksums if it doesn't exist
+func readChecksumsFile(path string) (map[string]string, error) {
+	checksums := map[string]string{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checksums, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle checksums: %w", err)
+	}
+	if err := json.Unmarshal(data, &checksums); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle checksums: %w", err)
+	}
+	return checksums, nil
+}
+
+// shippedChecksum returns the checksum this release ships for a bundled source
+// binary, releases built without checksums ship none
+func shippedChecksum(src string) (string, bool) {
+	sourceDir, err := bundledSourceDir()
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(sourceDir, src)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	checksums, err := readChecksumsFile(filepath.Join(sourceDir, BundleChecksumsName))
+	if err != nil {
+		return "", false
+	}
+	sum, ok := checksums[filepath.ToSlash(rel)]
+	return sum, ok
+}
+
+// recordChecksum stores the checksum of a binary installed into BundledBinaryDir
+// The caller must hold the lock of lockBundledBinaryDir.
+func recordChecksum(path, sum string) error {
+	rel, err := filepath.Rel(BundledBinaryDir, path)
+	if err != nil {
+		return fmt.Errorf("failed to record checksum of %s: %w", path, err)
+	}
+	bundleFilesMutex.Lock()
+	defer bundleFilesMutex.Unlock()
+	checksums, err := readBundleChecksums()
+	if err != nil {
+		// A corrupt file only loses the other checksums, which are recorded again on extraction
+		checksums = map[string]string{}
+	}
+	checksums[filepath.ToSlash(rel)] = sum
+
+	data, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle checksums: %w", err)
+	}
+	// The file is read-only, it is only ever replaced. Windows can't replace a
+	// read-only file, so it is made writable just before.
+	file := filepath.Join(BundledBinaryDir, BundleChecksumsName)
+	os.Remove(file + ".tmp")
+	if err := os.WriteFile(file+".tmp", data, 0444); err != nil {
+		return fmt.Errorf("failed to write bundle checksums: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		os.Chmod(file, 0644)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		os.Remove(file + ".tmp")
+		return fmt.Errorf("failed to write bundle checksums: %w", err)
+	}
+	return nil
+}
+
+// fileChecksum returns the hex encoded sha256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyBundledBinary checks a binary in BundledBinaryDir against the checksum
+// recorded when it was extracted, returning a *TamperedBinaryError on mismatch.
+// Binaries outside BundledBinaryDir, binaries not extracted yet and binaries
+// extracted before checksums were recorded pass. It holds the lock of
+// lockBundledBinaryDir, so it never sees an extraction half done.
+func VerifyBundledBinary(path string) error {
+	rel, err := filepath.Rel(BundledBinaryDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	unlock, err := lockBundledBinaryDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	checksums, err := readBundleChecksums()
+	if err != nil {
+		return err
+	}
+	expected, ok := checksums[filepath.ToSlash(rel)]
+	if !ok {
+		return nil
+	}
+
+	actual, err := fileChecksum(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+	if actual != expected {
+		return &TamperedBinaryError{Path: path, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// bundleLockName is the lock file serializing extraction between fun processes
+const bundleLockName = ".extract.lock"
+
+// lockBundledBinaryDir waits until no other fun process extracts into
+// BundledBinaryDir, returning the function that releases the lock
+func lockBundledBinaryDir() (func(), error) {
+	if err := os.MkdirAll(BundledBinaryDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create bundled binary directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(BundledBinaryDir, bundleLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundled binary lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock bundled binary directory: %w", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// withBundledBinaryDirLock runs extract while holding the lock of lockBundledBinaryDir
+func withBundledBinaryDirLock(extract func() error) error {
+	unlock, err := lockBundledBinaryDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return extract()
+}
+
+// bundledSourceDir returns the directory holding the binaries shipped with this release
+func bundledSourceDir() (string, error) {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable path: %w", err)
+	}
+	return filepath.Join(filepath.Dir(executablePath), "binaries", runtime.GOOS), nil
+}
+
+// bundledArchDir returns the subdirectory of dir for the host architecture if the
+// release ships one, otherwise dir. Windows releases carry Linux artifacts for
+// WSL, which must match the host even when fun itself runs emulated.
+func bundledArchDir(dir string) string {
+	archDir := filepath.Join(dir, HostArch())
+	if info, err := os.Stat(archDir); err == nil && info.IsDir() {
+		return archDir
+	}
+	return dir
+}
+
+// shippedBundleManifest returns the component versions shipped with this release,
+// empty for releases without a manifest
+func shippedBundleManifest() BundleManifest {
+	sourceDir, err := bundledSourceDir()
+	if err != nil {
+		return BundleManifest{}
+	}
+	manifest, err := ReadBundleManifest(filepath.Join(sourceDir, BundleManifestName))
+	if err != nil {
+		return BundleManifest{}
+	}
+	return manifest
+}
+
+// extractedBundleManifest returns the component versions extracted into BundledBinaryDir
+func extractedBundleManifest() BundleManifest {
+	manifest, err := ReadBundleManifest(filepath.Join(BundledBinaryDir, BundleManifestName))
+	if err != nil {
+		return BundleManifest{}
+	}
+	return manifest
+}
+
+// PendingBundleUpgrades returns the components this release ships in a different
+// version than the one extracted, which are re-extracted on the next start
+func PendingBundleUpgrades() []BundleUpgrade {
+	shipped := shippedBundleManifest()
+	extracted := extractedBundleManifest()
+
+	var upgrades []BundleUpgrade
+	for component, version := range shipped {
+		if extracted[component] != version {
+			upgrades = append(upgrades, BundleUpgrade{Component: component, From: extracted[component], To: version})
+		}
+	}
+	sort.Slice(upgrades, func(i, j int) bool { return upgrades[i].Component < upgrades[j].Component })
+	return upgrades
+}
+
+// bundledUpToDate reports whether an extracted component can be reused: it must
+// exist and match the version shipped with this release. Releases without a
+// manifest reuse whatever was extracted before.
+func bundledUpToDate(component, path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || (!info.IsDir() && info.Mode()&0111 == 0 && runtime.GOOS != "windows") {
+		return false
+	}
+	shipped, ok := shippedBundleManifest()[component]
+	if !ok {
+		return true
+	}
+	return extractedBundleManifest()[component] == shipped
+}
+
+// recordExtracted stores the shipped version of a component as extracted
+func recordExtracted(component string) error {
+	shipped, ok := shippedBundleManifest()[component]
+	if !ok {
+		return nil
+	}
+	bundleFilesMutex.Lock()
+	defer bundleFilesMutex.Unlock()
+	manifest := extractedBundleManifest()
+	manifest[component] = shipped
+	return manifest.Save(filepath.Join(BundledBinaryDir, BundleManifestName))
+}
+
+// installBinary copies src over dst through a synced temporary file, so dst is
+// never seen half written and a binary that is running is replaced for the next
+// start instead of being overwritten in place. The copy is hashed as it is
+// written and checked against the checksum shipped with the release, if any,
+// so a corrupt download is never installed and the source is read only once.
+// The caller must hold the lock of lockBundledBinaryDir.
+// Windows can't replace a running executable, the copy is then left staged next
+// to it and applied by applyStagedBinaries before containerd is started again.
+func installBinary(src, dst string) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source binary: %w", err)
+	}
+	defer sourceFile.Close()
+
+	staged := dst + ".new"
+	destFile, err := os.OpenFile(staged, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create destination binary file: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(destFile, hash), sourceFile); err != nil {
+		destFile.Close()
+		os.Remove(staged)
+		return fmt.Errorf("failed to extract binary: %w", err)
+	}
+	if err := destFile.Sync(); err != nil {
+		destFile.Close()
+		os.Remove(staged)
+		return fmt.Errorf("failed to extract binary: %w", err)
+	}
+	if err := destFile.Close(); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to extract binary: %w", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected, ok := shippedChecksum(src); ok && sum != expected {
+		os.Remove(staged)
+		return fmt.Errorf("bundled binary %s is corrupt (sha256 %s, expected %s)", src, sum, expected)
+	}
+
+	// A staged binary is recorded already, applyStagedBinaries runs before any verification
+	if err := recordChecksum(dst, sum); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	if err := os.Rename(staged, dst); err != nil {
+		return fmt.Errorf("binary staged at %s, it replaces %s once it is no longer running: %w", staged, dst, err)
+	}
+	return nil
+}
+
+// applyStagedBinaries moves binaries staged by installBinary into place, which
+// only succeeds while they aren't running
+func applyStagedBinaries() error {
+	unlock, err := lockBundledBinaryDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	staged, err := filepath.Glob(filepath.Join(BundledBinaryDir, "*.new"))
+	if err != nil {
+		return err
+	}
+	for _, path := range staged {
+		if err := os.Rename(path, path[:len(path)-len(".new")]); err != nil {
+			return fmt.Errorf("failed to apply staged binary %s: %w", path, err)
+		}
+	}
+	return nil
+}
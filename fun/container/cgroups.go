@@ -0,0 +1,99 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/api/types/runc/options"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// CgroupMode is the cgroup hierarchy layout of the host
+type CgroupMode string
+
+const (
+	// CgroupUnavailable means the host has no cgroups, e.g. Windows or macOS
+	CgroupUnavailable CgroupMode = "none"
+	// CgroupV1 is the legacy per-controller hierarchy
+	CgroupV1 CgroupMode = "v1"
+	// CgroupHybrid mounts v1 controllers with an empty v2 hierarchy alongside
+	CgroupHybrid CgroupMode = "hybrid"
+	// CgroupV2 is the unified hierarchy used by modern distributions
+	CgroupV2 CgroupMode = "v2"
+)
+
+// Cgroup drivers
+const (
+	CgroupDriverCgroupfs = "cgroupfs"
+	CgroupDriverSystemd  = "systemd"
+)
+
+// LabelCgroupDriver records the cgroup driver a container was created with, since
+// the cgroup path format in its spec depends on it
+const LabelCgroupDriver = "fun.cgroup-driver"
+
+// cgroupMode caches the detected mode, it can't change while the process runs
+var cgroupMode CgroupMode
+
+// DetectCgroupMode returns the cgroup mode of the host
+func DetectCgroupMode() CgroupMode {
+	if cgroupMode == "" {
+		cgroupMode = detectCgroupMode()
+	}
+	return cgroupMode
+}
+
+// systemdRunning reports whether systemd is the init system
+func systemdRunning() bool {
+	_, err := os.Stat("/run/systemd/system")
+	return err == nil
+}
+
+// ResolveCgroupDriver picks the cgroup driver for a configured value, where an empty
+// value selects systemd on cgroup v2 hosts booted with systemd, as runc recommends
+func ResolveCgroupDriver(configured string) (string, error) {
+	switch configured {
+	case CgroupDriverCgroupfs, CgroupDriverSystemd:
+		return configured, nil
+	case "":
+		if DetectCgroupMode() == CgroupV2 && systemdRunning() {
+			return CgroupDriverSystemd, nil
+		}
+		return CgroupDriverCgroupfs, nil
+	}
+	return "", fmt.Errorf("invalid cgroup driver %q, expected cgroupfs or systemd", configured)
+}
+
+// SetCgroupDriver sets the cgroup driver used for new containers
+func (c *Client) SetCgroupDriver(driver string) {
+	c.mu.Lock()
+	c.cgroupDriver = driver
+	c.mu.Unlock()
+}
+
+// getCgroupDriver returns the cgroup driver used for new containers
+func (c *Client) getCgroupDriver() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cgroupDriver
+}
+
+// systemdCgroupPath returns the runc systemd cgroup path (slice:prefix:name) for a container
+func systemdCgroupPath(containerID string) string {
+	return "system.slice:funserver:" + containerID
+}
+
+// withSystemdCgroup tells runc to manage the task's cgroup through systemd
+func withSystemdCgroup(_ context.Context, _ *containerd.Client, ti *containerd.TaskInfo) error {
+	if ti.Options == nil {
+		ti.Options = &options.Options{}
+	}
+	opts, ok := ti.Options.(*options.Options)
+	if !ok {
+		return errors.New("invalid runc shim options format")
+	}
+	opts.SystemdCgroup = true
+	return nil
+}
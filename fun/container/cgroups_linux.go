@@ -0,0 +1,39 @@
+package container
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroup2SuperMagic is the filesystem type of a cgroup v2 mount
+const cgroup2SuperMagic = 0x63677270
+
+// detectCgroupMode inspects the filesystems mounted under /sys/fs/cgroup
+func detectCgroupMode() CgroupMode {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs("/sys/fs/cgroup", &st); err != nil {
+		return CgroupUnavailable
+	}
+	if st.Type == cgroup2SuperMagic {
+		return CgroupV2
+	}
+
+	if err := syscall.Statfs("/sys/fs/cgroup/unified", &st); err == nil && st.Type == cgroup2SuperMagic {
+		return CgroupHybrid
+	}
+	return CgroupV1
+}
+
+// deviceNumbers returns the major and minor numbers of a block device
+func deviceNumbers(path string) (int64, int64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", path)
+	}
+	return int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev))), nil
+}
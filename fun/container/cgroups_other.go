@@ -0,0 +1,15 @@
+//go:build !linux
+
+package container
+
+import "errors"
+
+// detectCgroupMode returns CgroupUnavailable, containers run inside a Linux VM on this platform
+func detectCgroupMode() CgroupMode {
+	return CgroupUnavailable
+}
+
+// deviceNumbers is not supported, block devices belong to the Linux VM
+func deviceNumbers(path string) (int64, int64, error) {
+	return 0, 0, errors.New("device throttling is only supported on Linux hosts")
+}
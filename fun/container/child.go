@@ -0,0 +1,32 @@
+package container
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+// childEnvAllowlist are the variables of the daemon's environment passed on to
+// containerd, proxies included so registries behind them stay reachable
+var childEnvAllowlist = []string{
+	"PATH", "HOME", "TMPDIR", "LANG",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SystemRoot", "SystemDrive", "ProgramData", "ProgramFiles", "TEMP", "TMP", "USERPROFILE",
+}
+
+// childEnv returns the environment of containerd, only the allowlisted variables
+// of the daemon so secrets such as cloud API keys don't leak into it
+func childEnv() []string {
+	var env []string
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		for _, allowed := range childEnvAllowlist {
+			// Windows variable names are case-insensitive
+			if name == allowed || (runtime.GOOS == "windows" && strings.EqualFold(name, allowed)) {
+				env = append(env, entry)
+				break
+			}
+		}
+	}
+	return env
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// childMaxOpenFiles is the open file limit of containerd, matching its systemd unit
+const childMaxOpenFiles = 1048576
+
+// childOOMScoreAdj keeps the OOM killer away from containerd, as its systemd unit does
+const childOOMScoreAdj = -999
+
+// startChild starts containerd in its own process group, killed when the daemon
+// dies, and returns the function releasing its supervision resources
+func startChild(cmd *exec.Cmd) (func(), error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	// The parent death signal fires when the thread that forked the child exits,
+	// so fork from a thread that stays locked for the duration of Start
+	runtime.LockOSThread()
+	err := cmd.Start()
+	runtime.UnlockOSThread()
+	if err != nil {
+		return nil, err
+	}
+
+	pid := cmd.Process.Pid
+	limits := []struct {
+		name     string
+		resource int
+		limit    unix.Rlimit
+	}{
+		{"open files", unix.RLIMIT_NOFILE, unix.Rlimit{Cur: childMaxOpenFiles, Max: childMaxOpenFiles}},
+		{"core dumps", unix.RLIMIT_CORE, unix.Rlimit{Cur: 0, Max: 0}},
+	}
+	for _, l := range limits {
+		if err := unix.Prlimit(pid, l.resource, &l.limit, nil); err != nil {
+			log.Printf("Warning: Failed to set the containerd %s limit: %v", l.name, err)
+		}
+	}
+	oomPath := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	if err := os.WriteFile(oomPath, []byte(fmt.Sprintf("%d", childOOMScoreAdj)), 0644); err != nil {
+		log.Printf("Warning: Failed to adjust the containerd OOM score: %v", err)
+	}
+
+	return func() {}, nil
+}
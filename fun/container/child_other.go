@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+
+package container
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startChild starts containerd in its own process group
+// There is no parent death signal on this platform, Stop ends the process.
+func startChild(cmd *exec.Cmd) (func(), error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
@@ -2,20 +2,107 @@ package container
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
+	"sync"
 	"time"
 
+	"fun/audit"
+
 	containerd "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/pkg/namespaces"
 	"github.com/pkg/errors"
 )
 
+// DefaultMaxHeavyOperations is the number of pulls, imports and snapshot creations
+// allowed to run at the same time unless configured otherwise
+const DefaultMaxHeavyOperations = 2
+
 // Client wraps the containerd client and provides container management functionality
+// A Client is safe for concurrent use. Clients derived with WithNamespace share the
+// connection and settings of the client they were derived from.
 type Client struct {
 	client    *containerd.Client
 	namespace string
 	ctx       context.Context
+
+	*clientShared
+}
+
+// clientShared holds the state shared by a client and its namespaced sub-clients
+type clientShared struct {
+	// mu guards the settings below, which may be changed while operations run
+	mu          sync.RWMutex
+	credentials *CredentialStore
+	ipam        *IPAMStore
+	stateDir    string
+	pullOptions PullOptions
+	// cgroupDriver is "systemd" or "cgroupfs", empty behaves like cgroupfs
+	cgroupDriver string
+	// timezone and locale are the defaults of containers that don't set their own
+	timezone string
+	locale   string
+	// logDefaults are the log limits of containers that don't set their own
+	logDefaults LogLimits
+	// secretsDir holds the secrets config file templates can read
+	secretsDir string
+	history    *DeploymentHistory
+	// deploymentHook is called after a desired state has been applied
+	deploymentHook func(revision DeploymentRevision)
+	// capabilities are the features of the containerd server, detected on connect
+	capabilities Capabilities
+	// criticalExitHook is called when a container marked critical exits
+	criticalExitHook func(containerID string, info TerminationInfo)
+	// crashLoopHook is called when a container starts crash-looping
+	crashLoopHook func(containerID string)
+	// preemptionHook is called after a container was stopped to relieve resource pressure
+	preemptionHook func(event PreemptionEvent)
+	// reserved is kept free for the host, placementMutex serializes admission checks
+	// and guards placements, the limits of admitted creates still in progress
+	reserved       HostResources
+	placementMutex sync.Mutex
+	placements     map[uint64]ResourceLimits
+	nextPlacement  uint64
+	// admission checks placements against the current utilization of the host
+	admission AdmissionPolicy
+	// idScheme chooses the IDs of containers created without one
+	idScheme string
+	// deployMutex serializes applying desired states
+	deployMutex sync.Mutex
+	// dryRun receives the actions of mutating operations instead of running them
+	dryRun io.Writer
+	// tlsConfig restricts registry connections, nil uses the Go defaults
+	tlsConfig *tls.Config
+	// probeClient sends HTTP health probes, it is built from tlsConfig on first use
+	probeClient *http.Client
+	// trustPolicy is checked before images are pulled or used, audit records its denials
+	trustPolicy *TrustPolicy
+	audit       *audit.Logger
+	// manifestVerifier, if set, requires signed desired states from the cloud and Git
+	manifestVerifier *ManifestVerifier
+	// commandNoncePath keeps the nonces of the signed commands executed
+	commandNoncePath string
+	// desiredStateIssuedPath keeps the issue time of the last desired state applied
+	desiredStateIssuedPath string
+	// prewarmer holds the images hinted for upcoming deployments, GC keeps them
+	prewarmer *Prewarmer
+	// imageGCPolicy keeps unused images from being pruned
+	imageGCPolicy ImageGCPolicy
+
+	// heavyOps limits concurrent pulls, imports and snapshot creations
+	heavyOps chan struct{}
+
+	// pullsInFlight counts image pulls in progress so GC can avoid them
+	pullsInFlight int64
+
+	// taskStatuses caches the task status of the containers while WatchTaskEvents runs
+	taskStatuses *taskStatusIndex
+
+	// imageListing keeps the records of the last image listing for its next pages
+	imageListingMutex sync.Mutex
+	imageListing      *imageListing
 }
 
 // NewClient creates a new containerd client
@@ -51,14 +138,78 @@ func NewClient(socket, namespace string) (*Client, error) {
 	// Create a namespaced context
 	ctx := namespaces.WithNamespace(context.Background(), namespace)
 
-	return &Client{
+	c := &Client{
 		client:    client,
 		namespace: namespace,
 		ctx:       ctx,
-	}, nil
+		clientShared: &clientShared{
+			pullOptions:  DefaultPullOptions(),
+			heavyOps:     make(chan struct{}, DefaultMaxHeavyOperations),
+			taskStatuses: newTaskStatusIndex(),
+		},
+	}
+
+	// Fail early with a clear message instead of on the first unsupported call
+	caps, err := c.negotiate(ctx, socket)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.capabilities = caps
+	return c, nil
+}
+
+// WithNamespace returns a client whose operations run in the given containerd namespace
+// The returned client shares the connection and settings with c, so it must not be
+// closed separately.
+func (c *Client) WithNamespace(namespace string) *Client {
+	return &Client{
+		client:       c.client,
+		namespace:    namespace,
+		ctx:          namespaces.WithNamespace(context.Background(), namespace),
+		clientShared: c.clientShared,
+	}
+}
+
+// Namespace returns the containerd namespace the client operates in
+func (c *Client) Namespace() string {
+	return c.namespace
 }
 
-// Close closes the containerd client
+// withNamespace scopes ctx to the client's namespace
+// The containerd connection defaults to the namespace of the root client, so
+// sub-clients have to set theirs on every call.
+func (c *Client) withNamespace(ctx context.Context) context.Context {
+	return namespaces.WithNamespace(ctx, c.namespace)
+}
+
+// SetMaxHeavyOperations limits how many pulls, imports and snapshot creations may
+// run at the same time, protecting the disk and memory of small hosts
+func (c *Client) SetMaxHeavyOperations(n int) {
+	if n <= 0 {
+		n = DefaultMaxHeavyOperations
+	}
+	c.mu.Lock()
+	c.heavyOps = make(chan struct{}, n)
+	c.mu.Unlock()
+}
+
+// acquireHeavy waits for a heavy operation slot, returning the function that frees it
+func (c *Client) acquireHeavy(ctx context.Context) (func(), error) {
+	// Hold on to the channel so a concurrent SetMaxHeavyOperations can't unbalance it
+	c.mu.RLock()
+	sem := c.heavyOps
+	c.mu.RUnlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the containerd client, including for all sub-clients
 func (c *Client) Close() error {
 	if c.client != nil {
 		return c.client.Close()
@@ -73,7 +224,7 @@ func (c *Client) Ping(ctx context.Context) error {
 	defer cancel()
 
 	// Try to ping containerd
-	_, err := c.client.Version(ctx)
+	_, err := c.client.Version(c.withNamespace(ctx))
 	if err != nil {
 		return errors.Wrap(err, "failed to ping containerd")
 	}
@@ -83,35 +234,30 @@ func (c *Client) Ping(ctx context.Context) error {
 
 // GetContainers returns a list of all containers
 func (c *Client) GetContainers(ctx context.Context) ([]containerd.Container, error) {
-	return c.client.Containers(ctx)
+	return c.client.Containers(c.withNamespace(ctx))
 }
 
 // GetContainer returns a specific container by ID
 func (c *Client) GetContainer(ctx context.Context, id string) (containerd.Container, error) {
-	return c.client.LoadContainer(ctx, id)
+	return c.client.LoadContainer(c.withNamespace(ctx), id)
 }
 
 // GetRunningContainers returns a list of running containers
 func (c *Client) GetRunningContainers(ctx context.Context) ([]containerd.Container, error) {
+	ctx = c.withNamespace(ctx)
 	containers, err := c.client.Containers(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	statuses, err := c.TaskStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	var running []containerd.Container
 	for _, container := range containers {
-		task, err := container.Task(ctx, nil)
-		if err != nil {
-			continue
-		}
-
-		status, err := task.Status(ctx)
-		if err != nil {
-			log.Printf("Warning: Failed to get status for container %s: %v", container.ID(), err)
-			continue
-		}
-
-		if status.Status == containerd.Running {
+		if statuses[container.ID()].Status == containerd.Running {
 			running = append(running, container)
 		}
 	}
@@ -119,6 +265,20 @@ func (c *Client) GetRunningContainers(ctx context.Context) ([]containerd.Contain
 	return running, nil
 }
 
+// SetCredentialStore sets the credential store used to authenticate registry requests
+func (c *Client) SetCredentialStore(store *CredentialStore) {
+	c.mu.Lock()
+	c.credentials = store
+	c.mu.Unlock()
+}
+
+// credentialStore returns the credential store, nil if none is set
+func (c *Client) credentialStore() *CredentialStore {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.credentials
+}
+
 // GetContainerdClient returns the raw containerd client for advanced operations
 func (c *Client) GetContainerdClient() *containerd.Client {
 	return c.client
@@ -129,6 +289,15 @@ func (c *Client) GetNamespacedContext() context.Context {
 	return c.ctx
 }
 
+// RuntimeVersion returns the version of the containerd daemon
+func (c *Client) RuntimeVersion(ctx context.Context) (string, error) {
+	version, err := c.client.Version(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get containerd version")
+	}
+	return version.Version, nil
+}
+
 // VerifyConnection checks if the connection to containerd is working
 func (c *Client) VerifyConnection(ctx context.Context) error {
 	// Add a timeout
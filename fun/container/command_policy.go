@@ -0,0 +1,153 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// Command policy rules, reported with each violation
+const (
+	PolicyRuleCommand  = "command"
+	PolicyRuleRegistry = "registry"
+	PolicyRuleDevice   = "device"
+)
+
+// CommandPolicy constrains what the orchestrator may do on the host
+// It is only read from the host, the orchestrator can't replace it. An empty
+// policy allows everything.
+type CommandPolicy struct {
+	// AllowedCommands lists the command types the orchestrator may send, empty allows all
+	AllowedCommands []string `json:"allowed_commands,omitempty"`
+	// DeniedCommands lists command types that are always refused
+	DeniedCommands []string `json:"denied_commands,omitempty"`
+	// AllowedRegistries lists registry hosts deployed images may come from, "*.example.com" matches subdomains
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+	// DenyPrivileged refuses containers that attach host devices. Desired states
+	// can't ask for privileged mode, host mounts or fixed devices.
+	DenyPrivileged bool `json:"deny_privileged,omitempty"`
+}
+
+// PolicyViolation is a single rule a command broke
+type PolicyViolation struct {
+	Rule    string
+	Subject string
+	Reason  string
+}
+
+// CommandPolicyError is returned when the policy refuses a command
+type CommandPolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *CommandPolicyError) Error() string {
+	reasons := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		reasons[i] = v.Reason
+	}
+	return "refused by the host's command policy: " + strings.Join(reasons, "; ")
+}
+
+// LoadCommandPolicy reads a command policy file, returning an empty policy if it doesn't exist
+func LoadCommandPolicy(path string) (*CommandPolicy, error) {
+	policy := &CommandPolicy{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read command policy")
+	}
+
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrap(err, "failed to parse command policy")
+	}
+	return policy, nil
+}
+
+// CheckCommand refuses command types the policy doesn't allow
+func (p *CommandPolicy) CheckCommand(commandType string) error {
+	for _, denied := range p.DeniedCommands {
+		if denied == commandType {
+			return refusal(PolicyRuleCommand, commandType, fmt.Sprintf("command %s is denied", commandType))
+		}
+	}
+	if len(p.AllowedCommands) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedCommands {
+		if allowed == commandType {
+			return nil
+		}
+	}
+	return refusal(PolicyRuleCommand, commandType, fmt.Sprintf("command %s is not allowed", commandType))
+}
+
+// CheckDesiredState checks every container and init container of a desired
+// state, reporting all violations at once
+func (p *CommandPolicy) CheckDesiredState(desired DesiredState) error {
+	var violations []PolicyViolation
+	for _, d := range desired.Containers {
+		violations = append(violations, p.checkContainer(d.createOptions())...)
+		for _, initContainer := range d.InitContainers {
+			violations = append(violations, p.checkImage(d.Name+"/"+initContainer.Name, initContainer.Image)...)
+		}
+	}
+	if len(violations) > 0 {
+		return &CommandPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// CheckImages applies the registry rules to images the orchestrator asks the
+// host to pull ahead of a deployment
+func (p *CommandPolicy) CheckImages(images []string) error {
+	var violations []PolicyViolation
+	for _, image := range images {
+		violations = append(violations, p.checkImage(image, image)...)
+	}
+	if len(violations) > 0 {
+		return &CommandPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// checkContainer applies the image and device rules to a container
+func (p *CommandPolicy) checkContainer(opts CreateContainerOptions) []PolicyViolation {
+	violations := p.checkImage(opts.Name, opts.Image)
+	if p.DenyPrivileged {
+		for _, selector := range opts.HotplugDevices {
+			violations = append(violations, PolicyViolation{
+				Rule:    PolicyRuleDevice,
+				Subject: opts.Name,
+				Reason:  fmt.Sprintf("container %s attaches host devices %s", opts.Name, selector),
+			})
+		}
+	}
+	return violations
+}
+
+// checkImage applies the registry rule to the image of a container
+func (p *CommandPolicy) checkImage(name, image string) []PolicyViolation {
+	if len(p.AllowedRegistries) == 0 {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return []PolicyViolation{{Rule: PolicyRuleRegistry, Subject: name, Reason: fmt.Sprintf("container %s has an invalid image %q", name, image)}}
+	}
+	if registry := reference.Domain(named); !registryAllowed(p.AllowedRegistries, registry) {
+		return []PolicyViolation{{Rule: PolicyRuleRegistry, Subject: name, Reason: fmt.Sprintf("container %s uses registry %s", name, registry)}}
+	}
+	return nil
+}
+
+// refusal builds the error of a single violation
+func refusal(rule, subject, reason string) error {
+	return &CommandPolicyError{Violations: []PolicyViolation{{Rule: rule, Subject: subject, Reason: reason}}}
+}
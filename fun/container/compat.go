@@ -0,0 +1,133 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/plugins"
+	"github.com/pkg/errors"
+)
+
+// Range of containerd server versions the v2 client is known to work with
+const (
+	MinContainerdMajor = 1
+	MinContainerdMinor = 7
+	MaxContainerdMajor = 2
+)
+
+// Capabilities are the optional features of the connected containerd
+type Capabilities struct {
+	Version string `json:"version"`
+	// Transfer is the transfer service, added in containerd 1.7
+	Transfer bool `json:"transfer"`
+	// Sandbox is the sandbox controller API, which CRI uses for pods since containerd 2.0
+	Sandbox bool `json:"sandbox"`
+	// CRI is the Kubernetes CRI plugin
+	CRI bool `json:"cri"`
+	// SnapshotterRoots are the directories of the snapshotters by name, where
+	// the image layers and container filesystems take up disk space
+	SnapshotterRoots map[string]string `json:"snapshotter_roots,omitempty"`
+}
+
+// IncompatibleVersionError is returned when the containerd server speaks an API the client doesn't
+type IncompatibleVersionError struct {
+	Version string
+	Socket  string
+}
+
+func (e *IncompatibleVersionError) Error() string {
+	return fmt.Sprintf("containerd %s at %s is not supported, funserver needs containerd %d.%d up to %d.x; "+
+		"stop it and use the bundled containerd (%s) or point containerd_socket at a supported one",
+		e.Version, e.Socket, MinContainerdMajor, MinContainerdMinor, MaxContainerdMajor, GetBundledContainerdPath())
+}
+
+// negotiate checks that the server version is supported and detects its capabilities
+func (c *Client) negotiate(ctx context.Context, socket string) (Capabilities, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	version, err := c.client.Version(ctx)
+	if err != nil {
+		return Capabilities{}, errors.Wrap(err, "failed to get containerd version")
+	}
+	if !supportedContainerdVersion(version.Version) {
+		return Capabilities{}, &IncompatibleVersionError{Version: version.Version, Socket: socket}
+	}
+
+	caps := Capabilities{Version: version.Version}
+	resp, err := c.client.IntrospectionService().Plugins(ctx)
+	if err != nil {
+		// Servers restricting introspection are usable, just without the optional features
+		return caps, nil
+	}
+	for _, plugin := range resp.Plugins {
+		if plugin.InitErr != nil {
+			continue
+		}
+		switch {
+		case plugin.Type == plugins.TransferPlugin.String():
+			caps.Transfer = true
+		case plugin.Type == plugins.SandboxControllerPlugin.String():
+			caps.Sandbox = true
+		case plugin.Type == plugins.GRPCPlugin.String() && plugin.ID == "cri":
+			caps.CRI = true
+		case plugin.Type == plugins.SnapshotPlugin.String() && plugin.Exports[plugins.SnapshotterRootDir] != "":
+			if caps.SnapshotterRoots == nil {
+				caps.SnapshotterRoots = map[string]string{}
+			}
+			caps.SnapshotterRoots[plugin.ID] = plugin.Exports[plugins.SnapshotterRootDir]
+		}
+	}
+	return caps, nil
+}
+
+// supportedContainerdVersion reports whether a server version such as "v2.0.3" or
+// "1.7.24-rc.1" is in the supported range. Unparseable versions, e.g. from
+// development builds, are given the benefit of the doubt.
+func supportedContainerdVersion(version string) bool {
+	major, minor, ok := parseContainerdVersion(version)
+	if !ok {
+		return true
+	}
+	if major < MinContainerdMajor || (major == MinContainerdMajor && minor < MinContainerdMinor) {
+		return false
+	}
+	return major <= MaxContainerdMajor
+}
+
+// parseContainerdVersion returns the major and minor version of a containerd release
+func parseContainerdVersion(version string) (major, minor int, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// Capabilities returns the features detected when the client connected
+func (c *Client) Capabilities() Capabilities {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities
+}
+
+// RequireCRI returns an error unless the connected containerd loaded its CRI
+// plugin, which may be disabled or have failed to load, e.g. without a CNI setup
+func (c *Client) RequireCRI() error {
+	caps := c.Capabilities()
+	if !caps.CRI {
+		return fmt.Errorf("the CRI plugin is not loaded in containerd %s", caps.Version)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// LabelConfigFiles lists the container paths of a container's templated config
+// files, the templates themselves are kept in its state directory
+const LabelConfigFiles = "fun.config-files"
+
+// configFilesState is the file in a container's state directory holding the
+// templates and the values they are rendered with
+const configFilesState = "config-files.json"
+
+// ConfigFile is a file rendered from a Go template by the daemon and mounted
+// read-only into a container
+// Templates see the container's environment as .Env and can read secrets from
+// the daemon's secrets directory with {{ secret "name" }}.
+type ConfigFile struct {
+	Path     string `json:"path"`
+	Template string `json:"template"`
+	// Mode of the rendered file, 0 is 0400; files are owned by the container's user
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
+// configFiles is what a container's config files are rendered from
+type configFiles struct {
+	Env   []string     `json:"env,omitempty"`
+	Files []ConfigFile `json:"files"`
+	// UID and GID of the container's user, who owns the rendered files
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+}
+
+// SetSecretsDir sets the directory config file templates read secrets from
+func (c *Client) SetSecretsDir(dir string) {
+	c.mu.Lock()
+	c.secretsDir = dir
+	c.mu.Unlock()
+}
+
+// validateConfigFiles checks that config files have unique absolute paths and
+// templates that parse
+func validateConfigFiles(files []ConfigFile) error {
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if !path.IsAbs(file.Path) {
+			return fmt.Errorf("config file path %q must be absolute", file.Path)
+		}
+		if seen[file.Path] {
+			return fmt.Errorf("config file %s is listed more than once", file.Path)
+		}
+		seen[file.Path] = true
+		if _, err := newConfigTemplate(file, ""); err != nil {
+			return fmt.Errorf("config file %s: %w", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// configFilesLabel returns the sorted container paths of files
+func configFilesLabel(files []ConfigFile) string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, ",")
+}
+
+// newConfigTemplate parses the template of a config file, missing values are
+// errors rather than empty strings
+func newConfigTemplate(file ConfigFile, secretsDir string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			if secretsDir == "" || name == "" || strings.ContainsAny(name, `/\`) || name == ".." {
+				return "", fmt.Errorf("invalid secret %q", name)
+			}
+			data, err := os.ReadFile(filepath.Join(secretsDir, name))
+			if err != nil {
+				return "", fmt.Errorf("failed to read secret %s: %w", name, err)
+			}
+			return strings.TrimRight(string(data), "\n"), nil
+		},
+	}
+	return template.New(file.Path).Funcs(funcs).Option("missingkey=error").Parse(file.Template)
+}
+
+// renderConfigFile renders a config file with the container's environment
+func renderConfigFile(file ConfigFile, env []string, secretsDir string) ([]byte, error) {
+	tmpl, err := newConfigTemplate(file, secretsDir)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(env))
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		values[name] = value
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, map[string]interface{}{"Env": values}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// configFileSource returns where the rendered file for a container path is kept
+func (c *Client) configFileSource(containerID string, index int, file ConfigFile) string {
+	return filepath.Join(c.containerStateDir(containerID), "config", fmt.Sprintf("%d-%s", index, path.Base(file.Path)))
+}
+
+// writeConfigFiles stores the templates of a container, renders them and
+// returns the mounts for them
+func (c *Client) writeConfigFiles(containerID string, env []string, files []ConfigFile) ([]specs.Mount, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if err := c.saveConfigFiles(containerID, configFiles{Env: env, Files: files}); err != nil {
+		return nil, err
+	}
+	if _, err := c.renderConfigFiles(containerID, false); err != nil {
+		return nil, err
+	}
+
+	var mounts []specs.Mount
+	for i, file := range files {
+		mounts = append(mounts, specs.Mount{
+			Type:        "bind",
+			Source:      c.configFileSource(containerID, i, file),
+			Destination: file.Path,
+			Options:     []string{"rbind", "ro"},
+		})
+	}
+	return mounts, nil
+}
+
+// saveConfigFiles writes the templates of a container to its state directory
+func (c *Client) saveConfigFiles(containerID string, state configFiles) error {
+	// Only the daemon reads the rendered files, containers see them through their mounts
+	dir := filepath.Join(c.containerStateDir(containerID), "config")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create config file directory")
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal config files")
+	}
+	// The environment may hold credentials
+	if err := writeStateFile(filepath.Join(c.containerStateDir(containerID), configFilesState), data, 0600, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to save config files")
+	}
+	return nil
+}
+
+// loadConfigFiles reads the stored templates of a container
+func (c *Client) loadConfigFiles(containerID string) (configFiles, error) {
+	var state configFiles
+	data, err := os.ReadFile(filepath.Join(c.containerStateDir(containerID), configFilesState))
+	if err != nil {
+		return state, errors.Wrap(err, "failed to read config files")
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Wrap(err, "failed to parse config files")
+	}
+	return state, nil
+}
+
+// renderConfigFiles renders the stored templates of a container, reporting
+// whether any rendered file changed
+// Files are replaced through a temporary file, except those of a running
+// container: its bind mounts hold on to the old file, so they are rewritten in
+// place instead.
+func (c *Client) renderConfigFiles(containerID string, running bool) (bool, error) {
+	state, err := c.loadConfigFiles(containerID)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	secretsDir := c.secretsDir
+	c.mu.RUnlock()
+
+	changed := false
+	for i, file := range state.Files {
+		content, err := renderConfigFile(file, state.Env, secretsDir)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to render %s", file.Path)
+		}
+		source := c.configFileSource(containerID, i, file)
+		if current, err := os.ReadFile(source); err == nil && bytes.Equal(current, content) {
+			continue
+		}
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0400
+		}
+		if running && fileExists(source) {
+			// The daemon runs as root, which writes read-only files
+			err = os.WriteFile(source, content, mode)
+		} else {
+			err = writeStateFile(source, content, mode, state.UID, state.GID)
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to write %s", file.Path)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// reloadConfigFiles re-renders a container's config files and sends SIGHUP to
+// it if it is running and a file changed
+func (c *Client) reloadConfigFiles(ctx context.Context, container containerd.Container) error {
+	// Mounts of a paused container hold on to the files just the same
+	task, err := container.Task(ctx, nil)
+	running := err == nil
+	changed, err := c.renderConfigFiles(container.ID(), running)
+	if err != nil || !changed || !running {
+		return err
+	}
+	if status, err := task.Status(ctx); err != nil || status.Status != containerd.Running {
+		return nil
+	}
+	log.Printf("Config files of container %s changed, sending SIGHUP", container.ID())
+	if err := task.Kill(ctx, syscall.SIGHUP); err != nil {
+		return errors.Wrap(err, "failed to signal container")
+	}
+	return nil
+}
+
+// UpdateConfigFiles replaces the templates of a container's config files,
+// re-rendering them and signaling the container if they changed
+// The paths must be the ones the container was created with, other paths need
+// new mounts and so a new container.
+func (c *Client) UpdateConfigFiles(ctx context.Context, containerID string, files []ConfigFile) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("update config files of container %s", containerID) {
+		return nil
+	}
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container labels")
+	}
+	if labels[LabelConfigFiles] != configFilesLabel(files) {
+		return fmt.Errorf("config file paths of container %s changed, it has to be recreated", containerID)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	state, err := c.loadConfigFiles(containerID)
+	if err != nil {
+		return err
+	}
+	// Keep the order of the existing mounts, their sources are numbered
+	byPath := make(map[string]ConfigFile, len(files))
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+	for i, file := range state.Files {
+		state.Files[i] = byPath[file.Path]
+	}
+	if err := c.saveConfigFiles(containerID, state); err != nil {
+		return err
+	}
+	return c.reloadConfigFiles(ctx, container)
+}
+
+// RefreshConfigFiles re-renders the config files of all containers, e.g. after
+// a secret changed, signaling the containers whose files changed
+func (c *Client) RefreshConfigFiles(ctx context.Context) error {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx, fmt.Sprintf("labels.%q", LabelConfigFiles))
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+	for _, container := range containers {
+		if err := c.reloadConfigFiles(ctx, container); err != nil {
+			log.Printf("Warning: Failed to refresh config files of container %s: %v", container.ID(), err)
+		}
+	}
+	return nil
+}
+
+// ensureConfigFiles renders the config files of a container before it starts,
+// so the bind mount sources exist even if the state directory was cleaned up
+func (c *Client) ensureConfigFiles(containerID string, labels map[string]string) error {
+	if labels[LabelConfigFiles] == "" {
+		return nil
+	}
+	_, err := c.renderConfigFiles(containerID, false)
+	return err
+}
+
+// setConfigFilesOwner hands the config files of a new container to the user
+// its spec runs as, the user is only known once the spec is built
+func (c *Client) setConfigFilesOwner(ctx context.Context, container containerd.Container) error {
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container spec")
+	}
+	if spec.Process == nil || (spec.Process.User.UID == 0 && spec.Process.User.GID == 0) {
+		return nil
+	}
+	state, err := c.loadConfigFiles(container.ID())
+	if err != nil {
+		return err
+	}
+	state.UID, state.GID = int(spec.Process.User.UID), int(spec.Process.User.GID)
+	if err := c.saveConfigFiles(container.ID(), state); err != nil {
+		return err
+	}
+	for i, file := range state.Files {
+		if err := os.Chown(c.configFileSource(container.ID(), i, file), state.UID, state.GID); err != nil {
+			return errors.Wrapf(err, "failed to set the owner of %s", file.Path)
+		}
+	}
+	return nil
+}
@@ -2,14 +2,23 @@ package container
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/v2/core/remotes/docker/config"
 	"github.com/containerd/containerd/v2/pkg/cio"
 	"github.com/containerd/containerd/v2/pkg/oci"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -18,24 +27,41 @@ import (
 
 // Container represents a managed container
 type Container struct {
-	ID              string            `json:"id"`
-	Name            string            `json:"name"`
-	ImageRef        string            `json:"image_ref"`
-	Command         []string          `json:"command"`
-	Args            []string          `json:"args"`
-	Env             []string          `json:"env"`
-	Labels          map[string]string `json:"labels"`
-	Status          string            `json:"status"`
-	CreatedAt       time.Time         `json:"created_at"`
-	RestartPolicy   string            `json:"restart_policy"`
-	PrivilegedMode  bool              `json:"privileged_mode"`
-	ContainerClient *Client           `json:"-"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	ImageRef      string            `json:"image_ref"`
+	Command       []string          `json:"command"`
+	Args          []string          `json:"args"`
+	Env           []string          `json:"env"`
+	Labels        map[string]string `json:"labels"`
+	Status        string            `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	RestartPolicy string            `json:"restart_policy"`
+	RestartCount  int               `json:"restart_count"`
+	CrashLooping  bool              `json:"crash_looping"`
+	// Termination describes how the last run ended, nil if it never exited
+	Termination *TerminationInfo `json:"termination,omitempty"`
+	// Critical containers are reported to the orchestrator as soon as they exit
+	Critical bool `json:"critical"`
+	// Priority is the priority class, Preempted why the container was stopped to relieve resource pressure
+	Priority  string `json:"priority"`
+	Preempted string `json:"preempted,omitempty"`
+	// Ports are the container ports published on the host
+	Ports []PortMapping `json:"ports,omitempty"`
+	// StartedAt is when the task last started, nil if the start wasn't recorded
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	PrivilegedMode  bool       `json:"privileged_mode"`
+	ContainerClient *Client    `json:"-"`
 }
 
 // CreateContainerOptions contains options for creating a container
 type CreateContainerOptions struct {
+	// ID defaults to one chosen by the client's ID scheme, Name to one derived
+	// from Service and Replica or a random one
 	ID             string
 	Name           string
+	Service        string
+	Replica        int
 	Image          string
 	Command        []string
 	Args           []string
@@ -44,19 +70,140 @@ type CreateContainerOptions struct {
 	Mounts         []specs.Mount
 	RestartPolicy  string
 	PrivilegedMode bool
+
+	// Replaces is the ID of a container the new one takes the name of, it keeps
+	// running until the new one started and is removed by the caller
+	Replaces string
+
+	// Devices maps host devices into the container without full privileged mode
+	Devices []DeviceMapping
+	// HotplugDevices select USB and serial devices, by /dev path glob or USB ID
+	// such as 0403:6001, that are attached whenever they are plugged in
+	HotplugDevices []string
+	// CapAdd and CapDrop grant or remove individual capabilities, e.g. NET_BIND_SERVICE
+	CapAdd  []string
+	CapDrop []string
+	// GroupAdd adds supplementary groups (names or GIDs) to the container process
+	GroupAdd []string
+
+	// PullPolicy controls whether the image is pulled, defaults to PullIfNotPresent
+	PullPolicy ImagePullPolicy
+
+	// Network attaches the container to a user-defined network
+	Network string
+	// IPAddress requests a static address on Network; empty assigns the next free one
+	IPAddress string
+	// Ports are published on the host by the daemon's PortForwarder
+	Ports []PortMapping
+
+	// Hostname sets the container hostname
+	Hostname string
+	// ExtraHosts adds host:ip entries to /etc/hosts
+	ExtraHosts []string
+	// DNS, DNSSearch and DNSOptions configure /etc/resolv.conf
+	DNS        []string
+	DNSSearch  []string
+	DNSOptions []string
+
+	// HealthCheck configures startup, readiness and liveness probes
+	HealthCheck *HealthCheckConfig
+
+	// Resources limits CPU, memory, swap, block I/O and egress bandwidth
+	Resources ResourceLimits
+
+	// Timezone and Locale are ZoneHost, ZoneNone or a zone such as Europe/Berlin
+	// and a locale such as de_DE.UTF-8, empty uses the client's defaults
+	Timezone string
+	Locale   string
+
+	// ConfigFiles are rendered from templates and mounted read-only
+	ConfigFiles []ConfigFile
+
+	// Priority is the priority class, lower ones are preempted first under resource pressure
+	Priority string
+
+	// LogOptions override the client's log limits, see ParseLogOptions
+	LogOptions map[string]string
+}
+
+// DeviceMapping describes a host device exposed inside a container
+type DeviceMapping struct {
+	HostPath      string
+	ContainerPath string
+	// Permissions is a combination of r (read), w (write) and m (mknod)
+	Permissions string
+}
+
+// ParseDeviceMapping parses a device specification in the form host[:container[:permissions]]
+func ParseDeviceMapping(spec string) (DeviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 0 || parts[0] == "" || len(parts) > 3 {
+		return DeviceMapping{}, fmt.Errorf("invalid device specification: %s", spec)
+	}
+
+	device := DeviceMapping{
+		HostPath:      parts[0],
+		ContainerPath: parts[0],
+		Permissions:   "rwm",
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		device.ContainerPath = parts[1]
+	}
+	if len(parts) > 2 {
+		device.Permissions = parts[2]
+		for _, p := range device.Permissions {
+			if p != 'r' && p != 'w' && p != 'm' {
+				return DeviceMapping{}, fmt.Errorf("invalid device permissions %q in %s", device.Permissions, spec)
+			}
+		}
+	}
+
+	return device, nil
+}
+
+// normalizeCapabilities converts capability names to the CAP_ prefixed form used by OCI
+func normalizeCapabilities(caps []string) []string {
+	var result []string
+	for _, c := range caps {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		result = append(result, c)
+	}
+	return result
 }
 
 // CreateContainer creates a new container
 func (c *Client) CreateContainer(ctx context.Context, opts CreateContainerOptions) (*Container, error) {
-	// Pull the image first
-	image, err := c.PullImage(ctx, opts.Image)
+	ctx = c.withNamespace(ctx)
+	if c.DryRun() {
+		return c.dryRunCreate(ctx, opts)
+	}
+
+	// Make sure the image is available according to the pull policy
+	image, err := c.EnsureImage(ctx, opts.Image, opts.PullPolicy)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to pull image")
+		return nil, errors.Wrap(err, "failed to get image")
+	}
+
+	// Choose the name and ID according to the naming scheme
+	if err := c.assignName(&opts); err != nil {
+		return nil, err
 	}
 
-	// Create a unique container ID if not provided
-	if opts.ID == "" {
-		opts.ID = opts.Name
+	var imageEnv []string
+	if spec, err := image.Spec(ctx); err == nil {
+		imageEnv = spec.Config.Env
+	}
+	if err := c.applyTimezone(&opts, imageEnv); err != nil {
+		return nil, err
+	}
+	if err := applyHotplugDevices(&opts); err != nil {
+		return nil, err
 	}
 
 	// Prepare container options
@@ -69,9 +216,16 @@ func (c *Client) CreateContainer(ctx context.Context, opts CreateContainerOption
 		containerOpts = append(containerOpts, oci.WithProcessArgs(append(opts.Command, opts.Args...)...))
 	}
 
-	// Add mounts if provided
-	if len(opts.Mounts) > 0 {
-		containerOpts = append(containerOpts, oci.WithMounts(opts.Mounts))
+	// Add mounts if provided, relabeling those marked z or Z for SELinux
+	mounts, selinuxLabel, err := relabelMounts(opts.Mounts)
+	if err != nil {
+		return nil, err
+	}
+	if len(mounts) > 0 {
+		containerOpts = append(containerOpts, oci.WithMounts(mounts))
+	}
+	if selinuxLabel != "" {
+		containerOpts = append(containerOpts, oci.WithSelinuxLabel(selinuxLabel))
 	}
 
 	// Set privileged mode if requested
@@ -79,6 +233,236 @@ func (c *Client) CreateContainer(ctx context.Context, opts CreateContainerOption
 		containerOpts = append(containerOpts, oci.WithPrivileged)
 	}
 
+	// Grant individual devices, capabilities and groups
+	for _, device := range opts.Devices {
+		containerOpts = append(containerOpts, oci.WithDevices(device.HostPath, device.ContainerPath, device.Permissions))
+	}
+	if opts.Labels[LabelDevices] != "" {
+		containerOpts = append(containerOpts, withHotplugDeviceRules(opts.Labels[LabelDevicesAttached]))
+	}
+	if caps := normalizeCapabilities(opts.CapAdd); len(caps) > 0 {
+		containerOpts = append(containerOpts, oci.WithAddedCapabilities(caps))
+	}
+	if caps := normalizeCapabilities(opts.CapDrop); len(caps) > 0 {
+		containerOpts = append(containerOpts, oci.WithDroppedCapabilities(caps))
+	}
+	if len(opts.GroupAdd) > 0 {
+		containerOpts = append(containerOpts, oci.WithAppendAdditionalGroups(opts.GroupAdd...))
+	}
+
+	// Apply resource limits
+	resourceOpts, err := opts.Resources.specOpts()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid resource limits")
+	}
+	containerOpts = append(containerOpts, resourceOpts...)
+
+	// Refuse or queue placements that don't fit on the host. The reservation is
+	// kept until the container exists, or dropped if creating it fails.
+	releasePlacement, err := c.admit(ctx, opts.Resources)
+	if err != nil {
+		return nil, err
+	}
+	defer releasePlacement()
+	if err := c.checkNameCollision(ctx, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Resources.EgressRate > 0 {
+		if opts.Network == "" {
+			return nil, errors.New("egress limits require a network")
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelEgressRate] = strconv.FormatUint(opts.Resources.EgressRate, 10)
+	}
+	if opts.Resources.CpusetCPUs != "" || opts.Resources.CpusetMems != "" {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		if opts.Resources.CpusetCPUs != "" {
+			opts.Labels[LabelCpusetCPUs] = opts.Resources.CpusetCPUs
+		}
+		if opts.Resources.CpusetMems != "" {
+			opts.Labels[LabelCpusetMems] = opts.Resources.CpusetMems
+		}
+	}
+
+	if len(opts.Ports) > 0 {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelPorts] = portsLabel(opts.Ports)
+	}
+	if len(opts.LogOptions) > 0 {
+		if _, err := ParseLogOptions(opts.LogOptions, LogLimits{}); err != nil {
+			return nil, err
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelLogOptions] = logOptionsLabel(opts.LogOptions)
+	}
+
+	// A failed create only rolls back what it added: a container re-created
+	// with the same ID keeps the address and state files it already had
+	stateExisted := dirExists(c.containerStateDir(opts.ID))
+	allocated := false
+	ipam := c.GetIPAMStore()
+	rollback := func() {
+		if allocated {
+			ipam.Release(opts.ID)
+		}
+		if !stateExisted {
+			c.removeContainerState(opts.ID)
+		}
+	}
+
+	// Reserve an address before creating the container so conflicts fail early
+	if opts.Network != "" {
+		if ipam == nil {
+			return nil, errors.New("networks are not available without an IPAM store")
+		}
+
+		_, hadAddress := ipam.AddressOf(opts.Network, opts.ID)
+		ip, err := ipam.Allocate(opts.Network, opts.ID, opts.IPAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to assign IP address")
+		}
+		allocated = !hadAddress
+
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelNetwork] = opts.Network
+		opts.Labels[LabelIPAddress] = ip
+	}
+
+	// Render /etc/hosts, /etc/hostname and /etc/resolv.conf if requested
+	if err := validateExtraHosts(opts.ExtraHosts); err != nil {
+		rollback()
+		return nil, err
+	}
+	etcSettings := etcFilesSettings{
+		Hostname:   opts.Hostname,
+		ExtraHosts: opts.ExtraHosts,
+		DNS:        opts.DNS,
+		DNSSearch:  opts.DNSSearch,
+		DNSOptions: opts.DNSOptions,
+		IPAddress:  opts.Labels[LabelIPAddress],
+	}
+	etcMounts, err := c.writeEtcFiles(opts.ID, etcSettings)
+	if err != nil {
+		rollback()
+		return nil, errors.Wrap(err, "failed to prepare container /etc files")
+	}
+	if len(etcMounts) > 0 {
+		// A confined container can only read the generated files once they're labeled for it
+		if selinuxLabel != "" {
+			for _, mount := range etcMounts {
+				if err := relabelPath(mount.Source, selinuxFileLabel); err != nil {
+					rollback()
+					return nil, err
+				}
+			}
+		}
+		containerOpts = append(containerOpts, oci.WithMounts(etcMounts))
+
+		label, err := etcSettingsLabel(etcSettings)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelEtcSettings] = label
+	}
+
+	if len(opts.ConfigFiles) > 0 {
+		if err := validateConfigFiles(opts.ConfigFiles); err != nil {
+			rollback()
+			return nil, err
+		}
+		configMounts, err := c.writeConfigFiles(opts.ID, opts.Env, opts.ConfigFiles)
+		if err != nil {
+			rollback()
+			return nil, errors.Wrap(err, "failed to render config files")
+		}
+		if selinuxLabel != "" {
+			for _, mount := range configMounts {
+				if err := relabelPath(mount.Source, selinuxFileLabel); err != nil {
+					rollback()
+					return nil, err
+				}
+			}
+		}
+		containerOpts = append(containerOpts, oci.WithMounts(configMounts))
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelConfigFiles] = configFilesLabel(opts.ConfigFiles)
+	}
+	if opts.Hostname != "" {
+		containerOpts = append(containerOpts, oci.WithHostname(opts.Hostname))
+	}
+
+	// With the systemd driver runc expects a slice:prefix:name cgroup path
+	if c.getCgroupDriver() == CgroupDriverSystemd {
+		containerOpts = append(containerOpts, oci.WithCgroup(systemdCgroupPath(opts.ID)))
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelCgroupDriver] = CgroupDriverSystemd
+	}
+
+	// Record the restart policy for the daemon's restart supervisor
+	restartPolicy, err := ParseRestartPolicy(opts.RestartPolicy)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	if restartPolicy != RestartNo {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelRestartPolicy] = restartPolicy
+	}
+
+	// Record non-default priorities for preemption
+	priority, err := ParsePriority(opts.Priority)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	if priority != PriorityNormal {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelPriority] = priority
+	}
+
+	// Store probes in a label so the daemon's health monitor can pick them up
+	if opts.HealthCheck != nil {
+		label, err := healthCheckLabel(opts.HealthCheck)
+		if err != nil {
+			rollback()
+			return nil, errors.Wrap(err, "invalid health check")
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelHealthCheck] = label
+	}
+
+	// Creating the snapshot unpacks the image layers, which is heavy on small hosts
+	release, err := c.acquireHeavy(ctx)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	defer release()
+
 	// Create the container
 	container, err := c.client.NewContainer(
 		ctx,
@@ -86,10 +470,20 @@ func (c *Client) CreateContainer(ctx context.Context, opts CreateContainerOption
 		containerd.WithImage(image),
 		containerd.WithNewSnapshot(opts.ID+"-snapshot", image),
 		containerd.WithNewSpec(containerOpts...),
+		containerd.WithContainerLabels(opts.Labels),
 	)
 	if err != nil {
+		rollback()
 		return nil, errors.Wrap(err, "failed to create container")
 	}
+	if len(opts.ConfigFiles) > 0 {
+		// Without it the container's user can't read its files
+		if err := c.setConfigFilesOwner(ctx, container); err != nil {
+			container.Delete(ctx, containerd.WithSnapshotCleanup)
+			rollback()
+			return nil, err
+		}
+	}
 
 	return &Container{
 		ID:              container.ID(),
@@ -107,37 +501,134 @@ func (c *Client) CreateContainer(ctx context.Context, opts CreateContainerOption
 	}, nil
 }
 
-// StartContainer starts a container
+// StartContainer starts a container, its output goes to its log file
 func (c *Client) StartContainer(ctx context.Context, containerID string) error {
+	return c.startContainer(ctx, containerID, false)
+}
+
+// StartContainerAttached starts a container with its output on the caller's
+// stdio instead of its log file, like a container run in the foreground
+func (c *Client) StartContainerAttached(ctx context.Context, containerID string) error {
+	return c.startContainer(ctx, containerID, true)
+}
+
+// startContainer starts a container, attached to the caller's stdio or logging
+func (c *Client) startContainer(ctx context.Context, containerID string, attached bool) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("start container %s", containerID) {
+		return nil
+	}
 	container, err := c.client.LoadContainer(ctx, containerID)
 	if err != nil {
 		return errors.Wrap(err, "failed to load container")
 	}
 
-	// Create an IO for the container
-	logFile, err := os.Create(filepath.Join(os.TempDir(), containerID+".log"))
+	labels, err := container.Labels(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to create log file")
+		return errors.Wrap(err, "failed to get container labels")
+	}
+
+	// Make sure managed /etc files exist before the bind mounts are set up
+	if err := c.ensureEtcFiles(containerID, labels); err != nil {
+		return errors.Wrap(err, "failed to prepare container /etc files")
+	}
+	if err := c.ensureConfigFiles(containerID, labels); err != nil {
+		return errors.Wrap(err, "failed to render config files")
+	}
+
+	// A started container is eligible for restarts again
+	if labels[LabelStopped] != "" || labels[LabelPreempted] != "" || labels[LabelStandby] != "" {
+		if _, err := container.SetLabels(ctx, map[string]string{LabelStopped: "", LabelPreempted: "", LabelStandby: ""}); err != nil {
+			return errors.Wrap(err, "failed to clear stopped marker")
+		}
+	}
+
+	// Clean up the task of a previous run, otherwise a new one can't be created
+	if oldTask, err := container.Task(ctx, nil); err == nil {
+		if _, err := oldTask.Delete(ctx); err != nil {
+			return errors.Wrap(err, "failed to delete previous task")
+		}
+	}
+
+	// Use the cgroup driver the container's spec was created for
+	var taskOpts []containerd.NewTaskOpts
+	if labels[LabelCgroupDriver] == CgroupDriverSystemd {
+		taskOpts = append(taskOpts, withSystemdCgroup)
+	}
+
+	// Send the output to the log driver with the container's limits
+	ioCreator := cio.NewCreator(cio.WithStdio)
+	if !attached {
+		logLimits, err := c.containerLogLimits(labels)
+		if err != nil {
+			return errors.Wrap(err, "invalid log options")
+		}
+		if ioCreator, err = c.logCreator(containerID, logLimits); err != nil {
+			return err
+		}
+	}
+
+	// Continue from the checkpoint taken when the daemon stopped, if there is one
+	var task containerd.Task
+	if restoreOpts := c.checkpointTaskOpts(ctx, container, labels); restoreOpts != nil {
+		task, err = container.NewTask(ctx, ioCreator, append(taskOpts, restoreOpts...)...)
+		c.client.ImageService().Delete(ctx, labels[LabelCheckpoint])
+		if err != nil {
+			log.Printf("Warning: Failed to restore container %s from its checkpoint, starting it afresh: %v", containerID, err)
+			task = nil
+		}
 	}
 
 	// Create a task
-	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStdio))
-	if err != nil {
-		logFile.Close()
-		return errors.Wrap(err, "failed to create task")
+	if task == nil {
+		task, err = container.NewTask(ctx, ioCreator, taskOpts...)
+		if err != nil {
+			return errors.Wrap(err, "failed to create task")
+		}
+	}
+
+	// Attach the network before the process starts so it never runs unconnected
+	if err := c.attachNetwork(ctx, containerID, task.Pid(), labels); err != nil {
+		task.Delete(ctx, containerd.WithProcessKill)
+		return errors.Wrap(err, "failed to attach network")
+	}
+
+	// Undo the attachment and the task if the process doesn't get going, so the
+	// next start neither finds a stale task nor leaks the interface
+	abort := func() {
+		if err := c.detachNetwork(ctx, containerID, task.Pid(), labels); err != nil {
+			log.Printf("Warning: Failed to detach network for container %s: %v", containerID, err)
+		}
+		task.Delete(ctx, containerd.WithProcessKill)
+	}
+
+	// Shape egress traffic on the freshly attached interface
+	if rate := labels[LabelEgressRate]; rate != "" {
+		bps, err := strconv.ParseUint(rate, 10, 64)
+		if err == nil {
+			err = applyEgressLimit(ctx, task.Pid(), bps)
+		}
+		if err != nil {
+			abort()
+			return errors.Wrap(err, "failed to apply egress limit")
+		}
 	}
 
 	// Start the task
 	if err := task.Start(ctx); err != nil {
-		logFile.Close()
+		abort()
 		return errors.Wrap(err, "failed to start task")
 	}
 
 	return nil
 }
 
-// StopContainer stops a container
+// StopContainer stops a container and marks it as stopped so it is not restarted
 func (c *Client) StopContainer(ctx context.Context, containerID string, timeout time.Duration) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("stop container %s (timeout %v)", containerID, timeout) {
+		return nil
+	}
 	container, err := c.client.LoadContainer(ctx, containerID)
 	if err != nil {
 		return errors.Wrap(err, "failed to load container")
@@ -148,6 +639,15 @@ func (c *Client) StopContainer(ctx context.Context, containerID string, timeout
 		return errors.Wrap(err, "failed to get task")
 	}
 
+	if _, err := container.SetLabels(ctx, map[string]string{LabelStopped: "true"}); err != nil {
+		return errors.Wrap(err, "failed to mark container as stopped")
+	}
+
+	return stopTask(ctx, task, timeout)
+}
+
+// stopTask sends SIGTERM to a task and SIGKILL if it hasn't exited after timeout
+func stopTask(ctx context.Context, task containerd.Task, timeout time.Duration) error {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -176,8 +676,35 @@ func (c *Client) StopContainer(ctx context.Context, containerID string, timeout
 	}
 }
 
+// RestartContainer stops a container if it is running and starts it again
+func (c *Client) RestartContainer(ctx context.Context, containerID string, timeout time.Duration) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("restart container %s (timeout %v)", containerID, timeout) {
+		return nil
+	}
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+
+	if task, err := container.Task(ctx, nil); err == nil {
+		status, err := task.Status(ctx)
+		if err == nil && status.Status == containerd.Running {
+			if err := c.StopContainer(ctx, containerID, timeout); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.StartContainer(ctx, containerID)
+}
+
 // RemoveContainer removes a container
 func (c *Client) RemoveContainer(ctx context.Context, containerID string, force bool) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("remove container %s (force %t)", containerID, force) {
+		return nil
+	}
 	container, err := c.client.LoadContainer(ctx, containerID)
 	if err != nil {
 		return errors.Wrap(err, "failed to load container")
@@ -207,24 +734,152 @@ func (c *Client) RemoveContainer(ctx context.Context, containerID string, force
 		}
 	}
 
+	// Tear down the network attachment and free the address
+	if ipam := c.GetIPAMStore(); ipam != nil {
+		if labels, err := container.Labels(ctx); err == nil && labels[LabelNetwork] != "" {
+			if err := c.detachNetwork(ctx, containerID, 0, labels); err != nil {
+				log.Printf("Warning: Failed to detach network for container %s: %v", containerID, err)
+			}
+			if err := ipam.Release(containerID); err != nil {
+				log.Printf("Warning: Failed to release IP address for container %s: %v", containerID, err)
+			}
+		}
+	}
+
 	// Delete the container
 	if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil {
 		return errors.Wrap(err, "failed to delete container")
 	}
 
+	if err := c.removeContainerState(containerID); err != nil {
+		log.Printf("Warning: Failed to remove state for container %s: %v", containerID, err)
+	}
+
 	return nil
 }
 
-// GetContainerLogs gets the logs from a container
+// InspectContainer returns the details of a container including its current status
+func (c *Client) InspectContainer(ctx context.Context, containerID string) (*Container, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load container")
+	}
+	return c.describeContainer(ctx, container)
+}
+
+// ListContainers returns the details of all containers in the client's namespace
+// The container records and the task statuses are each fetched in one request,
+// so listing doesn't take round trips per container.
+func (c *Client) ListContainers(ctx context.Context) ([]*Container, error) {
+	ctx = c.withNamespace(ctx)
+	records, err := c.client.ContainerService().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+	statuses, err := c.TaskStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Container, 0, len(records))
+	for _, info := range records {
+		status, hasTask := statuses[info.ID]
+		result = append(result, c.containerFromRecord(info, status, hasTask))
+	}
+
+	return result, nil
+}
+
+// describeContainer builds a Container from containerd metadata and task state
+func (c *Client) describeContainer(ctx context.Context, container containerd.Container) (*Container, error) {
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get container info")
+	}
+
+	var status containerd.Status
+	hasTask := false
+	if task, err := container.Task(ctx, nil); err == nil {
+		if status, err = task.Status(ctx); err == nil {
+			hasTask = true
+		}
+	}
+	return c.containerFromRecord(info, status, hasTask), nil
+}
+
+// containerFromRecord builds a Container from its containerd record and the
+// status of its task, hasTask is false for containers without one
+func (c *Client) containerFromRecord(info containers.Container, taskStatus containerd.Status, hasTask bool) *Container {
+	result := &Container{
+		ID:              info.ID,
+		Name:            info.ID,
+		ImageRef:        info.Image,
+		Labels:          info.Labels,
+		Status:          "created",
+		CreatedAt:       info.CreatedAt,
+		RestartPolicy:   info.Labels[LabelRestartPolicy],
+		Critical:        info.Labels[LabelCritical] != "",
+		Priority:        info.Labels[LabelPriority],
+		Preempted:       info.Labels[LabelPreempted],
+		StartedAt:       startedAtFromLabels(info.Labels),
+		Ports:           portsFromLabels(info.Labels),
+		ContainerClient: c,
+	}
+
+	if name := info.Labels[LabelName]; name != "" {
+		result.Name = name
+	}
+
+	restartState := restartStateFromLabels(info.Labels)
+	result.RestartCount = restartState.RestartCount
+	result.CrashLooping = restartState.CrashLooping
+	if result.Priority == "" {
+		result.Priority = PriorityNormal
+	}
+
+	if info.Spec != nil {
+		var spec oci.Spec
+		if err := json.Unmarshal(info.Spec.GetValue(), &spec); err == nil && spec.Process != nil {
+			result.Command = spec.Process.Args
+			result.Env = spec.Process.Env
+		}
+	}
+
+	if hasTask {
+		result.Status = string(taskStatus.Status)
+	}
+	result.Termination = terminationFromTask(info.Labels, taskStatus)
+	if result.CrashLooping && result.Status != string(containerd.Running) {
+		result.Status = "crash-looping"
+	}
+
+	return result
+}
+
+// GetContainerLogs gets the logs from a container, including the rotated files
 func (c *Client) GetContainerLogs(ctx context.Context, containerID string, follow bool, writer io.Writer) error {
 	// Check if the logfile exists
-	logPath := filepath.Join(os.TempDir(), containerID+".log")
+	logPath := c.containerLogPath(containerID)
 	logFile, err := os.Open(logPath)
 	if err != nil {
 		return errors.Wrap(err, "failed to open log file")
 	}
 	defer logFile.Close()
 
+	// A file rotated away meanwhile is skipped
+	for _, path := range rotatedLogPaths(logPath) {
+		rotated, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		_, err = io.Copy(writer, rotated)
+		rotated.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to copy logs")
+		}
+	}
+
 	if follow {
 		// Implement log following (similar to tail -f)
 		// This is a simplified version
@@ -248,15 +903,93 @@ func (c *Client) GetContainerLogs(ctx context.Context, containerID string, follo
 
 // PullImage pulls an image from a registry
 func (c *Client) PullImage(ctx context.Context, ref string) (containerd.Image, error) {
-	image, err := c.client.Pull(ctx, ref, containerd.WithPullUnpack)
+	ctx = c.withNamespace(ctx)
+	dgst, err := c.checkPullTrust(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryRunf("pull image %s", ref) {
+		return nil, nil
+	}
+
+	atomic.AddInt64(&c.pullsInFlight, 1)
+	defer atomic.AddInt64(&c.pullsInFlight, -1)
+
+	release, err := c.acquireHeavy(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to pull image")
 	}
+	defer release()
+
+	options := c.getPullOptions()
+	pullOpts := []containerd.RemoteOpt{
+		containerd.WithPullUnpack,
+		containerd.WithResolver(c.newResolver(ctx)),
+	}
+	if options.MaxConcurrentDownloads > 0 {
+		pullOpts = append(pullOpts, containerd.WithMaxConcurrentDownloads(options.MaxConcurrentDownloads))
+	}
+
+	// A verified image is pulled by its digest, the tag may have moved since
+	pullRef := ref
+	keepPinned := false
+	if dgst != "" {
+		if pullRef, err = pinnedRef(ref, dgst); err != nil {
+			return nil, err
+		}
+		_, err := c.client.ImageService().Get(ctx, pullRef)
+		keepPinned = err == nil
+	}
+
+	// Each attempt resumes layers from containerd's ingest store instead of starting over
+	var image containerd.Image
+	err = c.withPullRetries(ctx, ref, func() error {
+		var err error
+		image, err = c.client.Pull(ctx, pullRef, pullOpts...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to pull image")
+	}
+	if pullRef != ref {
+		return c.tagPinnedImage(ctx, ref, image, keepPinned)
+	}
 	return image, nil
 }
 
+// newResolver creates a registry resolver that authenticates using the client's credential store
+func (c *Client) newResolver(ctx context.Context) remotes.Resolver {
+	hostOptions := dockerconfig.HostOptions{}
+	if credentials := c.credentialStore(); credentials != nil {
+		hostOptions.Credentials = credentials.Get
+	}
+	if tlsConfig := c.getTLSConfig(); tlsConfig != nil {
+		// Cloned since the hosts configuration adds registry specific settings to it
+		hostOptions.DefaultTLS = tlsConfig.Clone()
+	}
+	if retries := c.getPullOptions().RequestRetries; retries > 0 {
+		hostOptions.UpdateClient = func(client *http.Client) error {
+			base := client.Transport
+			if base == nil {
+				base = http.DefaultTransport
+			}
+			client.Transport = &retryTransport{
+				base:    base,
+				retries: retries,
+				backoff: 500 * time.Millisecond,
+			}
+			return nil
+		}
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: dockerconfig.ConfigureHosts(ctx, hostOptions),
+	})
+}
+
 // ListImages lists all images
 func (c *Client) ListImages(ctx context.Context) ([]containerd.Image, error) {
+	ctx = c.withNamespace(ctx)
 	images, err := c.client.ImageService().List(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list images")
@@ -276,6 +1009,10 @@ func (c *Client) ListImages(ctx context.Context) ([]containerd.Image, error) {
 
 // RemoveImage removes an image
 func (c *Client) RemoveImage(ctx context.Context, ref string) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("remove image %s", ref) {
+		return nil
+	}
 	err := c.client.ImageService().Delete(ctx, ref)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove image")
@@ -0,0 +1,119 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSandboxImage is the pause image used for CRI pod sandboxes
+const DefaultSandboxImage = "registry.k8s.io/pause:3.10"
+
+// criPluginID is the containerd plugin that serves the CRI gRPC API
+const criPluginID = "io.containerd.grpc.v1.cri"
+
+// containerdConfigOptions contains the values rendered into a containerd config.toml
+type containerdConfigOptions struct {
+	Root          string
+	State         string
+	Address       string
+	SocketGID     int
+	EnableCRI     bool
+	SandboxImage  string
+	SystemdCgroup bool
+	RuncPath      string
+	CNIBinDir     string
+	CNIConfDir    string
+}
+
+// generateContainerdConfig renders a containerd 2.x (version 3) configuration
+func generateContainerdConfig(opts containerdConfigOptions) string {
+	var b strings.Builder
+
+	b.WriteString("version = 3\n")
+	if opts.Root != "" {
+		fmt.Fprintf(&b, "root = %q\n", opts.Root)
+	}
+	if opts.State != "" {
+		fmt.Fprintf(&b, "state = %q\n", opts.State)
+	}
+
+	// The CRI service shares the containerd gRPC socket, so disabling the plugin is
+	// the only way to keep kubelets from using it
+	if !opts.EnableCRI {
+		fmt.Fprintf(&b, "disabled_plugins = [%q]\n", criPluginID)
+	}
+
+	if opts.Address != "" || opts.SocketGID > 0 {
+		b.WriteString("\n[grpc]\n")
+		if opts.Address != "" {
+			fmt.Fprintf(&b, "  address = %q\n", opts.Address)
+		}
+		// containerd creates the socket with 0660 permissions, owned by this group
+		if opts.SocketGID > 0 {
+			fmt.Fprintf(&b, "  gid = %d\n", opts.SocketGID)
+		}
+	}
+
+	if !opts.EnableCRI {
+		return b.String()
+	}
+
+	sandboxImage := opts.SandboxImage
+	if sandboxImage == "" {
+		sandboxImage = DefaultSandboxImage
+	}
+
+	b.WriteString("\n[plugins]\n")
+	b.WriteString("  [plugins.'io.containerd.cri.v1.images'.pinned_images]\n")
+	fmt.Fprintf(&b, "    sandbox = %q\n", sandboxImage)
+
+	b.WriteString("\n  [plugins.'io.containerd.cri.v1.runtime'.containerd.runtimes.runc]\n")
+	b.WriteString("    runtime_type = \"io.containerd.runc.v2\"\n")
+	if opts.RuncPath != "" || opts.SystemdCgroup {
+		b.WriteString("    [plugins.'io.containerd.cri.v1.runtime'.containerd.runtimes.runc.options]\n")
+		if opts.RuncPath != "" {
+			fmt.Fprintf(&b, "      BinaryName = %q\n", opts.RuncPath)
+		}
+		if opts.SystemdCgroup {
+			b.WriteString("      SystemdCgroup = true\n")
+		}
+	}
+
+	if opts.CNIBinDir != "" || opts.CNIConfDir != "" {
+		b.WriteString("\n  [plugins.'io.containerd.cri.v1.runtime'.cni]\n")
+		if opts.CNIBinDir != "" {
+			fmt.Fprintf(&b, "    bin_dir = %q\n", opts.CNIBinDir)
+		}
+		if opts.CNIConfDir != "" {
+			fmt.Fprintf(&b, "    conf_dir = %q\n", opts.CNIConfDir)
+		}
+	}
+
+	return b.String()
+}
+
+// writeContainerdConfig writes a generated containerd configuration to path
+func writeContainerdConfig(path string, opts containerdConfigOptions) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create containerd config directory")
+	}
+
+	if err := os.WriteFile(path, []byte(generateContainerdConfig(opts)), 0644); err != nil {
+		return errors.Wrap(err, "failed to write containerd config")
+	}
+
+	return nil
+}
+
+// GetCRIEndpoint returns the CRI endpoint URL for a containerd socket, in the
+// format expected by kubelet's --container-runtime-endpoint flag
+func GetCRIEndpoint(socketPath string) string {
+	if strings.HasPrefix(socketPath, `\\.\pipe\`) {
+		return "npipe://" + strings.ReplaceAll(socketPath, `\`, "/")
+	}
+	return "unix://" + socketPath
+}
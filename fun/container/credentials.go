@@ -0,0 +1,226 @@
+package container
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialHelperPrefix is the executable prefix used by docker-credential-helpers
+const CredentialHelperPrefix = "docker-credential-"
+
+// dockerHubServerURL is the key Docker uses to store Docker Hub credentials
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// DockerConfigFile represents the subset of ~/.docker/config.json used for registry auth
+type DockerConfigFile struct {
+	Auths       map[string]DockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+}
+
+// DockerAuthEntry represents an inline credential entry in the Docker config file
+type DockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// helperCredentials is the JSON document returned by a credential helper's "get" command
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// CredentialStore resolves registry credentials using Docker's config file and
+// docker-credential-helper compatible executables (osxkeychain, wincred, pass, ...)
+type CredentialStore struct {
+	// DefaultHelper overrides the credsStore from the Docker config file when set
+	DefaultHelper string
+	config        DockerConfigFile
+
+	// missingHelpers are the helpers found missing, so each is only warned about once
+	missingMutex   sync.Mutex
+	missingHelpers map[string]bool
+}
+
+// errHelperNotFound is returned for a credential helper that isn't installed
+var errHelperNotFound = errors.New("credential helper not found")
+
+// GetDefaultDockerConfigPath returns the path to the Docker client configuration file
+func GetDefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".docker", "config.json")
+}
+
+// LoadDockerConfig reads a Docker client configuration file
+// A missing file is not an error and results in an empty configuration
+func LoadDockerConfig(path string) (DockerConfigFile, error) {
+	var cfg DockerConfigFile
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, errors.Wrap(err, "failed to read docker config")
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "failed to parse docker config")
+	}
+
+	return cfg, nil
+}
+
+// NewCredentialStore creates a credential store from the Docker config at configPath
+// If defaultHelper is not empty it is used instead of the config's credsStore
+func NewCredentialStore(configPath, defaultHelper string) (*CredentialStore, error) {
+	if configPath == "" {
+		configPath = GetDefaultDockerConfigPath()
+	}
+
+	cfg, err := LoadDockerConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CredentialStore{
+		DefaultHelper: defaultHelper,
+		config:        cfg,
+	}, nil
+}
+
+// Get returns the username and secret for a registry host
+// Empty credentials are returned when nothing is configured for the host
+func (s *CredentialStore) Get(host string) (string, string, error) {
+	serverURL := normalizeRegistryHost(host)
+
+	// Per-registry helpers take precedence over everything else
+	if helper, ok := s.config.CredHelpers[host]; ok {
+		return getHelperCredentials(helper, serverURL)
+	}
+	if helper, ok := s.config.CredHelpers[serverURL]; ok {
+		return getHelperCredentials(helper, serverURL)
+	}
+
+	// Then the global credential store. Without its helper, e.g. a config
+	// copied from a desktop, the inline auths or anonymous access still work.
+	helper := s.DefaultHelper
+	if helper == "" {
+		helper = s.config.CredsStore
+	}
+	if helper != "" {
+		username, secret, err := getHelperCredentials(helper, serverURL)
+		if errors.Is(err, errHelperNotFound) {
+			s.warnMissingHelper(helper, err)
+		} else if err != nil {
+			return "", "", err
+		}
+		if username != "" || secret != "" {
+			return username, secret, nil
+		}
+	}
+
+	// Finally fall back to inline auths in the config file
+	for _, key := range []string{host, serverURL, "https://" + host, "http://" + host} {
+		if entry, ok := s.config.Auths[key]; ok {
+			return decodeAuthEntry(entry)
+		}
+	}
+
+	return "", "", nil
+}
+
+// warnMissingHelper logs that the credential store's helper is missing, once per helper
+func (s *CredentialStore) warnMissingHelper(helper string, err error) {
+	s.missingMutex.Lock()
+	defer s.missingMutex.Unlock()
+	if s.missingHelpers[helper] {
+		return
+	}
+	if s.missingHelpers == nil {
+		s.missingHelpers = make(map[string]bool)
+	}
+	s.missingHelpers[helper] = true
+	log.Printf("Warning: %v, pulling without its credentials", err)
+}
+
+// getHelperCredentials runs "docker-credential-<helper> get" for the given server
+func getHelperCredentials(helper, serverURL string) (string, string, error) {
+	helperPath, err := exec.LookPath(CredentialHelperPrefix + helper)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s%s", errHelperNotFound, CredentialHelperPrefix, helper)
+	}
+
+	cmd := exec.Command(helperPath, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		// Helpers report missing entries on stdout with a non-zero exit code
+		if strings.Contains(output, "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("credential helper %s failed: %w, output: %s", helper, err, output)
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("failed to parse output of credential helper %s: %w", helper, err)
+	}
+
+	// An identity token is reported with the special "<token>" username
+	if creds.Username == "<token>" {
+		return "", creds.Secret, nil
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// decodeAuthEntry extracts credentials from an inline Docker auth entry
+func decodeAuthEntry(entry DockerAuthEntry) (string, string, error) {
+	if entry.IdentityToken != "" {
+		return "", entry.IdentityToken, nil
+	}
+	if entry.Auth == "" {
+		return entry.Username, entry.Password, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to decode docker auth entry")
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", errors.New("invalid docker auth entry")
+	}
+	return username, password, nil
+}
+
+// normalizeRegistryHost maps a registry host to the key Docker stores credentials under
+func normalizeRegistryHost(host string) string {
+	switch host {
+	case "docker.io", "registry-1.docker.io", "index.docker.io":
+		return dockerHubServerURL
+	}
+	return host
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LabelCritical marks containers the orchestrator wants to hear about as soon as they exit
+const LabelCritical = "fun.critical"
+
+// LabelStartedAt stores when a container's task last started, for uptime reports
+const LabelStartedAt = "fun.started_at"
+
+// SetCriticalContainers marks exactly the given containers, by ID or name, as
+// critical. The mark is a label, so it survives daemon restarts, and
+// deployments carry it over to the container replacing a critical one.
+func (c *Client) SetCriticalContainers(ctx context.Context, containerIDs []string) error {
+	ctx = c.withNamespace(ctx)
+	critical := make(map[string]bool, len(containerIDs))
+	for _, id := range containerIDs {
+		critical[id] = true
+	}
+
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get labels of container %s", container.ID())
+		}
+		name := labels[LabelName]
+		marked, wanted := labels[LabelCritical] != "", critical[container.ID()] || (name != "" && critical[name])
+		delete(critical, container.ID())
+		delete(critical, name)
+		if marked == wanted {
+			continue
+		}
+
+		value := ""
+		if wanted {
+			value = "true"
+		}
+		if c.dryRunf("set critical=%t on container %s", wanted, container.ID()) {
+			continue
+		}
+		if _, err := container.SetLabels(ctx, map[string]string{LabelCritical: value}); err != nil {
+			return errors.Wrapf(err, "failed to update container %s", container.ID())
+		}
+	}
+
+	// The orchestrator may know of containers that haven't been created yet
+	for id := range critical {
+		log.Printf("Warning: Critical container %s does not exist", id)
+	}
+	return nil
+}
+
+// isCritical reports whether a container is marked as critical
+func (c *Client) isCritical(ctx context.Context, containerID string) bool {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return false
+	}
+	labels, err := container.Labels(ctx)
+	return err == nil && labels[LabelCritical] != ""
+}
+
+// SetCriticalExitHook sets a function called when a critical container exits
+// It runs on the task event watcher, so slow work belongs in a goroutine.
+func (c *Client) SetCriticalExitHook(hook func(containerID string, info TerminationInfo)) {
+	c.mu.Lock()
+	c.criticalExitHook = hook
+	c.mu.Unlock()
+}
+
+// recordStart stores the start time of a container's task
+func (c *Client) recordStart(ctx context.Context, containerID string) error {
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	_, err = container.SetLabels(ctx, map[string]string{LabelStartedAt: time.Now().UTC().Format(time.RFC3339)})
+	return err
+}
+
+// startedAtFromLabels returns the recorded start time of a container, nil if unknown
+func startedAtFromLabels(labels map[string]string) *time.Time {
+	startedAt, err := time.Parse(time.RFC3339, labels[LabelStartedAt])
+	if err != nil {
+		return nil
+	}
+	return &startedAt
+}
@@ -0,0 +1,58 @@
+package container
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// wslContainerdSocket is the containerd socket inside the WSL2 distribution
+const wslContainerdSocket = "/run/containerd/containerd.sock"
+
+// CtrCommand returns a ctr command running args against the managed containerd
+// socket and namespace. With WSL2 the command runs ctr inside the distribution,
+// which reaches the socket directly instead of through the named pipe proxy.
+func CtrCommand(ctx context.Context, socket, namespace string, args []string) (*exec.Cmd, error) {
+	if IsRunningOnWindows() {
+		wsl2Config := DefaultWSL2Config()
+		if wsl2Config.Enabled && IsWSL2Available() && IsWSL2DistributionAvailable(wsl2Config.Distribution) {
+			wslArgs := append([]string{
+				"--distribution", wsl2Config.Distribution, "--",
+				"ctr", "--address", wslContainerdSocket, "--namespace", namespace,
+			}, args...)
+			return exec.CommandContext(ctx, "wsl.exe", wslArgs...), nil
+		}
+	}
+
+	address, err := ctrAddress(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrPath := GetCtrPath()
+	if ctrPath == "" {
+		return nil, errors.New("ctr not found, run the dependency download or install containerd")
+	}
+
+	ctrArgs := append([]string{"--address", address, "--namespace", namespace}, args...)
+	return exec.CommandContext(ctx, ctrPath, ctrArgs...), nil
+}
+
+// ctrAddress returns the containerd socket to use, preferring the configured one
+// and falling back to the socket of the embedded server
+func ctrAddress(socket string) (string, error) {
+	if CheckContainerdRunning(socket) {
+		return socket, nil
+	}
+	if funSocket := GetFunSocketPath(); CheckContainerdRunning(funSocket) {
+		return funSocket, nil
+	}
+
+	// containerd runs inside the LinuxKit VM on macOS, which doesn't expose its socket yet
+	if runtime.GOOS == "darwin" {
+		return "", errors.New("the containerd socket of the LinuxKit VM is not reachable from the host")
+	}
+	return "", errors.Errorf("containerd is not running at %s", socket)
+}
@@ -0,0 +1,222 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fun/events"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/pkg/errors"
+)
+
+// DebugBundleOptions contains options for capturing a debug bundle
+type DebugBundleOptions struct {
+	// Dir is where bundles are written, each in a directory of its own
+	Dir string
+	// CoreDumps also copies core files the container wrote into its filesystem
+	CoreDumps bool
+	// Events are the daemon's journal entries about the container, written to events.json
+	Events []events.Event
+}
+
+// SetCrashLoopHook sets a function called when a container starts crash-looping
+// It runs on the restart supervisor, so slow work belongs in a goroutine.
+func (c *Client) SetCrashLoopHook(hook func(containerID string)) {
+	c.mu.Lock()
+	c.crashLoopHook = hook
+	c.mu.Unlock()
+}
+
+// isCoreDump reports whether a path looks like a core file, as written with the
+// default core_pattern of "core" or "core.<pid>"
+func isCoreDump(p string) bool {
+	name := path.Base(p)
+	return name == "core" || strings.HasPrefix(name, "core.")
+}
+
+// CaptureDebugBundle writes what is needed to debug a failing container to a
+// new directory under opts.Dir and returns its path: the container details and
+// spec, its logs and its filesystem changes, and optionally its core dumps
+// Parts that can't be captured are listed in errors.txt instead of failing the bundle.
+func (c *Client) CaptureDebugBundle(ctx context.Context, containerID string, opts DebugBundleOptions) (string, error) {
+	nsCtx := c.withNamespace(ctx)
+	dir := filepath.Join(opts.Dir, fmt.Sprintf("%s-%s", containerID, time.Now().UTC().Format("20060102T150405Z")))
+	if c.dryRunf("capture debug bundle of container %s in %s", containerID, dir) {
+		return dir, nil
+	}
+	container, err := c.client.LoadContainer(nsCtx, containerID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to load container")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create debug bundle directory")
+	}
+
+	var problems []string
+	writeJSON := func(name string, value interface{}) {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, name), data, 0600)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if details, err := c.InspectContainer(ctx, containerID); err != nil {
+		problems = append(problems, fmt.Sprintf("inspect.json: %v", err))
+	} else {
+		writeJSON("inspect.json", details)
+	}
+	if spec, err := container.Spec(nsCtx); err != nil {
+		problems = append(problems, fmt.Sprintf("spec.json: %v", err))
+	} else {
+		writeJSON("spec.json", spec)
+	}
+
+	if logFile, err := os.Create(filepath.Join(dir, "logs.txt")); err != nil {
+		problems = append(problems, fmt.Sprintf("logs.txt: %v", err))
+	} else {
+		if err := c.GetContainerLogs(ctx, containerID, false, logFile); err != nil {
+			problems = append(problems, fmt.Sprintf("logs.txt: %v", err))
+		}
+		logFile.Close()
+	}
+
+	changes, err := c.ContainerDiff(ctx, containerID)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("diff.txt: %v", err))
+	} else {
+		var b strings.Builder
+		for _, change := range changes {
+			fmt.Fprintf(&b, "%s %s\n", change.Kind, change.Path)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "diff.txt"), []byte(b.String()), 0600); err != nil {
+			problems = append(problems, fmt.Sprintf("diff.txt: %v", err))
+		}
+	}
+
+	if len(opts.Events) > 0 {
+		writeJSON("events.json", opts.Events)
+	}
+
+	if opts.CoreDumps && err == nil {
+		var cores []string
+		for _, change := range changes {
+			if change.Kind != "D" && isCoreDump(change.Path) {
+				cores = append(cores, change.Path)
+			}
+		}
+		if len(cores) > 0 {
+			if err := c.copyFromContainer(nsCtx, containerID, cores, filepath.Join(dir, "cores")); err != nil {
+				problems = append(problems, fmt.Sprintf("cores: %v", err))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		os.WriteFile(filepath.Join(dir, "errors.txt"), []byte(strings.Join(problems, "\n")+"\n"), 0600)
+		log.Printf("Warning: Debug bundle of container %s is incomplete, see %s", containerID, filepath.Join(dir, "errors.txt"))
+	}
+	return dir, nil
+}
+
+// copyFromContainer copies files out of a container's root filesystem into dir,
+// flattening their paths
+func (c *Client) copyFromContainer(ctx context.Context, containerID string, paths []string, dir string) error {
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container info")
+	}
+	mounts, err := c.client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot mounts")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return mount.WithReadonlyTempMount(ctx, mounts, func(root string) error {
+		for _, p := range paths {
+			name := strings.ReplaceAll(strings.TrimPrefix(p, "/"), "/", "_")
+			if err := copyFile(filepath.Join(root, filepath.FromSlash(p)), filepath.Join(dir, name)); err != nil {
+				return errors.Wrapf(err, "failed to copy %s", p)
+			}
+		}
+		return nil
+	})
+}
+
+// PruneDebugBundles removes the debug bundles under dir older than maxAge, then
+// the oldest ones until the rest, core dumps included, fit in maxBytes. The
+// newest bundle is always kept, an alert may just have referred to it. Zero
+// limits don't apply. It returns how many bundles were removed and the bytes freed.
+func PruneDebugBundles(dir string, maxAge time.Duration, maxBytes int64) (int, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list debug bundles")
+	}
+
+	type bundle struct {
+		path     string
+		modified time.Time
+		size     int64
+	}
+	var bundles []bundle
+	total := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		b := bundle{path: filepath.Join(dir, entry.Name()), modified: info.ModTime()}
+		filepath.Walk(b.path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				b.size += info.Size()
+			}
+			return nil
+		})
+		total += b.size
+		bundles = append(bundles, b)
+	}
+	// Oldest first, the newest is never a candidate
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].modified.Before(bundles[j].modified) })
+	if len(bundles) > 0 {
+		bundles = bundles[:len(bundles)-1]
+	}
+
+	removed := 0
+	freed := int64(0)
+	cutoff := time.Now().Add(-maxAge)
+	for _, b := range bundles {
+		expired := maxAge > 0 && b.modified.Before(cutoff)
+		oversized := maxBytes > 0 && total > maxBytes
+		if !expired && !oversized {
+			continue
+		}
+		if err := os.RemoveAll(b.path); err != nil {
+			log.Printf("Warning: Failed to remove debug bundle %s: %v", b.path, err)
+			continue
+		}
+		removed++
+		freed += b.size
+		total -= b.size
+	}
+	return removed, freed, nil
+}
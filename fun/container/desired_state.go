@@ -0,0 +1,394 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LabelManagedBy marks the containers created by applying a desired state
+// with ManagedByDesiredState. Only those are deleted when a document no longer
+// lists them, containers created by the CLI, the Docker API shim or a
+// migration are left alone.
+const LabelManagedBy = "fun.managed-by"
+
+// ManagedByDesiredState is the value of LabelManagedBy of desired-state containers
+const ManagedByDesiredState = "desired-state"
+
+// DesiredState is the full set of containers the orchestrator wants on the host
+// Containers created from an earlier desired state that are missing from the
+// document are deleted.
+// A state with a Project only covers the containers of that project, which are
+// labeled with it and named <project>-<name>, and leaves the other containers
+// alone. A state without one leaves the containers of every project alone.
+type DesiredState struct {
+	Project    string             `json:"project,omitempty"`
+	Containers []DesiredContainer `json:"containers"`
+}
+
+// DesiredContainer describes one container of the desired state
+// Command, Env and Labels are only compared when set, since the image supplies
+// defaults for them.
+type DesiredContainer struct {
+	Name          string            `json:"name"`
+	Image         string            `json:"image"`
+	Command       []string          `json:"command,omitempty"`
+	Env           []string          `json:"env,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	RestartPolicy string            `json:"restart_policy,omitempty"`
+	Network       string            `json:"network,omitempty"`
+
+	// CpusetCPUs and NUMANode are placement hints for latency-sensitive
+	// workloads, pinning the container to CPUs or to the CPUs and memory of a
+	// NUMA node. CpusetCPUs narrows the CPUs of NUMANode when both are set.
+	CpusetCPUs string `json:"cpuset_cpus,omitempty"`
+	NUMANode   *int   `json:"numa_node,omitempty"`
+
+	// Timezone and Locale override the daemon's container_timezone and
+	// container_locale, e.g. "none" for a service that must log in UTC
+	Timezone string `json:"timezone,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+
+	// InitContainers run in order before the container is created, while the
+	// container it replaces keeps running; the deployment fails if one of them
+	// fails, leaving the old container in place. Changing them alone doesn't
+	// replace the container.
+	InitContainers []InitContainer `json:"init_containers,omitempty"`
+
+	// ConfigFiles are rendered from Go templates and mounted read-only. Changed
+	// templates are re-rendered and the container gets SIGHUP, changed paths
+	// replace the container.
+	ConfigFiles []ConfigFile `json:"config_files,omitempty"`
+
+	// Priority is low, normal, high or critical. Under memory pressure the
+	// daemon may stop lower-priority containers to keep the others healthy.
+	Priority string `json:"priority,omitempty"`
+
+	// Devices select USB and serial devices, by /dev path glob or USB ID such
+	// as 0403:6001, that are attached whenever they are plugged in
+	Devices []string `json:"devices,omitempty"`
+
+	// Singleton containers run on only one host of the fleet group, the one
+	// holding their lease, and fail over when that host goes offline
+	Singleton bool `json:"singleton,omitempty"`
+}
+
+// placement resolves the placement hints against the host topology into the
+// cpuset CPUs and memory nodes of the container
+func (d DesiredContainer) placement(topology HostTopology) (string, string, error) {
+	var cpus, mems string
+	if d.NUMANode != nil {
+		var err error
+		if cpus, mems, err = topology.Placement(*d.NUMANode); err != nil {
+			return "", "", err
+		}
+	}
+	if d.CpusetCPUs != "" {
+		cpus = d.CpusetCPUs
+	}
+	if err := topology.Validate(cpus, mems); err != nil {
+		return "", "", err
+	}
+	return cpus, mems, nil
+}
+
+// DiffAction is what has to happen to a container to reach the desired state
+type DiffAction string
+
+const (
+	// DiffCreate creates a container that doesn't exist yet
+	DiffCreate DiffAction = "create"
+	// DiffUpdate recreates a container whose configuration changed
+	DiffUpdate DiffAction = "update"
+	// DiffDelete removes a container that is no longer desired
+	DiffDelete DiffAction = "delete"
+)
+
+// FieldChange is a single differing field of an updated container
+type FieldChange struct {
+	Field   string `json:"field"`
+	Current string `json:"current"`
+	Desired string `json:"desired"`
+}
+
+// StateChange is a planned action for one container
+type StateChange struct {
+	Action DiffAction `json:"action"`
+	Name   string     `json:"name"`
+	// ID is the container the change acts on: the existing one for deletes,
+	// the new one for creates and updates once they are applied
+	ID      string        `json:"id,omitempty"`
+	Image   string        `json:"image,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// StateDiff is the plan to move the host from its current to the desired state
+type StateDiff struct {
+	Changes   []StateChange `json:"changes"`
+	Unchanged []string      `json:"unchanged,omitempty"`
+}
+
+// HasChanges reports whether applying the diff would change anything
+func (d *StateDiff) HasChanges() bool {
+	return len(d.Changes) > 0
+}
+
+// Validate checks that the desired state can be planned
+func (s DesiredState) Validate() error {
+	if s.Project != "" && !validName.MatchString(s.Project) {
+		return fmt.Errorf("invalid project name %q", s.Project)
+	}
+	seen := make(map[string]bool)
+	for i, desired := range s.Containers {
+		if desired.Name == "" {
+			return fmt.Errorf("container %d has no name", i)
+		}
+		if desired.Image == "" {
+			return fmt.Errorf("container %s has no image", desired.Name)
+		}
+		if seen[desired.Name] {
+			return fmt.Errorf("container %s is listed more than once", desired.Name)
+		}
+		seen[desired.Name] = true
+
+		if _, err := ParseRestartPolicy(desired.RestartPolicy); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if _, err := NormalizeImageRef(desired.Image); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if _, _, err := desired.placement(DetectTopology()); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if err := ValidateTimezone(desired.Timezone); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if err := ValidateLocale(desired.Locale); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if err := validateInitContainers(desired.InitContainers); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if err := validateConfigFiles(desired.ConfigFiles); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if _, err := ParsePriority(desired.Priority); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if _, err := ParseDeviceSelectors(strings.Join(desired.Devices, ",")); err != nil {
+			return fmt.Errorf("container %s: %w", desired.Name, err)
+		}
+		if project, ok := desired.Labels[LabelProject]; ok && project != s.Project {
+			return fmt.Errorf("container %s: label %s must match the project of the state", desired.Name, LabelProject)
+		}
+	}
+	return nil
+}
+
+// DiffDesiredState computes the actions needed to reach the desired state without
+// applying any of them
+func (c *Client) DiffDesiredState(ctx context.Context, desired DesiredState) (*StateDiff, error) {
+	if err := desired.Validate(); err != nil {
+		return nil, err
+	}
+
+	current, err := c.ListContainers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read current state")
+	}
+	var scoped []*Container
+	for _, container := range current {
+		if container.Labels[LabelProject] == desired.Project {
+			scoped = append(scoped, container)
+		}
+	}
+
+	return DiffState(scoped, desired.withManagedLabels()), nil
+}
+
+// withManagedLabels returns the state with its containers labeled as managed
+// by the desired state, and with the project of a project state so their
+// usage is reported under it. The name in the document is their service, the
+// containers of a project are named after it so projects may use the same names.
+func (s DesiredState) withManagedLabels() DesiredState {
+	labeled := DesiredState{Project: s.Project, Containers: make([]DesiredContainer, len(s.Containers))}
+	for i, desired := range s.Containers {
+		desired.Labels = copyLabels(desired.Labels)
+		if desired.Labels == nil {
+			desired.Labels = map[string]string{}
+		}
+		desired.Labels[LabelManagedBy] = ManagedByDesiredState
+		desired.Labels[LabelService] = desired.Name
+		if s.Project != "" {
+			desired.Labels[LabelProject] = s.Project
+			desired.Name = s.Project + "-" + desired.Name
+		}
+		labeled.Containers[i] = desired
+	}
+	return labeled
+}
+
+// DiffState compares the current containers with the desired state, matching
+// them by name. Containers missing from the document are only deleted if an
+// earlier desired state created them. The desired state must have been validated.
+func DiffState(current []*Container, desired DesiredState) *StateDiff {
+	existing := make(map[string]*Container, len(current))
+	for _, container := range current {
+		existing[container.Name] = container
+	}
+
+	diff := &StateDiff{Changes: []StateChange{}}
+	wanted := make(map[string]bool, len(desired.Containers))
+	for _, d := range desired.Containers {
+		wanted[d.Name] = true
+
+		container, ok := existing[d.Name]
+		if !ok {
+			diff.Changes = append(diff.Changes, StateChange{Action: DiffCreate, Name: d.Name, Image: d.Image})
+			continue
+		}
+
+		changes := containerChanges(container, d)
+		if len(changes) == 0 {
+			diff.Unchanged = append(diff.Unchanged, d.Name)
+			continue
+		}
+		diff.Changes = append(diff.Changes, StateChange{Action: DiffUpdate, Name: d.Name, ID: container.ID, Image: d.Image, Changes: changes})
+	}
+
+	for _, container := range current {
+		if !wanted[container.Name] && container.Labels[LabelManagedBy] == ManagedByDesiredState {
+			diff.Changes = append(diff.Changes, StateChange{Action: DiffDelete, Name: container.Name, ID: container.ID, Image: container.ImageRef})
+		}
+	}
+
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		return diff.Changes[i].Name < diff.Changes[j].Name
+	})
+	sort.Strings(diff.Unchanged)
+	return diff
+}
+
+// containerChanges lists the fields of an existing container that differ from desired
+func containerChanges(container *Container, desired DesiredContainer) []FieldChange {
+	var changes []FieldChange
+
+	currentImage, err := NormalizeImageRef(container.ImageRef)
+	if err != nil {
+		currentImage = container.ImageRef
+	}
+	desiredImage, _ := NormalizeImageRef(desired.Image)
+	if currentImage != desiredImage {
+		changes = append(changes, FieldChange{Field: "image", Current: container.ImageRef, Desired: desired.Image})
+	}
+
+	if len(desired.Command) > 0 && !equalStrings(container.Command, desired.Command) {
+		changes = append(changes, FieldChange{
+			Field:   "command",
+			Current: strings.Join(container.Command, " "),
+			Desired: strings.Join(desired.Command, " "),
+		})
+	}
+
+	// The image contributes its own environment, so only desired entries must be present
+	currentEnv := make(map[string]bool, len(container.Env))
+	for _, env := range container.Env {
+		currentEnv[env] = true
+	}
+	for _, env := range desired.Env {
+		if !currentEnv[env] {
+			changes = append(changes, FieldChange{Field: "env", Current: envValue(container.Env, env), Desired: env})
+		}
+	}
+
+	var labelKeys []string
+	for key := range desired.Labels {
+		labelKeys = append(labelKeys, key)
+	}
+	sort.Strings(labelKeys)
+	for _, key := range labelKeys {
+		if container.Labels[key] != desired.Labels[key] {
+			changes = append(changes, FieldChange{
+				Field:   "labels." + key,
+				Current: container.Labels[key],
+				Desired: desired.Labels[key],
+			})
+		}
+	}
+
+	currentPolicy, err := ParseRestartPolicy(container.RestartPolicy)
+	if err != nil {
+		currentPolicy = container.RestartPolicy
+	}
+	desiredPolicy, _ := ParseRestartPolicy(desired.RestartPolicy)
+	if currentPolicy != desiredPolicy {
+		changes = append(changes, FieldChange{Field: "restart_policy", Current: currentPolicy, Desired: desiredPolicy})
+	}
+
+	if timezone := container.Labels[LabelTimezone]; timezone != desired.Timezone {
+		changes = append(changes, FieldChange{Field: "timezone", Current: timezone, Desired: desired.Timezone})
+	}
+	if locale := container.Labels[LabelLocale]; locale != desired.Locale {
+		changes = append(changes, FieldChange{Field: "locale", Current: locale, Desired: desired.Locale})
+	}
+
+	if network := container.Labels[LabelNetwork]; network != desired.Network {
+		changes = append(changes, FieldChange{Field: "network", Current: network, Desired: desired.Network})
+	}
+
+	desiredPriority, _ := ParsePriority(desired.Priority)
+	if container.Priority != desiredPriority {
+		changes = append(changes, FieldChange{Field: "priority", Current: container.Priority, Desired: desiredPriority})
+	}
+
+	if current := container.Labels[LabelSingleton] != ""; current != desired.Singleton {
+		changes = append(changes, FieldChange{Field: "singleton", Current: strconv.FormatBool(current), Desired: strconv.FormatBool(desired.Singleton)})
+	}
+
+	selectors, _ := ParseDeviceSelectors(strings.Join(desired.Devices, ","))
+	if current, devices := container.Labels[LabelDevices], strings.Join(selectors, ","); current != devices {
+		changes = append(changes, FieldChange{Field: "devices", Current: current, Desired: devices})
+	}
+
+	if current, paths := container.Labels[LabelConfigFiles], configFilesLabel(desired.ConfigFiles); current != paths {
+		changes = append(changes, FieldChange{Field: "config_files", Current: current, Desired: paths})
+	}
+
+	cpus, mems, _ := desired.placement(DetectTopology())
+	if current := container.Labels[LabelCpusetCPUs]; current != cpus {
+		changes = append(changes, FieldChange{Field: "cpuset_cpus", Current: current, Desired: cpus})
+	}
+	if current := container.Labels[LabelCpusetMems]; current != mems {
+		changes = append(changes, FieldChange{Field: "cpuset_mems", Current: current, Desired: mems})
+	}
+
+	return changes
+}
+
+// envValue returns the current entry for the variable set by env, empty if unset
+func envValue(current []string, env string) string {
+	name := strings.SplitN(env, "=", 2)[0]
+	for _, entry := range current {
+		if strings.SplitN(entry, "=", 2)[0] == name {
+			return entry
+		}
+	}
+	return ""
+}
+
+// equalStrings reports whether two string slices have the same elements in order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/continuity/fs"
+	"github.com/pkg/errors"
+)
+
+// FileChange is a file of a container's root filesystem that differs from its image
+type FileChange struct {
+	// Kind is A for added, C for changed or D for deleted, as in docker diff
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// ContainerDiff lists the files added, changed and deleted in a container
+// relative to its image, comparing the container's snapshot with its parent
+// Removed directories are reported once, their contents are implied.
+func (c *Client) ContainerDiff(ctx context.Context, containerID string) ([]FileChange, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load container")
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get container info")
+	}
+	if info.SnapshotKey == "" {
+		return nil, errors.New("container has no root filesystem snapshot")
+	}
+
+	snapshotter := c.client.SnapshotService(info.Snapshotter)
+	snapshot, err := snapshotter.Stat(ctx, info.SnapshotKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat container snapshot")
+	}
+	upperMounts, err := snapshotter.Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get snapshot mounts")
+	}
+
+	// A temporary view of the image layers is the base of the comparison
+	var lowerMounts []mount.Mount
+	if snapshot.Parent != "" {
+		viewKey := fmt.Sprintf("%s-diff-%d", info.SnapshotKey, time.Now().UnixNano())
+		lowerMounts, err = snapshotter.View(ctx, viewKey, snapshot.Parent)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to view image snapshot")
+		}
+		defer snapshotter.Remove(ctx, viewKey)
+	}
+
+	release, err := c.acquireHeavy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	changes := []FileChange{}
+	err = mount.WithReadonlyTempMount(ctx, upperMounts, func(upper string) error {
+		compare := func(lower string) error {
+			return fs.Changes(ctx, lower, upper, func(kind fs.ChangeKind, path string, _ os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				switch kind {
+				case fs.ChangeKindAdd:
+					changes = append(changes, FileChange{Kind: "A", Path: filepath.ToSlash(path)})
+				case fs.ChangeKindModify:
+					changes = append(changes, FileChange{Kind: "C", Path: filepath.ToSlash(path)})
+				case fs.ChangeKindDelete:
+					changes = append(changes, FileChange{Kind: "D", Path: filepath.ToSlash(path)})
+				}
+				return nil
+			})
+		}
+		if lowerMounts == nil {
+			return compare("")
+		}
+		return mount.WithReadonlyTempMount(ctx, lowerMounts, compare)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compare the container with its image")
+	}
+	return changes, nil
+}
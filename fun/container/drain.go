@@ -0,0 +1,93 @@
+package container
+
+import (
+	"context"
+	"log"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// LabelDrained marks containers stopped by a drain or the daemon's shutdown
+// policy, which are started again by ResumeDrained instead of by their restart policy
+const LabelDrained = "fun.drained"
+
+// Drain gracefully stops all running containers, for example before the host reboots
+// Unlike StopContainer the containers are not marked as stopped by the user, so
+// ResumeDrained brings them back once the host is available again.
+func (c *Client) Drain(ctx context.Context, timeout time.Duration) (int, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	drained := 0
+	var firstErr error
+	for _, container := range containers {
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+		status, err := task.Status(ctx)
+		if err != nil || status.Status != containerd.Running {
+			continue
+		}
+		if c.dryRunf("drain container %s (timeout %v)", container.ID(), timeout) {
+			drained++
+			continue
+		}
+
+		// Mark first so the restart supervisor leaves the container alone once it exits
+		if _, err := container.SetLabels(ctx, map[string]string{LabelDrained: "true"}); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to mark container %s as drained", container.ID())
+			}
+			continue
+		}
+		if err := stopTask(ctx, task, timeout); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to stop container %s", container.ID())
+			}
+			continue
+		}
+		drained++
+	}
+
+	return drained, firstErr
+}
+
+// ResumeDrained starts the containers stopped by a previous drain or shutdown,
+// restoring those that were checkpointed
+func (c *Client) ResumeDrained(ctx context.Context) (int, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	resumed := 0
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil || labels[LabelDrained] == "" {
+			continue
+		}
+		if c.dryRunf("resume drained container %s", container.ID()) {
+			resumed++
+			continue
+		}
+
+		if _, err := container.SetLabels(ctx, map[string]string{LabelDrained: ""}); err != nil {
+			log.Printf("Warning: Failed to clear drained marker of container %s: %v", container.ID(), err)
+			continue
+		}
+		if err := c.StartContainer(ctx, container.ID()); err != nil {
+			log.Printf("Warning: Failed to resume container %s: %v", container.ID(), err)
+			continue
+		}
+		resumed++
+	}
+
+	return resumed, nil
+}
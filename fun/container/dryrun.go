@@ -0,0 +1,201 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetDryRun makes mutating operations describe what they would do on w instead
+// of doing it. Reads still reach containerd so the actions reflect the host.
+// A nil writer turns dry-run mode off.
+func (c *Client) SetDryRun(w io.Writer) {
+	c.mu.Lock()
+	c.dryRun = w
+	c.mu.Unlock()
+}
+
+// DryRun reports whether the client is in dry-run mode
+func (c *Client) DryRun() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dryRun != nil
+}
+
+// dryRunf describes an action and reports true in dry-run mode, so callers can
+// skip the action
+func (c *Client) dryRunf(format string, args ...interface{}) bool {
+	c.mu.RLock()
+	w := c.dryRun
+	c.mu.RUnlock()
+	if w == nil {
+		return false
+	}
+	fmt.Fprintf(w, "[dry-run] "+format+"\n", args...)
+	return true
+}
+
+// dryRunCreate describes the image pull and container spec CreateContainer would use
+// Lists are sorted so the output of the same options is always identical.
+func (c *Client) dryRunCreate(ctx context.Context, opts CreateContainerOptions) (*Container, error) {
+	ref, err := NormalizeImageRef(opts.Image)
+	if err != nil {
+		return nil, err
+	}
+	if policy := c.GetTrustPolicy(); policy != nil {
+		if err := policy.checkReference(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	pullPolicy := opts.PullPolicy
+	if pullPolicy == "" {
+		pullPolicy = PullIfNotPresent
+	}
+	_, err = c.client.GetImage(ctx, ref)
+	switch {
+	case pullPolicy == PullAlways:
+		c.dryRunf("pull image %s", ref)
+	case err != nil && pullPolicy == PullNever:
+		return nil, fmt.Errorf("image %s is not present locally and pull policy is never", ref)
+	case err != nil:
+		c.dryRunf("pull image %s", ref)
+	}
+
+	if opts.ID == "" {
+		opts.ID = opts.Name
+	}
+	restartPolicy, err := ParseRestartPolicy(opts.RestartPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := opts.Resources.specOpts(); err != nil {
+		return nil, errors.Wrap(err, "invalid resource limits")
+	}
+	if err := validateExtraHosts(opts.ExtraHosts); err != nil {
+		return nil, err
+	}
+
+	c.dryRunf("create container %s from image %s", opts.ID, ref)
+	if len(opts.Command) > 0 {
+		c.dryRunf("  command: %s", strings.Join(append(opts.Command, opts.Args...), " "))
+	}
+	for _, env := range sortedStrings(opts.Env) {
+		c.dryRunf("  env: %s", env)
+	}
+
+	mounts := append(opts.Mounts[:0:0], opts.Mounts...)
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Destination < mounts[j].Destination })
+	for _, mount := range mounts {
+		c.dryRunf("  mount: %s -> %s (%s %s)", mount.Source, mount.Destination, mount.Type, strings.Join(mount.Options, ","))
+	}
+
+	if opts.PrivilegedMode {
+		c.dryRunf("  privileged: true")
+	}
+	for _, device := range opts.Devices {
+		c.dryRunf("  device: %s -> %s (%s)", device.HostPath, device.ContainerPath, device.Permissions)
+	}
+	for _, capability := range sortedStrings(normalizeCapabilities(opts.CapAdd)) {
+		c.dryRunf("  cap-add: %s", capability)
+	}
+	for _, capability := range sortedStrings(normalizeCapabilities(opts.CapDrop)) {
+		c.dryRunf("  cap-drop: %s", capability)
+	}
+	for _, group := range sortedStrings(opts.GroupAdd) {
+		c.dryRunf("  group-add: %s", group)
+	}
+
+	resources := opts.Resources
+	if resources.CPUs > 0 {
+		c.dryRunf("  cpus: %g", resources.CPUs)
+	}
+	if resources.Memory > 0 {
+		c.dryRunf("  memory: %d bytes", resources.Memory)
+	}
+	if resources.MemorySwap != 0 {
+		c.dryRunf("  memory-swap: %d bytes", resources.MemorySwap)
+	}
+	if resources.BlkioWeight > 0 {
+		c.dryRunf("  blkio-weight: %d", resources.BlkioWeight)
+	}
+	throttles := []struct {
+		name    string
+		devices []ThrottleDevice
+	}{
+		{"device-read-bps", resources.DeviceReadBps},
+		{"device-write-bps", resources.DeviceWriteBps},
+		{"device-read-iops", resources.DeviceReadIOps},
+		{"device-write-iops", resources.DeviceWriteIOps},
+	}
+	for _, throttle := range throttles {
+		for _, device := range throttle.devices {
+			c.dryRunf("  %s: %s %d", throttle.name, device.Path, device.Rate)
+		}
+	}
+	if resources.EgressRate > 0 {
+		c.dryRunf("  egress-rate: %d bit/s", resources.EgressRate)
+	}
+
+	if opts.Network != "" {
+		ip := opts.IPAddress
+		if ip == "" {
+			ip = "next free address"
+		}
+		c.dryRunf("  network: %s (%s)", opts.Network, ip)
+	}
+	if opts.Hostname != "" {
+		c.dryRunf("  hostname: %s", opts.Hostname)
+	}
+	for _, host := range opts.ExtraHosts {
+		c.dryRunf("  add-host: %s", host)
+	}
+	for _, dns := range opts.DNS {
+		c.dryRunf("  dns: %s", dns)
+	}
+	if restartPolicy != RestartNo {
+		c.dryRunf("  restart: %s", restartPolicy)
+	}
+	if opts.HealthCheck != nil {
+		label, err := healthCheckLabel(opts.HealthCheck)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid health check")
+		}
+		c.dryRunf("  health-check: %s", label)
+	}
+
+	labels := make([]string, 0, len(opts.Labels))
+	for key, value := range opts.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	for _, label := range sortedStrings(labels) {
+		c.dryRunf("  label: %s", label)
+	}
+
+	return &Container{
+		ID:              opts.ID,
+		Name:            opts.Name,
+		ImageRef:        opts.Image,
+		Command:         opts.Command,
+		Args:            opts.Args,
+		Env:             opts.Env,
+		Labels:          opts.Labels,
+		Status:          "dry-run",
+		CreatedAt:       time.Now(),
+		RestartPolicy:   opts.RestartPolicy,
+		PrivilegedMode:  opts.PrivilegedMode,
+		ContainerClient: c,
+	}, nil
+}
+
+// sortedStrings returns a sorted copy of list
+func sortedStrings(list []string) []string {
+	sorted := append([]string(nil), list...)
+	sort.Strings(sorted)
+	return sorted
+}
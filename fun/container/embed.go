@@ -2,7 +2,6 @@ package container
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -16,18 +15,12 @@ var binaryPaths = map[string]string{
 }
 
 // extractBundledContainerd is the implementation for extracting the bundled containerd binary
-// This replaces the TODO in the EnsureBundledContainerdExtracted function
+// The caller must hold the lock of lockBundledBinaryDir.
 func extractBundledContainerd() error {
-	// Create the directory for bundled binaries if it doesn't exist
-	if err := os.MkdirAll(BundledBinaryDir, 0755); err != nil {
-		return fmt.Errorf("failed to create bundled binary directory: %w", err)
-	}
-
 	bundledPath := GetBundledContainerdPath()
 
-	// Check if the binary already exists and is executable
-	if info, err := os.Stat(bundledPath); err == nil && info.Mode()&0111 != 0 {
-		// Binary already exists and is executable, no need to extract
+	// Reuse the extracted binary unless this release ships another version
+	if bundledUpToDate(ComponentContainerd, bundledPath) {
 		return nil
 	}
 
@@ -47,27 +40,12 @@ func extractBundledContainerd() error {
 		return fmt.Errorf("bundled containerd binary not found at %s: %w", sourcePath, err)
 	}
 
-	// Open the source binary file
-	sourceFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("failed to open source binary: %w", err)
-	}
-	defer sourceFile.Close()
-
-	// Create the destination file
-	destFile, err := os.OpenFile(bundledPath, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create destination binary file: %w", err)
-	}
-	defer destFile.Close()
-
 	// Copy the source binary to the destination
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		return fmt.Errorf("failed to extract binary: %w", err)
+	if err := installBinary(sourcePath, bundledPath); err != nil {
+		return err
 	}
 
-	return nil
+	return recordExtracted(ComponentContainerd)
 }
 
 // CreateEmbeddableBinariesStructure creates the directory structure for storing binaries that will be embedded
@@ -0,0 +1,239 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// hostResolvConf is the host resolver configuration used as a fallback
+const hostResolvConf = "/etc/resolv.conf"
+
+// LabelEtcSettings stores the inputs for a container's managed /etc files
+const LabelEtcSettings = "fun.etc"
+
+// etcFilesSettings holds the inputs used to render a container's /etc files
+// It is persisted in a container label so the files can be regenerated on restart
+type etcFilesSettings struct {
+	Hostname   string   `json:"hostname,omitempty"`
+	ExtraHosts []string `json:"extra_hosts,omitempty"`
+	DNS        []string `json:"dns,omitempty"`
+	DNSSearch  []string `json:"dns_search,omitempty"`
+	DNSOptions []string `json:"dns_options,omitempty"`
+	IPAddress  string   `json:"ip_address,omitempty"`
+}
+
+// SetStateDir sets the directory where per-container state files are kept
+func (c *Client) SetStateDir(dir string) {
+	c.mu.Lock()
+	c.stateDir = dir
+	c.mu.Unlock()
+}
+
+// containerStateDir returns the state directory for a container
+func (c *Client) containerStateDir(containerID string) string {
+	c.mu.RLock()
+	dir := c.stateDir
+	c.mu.RUnlock()
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "fun-containers")
+	}
+	return filepath.Join(dir, containerID)
+}
+
+// needsHostsFile reports whether /etc/hosts and /etc/hostname should be managed
+func (s etcFilesSettings) needsHostsFile() bool {
+	return s.Hostname != "" || len(s.ExtraHosts) > 0
+}
+
+// needsResolvConf reports whether /etc/resolv.conf should be managed
+func (s etcFilesSettings) needsResolvConf() bool {
+	return len(s.DNS) > 0 || len(s.DNSSearch) > 0 || len(s.DNSOptions) > 0
+}
+
+// validateExtraHosts checks that extra hosts use the host:ip format
+func validateExtraHosts(hosts []string) error {
+	for _, h := range hosts {
+		name, ip, ok := strings.Cut(h, ":")
+		if !ok || name == "" || ip == "" {
+			return fmt.Errorf("invalid extra host %q, expected host:ip", h)
+		}
+	}
+	return nil
+}
+
+// renderHosts renders an /etc/hosts file
+func renderHosts(settings etcFilesSettings) string {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+
+	if settings.Hostname != "" {
+		ip := settings.IPAddress
+		if ip == "" {
+			ip = "127.0.1.1"
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ip, settings.Hostname)
+	}
+
+	for _, h := range settings.ExtraHosts {
+		// Split on the first colon so IPv6 addresses stay intact
+		name, ip, _ := strings.Cut(h, ":")
+		fmt.Fprintf(&b, "%s\t%s\n", ip, name)
+	}
+
+	return b.String()
+}
+
+// renderResolvConf renders an /etc/resolv.conf file, falling back to the host's
+// nameservers when only search domains or options are given
+func renderResolvConf(settings etcFilesSettings) string {
+	nameservers := settings.DNS
+	if len(nameservers) == 0 {
+		nameservers = hostNameservers()
+	}
+
+	var b strings.Builder
+	for _, ns := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(settings.DNSSearch) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(settings.DNSSearch, " "))
+	}
+	if len(settings.DNSOptions) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(settings.DNSOptions, " "))
+	}
+	return b.String()
+}
+
+// hostNameservers returns the nameservers configured on the host
+// Loopback resolvers such as systemd-resolved's stub are unreachable from containers
+func hostNameservers() []string {
+	file, err := os.Open(hostResolvConf)
+	if err != nil {
+		return []string{"8.8.8.8", "1.1.1.1"}
+	}
+	defer file.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if strings.HasPrefix(fields[1], "127.") || fields[1] == "::1" {
+			continue
+		}
+		result = append(result, fields[1])
+	}
+
+	if len(result) == 0 {
+		return []string{"8.8.8.8", "1.1.1.1"}
+	}
+	return result
+}
+
+// writeEtcFiles renders the managed /etc files for a container and returns the mounts for them
+func (c *Client) writeEtcFiles(containerID string, settings etcFilesSettings) ([]specs.Mount, error) {
+	if !settings.needsHostsFile() && !settings.needsResolvConf() {
+		return nil, nil
+	}
+
+	dir := c.containerStateDir(containerID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create container state directory")
+	}
+
+	files := map[string]string{}
+	if settings.needsHostsFile() {
+		files["hosts"] = renderHosts(settings)
+		if settings.Hostname != "" {
+			files["hostname"] = settings.Hostname + "\n"
+		}
+	}
+	if settings.needsResolvConf() {
+		files["resolv.conf"] = renderResolvConf(settings)
+	}
+
+	var mounts []specs.Mount
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := writeStateFile(path, []byte(content), 0644, 0, 0); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s", name)
+		}
+		mounts = append(mounts, specs.Mount{
+			Type:        "bind",
+			Source:      path,
+			Destination: "/etc/" + name,
+			Options:     []string{"rbind", "rw"},
+		})
+	}
+
+	return mounts, nil
+}
+
+// etcSettingsLabel encodes settings for storage in a container label
+func etcSettingsLabel(settings etcFilesSettings) (string, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal container etc settings")
+	}
+	return string(data), nil
+}
+
+// ensureEtcFiles re-renders the managed /etc files from the container labels so
+// the bind mount sources exist even if the state directory was cleaned up
+func (c *Client) ensureEtcFiles(containerID string, labels map[string]string) error {
+	data, ok := labels[LabelEtcSettings]
+	if !ok {
+		return nil
+	}
+
+	var settings etcFilesSettings
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		return errors.Wrap(err, "failed to parse container etc settings")
+	}
+
+	_, err := c.writeEtcFiles(containerID, settings)
+	return err
+}
+
+// writeStateFile replaces a file in a container's state directory through a
+// temporary file, so a container starting meanwhile never mounts a partial
+// file. Files not owned by root are handed to uid and gid.
+func writeStateFile(path string, data []byte, mode os.FileMode, uid, gid int) error {
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (uid != 0 || gid != 0) {
+		err = os.Chown(tmpPath, uid, gid)
+	}
+	// The umask may have narrowed the mode
+	if err == nil {
+		err = os.Chmod(tmpPath, mode)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removeContainerState deletes the state directory for a container
+func (c *Client) removeContainerState(containerID string) error {
+	return os.RemoveAll(c.containerStateDir(containerID))
+}
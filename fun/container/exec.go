@@ -0,0 +1,215 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"fun/logging"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/pkg/errors"
+)
+
+// execCounter makes exec process IDs unique within this process
+var execCounter uint64
+
+// TerminalSize is the size of a terminal in characters
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// ExecOptions contains options for running a command inside a running container
+type ExecOptions struct {
+	Command    []string
+	Env        []string
+	WorkingDir string
+	TTY        bool
+	// Stdin is forwarded until it ends, the command then sees the end of its input
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Resize delivers the size of the caller's terminal whenever it changes,
+	// for TTY processes, the first size is applied as soon as the command starts
+	Resize <-chan TerminalSize
+}
+
+// Exec runs a command inside a running container and returns its exit code
+func (c *Client) Exec(ctx context.Context, containerID string, opts ExecOptions) (int, error) {
+	ctx = c.withNamespace(ctx)
+	if len(opts.Command) == 0 {
+		return -1, errors.New("no command specified")
+	}
+
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to load container")
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return -1, errors.Wrap(err, "container is not running")
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to load container spec")
+	}
+
+	if spec.Process == nil {
+		return -1, errors.New("container spec has no process to exec from")
+	}
+
+	// Start from the container's process so user, capabilities and env are inherited
+	pspec := *spec.Process
+	pspec.Args = opts.Command
+	pspec.Terminal = opts.TTY
+	pspec.Env = append(append([]string{}, spec.Process.Env...), opts.Env...)
+	if opts.WorkingDir != "" {
+		pspec.Cwd = opts.WorkingDir
+	}
+
+	// The process only sees the end of its input once its stdin is closed
+	var stdin *stdinCloser
+	if opts.Stdin != nil {
+		stdin = &stdinCloser{reader: opts.Stdin}
+	}
+	ioOpts := []cio.Opt{cio.WithStreams(nil, opts.Stdout, opts.Stderr)}
+	if stdin != nil {
+		ioOpts = []cio.Opt{cio.WithStreams(stdin, opts.Stdout, opts.Stderr)}
+	}
+	if opts.TTY {
+		ioOpts = append(ioOpts, cio.WithTerminal)
+	}
+
+	execID := fmt.Sprintf("exec-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&execCounter, 1))
+	process, err := task.Exec(ctx, execID, &pspec, cio.NewCreator(ioOpts...))
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to create exec process")
+	}
+	defer process.Delete(context.Background())
+	if stdin != nil {
+		stdin.setCloser(func() {
+			if err := process.CloseIO(ctx, containerd.WithStdinCloser); err != nil {
+				logging.Debugf("Failed to close stdin of exec process %s: %v", execID, err)
+			}
+		})
+	}
+
+	statusCh, err := process.Wait(ctx)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to wait for exec process")
+	}
+
+	if err := process.Start(ctx); err != nil {
+		return -1, errors.Wrap(err, "failed to start exec process")
+	}
+
+	if opts.TTY && opts.Resize != nil {
+		resizeCtx, stopResize := context.WithCancel(ctx)
+		defer stopResize()
+		go func() {
+			for {
+				select {
+				case <-resizeCtx.Done():
+					return
+				case size, ok := <-opts.Resize:
+					if !ok {
+						return
+					}
+					if err := process.Resize(resizeCtx, uint32(size.Width), uint32(size.Height)); err != nil && resizeCtx.Err() == nil {
+						logging.Debugf("Failed to resize the terminal of exec process %s: %v", execID, err)
+					}
+				}
+			}
+		}()
+	}
+
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusCh:
+	case <-ctx.Done():
+	}
+	// A timed out or abandoned process would otherwise keep running in the container
+	if ctx.Err() != nil {
+		c.killExec(process, execID)
+		return -1, errors.Wrap(ctx.Err(), "exec process did not finish")
+	}
+	code, _, err := status.Result()
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to get exec result")
+	}
+
+	// Make sure all output has been flushed before returning
+	if pio := process.IO(); pio != nil {
+		pio.Wait()
+	}
+
+	return int(code), nil
+}
+
+// execKillTimeout bounds killing an exec process whose caller gave up on it
+const execKillTimeout = 10 * time.Second
+
+// killExec kills an exec process and waits for it to exit, so it can be deleted
+func (c *Client) killExec(process containerd.Process, execID string) {
+	ctx, cancel := context.WithTimeout(c.withNamespace(context.Background()), execKillTimeout)
+	defer cancel()
+	exited, err := process.Wait(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to wait for exec process %s: %v", execID, err)
+		return
+	}
+	if err := process.Kill(ctx, syscall.SIGKILL); err != nil {
+		log.Printf("Warning: Failed to kill exec process %s: %v", execID, err)
+		return
+	}
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		log.Printf("Warning: Exec process %s did not exit after it was killed", execID)
+	}
+}
+
+// stdinCloser forwards the caller's input to an exec process and closes the
+// process's stdin once the input ends
+type stdinCloser struct {
+	reader io.Reader
+
+	mutex  sync.Mutex
+	closer func()
+	ended  bool
+}
+
+func (s *stdinCloser) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if err == io.EOF {
+		s.mutex.Lock()
+		s.ended = true
+		closer := s.closer
+		s.mutex.Unlock()
+		if closer != nil {
+			closer()
+		}
+	}
+	return n, err
+}
+
+// setCloser sets the function closing the process's stdin, calling it right
+// away if the input ended before the process was created
+func (s *stdinCloser) setCloser(closer func()) {
+	s.mutex.Lock()
+	s.closer = closer
+	ended := s.ended
+	s.mutex.Unlock()
+	if ended {
+		closer()
+	}
+}
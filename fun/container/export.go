@@ -0,0 +1,47 @@
+package container
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// ExportContainer writes the merged root filesystem of a container, its image
+// layers plus the changes made at runtime, to w as a tar stream
+// The snapshot is mounted read-only, so running containers can be exported too.
+func (c *Client) ExportContainer(ctx context.Context, containerID string, w io.Writer) error {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container info")
+	}
+	if info.SnapshotKey == "" {
+		return errors.New("container has no root filesystem snapshot")
+	}
+
+	mounts, err := c.client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot mounts")
+	}
+
+	release, err := c.acquireHeavy(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// A diff against nothing contains every file of the root filesystem
+	return mount.WithReadonlyTempMount(ctx, mounts, func(root string) error {
+		if err := archive.WriteDiff(ctx, w, "", root); err != nil {
+			return errors.Wrap(err, "failed to write root filesystem")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,452 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"fun/logging"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// LabelHealthCheck stores a container's probe configuration
+const LabelHealthCheck = "fun.healthcheck"
+
+// ProbeType identifies how a probe checks a container
+type ProbeType string
+
+const (
+	// ProbeExec runs a command inside the container, exit code 0 is success
+	ProbeExec ProbeType = "exec"
+	// ProbeHTTP performs an HTTP GET, a 2xx or 3xx status is success. Like
+	// Kubernetes, HTTPS probes don't verify the container's certificate.
+	ProbeHTTP ProbeType = "http"
+	// ProbeTCP opens a TCP connection
+	ProbeTCP ProbeType = "tcp"
+)
+
+// Probe describes a single health probe
+type Probe struct {
+	Type    ProbeType `json:"type"`
+	Command []string  `json:"command,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Port    int       `json:"port,omitempty"`
+	// Scheme of HTTP probes, http or https, empty for http
+	Scheme string `json:"scheme,omitempty"`
+
+	InitialDelaySeconds int `json:"initial_delay_seconds,omitempty"`
+	PeriodSeconds       int `json:"period_seconds,omitempty"`
+	TimeoutSeconds      int `json:"timeout_seconds,omitempty"`
+	FailureThreshold    int `json:"failure_threshold,omitempty"`
+	SuccessThreshold    int `json:"success_threshold,omitempty"`
+}
+
+// HealthCheckConfig groups the probes for a container, following Kubernetes semantics:
+// the startup probe must pass before the others run, readiness gates traffic and
+// dependents, and liveness failures restart the container
+type HealthCheckConfig struct {
+	Startup   *Probe `json:"startup,omitempty"`
+	Readiness *Probe `json:"readiness,omitempty"`
+	Liveness  *Probe `json:"liveness,omitempty"`
+}
+
+// HealthStatus is the current probe state of a container
+type HealthStatus struct {
+	Started   bool      `json:"started"`
+	Ready     bool      `json:"ready"`
+	Live      bool      `json:"live"`
+	LastProbe time.Time `json:"last_probe"`
+	LastError string    `json:"last_error,omitempty"`
+	Restarts  int       `json:"restarts"`
+}
+
+// probeState tracks the counters of one probe
+type probeState struct {
+	nextRun   time.Time
+	successes int
+	failures  int
+}
+
+// healthState tracks all probes of one container task
+type healthState struct {
+	pid       uint32
+	config    HealthCheckConfig
+	status    HealthStatus
+	startup   probeState
+	readiness probeState
+	liveness  probeState
+}
+
+// HealthMonitor runs probes for containers that have a health check configured
+type HealthMonitor struct {
+	client *Client
+	mutex  sync.Mutex
+	states map[string]*healthState
+	// restart is called instead of restarting directly when set, e.g. to apply backoff
+	restart func(ctx context.Context, containerID string) error
+}
+
+// NewHealthMonitor creates a health monitor for the client's containers
+func NewHealthMonitor(client *Client) *HealthMonitor {
+	return &HealthMonitor{
+		client: client,
+		states: make(map[string]*healthState),
+	}
+}
+
+// SetRestartHandler sets the function used to restart unhealthy containers
+func (m *HealthMonitor) SetRestartHandler(restart func(ctx context.Context, containerID string) error) {
+	m.restart = restart
+}
+
+// withDefaults fills unset probe fields with Kubernetes-like defaults
+func (p Probe) withDefaults() Probe {
+	if p.PeriodSeconds <= 0 {
+		p.PeriodSeconds = 10
+	}
+	if p.TimeoutSeconds <= 0 {
+		p.TimeoutSeconds = 1
+	}
+	if p.FailureThreshold <= 0 {
+		p.FailureThreshold = 3
+	}
+	if p.SuccessThreshold <= 0 {
+		p.SuccessThreshold = 1
+	}
+	return p
+}
+
+// Validate checks that a probe is well-formed
+func (p *Probe) Validate() error {
+	switch p.Type {
+	case ProbeExec:
+		if len(p.Command) == 0 {
+			return errors.New("exec probe requires a command")
+		}
+	case ProbeHTTP, ProbeTCP:
+		if p.Port <= 0 || p.Port > 65535 {
+			return fmt.Errorf("%s probe requires a valid port", p.Type)
+		}
+		if p.Type == ProbeHTTP && p.Scheme != "" && p.Scheme != "http" && p.Scheme != "https" {
+			return fmt.Errorf("invalid http probe scheme %q, expected http or https", p.Scheme)
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q", p.Type)
+	}
+	return nil
+}
+
+// healthCheckLabel encodes a health check for storage in a container label
+func healthCheckLabel(config *HealthCheckConfig) (string, error) {
+	for _, probe := range []*Probe{config.Startup, config.Readiness, config.Liveness} {
+		if probe == nil {
+			continue
+		}
+		if err := probe.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal health check")
+	}
+	return string(data), nil
+}
+
+// Run probes containers once per second until the context is cancelled
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.probeAll(ctx)
+		}
+	}
+}
+
+// Status returns the health status of a container
+func (m *HealthMonitor) Status(containerID string) (HealthStatus, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state, ok := m.states[containerID]
+	if !ok {
+		return HealthStatus{}, false
+	}
+	return state.status, true
+}
+
+// IsReady reports whether a container has passed its readiness probe
+// Containers without a readiness probe are ready once started
+func (m *HealthMonitor) IsReady(containerID string) bool {
+	status, ok := m.Status(containerID)
+	return ok && status.Ready
+}
+
+// WaitReady blocks until a container is ready or the context is done, for use in
+// dependency ordering
+func (m *HealthMonitor) WaitReady(ctx context.Context, containerID string) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if m.IsReady(containerID) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("container %s did not become ready: %w", containerID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll refreshes the set of monitored containers and runs due probes
+func (m *HealthMonitor) probeAll(ctx context.Context) {
+	containers, err := m.client.GetContainers(ctx)
+	if err != nil {
+		log.Printf("Health monitor: failed to list containers: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil || labels[LabelHealthCheck] == "" {
+			continue
+		}
+
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+		status, err := task.Status(ctx)
+		if err != nil || status.Status != containerd.Running {
+			continue
+		}
+
+		var config HealthCheckConfig
+		if err := json.Unmarshal([]byte(labels[LabelHealthCheck]), &config); err != nil {
+			log.Printf("Health monitor: invalid health check on %s: %v", container.ID(), err)
+			continue
+		}
+
+		seen[container.ID()] = true
+		m.probeContainer(ctx, container.ID(), task.Pid(), config, labels)
+	}
+
+	// Forget containers that stopped or were removed
+	m.mutex.Lock()
+	for id := range m.states {
+		if !seen[id] {
+			delete(m.states, id)
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// probeContainer runs the due probes of a single container
+func (m *HealthMonitor) probeContainer(ctx context.Context, id string, pid uint32, config HealthCheckConfig, labels map[string]string) {
+	m.mutex.Lock()
+	state, ok := m.states[id]
+	if !ok || state.pid != pid {
+		// A new task means the container (re)started, so probes start over
+		restarts := 0
+		if ok {
+			restarts = state.status.Restarts
+		}
+		now := time.Now()
+		state = &healthState{pid: pid, config: config}
+		state.status.Restarts = restarts
+		state.status.Started = config.Startup == nil
+		state.status.Live = true
+		state.status.Ready = config.Readiness == nil && state.status.Started
+		for _, p := range []struct {
+			probe *Probe
+			state *probeState
+		}{{config.Startup, &state.startup}, {config.Readiness, &state.readiness}, {config.Liveness, &state.liveness}} {
+			if p.probe != nil {
+				p.state.nextRun = now.Add(time.Duration(p.probe.InitialDelaySeconds) * time.Second)
+			}
+		}
+		m.states[id] = state
+	}
+	m.mutex.Unlock()
+
+	host := labels[LabelIPAddress]
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	// Startup probe gates everything else
+	if !state.status.Started {
+		passed, failed := m.runProbe(ctx, id, host, config.Startup, &state.startup, &state.status)
+		if passed {
+			m.mutex.Lock()
+			state.status.Started = true
+			state.status.Ready = config.Readiness == nil
+			m.mutex.Unlock()
+		} else if failed {
+			m.handleUnhealthy(ctx, id, state, "startup probe failed")
+		}
+		return
+	}
+
+	if config.Readiness != nil {
+		passed, failed := m.runProbe(ctx, id, host, config.Readiness, &state.readiness, &state.status)
+		m.mutex.Lock()
+		if passed {
+			state.status.Ready = true
+		} else if failed {
+			state.status.Ready = false
+		}
+		m.mutex.Unlock()
+	}
+
+	if config.Liveness != nil {
+		passed, failed := m.runProbe(ctx, id, host, config.Liveness, &state.liveness, &state.status)
+		m.mutex.Lock()
+		if passed {
+			state.status.Live = true
+		}
+		m.mutex.Unlock()
+		if failed {
+			m.handleUnhealthy(ctx, id, state, "liveness probe failed")
+		}
+	}
+}
+
+// runProbe runs a probe if it is due and reports whether its success or failure
+// threshold was reached
+func (m *HealthMonitor) runProbe(ctx context.Context, id, host string, probe *Probe, ps *probeState, status *HealthStatus) (passed, failed bool) {
+	p := probe.withDefaults()
+	if time.Now().Before(ps.nextRun) {
+		return false, false
+	}
+	ps.nextRun = time.Now().Add(time.Duration(p.PeriodSeconds) * time.Second)
+
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(p.TimeoutSeconds)*time.Second)
+	err := m.client.runProbe(probeCtx, id, host, p)
+	cancel()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status.LastProbe = time.Now()
+	if err != nil {
+		logging.Debugf("Health monitor: %s probe of container %s failed: %v", p.Type, id, err)
+		status.LastError = err.Error()
+		ps.successes = 0
+		ps.failures++
+		return false, ps.failures >= p.FailureThreshold
+	}
+
+	status.LastError = ""
+	ps.failures = 0
+	ps.successes++
+	return ps.successes >= p.SuccessThreshold, false
+}
+
+// handleUnhealthy restarts a container whose startup or liveness probe failed
+func (m *HealthMonitor) handleUnhealthy(ctx context.Context, id string, state *healthState, reason string) {
+	m.mutex.Lock()
+	state.status.Live = false
+	state.status.Ready = false
+	state.status.Restarts++
+	m.mutex.Unlock()
+
+	log.Printf("Health monitor: container %s is unhealthy (%s), restarting", id, reason)
+
+	var err error
+	if m.restart != nil {
+		err = m.restart(ctx, id)
+	} else {
+		err = m.client.RestartContainer(ctx, id, 10*time.Second)
+	}
+	if err != nil {
+		log.Printf("Health monitor: failed to restart container %s: %v", id, err)
+	}
+}
+
+// runProbe performs a single probe against a container
+func (c *Client) runProbe(ctx context.Context, id, host string, probe Probe) error {
+	switch probe.Type {
+	case ProbeExec:
+		code, err := c.Exec(ctx, id, ExecOptions{Command: probe.Command})
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("probe command exited with code %d", code)
+		}
+		return nil
+
+	case ProbeHTTP:
+		pid, err := c.taskPid(ctx, id)
+		if err != nil {
+			return err
+		}
+		scheme := probe.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(probe.Port)), probe.Path)
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, probePidKey{}, pid), "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.probeHTTPClient().Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("probe returned status %d", resp.StatusCode)
+		}
+		return nil
+
+	case ProbeTCP:
+		pid, err := c.taskPid(ctx, id)
+		if err != nil {
+			return err
+		}
+		conn, err := dialInNetNS(ctx, pid, "tcp", net.JoinHostPort(host, strconv.Itoa(probe.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	return fmt.Errorf("unknown probe type %q", probe.Type)
+}
+
+// probePidKey carries the task PID of an HTTP probe to the dialer, which
+// connects from the task's network namespace
+type probePidKey struct{}
+
+// taskPid returns the PID of a container's running task
+func (c *Client) taskPid(ctx context.Context, id string) (uint32, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, id)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to load container")
+	}
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "container is not running")
+	}
+	return task.Pid(), nil
+}
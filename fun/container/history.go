@@ -0,0 +1,458 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxRevisions is how many applied revisions the deployment history keeps
+const DefaultMaxRevisions = 50
+
+// deployStopTimeout is how long replaced containers get to shut down gracefully
+const deployStopTimeout = 10 * time.Second
+
+// DeploymentRevision records one applied desired state
+type DeploymentRevision struct {
+	Revision  int           `json:"revision"`
+	AppliedAt time.Time     `json:"applied_at"`
+	AppliedBy string        `json:"applied_by"`
+	Message   string        `json:"message,omitempty"`
+	State     DesiredState  `json:"state"`
+	Changes   []StateChange `json:"changes"`
+	// RollbackOf is the revision a rollback restored, 0 for other deployments
+	RollbackOf int `json:"rollback_of,omitempty"`
+}
+
+// DeploymentHistory persists the desired states applied to the host so they can
+// be audited and rolled back to
+type DeploymentHistory struct {
+	path         string
+	mutex        sync.Mutex
+	maxRevisions int
+	Revisions    []DeploymentRevision `json:"revisions"`
+}
+
+// NewDeploymentHistory loads the deployment history at path, creating an empty one if needed
+func NewDeploymentHistory(path string) (*DeploymentHistory, error) {
+	history := &DeploymentHistory{
+		path:         path,
+		maxRevisions: DefaultMaxRevisions,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read deployment history")
+	}
+
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, errors.Wrap(err, "failed to parse deployment history")
+	}
+
+	return history, nil
+}
+
+// save writes the history to disk atomically; the caller must hold the mutex
+func (h *DeploymentHistory) save() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create deployment history directory")
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal deployment history")
+	}
+
+	tmpPath := h.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write deployment history")
+	}
+	return os.Rename(tmpPath, h.path)
+}
+
+// Record appends a revision and returns it, dropping the oldest revisions of
+// its project beyond the limit
+// rollbackOf is the revision a rollback restored, 0 for other deployments.
+func (h *DeploymentHistory) Record(state DesiredState, changes []StateChange, appliedBy, message string, rollbackOf int) (DeploymentRevision, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	revision := DeploymentRevision{
+		Revision:   1,
+		AppliedAt:  time.Now(),
+		AppliedBy:  appliedBy,
+		Message:    message,
+		State:      state,
+		Changes:    changes,
+		RollbackOf: rollbackOf,
+	}
+	if n := len(h.Revisions); n > 0 {
+		revision.Revision = h.Revisions[n-1].Revision + 1
+	}
+
+	previous := h.Revisions
+	h.Revisions = append(h.Revisions[:len(h.Revisions):len(h.Revisions)], revision)
+	// Each project keeps its own revisions, so a busy project doesn't push out
+	// the history of the others
+	if excess := len(h.project(state.Project)) - h.maxRevisions; excess > 0 {
+		kept := make([]DeploymentRevision, 0, len(h.Revisions)-excess)
+		for _, r := range h.Revisions {
+			if r.State.Project == state.Project && excess > 0 {
+				excess--
+				continue
+			}
+			kept = append(kept, r)
+		}
+		h.Revisions = kept
+	}
+
+	if err := h.save(); err != nil {
+		h.Revisions = previous
+		return DeploymentRevision{}, err
+	}
+	return revision, nil
+}
+
+// List returns all kept revisions, oldest first
+func (h *DeploymentHistory) List() []DeploymentRevision {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := make([]DeploymentRevision, len(h.Revisions))
+	copy(result, h.Revisions)
+	return result
+}
+
+// Get returns the given revision
+func (h *DeploymentHistory) Get(revision int) (DeploymentRevision, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, r := range h.Revisions {
+		if r.Revision == revision {
+			return r, true
+		}
+	}
+	return DeploymentRevision{}, false
+}
+
+// project returns the revisions of a project, oldest first; the empty project
+// is the global state. The caller must hold the mutex.
+func (h *DeploymentHistory) project(project string) []DeploymentRevision {
+	var revisions []DeploymentRevision
+	for _, r := range h.Revisions {
+		if r.State.Project == project {
+			revisions = append(revisions, r)
+		}
+	}
+	return revisions
+}
+
+// Current returns the latest revision of a project, "" for the global state
+func (h *DeploymentHistory) Current(project string) (DeploymentRevision, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	revisions := h.project(project)
+	if len(revisions) == 0 {
+		return DeploymentRevision{}, false
+	}
+	return revisions[len(revisions)-1], true
+}
+
+// Previous returns the revision of a project one step back from its current
+// one, "" for the global state. After a
+// rollback that is the revision before the one the rollback restored, so
+// repeated rollbacks keep going back instead of toggling between two revisions.
+func (h *DeploymentHistory) Previous(project string) (DeploymentRevision, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	revisions := h.project(project)
+	if len(revisions) == 0 {
+		return DeploymentRevision{}, false
+	}
+	current := revisions[len(revisions)-1].Revision
+	if restored := revisions[len(revisions)-1].RollbackOf; restored != 0 {
+		current = restored
+	}
+	for i := len(revisions) - 1; i > 0; i-- {
+		if revisions[i].Revision == current {
+			return revisions[i-1], true
+		}
+	}
+	return DeploymentRevision{}, false
+}
+
+// SetDeploymentHistory sets the store recording applied desired states
+func (c *Client) SetDeploymentHistory(history *DeploymentHistory) {
+	c.mu.Lock()
+	c.history = history
+	c.mu.Unlock()
+}
+
+// GetDeploymentHistory returns the store recording applied desired states
+func (c *Client) GetDeploymentHistory() *DeploymentHistory {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.history
+}
+
+// SetDeploymentHook sets a function called with every recorded revision
+// It runs while the deployment lock is held, so slow work belongs in a goroutine.
+func (c *Client) SetDeploymentHook(hook func(revision DeploymentRevision)) {
+	c.mu.Lock()
+	c.deploymentHook = hook
+	c.mu.Unlock()
+}
+
+// ApplyDesiredState brings the host to the desired state and records it as a new revision
+// Containers whose configuration changed are replaced: the replacement is
+// created and started first, so a failed pull, init container or start
+// leaves the old container running. If an action fails the remaining ones
+// are skipped and no revision is recorded.
+func (c *Client) ApplyDesiredState(ctx context.Context, desired DesiredState, appliedBy, message string) (*DeploymentRevision, error) {
+	return c.applyDesiredState(ctx, desired, appliedBy, message, 0)
+}
+
+// applyDesiredState applies and records a desired state, rollbackOf is the
+// revision a rollback restores
+func (c *Client) applyDesiredState(ctx context.Context, desired DesiredState, appliedBy, message string, rollbackOf int) (*DeploymentRevision, error) {
+	history := c.GetDeploymentHistory()
+	if history == nil {
+		return nil, errors.New("deployments are not available without a deployment history")
+	}
+
+	// Only one deployment may run at a time, or their plans would be stale
+	c.deployMutex.Lock()
+	defer c.deployMutex.Unlock()
+
+	diff, err := c.DiffDesiredState(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make(map[string]DesiredContainer, len(desired.Containers))
+	for _, d := range desired.withManagedLabels().Containers {
+		specs[d.Name] = d
+	}
+
+	for i, change := range diff.Changes {
+		log.Printf("Deploy: %s container %s", change.Action, change.Name)
+
+		if change.Action == DiffCreate || change.Action == DiffUpdate {
+			id, err := c.createDeployed(ctx, specs[change.Name], change.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to %s container %s: %w", change.Action, change.Name, err)
+			}
+			diff.Changes[i].ID = id
+		}
+		// The replaced container is only removed once its replacement runs
+		if change.Action == DiffUpdate || change.Action == DiffDelete {
+			if err := c.removeDeployed(ctx, change.ID); err != nil {
+				return nil, fmt.Errorf("failed to %s container %s: %w", change.Action, change.Name, err)
+			}
+		}
+	}
+
+	// Templates of unchanged containers are updated in place
+	for _, name := range diff.Unchanged {
+		if files := specs[name].ConfigFiles; len(files) > 0 {
+			id, err := c.LookupName(ctx, name)
+			if err == nil {
+				err = c.UpdateConfigFiles(ctx, id, files)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to update config files of container %s: %w", name, err)
+			}
+		}
+	}
+
+	// The changes above were only described, so there is nothing to record
+	if c.dryRunf("record deployment revision with %d changes (%s)", len(diff.Changes), message) {
+		return &DeploymentRevision{
+			AppliedAt: time.Now(),
+			AppliedBy: appliedBy,
+			Message:   message,
+			State:     desired,
+			Changes:   diff.Changes,
+		}, nil
+	}
+
+	revision, err := history.Record(desired, diff.Changes, appliedBy, message, rollbackOf)
+	if err != nil {
+		return nil, errors.Wrap(err, "state was applied but could not be recorded")
+	}
+
+	c.mu.RLock()
+	hook := c.deploymentHook
+	c.mu.RUnlock()
+	if hook != nil {
+		hook(revision)
+	}
+	return &revision, nil
+}
+
+// Rollback re-applies the desired state of an earlier revision of a project as
+// a new revision, "" is the global state. A revision of 0 goes one step back
+// from the current state of the project, see DeploymentHistory.Previous.
+func (c *Client) Rollback(ctx context.Context, project string, revision int, appliedBy string) (*DeploymentRevision, error) {
+	target, err := c.RollbackTarget(project, revision)
+	if err != nil {
+		return nil, err
+	}
+	restored := target.Revision
+	if target.RollbackOf != 0 {
+		restored = target.RollbackOf
+	}
+	return c.applyDesiredState(ctx, target.State, appliedBy, fmt.Sprintf("rollback to revision %d", target.Revision), restored)
+}
+
+// RollbackTarget returns the revision Rollback would restore. Revisions of
+// another project are refused, as are revisions whose state is the current
+// one, rolling back to them changes nothing.
+func (c *Client) RollbackTarget(project string, revision int) (DeploymentRevision, error) {
+	history := c.GetDeploymentHistory()
+	if history == nil {
+		return DeploymentRevision{}, errors.New("deployments are not available without a deployment history")
+	}
+
+	var target DeploymentRevision
+	var ok bool
+	if revision == 0 {
+		if target, ok = history.Previous(project); !ok {
+			return DeploymentRevision{}, errors.New("there is no previous revision to roll back to")
+		}
+	} else if target, ok = history.Get(revision); !ok {
+		return DeploymentRevision{}, fmt.Errorf("revision %d not found", revision)
+	} else if target.State.Project != project {
+		return DeploymentRevision{}, fmt.Errorf("revision %d is not a revision of %s", revision, projectLabel(project))
+	}
+
+	if current, ok := history.Current(project); ok && sameState(current.State, target.State) {
+		return DeploymentRevision{}, fmt.Errorf("revision %d is the current state, there is nothing to roll back", target.Revision)
+	}
+	return target, nil
+}
+
+// projectLabel describes a project in messages, "" is the global state
+func projectLabel(project string) string {
+	if project == "" {
+		return "the global state"
+	}
+	return "project " + project
+}
+
+// sameState reports whether two desired states are the same document
+func sameState(a, b DesiredState) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// createDeployed runs the init containers of a container of the desired state,
+// then creates and starts it and returns its ID. replaces is the container it
+// replaces, which keeps running meanwhile; the replacement takes its name and
+// gets another ID while the name is taken as ID.
+func (c *Client) createDeployed(ctx context.Context, desired DesiredContainer, replaces string) (string, error) {
+	cpus, mems, err := desired.placement(DetectTopology())
+	if err != nil {
+		return "", err
+	}
+	if err := c.runInitContainers(ctx, desired); err != nil {
+		return "", err
+	}
+	opts := desired.createOptions()
+	opts.Resources = ResourceLimits{CpusetCPUs: cpus, CpusetMems: mems}
+	if replaces != "" {
+		opts.Replaces = replaces
+		if replaces == opts.ID {
+			opts.ID = desired.Name + "-" + randomSuffix()
+		}
+		// The orchestrator marked the replaced container as critical by its ID,
+		// which the replacement doesn't keep
+		if c.isCritical(ctx, replaces) {
+			if opts.Labels == nil {
+				opts.Labels = map[string]string{}
+			}
+			opts.Labels[LabelCritical] = "true"
+		}
+	}
+	created, err := c.CreateContainer(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	// Singletons are started once the host holds their lease
+	if desired.Singleton {
+		return created.ID, nil
+	}
+	if err := c.StartContainer(ctx, created.ID); err != nil {
+		if removeErr := c.RemoveContainer(ctx, created.ID, true); removeErr != nil {
+			log.Printf("Warning: Failed to remove container %s that failed to start: %v", created.ID, removeErr)
+		}
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// createOptions are the options a container of the desired state is created
+// with, apart from its placement
+func (d DesiredContainer) createOptions() CreateContainerOptions {
+	labels := copyLabels(d.Labels)
+	if d.Singleton {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[LabelSingleton] = d.Name
+		labels[LabelStandby] = "waiting for the lease"
+	}
+	return CreateContainerOptions{
+		ID:             d.Name,
+		Name:           d.Name,
+		Service:        d.Labels[LabelService],
+		Replica:        1,
+		Image:          d.Image,
+		Command:        d.Command,
+		Env:            d.Env,
+		Labels:         labels,
+		RestartPolicy:  d.RestartPolicy,
+		Network:        d.Network,
+		Timezone:       d.Timezone,
+		Locale:         d.Locale,
+		ConfigFiles:    d.ConfigFiles,
+		Priority:       d.Priority,
+		HotplugDevices: d.Devices,
+	}
+}
+
+// removeDeployed stops a container gracefully and removes it
+func (c *Client) removeDeployed(ctx context.Context, id string) error {
+	if info, err := c.InspectContainer(ctx, id); err == nil && info.Status == "running" {
+		if err := c.StopContainer(ctx, id, deployStopTimeout); err != nil {
+			log.Printf("Warning: Failed to stop container %s gracefully: %v", id, err)
+		}
+	}
+	return c.RemoveContainer(ctx, id, true)
+}
+
+// copyLabels copies a label map so the desired state isn't modified by CreateContainer
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
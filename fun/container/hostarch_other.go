@@ -0,0 +1,22 @@
+//go:build !windows
+
+package container
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// HostArch returns the native architecture of the host as a GOARCH value,
+// which differs from runtime.GOARCH when an amd64 build runs translated by
+// Rosetta on Apple Silicon
+func HostArch() string {
+	if runtime.GOOS == "darwin" && runtime.GOARCH == "amd64" {
+		output, err := exec.Command("sysctl", "-n", "hw.optional.arm64").Output()
+		if err == nil && strings.TrimSpace(string(output)) == "1" {
+			return "arm64"
+		}
+	}
+	return runtime.GOARCH
+}
@@ -0,0 +1,28 @@
+package container
+
+import (
+	"debug/pe"
+	"runtime"
+
+	"golang.org/x/sys/windows"
+)
+
+// HostArch returns the native architecture of the host as a GOARCH value,
+// which differs from runtime.GOARCH when an amd64 build runs emulated on
+// Windows on ARM
+func HostArch() string {
+	var processMachine, nativeMachine uint16
+	if err := windows.IsWow64Process2(windows.CurrentProcess(), &processMachine, &nativeMachine); err != nil {
+		// Windows before 10 1709 only runs on amd64 and 386
+		return runtime.GOARCH
+	}
+	switch nativeMachine {
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "arm64"
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "amd64"
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "386"
+	}
+	return runtime.GOARCH
+}
@@ -0,0 +1,33 @@
+package container
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// HostDependency is the state of a kernel feature or tool containers need on a
+// Linux host, checked up front since containers otherwise fail late with
+// errors that don't name the missing piece
+type HostDependency struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// defaultSnapshotterLabel is the namespace label containerd clients read the
+// default snapshotter from
+const defaultSnapshotterLabel = "containerd.io/defaults/snapshotter"
+
+// ConfigureSnapshotter makes the client's namespace use the native snapshotter
+// when the kernel has no overlay filesystem, which containerd uses by default.
+// It returns the snapshotter in use.
+func (c *Client) ConfigureSnapshotter(ctx context.Context) (string, error) {
+	if OverlayAvailable() {
+		return "overlayfs", nil
+	}
+	if err := c.client.NamespaceService().SetLabel(ctx, c.namespace, defaultSnapshotterLabel, "native"); err != nil {
+		return "", errors.Wrap(err, "failed to select the native snapshotter")
+	}
+	return "native", nil
+}
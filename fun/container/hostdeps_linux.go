@@ -0,0 +1,210 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// requiredCgroupControllers are the controllers resource limits rely on
+var requiredCgroupControllers = []string{"cpu", "memory", "pids"}
+
+// OverlayAvailable reports whether the kernel supports the overlay filesystem
+// containerd's default snapshotter needs
+func OverlayAvailable() bool {
+	file, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// readSysctl returns the trimmed value of a /proc/sys entry, empty if it doesn't exist
+func readSysctl(name string) string {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeSysctl sets a /proc/sys entry
+func writeSysctl(name, value string) error {
+	return os.WriteFile(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")), []byte(value), 0644)
+}
+
+// CheckHostDependencies checks the kernel modules, tools and cgroup controllers
+// containers need on this host
+func CheckHostDependencies() []HostDependency {
+	deps := []HostDependency{checkOverlay(), checkBridgeNetfilter(), checkIPForward(), checkIptables()}
+	deps = append(deps, checkCgroupControllers())
+	if dep, ok := checkAppArmor(); ok {
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// checkOverlay checks for the overlay filesystem
+func checkOverlay() HostDependency {
+	dep := HostDependency{Name: "overlay filesystem", OK: OverlayAvailable()}
+	if dep.OK {
+		dep.Detail = "available"
+	} else {
+		dep.Detail = "not available, load it with modprobe overlay, until then images are unpacked with the slower native snapshotter"
+	}
+	return dep
+}
+
+// checkBridgeNetfilter checks that bridged container traffic passes iptables
+func checkBridgeNetfilter() HostDependency {
+	dep := HostDependency{Name: "br_netfilter module"}
+	switch readSysctl("net.bridge.bridge-nf-call-iptables") {
+	case "1":
+		dep.OK = true
+		dep.Detail = "loaded"
+	case "":
+		dep.Detail = "not loaded, traffic between containers bypasses iptables; load it with modprobe br_netfilter"
+	default:
+		dep.Detail = "loaded, but net.bridge.bridge-nf-call-iptables is 0"
+	}
+	return dep
+}
+
+// checkIPForward checks that containers can reach other networks
+func checkIPForward() HostDependency {
+	dep := HostDependency{Name: "IP forwarding", OK: readSysctl("net.ipv4.ip_forward") == "1"}
+	if dep.OK {
+		dep.Detail = "enabled"
+	} else {
+		dep.Detail = "disabled, containers can't reach other networks; enable net.ipv4.ip_forward"
+	}
+	return dep
+}
+
+// checkIptables checks for the iptables the CNI bridge plugin uses for NAT
+func checkIptables() HostDependency {
+	dep := HostDependency{Name: "iptables"}
+	if path, err := exec.LookPath("iptables"); err == nil {
+		dep.OK = true
+		dep.Detail = path
+		// iptables-nft and iptables-legacy both work, the version names the backend
+		if output, err := exec.Command(path, "--version").Output(); err == nil {
+			dep.Detail = strings.TrimSpace(string(output))
+		}
+		return dep
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		dep.Detail = "only nft is installed, the CNI bridge plugin needs the iptables command; install iptables-nft"
+	} else {
+		dep.Detail = "not installed, containers get no outbound NAT; install iptables"
+	}
+	return dep
+}
+
+// checkCgroupControllers checks that the controllers for resource limits are enabled
+func checkCgroupControllers() HostDependency {
+	dep := HostDependency{Name: "cgroup controllers"}
+	available := map[string]bool{}
+	switch DetectCgroupMode() {
+	case CgroupV2:
+		data, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+		if err != nil {
+			dep.Detail = fmt.Sprintf("failed to read the cgroup v2 controllers: %v", err)
+			return dep
+		}
+		for _, controller := range strings.Fields(string(data)) {
+			available[controller] = true
+		}
+	case CgroupV1, CgroupHybrid:
+		for _, controller := range requiredCgroupControllers {
+			if _, err := os.Stat(filepath.Join("/sys/fs/cgroup", controller)); err == nil {
+				available[controller] = true
+			}
+		}
+	default:
+		dep.Detail = "no cgroup filesystem mounted at /sys/fs/cgroup"
+		return dep
+	}
+
+	var missing []string
+	for _, controller := range requiredCgroupControllers {
+		if !available[controller] {
+			missing = append(missing, controller)
+		}
+	}
+	dep.OK = len(missing) == 0
+	if dep.OK {
+		dep.Detail = strings.Join(requiredCgroupControllers, ", ") + " enabled"
+	} else {
+		dep.Detail = fmt.Sprintf("%s not enabled, resource limits fail; enable them on the kernel command line", strings.Join(missing, ", "))
+	}
+	return dep
+}
+
+// checkAppArmor checks that AppArmor profiles can be loaded where AppArmor is
+// enabled, it returns false on hosts without AppArmor
+func checkAppArmor() (HostDependency, bool) {
+	data, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	if err != nil || strings.TrimSpace(string(data)) != "Y" {
+		return HostDependency{}, false
+	}
+	dep := HostDependency{Name: "AppArmor"}
+	if _, err := exec.LookPath("apparmor_parser"); err == nil {
+		dep.OK = true
+		dep.Detail = "enabled"
+	} else {
+		dep.Detail = "enabled, but apparmor_parser is missing so container profiles can't be loaded; install apparmor"
+	}
+	return dep, true
+}
+
+// ConfigureHostDependencies loads missing kernel modules and enables the sysctls
+// containers need, which requires root. It returns the changes made and the
+// ones that failed.
+func ConfigureHostDependencies() ([]string, []error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+
+	var changes []string
+	var errs []error
+	modprobe := func(module string) {
+		if output, err := exec.Command("modprobe", module).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to load the %s kernel module: %v: %s", module, err, strings.TrimSpace(string(output))))
+			return
+		}
+		changes = append(changes, fmt.Sprintf("loaded the %s kernel module", module))
+	}
+	sysctl := func(name string) {
+		if value := readSysctl(name); value == "" || value == "1" {
+			return
+		}
+		if err := writeSysctl(name, "1"); err != nil {
+			errs = append(errs, fmt.Errorf("failed to enable %s: %w", name, err))
+			return
+		}
+		changes = append(changes, fmt.Sprintf("enabled %s", name))
+	}
+
+	if !OverlayAvailable() {
+		modprobe("overlay")
+	}
+	if readSysctl("net.bridge.bridge-nf-call-iptables") == "" {
+		modprobe("br_netfilter")
+	}
+	sysctl("net.bridge.bridge-nf-call-iptables")
+	sysctl("net.ipv4.ip_forward")
+	return changes, errs
+}
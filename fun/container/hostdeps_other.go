@@ -0,0 +1,18 @@
+//go:build !linux
+
+package container
+
+// CheckHostDependencies returns nothing, containers run inside a Linux VM on this platform
+func CheckHostDependencies() []HostDependency {
+	return nil
+}
+
+// ConfigureHostDependencies does nothing, the Linux VM is set up by its image
+func ConfigureHostDependencies() ([]string, []error) {
+	return nil, nil
+}
+
+// OverlayAvailable reports true, the Linux VM's kernel provides overlayfs
+func OverlayAvailable() bool {
+	return true
+}
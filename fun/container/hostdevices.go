@@ -0,0 +1,446 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/typeurl/v2"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelDevices selects the USB and serial devices attached to a container
+	// as they appear, see HostDevice.Matches for the selectors
+	LabelDevices = "fun.devices"
+	// LabelDevicesAttached records the host devices currently attached through LabelDevices
+	LabelDevicesAttached = "fun.devices.attached"
+)
+
+// Host device kinds
+const (
+	DeviceUSB    = "usb"
+	DeviceSerial = "serial"
+)
+
+// deviceSettle is how long the device manager waits for a burst of hotplug
+// events to end, plugging in a device raises several
+const deviceSettle = time.Second
+
+// usbIDPattern matches USB ID selectors such as 0403:6001 or 0403:*
+var usbIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}:([0-9a-fA-F]{4}|\*)$`)
+
+// hotplugMajors are the character device majors of USB devices (189), USB
+// modems (166) and USB serial adapters (188). Containers selecting devices may
+// read and write any device of these classes, so devices plugged in later only
+// need their node created; without mknod access the container can't reach
+// the devices it didn't select.
+var hotplugMajors = []int64{166, 188, 189}
+
+// HostDevice is a USB or serial device of the host
+type HostDevice struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// VendorID and ProductID are the USB IDs, of the USB device a serial port belongs to
+	VendorID     string `json:"vendor_id,omitempty"`
+	ProductID    string `json:"product_id,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// ByID is the stable /dev/serial/by-id link of a serial port
+	ByID string `json:"by_id,omitempty"`
+}
+
+// Matches reports whether the device is selected by selector, a /dev path
+// glob such as /dev/ttyUSB* or a USB ID such as 0403:6001 or 0403:*
+func (d HostDevice) Matches(selector string) bool {
+	if strings.HasPrefix(selector, "/") {
+		for _, path := range []string{d.Path, d.ByID} {
+			if matched, _ := filepath.Match(selector, path); matched && path != "" {
+				return true
+			}
+		}
+		return false
+	}
+	vendor, product, _ := strings.Cut(strings.ToLower(selector), ":")
+	return d.VendorID == vendor && (product == "*" || d.ProductID == product)
+}
+
+// ParseDeviceSelectors splits and validates the comma separated selectors of LabelDevices
+func ParseDeviceSelectors(value string) ([]string, error) {
+	var selectors []string
+	for _, selector := range strings.Split(value, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		if strings.HasPrefix(selector, "/dev/") {
+			if _, err := filepath.Match(selector, ""); err != nil {
+				return nil, fmt.Errorf("invalid device selector %q: %w", selector, err)
+			}
+		} else if !usbIDPattern.MatchString(selector) {
+			return nil, fmt.Errorf("invalid device selector %q, expected a /dev path or a USB ID such as 0403:6001", selector)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// matchDevices returns the devices selected by any of selectors, sorted by path
+func matchDevices(devices []HostDevice, selectors []string) []HostDevice {
+	var matched []HostDevice
+	for _, device := range devices {
+		for _, selector := range selectors {
+			if device.Matches(selector) {
+				matched = append(matched, device)
+				break
+			}
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Path < matched[j].Path })
+	return matched
+}
+
+// devicePaths joins the paths of devices for LabelDevicesAttached
+func devicePaths(devices []HostDevice) string {
+	paths := make([]string, len(devices))
+	for i, device := range devices {
+		paths[i] = device.Path
+	}
+	return strings.Join(paths, ",")
+}
+
+// applyHotplugDevices labels a new container with its device selectors and
+// maps the selected devices present right now
+func applyHotplugDevices(opts *CreateContainerOptions) error {
+	selectors, err := ParseDeviceSelectors(strings.Join(opts.HotplugDevices, ","))
+	if err != nil || len(selectors) == 0 {
+		return err
+	}
+	devices, err := ScanHostDevices()
+	if err != nil {
+		return errors.Wrap(err, "failed to scan host devices")
+	}
+
+	attached := matchDevices(devices, selectors)
+	for _, device := range attached {
+		opts.Devices = append(opts.Devices, DeviceMapping{HostPath: device.Path, ContainerPath: device.Path, Permissions: "rwm"})
+	}
+	if opts.Labels == nil {
+		opts.Labels = map[string]string{}
+	}
+	opts.Labels[LabelDevices] = strings.Join(selectors, ",")
+	if len(attached) > 0 {
+		opts.Labels[LabelDevicesAttached] = devicePaths(attached)
+	}
+	return nil
+}
+
+// withHotplugDeviceRules allows the container to read and write the device
+// classes of hotplugMajors and of the devices matched right now, the
+// comma separated paths of LabelDevicesAttached
+func withHotplugDeviceRules(attached string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, spec *oci.Spec) error {
+		majors := append([]int64(nil), hotplugMajors...)
+		for _, path := range strings.Split(attached, ",") {
+			if path == "" {
+				continue
+			}
+			if node, err := oci.DeviceFromPath(path); err == nil && node.Type == "c" {
+				majors = append(majors, node.Major)
+			}
+		}
+		if spec.Linux == nil {
+			spec.Linux = &specs.Linux{}
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		seen := make(map[int64]bool)
+		for _, major := range majors {
+			if seen[major] {
+				continue
+			}
+			seen[major] = true
+			major := major
+			spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+				Allow:  true,
+				Type:   "c",
+				Major:  &major,
+				Access: "rw",
+			})
+		}
+		return nil
+	}
+}
+
+// allowsDeviceClass reports whether spec lets the container read and write
+// every character device of a major, as withHotplugDeviceRules does
+func allowsDeviceClass(spec *oci.Spec, major int64) bool {
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		return false
+	}
+	for _, rule := range spec.Linux.Resources.Devices {
+		if rule.Allow && rule.Type == "c" && rule.Major != nil && *rule.Major == major && rule.Minor == nil &&
+			strings.Contains(rule.Access, "r") && strings.Contains(rule.Access, "w") {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceManager keeps track of the host's USB and serial devices and attaches
+// them to the containers that select them with LabelDevices
+type DeviceManager struct {
+	client *Client
+
+	mutex    sync.Mutex
+	devices  []HostDevice
+	onChange func(devices []HostDevice)
+}
+
+// NewDeviceManager creates a device manager for the containers of client
+func NewDeviceManager(client *Client) *DeviceManager {
+	return &DeviceManager{client: client}
+}
+
+// SetChangeHandler is called with all devices whenever a device appears or disappears
+func (m *DeviceManager) SetChangeHandler(handler func(devices []HostDevice)) {
+	m.mutex.Lock()
+	m.onChange = handler
+	m.mutex.Unlock()
+}
+
+// Devices returns the devices found by the last scan
+func (m *DeviceManager) Devices() []HostDevice {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.devices
+}
+
+// Run rescans the devices on hotplug events, and every interval in case events
+// are missed or unavailable, until the context is cancelled
+func (m *DeviceManager) Run(ctx context.Context, interval time.Duration) {
+	events := make(chan struct{}, 1)
+	go func() {
+		if err := watchDeviceEvents(ctx, events); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Device hotplug events unavailable, scanning every %s: %v", interval, err)
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-events:
+			// Let the device nodes and their udev links settle
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(deviceSettle):
+			}
+		}
+		m.sync(ctx)
+	}
+}
+
+// sync rescans the devices and updates the containers that select them
+func (m *DeviceManager) sync(ctx context.Context) {
+	devices, err := ScanHostDevices()
+	if err != nil {
+		log.Printf("Warning: Failed to scan host devices: %v", err)
+		return
+	}
+
+	m.mutex.Lock()
+	changed := devicePaths(devices) != devicePaths(m.devices)
+	m.devices = devices
+	onChange := m.onChange
+	m.mutex.Unlock()
+	if changed && onChange != nil {
+		onChange(devices)
+	}
+
+	containers, err := m.client.ListContainers(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to list containers for device attachment: %v", err)
+		return
+	}
+	for _, container := range containers {
+		value := container.Labels[LabelDevices]
+		if value == "" {
+			continue
+		}
+		selectors, err := ParseDeviceSelectors(value)
+		if err != nil {
+			log.Printf("Warning: Container %s: %v", container.ID, err)
+			continue
+		}
+		if err := m.client.attachDevices(ctx, container.ID, matchDevices(devices, selectors)); err != nil {
+			log.Printf("Warning: Failed to update the devices of container %s: %v", container.ID, err)
+		}
+	}
+}
+
+// attachDevices replaces the devices attached through LabelDevices with
+// devices. The spec is updated for the next start, and the device nodes of a
+// running container are created or removed in place. Only containers whose
+// device cgroup doesn't allow a device's class are restarted to see it.
+func (c *Client) attachDevices(ctx context.Context, containerID string, devices []HostDevice) error {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container info")
+	}
+	previous := info.Labels[LabelDevicesAttached]
+	wanted := devicePaths(devices)
+	if previous == wanted {
+		return nil
+	}
+	if c.dryRunf("update the devices of container %s from [%s] to [%s]", containerID, previous, wanted) {
+		return nil
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container spec")
+	}
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	// The device cgroup of a running container is the one it started with
+	started := *spec.Linux.Resources
+	started.Devices = append([]specs.LinuxDeviceCgroup(nil), spec.Linux.Resources.Devices...)
+	startedSpec := &oci.Spec{Linux: &specs.Linux{Resources: &started}}
+
+	var removed []specs.LinuxDevice
+	if previous != "" {
+		removed = removeSpecDevices(spec, strings.Split(previous, ","))
+	}
+	var added []specs.LinuxDevice
+	var attached []HostDevice
+	for _, device := range devices {
+		node, err := oci.DeviceFromPath(device.Path)
+		if err != nil {
+			// The device may have disappeared since the scan, the next one catches up
+			log.Printf("Warning: Failed to attach device %s to container %s: %v", device.Path, containerID, err)
+			continue
+		}
+		spec.Linux.Devices = append(spec.Linux.Devices, *node)
+		added = append(added, *node)
+		major, minor := node.Major, node.Minor
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   node.Type,
+			Major:  &major,
+			Minor:  &minor,
+			Access: "rwm",
+		})
+		attached = append(attached, device)
+	}
+
+	specAny, err := typeurl.MarshalAny(spec)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal container spec")
+	}
+	err = container.Update(ctx, func(ctx context.Context, _ *containerd.Client, c *containers.Container) error {
+		c.Spec = specAny
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		if len(attached) > 0 {
+			c.Labels[LabelDevicesAttached] = devicePaths(attached)
+		} else {
+			delete(c.Labels, LabelDevicesAttached)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to update container")
+	}
+	log.Printf("Devices of container %s changed from [%s] to [%s]", containerID, previous, devicePaths(attached))
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return nil
+	}
+	if status, err := task.Status(ctx); err != nil || status.Status != containerd.Running {
+		return nil
+	}
+	for _, node := range added {
+		if node.Type != "c" || !allowsDeviceClass(startedSpec, node.Major) {
+			log.Printf("Restarting container %s, its device cgroup doesn't allow %s", containerID, node.Path)
+			return c.RestartContainer(ctx, containerID, deployStopTimeout)
+		}
+	}
+	// Nodes that are replaced are removed first, the same path may come back
+	// with other numbers
+	for _, node := range removed {
+		if err := removeDeviceNode(task.Pid(), node.Path); err != nil {
+			log.Printf("Warning: Failed to remove device %s from container %s: %v", node.Path, containerID, err)
+		}
+	}
+	for _, node := range added {
+		if err := createDeviceNode(task.Pid(), node); err != nil {
+			log.Printf("Restarting container %s, failed to create device %s in it: %v", containerID, node.Path, err)
+			return c.RestartContainer(ctx, containerID, deployStopTimeout)
+		}
+	}
+	return nil
+}
+
+// removeSpecDevices removes the device nodes and cgroup rules of host paths
+// from spec and returns the removed nodes
+func removeSpecDevices(spec *oci.Spec, paths []string) []specs.LinuxDevice {
+	type number struct{ major, minor int64 }
+	removed := make(map[number]bool)
+	var kept, dropped []specs.LinuxDevice
+	for _, device := range spec.Linux.Devices {
+		drop := false
+		for _, path := range paths {
+			if device.Path == path {
+				drop = true
+				removed[number{device.Major, device.Minor}] = true
+				break
+			}
+		}
+		if drop {
+			dropped = append(dropped, device)
+		} else {
+			kept = append(kept, device)
+		}
+	}
+	spec.Linux.Devices = kept
+
+	var rules []specs.LinuxDeviceCgroup
+	for _, rule := range spec.Linux.Resources.Devices {
+		if rule.Allow && rule.Major != nil && rule.Minor != nil && removed[number{*rule.Major, *rule.Minor}] {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	spec.Linux.Resources.Devices = rules
+	return dropped
+}
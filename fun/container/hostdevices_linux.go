@@ -0,0 +1,213 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// ScanHostDevices lists the USB devices and serial ports of the host
+func ScanHostDevices() ([]HostDevice, error) {
+	var devices []HostDevice
+
+	usb, err := filepath.Glob("/sys/bus/usb/devices/*/idVendor")
+	if err != nil {
+		return nil, err
+	}
+	for _, idVendor := range usb {
+		dir := filepath.Dir(idVendor)
+		name := ueventValue(dir, "DEVNAME")
+		if name == "" {
+			continue
+		}
+		device := usbDevice(dir)
+		device.Path = filepath.Join("/dev", name)
+		device.Kind = DeviceUSB
+		devices = append(devices, device)
+	}
+
+	byID := serialLinks()
+	ttys, err := os.ReadDir("/sys/class/tty")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, tty := range ttys {
+		dir := filepath.Join("/sys/class/tty", tty.Name())
+		// Virtual terminals have no device, and the legacy 8250 driver
+		// registers ports whether or not there is hardware behind them
+		deviceDir, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+		if err != nil {
+			continue
+		}
+		if driver, err := os.Readlink(filepath.Join(deviceDir, "driver")); err == nil && filepath.Base(driver) == "serial8250" {
+			continue
+		}
+
+		var device HostDevice
+		// USB serial adapters are identified by the USB device they belong to
+		for dir := deviceDir; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+				device = usbDevice(dir)
+				break
+			}
+		}
+		device.Path = filepath.Join("/dev", tty.Name())
+		device.Kind = DeviceSerial
+		device.ByID = byID[device.Path]
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// usbDevice reads the IDs and descriptions of the USB device in a sysfs directory
+func usbDevice(dir string) HostDevice {
+	return HostDevice{
+		VendorID:     sysfsValue(dir, "idVendor"),
+		ProductID:    sysfsValue(dir, "idProduct"),
+		Serial:       sysfsValue(dir, "serial"),
+		Manufacturer: sysfsValue(dir, "manufacturer"),
+		Product:      sysfsValue(dir, "product"),
+	}
+}
+
+// serialLinks maps serial ports to their stable /dev/serial/by-id links
+func serialLinks() map[string]string {
+	links := make(map[string]string)
+	entries, err := os.ReadDir("/dev/serial/by-id")
+	if err != nil {
+		return links
+	}
+	for _, entry := range entries {
+		link := filepath.Join("/dev/serial/by-id", entry.Name())
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			links[target] = link
+		}
+	}
+	return links
+}
+
+// sysfsValue reads a sysfs attribute, empty if it doesn't exist
+func sysfsValue(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ueventValue reads a key of the uevent attribute of a sysfs directory
+func ueventValue(dir, key string) string {
+	for _, line := range strings.Split(sysfsValue(dir, "uevent"), "\n") {
+		if value, ok := strings.CutPrefix(line, key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// watchDeviceEvents signals events when a USB or tty device is added or
+// removed, listening to the kernel's uevents like udev does
+func watchDeviceEvents(ctx context.Context, events chan<- struct{}) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1, Pid: 0}); err != nil {
+		return err
+	}
+	// Time out reads so cancellation is noticed
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16<<10)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !deviceEvent(buf[:n]) {
+			continue
+		}
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// deviceEvent reports whether a uevent adds or removes a USB or tty device
+func deviceEvent(message []byte) bool {
+	var action, subsystem string
+	for _, field := range bytes.Split(message, []byte{0}) {
+		if value, ok := bytes.CutPrefix(field, []byte("ACTION=")); ok {
+			action = string(value)
+		} else if value, ok := bytes.CutPrefix(field, []byte("SUBSYSTEM=")); ok {
+			subsystem = string(value)
+		}
+	}
+	return (action == "add" || action == "remove") && (subsystem == "usb" || subsystem == "tty")
+}
+
+// containerPath returns path inside the root filesystem of the container whose
+// init process is pid, as seen through its mount namespace
+func containerPath(pid uint32, path string) string {
+	return fmt.Sprintf("/proc/%d/root%s", pid, filepath.Clean("/"+path))
+}
+
+// createDeviceNode creates a device node in the /dev of a running container,
+// replacing what was at its path
+func createDeviceNode(pid uint32, node specs.LinuxDevice) error {
+	path := containerPath(pid, node.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := uint32(0666)
+	if node.FileMode != nil {
+		mode = uint32(node.FileMode.Perm())
+	}
+	switch node.Type {
+	case "c", "u":
+		mode |= unix.S_IFCHR
+	case "b":
+		mode |= unix.S_IFBLK
+	default:
+		return fmt.Errorf("unsupported device type %q", node.Type)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := unix.Mknod(path, mode, int(unix.Mkdev(uint32(node.Major), uint32(node.Minor)))); err != nil {
+		return err
+	}
+	uid, gid := 0, 0
+	if node.UID != nil {
+		uid = int(*node.UID)
+	}
+	if node.GID != nil {
+		gid = int(*node.GID)
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// removeDeviceNode removes a device node from the /dev of a running container
+func removeDeviceNode(pid uint32, path string) error {
+	err := os.Remove(containerPath(pid, path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package container
+
+import (
+	"context"
+	"errors"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ScanHostDevices finds no devices, containers run inside a Linux VM on this platform
+func ScanHostDevices() ([]HostDevice, error) {
+	return nil, nil
+}
+
+// watchDeviceEvents is not supported, host devices can't be passed into the Linux VM
+func watchDeviceEvents(ctx context.Context, events chan<- struct{}) error {
+	return errors.New("device hotplug is only supported on Linux hosts")
+}
+
+// createDeviceNode is not supported, host devices can't be passed into the Linux VM
+func createDeviceNode(pid uint32, node specs.LinuxDevice) error {
+	return errors.New("device hotplug is only supported on Linux hosts")
+}
+
+// removeDeviceNode is not supported, host devices can't be passed into the Linux VM
+func removeDeviceNode(pid uint32, path string) error {
+	return errors.New("device hotplug is only supported on Linux hosts")
+}
@@ -0,0 +1,144 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ImageDetails describes an image from its manifest and OCI config
+type ImageDetails struct {
+	Name         string     `json:"name"`
+	Digest       string     `json:"digest"`
+	ConfigDigest string     `json:"config_digest"`
+	Created      *time.Time `json:"created,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	OS           string     `json:"os"`
+	Architecture string     `json:"architecture"`
+	// Size is the compressed size of all layers
+	Size    int64          `json:"size"`
+	Layers  []ImageLayer   `json:"layers"`
+	History []ImageHistory `json:"history"`
+
+	ExposedPorts []string          `json:"exposed_ports,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Volumes      []string          `json:"volumes,omitempty"`
+	StopSignal   string            `json:"stop_signal,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// ImageLayer is a layer of an image
+type ImageLayer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diff_id,omitempty"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+// ImageHistory is a build step of an image, Layer is empty for steps that only
+// changed the config
+type ImageHistory struct {
+	Created   *time.Time `json:"created,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	Layer     string     `json:"layer,omitempty"`
+	Size      int64      `json:"size"`
+}
+
+// InspectImage returns the layers, build history and runtime configuration of a
+// local image, read from its OCI config without running it
+func (c *Client) InspectImage(ctx context.Context, ref string) (*ImageDetails, error) {
+	ctx = c.withNamespace(ctx)
+	normalized, err := NormalizeImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	image, err := c.client.GetImage(ctx, normalized)
+	if err != nil {
+		return nil, errors.Wrapf(err, "image %s not found locally", normalized)
+	}
+
+	store := c.client.ContentStore()
+	manifest, err := images.Manifest(ctx, store, image.Target(), platforms.Default())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image manifest")
+	}
+	data, err := content.ReadBlob(ctx, store, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image config")
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "failed to parse image config")
+	}
+
+	details := &ImageDetails{
+		Name:         normalized,
+		Digest:       image.Target().Digest.String(),
+		ConfigDigest: manifest.Config.Digest.String(),
+		Created:      config.Created,
+		Author:       config.Author,
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Layers:       []ImageLayer{},
+		History:      []ImageHistory{},
+		Env:          config.Config.Env,
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		WorkingDir:   config.Config.WorkingDir,
+		User:         config.Config.User,
+		StopSignal:   config.Config.StopSignal,
+		Labels:       config.Config.Labels,
+	}
+
+	for i, layer := range manifest.Layers {
+		imageLayer := ImageLayer{
+			Digest:    layer.Digest.String(),
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+		}
+		if i < len(config.RootFS.DiffIDs) {
+			imageLayer.DiffID = config.RootFS.DiffIDs[i].String()
+		}
+		details.Layers = append(details.Layers, imageLayer)
+		details.Size += layer.Size
+	}
+
+	// Each history entry that isn't an empty layer created the next layer
+	layerIndex := 0
+	for _, step := range config.History {
+		entry := ImageHistory{
+			Created:   step.Created,
+			CreatedBy: step.CreatedBy,
+			Comment:   step.Comment,
+		}
+		if !step.EmptyLayer && layerIndex < len(details.Layers) {
+			entry.Layer = details.Layers[layerIndex].Digest
+			entry.Size = details.Layers[layerIndex].Size
+			layerIndex++
+		}
+		details.History = append(details.History, entry)
+	}
+
+	for port := range config.Config.ExposedPorts {
+		details.ExposedPorts = append(details.ExposedPorts, port)
+	}
+	sort.Strings(details.ExposedPorts)
+	for volume := range config.Config.Volumes {
+		details.Volumes = append(details.Volumes, volume)
+	}
+	sort.Strings(details.Volumes)
+
+	return details, nil
+}
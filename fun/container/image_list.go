@@ -0,0 +1,234 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
+	"github.com/pkg/errors"
+)
+
+// ImageSummary is a local image as listed, without its layers
+type ImageSummary struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	// Size is the compressed size of the image for the host platform
+	Size      int64             `json:"size"`
+	CreatedAt time.Time         `json:"created_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ImageListOptions selects the images WalkImages and ListImagePage return
+type ImageListOptions struct {
+	// Name is a glob pattern matched against the full image name, such as
+	// "docker.io/library/*", empty matches all
+	Name string
+	// Labels must all be set on the image, an empty value matches any value
+	Labels map[string]string
+	// After continues a listing after the image of that name, images are listed by name
+	After string
+	// Limit ends the listing after that many images, 0 lists all
+	Limit int
+}
+
+// ImagePage is a page of an image listing
+type ImagePage struct {
+	Images []ImageSummary `json:"images"`
+	// Next is the After of the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// ParseImageLabelFilters parses label filters such as "tier=web" or "tier",
+// which matches any value
+func ParseImageLabelFilters(values []string) (map[string]string, error) {
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, _ := strings.Cut(value, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid label filter %q, expected key or key=value", value)
+		}
+		labels[key] = val
+	}
+	return labels, nil
+}
+
+// Validate checks the name pattern, so a bad one fails before anything is listed
+func (o ImageListOptions) Validate() error {
+	if _, err := path.Match(o.Name, ""); err != nil {
+		return fmt.Errorf("invalid image name pattern %q: %w", o.Name, err)
+	}
+	if o.Limit < 0 {
+		return fmt.Errorf("invalid image list limit %d", o.Limit)
+	}
+	return nil
+}
+
+// filters returns the containerd filters selecting the name and labels, so
+// containerd skips the other images instead of sending them
+func (o ImageListOptions) filters() []string {
+	if o.Name == "" && len(o.Labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(o.Labels))
+	for key := range o.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Filters separated by commas must all match
+	var conditions []string
+	if o.Name != "" {
+		conditions = append(conditions, "name~="+strconv.Quote(globRegexp(o.Name)))
+	}
+	for _, key := range keys {
+		condition := "labels." + strconv.Quote(key)
+		if value := o.Labels[key]; value != "" {
+			condition += "==" + strconv.Quote(value)
+		}
+		conditions = append(conditions, condition)
+	}
+	return []string{strings.Join(conditions, ",")}
+}
+
+// globRegexp converts a pattern of path.Match, which Validate accepted, to an
+// anchored regular expression matching the same names
+func globRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case inClass:
+			switch ch {
+			case ']':
+				inClass = false
+				b.WriteByte(ch)
+			case '-':
+				b.WriteByte(ch)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(ch)))
+			}
+		case ch == '[':
+			inClass = true
+			b.WriteByte(ch)
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+		case ch == '*':
+			b.WriteString("[^/]*")
+		case ch == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// imageListingTTL is how long the sorted image records of a listing are kept
+// for the pages continuing it
+const imageListingTTL = 30 * time.Second
+
+// imageListing holds the image records of the last listing sorted by name, so
+// the following pages don't list and sort every image again
+type imageListing struct {
+	key     string
+	images  []images.Image
+	created time.Time
+}
+
+// sortedImages returns the image records selected by the filters of opts in
+// name order. A listing continuing after an image reuses the records of the
+// listing it continues while they are recent, a new listing fetches them.
+func (c *Client) sortedImages(ctx context.Context, opts ImageListOptions) ([]images.Image, error) {
+	filters := opts.filters()
+	key := c.namespace + "\x00" + strings.Join(filters, "\x00")
+
+	c.imageListingMutex.Lock()
+	defer c.imageListingMutex.Unlock()
+	if listing := c.imageListing; opts.After != "" && listing != nil && listing.key == key && time.Since(listing.created) < imageListingTTL {
+		return listing.images, nil
+	}
+
+	imageList, err := c.client.ImageService().List(ctx, filters...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+	sort.Slice(imageList, func(i, j int) bool { return imageList[i].Name < imageList[j].Name })
+	c.imageListing = &imageListing{key: key, images: imageList, created: time.Now()}
+	return imageList, nil
+}
+
+// WalkImages calls fn with the images selected by opts in name order until fn
+// returns an error. Sizes are read one image at a time as the images are
+// passed on, so listing thousands of images only holds their records.
+func (c *Client) WalkImages(ctx context.Context, opts ImageListOptions, fn func(ImageSummary) error) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	ctx = c.withNamespace(ctx)
+	imageList, err := c.sortedImages(ctx, opts)
+	if err != nil {
+		return err
+	}
+	start := sort.Search(len(imageList), func(i int) bool { return imageList[i].Name > opts.After })
+
+	store := c.client.ContentStore()
+	listed := 0
+	for _, img := range imageList[start:] {
+		if opts.Limit > 0 && listed == opts.Limit {
+			break
+		}
+
+		// An image whose content is missing is still listed, without a size
+		size, _ := img.Size(ctx, store, platforms.Default())
+		summary := ImageSummary{
+			Name:      img.Name,
+			Digest:    img.Target.Digest.String(),
+			Size:      size,
+			CreatedAt: img.CreatedAt,
+			Labels:    img.Labels,
+		}
+		if err := fn(summary); err != nil {
+			return err
+		}
+		listed++
+	}
+	return nil
+}
+
+// ListImagePage returns a page of the images selected by opts, pass its Next as
+// the After of the following request to get the next page
+func (c *Client) ListImagePage(ctx context.Context, opts ImageListOptions) (*ImagePage, error) {
+	page := &ImagePage{Images: []ImageSummary{}}
+	limit := opts.Limit
+	// One more image tells whether there is a next page
+	if limit > 0 {
+		opts.Limit++
+	}
+	err := c.WalkImages(ctx, opts, func(image ImageSummary) error {
+		page.Images = append(page.Images, image)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(page.Images) > limit {
+		page.Images = page.Images[:limit]
+		page.Next = page.Images[limit-1].Name
+	}
+	return page, nil
+}
@@ -0,0 +1,253 @@
+package container
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ImageLayerReport describes how much of an image's layer data is shared with other images
+type ImageLayerReport struct {
+	Name       string `json:"name"`
+	Layers     int    `json:"layers"`
+	TotalSize  int64  `json:"total_size"`
+	SharedSize int64  `json:"shared_size"`
+	UniqueSize int64  `json:"unique_size"`
+}
+
+// ImageAnalysis summarizes layer deduplication across all images
+type ImageAnalysis struct {
+	Images []ImageLayerReport `json:"images"`
+	// LogicalSize is the sum of all image sizes as if nothing was shared
+	LogicalSize int64 `json:"logical_size"`
+	// PhysicalSize is the size of the distinct layers actually stored
+	PhysicalSize int64 `json:"physical_size"`
+}
+
+// GCResult summarizes a content-store garbage collection run
+type GCResult struct {
+	PrunedImages   []string
+	ReclaimedBytes int64
+	Duration       time.Duration
+}
+
+// ImageGCPolicy chooses the unused images pruning keeps
+type ImageGCPolicy struct {
+	// Keep are patterns of image names, such as "docker.io/library/*", that are
+	// never pruned, e.g. the base images builds on this host start from
+	Keep []string
+	// MinAge keeps images pulled or updated more recently than this
+	MinAge time.Duration
+}
+
+// ValidateImageGCKeep checks the patterns of ImageGCPolicy.Keep
+func ValidateImageGCKeep(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid image GC keep pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// SetImageGCPolicy sets the images pruning keeps although no container uses them
+func (c *Client) SetImageGCPolicy(policy ImageGCPolicy) {
+	c.mu.Lock()
+	c.imageGCPolicy = policy
+	c.mu.Unlock()
+}
+
+// keeps reports whether the policy keeps an unused image
+func (p ImageGCPolicy) keeps(img images.Image, now time.Time) bool {
+	for _, pattern := range p.Keep {
+		if matched, _ := path.Match(pattern, img.Name); matched {
+			return true
+		}
+	}
+	updated := img.UpdatedAt
+	if updated.IsZero() {
+		updated = img.CreatedAt
+	}
+	return now.Sub(updated) < p.MinAge
+}
+
+// AnalyzeImages reports shared and unique layer sizes across all images
+func (c *Client) AnalyzeImages(ctx context.Context) (*ImageAnalysis, error) {
+	ctx = c.withNamespace(ctx)
+	imageList, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+
+	store := c.client.ContentStore()
+	imageLayers := make(map[string][]content.Info)
+	layerRefs := make(map[digest.Digest]int)
+	layerSizes := make(map[digest.Digest]int64)
+
+	for _, img := range imageList {
+		manifest, err := images.Manifest(ctx, store, img.Target, platforms.Default())
+		if err != nil {
+			log.Printf("Warning: Failed to read manifest for image %s: %v", img.Name, err)
+			continue
+		}
+
+		// Count each layer once per image even if an image lists it twice
+		seen := make(map[digest.Digest]bool)
+		for _, layer := range manifest.Layers {
+			if seen[layer.Digest] {
+				continue
+			}
+			seen[layer.Digest] = true
+			layerRefs[layer.Digest]++
+			layerSizes[layer.Digest] = layer.Size
+			imageLayers[img.Name] = append(imageLayers[img.Name], content.Info{Digest: layer.Digest, Size: layer.Size})
+		}
+	}
+
+	analysis := &ImageAnalysis{}
+	for name, layers := range imageLayers {
+		report := ImageLayerReport{Name: name, Layers: len(layers)}
+		for _, layer := range layers {
+			report.TotalSize += layer.Size
+			if layerRefs[layer.Digest] > 1 {
+				report.SharedSize += layer.Size
+			} else {
+				report.UniqueSize += layer.Size
+			}
+		}
+		analysis.LogicalSize += report.TotalSize
+		analysis.Images = append(analysis.Images, report)
+	}
+	for _, size := range layerSizes {
+		analysis.PhysicalSize += size
+	}
+
+	sort.Slice(analysis.Images, func(i, j int) bool {
+		return analysis.Images[i].Name < analysis.Images[j].Name
+	})
+
+	return analysis, nil
+}
+
+// contentStoreSize returns the total size of blobs in the content store
+func (c *Client) contentStoreSize(ctx context.Context) (int64, error) {
+	var total int64
+	err := c.client.ContentStore().Walk(ctx, func(info content.Info) error {
+		total += info.Size
+		return nil
+	})
+	return total, err
+}
+
+// GarbageCollect removes unreferenced content from the content store
+// If pruneUnused is set, images not used by any container are deleted first.
+// Pulls in progress are protected by their leases, and the collection is skipped
+// entirely while this client has pulls in flight.
+func (c *Client) GarbageCollect(ctx context.Context, pruneUnused bool) (*GCResult, error) {
+	ctx = c.withNamespace(ctx)
+	if n := atomic.LoadInt64(&c.pullsInFlight); n > 0 {
+		return nil, errors.Errorf("skipping garbage collection: %d pulls in progress", n)
+	}
+
+	start := time.Now()
+	result := &GCResult{}
+
+	before, err := c.contentStoreSize(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to measure content store")
+	}
+
+	if pruneUnused {
+		pruned, err := c.pruneUnusedImages(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result.PrunedImages = pruned
+	}
+
+	if c.dryRunf("collect unreferenced content (%d bytes in the content store)", before) {
+		return result, nil
+	}
+
+	// Deleting a lease synchronously makes containerd run a full GC pass
+	leaseManager := c.client.LeasesService()
+	lease, err := leaseManager.Create(ctx, leases.WithRandomID(), leases.WithExpiration(time.Minute))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GC lease")
+	}
+	if err := leaseManager.Delete(ctx, lease, leases.SynchronousDelete); err != nil {
+		return nil, errors.Wrap(err, "failed to run garbage collection")
+	}
+
+	after, err := c.contentStoreSize(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to measure content store")
+	}
+
+	result.ReclaimedBytes = before - after
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// pruneUnusedImages deletes images that no container references, apart from
+// those pre-pulled for upcoming deployments, the checkpoints containers are
+// restored from and those the ImageGCPolicy keeps
+func (c *Client) pruneUnusedImages(ctx context.Context) ([]string, error) {
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	inUse := make(map[string]bool)
+	c.mu.RLock()
+	prewarmer := c.prewarmer
+	policy := c.imageGCPolicy
+	c.mu.RUnlock()
+	if prewarmer != nil {
+		inUse = prewarmer.Hinted()
+	}
+	for _, container := range containers {
+		info, err := container.Info(ctx)
+		if err != nil {
+			continue
+		}
+		inUse[info.Image] = true
+		if checkpoint := info.Labels[LabelCheckpoint]; checkpoint != "" {
+			inUse[checkpoint] = true
+		}
+	}
+
+	imageList, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+
+	var pruned []string
+	now := time.Now()
+	for _, img := range imageList {
+		if inUse[img.Name] || policy.keeps(img, now) {
+			continue
+		}
+		if c.dryRunf("remove unused image %s", img.Name) {
+			pruned = append(pruned, img.Name)
+			continue
+		}
+		if err := c.client.ImageService().Delete(ctx, img.Name); err != nil {
+			log.Printf("Warning: Failed to prune image %s: %v", img.Name, err)
+			continue
+		}
+		pruned = append(pruned, img.Name)
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,158 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// LabelInitFor marks an init container with the container it prepares
+const LabelInitFor = "fun.init-for"
+
+// DefaultInitTimeout is how long an init container may run if it sets no timeout
+const DefaultInitTimeout = 10 * time.Minute
+
+// InitContainer runs to completion before the container it belongs to starts,
+// e.g. to migrate a database or render configuration
+type InitContainer struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Command []string `json:"command,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	// Timeout in seconds, 0 uses DefaultInitTimeout
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// validateInitContainers checks the init containers of a desired container
+func validateInitContainers(inits []InitContainer) error {
+	seen := make(map[string]bool)
+	for i, initContainer := range inits {
+		if initContainer.Name == "" {
+			return fmt.Errorf("init container %d has no name", i)
+		}
+		if seen[initContainer.Name] {
+			return fmt.Errorf("init container %s is listed more than once", initContainer.Name)
+		}
+		seen[initContainer.Name] = true
+		if _, err := NormalizeImageRef(initContainer.Image); err != nil {
+			return fmt.Errorf("init container %s: %w", initContainer.Name, err)
+		}
+		if initContainer.Timeout < 0 {
+			return fmt.Errorf("init container %s: timeout must not be negative", initContainer.Name)
+		}
+	}
+	return nil
+}
+
+// runInitContainers runs the init containers of desired one after the other,
+// stopping at the first that fails. Deployments run them before touching the
+// container desired replaces, so a failing init leaves the service up.
+// They share the network of the container they prepare and are removed once
+// they exited, their output is in the daemon log.
+func (c *Client) runInitContainers(ctx context.Context, desired DesiredContainer) error {
+	for _, initContainer := range desired.InitContainers {
+		id := desired.Name + "-init-" + initContainer.Name
+		if c.dryRunf("run init container %s from %s", id, initContainer.Image) {
+			continue
+		}
+
+		log.Printf("Deploy: running init container %s of %s", initContainer.Name, desired.Name)
+		code, err := c.runToCompletion(ctx, id, initContainer, desired)
+		if err != nil {
+			return fmt.Errorf("init container %s failed: %w", initContainer.Name, err)
+		}
+		if code != 0 {
+			return fmt.Errorf("init container %s exited with code %d, see the daemon log for its output", initContainer.Name, code)
+		}
+	}
+	return nil
+}
+
+// runToCompletion creates and starts an init container and waits for it to
+// exit, returning its exit code
+func (c *Client) runToCompletion(ctx context.Context, id string, initContainer InitContainer, desired DesiredContainer) (uint32, error) {
+	nsCtx := c.withNamespace(ctx)
+
+	// A failed deployment may have left it behind
+	if _, err := c.client.LoadContainer(nsCtx, id); err == nil {
+		if err := c.removeInitContainer(ctx, id); err != nil {
+			return 0, errors.Wrap(err, "failed to remove previous run")
+		}
+	}
+
+	_, err := c.CreateContainer(ctx, CreateContainerOptions{
+		ID:            id,
+		Name:          id,
+		Image:         initContainer.Image,
+		Command:       initContainer.Command,
+		Env:           initContainer.Env,
+		Labels:        map[string]string{LabelInitFor: desired.Name},
+		RestartPolicy: "no",
+		Network:       desired.Network,
+		Timezone:      desired.Timezone,
+		Locale:        desired.Locale,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := c.removeInitContainer(ctx, id); err != nil {
+			log.Printf("Warning: Failed to remove init container %s: %v", id, err)
+		}
+	}()
+
+	if err := c.StartContainer(ctx, id); err != nil {
+		return 0, err
+	}
+
+	container, err := c.client.LoadContainer(nsCtx, id)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to load container")
+	}
+	task, err := container.Task(nsCtx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get task")
+	}
+
+	timeout := DefaultInitTimeout
+	if initContainer.Timeout > 0 {
+		timeout = time.Duration(initContainer.Timeout) * time.Second
+	}
+	waitCtx, cancel := context.WithTimeout(nsCtx, timeout)
+	defer cancel()
+	exitCh, err := task.Wait(waitCtx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to wait for task")
+	}
+
+	select {
+	case status := <-exitCh:
+		code, _, err := status.Result()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get exit status")
+		}
+		return code, nil
+	case <-waitCtx.Done():
+		return 0, fmt.Errorf("did not finish within %s", timeout)
+	}
+}
+
+// removeInitContainer deletes an init container and its task, which has usually
+// exited already and can't be killed as RemoveContainer does
+func (c *Client) removeInitContainer(ctx context.Context, id string) error {
+	nsCtx := c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(nsCtx, id)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	if task, err := container.Task(nsCtx, nil); err == nil {
+		if _, err := task.Delete(nsCtx, containerd.WithProcessKill); err != nil {
+			return errors.Wrap(err, "failed to delete task")
+		}
+	}
+	return c.RemoveContainer(ctx, id, false)
+}
@@ -0,0 +1,334 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// IPAMStore persists networks and their IP allocations so static and dynamic
+// addresses don't conflict across container and daemon restarts
+// The daemon and CLI commands share the file, changes are made under a file
+// lock on the state just read from it.
+type IPAMStore struct {
+	path     string
+	mutex    sync.Mutex
+	Networks map[string]*IPAMNetwork `json:"networks"`
+}
+
+// IPAMNetwork describes a user-defined network and its allocations
+type IPAMNetwork struct {
+	Name    string `json:"name"`
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Allocations maps an IP address to the container that owns it
+	Allocations map[string]string `json:"allocations"`
+}
+
+// NewIPAMStore loads the IPAM store at path, creating an empty one if needed
+func NewIPAMStore(path string) (*IPAMStore, error) {
+	store := &IPAMStore{
+		path:     path,
+		Networks: make(map[string]*IPAMNetwork),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the store from disk, an absent file is an empty store; the
+// caller must hold the mutex
+func (s *IPAMStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.Networks = make(map[string]*IPAMNetwork)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read IPAM store")
+	}
+
+	var loaded IPAMStore
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return errors.Wrap(err, "failed to parse IPAM store")
+	}
+	s.Networks = loaded.Networks
+	if s.Networks == nil {
+		s.Networks = make(map[string]*IPAMNetwork)
+	}
+	return nil
+}
+
+// lock takes the mutex and the file lock shared with other fun processes and
+// reloads the store, returning the function that releases both
+func (s *IPAMStore) lock() (func(), error) {
+	s.mutex.Lock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		s.mutex.Unlock()
+		return nil, errors.Wrap(err, "failed to create IPAM directory")
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, errors.Wrap(err, "failed to open IPAM lock")
+	}
+	unlock := func() {
+		unlockFile(f)
+		f.Close()
+		s.mutex.Unlock()
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		s.mutex.Unlock()
+		return nil, errors.Wrap(err, "failed to lock IPAM store")
+	}
+	if err := s.load(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// save writes the store to disk atomically; the caller must hold the lock
+func (s *IPAMStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create IPAM directory")
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal IPAM store")
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write IPAM store")
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// CreateNetwork registers a network with the given subnet and optional gateway
+func (s *IPAMStore) CreateNetwork(name, subnet, gateway string) (*IPAMNetwork, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, exists := s.Networks[name]; exists {
+		return nil, fmt.Errorf("network %s already exists", name)
+	}
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
+	}
+
+	// Overlapping subnets would make routing on the host ambiguous
+	for _, other := range s.Networks {
+		_, otherNet, err := net.ParseCIDR(other.Subnet)
+		if err != nil {
+			continue
+		}
+		if ipnet.Contains(otherNet.IP) || otherNet.Contains(ipnet.IP) {
+			return nil, fmt.Errorf("subnet %s overlaps with network %s (%s)", subnet, other.Name, other.Subnet)
+		}
+	}
+
+	if gateway == "" {
+		gateway = nextIP(ipnet.IP).String()
+	} else if ip := net.ParseIP(gateway); ip == nil || !ipnet.Contains(ip) {
+		return nil, fmt.Errorf("gateway %s is not in subnet %s", gateway, subnet)
+	}
+
+	network := &IPAMNetwork{
+		Name:        name,
+		Subnet:      ipnet.String(),
+		Gateway:     gateway,
+		Allocations: make(map[string]string),
+	}
+	s.Networks[name] = network
+
+	if err := s.save(); err != nil {
+		delete(s.Networks, name)
+		return nil, err
+	}
+
+	return network, nil
+}
+
+// RemoveNetwork removes a network that has no remaining allocations
+func (s *IPAMStore) RemoveNetwork(name string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	network, ok := s.Networks[name]
+	if !ok {
+		return fmt.Errorf("network %s not found", name)
+	}
+	if len(network.Allocations) > 0 {
+		return fmt.Errorf("network %s still has %d containers attached", name, len(network.Allocations))
+	}
+
+	delete(s.Networks, name)
+	return s.save()
+}
+
+// GetNetwork returns a copy of the named network
+func (s *IPAMStore) GetNetwork(name string) (IPAMNetwork, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Other processes may have changed it, the last state is kept if it can't be read
+	s.load()
+
+	network, ok := s.Networks[name]
+	if !ok {
+		return IPAMNetwork{}, false
+	}
+	return *network, true
+}
+
+// AddressOf returns the address allocated to a container on a network
+func (s *IPAMStore) AddressOf(networkName, containerID string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load()
+
+	if network, ok := s.Networks[networkName]; ok {
+		for ip, owner := range network.Allocations {
+			if owner == containerID {
+				return ip, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ListNetworks returns all networks sorted by name
+func (s *IPAMStore) ListNetworks() []IPAMNetwork {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Other processes may have changed it, the last state is kept if it can't be read
+	s.load()
+
+	var result []IPAMNetwork
+	for _, network := range s.Networks {
+		result = append(result, *network)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Allocate reserves an IP address on a network for a container
+// If requested is empty the next free address in the subnet is used
+func (s *IPAMStore) Allocate(networkName, containerID, requested string) (string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	network, ok := s.Networks[networkName]
+	if !ok {
+		return "", fmt.Errorf("network %s not found", networkName)
+	}
+
+	// A container keeps its address if it is re-created with the same ID
+	for ip, owner := range network.Allocations {
+		if owner == containerID && (requested == "" || requested == ip) {
+			return ip, nil
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid network subnet")
+	}
+
+	if requested != "" {
+		ip := net.ParseIP(requested)
+		if ip == nil || !ipnet.Contains(ip) {
+			return "", fmt.Errorf("IP %s is not in subnet %s", requested, network.Subnet)
+		}
+		if ip.String() == network.Gateway {
+			return "", fmt.Errorf("IP %s is the network gateway", requested)
+		}
+		if owner, taken := network.Allocations[ip.String()]; taken {
+			return "", fmt.Errorf("IP %s is already assigned to container %s", requested, owner)
+		}
+		network.Allocations[ip.String()] = containerID
+		return ip.String(), s.save()
+	}
+
+	broadcast := broadcastIP(ipnet)
+	for ip := nextIP(ipnet.IP); ipnet.Contains(ip) && !ip.Equal(broadcast); ip = nextIP(ip) {
+		addr := ip.String()
+		if addr == network.Gateway {
+			continue
+		}
+		if _, taken := network.Allocations[addr]; taken {
+			continue
+		}
+		network.Allocations[addr] = containerID
+		return addr, s.save()
+	}
+
+	return "", fmt.Errorf("no free addresses left in network %s", networkName)
+}
+
+// Release frees all addresses held by a container
+func (s *IPAMStore) Release(containerID string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	changed := false
+	for _, network := range s.Networks {
+		for ip, owner := range network.Allocations {
+			if owner == containerID {
+				delete(network.Allocations, ip)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// nextIP returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// broadcastIP returns the last address of a subnet
+func broadcastIP(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.IP))
+	for i := range ipnet.IP {
+		ip[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	return ip
+}
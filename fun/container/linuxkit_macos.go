@@ -64,7 +64,7 @@ onboot:
 
 onshutdown:
   - name: shutdown
-    image: busybox:latest
+    image: busybox:1.36.1@sha256:9ae97d36d26566ff84e8893c64a6dc4fe8ca6d1144bf5b87b2b85a32def253c7
     command: ["/bin/echo", "peace out"]
 
 services:
@@ -74,6 +74,12 @@ services:
       - INSECURE=true
   - name: rngd
     image: linuxkit/rngd:1a18f2149e42a0a1cb9e7d37608a494342c26032
+  - name: ntpd
+    image: busybox:1.36.1@sha256:9ae97d36d26566ff84e8893c64a6dc4fe8ca6d1144bf5b87b2b85a32def253c7
+    command: ["/bin/ntpd", "-n", "-p", "pool.ntp.org"]
+    net: host
+    capabilities:
+      - CAP_SYS_TIME
   - name: nginx
     image: nginx:1.19.5-alpine
     capabilities:
@@ -0,0 +1,179 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logWriter writes a container's output to its log file, rotating the file at
+// its maximum size and holding back or dropping output beyond its rate
+type logWriter struct {
+	path   string
+	limits LogLimits
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+
+	// tokens is the output the rate allows right now, refilled up to one second worth
+	tokens  float64
+	refill  time.Time
+	limited bool
+	// dropped counts the bytes dropped since the rate was exceeded, total all of them
+	dropped int64
+	total   int64
+}
+
+// newLogWriter opens the log file at path, appending to it
+func newLogWriter(path string, limits LogLimits) (*logWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return &logWriter{
+		path:   path,
+		limits: limits,
+		file:   file,
+		size:   info.Size(),
+		tokens: float64(limits.Rate),
+		refill: time.Now(),
+	}, nil
+}
+
+// Write logs p, blocking or dropping it while the output exceeds the rate.
+// It never fails so the container's output keeps being read, a failed write
+// is retried on the next one after reopening the file.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.limits.Rate > 0 {
+		w.refillTokens()
+		switch {
+		case w.limits.Mode == LogModeDrop && w.tokens < float64(len(p)):
+			if !w.limited {
+				w.limited = true
+				w.note("output exceeds %d bytes/s, dropping it", w.limits.Rate)
+			}
+			w.dropped += int64(len(p))
+			w.total += int64(len(p))
+			return len(p), nil
+		case w.limits.Mode != LogModeDrop:
+			w.tokens -= float64(len(p))
+			if w.tokens < 0 {
+				if !w.limited {
+					w.limited = true
+					w.note("output exceeds %d bytes/s, throttling it", w.limits.Rate)
+				}
+				// Not reading the pipe meanwhile blocks the container's writes once it is full
+				time.Sleep(time.Duration(-w.tokens / float64(w.limits.Rate) * float64(time.Second)))
+				w.tokens = 0
+				w.refill = time.Now()
+			}
+		default:
+			w.tokens -= float64(len(p))
+		}
+	}
+
+	w.write(p)
+	return len(p), nil
+}
+
+// refillTokens adds the output allowed since the last refill, reporting when a
+// throttled container stayed under its rate for a second
+func (w *logWriter) refillTokens() {
+	now := time.Now()
+	w.tokens += now.Sub(w.refill).Seconds() * float64(w.limits.Rate)
+	w.refill = now
+	if w.tokens < float64(w.limits.Rate) {
+		return
+	}
+	w.tokens = float64(w.limits.Rate)
+	if w.limited {
+		w.limited = false
+		if w.dropped > 0 {
+			w.note("output back under %d bytes/s, dropped %d bytes (%d in total)", w.limits.Rate, w.dropped, w.total)
+		} else {
+			w.note("output back under %d bytes/s", w.limits.Rate)
+		}
+		w.dropped = 0
+	}
+}
+
+// note records an event of the log driver in the log itself, where it is seen
+// next to the output it concerns
+func (w *logWriter) note(format string, args ...interface{}) {
+	w.write([]byte(fmt.Sprintf("[fun %s] "+format+"\n", append([]interface{}{time.Now().UTC().Format(time.RFC3339)}, args...)...)))
+}
+
+// write appends p to the log file, rotating it first if p doesn't fit
+func (w *logWriter) write(p []byte) {
+	if w.limits.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.limits.MaxSize {
+		w.rotate()
+	}
+	if w.file == nil {
+		if err := w.reopen(os.O_APPEND); err != nil {
+			return
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// rotate shifts the rotated files by one, dropping the oldest, and starts a new file
+func (w *logWriter) rotate() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	if w.limits.MaxFiles > 0 {
+		os.Remove(w.path + "." + strconv.Itoa(w.limits.MaxFiles))
+		for i := w.limits.MaxFiles - 1; i >= 1; i-- {
+			os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	}
+	w.reopen(os.O_TRUNC)
+}
+
+// reopen opens the log file again with flag, either os.O_APPEND or os.O_TRUNC
+func (w *logWriter) reopen(flag int) error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+	if flag == os.O_APPEND {
+		if info, err := file.Stat(); err == nil {
+			w.size = info.Size()
+		}
+	}
+	return nil
+}
+
+// Close reports the output dropped since the rate was last exceeded and closes the file
+func (w *logWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.dropped > 0 {
+		w.note("dropped %d bytes of output (%d in total)", w.dropped, w.total)
+	}
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
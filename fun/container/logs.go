@@ -0,0 +1,241 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/pkg/cio"
+)
+
+// LabelLogOptions stores the log options a container was created with, on top
+// of the client's defaults, as key=value pairs separated by commas
+const LabelLogOptions = "fun.log-opts"
+
+// What happens to output beyond a container's log rate
+const (
+	// LogModeBlock stops reading the container's output until the rate allows
+	// it, so its writes block once the pipe is full
+	LogModeBlock = "block"
+	// LogModeDrop discards the output and counts the dropped bytes
+	LogModeDrop = "drop"
+)
+
+// LogLimits bounds the log file of a container
+type LogLimits struct {
+	// MaxSize is the size a log file grows to before it is rotated, 0 never rotates
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept next to the current one, with
+	// 0 the file is emptied when it is rotated
+	MaxFiles int
+	// Rate is the output in bytes per second a container may log, 0 doesn't limit it
+	Rate int64
+	// Mode is LogModeBlock or LogModeDrop
+	Mode string
+}
+
+// SetLogDefaults sets the log limits of containers created without their own
+func (c *Client) SetLogDefaults(limits LogLimits) {
+	c.mu.Lock()
+	c.logDefaults = limits
+	c.mu.Unlock()
+}
+
+// ParseLogOptions applies log options such as max-size=10m, max-file=3,
+// rate=1m or mode=drop on top of defaults
+func ParseLogOptions(options map[string]string, defaults LogLimits) (LogLimits, error) {
+	limits := defaults
+	for key, value := range options {
+		var err error
+		switch key {
+		case "max-size":
+			limits.MaxSize, err = ParseByteSize(value)
+		case "max-file":
+			limits.MaxFiles, err = strconv.Atoi(value)
+			if err == nil && limits.MaxFiles < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "rate":
+			limits.Rate, err = ParseByteSize(value)
+		case "mode":
+			if value != LogModeBlock && value != LogModeDrop {
+				err = fmt.Errorf("expected %s or %s", LogModeBlock, LogModeDrop)
+			}
+			limits.Mode = value
+		default:
+			return limits, fmt.Errorf("unknown log option %q", key)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("invalid log option %s=%s: %w", key, value, err)
+		}
+	}
+	if limits.Mode == "" {
+		limits.Mode = LogModeBlock
+	}
+	return limits, nil
+}
+
+// ParseLogOptionFlags parses --log-opt values of the form key=value
+func ParseLogOptionFlags(values []string) (map[string]string, error) {
+	options := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid log option %q, expected key=value", value)
+		}
+		options[key] = val
+	}
+	return options, nil
+}
+
+// logOptionsLabel encodes log options for LabelLogOptions
+func logOptionsLabel(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+options[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// containerLogLimits returns the log limits of a container from its labels
+func (c *Client) containerLogLimits(labels map[string]string) (LogLimits, error) {
+	c.mu.RLock()
+	defaults := c.logDefaults
+	c.mu.RUnlock()
+
+	options := map[string]string{}
+	if label := labels[LabelLogOptions]; label != "" {
+		for _, pair := range strings.Split(label, ",") {
+			key, value, _ := strings.Cut(pair, "=")
+			options[key] = value
+		}
+	}
+	return ParseLogOptions(options, defaults)
+}
+
+// containerLogPath returns the log file of a container in its state
+// directory, so it is removed along with the container; rotated files are kept
+// next to it with the suffixes .1 (newest) to .N
+func (c *Client) containerLogPath(containerID string) string {
+	return filepath.Join(c.containerStateDir(containerID), "container.log")
+}
+
+// rotatedLogPaths returns the rotated log files of a container, oldest first
+func rotatedLogPaths(logPath string) []string {
+	var paths []string
+	for i := 1; ; i++ {
+		path := logPath + "." + strconv.Itoa(i)
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		paths = append([]string{path}, paths...)
+	}
+	return paths
+}
+
+// logCreator returns how the output of a container's task is logged. On Linux
+// the shim hands it to this binary running as a containerd logging binary, so
+// logging outlives the process that started the container and the limits are
+// enforced as it is written. Elsewhere the shim runs in a VM without access to
+// this binary, the output goes to the caller's stdio.
+func (c *Client) logCreator(containerID string, limits LogLimits) (cio.Creator, error) {
+	logPath := c.containerLogPath(containerID)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	if runtime.GOOS != "linux" {
+		// The log file is listed even though nothing is written to it
+		if file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			file.Close()
+		}
+		return cio.NewCreator(cio.WithStdio), nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the logging binary: %w", err)
+	}
+	options := url.Values{}
+	options.Set("path", logPath)
+	options.Set("max-size", strconv.FormatInt(limits.MaxSize, 10))
+	options.Set("max-file", strconv.Itoa(limits.MaxFiles))
+	options.Set("rate", strconv.FormatInt(limits.Rate, 10))
+	options.Set("mode", limits.Mode)
+	// The shim passes the query as unordered arguments, a single pair keeps them in order
+	return cio.BinaryIO(executable, map[string]string{"log-driver": options.Encode()}), nil
+}
+
+// RunLogDriver is run by the containerd shim as the logging binary of a
+// container, with the options logCreator encoded. It copies the container's
+// stdout and stderr, passed as file descriptors 3 and 4, into its log file
+// until the container closes them.
+func RunLogDriver(encoded string) error {
+	options, err := url.ParseQuery(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid log driver options: %w", err)
+	}
+	path := options.Get("path")
+	if path == "" {
+		return fmt.Errorf("log driver options lack a path")
+	}
+	options.Del("path")
+	flat := make(map[string]string, len(options))
+	for key := range options {
+		flat[key] = options.Get(key)
+	}
+	limits, err := ParseLogOptions(flat, LogLimits{})
+	if err != nil {
+		return err
+	}
+
+	writer, err := newLogWriter(path, limits)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	stdout := os.NewFile(3, "stdout")
+	stderr := os.NewFile(4, "stderr")
+	// Closing the last descriptor tells the shim the driver is ready
+	if ready := os.NewFile(5, "ready"); ready != nil {
+		ready.Close()
+	}
+
+	var wg sync.WaitGroup
+	for _, stream := range []*os.File{stdout, stderr} {
+		wg.Add(1)
+		go func(stream *os.File) {
+			defer wg.Done()
+			copyLogLines(writer, stream)
+		}(stream)
+	}
+	wg.Wait()
+	return nil
+}
+
+// copyLogLines copies stream into writer a line at a time, so the lines of
+// stdout and stderr don't interleave. Lines longer than the buffer are split.
+func copyLogLines(writer io.Writer, stream io.Reader) {
+	reader := bufio.NewReaderSize(stream, 64<<10)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			writer.Write(line)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,14 +30,80 @@ type ManagerConfig struct {
 	// Client configuration
 	ClientSocket string
 	Namespace    string
+	// NewClient connects the primary client to a socket, nil uses NewClient with
+	// Namespace. The daemon passes its own to configure the client like the CLI's.
+	NewClient func(socket string) (*Client, error)
+
+	// Connections are additional containerd sockets by name, such as the system
+	// containerd of a Kubernetes node next to the embedded one
+	Connections map[string]string
+
+	// ClockSyncInterval is how often the clock of a VM backend is compared with the
+	// host's and corrected, zero disables it
+	ClockSyncInterval time.Duration
+	// DiskTrimInterval is how often the WSL2 distribution's disk is trimmed, which
+	// releases the host space of deleted images and containers. Zero disables it.
+	DiskTrimInterval time.Duration
 }
 
+// Connection names, the primary connection is named after where its containerd runs
+const (
+	ConnectionEmbedded = "embedded"
+	ConnectionSystem   = "system"
+	ConnectionWSL      = "wsl"
+)
+
+// ConnectionStatus describes one of the containerd connections of a manager
+type ConnectionStatus struct {
+	Name      string `json:"name"`
+	Socket    string `json:"socket"`
+	Primary   bool   `json:"primary"`
+	Connected bool   `json:"connected"`
+	Version   string `json:"version,omitempty"`
+}
+
+// targetKey is the context key of the connection an operation targets
+type targetKey struct{}
+
+// WithTarget makes the Manager operations run with ctx use the named connection
+// instead of the primary one
+func WithTarget(ctx context.Context, connection string) context.Context {
+	return context.WithValue(ctx, targetKey{}, connection)
+}
+
+// ErrManagerNotRunning is returned for operations while the manager is stopped or stopping
+var ErrManagerNotRunning = errors.New("container manager is not running")
+
+// managerState is the lifecycle state of a Manager
+type managerState int
+
+const (
+	managerStopped managerState = iota
+	managerRunning
+	managerStopping
+)
+
+// forcedDrainTimeout bounds how long Stop waits for operations after cancelling them
+const forcedDrainTimeout = 10 * time.Second
+
 // Manager manages containerd server and client operations
 type Manager struct {
 	config      ManagerConfig
 	server      *Server
 	client      *Client
 	useEmbedded bool
+	// connections are the clients of the additional sockets, by name
+	connections map[string]*Client
+
+	// mutex guards the lifecycle fields below as well as server and client
+	mutex  sync.RWMutex
+	state  managerState
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// operations tracks in-flight client calls so Stop can drain them
+	operations sync.WaitGroup
+	active     int64
 }
 
 // DefaultManagerConfig returns default manager configuration
@@ -64,6 +134,9 @@ func DefaultManagerConfig() ManagerConfig {
 		ServerConfig: DefaultServerConfig(),
 		ClientSocket: defaultSocket,
 		Namespace:    "fun",
+		// Hosts that sleep resume with the VM's clock behind
+		ClockSyncInterval: time.Minute,
+		DiskTrimInterval:  time.Hour,
 	}
 }
 
@@ -84,11 +157,67 @@ func NewManager(config ManagerConfig) *Manager {
 	return &Manager{
 		config:      config,
 		useEmbedded: config.RunAs == "server" || config.RunAs == "both",
+		connections: make(map[string]*Client),
+	}
+}
+
+// PrimaryConnection returns the name of the connection operations use by default
+func (m *Manager) PrimaryConnection() string {
+	if m.config.RunAs == "both" {
+		if IsRunningOnWindows() && DefaultWSL2Config().Enabled {
+			return ConnectionWSL
+		}
+		return ConnectionEmbedded
 	}
+	return ConnectionSystem
 }
 
 // Start starts the container manager
 func (m *Manager) Start(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.state != managerStopped {
+		return errors.New("container manager is already running")
+	}
+
+	if err := m.startBackend(ctx); err != nil {
+		return err
+	}
+
+	// Additional sockets are optional, e.g. a Kubernetes node's containerd may still be starting
+	for name, socket := range m.config.Connections {
+		client, err := NewClient(socket, m.config.Namespace)
+		if err != nil {
+			log.Printf("Warning: Failed to connect to the %s containerd at %s: %v", name, socket, err)
+			continue
+		}
+		m.connections[name] = client
+	}
+
+	// Operations are cancelled through this context if Stop's drain times out
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.state = managerRunning
+
+	if m.config.ClockSyncInterval > 0 && m.usesVMBackend() {
+		go m.syncClock(m.ctx)
+	}
+	if m.config.DiskTrimInterval > 0 && m.usesVMBackend() && IsRunningOnWindows() {
+		go m.trimDisk(m.ctx)
+	}
+
+	return nil
+}
+
+// usesVMBackend reports whether the manager runs containerd in the LinuxKit VM or
+// WSL and uses it itself
+func (m *Manager) usesVMBackend() bool {
+	return m.config.RunAs == "both" && (IsRunningOnMacOS() || (IsRunningOnWindows() && DefaultWSL2Config().Enabled))
+}
+
+// startBackend starts the embedded server and connects the primary client as
+// configured. The caller must hold the mutex.
+func (m *Manager) startBackend(ctx context.Context) error {
 	// Start the server if configured to do so
 	if m.config.RunAs == "server" || m.config.RunAs == "both" {
 		// Make sure containerd is installed
@@ -115,7 +244,7 @@ func (m *Manager) Start(ctx context.Context) error {
 			return fmt.Errorf("no containerd instance available at %s", m.config.ClientSocket)
 		}
 
-		client, err := NewClient(m.config.ClientSocket, m.config.Namespace)
+		client, err := m.newClient(m.config.ClientSocket)
 		if err != nil {
 			// If we started the server, stop it on client error
 			if m.server != nil {
@@ -126,12 +255,53 @@ func (m *Manager) Start(ctx context.Context) error {
 		}
 		m.client = client
 	}
-
 	return nil
 }
 
+// newClient connects a primary client to socket
+func (m *Manager) newClient(socket string) (*Client, error) {
+	if m.config.NewClient != nil {
+		return m.config.NewClient(socket)
+	}
+	return NewClient(socket, m.config.Namespace)
+}
+
 // Stop stops the container manager
+// New operations are refused right away, and in-flight operations are given until
+// ctx is done to finish. After that they are cancelled so Stop can't hang forever.
 func (m *Manager) Stop(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.state != managerRunning {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.state = managerStopping
+	m.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.operations.Wait()
+		close(drained)
+	}()
+
+	// Operations that ignore the cancellation fail once their client is closed,
+	// the manager is stopped either way so it can be started again
+	var drainErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		m.cancel()
+		select {
+		case <-drained:
+		case <-time.After(forcedDrainTimeout):
+			drainErr = fmt.Errorf("timed out waiting for %d container operations to finish", m.ActiveOperations())
+		}
+	}
+	m.cancel()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	var clientErr, serverErr error
 
 	// Stop the client if it exists
@@ -139,14 +309,23 @@ func (m *Manager) Stop(ctx context.Context) error {
 		clientErr = m.client.Close()
 		m.client = nil
 	}
+	for name, client := range m.connections {
+		client.Close()
+		delete(m.connections, name)
+	}
 
 	// Stop the server if it exists
 	if m.server != nil {
-		serverErr = m.server.Stop(ctx)
+		serverErr = m.server.Stop(context.Background())
 		m.server = nil
 	}
 
+	m.state = managerStopped
+
 	// Return first error encountered
+	if drainErr != nil {
+		return drainErr
+	}
 	if clientErr != nil {
 		return errors.Wrap(clientErr, "failed to close containerd client")
 	}
@@ -157,13 +336,225 @@ func (m *Manager) Stop(ctx context.Context) error {
 	return nil
 }
 
+// UpgradeContainerd re-extracts the bundled binaries this release ships in a newer
+// version and restarts the embedded containerd on them. New operations are refused
+// and in-flight ones are given until ctx is done to finish, then containerd is
+// restarted while the containers keep running in their shims.
+func (m *Manager) UpgradeContainerd(ctx context.Context) ([]BundleUpgrade, error) {
+	upgrades := PendingBundleUpgrades()
+	if len(upgrades) == 0 {
+		return nil, nil
+	}
+	// The job object supervising containerd on Windows also ends the shims
+	if runtime.GOOS == "windows" {
+		return upgrades, errors.New("upgrades are applied when the service is restarted on Windows")
+	}
+
+	m.mutex.Lock()
+	if m.state != managerRunning || m.server == nil {
+		m.mutex.Unlock()
+		return upgrades, errors.New("only the embedded containerd server can be upgraded")
+	}
+	m.state = managerStopping
+	m.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.operations.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		m.mutex.Lock()
+		m.state = managerRunning
+		m.mutex.Unlock()
+		return upgrades, fmt.Errorf("timed out waiting for %d container operations to finish", m.ActiveOperations())
+	}
+
+	// On failure the manager stays running, so Stop still cleans up
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state = managerRunning
+
+	// The running binaries are replaced on disk, so a failure here leaves containerd as it was
+	if err := EnsureAllBundledComponentsExtracted(); err != nil {
+		return upgrades, errors.Wrap(err, "failed to extract upgraded binaries")
+	}
+
+	// The clients reconnect once containerd is back, so whoever holds one, such
+	// as the daemon, keeps using it. containerd is started with the context, it
+	// must outlive the drain deadline.
+	if err := m.server.Restart(context.WithoutCancel(ctx)); err != nil {
+		return upgrades, errors.Wrap(err, "failed to restart containerd")
+	}
+	log.Printf("Restarted containerd on the upgraded bundled binaries")
+	return upgrades, nil
+}
+
+// syncClock corrects the clock of the VM backend when it drifted, until ctx is done
+func (m *Manager) syncClock(ctx context.Context) {
+	ticker := time.NewTicker(m.config.ClockSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.checkClock(ctx)
+	}
+}
+
+// trimDisk trims the disk of the WSL2 distribution periodically, until ctx is done
+func (m *Manager) trimDisk(ctx context.Context) {
+	ticker := time.NewTicker(m.config.DiskTrimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mutex.RLock()
+		server := m.server
+		m.mutex.RUnlock()
+		if server == nil || !server.usesWSL() {
+			continue
+		}
+		if err := TrimWSLDisk(ctx, DefaultWSL2Config()); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// checkClock compares the clock of the VM backend with the host's
+func (m *Manager) checkClock(ctx context.Context) {
+	client := m.GetClient()
+	if client == nil {
+		return
+	}
+	offset, err := client.ClockOffset(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to compare the VM clock with the host: %v", err)
+		return
+	}
+	if offset.Abs() < MaxClockDrift {
+		return
+	}
+
+	if IsRunningOnWindows() {
+		if err := SyncWSLClock(ctx, DefaultWSL2Config()); err != nil {
+			log.Printf("Warning: %v", err)
+			return
+		}
+		log.Printf("Corrected the WSL clock, which was off by %s", offset.Round(time.Millisecond))
+		return
+	}
+	// The LinuxKit VM runs ntpd, which corrects the clock once it reaches a server
+	log.Printf("Warning: The VM clock is off by %s", offset.Round(time.Millisecond))
+}
+
+// ActiveOperations returns the number of client operations in progress
+func (m *Manager) ActiveOperations() int {
+	return int(atomic.LoadInt64(&m.active))
+}
+
+// Done returns a channel that is closed when the manager stops, for background
+// work started on behalf of the manager
+func (m *Manager) Done() <-chan struct{} {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.ctx == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return m.ctx.Done()
+}
+
+// beginOperation registers an in-flight operation and returns the client with a
+// context that is also cancelled when the manager is forced to stop. The returned
+// function must be called when the operation completes.
+func (m *Manager) beginOperation(ctx context.Context) (context.Context, *Client, func(), error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.state != managerRunning {
+		return nil, nil, nil, ErrManagerNotRunning
+	}
+	client := m.client
+	if target, ok := ctx.Value(targetKey{}).(string); ok && target != "" && target != m.PrimaryConnection() {
+		if _, configured := m.config.Connections[target]; !configured {
+			return nil, nil, nil, fmt.Errorf("unknown containerd connection %q", target)
+		}
+		if client = m.connections[target]; client == nil {
+			return nil, nil, nil, fmt.Errorf("not connected to the %s containerd", target)
+		}
+	}
+	if client == nil {
+		return nil, nil, nil, errors.New("containerd client not initialized")
+	}
+
+	m.operations.Add(1)
+	atomic.AddInt64(&m.active, 1)
+
+	opCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(m.ctx, cancel)
+
+	done := func() {
+		stop()
+		cancel()
+		atomic.AddInt64(&m.active, -1)
+		m.operations.Done()
+	}
+	return opCtx, client, done, nil
+}
+
+// Connections returns the status of the primary and additional containerd connections
+func (m *Manager) Connections(ctx context.Context) []ConnectionStatus {
+	m.mutex.RLock()
+	clients := map[string]*Client{m.PrimaryConnection(): m.client}
+	sockets := map[string]string{m.PrimaryConnection(): m.config.ClientSocket}
+	for name, socket := range m.config.Connections {
+		clients[name] = m.connections[name]
+		sockets[name] = socket
+	}
+	m.mutex.RUnlock()
+
+	var statuses []ConnectionStatus
+	for name, socket := range sockets {
+		status := ConnectionStatus{Name: name, Socket: socket, Primary: name == m.PrimaryConnection()}
+		if client := clients[name]; client != nil && client.Ping(ctx) == nil {
+			status.Connected = true
+			status.Version = client.Capabilities().Version
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Primary != statuses[j].Primary {
+			return statuses[i].Primary
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
 // GetClient returns the containerd client
+// Calls made directly on the client are not tracked, prefer the Manager methods
 func (m *Manager) GetClient() *Client {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.client
 }
 
 // GetServer returns the containerd server
 func (m *Manager) GetServer() *Server {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.server
 }
 
@@ -174,6 +565,9 @@ func (m *Manager) IsUsingEmbeddedServer() bool {
 
 // IsServerRunning returns whether the containerd server is running
 func (m *Manager) IsServerRunning() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	if m.server == nil {
 		return false
 	}
@@ -182,6 +576,9 @@ func (m *Manager) IsServerRunning() bool {
 
 // GetServiceStatus returns the status of the containerd service
 func (m *Manager) GetServiceStatus() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	if m.server != nil && m.server.IsRunning() {
 		return "Embedded server running"
 	}
@@ -200,15 +597,17 @@ func (m *Manager) GetServiceStatus() string {
 
 // GetContainerdVersion returns the version of containerd being used
 func (m *Manager) GetContainerdVersion() (string, error) {
-	if m.client == nil {
-		return "", errors.New("client not initialized")
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	ctx, client, done, err := m.beginOperation(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
 	// Use the client's raw API to get version
-	version, err := m.client.GetContainerdClient().Version(ctx)
+	version, err := client.GetContainerdClient().Version(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -216,13 +615,33 @@ func (m *Manager) GetContainerdVersion() (string, error) {
 	return version.Version, nil
 }
 
+// GetCRIEndpoint returns the CRI endpoint for kubelets such as k3s, an error if
+// containerd didn't load its CRI plugin
+// Only the embedded server is managed by us, so external containerd is reported as-is
+func (m *Manager) GetCRIEndpoint() (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.client == nil {
+		return "", errors.New("containerd client not initialized")
+	}
+	if err := m.client.RequireCRI(); err != nil {
+		return "", err
+	}
+	if m.server != nil {
+		return m.server.GetCRIEndpoint()
+	}
+	return GetCRIEndpoint(m.config.ClientSocket), nil
+}
+
 // GetContainerdLogs gets the logs from the embedded containerd server
 func (m *Manager) GetContainerdLogs(writer io.Writer) error {
-	if m.server == nil {
+	server := m.GetServer()
+	if server == nil {
 		return errors.New("embedded server not running")
 	}
 
-	logPath := m.server.GetLogFilePath()
+	logPath := server.GetLogFilePath()
 	logFile, err := os.Open(logPath)
 	if err != nil {
 		return errors.Wrap(err, "failed to open containerd log file")
@@ -235,32 +654,40 @@ func (m *Manager) GetContainerdLogs(writer io.Writer) error {
 
 // CreateContainer creates a new container using the client
 func (m *Manager) CreateContainer(ctx context.Context, opts CreateContainerOptions) (*Container, error) {
-	if m.client == nil {
-		return nil, errors.New("containerd client not initialized")
+	ctx, client, done, err := m.beginOperation(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return m.client.CreateContainer(ctx, opts)
+	defer done()
+	return client.CreateContainer(ctx, opts)
 }
 
 // StartContainer starts a container using the client
 func (m *Manager) StartContainer(ctx context.Context, containerID string) error {
-	if m.client == nil {
-		return errors.New("containerd client not initialized")
+	ctx, client, done, err := m.beginOperation(ctx)
+	if err != nil {
+		return err
 	}
-	return m.client.StartContainer(ctx, containerID)
+	defer done()
+	return client.StartContainer(ctx, containerID)
 }
 
 // StopContainer stops a container using the client
 func (m *Manager) StopContainer(ctx context.Context, containerID string, timeout int) error {
-	if m.client == nil {
-		return errors.New("containerd client not initialized")
+	ctx, client, done, err := m.beginOperation(ctx)
+	if err != nil {
+		return err
 	}
-	return m.client.StopContainer(ctx, containerID, time.Duration(timeout)*time.Second)
+	defer done()
+	return client.StopContainer(ctx, containerID, time.Duration(timeout)*time.Second)
 }
 
 // RemoveContainer removes a container using the client
 func (m *Manager) RemoveContainer(ctx context.Context, containerID string, force bool) error {
-	if m.client == nil {
-		return errors.New("containerd client not initialized")
+	ctx, client, done, err := m.beginOperation(ctx)
+	if err != nil {
+		return err
 	}
-	return m.client.RemoveContainer(ctx, containerID, force)
+	defer done()
+	return client.RemoveContainer(ctx, containerID, force)
 }
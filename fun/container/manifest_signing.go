@@ -0,0 +1,352 @@
+package container
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/audit"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestSignatureSuffix names the detached signature next to a manifest file,
+// e.g. desired-state.json.sig as written by cosign sign-blob
+const ManifestSignatureSuffix = ".sig"
+
+// MaxCommandLifetime bounds how long a signed command stays valid, the nonces
+// of executed commands are remembered until they expire
+const MaxCommandLifetime = 24 * time.Hour
+
+// CommandEnvelope holds the fields of a signed orchestrator command that bind
+// it to a host, a project and a single use before it expires. The command
+// itself is decoded from the same signed document by the caller.
+type CommandEnvelope struct {
+	ID      string    `json:"id"`
+	Host    string    `json:"host"`
+	Project string    `json:"project,omitempty"`
+	Nonce   string    `json:"nonce"`
+	Expires time.Time `json:"expires"`
+}
+
+// DesiredStateEnvelope is the signed document of a desired state served by the
+// orchestrator. It binds the state to a host and a project until it expires,
+// and Issued orders the documents so an older one can't be replayed.
+type DesiredStateEnvelope struct {
+	Host    string          `json:"host"`
+	Project string          `json:"project,omitempty"`
+	Issued  time.Time       `json:"issued"`
+	Expires time.Time       `json:"expires"`
+	State   json.RawMessage `json:"state"`
+}
+
+// ManifestVerifier checks the detached signatures of desired-state manifests
+// Its keys are only read from the host's configuration, so an orchestrator
+// account alone can't replace them.
+type ManifestVerifier struct {
+	signers []TrustSigner
+}
+
+// ManifestSignatureError is returned when a manifest isn't signed by a trusted key
+type ManifestSignatureError struct {
+	Source string
+	Reason string
+}
+
+func (e *ManifestSignatureError) Error() string {
+	return fmt.Sprintf("manifest from %s rejected: %s", e.Source, e.Reason)
+}
+
+// LoadManifestVerifier reads the PEM encoded public keys manifests may be signed with
+func LoadManifestVerifier(paths []string) (*ManifestVerifier, error) {
+	verifier := &ManifestVerifier{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read manifest signing key")
+		}
+		if _, err := parsePublicKey(string(data)); err != nil {
+			return nil, fmt.Errorf("invalid manifest signing key %s: %w", path, err)
+		}
+		verifier.signers = append(verifier.signers, TrustSigner{
+			Name:      strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+			PublicKey: string(data),
+		})
+	}
+	return verifier, nil
+}
+
+// Verify checks that signature, base64 encoded, is a signature of manifest by
+// one of the keys. It returns the name of the signer.
+func (v *ManifestVerifier) Verify(manifest []byte, signature string) (string, error) {
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return "", errors.New("manifest is not signed")
+	}
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", errors.New("signature is not base64 encoded")
+	}
+	for _, signer := range v.signers {
+		if verifySignature(signer.PublicKey, manifest, raw) {
+			return signer.Name, nil
+		}
+	}
+	return "", errors.New("signature doesn't match any trusted key")
+}
+
+// SetManifestVerifier requires desired states from the cloud and Git and the
+// orchestrator's commands to be signed, nil accepts unsigned manifests.
+// noncePath keeps the nonces of the signed commands executed, issuedPath the
+// issue time of the last desired state from the cloud that was applied.
+func (c *Client) SetManifestVerifier(verifier *ManifestVerifier, noncePath, issuedPath string) {
+	c.mu.Lock()
+	c.manifestVerifier = verifier
+	c.commandNoncePath = noncePath
+	c.desiredStateIssuedPath = issuedPath
+	c.mu.Unlock()
+}
+
+// ManifestsSigned reports whether manifests must be signed
+func (c *Client) ManifestsSigned() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.manifestVerifier != nil
+}
+
+// VerifyCommand checks that signed, the document the orchestrator signed for
+// command id, has a valid signature, is meant for hostID, hasn't expired and
+// wasn't executed before. Its nonce is used up, so a command is only accepted
+// once. Rejections are recorded in the audit log.
+func (c *Client) VerifyCommand(source string, signed []byte, signature, id, hostID string) (CommandEnvelope, error) {
+	c.mu.RLock()
+	verifier := c.manifestVerifier
+	noncePath := c.commandNoncePath
+	c.mu.RUnlock()
+
+	var envelope CommandEnvelope
+	err := func() error {
+		if verifier == nil {
+			return errors.New("no manifest signing keys are configured")
+		}
+		if _, err := verifier.Verify(signed, signature); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(signed, &envelope); err != nil {
+			return errors.New("signed command is not valid JSON")
+		}
+		switch {
+		case envelope.ID != id:
+			return fmt.Errorf("signed command is %q", envelope.ID)
+		case envelope.Host != hostID:
+			return fmt.Errorf("command was signed for host %q", envelope.Host)
+		case envelope.Nonce == "":
+			return errors.New("signed command has no nonce")
+		case envelope.Expires.IsZero() || time.Now().After(envelope.Expires):
+			return errors.New("signed command expired")
+		case time.Until(envelope.Expires) > MaxCommandLifetime:
+			return fmt.Errorf("signed command expires after more than %s", MaxCommandLifetime)
+		}
+		return useCommandNonce(noncePath, envelope.Nonce, envelope.Expires)
+	}()
+	if err == nil {
+		return envelope, nil
+	}
+
+	rejected := &ManifestSignatureError{Source: source, Reason: err.Error()}
+	if auditErr := c.AuditLogger().Record(audit.Event{
+		Type:    audit.EventManifestRejected,
+		Subject: source,
+		Reason:  rejected.Reason,
+	}); auditErr != nil {
+		log.Printf("Warning: Failed to record command rejection in the audit log: %v", auditErr)
+	}
+	return envelope, rejected
+}
+
+// VerifyDesiredState checks that signed, the envelope the orchestrator signed
+// around a desired state, has a valid signature, is meant for hostID, hasn't
+// expired, wraps a state of the signed project and wasn't issued before the
+// last one applied. The document is served again on every change, so unlike a
+// command it can be verified more than once. Rejections are recorded in the
+// audit log.
+func (c *Client) VerifyDesiredState(source string, signed []byte, signature, hostID string) (DesiredStateEnvelope, error) {
+	c.mu.RLock()
+	verifier := c.manifestVerifier
+	issuedPath := c.desiredStateIssuedPath
+	c.mu.RUnlock()
+
+	var envelope DesiredStateEnvelope
+	err := func() error {
+		if verifier == nil {
+			return errors.New("no manifest signing keys are configured")
+		}
+		if _, err := verifier.Verify(signed, signature); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(signed, &envelope); err != nil {
+			return errors.New("signed desired state is not valid JSON")
+		}
+		var state struct {
+			Project string `json:"project"`
+		}
+		if err := json.Unmarshal(envelope.State, &state); err != nil {
+			return errors.New("signed desired state has no valid state")
+		}
+		switch {
+		case envelope.Host != hostID:
+			return fmt.Errorf("desired state was signed for host %q", envelope.Host)
+		case state.Project != envelope.Project:
+			return fmt.Errorf("desired state of project %q was signed for project %q", state.Project, envelope.Project)
+		case envelope.Issued.IsZero():
+			return errors.New("signed desired state has no issue time")
+		case envelope.Expires.IsZero() || time.Now().After(envelope.Expires):
+			return errors.New("signed desired state expired")
+		}
+		last, err := readDesiredStateIssued(issuedPath)
+		if err != nil {
+			return err
+		}
+		if envelope.Issued.Before(last) {
+			return fmt.Errorf("desired state was issued at %s, before the one applied at %s",
+				envelope.Issued.Format(time.RFC3339), last.Format(time.RFC3339))
+		}
+		return nil
+	}()
+	if err == nil {
+		return envelope, nil
+	}
+
+	rejected := &ManifestSignatureError{Source: source, Reason: err.Error()}
+	if auditErr := c.AuditLogger().Record(audit.Event{
+		Type:    audit.EventManifestRejected,
+		Subject: source,
+		Reason:  rejected.Reason,
+	}); auditErr != nil {
+		log.Printf("Warning: Failed to record desired state rejection in the audit log: %v", auditErr)
+	}
+	return envelope, rejected
+}
+
+// RecordDesiredState remembers the issue time of a desired state the host was
+// reconciled against, so older documents are rejected from then on
+func (c *Client) RecordDesiredState(envelope DesiredStateEnvelope) error {
+	c.mu.RLock()
+	path := c.desiredStateIssuedPath
+	c.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+
+	commandNonceMutex.Lock()
+	defer commandNonceMutex.Unlock()
+	last, err := readDesiredStateIssued(path)
+	if err != nil {
+		return err
+	}
+	if !envelope.Issued.After(last) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create the desired state directory")
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(envelope.Issued.Format(time.RFC3339Nano)), 0600); err != nil {
+		return errors.Wrap(err, "failed to record the desired state issue time")
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readDesiredStateIssued returns the issue time recorded at path, zero if none was
+func readDesiredStateIssued(path string) (time.Time, error) {
+	if path == "" {
+		return time.Time{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to read the desired state issue time")
+	}
+	issued, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to parse the desired state issue time")
+	}
+	return issued, nil
+}
+
+// commandNonceMutex serializes the uses of the nonce and issue time files
+var commandNonceMutex sync.Mutex
+
+// useCommandNonce records nonce in the file at path until expires, it fails if
+// the nonce was used already. Expired nonces are dropped.
+func useCommandNonce(path, nonce string, expires time.Time) error {
+	commandNonceMutex.Lock()
+	defer commandNonceMutex.Unlock()
+
+	nonces := map[string]time.Time{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &nonces); err != nil {
+			return errors.Wrap(err, "failed to parse the command nonces")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read the command nonces")
+	}
+	if _, used := nonces[nonce]; used {
+		return errors.New("signed command was already executed")
+	}
+	now := time.Now()
+	for n, until := range nonces {
+		if now.After(until) {
+			delete(nonces, n)
+		}
+	}
+	nonces[nonce] = expires
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create the command nonce directory")
+	}
+	data, err := json.Marshal(nonces)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to record the command nonce")
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// VerifyManifest checks the signature of a manifest received from source,
+// recording rejections in the audit log. Without a verifier every manifest passes.
+func (c *Client) VerifyManifest(source string, manifest []byte, signature string) error {
+	c.mu.RLock()
+	verifier := c.manifestVerifier
+	c.mu.RUnlock()
+	if verifier == nil {
+		return nil
+	}
+
+	_, err := verifier.Verify(manifest, signature)
+	if err == nil {
+		return nil
+	}
+
+	rejected := &ManifestSignatureError{Source: source, Reason: err.Error()}
+	if auditErr := c.AuditLogger().Record(audit.Event{
+		Type:    audit.EventManifestRejected,
+		Subject: source,
+		Reason:  rejected.Reason,
+	}); auditErr != nil {
+		log.Printf("Warning: Failed to record manifest rejection in the audit log: %v", auditErr)
+	}
+	return rejected
+}
@@ -0,0 +1,362 @@
+package container
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"fun/tlsconfig"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// DockerEngine is a minimal client for the local Docker Engine API used for migration
+type DockerEngine struct {
+	host       string
+	httpClient *http.Client
+}
+
+// DockerImageSummary represents an image as listed by the Docker Engine API
+type DockerImageSummary struct {
+	ID       string   `json:"Id"`
+	RepoTags []string `json:"RepoTags"`
+	Size     int64    `json:"Size"`
+}
+
+// DockerContainerSummary represents a container as listed by the Docker Engine API
+type DockerContainerSummary struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	Image string   `json:"Image"`
+	State string   `json:"State"`
+}
+
+// DockerContainerDetails represents the subset of a Docker container inspect result needed for migration
+type DockerContainerDetails struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image      string            `json:"Image"`
+		Cmd        []string          `json:"Cmd"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Env        []string          `json:"Env"`
+		Labels     map[string]string `json:"Labels"`
+	} `json:"Config"`
+	HostConfig struct {
+		Privileged    bool `json:"Privileged"`
+		RestartPolicy struct {
+			Name string `json:"Name"`
+		} `json:"RestartPolicy"`
+	} `json:"HostConfig"`
+	Mounts []struct {
+		Type        string `json:"Type"`
+		Source      string `json:"Source"`
+		Destination string `json:"Destination"`
+		RW          bool   `json:"RW"`
+	} `json:"Mounts"`
+}
+
+// MigrateDockerOptions contains options for migrating from a local Docker daemon
+type MigrateDockerOptions struct {
+	// DockerHost is the Docker daemon address, defaults to DOCKER_HOST or the platform socket
+	DockerHost string
+	// IncludeContainers recreates Docker containers as fun-managed containers
+	IncludeContainers bool
+	// RunningOnly limits container migration to running containers
+	RunningOnly bool
+}
+
+// MigrateDockerResult summarizes a Docker migration
+type MigrateDockerResult struct {
+	Images     []string
+	Containers []string
+	Failures   []string
+}
+
+// GetDefaultDockerHost returns the address of the local Docker daemon
+func GetDefaultDockerHost() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	if IsRunningOnWindows() {
+		return "npipe:////./pipe/docker_engine"
+	}
+	return "unix:///var/run/docker.sock"
+}
+
+// NewDockerEngine creates a Docker Engine API client for the given host address
+// https:// hosts are reached with the TLS restrictions of tlsConfig, which may be nil.
+func NewDockerEngine(host string, tlsConfig *tls.Config) (*DockerEngine, error) {
+	if host == "" {
+		host = GetDefaultDockerHost()
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid docker host")
+	}
+
+	// The Docker daemon is local or on the same network, never behind the proxy
+	transport := tlsconfig.NewTransport(tlsConfig)
+	transport.Proxy = nil
+	baseURL := "http://docker"
+
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		}
+	case "npipe":
+		pipePath := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialNamedPipe(ctx, pipePath)
+		}
+	case "tcp", "http":
+		baseURL = "http://" + u.Host
+	case "https":
+		baseURL = "https://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host %s, set DOCKER_HOST to a unix://, npipe://, tcp:// or https:// address", host)
+	}
+
+	return &DockerEngine{
+		host:       baseURL,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// get performs a GET request against the Docker Engine API
+func (d *DockerEngine) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.host+path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create docker request")
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to docker daemon")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker API error: %s (status: %d)", strings.TrimSpace(string(body)), resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// getJSON performs a GET request and decodes the JSON response into v
+func (d *DockerEngine) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := d.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed to decode docker response")
+	}
+	return nil
+}
+
+// ListImages lists the images known to the Docker daemon
+func (d *DockerEngine) ListImages(ctx context.Context) ([]DockerImageSummary, error) {
+	var images []DockerImageSummary
+	if err := d.getJSON(ctx, "/images/json", &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ListContainers lists the containers known to the Docker daemon
+func (d *DockerEngine) ListContainers(ctx context.Context, all bool) ([]DockerContainerSummary, error) {
+	path := "/containers/json"
+	if all {
+		path += "?all=1"
+	}
+
+	var containers []DockerContainerSummary
+	if err := d.getJSON(ctx, path, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// InspectContainer returns the details of a Docker container
+func (d *DockerEngine) InspectContainer(ctx context.Context, id string) (*DockerContainerDetails, error) {
+	var details DockerContainerDetails
+	if err := d.getJSON(ctx, "/containers/"+url.PathEscape(id)+"/json", &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// ExportImage streams an image as a docker-archive tarball
+func (d *DockerEngine) ExportImage(ctx context.Context, ref string) (io.ReadCloser, error) {
+	resp, err := d.get(ctx, "/images/"+url.PathEscape(ref)+"/get")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ImportImage imports an image archive into the client's namespace and unpacks it
+func (c *Client) ImportImage(ctx context.Context, reader io.Reader) ([]string, error) {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("import image archive") {
+		return nil, nil
+	}
+	release, err := c.acquireHeavy(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to import image")
+	}
+	defer release()
+
+	imported, err := c.client.Import(ctx, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to import image")
+	}
+
+	var names []string
+	for _, img := range imported {
+		image := containerd.NewImage(c.client, img)
+		if err := image.Unpack(ctx, ""); err != nil {
+			return names, errors.Wrapf(err, "failed to unpack image %s", img.Name)
+		}
+		names = append(names, img.Name)
+	}
+
+	return names, nil
+}
+
+// MigrateFromDocker copies images, and optionally containers, from a local Docker daemon
+func (c *Client) MigrateFromDocker(ctx context.Context, opts MigrateDockerOptions) (*MigrateDockerResult, error) {
+	ctx = c.withNamespace(ctx)
+	engine, err := NewDockerEngine(opts.DockerHost, c.getTLSConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := engine.ListImages(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list docker images")
+	}
+
+	result := &MigrateDockerResult{}
+
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			// Dangling images have no usable reference
+			if tag == "<none>:<none>" {
+				continue
+			}
+
+			if c.dryRunf("import docker image %s", tag) {
+				result.Images = append(result.Images, tag)
+				continue
+			}
+			log.Printf("Migrating image %s", tag)
+			archive, err := engine.ExportImage(ctx, tag)
+			if err != nil {
+				result.Failures = append(result.Failures, fmt.Sprintf("image %s: %v", tag, err))
+				continue
+			}
+
+			names, err := c.ImportImage(ctx, archive)
+			archive.Close()
+			if err != nil {
+				result.Failures = append(result.Failures, fmt.Sprintf("image %s: %v", tag, err))
+				continue
+			}
+			result.Images = append(result.Images, names...)
+		}
+	}
+
+	if !opts.IncludeContainers {
+		return result, nil
+	}
+
+	containers, err := engine.ListContainers(ctx, !opts.RunningOnly)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to list docker containers")
+	}
+
+	for _, summary := range containers {
+		details, err := engine.InspectContainer(ctx, summary.ID)
+		if err != nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("container %s: %v", summary.ID, err))
+			continue
+		}
+
+		createOpts := dockerContainerToOptions(details)
+		log.Printf("Migrating container %s", createOpts.Name)
+
+		if _, err := c.CreateContainer(ctx, createOpts); err != nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("container %s: %v", createOpts.Name, err))
+			continue
+		}
+		result.Containers = append(result.Containers, createOpts.Name)
+	}
+
+	return result, nil
+}
+
+// dockerContainerToOptions converts a Docker container definition to fun container options
+func dockerContainerToOptions(details *DockerContainerDetails) CreateContainerOptions {
+	opts := CreateContainerOptions{
+		Name:           strings.TrimPrefix(details.Name, "/"),
+		Image:          details.Config.Image,
+		Env:            details.Config.Env,
+		Labels:         details.Config.Labels,
+		RestartPolicy:  details.HostConfig.RestartPolicy.Name,
+		PrivilegedMode: details.HostConfig.Privileged,
+	}
+
+	// Docker splits the process into an entrypoint and its arguments
+	if len(details.Config.Entrypoint) > 0 {
+		opts.Command = details.Config.Entrypoint
+		opts.Args = details.Config.Cmd
+	} else {
+		opts.Command = details.Config.Cmd
+	}
+
+	for _, m := range details.Mounts {
+		// Named volumes live inside Docker's data root and can't be shared safely
+		if m.Type != "bind" {
+			continue
+		}
+
+		mode := "ro"
+		if m.RW {
+			mode = "rw"
+		}
+		opts.Mounts = append(opts.Mounts, specs.Mount{
+			Type:        "bind",
+			Source:      m.Source,
+			Destination: m.Destination,
+			Options:     []string{"rbind", mode},
+		})
+	}
+
+	if opts.Labels == nil {
+		opts.Labels = map[string]string{}
+	}
+	opts.Labels["fun.migrated-from"] = "docker"
+	opts.Labels["fun.migrated-at"] = time.Now().UTC().Format(time.RFC3339)
+
+	return opts
+}
@@ -0,0 +1,299 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LabelMigratedFrom records the namespace a container was moved from
+const LabelMigratedFrom = "fun.migrated-from"
+
+// NamespaceSummary describes what a containerd namespace holds
+type NamespaceSummary struct {
+	Name       string   `json:"name"`
+	Containers []string `json:"containers"`
+	Images     int      `json:"images"`
+	// Current is set for the namespace the client operates in
+	Current bool `json:"current"`
+}
+
+// NamespaceMigrationResult summarizes a namespace migration
+type NamespaceMigrationResult struct {
+	Moved    []string
+	Failures []string
+}
+
+// ListNamespaces returns the containerd namespaces with their containers, so
+// containers created outside the configured namespace can be found
+func (c *Client) ListNamespaces(ctx context.Context) ([]NamespaceSummary, error) {
+	names, err := c.client.NamespaceService().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list namespaces")
+	}
+	sort.Strings(names)
+
+	summaries := make([]NamespaceSummary, 0, len(names))
+	for _, name := range names {
+		nsCtx := namespaces.WithNamespace(ctx, name)
+		summary := NamespaceSummary{Name: name, Containers: []string{}, Current: name == c.namespace}
+
+		containers, err := c.client.Containers(nsCtx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list containers in namespace %s", name)
+		}
+		for _, container := range containers {
+			summary.Containers = append(summary.Containers, container.ID())
+		}
+		sort.Strings(summary.Containers)
+
+		imageList, err := c.client.ImageService().List(nsCtx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list images in namespace %s", name)
+		}
+		summary.Images = len(imageList)
+
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// MigrateNamespace moves stopped containers from one namespace into the client's
+// namespace, all of them if containerIDs is empty. The image and the changes made
+// to the root filesystem are carried over, the container keeps its ID, spec and
+// labels. Unless keep is set the source container is removed afterwards.
+func (c *Client) MigrateNamespace(ctx context.Context, from string, containerIDs []string, keep bool) (*NamespaceMigrationResult, error) {
+	if from == c.namespace {
+		return nil, errors.Errorf("containers are already in namespace %s", from)
+	}
+	srcCtx := namespaces.WithNamespace(ctx, from)
+	dstCtx := c.withNamespace(ctx)
+
+	if len(containerIDs) == 0 {
+		containers, err := c.client.Containers(srcCtx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list containers in namespace %s", from)
+		}
+		for _, container := range containers {
+			containerIDs = append(containerIDs, container.ID())
+		}
+	}
+
+	result := &NamespaceMigrationResult{}
+	if len(containerIDs) == 0 {
+		return result, nil
+	}
+
+	if !c.dryRunf("create namespace %s", c.namespace) {
+		if err := c.client.NamespaceService().Create(ctx, c.namespace, nil); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, errors.Wrapf(err, "failed to create namespace %s", c.namespace)
+		}
+	}
+
+	for _, id := range containerIDs {
+		if c.dryRunf("move container %s from namespace %s to %s (keep source %t)", id, from, c.namespace, keep) {
+			result.Moved = append(result.Moved, id)
+			continue
+		}
+		if err := c.migrateContainer(srcCtx, dstCtx, id, keep); err != nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("%s: %v", id, err))
+			continue
+		}
+		result.Moved = append(result.Moved, id)
+	}
+	return result, nil
+}
+
+// migrateContainer moves one container between the namespaces of srcCtx and dstCtx
+func (c *Client) migrateContainer(srcCtx, dstCtx context.Context, id string, keep bool) error {
+	container, err := c.client.LoadContainer(srcCtx, id)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	if task, err := container.Task(srcCtx, nil); err == nil {
+		status, err := task.Status(srcCtx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get task status")
+		}
+		if status.Status != containerd.Stopped {
+			return errors.Errorf("container is %s, stop it first", status.Status)
+		}
+	}
+	info, err := container.Info(srcCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container info")
+	}
+	if _, err := c.client.LoadContainer(dstCtx, id); err == nil {
+		return errors.Errorf("a container named %s already exists in the target namespace", id)
+	}
+
+	release, err := c.acquireHeavy(dstCtx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Keep what is copied from being garbage collected before the container references it
+	dstCtx, done, err := c.client.WithLease(dstCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to create lease")
+	}
+	defer done(dstCtx)
+
+	if info.Image != "" {
+		if err := c.copyImage(srcCtx, dstCtx, info.Image, info.Snapshotter); err != nil {
+			return err
+		}
+	}
+	if info.SnapshotKey != "" {
+		if err := c.copySnapshot(srcCtx, dstCtx, info.Snapshotter, info.SnapshotKey); err != nil {
+			return err
+		}
+	}
+
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	info.Labels[LabelMigratedFrom] = namespaceOf(srcCtx)
+	if _, err := c.client.ContainerService().Create(dstCtx, info); err != nil {
+		return errors.Wrap(err, "failed to create container in the target namespace")
+	}
+
+	if keep {
+		return nil
+	}
+	if task, err := container.Task(srcCtx, nil); err == nil {
+		if _, err := task.Delete(srcCtx); err != nil {
+			return errors.Wrap(err, "container was copied but its stopped task could not be removed")
+		}
+	}
+	if err := container.Delete(srcCtx, containerd.WithSnapshotCleanup); err != nil {
+		return errors.Wrap(err, "container was copied but could not be removed from the source namespace")
+	}
+	return nil
+}
+
+// copyImage copies an image record and its content to the target namespace and unpacks it
+func (c *Client) copyImage(srcCtx, dstCtx context.Context, name, snapshotter string) error {
+	image, err := c.client.ImageService().Get(srcCtx, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get image %s", name)
+	}
+
+	store := c.client.ContentStore()
+	copyBlob := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		// Manifests of other platforms are usually not present locally
+		if _, err := store.Info(srcCtx, desc.Digest); errdefs.IsNotFound(err) {
+			return nil, images.ErrSkipDesc
+		}
+		if err := c.copyContent(srcCtx, dstCtx, desc); err != nil {
+			return nil, err
+		}
+		return images.Children(srcCtx, store, desc)
+	})
+	if err := images.Walk(srcCtx, copyBlob, image.Target); err != nil {
+		return errors.Wrapf(err, "failed to copy image %s", name)
+	}
+
+	if _, err := c.client.ImageService().Create(dstCtx, image); err != nil && !errdefs.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create image %s", name)
+	}
+	if err := containerd.NewImage(c.client, image).Unpack(dstCtx, snapshotter); err != nil {
+		return errors.Wrapf(err, "failed to unpack image %s", name)
+	}
+	return nil
+}
+
+// copyContent makes a blob of the source namespace available in the target namespace
+// The blob data is shared between namespaces, so usually only the record is added.
+func (c *Client) copyContent(srcCtx, dstCtx context.Context, desc ocispec.Descriptor) error {
+	store := c.client.ContentStore()
+	info, err := store.Info(srcCtx, desc.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get content %s", desc.Digest)
+	}
+
+	writer, err := content.OpenWriter(dstCtx, store, content.WithRef("fun-migrate-"+desc.Digest.String()), content.WithDescriptor(desc))
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to open writer for %s", desc.Digest)
+	}
+	if err == nil {
+		defer writer.Close()
+		reader, err := store.ReaderAt(srcCtx, desc)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read content %s", desc.Digest)
+		}
+		defer reader.Close()
+		if err := content.Copy(dstCtx, writer, content.NewReader(reader), desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to copy content %s", desc.Digest)
+		}
+	}
+
+	// The labels reference child blobs and keep them from being garbage collected
+	if len(info.Labels) == 0 {
+		return nil
+	}
+	var fields []string
+	for key := range info.Labels {
+		fields = append(fields, "labels."+key)
+	}
+	if _, err := store.Update(dstCtx, content.Info{Digest: desc.Digest, Labels: info.Labels}, fields...); err != nil {
+		return errors.Wrapf(err, "failed to label content %s", desc.Digest)
+	}
+	return nil
+}
+
+// copySnapshot recreates a container's root filesystem snapshot in the target
+// namespace, applying the changes made on top of the image as a layer
+func (c *Client) copySnapshot(srcCtx, dstCtx context.Context, snapshotter, key string) error {
+	sn := c.client.SnapshotService(snapshotter)
+	info, err := sn.Stat(srcCtx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot info")
+	}
+
+	upper, err := sn.Mounts(srcCtx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot mounts")
+	}
+	viewKey := key + "-fun-migrate"
+	lower, err := sn.View(srcCtx, viewKey, info.Parent)
+	if err != nil {
+		return errors.Wrap(err, "failed to view the image snapshot")
+	}
+	defer sn.Remove(srcCtx, viewKey)
+
+	layer, err := c.client.DiffService().Compare(srcCtx, lower, upper, diff.WithMediaType(ocispec.MediaTypeImageLayer))
+	if err != nil {
+		return errors.Wrap(err, "failed to compute root filesystem changes")
+	}
+	if err := c.copyContent(srcCtx, dstCtx, layer); err != nil {
+		return err
+	}
+
+	mounts, err := sn.Prepare(dstCtx, key, info.Parent, snapshots.WithLabels(info.Labels))
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare snapshot in the target namespace")
+	}
+	if _, err := c.client.DiffService().Apply(dstCtx, layer, mounts); err != nil {
+		sn.Remove(dstCtx, key)
+		return errors.Wrap(err, "failed to apply root filesystem changes")
+	}
+	return nil
+}
+
+// namespaceOf returns the namespace of ctx, empty if it has none
+func namespaceOf(ctx context.Context) string {
+	namespace, _ := namespaces.Namespace(ctx)
+	return namespace
+}
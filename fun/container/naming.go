@@ -0,0 +1,257 @@
+package container
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelName stores the friendly name of a container whose ID differs from it
+	LabelName = "fun.name"
+	// LabelService and LabelReplica record the service a container is a replica
+	// of, together with LabelProject
+	LabelService = "fun.service"
+	LabelReplica = "fun.replica"
+)
+
+// Labels Docker Compose sets on the containers it creates through the Docker
+// API, they are mapped onto the project, service and replica of the container
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+)
+
+// Container ID schemes
+const (
+	// IDSchemeName uses the container name as its ID
+	IDSchemeName = "name"
+	// IDSchemeGenerated derives the ID from the project, service, replica index
+	// and a short random suffix, so names can be reused without collisions
+	IDSchemeGenerated = "generated"
+)
+
+// validName matches container names and IDs, as accepted by containerd
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ParseIDScheme normalizes a container ID scheme, empty is IDSchemeName
+func ParseIDScheme(scheme string) (string, error) {
+	switch scheme {
+	case "", IDSchemeName:
+		return IDSchemeName, nil
+	case IDSchemeGenerated:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("invalid container ID scheme %q, expected name or generated", scheme)
+}
+
+// SetIDScheme sets how IDs are chosen for containers created without one
+func (c *Client) SetIDScheme(scheme string) {
+	c.mu.Lock()
+	c.idScheme = scheme
+	c.mu.Unlock()
+}
+
+// randomSuffix returns a short random hex string
+func randomSuffix() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ServiceName returns the friendly name of a service replica,
+// <project>-<service>-<replica>, without the project if it is empty
+func ServiceName(project, service string, replica int) string {
+	parts := []string{service, strconv.Itoa(replica)}
+	if project != "" {
+		parts = append([]string{project}, parts...)
+	}
+	return strings.Join(parts, "-")
+}
+
+// assignName fills in the name and ID of new container options according to
+// the client's ID scheme, and records them and the service in labels
+func (c *Client) assignName(opts *CreateContainerOptions) error {
+	if opts.Service == "" && opts.Labels[composeServiceLabel] != "" {
+		opts.Service = opts.Labels[composeServiceLabel]
+		opts.Replica, _ = strconv.Atoi(opts.Labels[composeNumberLabel])
+		if project := opts.Labels[composeProjectLabel]; project != "" && opts.Labels[LabelProject] == "" {
+			opts.Labels[LabelProject] = project
+		}
+	}
+	if opts.Service != "" {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelService] = opts.Service
+		opts.Labels[LabelReplica] = strconv.Itoa(opts.Replica)
+	}
+	if opts.Name == "" {
+		if opts.Service != "" {
+			opts.Name = ServiceName(opts.Labels[LabelProject], opts.Service, opts.Replica)
+		} else {
+			opts.Name = "fun-" + randomSuffix()
+		}
+	}
+	if !validName.MatchString(opts.Name) {
+		return fmt.Errorf("invalid container name %q, use letters, digits, '.', '_' and '-'", opts.Name)
+	}
+
+	if opts.ID == "" {
+		c.mu.RLock()
+		scheme := c.idScheme
+		c.mu.RUnlock()
+		opts.ID = opts.Name
+		if scheme == IDSchemeGenerated {
+			opts.ID = opts.Name + "-" + randomSuffix()
+		}
+	}
+	if opts.ID != opts.Name {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[LabelName] = opts.Name
+	}
+	return nil
+}
+
+// checkNameCollision refuses a container whose ID or friendly name is taken
+// Generated IDs that collide get a new suffix instead. The name of the
+// container being replaced may be reused.
+func (c *Client) checkNameCollision(ctx context.Context, opts *CreateContainerOptions) error {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+
+	ids := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		ids[container.ID()] = true
+		if container.ID() == opts.Replaces {
+			continue
+		}
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			continue
+		}
+		name := labels[LabelName]
+		if name == "" {
+			name = container.ID()
+		}
+		if name == opts.Name {
+			return fmt.Errorf("container name %q is already in use by container %s", opts.Name, container.ID())
+		}
+	}
+
+	if ids[opts.ID] {
+		if opts.Labels[LabelName] == "" {
+			return fmt.Errorf("container ID %q is already in use", opts.ID)
+		}
+		for ids[opts.ID] {
+			opts.ID = opts.Name + "-" + randomSuffix()
+		}
+	}
+	return nil
+}
+
+// LookupName returns the ID of the container with a friendly name, which is
+// its ID unless the container was created with another one. Unlike
+// ResolveContainer it matches no prefixes or services.
+func (c *Client) LookupName(ctx context.Context, name string) (string, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx, "labels."+strconv.Quote(LabelName)+"=="+strconv.Quote(name))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list containers")
+	}
+	switch len(containers) {
+	case 1:
+		return containers[0].ID(), nil
+	case 0:
+	default:
+		ids := make([]string, 0, len(containers))
+		for _, container := range containers {
+			ids = append(ids, container.ID())
+		}
+		sort.Strings(ids)
+		return "", fmt.Errorf("name %q is ambiguous, it matches containers %s", name, strings.Join(ids, ", "))
+	}
+
+	// Containers named after their ID don't carry the label
+	container, err := c.client.LoadContainer(ctx, name)
+	if err == nil {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read container labels")
+		}
+		if labels[LabelName] == "" {
+			return name, nil
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return "", errors.Wrap(err, "failed to load container")
+	}
+	return "", fmt.Errorf("no container named %s: %w", name, errdefs.ErrNotFound)
+}
+
+// ResolveContainer returns the ID of the container a reference names, which
+// is tried in order as an exact ID, a friendly name, a project/service pair
+// and a unique ID prefix. References matching more than one container are
+// errors listing the matches.
+func (c *Client) ResolveContainer(ctx context.Context, ref string) (string, error) {
+	ctx = c.withNamespace(ctx)
+	if ref == "" {
+		return "", errors.New("empty container reference")
+	}
+	if _, err := c.client.LoadContainer(ctx, ref); err == nil {
+		return ref, nil
+	} else if !errdefs.IsNotFound(err) {
+		return "", errors.Wrap(err, "failed to load container")
+	}
+	if id, err := c.LookupName(ctx, ref); err == nil {
+		return id, nil
+	} else if !errdefs.IsNotFound(err) {
+		return "", err
+	}
+
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list containers")
+	}
+	var byService, byPrefix []string
+	project, service, isService := strings.Cut(ref, "/")
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			continue
+		}
+		if isService && labels[LabelService] == service && labels[LabelProject] == project {
+			byService = append(byService, container.ID())
+		}
+		if strings.HasPrefix(container.ID(), ref) {
+			byPrefix = append(byPrefix, container.ID())
+		}
+	}
+
+	for _, matches := range []struct {
+		kind string
+		ids  []string
+	}{{"service", byService}, {"ID prefix", byPrefix}} {
+		switch {
+		case len(matches.ids) == 1:
+			return matches.ids[0], nil
+		case len(matches.ids) > 1:
+			sort.Strings(matches.ids)
+			return "", fmt.Errorf("%s %q is ambiguous, it matches containers %s", matches.kind, ref, strings.Join(matches.ids, ", "))
+		}
+	}
+	return "", fmt.Errorf("no such container: %s", ref)
+}
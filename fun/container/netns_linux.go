@@ -0,0 +1,48 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialInNetNS connects to addr from the network namespace of process pid
+// The socket is created on a thread switched into the namespace and keeps it
+// once the thread switches back, so only the dial itself runs there.
+func dialInNetNS(ctx context.Context, pid uint32, network, addr string) (net.Conn, error) {
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the network namespace of process %d: %w", pid, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	original, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open the current network namespace: %w", err)
+	}
+	defer original.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter the network namespace of process %d: %w", pid, err)
+	}
+
+	var d net.Dialer
+	conn, dialErr := d.DialContext(ctx, network, addr)
+
+	// A thread stuck in the container's namespace must not run other goroutines,
+	// it is left locked so it exits with this goroutine
+	if err := unix.Setns(int(original.Fd()), unix.CLONE_NEWNET); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("failed to leave the network namespace of process %d: %w", pid, err)
+	}
+	runtime.UnlockOSThread()
+	return conn, dialErr
+}
@@ -0,0 +1,144 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Labels used to record network attachments on containers
+const (
+	LabelNetwork   = "fun.network"
+	LabelIPAddress = "fun.ip"
+)
+
+// cniInterfaceName is the interface name used inside containers
+const cniInterfaceName = "eth0"
+
+// SetIPAMStore sets the IPAM store used for network address assignment
+func (c *Client) SetIPAMStore(store *IPAMStore) {
+	c.mu.Lock()
+	c.ipam = store
+	c.mu.Unlock()
+}
+
+// GetIPAMStore returns the IPAM store used for network address assignment
+func (c *Client) GetIPAMStore() *IPAMStore {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ipam
+}
+
+// cniBridgeConfig builds a CNI bridge network configuration with a static address
+func cniBridgeConfig(network IPAMNetwork, ip string) ([]byte, error) {
+	_, ipnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid network subnet")
+	}
+	prefix, _ := ipnet.Mask.Size()
+
+	conf := map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       network.Name,
+		"type":       "bridge",
+		"bridge":     bridgeName(network.Name),
+		"isGateway":  true,
+		"ipMasq":     true,
+		"ipam": map[string]interface{}{
+			"type": "static",
+			"addresses": []map[string]string{
+				{"address": fmt.Sprintf("%s/%d", ip, prefix), "gateway": network.Gateway},
+			},
+			"routes": []map[string]string{{"dst": "0.0.0.0/0"}},
+		},
+	}
+
+	return json.Marshal(conf)
+}
+
+// bridgeName derives a Linux bridge name (max 15 characters) from a network name
+func bridgeName(network string) string {
+	name := "fun-" + strings.ReplaceAll(network, "_", "-")
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// invokeCNI runs the bridge CNI plugin for the given command (ADD or DEL)
+func invokeCNI(ctx context.Context, command, containerID, netns string, conf []byte) error {
+	cniPath := GetCNIPath()
+	if cniPath == "" {
+		return errors.New("CNI plugins are not available")
+	}
+
+	cmd := exec.CommandContext(ctx, filepath.Join(cniPath, "bridge"))
+	cmd.Stdin = bytes.NewReader(conf)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerID,
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME="+cniInterfaceName,
+		"CNI_PATH="+cniPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("CNI %s failed: %w, output: %s", command, err, string(output))
+	}
+	return nil
+}
+
+// attachNetwork connects a started task to its network with its assigned address
+func (c *Client) attachNetwork(ctx context.Context, containerID string, pid uint32, labels map[string]string) error {
+	networkName := labels[LabelNetwork]
+	ipam := c.GetIPAMStore()
+	if networkName == "" || ipam == nil {
+		return nil
+	}
+
+	network, ok := ipam.GetNetwork(networkName)
+	if !ok {
+		return fmt.Errorf("network %s not found", networkName)
+	}
+
+	conf, err := cniBridgeConfig(network, labels[LabelIPAddress])
+	if err != nil {
+		return err
+	}
+
+	return invokeCNI(ctx, "ADD", containerID, fmt.Sprintf("/proc/%d/ns/net", pid), conf)
+}
+
+// detachNetwork removes the network attachment for a container
+func (c *Client) detachNetwork(ctx context.Context, containerID string, pid uint32, labels map[string]string) error {
+	networkName := labels[LabelNetwork]
+	ipam := c.GetIPAMStore()
+	if networkName == "" || ipam == nil {
+		return nil
+	}
+
+	network, ok := ipam.GetNetwork(networkName)
+	if !ok {
+		return nil
+	}
+
+	conf, err := cniBridgeConfig(network, labels[LabelIPAddress])
+	if err != nil {
+		return err
+	}
+
+	netns := ""
+	if pid != 0 {
+		netns = fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	return invokeCNI(ctx, "DEL", containerID, netns, conf)
+}
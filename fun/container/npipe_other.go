@@ -0,0 +1,14 @@
+//go:build !windows
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// dialNamedPipe fails, named pipes only exist on Windows
+func dialNamedPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, fmt.Errorf("named pipe %s is only available on Windows", path)
+}
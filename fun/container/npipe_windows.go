@@ -0,0 +1,15 @@
+package container
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// dialNamedPipe connects to the named pipe of an npipe:// address, whose path
+// is written with forward slashes, e.g. //./pipe/docker_engine
+func dialNamedPipe(ctx context.Context, path string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, strings.ReplaceAll(path, "/", `\`))
+}
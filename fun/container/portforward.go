@@ -0,0 +1,282 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+)
+
+// LabelPorts stores the published ports of a container, comma separated in the
+// form accepted by ParsePortMapping
+const LabelPorts = "fun.ports"
+
+// portDialTimeout bounds connecting a forwarded connection to the container
+const portDialTimeout = 5 * time.Second
+
+// PortMapping publishes a container port on the host
+type PortMapping struct {
+	// HostIP is the host address to listen on, 127.0.0.1 by default
+	HostIP        string `json:"host_ip"`
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+}
+
+// ParsePortMapping parses a port specification such as "8080:80",
+// "0.0.0.0:8080:80" or "8080:80/tcp". Only TCP is forwarded.
+func ParsePortMapping(spec string) (PortMapping, error) {
+	ports, protocol, _ := strings.Cut(spec, "/")
+	if protocol != "" && protocol != "tcp" {
+		return PortMapping{}, fmt.Errorf("only tcp ports can be published: %s", spec)
+	}
+
+	mapping := PortMapping{HostIP: "127.0.0.1"}
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		mapping.HostIP = parts[0]
+		if net.ParseIP(mapping.HostIP) == nil {
+			return PortMapping{}, fmt.Errorf("invalid host address %q in %s", mapping.HostIP, spec)
+		}
+		parts = parts[1:]
+	default:
+		return PortMapping{}, fmt.Errorf("invalid port specification %s, expected [host-ip:]host-port:container-port", spec)
+	}
+
+	var err error
+	if mapping.HostPort, err = parsePort(parts[0]); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid host port in %s: %w", spec, err)
+	}
+	if mapping.ContainerPort, err = parsePort(parts[1]); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid container port in %s: %w", spec, err)
+	}
+	return mapping, nil
+}
+
+// parsePort parses a TCP port number
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number", value)
+	}
+	return port, nil
+}
+
+// String returns the mapping in the form accepted by ParsePortMapping
+func (m PortMapping) String() string {
+	return fmt.Sprintf("%s:%d:%d", m.HostIP, m.HostPort, m.ContainerPort)
+}
+
+// HostAddress returns the address the port is published on
+func (m PortMapping) HostAddress() string {
+	return net.JoinHostPort(m.HostIP, strconv.Itoa(m.HostPort))
+}
+
+// portsLabel encodes published ports for LabelPorts
+func portsLabel(ports []PortMapping) string {
+	specs := make([]string, len(ports))
+	for i, port := range ports {
+		specs[i] = port.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+// portsFromLabels returns the published ports recorded on a container
+func portsFromLabels(labels map[string]string) []PortMapping {
+	var ports []PortMapping
+	for _, spec := range strings.Split(labels[LabelPorts], ",") {
+		if spec == "" {
+			continue
+		}
+		if port, err := ParsePortMapping(spec); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// PortForwarder relays connections to published host ports into the containers,
+// which is how ports reach containers on networks and containers in the VM on macOS
+type PortForwarder struct {
+	client *Client
+
+	mutex sync.Mutex
+	// backend resolves the address of the host containerd runs on, nil for this host
+	backend func() (string, error)
+	relays  map[string]*portRelay
+}
+
+// portRelay is a listener for one published port
+type portRelay struct {
+	containerID string
+	mapping     PortMapping
+	target      string
+	listener    net.Listener
+}
+
+// NewPortForwarder creates a forwarder for the published ports of client's containers
+func NewPortForwarder(client *Client) *PortForwarder {
+	return &PortForwarder{client: client, relays: make(map[string]*portRelay)}
+}
+
+// SetBackendAddress sets how to find the address of the VM containerd runs in,
+// containers without a network are reached at that address instead of localhost
+func (f *PortForwarder) SetBackendAddress(resolve func() (string, error)) {
+	f.mutex.Lock()
+	f.backend = resolve
+	f.mutex.Unlock()
+}
+
+// Run keeps the relays in line with the running containers until ctx is cancelled
+func (f *PortForwarder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.reconcile(ctx); err != nil {
+			log.Printf("Warning: Failed to update forwarded ports: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			f.closeAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Forwarded returns the relays currently listening, by host address
+func (f *PortForwarder) Forwarded() map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	forwarded := make(map[string]string, len(f.relays))
+	for address, relay := range f.relays {
+		forwarded[address] = relay.target
+	}
+	return forwarded
+}
+
+// reconcile opens relays for the published ports of running containers and closes
+// the relays of containers that stopped
+func (f *PortForwarder) reconcile(ctx context.Context) error {
+	containers, err := f.client.ListContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	resolve := f.backend
+	f.mutex.Unlock()
+	backend := "127.0.0.1"
+	if resolve != nil {
+		if backend, err = resolve(); err != nil {
+			return fmt.Errorf("failed to find the VM address: %w", err)
+		}
+	}
+
+	wanted := make(map[string]*portRelay)
+	for _, container := range containers {
+		if container.Status != string(containerd.Running) {
+			continue
+		}
+		host := backend
+		if ip := container.Labels[LabelIPAddress]; ip != "" {
+			host = ip
+		}
+		for _, mapping := range portsFromLabels(container.Labels) {
+			address := mapping.HostAddress()
+			// A container sharing this host's network already listens on the port itself
+			if resolve == nil && host == backend && mapping.HostPort == mapping.ContainerPort {
+				continue
+			}
+			if other, taken := wanted[address]; taken {
+				log.Printf("Warning: Port %s of container %s is already published by %s", address, container.ID, other.containerID)
+				continue
+			}
+			wanted[address] = &portRelay{
+				containerID: container.ID,
+				mapping:     mapping,
+				target:      net.JoinHostPort(host, strconv.Itoa(mapping.ContainerPort)),
+			}
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for address, relay := range f.relays {
+		if want, ok := wanted[address]; !ok || want.target != relay.target {
+			relay.listener.Close()
+			delete(f.relays, address)
+		}
+	}
+	for address, relay := range wanted {
+		if _, ok := f.relays[address]; ok {
+			continue
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Printf("Warning: Failed to publish port %s of container %s: %v", address, relay.containerID, err)
+			continue
+		}
+		relay.listener = listener
+		f.relays[address] = relay
+		go relay.serve()
+		log.Printf("Forwarding %s to container %s at %s", address, relay.containerID, relay.target)
+	}
+	return nil
+}
+
+// closeAll stops all relays
+func (f *PortForwarder) closeAll() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for address, relay := range f.relays {
+		relay.listener.Close()
+		delete(f.relays, address)
+	}
+}
+
+// serve accepts connections until the listener is closed
+func (r *portRelay) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.forward(conn)
+	}
+}
+
+// forward copies a connection to the container and back
+func (r *portRelay) forward(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", r.target, portDialTimeout)
+	if err != nil {
+		log.Printf("Warning: Failed to forward %s to container %s: %v", r.mapping.HostAddress(), r.containerID, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Pass on the end of the stream while the other direction may still be sending
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(upstream, conn)
+	go copyHalf(conn, upstream)
+	<-done
+	<-done
+}
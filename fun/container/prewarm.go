@@ -0,0 +1,221 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPrePullExpiry is how long a pre-pull hint without a deadline is kept
+const DefaultPrePullExpiry = 24 * time.Hour
+
+// PrePullWindow is the daily local time window images may be pulled ahead of
+// deployments in, such as the night hours of a metered link. The zero value
+// allows any time.
+type PrePullWindow struct {
+	// Start and End are offsets from midnight, a window ending before it
+	// starts runs over midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParsePrePullWindow parses a window such as "01:00-06:00", empty allows any time
+func ParsePrePullWindow(value string) (PrePullWindow, error) {
+	if value == "" {
+		return PrePullWindow{}, nil
+	}
+	start, end, ok := strings.Cut(value, "-")
+	if !ok {
+		return PrePullWindow{}, fmt.Errorf("invalid pre-pull window %q, expected HH:MM-HH:MM", value)
+	}
+	var window PrePullWindow
+	var err error
+	if window.Start, err = parseClock(strings.TrimSpace(start)); err != nil {
+		return PrePullWindow{}, fmt.Errorf("invalid pre-pull window %q: %w", value, err)
+	}
+	if window.End, err = parseClock(strings.TrimSpace(end)); err != nil {
+		return PrePullWindow{}, fmt.Errorf("invalid pre-pull window %q: %w", value, err)
+	}
+	return window, nil
+}
+
+// parseClock parses a time of day such as 06:30 into the offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls in the window
+func (w PrePullWindow) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// PrePullHint is an image the orchestrator plans to schedule on the host
+type PrePullHint struct {
+	Image     string    `json:"image"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Prewarmer pulls the images the orchestrator hints at while the host is idle
+// and inside the pre-pull window, so the deployments using them start right
+// away instead of waiting for the download. No container uses the pulled
+// images yet, so image GC keeps them until their hint expires.
+type Prewarmer struct {
+	client *Client
+	window PrePullWindow
+
+	mutex sync.Mutex
+	hints map[string]time.Time
+	// pulled are the hinted images pulled already, until their hint expires
+	pulled map[string]time.Time
+}
+
+// NewPrewarmer creates a prewarmer pulling images for client within window,
+// and keeps the client's image GC from deleting the hinted images
+func NewPrewarmer(client *Client, window PrePullWindow) *Prewarmer {
+	p := &Prewarmer{client: client, window: window, hints: make(map[string]time.Time), pulled: make(map[string]time.Time)}
+	client.mu.Lock()
+	client.prewarmer = p
+	client.mu.Unlock()
+	return p
+}
+
+// Hint queues images to pull until expiresAt, a zero time keeps them for
+// DefaultPrePullExpiry. Hinting a queued image again extends its deadline.
+func (p *Prewarmer) Hint(images []string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(DefaultPrePullExpiry)
+	}
+	normalized := make([]string, 0, len(images))
+	for _, image := range images {
+		ref, err := NormalizeImageRef(image)
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, ref)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, ref := range normalized {
+		if expiresAt.After(p.hints[ref]) {
+			p.hints[ref] = expiresAt
+		}
+	}
+	return nil
+}
+
+// Pending returns the hinted images not pulled yet, soonest deadline first
+func (p *Prewarmer) Pending() []PrePullHint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	hints := make([]PrePullHint, 0, len(p.hints))
+	for image, expiresAt := range p.hints {
+		if now.Before(expiresAt) {
+			hints = append(hints, PrePullHint{Image: image, ExpiresAt: expiresAt})
+		}
+	}
+	sort.Slice(hints, func(i, j int) bool {
+		if !hints[i].ExpiresAt.Equal(hints[j].ExpiresAt) {
+			return hints[i].ExpiresAt.Before(hints[j].ExpiresAt)
+		}
+		return hints[i].Image < hints[j].Image
+	})
+	return hints
+}
+
+// PullPending pulls the hinted images one at a time, soonest deadline first,
+// for as long as the window is open and nothing else is pulling. It returns
+// the number of images pulled.
+func (p *Prewarmer) PullPending(ctx context.Context) int {
+	defer p.dropExpired()
+
+	pulled := 0
+	for _, hint := range p.Pending() {
+		if ctx.Err() != nil || !p.window.Contains(time.Now()) || !p.idle() {
+			break
+		}
+		// A failed hint isn't retried, the orchestrator hints it again if it still plans to use it
+		p.remove(hint.Image)
+		start := time.Now()
+		if _, err := p.client.EnsureImage(ctx, hint.Image, PullIfNotPresent); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Warning: Failed to pre-pull image %s: %v", hint.Image, err)
+			}
+			continue
+		}
+		log.Printf("Pre-pulled image %s in %s", hint.Image, time.Since(start).Round(time.Second))
+		p.mutex.Lock()
+		p.pulled[hint.Image] = hint.ExpiresAt
+		p.mutex.Unlock()
+		pulled++
+	}
+	return pulled
+}
+
+// idle reports whether no pulls, imports or snapshot creations are running, so
+// pre-pulls never hold up a deployment
+func (p *Prewarmer) idle() bool {
+	if atomic.LoadInt64(&p.client.pullsInFlight) > 0 {
+		return false
+	}
+	p.client.mu.RLock()
+	defer p.client.mu.RUnlock()
+	return len(p.client.heavyOps) == 0
+}
+
+// Hinted reports the images of the unexpired hints, pulled or not, which image
+// GC must keep
+func (p *Prewarmer) Hinted() map[string]bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	hinted := make(map[string]bool, len(p.hints)+len(p.pulled))
+	for _, images := range []map[string]time.Time{p.hints, p.pulled} {
+		for image, expiresAt := range images {
+			if now.Before(expiresAt) {
+				hinted[image] = true
+			}
+		}
+	}
+	return hinted
+}
+
+// remove forgets a hinted image before it is pulled
+func (p *Prewarmer) remove(image string) {
+	p.mutex.Lock()
+	delete(p.hints, image)
+	p.mutex.Unlock()
+}
+
+// dropExpired forgets the hints past their deadline
+func (p *Prewarmer) dropExpired() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for _, images := range []map[string]time.Time{p.hints, p.pulled} {
+		for image, expiresAt := range images {
+			if !now.Before(expiresAt) {
+				delete(images, image)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelPriority stores the priority class of a container, missing is PriorityNormal
+	LabelPriority = "fun.priority"
+	// LabelPreempted marks containers stopped to relieve resource pressure with
+	// the reason, so their restart policy doesn't bring them back
+	LabelPreempted = "fun.preempted"
+	// LabelPreemptedMemory records the working set in bytes of a container when
+	// it was preempted, the memory it needs back before it is resumed
+	LabelPreemptedMemory = "fun.preempted-memory"
+)
+
+// Priority classes, from the first to be preempted to never preempted
+const (
+	PriorityLow      = "low"
+	PriorityNormal   = "normal"
+	PriorityHigh     = "high"
+	PriorityCritical = "critical"
+)
+
+// priorityRanks orders the priority classes
+var priorityRanks = map[string]int{
+	PriorityLow:      0,
+	PriorityNormal:   1,
+	PriorityHigh:     2,
+	PriorityCritical: 3,
+}
+
+// ParsePriority normalizes a priority class, empty is PriorityNormal
+func ParsePriority(priority string) (string, error) {
+	if priority == "" {
+		return PriorityNormal, nil
+	}
+	if _, ok := priorityRanks[priority]; !ok {
+		return "", fmt.Errorf("invalid priority %q, expected low, normal, high or critical", priority)
+	}
+	return priority, nil
+}
+
+// priorityRank returns the rank of a container's priority label, unknown
+// values rank as PriorityNormal
+func priorityRank(labels map[string]string) int {
+	if rank, ok := priorityRanks[labels[LabelPriority]]; ok {
+		return rank
+	}
+	return priorityRanks[PriorityNormal]
+}
+
+// PreemptionPolicy configures when lower-priority containers are stopped
+type PreemptionPolicy struct {
+	// MinMemoryAvailable is the available host memory below which a container
+	// is preempted, 0 disables preemption
+	MinMemoryAvailable int64
+	// StopTimeout is how long a preempted container gets to stop
+	StopTimeout time.Duration
+	// MaxPriority is the highest priority class that may be preempted, empty
+	// allows any class below the highest one running
+	MaxPriority string
+}
+
+// PreemptionEvent describes a container stopped to relieve resource pressure
+type PreemptionEvent struct {
+	ContainerID string    `json:"container_id"`
+	Priority    string    `json:"priority"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+}
+
+// SetPreemptionHook sets a function called after a container was preempted
+// It runs on the caller of RelievePressure, so slow work belongs in a goroutine.
+func (c *Client) SetPreemptionHook(hook func(event PreemptionEvent)) {
+	c.mu.Lock()
+	c.preemptionHook = hook
+	c.mu.Unlock()
+}
+
+// preemptionCandidate is a running container that may be preempted
+type preemptionCandidate struct {
+	container containerd.Container
+	task      containerd.Task
+	priority  string
+	rank      int
+	memory    uint64
+}
+
+// RelievePressure preempts one container when the available host memory is
+// below the policy's minimum, and returns it, nil if nothing was preempted
+// Only containers with a lower priority than another running container, and
+// at most the policy's MaxPriority, are candidates. Critical ones never are,
+// neither the critical priority class nor containers the orchestrator marked
+// critical. The lowest priority goes first and the largest working set among
+// equals, one container per call so the memory freed can be seen before the
+// next one is stopped.
+func (c *Client) RelievePressure(ctx context.Context, policy PreemptionPolicy) (*PreemptionEvent, error) {
+	if policy.MinMemoryAvailable <= 0 {
+		return nil, nil
+	}
+	available := hostMemoryAvailable()
+	if available <= 0 || available >= policy.MinMemoryAvailable {
+		return nil, nil
+	}
+
+	nsCtx := c.withNamespace(ctx)
+	containers, err := c.client.Containers(nsCtx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	var candidates []preemptionCandidate
+	highest := -1
+	for _, container := range containers {
+		labels, err := container.Labels(nsCtx)
+		if err != nil {
+			continue
+		}
+		task, err := container.Task(nsCtx, nil)
+		if err != nil {
+			continue
+		}
+		if status, err := task.Status(nsCtx); err != nil || status.Status != containerd.Running {
+			continue
+		}
+		candidate := preemptionCandidate{
+			container: container,
+			task:      task,
+			priority:  labels[LabelPriority],
+			rank:      priorityRank(labels),
+		}
+		if candidate.priority == "" {
+			candidate.priority = PriorityNormal
+		}
+		if candidate.rank > highest {
+			highest = candidate.rank
+		}
+		// Critical containers still count as running above the others
+		if labels[LabelCritical] != "" {
+			continue
+		}
+		if stats, err := c.ContainerStats(ctx, container.ID()); err == nil {
+			candidate.memory = stats.MemoryWorkingSet
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].memory > candidates[j].memory
+	})
+	limit := highest - 1
+	if rank, ok := priorityRanks[policy.MaxPriority]; ok && rank < limit {
+		limit = rank
+	}
+	if len(candidates) == 0 || candidates[0].rank > limit || candidates[0].priority == PriorityCritical {
+		log.Printf("Warning: Host memory is low (%d bytes available) but no container can be preempted", available)
+		return nil, nil
+	}
+	victim := candidates[0]
+
+	event := PreemptionEvent{
+		ContainerID: victim.container.ID(),
+		Priority:    victim.priority,
+		Reason: fmt.Sprintf("host memory low: %d bytes available, %d bytes required; container used %d bytes",
+			available, policy.MinMemoryAvailable, victim.memory),
+		Time: time.Now(),
+	}
+	if c.dryRunf("preempt container %s (%s priority): %s", event.ContainerID, event.Priority, event.Reason) {
+		return &event, nil
+	}
+
+	// Mark first so the restart supervisor leaves the container alone once it exits
+	if _, err := victim.container.SetLabels(nsCtx, map[string]string{
+		LabelPreempted:       event.Reason,
+		LabelPreemptedMemory: strconv.FormatUint(victim.memory, 10),
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to mark container %s as preempted", event.ContainerID)
+	}
+	timeout := policy.StopTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	if err := stopTask(nsCtx, victim.task, timeout); err != nil {
+		return nil, errors.Wrapf(err, "failed to stop container %s", event.ContainerID)
+	}
+	log.Printf("Preempted container %s (%s priority): %s", event.ContainerID, event.Priority, event.Reason)
+
+	c.mu.RLock()
+	hook := c.preemptionHook
+	c.mu.RUnlock()
+	if hook != nil {
+		hook(event)
+	}
+	return &event, nil
+}
+
+// ResumePreempted starts one preempted container again once the available host
+// memory is above the policy's minimum by at least what the container used
+// when it was preempted, and returns its ID, empty if none was resumed
+// The highest priority goes first, one container per call like RelievePressure
+// so the two don't take turns stopping and starting the same container.
+// Containers the user stopped since are left alone.
+func (c *Client) ResumePreempted(ctx context.Context, policy PreemptionPolicy) (string, error) {
+	if policy.MinMemoryAvailable <= 0 {
+		return "", nil
+	}
+	available := hostMemoryAvailable()
+	if available <= 0 || available < policy.MinMemoryAvailable {
+		return "", nil
+	}
+
+	nsCtx := c.withNamespace(ctx)
+	containers, err := c.client.Containers(nsCtx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list containers")
+	}
+
+	var next containerd.Container
+	nextRank := -1
+	for _, container := range containers {
+		labels, err := container.Labels(nsCtx)
+		if err != nil || labels[LabelPreempted] == "" || labels[LabelStopped] != "" {
+			continue
+		}
+		needed, _ := strconv.ParseInt(labels[LabelPreemptedMemory], 10, 64)
+		if available-needed < policy.MinMemoryAvailable {
+			continue
+		}
+		if rank := priorityRank(labels); rank > nextRank {
+			next, nextRank = container, rank
+		}
+	}
+	if next == nil {
+		return "", nil
+	}
+
+	if c.dryRunf("resume preempted container %s, %d bytes of memory available", next.ID(), available) {
+		return next.ID(), nil
+	}
+	// StartContainer clears the preempted marker
+	if err := c.StartContainer(ctx, next.ID()); err != nil {
+		return "", errors.Wrapf(err, "failed to resume preempted container %s", next.ID())
+	}
+	if _, err := next.SetLabels(nsCtx, map[string]string{LabelPreemptedMemory: ""}); err != nil {
+		log.Printf("Warning: Failed to clear the preempted memory of container %s: %v", next.ID(), err)
+	}
+	log.Printf("Resumed preempted container %s, %d bytes of memory available", next.ID(), available)
+	return next.ID(), nil
+}
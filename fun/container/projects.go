@@ -0,0 +1,73 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ProjectStateFile is the desired-state document of a project directory
+const ProjectStateFile = "desired-state.json"
+
+// ProjectState is the desired state of one project directory
+type ProjectState struct {
+	Project string
+	Path    string
+	State   DesiredState
+	// Declared is the project the document names, empty if it leaves it to its directory
+	Declared string
+	// Manifest is the document as read, Signature its detached signature if there is one
+	Manifest  []byte
+	Signature string
+	// Err is why the document can't be applied, the other projects are still loaded
+	Err error
+}
+
+// LoadProjectStates reads <dir>/<project>/desired-state.json of every project
+// below dir. Each state is scoped to the project named after its directory.
+func LoadProjectStates(dir string) ([]ProjectState, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*", ProjectStateFile))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	projects := make([]ProjectState, 0, len(paths))
+	for _, path := range paths {
+		project := ProjectState{Project: filepath.Base(filepath.Dir(path)), Path: path}
+		project.Manifest, project.Err = os.ReadFile(path)
+		if project.Err == nil {
+			project.State, project.Err = parseDesiredState(path, project.Manifest)
+		}
+		if signature, err := os.ReadFile(path + ManifestSignatureSuffix); err == nil {
+			project.Signature = string(signature)
+		}
+		if project.Err == nil && project.State.Project != "" && project.State.Project != project.Project {
+			project.Err = fmt.Errorf("%s names project %q, expected %q", path, project.State.Project, project.Project)
+		}
+		project.Declared = project.State.Project
+		project.State.Project = project.Project
+		projects = append(projects, project)
+	}
+	return projects, nil
+}
+
+// ReadDesiredState reads a desired-state document from a JSON file
+func ReadDesiredState(path string) (DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DesiredState{}, err
+	}
+	return parseDesiredState(path, data)
+}
+
+// parseDesiredState decodes the desired-state document read from path
+func parseDesiredState(path string, data []byte) (DesiredState, error) {
+	var desired DesiredState
+	if err := json.Unmarshal(data, &desired); err != nil {
+		return desired, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return desired, nil
+}
@@ -0,0 +1,254 @@
+package container
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"fun/tlsconfig"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// PullOptions controls how image layers are downloaded
+type PullOptions struct {
+	// MaxConcurrentDownloads limits parallel layer downloads per pull
+	MaxConcurrentDownloads int
+	// Retries is the number of times a failed pull is retried. Partially
+	// downloaded layers are kept in containerd's ingest store and resumed.
+	Retries int
+	// RetryBackoff is the initial delay between retries, doubled on each attempt
+	RetryBackoff time.Duration
+	// RequestRetries is the number of times an individual registry request is retried
+	RequestRetries int
+}
+
+// DefaultPullOptions returns the default pull options
+func DefaultPullOptions() PullOptions {
+	return PullOptions{
+		MaxConcurrentDownloads: 3,
+		Retries:                3,
+		RetryBackoff:           2 * time.Second,
+		RequestRetries:         3,
+	}
+}
+
+// SetPullOptions sets the options used for image pulls
+func (c *Client) SetPullOptions(opts PullOptions) {
+	c.mu.Lock()
+	c.pullOptions = opts
+	c.mu.Unlock()
+}
+
+// getPullOptions returns the options used for image pulls
+func (c *Client) getPullOptions() PullOptions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pullOptions
+}
+
+// SetTLSConfig restricts the TLS versions and cipher suites used to reach registries
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.mu.Lock()
+	c.tlsConfig = config
+	c.probeClient = nil
+	c.mu.Unlock()
+}
+
+// getTLSConfig returns the registry TLS configuration, nil for the Go defaults
+func (c *Client) getTLSConfig() *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tlsConfig
+}
+
+// probeHTTPClient returns the client of HTTP health probes, which uses the
+// TLS restrictions but no proxy, probes go to the container directly from its
+// network namespace. Connections aren't kept, the same address may be another
+// container's next time.
+func (c *Client) probeHTTPClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.probeClient == nil {
+		transport := tlsconfig.NewTransport(c.tlsConfig)
+		transport.Proxy = nil
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			pid, _ := ctx.Value(probePidKey{}).(uint32)
+			return dialInNetNS(ctx, pid, network, addr)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		c.probeClient = &http.Client{Transport: transport}
+	}
+	return c.probeClient
+}
+
+// retryTransport retries idempotent registry requests that fail with transient errors
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only GET and HEAD are safe to replay without a body
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.retries || !isRetryableResponse(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		log.Printf("Retrying registry request %s %s (attempt %d/%d)", req.Method, req.URL.Redacted(), attempt+1, t.retries)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryableResponse reports whether a registry response indicates a transient failure
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// withPullRetries runs pull until it succeeds, the retries are exhausted or ctx is done
+func (c *Client) withPullRetries(ctx context.Context, ref string, pull func() error) error {
+	options := c.getPullOptions()
+	backoff := options.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var err error
+	for attempt := 0; attempt <= options.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying pull of %s in %s (attempt %d/%d): %v", ref, backoff, attempt, options.Retries, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		if err = pull(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("pull failed after %d attempts: %w", options.Retries+1, err)
+}
+
+// ImagePullPolicy determines when an image is pulled before creating a container
+type ImagePullPolicy string
+
+const (
+	// PullAlways pulls the image every time, picking up updated tags
+	PullAlways ImagePullPolicy = "always"
+	// PullIfNotPresent only pulls when the image is missing locally
+	PullIfNotPresent ImagePullPolicy = "missing"
+	// PullNever uses the local image and fails if it is missing
+	PullNever ImagePullPolicy = "never"
+)
+
+// ParseImagePullPolicy parses a pull policy name, accepting Kubernetes and compose spellings
+func ParseImagePullPolicy(policy string) (ImagePullPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "missing", "ifnotpresent", "if_not_present":
+		return PullIfNotPresent, nil
+	case "always":
+		return PullAlways, nil
+	case "never":
+		return PullNever, nil
+	}
+	return "", fmt.Errorf("invalid pull policy %q, expected always, missing or never", policy)
+}
+
+// NormalizeImageRef expands short image names such as "nginx" to fully qualified references
+func NormalizeImageRef(ref string) (string, error) {
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	return named.String(), nil
+}
+
+// EnsureImage returns a local, unpacked image for ref according to the pull policy
+func (c *Client) EnsureImage(ctx context.Context, ref string, policy ImagePullPolicy) (containerd.Image, error) {
+	ctx = c.withNamespace(ctx)
+	if policy == "" {
+		policy = PullIfNotPresent
+	}
+
+	normalized, err := NormalizeImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == PullAlways {
+		return c.PullImage(ctx, normalized)
+	}
+
+	image, err := c.client.GetImage(ctx, normalized)
+	if err != nil {
+		if policy == PullNever {
+			return nil, fmt.Errorf("image %s is not present locally and pull policy is never", normalized)
+		}
+		return c.PullImage(ctx, normalized)
+	}
+
+	// Local images may have been imported or pulled before the policy changed
+	if err := c.enforceTrustPolicy(ctx, normalized, image.Target().Digest); err != nil {
+		return nil, err
+	}
+
+	// An imported or previously pruned image may not have a snapshot yet
+	unpacked, err := image.IsUnpacked(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check image snapshot")
+	}
+	if !unpacked {
+		release, err := c.acquireHeavy(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		if err := image.Unpack(ctx, ""); err != nil {
+			return nil, errors.Wrap(err, "failed to unpack image")
+		}
+	}
+
+	return image, nil
+}
@@ -0,0 +1,256 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/defaults"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/pkg/errors"
+)
+
+// repairGracePeriod is how old a container must be before Repair touches its
+// task, younger ones may still be being created and started by another client
+const repairGracePeriod = time.Minute
+
+// RepairOptions contains options for repairing containers
+type RepairOptions struct {
+	// RemoveUnrepairable removes containers whose root filesystem is gone and
+	// can't be rebuilt because their image is gone too
+	RemoveUnrepairable bool
+}
+
+// RepairAction is an inconsistency found by Repair and what was done about it
+type RepairAction struct {
+	ContainerID string `json:"container_id,omitempty"`
+	Snapshot    string `json:"snapshot,omitempty"`
+	Problem     string `json:"problem"`
+	Action      string `json:"action"`
+	// Error is why the action failed, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Repair detects containers left inconsistent by a hard reboot or crash and
+// cleans or rebuilds them
+//   - tasks whose shim died are deleted, and the container is started again
+//     if its restart policy asks for it; containers created in the last
+//     minute are left alone, they may still be starting
+//   - missing root filesystem snapshots are rebuilt from the image, losing
+//     what the container wrote
+//   - snapshots of containers that no longer exist are removed
+func (c *Client) Repair(ctx context.Context, opts RepairOptions) ([]RepairAction, error) {
+	ctx = c.withNamespace(ctx)
+	list, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	var actions []RepairAction
+	record := func(action RepairAction, err error) {
+		if err != nil {
+			action.Error = err.Error()
+		}
+		actions = append(actions, action)
+	}
+
+	// Snapshot keys in use, by snapshotter. The default one is checked even
+	// when no container is left to name it.
+	inUse := map[string]map[string]bool{defaults.DefaultSnapshotter: {}}
+	for _, container := range list {
+		info, err := container.Info(ctx)
+		if err != nil {
+			record(RepairAction{ContainerID: container.ID(), Problem: "container record unreadable", Action: "none"}, err)
+			continue
+		}
+		if info.SnapshotKey != "" {
+			if inUse[info.Snapshotter] == nil {
+				inUse[info.Snapshotter] = make(map[string]bool)
+			}
+			inUse[info.Snapshotter][info.SnapshotKey] = true
+		}
+
+		removed := false
+		if info.SnapshotKey != "" {
+			_, err := c.client.SnapshotService(info.Snapshotter).Stat(ctx, info.SnapshotKey)
+			if errdefs.IsNotFound(err) {
+				var action RepairAction
+				action, removed, err = c.repairSnapshot(ctx, container, info, opts)
+				record(action, err)
+			}
+		}
+		if !removed && time.Since(info.CreatedAt) >= repairGracePeriod {
+			if action, err := c.repairTask(ctx, container, info.Labels); action != nil {
+				record(*action, err)
+			}
+		}
+	}
+
+	for snapshotter, keys := range inUse {
+		if err := c.removeOrphanedSnapshots(ctx, snapshotter, keys, record); err != nil {
+			return actions, err
+		}
+	}
+	return actions, nil
+}
+
+// repairTask deletes a task whose state is unknown to containerd, usually
+// because its shim died with the host, and starts the container again if it
+// should run. Other errors, such as a containerd that is briefly unreachable,
+// leave the task alone.
+func (c *Client) repairTask(ctx context.Context, container containerd.Container, labels map[string]string) (*RepairAction, error) {
+	task, err := container.Task(ctx, nil)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil && !errdefs.IsUnknown(err) {
+		return nil, nil
+	}
+	if err == nil {
+		status, statusErr := task.Status(ctx)
+		if statusErr != nil && !errdefs.IsNotFound(statusErr) && !errdefs.IsUnknown(statusErr) {
+			return nil, nil
+		}
+		if statusErr == nil && status.Status != containerd.Unknown {
+			return nil, nil
+		}
+	}
+
+	action := &RepairAction{ContainerID: container.ID(), Problem: "task state unavailable, its shim is gone", Action: "deleted task"}
+	if c.dryRunf("delete dead task of container %s", container.ID()) {
+		return action, nil
+	}
+	if task != nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			return action, errors.Wrap(err, "failed to delete task")
+		}
+	} else if _, err := c.client.TaskService().Delete(ctx, &tasks.DeleteTaskRequest{ContainerID: container.ID()}); err != nil && !errdefs.IsNotFound(err) {
+		return action, errors.Wrap(err, "failed to delete task")
+	}
+
+	policy := labels[LabelRestartPolicy]
+	if policy == "" || policy == RestartNo || policy == RestartOnFailure || labels[LabelStopped] != "" || labels[LabelDrained] != "" || labels[LabelPreempted] != "" || labels[LabelStandby] != "" {
+		return action, nil
+	}
+	action.Action = "deleted task and restarted container"
+	if err := c.StartContainer(ctx, container.ID()); err != nil {
+		return action, errors.Wrap(err, "failed to restart container")
+	}
+	return action, nil
+}
+
+// repairSnapshot rebuilds the missing root filesystem snapshot of a container
+// on top of its image, or removes the container if that's gone too and opts
+// allows it, reporting whether the container was removed
+func (c *Client) repairSnapshot(ctx context.Context, container containerd.Container, info containers.Container, opts RepairOptions) (RepairAction, bool, error) {
+	action := RepairAction{
+		ContainerID: container.ID(),
+		Snapshot:    info.SnapshotKey,
+		Problem:     "root filesystem snapshot is missing",
+		Action:      "rebuilt snapshot from image " + info.Image,
+	}
+
+	image, err := c.client.GetImage(ctx, info.Image)
+	if err != nil {
+		if !opts.RemoveUnrepairable {
+			action.Action = "none, its image is gone too"
+			return action, false, nil
+		}
+		action.Action = "removed container, its image is gone too"
+		if c.dryRunf("remove container %s, its snapshot and image are gone", container.ID()) {
+			return action, true, nil
+		}
+		// The task can't run without a root filesystem
+		if task, err := container.Task(ctx, nil); err == nil {
+			task.Delete(ctx, containerd.WithProcessKill)
+		}
+		if err := container.Delete(ctx); err != nil {
+			return action, false, errors.Wrap(err, "failed to remove container")
+		}
+		return action, true, nil
+	}
+
+	if c.dryRunf("rebuild snapshot %s of container %s from image %s", info.SnapshotKey, container.ID(), info.Image) {
+		return action, false, nil
+	}
+	// Keep the unpacked layers from being collected before the snapshot references them
+	ctx, done, err := c.client.WithLease(ctx)
+	if err != nil {
+		return action, false, errors.Wrap(err, "failed to create lease")
+	}
+	defer done(ctx)
+
+	unpacked, err := image.IsUnpacked(ctx, info.Snapshotter)
+	if err != nil {
+		return action, false, errors.Wrap(err, "failed to check image")
+	}
+	if !unpacked {
+		if err := image.Unpack(ctx, info.Snapshotter); err != nil {
+			return action, false, errors.Wrap(err, "failed to unpack image")
+		}
+	}
+	diffIDs, err := image.RootFS(ctx)
+	if err != nil {
+		return action, false, errors.Wrap(err, "failed to get image layers")
+	}
+	parent := identity.ChainID(diffIDs).String()
+	if _, err := c.client.SnapshotService(info.Snapshotter).Prepare(ctx, info.SnapshotKey, parent); err != nil {
+		return action, false, errors.Wrap(err, "failed to prepare snapshot")
+	}
+	return action, false, nil
+}
+
+// isContainerSnapshot reports whether a snapshot key was created by this
+// client, for a container's root filesystem or a diff view of it
+func isContainerSnapshot(key string) bool {
+	return strings.HasSuffix(key, "-snapshot") || strings.Contains(key, "-snapshot-diff-")
+}
+
+// removeOrphanedSnapshots removes the container snapshots of a snapshotter
+// that no container uses. Image layers and snapshots of other clients are left alone.
+func (c *Client) removeOrphanedSnapshots(ctx context.Context, snapshotter string, inUse map[string]bool, record func(RepairAction, error)) error {
+	service := c.client.SnapshotService(snapshotter)
+	var orphans []string
+	err := service.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind != snapshots.KindCommitted && isContainerSnapshot(info.Name) && !inUse[info.Name] {
+			orphans = append(orphans, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list snapshots")
+	}
+
+	for _, key := range orphans {
+		action := RepairAction{Snapshot: key, Problem: "snapshot of a container that no longer exists", Action: "removed snapshot"}
+		if c.dryRunf("remove orphaned snapshot %s", key) {
+			record(action, nil)
+			continue
+		}
+		err := service.Remove(ctx, key)
+		if errdefs.IsNotFound(err) {
+			err = nil
+		}
+		record(action, err)
+	}
+	return nil
+}
+
+// String describes a repair action on a single line
+func (a RepairAction) String() string {
+	subject := "container " + a.ContainerID
+	if a.ContainerID == "" {
+		subject = "snapshot " + a.Snapshot
+	}
+	line := fmt.Sprintf("%s: %s, %s", subject, a.Problem, a.Action)
+	if a.Error != "" {
+		line += " failed: " + a.Error
+	}
+	return line
+}
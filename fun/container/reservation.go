@@ -0,0 +1,182 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HostResources is an amount of CPU and memory on a host
+type HostResources struct {
+	CPUs        float64 `json:"cpus"`
+	MemoryBytes int64   `json:"memory_bytes"`
+}
+
+// HostCapacity returns the total CPU and memory of the host
+// MemoryBytes is 0 when it can't be determined
+func HostCapacity() HostResources {
+	return HostResources{
+		CPUs:        float64(runtime.NumCPU()),
+		MemoryBytes: hostMemoryBytes(),
+	}
+}
+
+// hostMemoryBytes returns the total physical memory of the host
+func hostMemoryBytes() int64 {
+	switch runtime.GOOS {
+	case "linux":
+		return meminfoBytes("MemTotal")
+	case "darwin":
+		output, err := exec.Command("sysctl", "-n", "hw.memsize").Output()
+		if err != nil {
+			return 0
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// hostMemoryAvailable returns the memory the host can currently give to new
+// workloads without swapping, 0 when it can't be determined
+func hostMemoryAvailable() int64 {
+	if runtime.GOOS != "linux" {
+		return 0
+	}
+	return meminfoBytes("MemAvailable")
+}
+
+// meminfoBytes returns a field of /proc/meminfo in bytes, 0 if it is missing
+func meminfoBytes(field string) int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == field+":" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// SetHostReservation reserves CPU and memory for the host OS and funserver itself,
+// which container placements may not use
+func (c *Client) SetHostReservation(reserved HostResources) {
+	c.mu.Lock()
+	c.reserved = reserved
+	c.mu.Unlock()
+}
+
+// Allocatable returns the resources available to containers, the host capacity
+// minus the reservation
+func (c *Client) Allocatable() HostResources {
+	c.mu.RLock()
+	reserved := c.reserved
+	c.mu.RUnlock()
+
+	capacity := HostCapacity()
+	allocatable := HostResources{
+		CPUs:        capacity.CPUs - reserved.CPUs,
+		MemoryBytes: capacity.MemoryBytes - reserved.MemoryBytes,
+	}
+	if allocatable.CPUs < 0 {
+		allocatable.CPUs = 0
+	}
+	if allocatable.MemoryBytes < 0 {
+		allocatable.MemoryBytes = 0
+	}
+	return allocatable
+}
+
+// AllocatedResources sums the CPU and memory limits of containers that are not
+// stopped by the user, preempted or on standby. Containers without limits don't count
+// towards the total.
+func (c *Client) AllocatedResources(ctx context.Context) (HostResources, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return HostResources{}, errors.Wrap(err, "failed to list containers")
+	}
+
+	var allocated HostResources
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil || labels[LabelStopped] != "" || labels[LabelPreempted] != "" || labels[LabelStandby] != "" {
+			continue
+		}
+
+		spec, err := container.Spec(ctx)
+		if err != nil || spec.Linux == nil || spec.Linux.Resources == nil {
+			continue
+		}
+		resources := spec.Linux.Resources
+
+		if cpu := resources.CPU; cpu != nil && cpu.Quota != nil && *cpu.Quota > 0 && cpu.Period != nil && *cpu.Period > 0 {
+			allocated.CPUs += float64(*cpu.Quota) / float64(*cpu.Period)
+		}
+		if mem := resources.Memory; mem != nil && mem.Limit != nil && *mem.Limit > 0 {
+			allocated.MemoryBytes += *mem.Limit
+		}
+	}
+
+	return allocated, nil
+}
+
+// checkAllocatable refuses placements whose limits would exceed the allocatable
+// resources with an AdmissionError. Admitted placements whose containers don't
+// exist yet count as allocated.
+// The caller must hold placementMutex so concurrent creates can't both fit
+func (c *Client) checkAllocatable(ctx context.Context, limits ResourceLimits) error {
+	if limits.CPUs == 0 && limits.Memory == 0 {
+		return nil
+	}
+
+	allocatable := c.Allocatable()
+	allocated, err := c.AllocatedResources(ctx)
+	if err != nil {
+		return err
+	}
+	pending := c.pendingPlacements()
+	allocated.CPUs += pending.CPUs
+	allocated.MemoryBytes += pending.MemoryBytes
+
+	if limits.CPUs > 0 && allocated.CPUs+limits.CPUs > allocatable.CPUs {
+		return &AdmissionError{
+			Resource:  AdmissionCPU,
+			Requested: limits.CPUs,
+			Available: allocatable.CPUs - allocated.CPUs,
+			Reason: fmt.Sprintf("requested %.2f, %.2f of %.2f allocatable CPUs in use",
+				limits.CPUs, allocated.CPUs, allocatable.CPUs),
+		}
+	}
+	// Skip the memory check if the host memory is unknown
+	if limits.Memory > 0 && allocatable.MemoryBytes > 0 && allocated.MemoryBytes+limits.Memory > allocatable.MemoryBytes {
+		return &AdmissionError{
+			Resource:  AdmissionMemory,
+			Requested: float64(limits.Memory),
+			Available: float64(allocatable.MemoryBytes - allocated.MemoryBytes),
+			Reason: fmt.Sprintf("requested %d bytes, %d of %d allocatable bytes in use",
+				limits.Memory, allocated.MemoryBytes, allocatable.MemoryBytes),
+		}
+	}
+	return nil
+}
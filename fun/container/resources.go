@@ -0,0 +1,282 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// LabelEgressRate stores a container's egress bandwidth limit in bits per second,
+// since traffic shaping is applied to the network interface on every start
+const LabelEgressRate = "fun.egress-rate"
+
+// LabelCpusetCPUs and LabelCpusetMems record a container's CPU pinning, so the
+// desired state can be compared with it
+const (
+	LabelCpusetCPUs = "fun.cpuset-cpus"
+	LabelCpusetMems = "fun.cpuset-mems"
+)
+
+// ThrottleDevice limits the I/O rate (bytes or operations per second) of a block device
+type ThrottleDevice struct {
+	Path string
+	Rate uint64
+}
+
+// ResourceLimits constrains the resources a container may use
+type ResourceLimits struct {
+	// CPUs is the number of CPUs, e.g. 1.5
+	CPUs float64
+	// CpusetCPUs pins the container to CPUs, e.g. "0-3,8"
+	CpusetCPUs string
+	// CpusetMems restricts memory allocation to NUMA nodes, e.g. "0"
+	CpusetMems string
+	// Memory is the memory limit in bytes
+	Memory int64
+	// MemorySwap is the memory plus swap limit in bytes like Docker's --memory-swap,
+	// -1 allows unlimited swap and 0 defaults to twice Memory
+	MemorySwap int64
+
+	// BlkioWeight is the relative block I/O weight, 10 to 1000
+	BlkioWeight uint16
+	// Device throttles in bytes or operations per second
+	DeviceReadBps   []ThrottleDevice
+	DeviceWriteBps  []ThrottleDevice
+	DeviceReadIOps  []ThrottleDevice
+	DeviceWriteIOps []ThrottleDevice
+
+	// EgressRate limits outgoing network traffic in bits per second
+	EgressRate uint64
+}
+
+// ParseByteSize parses sizes such as "512m", "2g" or "1048576" into bytes
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "b")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// ParseBandwidth parses rates in tc notation such as "10mbit", "500kbit" or "1gbit"
+// into bits per second, a bare number is bits per second
+func ParseBandwidth(s string) (uint64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "bit")
+	value = strings.TrimSuffix(value, "bps")
+
+	multiplier := uint64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k':
+			multiplier = 1000
+		case 'm':
+			multiplier = 1000 * 1000
+		case 'g':
+			multiplier = 1000 * 1000 * 1000
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 10mbit", s)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
+
+// ParseThrottleDevice parses a "path:rate" device throttle, where rate is a byte size
+// for bandwidth limits or a plain number for IOPS limits
+func ParseThrottleDevice(spec string) (ThrottleDevice, error) {
+	path, rate, ok := strings.Cut(spec, ":")
+	if !ok || path == "" || rate == "" {
+		return ThrottleDevice{}, fmt.Errorf("invalid device throttle %q, expected path:rate", spec)
+	}
+	n, err := ParseByteSize(rate)
+	if err != nil {
+		return ThrottleDevice{}, err
+	}
+	return ThrottleDevice{Path: path, Rate: uint64(n)}, nil
+}
+
+// validate checks the limits for values the kernel would reject
+func (r ResourceLimits) validate() error {
+	if r.CPUs < 0 {
+		return errors.New("CPUs must not be negative")
+	}
+	if r.MemorySwap > 0 && r.Memory == 0 {
+		return errors.New("a memory limit is required to limit swap")
+	}
+	if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+		return errors.New("memory+swap limit must not be lower than the memory limit")
+	}
+	if r.BlkioWeight != 0 && (r.BlkioWeight < 10 || r.BlkioWeight > 1000) {
+		return errors.New("blkio weight must be between 10 and 1000")
+	}
+	if r.CpusetCPUs != "" || r.CpusetMems != "" {
+		if err := DetectTopology().Validate(r.CpusetCPUs, r.CpusetMems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// specOpts converts the limits into OCI spec options
+func (r ResourceLimits) specOpts() ([]oci.SpecOpts, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []oci.SpecOpts
+	if r.CPUs > 0 {
+		period := uint64(100000)
+		opts = append(opts, oci.WithCPUCFS(int64(r.CPUs*float64(period)), period))
+	}
+	if r.CpusetCPUs != "" {
+		opts = append(opts, oci.WithCPUs(r.CpusetCPUs))
+	}
+	if r.CpusetMems != "" {
+		opts = append(opts, oci.WithCPUsMems(r.CpusetMems))
+	}
+	if r.Memory > 0 {
+		opts = append(opts, oci.WithMemoryLimit(uint64(r.Memory)))
+
+		// Like Docker, swap defaults to the size of the memory limit
+		swap := r.MemorySwap
+		if swap == 0 {
+			swap = 2 * r.Memory
+		}
+		opts = append(opts, withMemorySwap(swap))
+	}
+
+	blkio, err := r.blockIO()
+	if err != nil {
+		return nil, err
+	}
+	if blkio != nil {
+		opts = append(opts, withBlockIO(blkio))
+	}
+
+	return opts, nil
+}
+
+// blockIO builds the blkio resources, resolving device paths to major:minor numbers
+func (r ResourceLimits) blockIO() (*specs.LinuxBlockIO, error) {
+	if r.BlkioWeight == 0 && len(r.DeviceReadBps)+len(r.DeviceWriteBps)+len(r.DeviceReadIOps)+len(r.DeviceWriteIOps) == 0 {
+		return nil, nil
+	}
+
+	blkio := &specs.LinuxBlockIO{}
+	if r.BlkioWeight != 0 {
+		weight := r.BlkioWeight
+		blkio.Weight = &weight
+	}
+
+	for _, t := range []struct {
+		devices []ThrottleDevice
+		target  *[]specs.LinuxThrottleDevice
+	}{
+		{r.DeviceReadBps, &blkio.ThrottleReadBpsDevice},
+		{r.DeviceWriteBps, &blkio.ThrottleWriteBpsDevice},
+		{r.DeviceReadIOps, &blkio.ThrottleReadIOPSDevice},
+		{r.DeviceWriteIOps, &blkio.ThrottleWriteIOPSDevice},
+	} {
+		for _, device := range t.devices {
+			major, minor, err := deviceNumbers(device.Path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to resolve device %s", device.Path)
+			}
+			throttle := specs.LinuxThrottleDevice{Rate: device.Rate}
+			throttle.Major = major
+			throttle.Minor = minor
+			*t.target = append(*t.target, throttle)
+		}
+	}
+
+	return blkio, nil
+}
+
+// withMemorySwap sets the memory plus swap limit, -1 meaning unlimited
+func withMemorySwap(swap int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		ensureLinuxResources(s)
+		if s.Linux.Resources.Memory == nil {
+			s.Linux.Resources.Memory = &specs.LinuxMemory{}
+		}
+		s.Linux.Resources.Memory.Swap = &swap
+		return nil
+	}
+}
+
+// withBlockIO sets the block I/O weight and throttles
+func withBlockIO(blkio *specs.LinuxBlockIO) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		ensureLinuxResources(s)
+		s.Linux.Resources.BlockIO = blkio
+		return nil
+	}
+}
+
+// ensureLinuxResources makes sure the spec has a Linux resources section
+func ensureLinuxResources(s *oci.Spec) {
+	if s.Linux == nil {
+		s.Linux = &specs.Linux{}
+	}
+	if s.Linux.Resources == nil {
+		s.Linux.Resources = &specs.LinuxResources{}
+	}
+}
+
+// applyEgressLimit shapes outgoing traffic on the container's interface with a token
+// bucket filter, entering the task's network namespace with nsenter
+func applyEgressLimit(ctx context.Context, pid uint32, rate uint64) error {
+	if _, err := exec.LookPath("tc"); err != nil {
+		return errors.New("tc is required for egress limits but was not found")
+	}
+
+	// Allow bursts of roughly 10ms of traffic, with a floor so small rates still work
+	burst := rate / 8 / 100
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+
+	cmd := exec.CommandContext(ctx, "nsenter", "--net=/proc/"+strconv.FormatUint(uint64(pid), 10)+"/ns/net",
+		"tc", "qdisc", "replace", "dev", cniInterfaceName, "root", "tbf",
+		"rate", strconv.FormatUint(rate, 10)+"bit",
+		"burst", strconv.FormatUint(burst, 10),
+		"latency", "50ms",
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// Labels used by the restart supervisor
+const (
+	LabelRestartPolicy = "fun.restart-policy"
+	LabelRestartState  = "fun.restart-state"
+	// LabelStopped marks containers stopped by the user so they are not restarted
+	LabelStopped = "fun.stopped"
+)
+
+// Restart policies, matching Docker's names
+const (
+	RestartNo            = "no"
+	RestartAlways        = "always"
+	RestartOnFailure     = "on-failure"
+	RestartUnlessStopped = "unless-stopped"
+)
+
+// ParseRestartPolicy validates a restart policy name, defaulting to "no"
+func ParseRestartPolicy(policy string) (string, error) {
+	switch p := strings.ToLower(policy); p {
+	case "":
+		return RestartNo, nil
+	case RestartNo, RestartAlways, RestartOnFailure, RestartUnlessStopped:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %q, expected no, always, on-failure or unless-stopped", policy)
+}
+
+// RestartBackoff controls how quickly failed containers are restarted
+type RestartBackoff struct {
+	// InitialDelay is the delay before the first restart, doubled for each restart within Window
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between restarts
+	MaxDelay time.Duration
+	// MaxRestarts within Window trips the circuit breaker and marks the container crash-looping
+	MaxRestarts int
+	// Window is how far back restarts are counted
+	Window time.Duration
+}
+
+// DefaultRestartBackoff returns the default restart backoff
+func DefaultRestartBackoff() RestartBackoff {
+	return RestartBackoff{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Minute,
+		MaxRestarts:  5,
+		Window:       10 * time.Minute,
+	}
+}
+
+// RestartState is the restart history of a container, persisted in LabelRestartState
+type RestartState struct {
+	RestartCount int       `json:"restart_count"`
+	CrashLooping bool      `json:"crash_looping"`
+	LastRestart  time.Time `json:"last_restart,omitempty"`
+}
+
+// restartTracker holds the in-memory backoff state of one container
+type restartTracker struct {
+	history     []time.Time
+	nextAttempt time.Time
+	unhealthy   bool
+	state       RestartState
+}
+
+// RestartSupervisor restarts exited containers according to their restart policy
+type RestartSupervisor struct {
+	client     *Client
+	backoff    RestartBackoff
+	mutex      sync.Mutex
+	containers map[string]*restartTracker
+}
+
+// NewRestartSupervisor creates a restart supervisor
+func NewRestartSupervisor(client *Client, backoff RestartBackoff) *RestartSupervisor {
+	return &RestartSupervisor{
+		client:     client,
+		backoff:    backoff,
+		containers: make(map[string]*restartTracker),
+	}
+}
+
+// Run checks containers once per second until the context is cancelled
+func (s *RestartSupervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkAll(ctx)
+		}
+	}
+}
+
+// RestartUnhealthy stops a container that failed its probes and schedules a restart
+// through the same backoff as crashed containers
+func (s *RestartSupervisor) RestartUnhealthy(ctx context.Context, containerID string) error {
+	s.mutex.Lock()
+	s.tracker(containerID).unhealthy = true
+	s.mutex.Unlock()
+
+	container, err := s.client.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to get task")
+	}
+	return stopTask(ctx, task, 10*time.Second)
+}
+
+// Status returns the restart state of a container
+func (s *RestartSupervisor) Status(containerID string) (RestartState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t, ok := s.containers[containerID]
+	if !ok {
+		return RestartState{}, false
+	}
+	return t.state, true
+}
+
+// tracker returns the tracker for a container, creating it if needed
+// The caller must hold the mutex
+func (s *RestartSupervisor) tracker(containerID string) *restartTracker {
+	t, ok := s.containers[containerID]
+	if !ok {
+		t = &restartTracker{}
+		s.containers[containerID] = t
+	}
+	return t
+}
+
+// delay returns the backoff before the next restart given the recent restart count
+func (s *RestartSupervisor) delay(recent int) time.Duration {
+	delay := s.backoff.InitialDelay
+	for i := 0; i < recent && delay < s.backoff.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.backoff.MaxDelay {
+		delay = s.backoff.MaxDelay
+	}
+	return delay
+}
+
+// checkAll restarts exited containers whose backoff has elapsed
+func (s *RestartSupervisor) checkAll(ctx context.Context) {
+	containers, err := s.client.GetContainers(ctx)
+	if err != nil {
+		log.Printf("Restart supervisor: failed to list containers: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		seen[container.ID()] = true
+		if err := s.check(ctx, container); err != nil {
+			log.Printf("Restart supervisor: container %s: %v", container.ID(), err)
+		}
+	}
+
+	s.mutex.Lock()
+	for id := range s.containers {
+		if !seen[id] {
+			delete(s.containers, id)
+		}
+	}
+	s.mutex.Unlock()
+}
+
+// check restarts a single container if its policy and backoff allow it
+func (s *RestartSupervisor) check(ctx context.Context, container containerd.Container) error {
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		// Never started
+		return nil
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status != containerd.Stopped {
+		return nil
+	}
+
+	s.mutex.Lock()
+	t := s.tracker(container.ID())
+	if t.state.RestartCount == 0 && labels[LabelRestartState] != "" {
+		json.Unmarshal([]byte(labels[LabelRestartState]), &t.state)
+	}
+
+	if labels[LabelStopped] != "" || labels[LabelDrained] != "" || labels[LabelPreempted] != "" || labels[LabelStandby] != "" || !shouldRestart(labels[LabelRestartPolicy], status.ExitStatus, t.unhealthy) {
+		t.unhealthy = false
+		s.mutex.Unlock()
+		return nil
+	}
+
+	// Only restarts within the window count towards the backoff and circuit breaker
+	now := time.Now()
+	var recent []time.Time
+	for _, at := range t.history {
+		if now.Sub(at) < s.backoff.Window {
+			recent = append(recent, at)
+		}
+	}
+	t.history = recent
+
+	if len(t.history) >= s.backoff.MaxRestarts {
+		changed := !t.state.CrashLooping
+		t.state.CrashLooping = true
+		state := t.state
+		s.mutex.Unlock()
+		if changed {
+			log.Printf("Restart supervisor: container %s is crash-looping, %d restarts in %s", container.ID(), len(recent), s.backoff.Window)
+			s.client.mu.RLock()
+			hook := s.client.crashLoopHook
+			s.client.mu.RUnlock()
+			if hook != nil {
+				hook(container.ID())
+			}
+			return s.saveState(ctx, container, state)
+		}
+		return nil
+	}
+
+	if t.nextAttempt.IsZero() {
+		t.nextAttempt = now.Add(s.delay(len(t.history)))
+	}
+	if now.Before(t.nextAttempt) {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	t.history = append(t.history, now)
+	t.nextAttempt = time.Time{}
+	t.unhealthy = false
+	t.state.RestartCount++
+	t.state.CrashLooping = false
+	t.state.LastRestart = now
+	state := t.state
+	s.mutex.Unlock()
+
+	log.Printf("Restart supervisor: restarting container %s (exit code %d, restart %d)", container.ID(), status.ExitStatus, state.RestartCount)
+	if err := s.saveState(ctx, container, state); err != nil {
+		return err
+	}
+	return s.client.StartContainer(ctx, container.ID())
+}
+
+// shouldRestart reports whether an exited container should be restarted
+func shouldRestart(policy string, exitCode uint32, unhealthy bool) bool {
+	switch policy {
+	case RestartAlways, RestartUnlessStopped:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 || unhealthy
+	}
+	// Liveness failures restart the container even without a policy, like Kubernetes
+	return unhealthy
+}
+
+// saveState persists the restart state in the container's labels
+func (s *RestartSupervisor) saveState(ctx context.Context, container containerd.Container, state RestartState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal restart state")
+	}
+	_, err = container.SetLabels(ctx, map[string]string{LabelRestartState: string(data)})
+	return err
+}
+
+// restartStateFromLabels decodes the restart state stored on a container
+func restartStateFromLabels(labels map[string]string) RestartState {
+	var state RestartState
+	if data := labels[LabelRestartState]; data != "" {
+		json.Unmarshal([]byte(data), &state)
+	}
+	return state
+}
@@ -0,0 +1,287 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SBOM package types
+const (
+	PackageTypeDeb   = "deb"
+	PackageTypeAPK   = "apk"
+	PackageTypeMount = "mount"
+)
+
+// SBOM is the software bill of materials of a container, its image packages plus
+// the host content mounted into it
+type SBOM struct {
+	ContainerID string        `json:"container_id"`
+	Image       string        `json:"image"`
+	ImageDigest string        `json:"image_digest"`
+	OS          string        `json:"os,omitempty"`
+	Created     time.Time     `json:"created"`
+	Packages    []SBOMPackage `json:"packages"`
+}
+
+// SBOMPackage is a component of a container
+type SBOMPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Type    string `json:"type"`
+	Arch    string `json:"arch,omitempty"`
+	// Source is the host path of mounted content
+	Source string `json:"source,omitempty"`
+}
+
+// sbomFiles are the package databases and release files read from image layers
+var sbomFiles = map[string]bool{
+	"var/lib/dpkg/status":  true,
+	"lib/apk/db/installed": true,
+	"etc/os-release":       true,
+	"usr/lib/os-release":   true,
+}
+
+// dpkgStatusDir holds one status file per package on distroless images
+const dpkgStatusDir = "var/lib/dpkg/status.d/"
+
+// ContainerSBOM builds the software bill of materials of a container from the
+// package databases in its image layers and its bind mounts
+func (c *Client) ContainerSBOM(ctx context.Context, containerID string) (*SBOM, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load container")
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get container info")
+	}
+
+	image, err := c.client.GetImage(ctx, info.Image)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get container image")
+	}
+
+	store := c.client.ContentStore()
+	manifest, err := images.Manifest(ctx, store, image.Target(), platforms.Default())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image manifest")
+	}
+
+	// Later layers override earlier ones, so keep the last version of each file
+	files := make(map[string][]byte)
+	for _, layer := range manifest.Layers {
+		if err := readLayerFiles(ctx, store, layer, files); err != nil {
+			return nil, errors.Wrapf(err, "failed to read layer %s", layer.Digest)
+		}
+	}
+
+	sbom := &SBOM{
+		ContainerID: containerID,
+		Image:       info.Image,
+		ImageDigest: image.Target().Digest.String(),
+		Created:     time.Now(),
+		Packages:    []SBOMPackage{},
+	}
+
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if data, ok := files[name]; ok {
+			sbom.OS = osReleaseName(data)
+			break
+		}
+	}
+
+	var statusFiles []string
+	for name := range files {
+		if name == "var/lib/dpkg/status" || strings.HasPrefix(name, dpkgStatusDir) {
+			statusFiles = append(statusFiles, name)
+		}
+	}
+	sort.Strings(statusFiles)
+	for _, name := range statusFiles {
+		sbom.Packages = append(sbom.Packages, parseDpkgStatus(files[name])...)
+	}
+	if data, ok := files["lib/apk/db/installed"]; ok {
+		sbom.Packages = append(sbom.Packages, parseAPKInstalled(data)...)
+	}
+
+	if spec, err := container.Spec(ctx); err == nil {
+		for _, mount := range spec.Mounts {
+			if mount.Type != "bind" && !containsString(mount.Options, "bind") && !containsString(mount.Options, "rbind") {
+				continue
+			}
+			sbom.Packages = append(sbom.Packages, SBOMPackage{
+				Name:   mount.Destination,
+				Type:   PackageTypeMount,
+				Source: mount.Source,
+			})
+		}
+	}
+
+	return sbom, nil
+}
+
+// readLayerFiles extracts the SBOM relevant files of a layer into files, applying whiteouts
+func readLayerFiles(ctx context.Context, store content.Store, layer ocispec.Descriptor, files map[string][]byte) error {
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	stream, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		dir, base := path.Split(name)
+
+		// An opaque whiteout hides everything the lower layers had in the directory
+		if base == ".wh..wh..opq" {
+			for existing := range files {
+				if strings.HasPrefix(existing, dir) {
+					delete(files, existing)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			removed := dir + strings.TrimPrefix(base, ".wh.")
+			for existing := range files {
+				if existing == removed || strings.HasPrefix(existing, removed+"/") {
+					delete(files, existing)
+				}
+			}
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg || (!sbomFiles[name] && !strings.HasPrefix(name, dpkgStatusDir)) {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		files[name] = data
+	}
+}
+
+// parseDpkgStatus returns the installed packages of a dpkg status file
+func parseDpkgStatus(data []byte) []SBOMPackage {
+	var packages []SBOMPackage
+	for _, stanza := range bytes.Split(data, []byte("\n\n")) {
+		fields := controlFields(stanza)
+		if fields["Package"] == "" {
+			continue
+		}
+		// Status is missing in status.d files, which only list installed packages
+		if status := fields["Status"]; status != "" && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		packages = append(packages, SBOMPackage{
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Arch:    fields["Architecture"],
+			Type:    PackageTypeDeb,
+		})
+	}
+	return packages
+}
+
+// controlFields parses the "Key: value" lines of a debian control stanza
+func controlFields(stanza []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(stanza))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Continuation lines of multi-line fields start with a space
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
+
+// parseAPKInstalled returns the packages of an apk installed database
+func parseAPKInstalled(data []byte) []SBOMPackage {
+	var packages []SBOMPackage
+	var current SBOMPackage
+	flush := func() {
+		if current.Name != "" {
+			current.Type = PackageTypeAPK
+			packages = append(packages, current)
+		}
+		current = SBOMPackage{}
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			current.Name = value
+		case "V":
+			current.Version = value
+		case "A":
+			current.Arch = value
+		}
+	}
+	flush()
+	return packages
+}
+
+// osReleaseName returns the PRETTY_NAME of an os-release file
+func osReleaseName(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
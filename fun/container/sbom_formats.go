@@ -0,0 +1,202 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SBOM output formats
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+// spdxDocument is an SPDX 2.3 JSON document
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// cycloneDXDocument is a CycloneDX 1.5 JSON document
+type cycloneDXDocument struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Encode renders the SBOM in the given format
+func (s *SBOM) Encode(format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case "", SBOMFormatSPDX:
+		return json.MarshalIndent(s.spdx(), "", "  ")
+	case SBOMFormatCycloneDX:
+		return json.MarshalIndent(s.cycloneDX(), "", "  ")
+	}
+	return nil, fmt.Errorf("invalid SBOM format %q, expected spdx or cyclonedx", format)
+}
+
+// spdx converts the SBOM to an SPDX document
+func (s *SBOM) spdx() *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.ContainerID,
+		DocumentNamespace: fmt.Sprintf("https://thefunserver.com/spdx/%s/%s", url.PathEscape(s.ContainerID), s.Created.UTC().Format("20060102T150405Z")),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: fun"},
+		},
+	}
+
+	doc.Packages = append(doc.Packages, spdxPackage{
+		Name:             s.Image,
+		SPDXID:           "SPDXRef-Image",
+		VersionInfo:      s.ImageDigest,
+		DownloadLocation: "NOASSERTION",
+		Comment:          s.OS,
+	})
+	doc.Relationships = append(doc.Relationships, spdxRelationship{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: "SPDXRef-Image",
+	})
+
+	for i, p := range s.Packages {
+		pkg := spdxPackage{
+			Name:             p.Name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+		}
+		if p.Type == PackageTypeMount {
+			pkg.Comment = "mounted from host path " + p.Source
+		}
+		if purl := p.purl(s.OS); purl != "" {
+			pkg.ExternalRefs = []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: pkg.SPDXID,
+		})
+	}
+
+	return doc
+}
+
+// cycloneDX converts the SBOM to a CycloneDX document
+func (s *SBOM) cycloneDX() *cycloneDXDocument {
+	doc := &cycloneDXDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: s.Created.UTC().Format(time.RFC3339),
+			Component: cycloneDXComponent{
+				Type:    "container",
+				Name:    s.Image,
+				Version: s.ImageDigest,
+			},
+		},
+		Components: []cycloneDXComponent{},
+	}
+
+	for _, p := range s.Packages {
+		component := cycloneDXComponent{
+			Type:    "library",
+			Name:    p.Name,
+			Version: p.Version,
+			PURL:    p.purl(s.OS),
+		}
+		if p.Type == PackageTypeMount {
+			component.Type = "data"
+			component.Properties = []cycloneDXProperty{{Name: "fun:mount:source", Value: p.Source}}
+		}
+		doc.Components = append(doc.Components, component)
+	}
+
+	return doc
+}
+
+// purl returns the package URL of an OS package, empty for mounts
+func (p SBOMPackage) purl(osName string) string {
+	var purl string
+	switch p.Type {
+	case PackageTypeDeb:
+		namespace := "debian"
+		if strings.Contains(strings.ToLower(osName), "ubuntu") {
+			namespace = "ubuntu"
+		}
+		purl = fmt.Sprintf("pkg:deb/%s/%s@%s", namespace, url.PathEscape(p.Name), url.PathEscape(p.Version))
+	case PackageTypeAPK:
+		purl = fmt.Sprintf("pkg:apk/alpine/%s@%s", url.PathEscape(p.Name), url.PathEscape(p.Version))
+	default:
+		return ""
+	}
+	if p.Arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.Arch)
+	}
+	return purl
+}
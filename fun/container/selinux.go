@@ -0,0 +1,203 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// SELinux labels of containers, matching container-selinux on Fedora and RHEL
+const (
+	selinuxProcessLabel = "system_u:system_r:container_t:s0"
+	selinuxFileLabel    = "system_u:object_r:container_file_t:s0"
+)
+
+// SELinux relabel options of bind mounts, as in Docker and Podman
+const (
+	// MountOptionShared relabels the source so that all containers can use it
+	MountOptionShared = "z"
+	// MountOptionPrivate relabels the source so that only this container can use it
+	MountOptionPrivate = "Z"
+)
+
+// selinuxProtectedPaths are never relabeled, doing so would break the host
+var selinuxProtectedPaths = []string{"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/proc",
+	"/root", "/run", "/sbin", "/sys", "/tmp", "/usr", "/var"}
+
+// SELinuxMode returns enforcing, permissive or disabled for the host's SELinux
+func SELinuxMode() string {
+	data, err := os.ReadFile("/sys/fs/selinux/enforce")
+	if err != nil {
+		return "disabled"
+	}
+	if strings.TrimSpace(string(data)) == "1" {
+		return "enforcing"
+	}
+	return "permissive"
+}
+
+// SELinuxEnabled reports whether SELinux is enforcing or permissive on the host
+func SELinuxEnabled() bool {
+	return SELinuxMode() != "disabled"
+}
+
+// ParseBindMode converts the mode of a host:container[:mode] bind, such as
+// "ro" or "ro,Z", to mount options
+func ParseBindMode(mode string) ([]string, error) {
+	options := []string{"rbind", "rw"}
+	if mode == "" {
+		return options, nil
+	}
+	for _, option := range strings.Split(mode, ",") {
+		switch option {
+		case "ro", "rw":
+			options[1] = option
+		case MountOptionShared, MountOptionPrivate:
+			options = append(options, option)
+		case "consistent", "cached", "delegated", "nocopy":
+			// Docker Desktop's hints for file sharing, binds are native here
+		default:
+			return nil, fmt.Errorf("invalid volume mode %s", option)
+		}
+	}
+	return options, nil
+}
+
+// selinuxCategories returns a random pair of MCS categories for a container
+// with private mounts
+func selinuxCategories() (string, error) {
+	first, err := rand.Int(rand.Reader, big.NewInt(1024))
+	if err != nil {
+		return "", err
+	}
+	second, err := rand.Int(rand.Reader, big.NewInt(1023))
+	if err != nil {
+		return "", err
+	}
+	c1, c2 := first.Int64(), second.Int64()
+	if c2 >= c1 {
+		c2++
+	} else {
+		c1, c2 = c2, c1
+	}
+	return fmt.Sprintf("c%d,c%d", c1, c2), nil
+}
+
+// relabelPath sets the SELinux label of path and everything below it
+func relabelPath(path, label string) error {
+	clean := filepath.Clean(path)
+	for _, protected := range selinuxProtectedPaths {
+		if clean == protected {
+			return fmt.Errorf("relabeling %s for SELinux would break the host, bind a subdirectory instead", path)
+		}
+	}
+	if output, err := exec.Command("chcon", "-R", label, clean).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to relabel %s for SELinux: %s", path, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// relabelMounts strips the z and Z options from mounts and, when SELinux is
+// enabled, relabels their sources for containers. It returns the SELinux label
+// the container process runs with, empty if SELinux is disabled or no mount
+// asked for relabeling, which keeps the runtime's default label.
+// Private mounts get a pair of categories of their own, so the container runs
+// with those categories too and other containers can't read them.
+func relabelMounts(mounts []specs.Mount) ([]specs.Mount, string, error) {
+	var shared, private []string
+	result := make([]specs.Mount, 0, len(mounts))
+	for _, mount := range mounts {
+		var options []string
+		for _, option := range mount.Options {
+			switch option {
+			case MountOptionShared:
+				shared = append(shared, mount.Source)
+			case MountOptionPrivate:
+				private = append(private, mount.Source)
+			default:
+				options = append(options, option)
+			}
+		}
+		mount.Options = options
+		result = append(result, mount)
+	}
+
+	if !SELinuxEnabled() || len(shared)+len(private) == 0 {
+		return result, "", nil
+	}
+
+	for _, source := range shared {
+		if err := relabelPath(source, selinuxFileLabel); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(private) == 0 {
+		return result, selinuxProcessLabel, nil
+	}
+
+	categories, err := selinuxCategories()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to allocate SELinux categories")
+	}
+	for _, source := range private {
+		if err := relabelPath(source, selinuxFileLabel+":"+categories); err != nil {
+			return nil, "", err
+		}
+	}
+	return result, selinuxProcessLabel + ":" + categories, nil
+}
+
+// SELinuxFileLabel returns the SELinux label of a file
+func SELinuxFileLabel(path string) (string, error) {
+	output, err := exec.Command("stat", "-c", "%C", path).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the SELinux label of %s", path)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SELinuxDenials returns recent SELinux denials involving containers, from
+// ausearch or the audit log
+func SELinuxDenials(ctx context.Context) ([]string, error) {
+	var lines []string
+	if output, err := exec.CommandContext(ctx, "ausearch", "-m", "AVC,USER_AVC", "-ts", "recent").Output(); err == nil {
+		lines = strings.Split(string(output), "\n")
+	} else {
+		file, err := os.Open("/var/log/audit/audit.log")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the audit log")
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "failed to read the audit log")
+		}
+	}
+
+	var denials []string
+	for _, line := range lines {
+		if !strings.Contains(line, "denied") {
+			continue
+		}
+		for _, marker := range []string{"container_t", "containerd", "runc", `comm="fun"`} {
+			if strings.Contains(line, marker) {
+				denials = append(denials, line)
+				break
+			}
+		}
+	}
+	return denials, nil
+}
@@ -2,7 +2,9 @@ package container
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,6 +13,8 @@ import (
 	"sync"
 	"time"
 
+	"fun/audit"
+
 	"github.com/pkg/errors"
 )
 
@@ -28,6 +32,19 @@ type ServerConfig struct {
 	LogLevel string
 	// Log file path
 	LogFile string
+	// EnableCRI exposes the Kubernetes CRI API on the containerd socket
+	EnableCRI bool
+	// SandboxImage is the pause image used for CRI pod sandboxes
+	SandboxImage string
+	// SystemdCgroup makes runc manage CRI pod cgroups through systemd
+	SystemdCgroup bool
+	// SocketGID is the group given access to the containerd socket, 0 keeps root's group
+	SocketGID int
+	// Audit records security events such as tampered bundled binaries, nil disables it
+	Audit *audit.Logger
+	// Native runs containerd on the Windows host itself, rather than in the
+	// WSL2 distribution, for Windows containers only
+	Native bool
 }
 
 // Server represents a containerd server instance
@@ -41,6 +58,8 @@ type Server struct {
 	wsl2Config     WSL2Config
 	vmRunning      bool
 	wslRunning     bool
+	// releaseChild frees the supervision resources of the containerd process
+	releaseChild func()
 }
 
 // DefaultServerConfig returns a default server configuration
@@ -55,13 +74,16 @@ func DefaultServerConfig() ServerConfig {
 		defaultSocket = filepath.Join(dataDir, "containerd.sock")
 	}
 
+	driver, _ := ResolveCgroupDriver("")
+
 	return ServerConfig{
-		Root:     filepath.Join(dataDir, "root"),
-		State:    filepath.Join(dataDir, "state"),
-		Address:  defaultSocket,
-		Config:   "",
-		LogLevel: "info",
-		LogFile:  filepath.Join(dataDir, "containerd.log"),
+		Root:          filepath.Join(dataDir, "root"),
+		State:         filepath.Join(dataDir, "state"),
+		Address:       defaultSocket,
+		Config:        "",
+		LogLevel:      "info",
+		LogFile:       filepath.Join(dataDir, "containerd.log"),
+		SystemdCgroup: driver == CgroupDriverSystemd,
 	}
 }
 
@@ -87,12 +109,19 @@ func NewServer(config ServerConfig) *Server {
 		config.LogFile = filepath.Join(homeDir, ".fun", "containerd", "containerd.log")
 	}
 
+	wsl2Config := DefaultWSL2Config()
+	if config.Native {
+		wsl2Config.Enabled = false
+	}
+	wsl2Config.EnableCRI = config.EnableCRI
+	wsl2Config.SandboxImage = config.SandboxImage
+
 	return &Server{
 		config:         config,
 		running:        false,
 		stopSignal:     make(chan struct{}),
 		linuxKitConfig: DefaultLinuxKitConfig(),
-		wsl2Config:     DefaultWSL2Config(),
+		wsl2Config:     wsl2Config,
 		vmRunning:      false,
 		wslRunning:     false,
 	}
@@ -163,6 +192,20 @@ func (s *Server) Start(ctx context.Context) error {
 		log.Printf("Using native Windows container runtime")
 	}
 
+	// Binaries staged while containerd was running can be swapped in now
+	if err := applyStagedBinaries(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Don't reuse bundled binaries that were modified since they were extracted,
+	// extraction would otherwise keep them as they match the shipped versions
+	if err := s.ensureBundledIntegrity(GetBundledContainerdPath(), EnsureBundledContainerdExtracted); err != nil {
+		return err
+	}
+	if err := s.ensureBundledIntegrity(GetBundledRuncPath(), EnsureBundledRuncExtracted); err != nil {
+		return err
+	}
+
 	// For non-macOS/non-WSL2 platforms, continue with normal containerd startup
 	// Ensure all bundled components are available (containerd, runc, CNI plugins)
 	// First try to extract our bundled binaries if needed
@@ -207,6 +250,9 @@ func (s *Server) Start(ctx context.Context) error {
 		if err := os.MkdirAll(filepath.Dir(s.config.Address), 0755); err != nil {
 			return errors.Wrap(err, "failed to create socket directory")
 		}
+		if err := claimSocket(s.config.Address); err != nil {
+			return err
+		}
 	}
 
 	// Ensure log directory exists
@@ -222,30 +268,43 @@ func (s *Server) Start(ctx context.Context) error {
 		"--log-level", s.config.LogLevel,
 	}
 
-	// If runc path is from our bundled binaries, tell containerd about it
-	if IsRuncInstalled() && strings.Contains(runcPath, BundledBinaryDir) {
-		args = append(args, "--runtime-type", "io.containerd.runc.v2")
-		args = append(args, "--runtime-engine", runcPath)
-	}
+	if s.config.Config != "" {
+		args = append(args, "--config", s.config.Config)
+	} else {
+		// Generate a config so bundled runc/CNI and the CRI plugin are set up consistently
+		configOpts := containerdConfigOptions{
+			SocketGID:     s.config.SocketGID,
+			EnableCRI:     s.config.EnableCRI,
+			SandboxImage:  s.config.SandboxImage,
+			SystemdCgroup: s.config.SystemdCgroup,
+		}
+
+		// If runc path is from our bundled binaries, tell containerd about it
+		if strings.Contains(runcPath, BundledBinaryDir) {
+			configOpts.RuncPath = runcPath
+		}
 
-	// If CNI plugins are available from our bundled binaries, configure their path
-	cniPath := GetCNIPath()
-	if cniPath != "" && strings.Contains(cniPath, BundledBinaryDir) {
-		args = append(args, "--cni-bin-dir", cniPath)
-		args = append(args, "--cni-conf-dir", filepath.Join(s.config.Root, "cni", "conf"))
+		// If CNI plugins are available from our bundled binaries, configure their path
+		cniPath := GetCNIPath()
+		if cniPath != "" && strings.Contains(cniPath, BundledBinaryDir) {
+			configOpts.CNIBinDir = cniPath
+			configOpts.CNIConfDir = filepath.Join(s.config.Root, "cni", "conf")
 
-		// Ensure CNI config directory exists
-		cniConfDir := filepath.Join(s.config.Root, "cni", "conf")
-		if err := os.MkdirAll(cniConfDir, 0755); err != nil {
-			return errors.Wrap(err, "failed to create CNI configuration directory")
+			// Ensure CNI config directory exists
+			if err := os.MkdirAll(configOpts.CNIConfDir, 0755); err != nil {
+				return errors.Wrap(err, "failed to create CNI configuration directory")
+			}
 		}
-	}
 
-	if s.config.Config != "" {
-		args = append(args, "--config", s.config.Config)
+		configPath := filepath.Join(filepath.Dir(s.config.Root), "config.toml")
+		if err := writeContainerdConfig(configPath, configOpts); err != nil {
+			return err
+		}
+		args = append(args, "--config", configPath)
 	}
 
 	s.cmd = exec.CommandContext(ctx, containerdPath, args...)
+	s.cmd.Env = childEnv()
 
 	// Open log file
 	logFile, err := os.OpenFile(s.config.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
@@ -257,17 +316,20 @@ func (s *Server) Start(ctx context.Context) error {
 	s.cmd.Stdout = logFile
 	s.cmd.Stderr = logFile
 
-	// Start the command
-	if err := s.cmd.Start(); err != nil {
+	// Start the command so it can't outlive or escape the daemon
+	release, err := startChild(s.cmd)
+	if err != nil {
 		logFile.Close()
 		return errors.Wrap(err, "failed to start containerd")
 	}
+	s.releaseChild = release
 
 	// Wait for the socket to become available or timeout
 	err = WaitForSocket(s.config.Address, 30*time.Second)
 	if err != nil {
 		// Try to kill the process
 		s.cmd.Process.Kill()
+		s.release()
 		logFile.Close()
 		return errors.Wrap(err, "failed waiting for containerd to start")
 	}
@@ -276,6 +338,21 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+// claimSocket makes sure no other containerd serves a Unix socket, containerd
+// replaces the socket on start and would take it over. A socket left behind
+// by a containerd that didn't exit cleanly is removed, so it isn't mistaken
+// for the new one while waiting for it to come up.
+func claimSocket(path string) error {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another containerd is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove stale containerd socket")
+	}
+	return nil
+}
+
 // Stop stops the containerd server
 func (s *Server) Stop(ctx context.Context) error {
 	s.mutex.Lock()
@@ -325,6 +402,7 @@ func (s *Server) Stop(ctx context.Context) error {
 		return errors.New("containerd did not exit gracefully, killed")
 	case err := <-done:
 		s.running = false
+		s.release()
 		if err != nil {
 			return errors.Wrap(err, "containerd exited with error")
 		}
@@ -338,6 +416,32 @@ func (s *Server) Stop(ctx context.Context) error {
 	}
 }
 
+// Restart stops and starts the containerd process, e.g. to run an upgraded binary
+// Containers keep running in their shims meanwhile and are picked up again by the
+// new process. Containerd inside the LinuxKit VM or WSL2 can't be restarted this way.
+func (s *Server) Restart(ctx context.Context) error {
+	s.mutex.Lock()
+	inGuest := s.vmRunning || s.wslRunning
+	s.mutex.Unlock()
+	if inGuest {
+		return errors.New("containerd runs inside the Linux VM or WSL2 distribution and can't be restarted on its own")
+	}
+
+	if err := s.Stop(ctx); err != nil {
+		return errors.Wrap(err, "failed to stop containerd")
+	}
+	return s.Start(ctx)
+}
+
+// release frees the supervision resources of an exited containerd process
+// The caller must hold the mutex.
+func (s *Server) release() {
+	if s.releaseChild != nil {
+		s.releaseChild()
+		s.releaseChild = nil
+	}
+}
+
 // IsRunning returns whether the containerd server is running
 func (s *Server) IsRunning() bool {
 	s.mutex.Lock()
@@ -346,12 +450,69 @@ func (s *Server) IsRunning() bool {
 	return s.running
 }
 
+// usesWSL reports whether containerd runs in the WSL2 distribution
+func (s *Server) usesWSL() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.wslRunning
+}
+
 // GetSocketAddress returns the socket address for the containerd server
 func (s *Server) GetSocketAddress() string {
 	return s.config.Address
 }
 
+// GetCRIEndpoint returns the CRI endpoint kubelets should use to reach this server
+// For VM and WSL2 backends the endpoint is only reachable from inside the VM or distribution
+func (s *Server) GetCRIEndpoint() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.config.EnableCRI {
+		return "", errors.New("CRI is not enabled for the embedded containerd server")
+	}
+
+	if s.vmRunning || s.wslRunning {
+		return GetCRIEndpoint("/run/containerd/containerd.sock"), nil
+	}
+
+	return GetCRIEndpoint(s.config.Address), nil
+}
+
 // GetLogFilePath returns the path to the containerd log file
 func (s *Server) GetLogFilePath() string {
 	return s.config.LogFile
 }
+
+// ensureBundledIntegrity verifies a binary before it is executed and re-extracts it
+// from the release if it was tampered with or truncated since extraction
+func (s *Server) ensureBundledIntegrity(path string, extract func() error) error {
+	err := VerifyBundledBinary(path)
+	var tampered *TamperedBinaryError
+	if !errors.As(err, &tampered) {
+		if err != nil {
+			log.Printf("Warning: failed to verify %s: %v", path, err)
+		}
+		return nil
+	}
+
+	log.Printf("Security: %v, re-extracting it", tampered)
+	if auditErr := s.config.Audit.Record(audit.Event{
+		Type:    audit.EventBinaryTampered,
+		Subject: path,
+		Reason:  fmt.Sprintf("sha256 %s, expected %s", tampered.Actual, tampered.Expected),
+	}); auditErr != nil {
+		log.Printf("Warning: Failed to record tampered binary in the audit log: %v", auditErr)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return errors.Wrapf(err, "failed to remove tampered binary %s", path)
+	}
+	if err := extract(); err != nil {
+		return errors.Wrapf(err, "failed to re-extract tampered binary %s", path)
+	}
+	if err := VerifyBundledBinary(path); err != nil {
+		return errors.Wrapf(err, "re-extracted binary %s failed verification", path)
+	}
+	return nil
+}
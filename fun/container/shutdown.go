@@ -0,0 +1,187 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/api/types/runc/options"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// Shutdown policies, what happens to running containers when the daemon stops
+const (
+	// ShutdownLeaveRunning leaves the containers to containerd, they keep
+	// running unless containerd stops too
+	ShutdownLeaveRunning = "leave-running"
+	// ShutdownStop stops the containers gracefully, they are started again
+	// when the daemon starts
+	ShutdownStop = "stop"
+	// ShutdownCheckpoint checkpoints the containers with CRIU and restores them
+	// when the daemon starts, containers that can't be checkpointed are stopped
+	ShutdownCheckpoint = "checkpoint"
+)
+
+// LabelCheckpoint names the checkpoint image a container is restored from on
+// its next start, the checkpoint is removed once it was used
+const LabelCheckpoint = "fun.checkpoint"
+
+// ParseShutdownPolicy validates a shutdown policy name, defaulting to ShutdownLeaveRunning
+func ParseShutdownPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return ShutdownLeaveRunning, nil
+	case ShutdownLeaveRunning, ShutdownStop, ShutdownCheckpoint:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid shutdown policy %q, expected leave-running, stop or checkpoint", policy)
+}
+
+// shutdownMargin is the time Shutdown allows on top of the stop timeout for
+// listing the containers and for each priority class, for labeling the
+// containers and for CRIU to write their checkpoints
+const shutdownMargin = 30 * time.Second
+
+// ShutdownDuration returns the longest Shutdown takes to stop the containers
+// with timeout, a timeout and a margin for each priority class
+func ShutdownDuration(timeout time.Duration) time.Duration {
+	return shutdownMargin + time.Duration(len(priorityRanks))*(timeout+shutdownMargin)
+}
+
+// shutdownCandidate is a running container the shutdown policy applies to
+type shutdownCandidate struct {
+	container containerd.Container
+	task      containerd.Task
+	rank      int
+}
+
+// Shutdown applies a shutdown policy to the running containers and returns
+// how many it stopped or checkpointed. Containers go by priority class, the
+// lowest first, so critical ones keep serving the others until they are gone;
+// the containers of a class are handled at once. Each container gets timeout
+// to stop before it is killed, and each class gets its own deadline with some
+// margin, so a slow class doesn't use up the time of the next. Like Drain, the containers are not marked as
+// stopped by the user, ResumeDrained brings them back once the daemon starts.
+// It works the same on every backend, since it only goes through containerd.
+func (c *Client) Shutdown(ctx context.Context, policy string, timeout time.Duration) (int, error) {
+	if policy == ShutdownLeaveRunning {
+		return 0, nil
+	}
+	ctx = c.withNamespace(ctx)
+	list, err := c.client.Containers(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	var candidates []shutdownCandidate
+	for _, container := range list {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			continue
+		}
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+		if status, err := task.Status(ctx); err != nil || status.Status != containerd.Running {
+			continue
+		}
+		candidates = append(candidates, shutdownCandidate{container: container, task: task, rank: priorityRank(labels)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].rank < candidates[j].rank })
+
+	handled := 0
+	var firstErr error
+	var mutex sync.Mutex
+	for start := 0; start < len(candidates); {
+		end := start
+		for end < len(candidates) && candidates[end].rank == candidates[start].rank {
+			end++
+		}
+		classCtx, cancel := context.WithTimeout(ctx, timeout+shutdownMargin)
+		var wg sync.WaitGroup
+		for _, candidate := range candidates[start:end] {
+			wg.Add(1)
+			go func(candidate shutdownCandidate) {
+				defer wg.Done()
+				err := c.shutdownContainer(classCtx, candidate, policy, timeout)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					return
+				}
+				handled++
+			}(candidate)
+		}
+		wg.Wait()
+		cancel()
+		start = end
+	}
+	return handled, firstErr
+}
+
+// shutdownContainer checkpoints or stops a container for Shutdown
+func (c *Client) shutdownContainer(ctx context.Context, candidate shutdownCandidate, policy string, timeout time.Duration) error {
+	id := candidate.container.ID()
+	if c.dryRunf("%s container %s on shutdown (timeout %v)", policy, id, timeout) {
+		return nil
+	}
+
+	// The restart supervisor has stopped by now, so the container is only marked
+	// as drained once it is down; one that failed to stop keeps running unmarked
+	if policy == ShutdownCheckpoint {
+		image, err := candidate.task.Checkpoint(ctx, withCheckpointExit)
+		if err == nil {
+			if _, err := candidate.container.SetLabels(ctx, map[string]string{LabelDrained: "true", LabelCheckpoint: image.Name()}); err != nil {
+				// The task has exited, it starts afresh next time
+				c.client.ImageService().Delete(ctx, image.Name())
+				return errors.Wrapf(err, "failed to record the checkpoint of container %s", id)
+			}
+			log.Printf("Checkpointed container %s", id)
+			return nil
+		}
+		log.Printf("Warning: Failed to checkpoint container %s, stopping it instead: %v", id, err)
+	}
+
+	if err := stopTask(ctx, candidate.task, timeout); err != nil {
+		return errors.Wrapf(err, "failed to stop container %s", id)
+	}
+	if _, err := candidate.container.SetLabels(ctx, map[string]string{LabelDrained: "true"}); err != nil {
+		return errors.Wrapf(err, "failed to mark stopped container %s as drained", id)
+	}
+	log.Printf("Stopped container %s", id)
+	return nil
+}
+
+// withCheckpointExit makes the task exit once it is checkpointed
+func withCheckpointExit(info *containerd.CheckpointTaskInfo) error {
+	info.Options = &options.CheckpointOptions{Exit: true}
+	return nil
+}
+
+// checkpointTaskOpts returns the task options restoring a container from its
+// checkpoint, nil if it has none. The checkpoint is only tried once, a
+// container that fails to restore starts afresh.
+func (c *Client) checkpointTaskOpts(ctx context.Context, container containerd.Container, labels map[string]string) []containerd.NewTaskOpts {
+	name := labels[LabelCheckpoint]
+	if name == "" {
+		return nil
+	}
+	if _, err := container.SetLabels(ctx, map[string]string{LabelCheckpoint: ""}); err != nil {
+		log.Printf("Warning: Failed to clear the checkpoint of container %s, starting it afresh: %v", container.ID(), err)
+		return nil
+	}
+	image, err := c.client.GetImage(ctx, name)
+	if err != nil {
+		log.Printf("Warning: Checkpoint of container %s is gone, starting it afresh: %v", container.ID(), err)
+		return nil
+	}
+	return []containerd.NewTaskOpts{containerd.WithTaskCheckpoint(image)}
+}
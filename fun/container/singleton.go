@@ -0,0 +1,81 @@
+package container
+
+import (
+	"context"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelSingleton names the lease a container must hold to run, so it runs
+	// on only one host of the group
+	LabelSingleton = "fun.singleton"
+	// LabelStandby marks singletons stopped because another host holds their
+	// lease, with that host, so their restart policy doesn't bring them back
+	LabelStandby = "fun.standby"
+)
+
+// Singleton is a container that only runs while the host holds its lease
+type Singleton struct {
+	ID    string
+	Lease string
+	// Running is whether the task is running, Standby why it is held back
+	Running bool
+	Standby string
+}
+
+// ListSingletons returns the containers labeled with LabelSingleton
+func (c *Client) ListSingletons(ctx context.Context) ([]Singleton, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	var singletons []Singleton
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil || labels[LabelSingleton] == "" {
+			continue
+		}
+		singleton := Singleton{ID: container.ID(), Lease: labels[LabelSingleton], Standby: labels[LabelStandby]}
+		if task, err := container.Task(ctx, nil); err == nil {
+			if status, err := task.Status(ctx); err == nil && status.Status == containerd.Running {
+				singleton.Running = true
+			}
+		}
+		singletons = append(singletons, singleton)
+	}
+	return singletons, nil
+}
+
+// StandbyContainer holds a singleton back while another host holds its lease,
+// stopping it if it runs. Unlike StopContainer it isn't marked as stopped by the
+// user, so StartContainer brings it back once the host takes over the lease.
+func (c *Client) StandbyContainer(ctx context.Context, containerID, reason string, timeout time.Duration) error {
+	ctx = c.withNamespace(ctx)
+	if c.dryRunf("hold back singleton %s: %s", containerID, reason) {
+		return nil
+	}
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+
+	// Mark first so the restart supervisor leaves the container alone once it exits
+	if _, err := container.SetLabels(ctx, map[string]string{LabelStandby: reason}); err != nil {
+		return errors.Wrap(err, "failed to mark container as standby")
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return nil
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status != containerd.Running {
+		return nil
+	}
+	return stopTask(ctx, task, timeout)
+}
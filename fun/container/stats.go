@@ -0,0 +1,177 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/containerd/cgroups/v3/cgroup1/stats"
+	v2 "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/typeurl/v2"
+	"github.com/pkg/errors"
+)
+
+// ContainerStats is a resource usage sample, normalized across cgroup v1 and v2
+type ContainerStats struct {
+	CgroupVersion CgroupMode `json:"cgroup_version"`
+	Timestamp     time.Time  `json:"timestamp"`
+
+	// CPUUsageNanos is the cumulative CPU time consumed
+	CPUUsageNanos uint64 `json:"cpu_usage_nanos"`
+
+	// MemoryUsage includes page cache, MemoryWorkingSet excludes inactive file pages
+	// and is what the kernel considers when OOM-killing
+	MemoryUsage      uint64 `json:"memory_usage"`
+	MemoryWorkingSet uint64 `json:"memory_working_set"`
+	MemoryLimit      uint64 `json:"memory_limit"`
+	SwapUsage        uint64 `json:"swap_usage"`
+
+	PidsCurrent uint64 `json:"pids_current"`
+
+	IOReadBytes  uint64 `json:"io_read_bytes"`
+	IOWriteBytes uint64 `json:"io_write_bytes"`
+
+	// Network counters of the container's network namespace, zero if unavailable
+	NetworkRxBytes uint64 `json:"network_rx_bytes"`
+	NetworkTxBytes uint64 `json:"network_tx_bytes"`
+}
+
+// ContainerStats returns the current resource usage of a running container
+func (c *Client) ContainerStats(ctx context.Context, containerID string) (*ContainerStats, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load container")
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "container is not running")
+	}
+
+	metric, err := task.Metrics(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get task metrics")
+	}
+
+	data, err := typeurl.UnmarshalAny(metric.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode task metrics")
+	}
+
+	stats := &ContainerStats{Timestamp: metric.Timestamp.AsTime()}
+	switch m := data.(type) {
+	case *v1.Metrics:
+		stats.CgroupVersion = CgroupV1
+		fillV1Stats(stats, m)
+	case *v2.Metrics:
+		stats.CgroupVersion = CgroupV2
+		fillV2Stats(stats, m)
+	default:
+		return nil, fmt.Errorf("unsupported metrics type %T", data)
+	}
+
+	// cgroups don't account network traffic, so read it from the task's namespace
+	if rx, tx, err := readNetDev(task.Pid()); err == nil {
+		stats.NetworkRxBytes = rx
+		stats.NetworkTxBytes = tx
+	}
+
+	return stats, nil
+}
+
+// readNetDev sums the received and transmitted bytes of all non-loopback
+// interfaces in the network namespace of pid
+func readNetDev(pid uint32) (rx, tx uint64, err error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines look like "  eth0: rxbytes rxpackets ... txbytes txpackets ..."
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			rx += n
+		}
+		if n, err := strconv.ParseUint(fields[8], 10, 64); err == nil {
+			tx += n
+		}
+	}
+	return rx, tx, scanner.Err()
+}
+
+// fillV1Stats converts cgroup v1 metrics
+func fillV1Stats(stats *ContainerStats, m *v1.Metrics) {
+	if m.CPU != nil && m.CPU.Usage != nil {
+		stats.CPUUsageNanos = m.CPU.Usage.Total
+	}
+	if m.Memory != nil {
+		if m.Memory.Usage != nil {
+			stats.MemoryUsage = m.Memory.Usage.Usage
+			stats.MemoryLimit = m.Memory.Usage.Limit
+			// v1 reports memory+swap, so subtract memory to get swap alone
+			if m.Memory.Swap != nil && m.Memory.Swap.Usage > m.Memory.Usage.Usage {
+				stats.SwapUsage = m.Memory.Swap.Usage - m.Memory.Usage.Usage
+			}
+		}
+		stats.MemoryWorkingSet = workingSet(stats.MemoryUsage, m.Memory.TotalInactiveFile)
+	}
+	if m.Pids != nil {
+		stats.PidsCurrent = m.Pids.Current
+	}
+	if m.Blkio != nil {
+		for _, entry := range m.Blkio.IoServiceBytesRecursive {
+			switch entry.Op {
+			case "Read", "read":
+				stats.IOReadBytes += entry.Value
+			case "Write", "write":
+				stats.IOWriteBytes += entry.Value
+			}
+		}
+	}
+}
+
+// fillV2Stats converts cgroup v2 metrics
+func fillV2Stats(stats *ContainerStats, m *v2.Metrics) {
+	if m.CPU != nil {
+		// v2 reports microseconds
+		stats.CPUUsageNanos = m.CPU.UsageUsec * 1000
+	}
+	if m.Memory != nil {
+		stats.MemoryUsage = m.Memory.Usage
+		stats.MemoryLimit = m.Memory.UsageLimit
+		stats.SwapUsage = m.Memory.SwapUsage
+		stats.MemoryWorkingSet = workingSet(m.Memory.Usage, m.Memory.InactiveFile)
+	}
+	if m.Pids != nil {
+		stats.PidsCurrent = m.Pids.Current
+	}
+	if m.Io != nil {
+		for _, entry := range m.Io.Usage {
+			stats.IOReadBytes += entry.Rbytes
+			stats.IOWriteBytes += entry.Wbytes
+		}
+	}
+}
+
+// workingSet subtracts reclaimable inactive file pages from memory usage
+func workingSet(usage, inactiveFile uint64) uint64 {
+	if inactiveFile > usage {
+		return 0
+	}
+	return usage - inactiveFile
+}
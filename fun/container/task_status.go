@@ -0,0 +1,171 @@
+package container
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	apievents "github.com/containerd/containerd/api/events"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/pkg/errors"
+)
+
+// statusWorkers bounds the per-container status queries run at the same time
+// when containerd can't list the tasks at once
+const statusWorkers = 8
+
+// taskStatusIndex caches the task status of every container, kept current from
+// the task events so listing containers needs no round trip per container.
+// It is only used for the namespaces whose events are being watched.
+type taskStatusIndex struct {
+	mutex sync.Mutex
+	// statuses holds the task of each container by namespace, containers
+	// without a task have no entry
+	statuses map[string]map[string]containerd.Status
+}
+
+// newTaskStatusIndex creates an index not watching any namespace
+func newTaskStatusIndex() *taskStatusIndex {
+	return &taskStatusIndex{statuses: make(map[string]map[string]containerd.Status)}
+}
+
+// watch starts using the index for namespace with the statuses listed when
+// the event subscription was set up
+func (i *taskStatusIndex) watch(namespace string, statuses map[string]containerd.Status) {
+	i.mutex.Lock()
+	i.statuses[namespace] = statuses
+	i.mutex.Unlock()
+}
+
+// unwatch stops using the index for namespace, its events may be missed from now on
+func (i *taskStatusIndex) unwatch(namespace string) {
+	i.mutex.Lock()
+	delete(i.statuses, namespace)
+	i.mutex.Unlock()
+}
+
+// snapshot returns a copy of the statuses of namespace, false if it isn't watched
+func (i *taskStatusIndex) snapshot(namespace string) (map[string]containerd.Status, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	statuses, ok := i.statuses[namespace]
+	if !ok {
+		return nil, false
+	}
+	result := make(map[string]containerd.Status, len(statuses))
+	for id, status := range statuses {
+		result[id] = status
+	}
+	return result, true
+}
+
+// apply updates the index from a task event of namespace
+func (i *taskStatusIndex) apply(namespace string, event interface{}) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	statuses, ok := i.statuses[namespace]
+	if !ok {
+		return
+	}
+
+	switch e := event.(type) {
+	case *apievents.TaskCreate:
+		statuses[e.ContainerID] = containerd.Status{Status: containerd.Created}
+	case *apievents.TaskStart:
+		statuses[e.ContainerID] = containerd.Status{Status: containerd.Running}
+	case *apievents.TaskPaused:
+		statuses[e.ContainerID] = containerd.Status{Status: containerd.Paused}
+	case *apievents.TaskResumed:
+		statuses[e.ContainerID] = containerd.Status{Status: containerd.Running}
+	case *apievents.TaskExit:
+		// Exec processes have their own IDs, only the init process ends the container
+		if e.ID != e.ContainerID {
+			return
+		}
+		status := containerd.Status{Status: containerd.Stopped, ExitStatus: e.ExitStatus}
+		if e.ExitedAt != nil {
+			status.ExitTime = e.ExitedAt.AsTime()
+		}
+		statuses[e.ContainerID] = status
+	case *apievents.TaskDelete:
+		if e.ID == e.ContainerID || e.ID == "" {
+			delete(statuses, e.ContainerID)
+		}
+	}
+}
+
+// TaskStatuses returns the task status of every container that has a task, by
+// container ID. The daemon answers from the index kept by WatchTaskEvents,
+// other processes list the tasks in a single request.
+func (c *Client) TaskStatuses(ctx context.Context) (map[string]containerd.Status, error) {
+	if statuses, ok := c.taskStatuses.snapshot(c.namespace); ok {
+		return statuses, nil
+	}
+	return c.listTaskStatuses(ctx)
+}
+
+// listTaskStatuses asks containerd for the status of all tasks at once,
+// falling back to querying the containers concurrently
+func (c *Client) listTaskStatuses(ctx context.Context) (map[string]containerd.Status, error) {
+	ctx = c.withNamespace(ctx)
+	resp, err := c.client.TaskService().List(ctx, &tasksapi.ListTasksRequest{})
+	if err == nil {
+		statuses := make(map[string]containerd.Status, len(resp.Tasks))
+		for _, task := range resp.Tasks {
+			status := containerd.Status{
+				Status:     containerd.ProcessStatus(strings.ToLower(task.Status.String())),
+				ExitStatus: task.ExitStatus,
+			}
+			if task.ExitedAt != nil {
+				status.ExitTime = task.ExitedAt.AsTime()
+			}
+			statuses[task.ID] = status
+		}
+		return statuses, nil
+	}
+	if ctx.Err() != nil {
+		return nil, errors.Wrap(err, "failed to list tasks")
+	}
+
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+	return c.queryTaskStatuses(ctx, containers), nil
+}
+
+// queryTaskStatuses gets the task status of each container with a pool of
+// statusWorkers, leaving out the containers without a task
+func (c *Client) queryTaskStatuses(ctx context.Context, containers []containerd.Container) map[string]containerd.Status {
+	var mutex sync.Mutex
+	statuses := make(map[string]containerd.Status, len(containers))
+
+	jobs := make(chan containerd.Container)
+	var wg sync.WaitGroup
+	for w := 0; w < min(statusWorkers, len(containers)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for container := range jobs {
+				task, err := container.Task(ctx, nil)
+				if err != nil {
+					continue
+				}
+				status, err := task.Status(ctx)
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				statuses[container.ID()] = status
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, container := range containers {
+		jobs <- container
+	}
+	close(jobs)
+	wg.Wait()
+	return statuses
+}
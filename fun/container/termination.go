@@ -0,0 +1,210 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	apievents "github.com/containerd/containerd/api/events"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/typeurl/v2"
+	"github.com/pkg/errors"
+)
+
+// LabelTermination stores how a container's last run ended
+const LabelTermination = "fun.termination"
+
+const (
+	// taskStatusSettle is when the task status index is rebuilt once more after
+	// subscribing, Subscribe doesn't report when the event stream is live so
+	// the first listing may miss the events of that moment
+	taskStatusSettle = 5 * time.Second
+	// taskStatusResync is how often the index is rebuilt in case events were missed
+	taskStatusResync = time.Minute
+)
+
+// Termination reasons
+const (
+	ReasonCompleted = "Completed"
+	ReasonError     = "Error"
+	ReasonOOMKilled = "OOMKilled"
+	ReasonStopped   = "Stopped"
+)
+
+// TerminationInfo describes how a container's main process last exited
+type TerminationInfo struct {
+	ExitCode   uint32    `json:"exit_code"`
+	OOMKilled  bool      `json:"oom_killed"`
+	Reason     string    `json:"reason"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// terminationReason classifies an exit so OOM kills can be told apart from crashes
+func terminationReason(exitCode uint32, oomKilled, stopped bool) string {
+	switch {
+	case oomKilled:
+		return ReasonOOMKilled
+	case stopped:
+		return ReasonStopped
+	case exitCode == 0:
+		return ReasonCompleted
+	}
+	return ReasonError
+}
+
+// WatchTaskEvents records the start time and termination info of containers as
+// their tasks start and exit, and keeps the task status index current while it runs
+// The index is rebuilt from a listing periodically, so events missed around
+// subscribing or lost later don't leave it wrong. OOM events arrive before the
+// matching exit event, so they are remembered until then.
+func (c *Client) WatchTaskEvents(ctx context.Context) error {
+	ctx = c.withNamespace(ctx)
+	eventCh, errCh := c.client.Subscribe(ctx,
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/oom"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/exit"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/start"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/create"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/paused"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/resumed"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/delete"`, c.namespace),
+	)
+
+	// Events from now on are applied to the listed statuses, the index can't be
+	// trusted once they stop arriving. Until a listing succeeds, container
+	// listings ask containerd for the tasks every time.
+	defer c.taskStatuses.unwatch(c.namespace)
+	resync := func() {
+		statuses, err := c.listTaskStatuses(ctx)
+		if err != nil {
+			c.taskStatuses.unwatch(c.namespace)
+			log.Printf("Warning: Failed to list task statuses, container listings query containerd until it succeeds: %v", err)
+			return
+		}
+		c.taskStatuses.watch(c.namespace, statuses)
+	}
+	resync()
+	settle := time.After(taskStatusSettle)
+	ticker := time.NewTicker(taskStatusResync)
+	defer ticker.Stop()
+
+	oomKilled := make(map[string]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-settle:
+			resync()
+		case <-ticker.C:
+			resync()
+		case err := <-errCh:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "task event subscription failed")
+		case envelope := <-eventCh:
+			event, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				// The event may have changed a status, so the index is rebuilt
+				log.Printf("Warning: Failed to decode task event %s: %v", envelope.Topic, err)
+				resync()
+				continue
+			}
+			c.taskStatuses.apply(c.namespace, event)
+
+			switch e := event.(type) {
+			case *apievents.TaskStart:
+				if err := c.recordStart(ctx, e.ContainerID); err != nil {
+					log.Printf("Warning: Failed to record start of container %s: %v", e.ContainerID, err)
+				}
+
+			case *apievents.TaskOOM:
+				oomKilled[e.ContainerID] = true
+
+			case *apievents.TaskExit:
+				// Exec processes have their own IDs, only the init process ends the container
+				if e.ID != e.ContainerID {
+					continue
+				}
+				oom := oomKilled[e.ContainerID]
+				delete(oomKilled, e.ContainerID)
+
+				finishedAt := time.Now()
+				if e.ExitedAt != nil {
+					finishedAt = e.ExitedAt.AsTime()
+				}
+				if err := c.recordTermination(ctx, e.ContainerID, e.ExitStatus, oom, finishedAt); err != nil {
+					log.Printf("Warning: Failed to record exit of container %s: %v", e.ContainerID, err)
+				}
+			}
+		}
+	}
+}
+
+// recordTermination stores the termination info in the container's labels
+func (c *Client) recordTermination(ctx context.Context, containerID string, exitCode uint32, oomKilled bool, finishedAt time.Time) error {
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load container")
+	}
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get container labels")
+	}
+
+	info := TerminationInfo{
+		ExitCode:   exitCode,
+		OOMKilled:  oomKilled,
+		Reason:     terminationReason(exitCode, oomKilled, labels[LabelStopped] != ""),
+		FinishedAt: finishedAt,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal termination info")
+	}
+
+	if oomKilled {
+		log.Printf("Container %s was killed by the OOM killer", containerID)
+	}
+
+	if _, err := container.SetLabels(ctx, map[string]string{LabelTermination: string(data)}); err != nil {
+		return err
+	}
+
+	if labels[LabelCritical] != "" {
+		c.mu.RLock()
+		hook := c.criticalExitHook
+		c.mu.RUnlock()
+		if hook != nil {
+			hook(containerID, info)
+		}
+	}
+	return nil
+}
+
+// terminationFromTask returns the termination info of a container, preferring the
+// recorded event and falling back to the stopped task's exit status when the event
+// was missed, e.g. while the daemon was not running
+func terminationFromTask(labels map[string]string, status containerd.Status) *TerminationInfo {
+	var recorded *TerminationInfo
+	if data := labels[LabelTermination]; data != "" {
+		var info TerminationInfo
+		if err := json.Unmarshal([]byte(data), &info); err == nil {
+			recorded = &info
+		}
+	}
+
+	if status.Status != containerd.Stopped {
+		return recorded
+	}
+	if recorded != nil && !status.ExitTime.After(recorded.FinishedAt.Add(time.Second)) {
+		return recorded
+	}
+	return &TerminationInfo{
+		ExitCode:   status.ExitStatus,
+		Reason:     terminationReason(status.ExitStatus, false, labels[LabelStopped] != ""),
+		FinishedAt: status.ExitTime,
+	}
+}
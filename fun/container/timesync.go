@@ -0,0 +1,51 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/pkg/errors"
+)
+
+// MaxClockDrift is how far the clock where containerd runs may be off the host's
+// before it is corrected, TLS and log ordering tolerate less than that
+const MaxClockDrift = 2 * time.Second
+
+// ClockOffset measures how far containerd's clock is ahead of the host's, negative
+// if it is behind. It reads the server's time from the creation time of a lease,
+// so it works for containerd in a VM or WSL where nothing else can be run.
+// Precision is bounded by half the round trip.
+func (c *Client) ClockOffset(ctx context.Context) (time.Duration, error) {
+	ctx = c.withNamespace(ctx)
+	leaseManager := c.client.LeasesService()
+
+	before := time.Now()
+	lease, err := leaseManager.Create(ctx, leases.WithRandomID(), leases.WithExpiration(time.Minute))
+	after := time.Now()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create clock lease")
+	}
+	leaseManager.Delete(ctx, lease)
+
+	if lease.CreatedAt.IsZero() {
+		return 0, errors.New("containerd did not report the lease creation time")
+	}
+	host := before.Add(after.Sub(before) / 2)
+	return lease.CreatedAt.Sub(host), nil
+}
+
+// SyncWSLClock sets the clock of the WSL distribution to the host's
+// WSL shares the kernel of its utility VM, whose clock lags after the host slept.
+func SyncWSLClock(ctx context.Context, config WSL2Config) error {
+	now := time.Now().UTC()
+	cmd := exec.CommandContext(ctx, "wsl.exe", "--distribution", config.Distribution, "--user", "root",
+		"--", "date", "-u", "-s", fmt.Sprintf("@%d.%09d", now.Unix(), now.Nanosecond()))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to set the clock in WSL: %s", string(output))
+	}
+	return nil
+}
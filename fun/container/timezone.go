@@ -0,0 +1,200 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Timezone and locale settings of containers, other values name a timezone
+// such as Europe/Berlin or a locale such as de_DE.UTF-8
+const (
+	// ZoneHost propagates the host's timezone or locale
+	ZoneHost = "host"
+	// ZoneNone keeps the image's timezone or locale, usually UTC and POSIX
+	ZoneNone = "none"
+)
+
+// Labels recording the timezone and locale a container was created with, so a
+// change of the desired state recreates it
+const (
+	LabelTimezone = "fun.timezone"
+	LabelLocale   = "fun.locale"
+)
+
+// hostLocaltime is the host file describing its timezone
+const hostLocaltime = "/etc/localtime"
+
+// localePattern matches locale names such as de_DE.UTF-8, sr_RS@latin or C.UTF-8
+var localePattern = regexp.MustCompile(`^([A-Za-z]{2,3}(_[A-Za-z]{2})?|C|POSIX)(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+
+// SetTimezoneDefaults sets the timezone and locale of containers that don't
+// choose their own, empty or ZoneNone keeps the image's
+func (c *Client) SetTimezoneDefaults(timezone, locale string) {
+	c.mu.Lock()
+	c.timezone = timezone
+	c.locale = locale
+	c.mu.Unlock()
+}
+
+// ValidateTimezone checks a timezone setting, it is ZoneHost, ZoneNone or a
+// zone of the Go timezone database
+func ValidateTimezone(timezone string) error {
+	if timezone == "" || timezone == ZoneHost || timezone == ZoneNone {
+		return nil
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", timezone)
+	}
+	return nil
+}
+
+// ValidateLocale checks a locale setting, it is ZoneHost, ZoneNone or a locale
+// name such as de_DE.UTF-8
+func ValidateLocale(locale string) error {
+	if locale == "" || locale == ZoneHost || locale == ZoneNone {
+		return nil
+	}
+	if !localePattern.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q, expected a name such as de_DE.UTF-8", locale)
+	}
+	return nil
+}
+
+// HostTimezone returns the name of the host's timezone, empty if unknown
+func HostTimezone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" && !filepath.IsAbs(tz) {
+		return tz
+	}
+	// /etc/localtime links into the zoneinfo directory on Linux and macOS
+	if target, err := os.Readlink(hostLocaltime); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	if data, err := os.ReadFile("/etc/timezone"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// HostLocale returns the host's locale, empty if unknown
+func HostLocale() string {
+	for _, name := range []string{"LC_ALL", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	for _, path := range []string{"/etc/locale.conf", "/etc/default/locale"} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "LANG="); ok {
+				file.Close()
+				return strings.Trim(value, `"`)
+			}
+		}
+		file.Close()
+	}
+	return ""
+}
+
+// hasEnv reports whether env sets the variable name
+func hasEnv(env []string, name string) bool {
+	for _, entry := range env {
+		if strings.SplitN(entry, "=", 2)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMount reports whether mounts has one at destination
+func hasMount(mounts []specs.Mount, destination string) bool {
+	for _, mount := range mounts {
+		if mount.Destination == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTimezone adds the TZ and LANG variables and the /etc/localtime mount for
+// the container's timezone and locale. Variables and mounts set explicitly win,
+// and the daemon's defaults don't override a TZ or LANG from imageEnv either.
+// The zone file is only mounted when containers run on this host, in a VM the
+// TZ variable has to do.
+func (c *Client) applyTimezone(opts *CreateContainerOptions, imageEnv []string) error {
+	c.mu.RLock()
+	timezone, locale := c.timezone, c.locale
+	c.mu.RUnlock()
+	if hasEnv(imageEnv, "TZ") {
+		timezone = ""
+	}
+	if hasEnv(imageEnv, "LANG") || hasEnv(imageEnv, "LC_ALL") {
+		locale = ""
+	}
+	if opts.Timezone != "" {
+		timezone = opts.Timezone
+	}
+	if opts.Locale != "" {
+		locale = opts.Locale
+	}
+	if err := ValidateTimezone(timezone); err != nil {
+		return err
+	}
+	if err := ValidateLocale(locale); err != nil {
+		return err
+	}
+	// Appends must not write into the caller's slices
+	opts.Env = opts.Env[:len(opts.Env):len(opts.Env)]
+	opts.Mounts = opts.Mounts[:len(opts.Mounts):len(opts.Mounts)]
+
+	if opts.Timezone != "" || opts.Locale != "" {
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		if opts.Timezone != "" {
+			opts.Labels[LabelTimezone] = opts.Timezone
+		}
+		if opts.Locale != "" {
+			opts.Labels[LabelLocale] = opts.Locale
+		}
+	}
+
+	if timezone == ZoneHost {
+		timezone = HostTimezone()
+	}
+	if timezone != "" && timezone != ZoneNone {
+		if !hasEnv(opts.Env, "TZ") {
+			opts.Env = append(opts.Env, "TZ="+timezone)
+		}
+		zoneFile := filepath.Join("/usr/share/zoneinfo", timezone)
+		if runtime.GOOS == "linux" && fileExists(zoneFile) && !hasMount(opts.Mounts, hostLocaltime) {
+			opts.Mounts = append(opts.Mounts, specs.Mount{
+				Type:        "bind",
+				Source:      zoneFile,
+				Destination: hostLocaltime,
+				Options:     []string{"rbind", "ro"},
+			})
+		}
+	}
+
+	if locale == ZoneHost {
+		locale = HostLocale()
+	}
+	if locale != "" && locale != ZoneNone && !hasEnv(opts.Env, "LANG") {
+		opts.Env = append(opts.Env, "LANG="+locale)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is the kernel's USER_HZ, the unit of process times in /proc
+const clockTicks = 100
+
+// ContainerProcess is a process running inside a container
+// Only PID is set when containerd runs in a VM, whose /proc the host can't read.
+type ContainerProcess struct {
+	PID     uint32 `json:"pid"`
+	User    string `json:"user,omitempty"`
+	Command string `json:"command,omitempty"`
+	// CPUPercent is the CPU time used over the lifetime of the process, like ps
+	CPUPercent float64       `json:"cpu_percent"`
+	MemoryRSS  uint64        `json:"memory_rss"`
+	MemPercent float64       `json:"mem_percent"`
+	CPUTime    time.Duration `json:"cpu_time"`
+}
+
+// Top returns the processes running in a container
+func (c *Client) Top(ctx context.Context, containerID string) ([]ContainerProcess, error) {
+	ctx = c.withNamespace(ctx)
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load container")
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "container is not running")
+	}
+
+	pids, err := task.Pids(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list container processes")
+	}
+
+	uptime := hostUptime()
+	memory := hostMemoryBytes()
+	// User names come from the container's /etc/passwd, the host's may not know them
+	users := containerUsers(task.Pid())
+	processes := make([]ContainerProcess, 0, len(pids))
+	for _, info := range pids {
+		process := ContainerProcess{PID: info.Pid}
+		readProcess(&process, uptime, memory, users)
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// containerUsers returns the user names by UID from the /etc/passwd of the
+// container whose init process is pid, read through its root in /proc. It is
+// empty if the file can't be read, such as when containerd runs in a VM.
+func containerUsers(pid uint32) map[string]string {
+	users := map[string]string{}
+	file, err := os.Open(fmt.Sprintf("/proc/%d/root/etc/passwd", pid))
+	if err != nil {
+		return users
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := users[fields[2]]; !ok {
+			users[fields[2]] = fields[0]
+		}
+	}
+	return users
+}
+
+// hostUptime returns how long the host has been up, zero if unknown
+func hostUptime() time.Duration {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// readProcess fills in the details of a process from /proc, leaving them empty
+// if the process is gone or /proc isn't the container host's. UIDs missing
+// from users are shown as numbers.
+func readProcess(process *ContainerProcess, uptime time.Duration, hostMemory int64, users map[string]string) {
+	dir := fmt.Sprintf("/proc/%d", process.PID)
+
+	if cmdline, err := os.ReadFile(dir + "/cmdline"); err == nil {
+		process.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+
+	// The command name is in parentheses and may contain spaces, the fields follow it
+	if stat, err := os.ReadFile(dir + "/stat"); err == nil {
+		if i := strings.LastIndexByte(string(stat), ')'); i >= 0 {
+			fields := strings.Fields(string(stat[i+1:]))
+			if process.Command == "" {
+				if j := strings.IndexByte(string(stat), '('); j >= 0 {
+					process.Command = "[" + string(stat[j+1:i]) + "]"
+				}
+			}
+			if len(fields) > 19 {
+				utime, _ := strconv.ParseUint(fields[11], 10, 64)
+				stime, _ := strconv.ParseUint(fields[12], 10, 64)
+				start, _ := strconv.ParseUint(fields[19], 10, 64)
+				process.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+				elapsed := uptime - time.Duration(start)*time.Second/clockTicks
+				if elapsed > 0 {
+					process.CPUPercent = 100 * process.CPUTime.Seconds() / elapsed.Seconds()
+				}
+			}
+		}
+	}
+
+	file, err := os.Open(dir + "/status")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Uid:":
+			process.User = fields[1]
+			if name, ok := users[fields[1]]; ok {
+				process.User = name
+			}
+		case "VmRSS:":
+			if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				process.MemoryRSS = kb * 1024
+			}
+		}
+	}
+	if hostMemory > 0 {
+		process.MemPercent = 100 * float64(process.MemoryRSS) / float64(hostMemory)
+	}
+}
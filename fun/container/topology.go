@@ -0,0 +1,155 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NUMANode is a memory node of the host and the CPUs local to it
+type NUMANode struct {
+	ID   int   `json:"id"`
+	CPUs []int `json:"cpus"`
+}
+
+// HostTopology describes the CPUs and NUMA nodes of the host, it is reported at
+// registration so the orchestrator can place latency-sensitive workloads
+type HostTopology struct {
+	NUMANodes []NUMANode `json:"numa_nodes"`
+}
+
+// DetectTopology reads the NUMA layout from sysfs, hosts without NUMA
+// information are reported as a single node holding all CPUs
+func DetectTopology() HostTopology {
+	var topology HostTopology
+	if runtime.GOOS == "linux" {
+		paths, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+		for _, path := range paths {
+			id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "node"))
+			if err != nil {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(path, "cpulist"))
+			if err != nil {
+				continue
+			}
+			cpus, err := ParseCPUList(strings.TrimSpace(string(data)))
+			if err != nil {
+				continue
+			}
+			topology.NUMANodes = append(topology.NUMANodes, NUMANode{ID: id, CPUs: cpus})
+		}
+	}
+
+	if len(topology.NUMANodes) == 0 {
+		cpus := make([]int, runtime.NumCPU())
+		for i := range cpus {
+			cpus[i] = i
+		}
+		topology.NUMANodes = []NUMANode{{ID: 0, CPUs: cpus}}
+	}
+	sort.Slice(topology.NUMANodes, func(i, j int) bool {
+		return topology.NUMANodes[i].ID < topology.NUMANodes[j].ID
+	})
+	return topology
+}
+
+// Node returns the NUMA node with the given ID
+func (t HostTopology) Node(id int) (NUMANode, bool) {
+	for _, node := range t.NUMANodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return NUMANode{}, false
+}
+
+// Placement returns the cpuset CPUs and memory nodes pinning a container to a
+// NUMA node
+func (t HostTopology) Placement(id int) (string, string, error) {
+	node, ok := t.Node(id)
+	if !ok {
+		return "", "", fmt.Errorf("NUMA node %d does not exist, the host has %d node(s)", id, len(t.NUMANodes))
+	}
+	return FormatCPUList(node.CPUs), strconv.Itoa(node.ID), nil
+}
+
+// Validate checks that a cpuset only names CPUs and memory nodes of the host
+func (t HostTopology) Validate(cpus, mems string) error {
+	if cpus != "" {
+		list, err := ParseCPUList(cpus)
+		if err != nil {
+			return err
+		}
+		available := make(map[int]bool)
+		for _, node := range t.NUMANodes {
+			for _, cpu := range node.CPUs {
+				available[cpu] = true
+			}
+		}
+		for _, cpu := range list {
+			if !available[cpu] {
+				return fmt.Errorf("CPU %d in cpuset %s does not exist on this host", cpu, cpus)
+			}
+		}
+	}
+	if mems != "" {
+		list, err := ParseCPUList(mems)
+		if err != nil {
+			return err
+		}
+		for _, id := range list {
+			if _, ok := t.Node(id); !ok {
+				return fmt.Errorf("NUMA node %d in cpuset %s does not exist on this host", id, mems)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseCPUList parses a kernel CPU list such as "0-3,8,10-11"
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// FormatCPUList formats sorted CPU numbers as a kernel CPU list, collapsing ranges
+func FormatCPUList(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
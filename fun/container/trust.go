@@ -0,0 +1,407 @@
+package container
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"fun/audit"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// cosignSignatureAnnotation holds the base64 signature of a cosign simple signing payload
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// maxSignaturePayload bounds the size of signature manifests and payloads read from registries
+const maxSignaturePayload = 1 << 20
+
+// TrustPolicy restricts which images may be pulled and run
+// An empty policy allows everything.
+type TrustPolicy struct {
+	// AllowedRegistries lists registry hosts images may come from, "*.example.com" matches subdomains
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+	// BannedTags lists tags that may not be used, such as "latest"
+	BannedTags []string `json:"banned_tags,omitempty"`
+	// RequiredSigners must all have signed an image with cosign
+	RequiredSigners []TrustSigner `json:"required_signers,omitempty"`
+}
+
+// TrustSigner is a signing identity and its public key
+type TrustSigner struct {
+	Name string `json:"name"`
+	// PublicKey is a PEM encoded ECDSA, RSA or Ed25519 public key
+	PublicKey string `json:"public_key"`
+}
+
+// TrustPolicyError is returned when the policy refuses an image
+type TrustPolicyError struct {
+	Ref    string
+	Reason string
+}
+
+func (e *TrustPolicyError) Error() string {
+	return fmt.Sprintf("image %s denied by content trust policy: %s", e.Ref, e.Reason)
+}
+
+// LoadTrustPolicy reads a trust policy file, returning an empty policy if it doesn't exist
+func LoadTrustPolicy(path string) (*TrustPolicy, error) {
+	policy := &TrustPolicy{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read trust policy")
+	}
+
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrap(err, "failed to parse trust policy")
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Save writes the policy to path atomically
+func (p *TrustPolicy) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create trust policy directory")
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal trust policy")
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write trust policy")
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Validate checks that all signer keys can be parsed
+func (p *TrustPolicy) Validate() error {
+	for _, signer := range p.RequiredSigners {
+		if signer.Name == "" {
+			return errors.New("trust policy signer has no name")
+		}
+		if _, err := parsePublicKey(signer.PublicKey); err != nil {
+			return fmt.Errorf("invalid public key of signer %s: %w", signer.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkReference applies the registry and tag rules to a normalized reference
+func (p *TrustPolicy) checkReference(ref string) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return &TrustPolicyError{Ref: ref, Reason: "invalid reference"}
+	}
+
+	if len(p.AllowedRegistries) > 0 {
+		if registry := reference.Domain(named); !registryAllowed(p.AllowedRegistries, registry) {
+			return &TrustPolicyError{Ref: ref, Reason: fmt.Sprintf("registry %s is not allowed", registry)}
+		}
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		for _, banned := range p.BannedTags {
+			if tagged.Tag() == banned {
+				return &TrustPolicyError{Ref: ref, Reason: fmt.Sprintf("tag %s is banned", banned)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// registryAllowed reports whether registry matches one of the patterns,
+// "*.example.com" matches subdomains
+func registryAllowed(patterns []string, registry string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, registry); matched || pattern == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTrustPolicy sets the content trust policy enforced before pulls and creates
+func (c *Client) SetTrustPolicy(policy *TrustPolicy) {
+	c.mu.Lock()
+	c.trustPolicy = policy
+	c.mu.Unlock()
+}
+
+// GetTrustPolicy returns the content trust policy, nil if none is set
+func (c *Client) GetTrustPolicy() *TrustPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.trustPolicy
+}
+
+// InstallTrustPolicy validates policy, saves it to path and enforces it, recording
+// the update in the audit log
+func (c *Client) InstallTrustPolicy(policy *TrustPolicy, path, actor string) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if c.dryRunf("install content trust policy at %s (%d allowed registries, %d signers, %d banned tags)",
+		path, len(policy.AllowedRegistries), len(policy.RequiredSigners), len(policy.BannedTags)) {
+		return nil
+	}
+	if err := policy.Save(path); err != nil {
+		return err
+	}
+	c.SetTrustPolicy(policy)
+
+	if err := c.AuditLogger().Record(audit.Event{
+		Type:    audit.EventTrustPolicyUpdated,
+		Subject: path,
+		Actor:   actor,
+	}); err != nil {
+		log.Printf("Warning: Failed to record trust policy update in the audit log: %v", err)
+	}
+	return nil
+}
+
+// SetAuditLogger sets the logger recording policy denials
+func (c *Client) SetAuditLogger(logger *audit.Logger) {
+	c.mu.Lock()
+	c.audit = logger
+	c.mu.Unlock()
+}
+
+// AuditLogger returns the audit logger, nil if auditing is disabled
+func (c *Client) AuditLogger() *audit.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.audit
+}
+
+// enforceTrustPolicy checks ref, and the signatures of the image with the given
+// digest if signers are required, recording denials in the audit log
+func (c *Client) enforceTrustPolicy(ctx context.Context, ref string, dgst digest.Digest) error {
+	policy := c.GetTrustPolicy()
+	if policy == nil {
+		return nil
+	}
+
+	err := policy.checkReference(ref)
+	if err == nil && len(policy.RequiredSigners) > 0 {
+		err = c.verifySignatures(ctx, policy, ref, dgst)
+	}
+	if err == nil {
+		return nil
+	}
+
+	var denied *TrustPolicyError
+	if !errors.As(err, &denied) {
+		denied = &TrustPolicyError{Ref: ref, Reason: err.Error()}
+	}
+	if auditErr := c.AuditLogger().Record(audit.Event{
+		Type:    audit.EventTrustDenied,
+		Subject: ref,
+		Reason:  denied.Reason,
+	}); auditErr != nil {
+		log.Printf("Warning: Failed to record trust denial in the audit log: %v", auditErr)
+	}
+	return denied
+}
+
+// checkPullTrust enforces the policy before ref is pulled, resolving the digest
+// only when signatures have to be verified. It returns the verified digest,
+// empty if none was resolved, which the pull has to use instead of the tag.
+func (c *Client) checkPullTrust(ctx context.Context, ref string) (digest.Digest, error) {
+	policy := c.GetTrustPolicy()
+	if policy == nil {
+		return "", nil
+	}
+
+	var dgst digest.Digest
+	if len(policy.RequiredSigners) > 0 && policy.checkReference(ref) == nil {
+		resolved, err := c.resolveDigest(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		dgst = resolved
+	}
+	if err := c.enforceTrustPolicy(ctx, ref, dgst); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// pinnedRef returns ref with its tag replaced by dgst, so a pull fetches the
+// verified manifest even if the tag was moved since it was resolved
+func pinnedRef(ref string, dgst digest.Digest) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	return pinned.String(), nil
+}
+
+// tagPinnedImage points ref at an image pulled by its pinned reference, and
+// drops the pinned record unless it was there before the pull
+func (c *Client) tagPinnedImage(ctx context.Context, ref string, pulled containerd.Image, keepPinned bool) (containerd.Image, error) {
+	store := c.client.ImageService()
+	record := images.Image{Name: ref, Target: pulled.Target()}
+	created, err := store.Create(ctx, record)
+	if errdefs.IsAlreadyExists(err) {
+		created, err = store.Update(ctx, record, "target")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to tag image %s", ref)
+	}
+	if !keepPinned {
+		if err := store.Delete(ctx, pulled.Name()); err != nil && !errdefs.IsNotFound(err) {
+			log.Printf("Warning: Failed to remove image record %s: %v", pulled.Name(), err)
+		}
+	}
+	return containerd.NewImage(c.client, created), nil
+}
+
+// resolveDigest returns the manifest digest a reference currently points to in its registry
+func (c *Client) resolveDigest(ctx context.Context, ref string) (digest.Digest, error) {
+	_, desc, err := c.newResolver(ctx).Resolve(ctx, ref)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve image")
+	}
+	return desc.Digest, nil
+}
+
+// verifySignatures checks that every required signer signed the image digest
+// Signatures are looked up the way cosign stores them, as the sha256-<hex>.sig tag
+// of the image repository.
+func (c *Client) verifySignatures(ctx context.Context, policy *TrustPolicy, ref string, dgst digest.Digest) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return err
+	}
+	sigRef := fmt.Sprintf("%s:%s-%s.sig", reference.TrimNamed(named).String(), dgst.Algorithm(), dgst.Encoded())
+
+	resolver := c.newResolver(ctx)
+	name, desc, err := resolver.Resolve(ctx, sigRef)
+	if err != nil {
+		return &TrustPolicyError{Ref: ref, Reason: "image is not signed"}
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch signatures")
+	}
+
+	fetch := func(desc ocispec.Descriptor) ([]byte, error) {
+		reader, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(io.LimitReader(reader, maxSignaturePayload))
+	}
+
+	data, err := fetch(desc)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch signature manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return errors.Wrap(err, "failed to parse signature manifest")
+	}
+
+	signed := make(map[string]bool)
+	for _, layer := range manifest.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		payload, err := fetch(layer)
+		if err != nil || !payloadMatches(payload, dgst) {
+			continue
+		}
+		for _, signer := range policy.RequiredSigners {
+			if !signed[signer.Name] && verifySignature(signer.PublicKey, payload, signature) {
+				signed[signer.Name] = true
+			}
+		}
+	}
+
+	for _, signer := range policy.RequiredSigners {
+		if !signed[signer.Name] {
+			return &TrustPolicyError{Ref: ref, Reason: fmt.Sprintf("missing signature of %s", signer.Name)}
+		}
+	}
+	return nil
+}
+
+// payloadMatches reports whether a cosign simple signing payload is about dgst
+func payloadMatches(payload []byte, dgst digest.Digest) bool {
+	var simpleSigning struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil {
+		return false
+	}
+	return simpleSigning.Critical.Image.DockerManifestDigest == dgst.String()
+}
+
+// verifySignature checks a signature over payload with a PEM public key
+func verifySignature(publicKey string, payload, signature []byte) bool {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(payload)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	}
+	return false
+}
+
+// parsePublicKey decodes a PEM encoded PKIX public key
+func parsePublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(data)))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,221 @@
+package container
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LabelProject groups containers for usage accounting
+const LabelProject = "fun.project"
+
+// DefaultProject is the project of containers without a project label
+const DefaultProject = "default"
+
+// ProjectUsage is the resource consumption of a project over a period
+type ProjectUsage struct {
+	Project string `json:"project"`
+	// CPUSeconds is the CPU time consumed by all of the project's containers
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// MemoryByteHours integrates the working set over time
+	MemoryByteHours float64 `json:"memory_byte_hours"`
+	NetworkRxBytes  uint64  `json:"network_rx_bytes"`
+	NetworkTxBytes  uint64  `json:"network_tx_bytes"`
+}
+
+// UsageReport is the usage of all projects between two points in time
+type UsageReport struct {
+	PeriodStart time.Time      `json:"period_start"`
+	PeriodEnd   time.Time      `json:"period_end"`
+	Projects    []ProjectUsage `json:"projects"`
+}
+
+// usageSample is the last sample of a container, used to compute deltas
+type usageSample struct {
+	at         time.Time
+	cpuNanos   uint64
+	rxBytes    uint64
+	txBytes    uint64
+	workingSet uint64
+}
+
+// UsageAccumulator samples container stats and sums them per project between reports
+type UsageAccumulator struct {
+	client *Client
+
+	mutex       sync.Mutex
+	last        map[string]usageSample
+	projects    map[string]*ProjectUsage
+	periodStart time.Time
+	onSample    func(stats map[string]*ContainerStats)
+}
+
+// NewUsageAccumulator creates a usage accumulator for the containers of client
+func NewUsageAccumulator(client *Client) *UsageAccumulator {
+	return &UsageAccumulator{
+		client:      client,
+		last:        make(map[string]usageSample),
+		projects:    make(map[string]*ProjectUsage),
+		periodStart: time.Now(),
+	}
+}
+
+// SetSampleHook is called with the stats of the running containers by ID after every sample
+func (a *UsageAccumulator) SetSampleHook(hook func(stats map[string]*ContainerStats)) {
+	a.mutex.Lock()
+	a.onSample = hook
+	a.mutex.Unlock()
+}
+
+// Run samples usage every interval until ctx is cancelled
+func (a *UsageAccumulator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Sample(ctx); err != nil {
+				log.Printf("Warning: Failed to sample container usage: %v", err)
+			}
+		}
+	}
+}
+
+// Sample adds the usage since the previous sample of every running container
+func (a *UsageAccumulator) Sample(ctx context.Context) error {
+	containers, err := a.client.ListContainers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+
+	// Collect the stats before locking so a slow containerd doesn't hold up Flush
+	type sample struct {
+		project string
+		usageSample
+	}
+	samples := make(map[string]sample, len(containers))
+	running := make(map[string]*ContainerStats, len(containers))
+	for _, container := range containers {
+		stats, err := a.client.ContainerStats(ctx, container.ID)
+		if err != nil {
+			// Not running, its usage ended with the previous sample
+			continue
+		}
+		running[container.ID] = stats
+
+		project := container.Labels[LabelProject]
+		if project == "" {
+			project = DefaultProject
+		}
+		samples[container.ID] = sample{project, usageSample{
+			at:         time.Now(),
+			cpuNanos:   stats.CPUUsageNanos,
+			rxBytes:    stats.NetworkRxBytes,
+			txBytes:    stats.NetworkTxBytes,
+			workingSet: stats.MemoryWorkingSet,
+		}}
+	}
+
+	a.mutex.Lock()
+	for id, s := range samples {
+		a.add(s.project, id, s.usageSample)
+	}
+
+	// Forget stopped containers so a restart starts counting from zero again
+	for id := range a.last {
+		if _, ok := samples[id]; !ok {
+			delete(a.last, id)
+		}
+	}
+	onSample := a.onSample
+	a.mutex.Unlock()
+
+	if onSample != nil {
+		onSample(running)
+	}
+	return nil
+}
+
+// add accounts the difference between the previous and the current sample of a
+// container; the caller must hold the mutex
+func (a *UsageAccumulator) add(project, containerID string, current usageSample) {
+	previous, ok := a.last[containerID]
+	a.last[containerID] = current
+	if !ok {
+		// The first sample only establishes the baseline
+		return
+	}
+
+	usage := a.projects[project]
+	if usage == nil {
+		usage = &ProjectUsage{Project: project}
+		a.projects[project] = usage
+	}
+
+	usage.CPUSeconds += float64(counterDelta(previous.cpuNanos, current.cpuNanos)) / float64(time.Second)
+	usage.NetworkRxBytes += counterDelta(previous.rxBytes, current.rxBytes)
+	usage.NetworkTxBytes += counterDelta(previous.txBytes, current.txBytes)
+
+	// Integrate the memory working set with the trapezoidal rule
+	if elapsed := current.at.Sub(previous.at); elapsed > 0 {
+		average := (float64(previous.workingSet) + float64(current.workingSet)) / 2
+		usage.MemoryByteHours += average * elapsed.Hours()
+	}
+}
+
+// Flush returns the usage accumulated since the previous flush and starts a new period
+func (a *UsageAccumulator) Flush() *UsageReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	report := &UsageReport{PeriodStart: a.periodStart, PeriodEnd: now}
+	for _, usage := range a.projects {
+		report.Projects = append(report.Projects, *usage)
+	}
+	sort.Slice(report.Projects, func(i, j int) bool {
+		return report.Projects[i].Project < report.Projects[j].Project
+	})
+
+	a.projects = make(map[string]*ProjectUsage)
+	a.periodStart = now
+	return report
+}
+
+// Restore adds back a flushed report that could not be delivered, so its usage
+// is included in the next one
+func (a *UsageAccumulator) Restore(report *UsageReport) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if report.PeriodStart.Before(a.periodStart) {
+		a.periodStart = report.PeriodStart
+	}
+	for _, restored := range report.Projects {
+		usage := a.projects[restored.Project]
+		if usage == nil {
+			usage = &ProjectUsage{Project: restored.Project}
+			a.projects[restored.Project] = usage
+		}
+		usage.CPUSeconds += restored.CPUSeconds
+		usage.MemoryByteHours += restored.MemoryByteHours
+		usage.NetworkRxBytes += restored.NetworkRxBytes
+		usage.NetworkTxBytes += restored.NetworkTxBytes
+	}
+}
+
+// counterDelta returns the increase of a cumulative counter, treating a decrease
+// as a reset of the counter
+func counterDelta(previous, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net/http"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -64,6 +65,24 @@ func GetRuncPath() string {
 	return ""
 }
 
+// GetCtrPath returns the path to the ctr binary
+// It first checks if there's a bundled version, then falls back to PATH lookup
+func GetCtrPath() string {
+	// First check if we have a bundled version
+	bundledPath := GetBundledCtrPath()
+	if _, err := os.Stat(bundledPath); err == nil {
+		return bundledPath
+	}
+
+	// Fall back to PATH lookup
+	path, err := exec.LookPath("ctr")
+	if err == nil {
+		return path
+	}
+
+	return ""
+}
+
 // GetCNIPath returns the path to the CNI plugins directory
 // It first checks if there's a bundled version, then falls back to standard locations
 func GetCNIPath() string {
@@ -111,6 +130,15 @@ func GetBundledRuncPath() string {
 	return filepath.Join(BundledBinaryDir, exeName)
 }
 
+// GetBundledCtrPath returns the path where the bundled ctr binary should be
+func GetBundledCtrPath() string {
+	exeName := "ctr"
+	if runtime.GOOS == "windows" {
+		exeName = "ctr.exe"
+	}
+	return filepath.Join(BundledBinaryDir, exeName)
+}
+
 // GetBundledCNIPath returns the path where the bundled CNI plugins should be
 func GetBundledCNIPath() string {
 	return filepath.Join(BundledBinaryDir, "cni")
@@ -134,22 +162,21 @@ func HasCNIPlugins() bool {
 // EnsureBundledContainerdExtracted extracts the bundled containerd binary if needed
 // This function would be called during application startup
 func EnsureBundledContainerdExtracted() error {
-	// Call the implementation function
-	return extractBundledContainerd()
+	return withBundledBinaryDirLock(extractBundledContainerd)
 }
 
 // EnsureBundledRuncExtracted extracts the bundled runc binary if needed
 func EnsureBundledRuncExtracted() error {
-	// Create the directory for bundled binaries if it doesn't exist
-	if err := os.MkdirAll(BundledBinaryDir, 0755); err != nil {
-		return fmt.Errorf("failed to create bundled binary directory: %w", err)
-	}
+	return withBundledBinaryDirLock(extractBundledRunc)
+}
 
+// extractBundledRunc extracts the bundled runc binary if needed
+// The caller must hold the lock of lockBundledBinaryDir.
+func extractBundledRunc() error {
 	bundledPath := GetBundledRuncPath()
 
-	// Check if the binary already exists and is executable
-	if info, err := os.Stat(bundledPath); err == nil && info.Mode()&0111 != 0 {
-		// Binary already exists and is executable, no need to extract
+	// Reuse the extracted binary unless this release ships another version
+	if bundledUpToDate(ComponentRunc, bundledPath) {
 		return nil
 	}
 
@@ -174,37 +201,30 @@ func EnsureBundledRuncExtracted() error {
 	}
 
 	// Copy the source binary to the destination
-	sourceFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("failed to open source binary: %w", err)
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.OpenFile(bundledPath, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create destination binary file: %w", err)
-	}
-	defer destFile.Close()
-
-	if _, err := io.Copy(destFile, sourceFile); err != nil {
-		return fmt.Errorf("failed to copy runc binary: %w", err)
+	if err := installBinary(sourcePath, bundledPath); err != nil {
+		return err
 	}
 
-	return nil
+	return recordExtracted(ComponentRunc)
 }
 
 // EnsureBundledCNIPluginsExtracted extracts the bundled CNI plugins if needed
 func EnsureBundledCNIPluginsExtracted() error {
+	return withBundledBinaryDirLock(extractBundledCNIPlugins)
+}
+
+// extractBundledCNIPlugins extracts the bundled CNI plugins if needed
+// The caller must hold the lock of lockBundledBinaryDir.
+func extractBundledCNIPlugins() error {
 	// Create the directory for bundled binaries if it doesn't exist
 	cniDir := GetBundledCNIPath()
 	if err := os.MkdirAll(cniDir, 0755); err != nil {
 		return fmt.Errorf("failed to create bundled CNI directory: %w", err)
 	}
 
-	// Check if the directory already has plugins
+	// Reuse the extracted plugins unless this release ships another version
 	entries, err := os.ReadDir(cniDir)
-	if err == nil && len(entries) > 0 {
-		// Already has plugins, no need to extract
+	if err == nil && len(entries) > 0 && bundledUpToDate(ComponentCNI, cniDir) {
 		return nil
 	}
 
@@ -234,34 +254,32 @@ func EnsureBundledCNIPluginsExtracted() error {
 		return fmt.Errorf("failed to read CNI plugins directory: %w", err)
 	}
 
+	// The plugins are many binaries of a few MB each, copy some at a time
+	var wg sync.WaitGroup
+	errs := make(chan error, len(entries))
+	workers := make(chan struct{}, extractWorkers)
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 
-		sourcePath := filepath.Join(sourceDir, entry.Name())
-		destPath := filepath.Join(cniDir, entry.Name())
-
-		sourceFile, err := os.Open(sourcePath)
-		if err != nil {
-			return fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
-		}
-
-		destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY, 0755)
-		if err != nil {
-			sourceFile.Close()
-			return fmt.Errorf("failed to create destination file %s: %w", destPath, err)
-		}
-
-		_, err = io.Copy(destFile, sourceFile)
-		sourceFile.Close()
-		destFile.Close()
-		if err != nil {
-			return fmt.Errorf("failed to copy plugin %s: %w", entry.Name(), err)
-		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			if err := installBinary(filepath.Join(sourceDir, name), filepath.Join(cniDir, name)); err != nil {
+				errs <- fmt.Errorf("failed to copy plugin %s: %w", name, err)
+			}
+		}(entry.Name())
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
 	}
 
-	return nil
+	return recordExtracted(ComponentCNI)
 }
 
 // GetContainerdVersion returns the installed containerd version
@@ -426,36 +444,6 @@ func IsLinuxKitVMRunning(config LinuxKitConfig) bool {
 	return err == nil
 }
 
-// downloadFile downloads a file from a URL to a local path
-func downloadFile(url, outputPath string) error {
-	// Create the destination file
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file %s: %w", outputPath, err)
-	}
-	defer out.Close()
-
-	// Get the file from the URL
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to GET from %s: %w", url, err)
-	}
-	defer resp.Body.Close()
-
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
-	}
-
-	// Copy the response body to the file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
-	}
-
-	return nil
-}
-
 // StartLinuxKitVM starts the LinuxKit VM on macOS
 func StartLinuxKitVM(ctx context.Context, config LinuxKitConfig) error {
 	if !IsRunningOnMacOS() {
@@ -483,11 +471,19 @@ func StartLinuxKitVM(ctx context.Context, config LinuxKitConfig) error {
 		return fmt.Errorf("failed to create LinuxKit state directory: %w", err)
 	}
 
+	// A stable UUID keeps the VM's address, published ports are forwarded to it
+	uuid, err := linuxKitUUID(config)
+	if err != nil {
+		return err
+	}
+
 	// Prepare hyperkit command
 	args := []string{
 		"-m", fmt.Sprintf("%d", config.Memory),
 		"-c", fmt.Sprintf("%d", config.CPUs),
-		"-s", fmt.Sprintf("virtio-blk,file://%s,format=raw", filepath.Join(config.StateDir, "disk.img")),
+		"-U", uuid,
+		"-s", fmt.Sprintf("virtio-blk,file://%s,format=raw", VMDiskPath(config)),
+		"-s", linuxKitNetDevice,
 		"-l", "com1,stdio",
 		"-F", filepath.Join(config.StateDir, "hyperkit.pid"),
 		"-u", // UEFI boot
@@ -658,6 +654,12 @@ func EnsureLinuxKitComponents() error {
 	return nil
 }
 
+// dirExists checks if a directory exists
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
 // fileExists checks if a file exists and is not a directory
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -698,16 +700,16 @@ func IsHyperKitInstalled() bool {
 
 // EnsureBundledHyperKitExtracted ensures the bundled HyperKit binary is extracted
 func EnsureBundledHyperKitExtracted() error {
-	// Create the directory for bundled binaries if it doesn't exist
-	if err := os.MkdirAll(BundledBinaryDir, 0755); err != nil {
-		return fmt.Errorf("failed to create bundled binary directory: %w", err)
-	}
+	return withBundledBinaryDirLock(extractBundledHyperKit)
+}
 
+// extractBundledHyperKit extracts the bundled HyperKit binary if needed
+// The caller must hold the lock of lockBundledBinaryDir.
+func extractBundledHyperKit() error {
 	bundledPath := GetBundledHyperKitPath()
 
-	// Check if the binary already exists and is executable
-	if info, err := os.Stat(bundledPath); err == nil && info.Mode()&0111 != 0 {
-		// Binary already exists and is executable, no need to extract
+	// Reuse the extracted binary unless this release ships another version
+	if bundledUpToDate(ComponentHyperKit, bundledPath) {
 		return nil
 	}
 
@@ -725,53 +727,71 @@ func EnsureBundledHyperKitExtracted() error {
 		return fmt.Errorf("bundled HyperKit binary not found at %s: %w", sourcePath, err)
 	}
 
-	// Open the source binary file
-	sourceFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("failed to open source binary: %w", err)
+	// Copy the source binary to the destination
+	if err := installBinary(sourcePath, bundledPath); err != nil {
+		return err
 	}
-	defer sourceFile.Close()
 
-	// Create the destination file
-	destFile, err := os.OpenFile(bundledPath, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create destination binary file: %w", err)
-	}
-	defer destFile.Close()
+	return recordExtracted(ComponentHyperKit)
+}
 
-	// Copy the source binary to the destination
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		return fmt.Errorf("failed to extract binary: %w", err)
-	}
+// extractWorkers bounds the binaries copied at the same time while extracting
+const extractWorkers = 4
 
-	return nil
+// bundledComponent is a component EnsureAllBundledComponentsExtracted extracts
+type bundledComponent struct {
+	name    string
+	extract func() error
 }
 
 // EnsureAllBundledComponentsExtracted ensures all bundled components are extracted
+// The components are extracted concurrently, and the time each took is logged
+// so a slow first start shows where the time went.
 func EnsureAllBundledComponentsExtracted() error {
-	// Extract containerd
-	if err := EnsureBundledContainerdExtracted(); err != nil {
-		return fmt.Errorf("failed to extract bundled containerd: %w", err)
-	}
-
-	// Extract runc
-	if err := EnsureBundledRuncExtracted(); err != nil {
-		return fmt.Errorf("failed to extract bundled runc: %w", err)
+	// Another fun process may be extracting at the same time
+	unlock, err := lockBundledBinaryDir()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	// Extract CNI plugins
-	if err := EnsureBundledCNIPluginsExtracted(); err != nil {
-		return fmt.Errorf("failed to extract bundled CNI plugins: %w", err)
+	components := []bundledComponent{
+		{"containerd", extractBundledContainerd},
+		{"runc", extractBundledRunc},
+		{"CNI plugins", extractBundledCNIPlugins},
 	}
-
-	// Extract HyperKit (macOS only)
+	// HyperKit is only used on macOS
 	if runtime.GOOS == "darwin" {
-		if err := EnsureBundledHyperKitExtracted(); err != nil {
-			return fmt.Errorf("failed to extract bundled HyperKit: %w", err)
+		components = append(components, bundledComponent{"HyperKit", extractBundledHyperKit})
+	}
+
+	start := time.Now()
+	durations := make([]time.Duration, len(components))
+	errs := make([]error, len(components))
+	var wg sync.WaitGroup
+	for i, component := range components {
+		wg.Add(1)
+		go func(i int, extract func() error) {
+			defer wg.Done()
+			componentStart := time.Now()
+			errs[i] = extract()
+			durations[i] = time.Since(componentStart)
+		}(i, component.extract)
+	}
+	wg.Wait()
+
+	timings := make([]string, len(components))
+	for i, component := range components {
+		timings[i] = fmt.Sprintf("%s %s", component.name, durations[i].Round(time.Millisecond))
+	}
+	log.Printf("Bundled components ready in %s (%s)", time.Since(start).Round(time.Millisecond), strings.Join(timings, ", "))
+
+	// Report the first failure in the order the components were always extracted in
+	for i, component := range components {
+		if errs[i] != nil {
+			return fmt.Errorf("failed to extract bundled %s: %w", component.name, errs[i])
 		}
 	}
-
 	return nil
 }
 
@@ -0,0 +1,197 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// VMDiskName is the file name of the LinuxKit VM disk image in its state directory
+const VMDiskName = "disk.img"
+
+// vmDiskChunk is the block size compact and move use to find zeroed regions
+const vmDiskChunk = 1 << 20
+
+// VMDiskUsage describes the LinuxKit VM disk image
+type VMDiskUsage struct {
+	// Path is where the image is stored, after following a move to another volume
+	Path string `json:"path"`
+	// Size is the capacity of the disk as seen by the VM
+	Size int64 `json:"size"`
+	// Allocated is the space the sparse image takes on the host
+	Allocated int64 `json:"allocated"`
+}
+
+// VMDiskPath returns the path hyperkit opens the VM disk at, a symlink if the
+// disk was moved to another volume
+func VMDiskPath(config LinuxKitConfig) string {
+	return filepath.Join(config.StateDir, VMDiskName)
+}
+
+// GetVMDiskUsage returns the size and host usage of the VM disk
+func GetVMDiskUsage(config LinuxKitConfig) (*VMDiskUsage, error) {
+	path, err := filepath.EvalSymlinks(VMDiskPath(config))
+	if err != nil {
+		return nil, fmt.Errorf("no VM disk at %s: %w", VMDiskPath(config), err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat VM disk: %w", err)
+	}
+	return &VMDiskUsage{Path: path, Size: info.Size(), Allocated: allocatedSize(info)}, nil
+}
+
+// ResizeVMDisk grows the VM disk to sizeGB, the VM sees the new capacity on its
+// next boot. Shrinking is refused since the guest filesystem may use the space.
+func ResizeVMDisk(config LinuxKitConfig, sizeGB int) error {
+	usage, err := stoppedVMDisk(config)
+	if err != nil {
+		return err
+	}
+	size := int64(sizeGB) << 30
+	if size < usage.Size {
+		return fmt.Errorf("the VM disk is %d GB, shrinking it would lose data", usage.Size>>30)
+	}
+	if err := os.Truncate(usage.Path, size); err != nil {
+		return fmt.Errorf("failed to resize VM disk: %w", err)
+	}
+	return nil
+}
+
+// CompactVMDisk rewrites the VM disk sparsely, releasing the host space of blocks
+// the guest zeroed. It returns the number of bytes released.
+func CompactVMDisk(config LinuxKitConfig) (int64, error) {
+	usage, err := stoppedVMDisk(config)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := usage.Path + ".compact"
+	if err := copySparse(usage.Path, tmp); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, usage.Path); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to replace VM disk: %w", err)
+	}
+
+	compacted, err := GetVMDiskUsage(config)
+	if err != nil {
+		return 0, err
+	}
+	return usage.Allocated - compacted.Allocated, nil
+}
+
+// MoveVMDisk moves the VM disk into dir, such as a larger volume, and links it
+// from the state directory so the VM finds it. Moving it back into the state
+// directory removes the link.
+func MoveVMDisk(config LinuxKitConfig, dir string) error {
+	usage, err := stoppedVMDisk(config)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	target := filepath.Join(dir, VMDiskName)
+	if target == usage.Path {
+		return nil
+	}
+	if _, err := os.Lstat(target); err == nil && target != VMDiskPath(config) {
+		return fmt.Errorf("%s already exists", target)
+	}
+
+	// Copy across volumes, a rename only works within one
+	staged := target + ".moving"
+	if err := os.Rename(usage.Path, staged); err != nil {
+		if err := copySparse(usage.Path, staged); err != nil {
+			os.Remove(staged)
+			return err
+		}
+		if err := os.Remove(usage.Path); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("failed to remove the old VM disk: %w", err)
+		}
+	}
+
+	link := VMDiskPath(config)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s, the disk is at %s: %w", link, staged, err)
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("failed to move VM disk, it is at %s: %w", staged, err)
+	}
+	if target != link {
+		if err := os.Symlink(target, link); err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", link, target, err)
+		}
+	}
+	return nil
+}
+
+// stoppedVMDisk returns the VM disk, refusing while the VM uses it
+func stoppedVMDisk(config LinuxKitConfig) (*VMDiskUsage, error) {
+	if IsLinuxKitVMRunning(config) {
+		return nil, fmt.Errorf("the VM %s is running, stop it first", config.Name)
+	}
+	return GetVMDiskUsage(config)
+}
+
+// copySparse copies a disk image, skipping zeroed chunks so they take no space
+func copySparse(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", src, err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	buf := make([]byte, vmDiskChunk)
+	zero := make([]byte, vmDiskChunk)
+	for {
+		n, readErr := io.ReadFull(in, buf)
+		if n > 0 {
+			var err error
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, err = out.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = out.Write(buf[:n])
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write %s: %w", dst, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read %s: %w", src, readErr)
+		}
+	}
+
+	// Trailing zeroes were skipped, the size has to be set explicitly
+	if err := out.Truncate(info.Size()); err != nil {
+		return fmt.Errorf("failed to size %s: %w", dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package container
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the space a file takes on disk, less than its size if sparse
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
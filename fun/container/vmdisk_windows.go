@@ -0,0 +1,8 @@
+package container
+
+import "os"
+
+// allocatedSize returns the space a file takes on disk, Windows reports the size
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,156 @@
+package container
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vmnetLeases is where macOS records the addresses vmnet handed to VMs
+const vmnetLeases = "/var/db/dhcpd_leases"
+
+// linuxKitNetDevice is the hyperkit network device of the VM, backed by vmnet
+const linuxKitNetDevice = "2:0,virtio-net"
+
+// linuxKitUUID returns the UUID of the VM, created on first use
+// vmnet derives the VM's MAC address from it, so it has to stay the same for the
+// VM to keep its address.
+func linuxKitUUID(config LinuxKitConfig) (string, error) {
+	path := filepath.Join(config.StateDir, "uuid")
+	if data, err := os.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate VM UUID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create LinuxKit state directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(uuid+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to save VM UUID: %w", err)
+	}
+	return uuid, nil
+}
+
+// linuxKitMAC returns the MAC address vmnet gives the VM, which hyperkit prints
+// for a UUID without starting it
+func linuxKitMAC(config LinuxKitConfig) (string, error) {
+	uuid, err := linuxKitUUID(config)
+	if err != nil {
+		return "", err
+	}
+	hyperkitPath := GetHyperKitPath()
+	if hyperkitPath == "" {
+		return "", fmt.Errorf("hyperkit binary not found")
+	}
+	output, err := exec.Command(hyperkitPath, "-M", "-U", uuid, "-s", linuxKitNetDevice).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the VM MAC address: %w, output: %s", err, string(output))
+	}
+	_, mac, ok := strings.Cut(strings.TrimSpace(string(output)), "MAC:")
+	if !ok {
+		return "", fmt.Errorf("unexpected hyperkit output: %s", string(output))
+	}
+	return normalizeMAC(strings.TrimSpace(mac)), nil
+}
+
+// LinuxKitVMAddress finds the IP address of the running VM in the vmnet leases
+// It asks hyperkit for the VM's MAC address once and reads the leases again
+// only when the file changed, so it is cheap to call on every reconcile.
+type LinuxKitVMAddress struct {
+	config LinuxKitConfig
+
+	mutex sync.Mutex
+	mac   string
+	// modTime and size identify the version of the leases ip was read from
+	modTime time.Time
+	size    int64
+	ip      string
+}
+
+// NewLinuxKitVMAddress creates a resolver for the address of the VM of config
+func NewLinuxKitVMAddress(config LinuxKitConfig) *LinuxKitVMAddress {
+	return &LinuxKitVMAddress{config: config}
+}
+
+// Get returns the VM's address, an error if vmnet has no lease for it
+func (a *LinuxKitVMAddress) Get() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// The MAC address only depends on the VM's UUID, which doesn't change
+	if a.mac == "" {
+		mac, err := linuxKitMAC(a.config)
+		if err != nil {
+			return "", err
+		}
+		a.mac = mac
+	}
+
+	info, err := os.Stat(vmnetLeases)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vmnet leases: %w", err)
+	}
+	if a.ip != "" && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return a.ip, nil
+	}
+
+	ip, err := findVMNetLease(a.mac)
+	if err != nil {
+		a.ip = ""
+		return "", err
+	}
+	a.ip, a.modTime, a.size = ip, info.ModTime(), info.Size()
+	return ip, nil
+}
+
+// findVMNetLease returns the address leased to the given MAC address
+func findVMNetLease(mac string) (string, error) {
+	file, err := os.Open(vmnetLeases)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vmnet leases: %w", err)
+	}
+	defer file.Close()
+
+	// Entries are blocks of key=value lines, ip_address comes before hw_address
+	var ip string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		switch key {
+		case "ip_address":
+			ip = value
+		case "hw_address":
+			// The value is prefixed with the hardware type, e.g. "1,"
+			if _, hw, ok := strings.Cut(value, ","); ok && normalizeMAC(hw) == mac {
+				return ip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no vmnet lease for the VM (MAC %s), is it running?", mac)
+}
+
+// normalizeMAC formats a MAC address with two lowercase digits per octet, vmnet
+// leases drop leading zeros
+func normalizeMAC(mac string) string {
+	octets := strings.Split(strings.ToLower(mac), ":")
+	for i, octet := range octets {
+		if value, err := strconv.ParseUint(octet, 16, 8); err == nil {
+			octets[i] = fmt.Sprintf("%02x", value)
+		}
+	}
+	return strings.Join(octets, ":")
+}
@@ -0,0 +1,251 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WatchRule syncs the files under a host path to a path in a container
+type WatchRule struct {
+	HostPath      string
+	ContainerPath string
+}
+
+// ParseWatchRule parses a "host:container" watch rule
+func ParseWatchRule(spec string) (WatchRule, error) {
+	// Split on the last colon, Windows host paths have a drive letter
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 || i == len(spec)-1 || !path.IsAbs(spec[i+1:]) {
+		return WatchRule{}, fmt.Errorf("invalid watch rule %q, expected host-path:container-path", spec)
+	}
+	hostPath, err := filepath.Abs(spec[:i])
+	if err != nil {
+		return WatchRule{}, err
+	}
+	return WatchRule{HostPath: hostPath, ContainerPath: spec[i+1:]}, nil
+}
+
+// WatchOptions contains options for syncing files into a container during development
+type WatchOptions struct {
+	Rules []WatchRule
+	// Interval between scans of the host paths, defaults to a second
+	Interval time.Duration
+	// Restart restarts the container after a sync, for apps that don't reload by themselves
+	Restart bool
+	// OnSync is called after changes were applied, with container paths
+	OnSync func(changed, removed []string)
+}
+
+// watchedFile is what a scan remembers of a file to detect changes
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	dir     bool
+}
+
+// scanWatchRule lists the files under a rule's host path, skipping VCS directories
+func scanWatchRule(rule WatchRule) (map[string]watchedFile, error) {
+	files := make(map[string]watchedFile)
+	err := filepath.Walk(rule.HostPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may disappear while the tree is walked
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && (info.Name() == ".git" || info.Name() == ".hg") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(rule.HostPath, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = watchedFile{modTime: info.ModTime(), size: info.Size(), dir: info.IsDir()}
+		return nil
+	})
+	return files, err
+}
+
+// boundInto reports whether a rule's host path is bind-mounted at its container
+// path, in which case changes show up in the container without syncing
+func (c *Client) boundInto(ctx context.Context, containerID string, rule WatchRule) bool {
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return false
+	}
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return false
+	}
+	for _, mount := range spec.Mounts {
+		if mount.Type == "bind" && filepath.Clean(mount.Source) == rule.HostPath && path.Clean(mount.Destination) == path.Clean(rule.ContainerPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch scans the host paths of the rules and applies changes to the container
+// until ctx is done, copying files through tar in the container unless the path
+// is bind-mounted, and restarting it afterwards if requested
+func (c *Client) Watch(ctx context.Context, containerID string, opts WatchOptions) error {
+	if len(opts.Rules) == 0 {
+		return errors.New("no paths to watch")
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	nsCtx := c.withNamespace(ctx)
+	bound := make([]bool, len(opts.Rules))
+	previous := make([]map[string]watchedFile, len(opts.Rules))
+	for i, rule := range opts.Rules {
+		files, err := scanWatchRule(rule)
+		if err != nil {
+			return errors.Wrapf(err, "failed to scan %s", rule.HostPath)
+		}
+		previous[i] = files
+		bound[i] = c.boundInto(nsCtx, containerID, rule)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		var changed, removed []string
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for i, rule := range opts.Rules {
+			files, err := scanWatchRule(rule)
+			if err != nil {
+				return errors.Wrapf(err, "failed to scan %s", rule.HostPath)
+			}
+			for rel, file := range files {
+				if old, ok := previous[i][rel]; ok && old == file {
+					continue
+				}
+				target := path.Join(rule.ContainerPath, rel)
+				changed = append(changed, target)
+				if !bound[i] {
+					if err := addToArchive(tw, filepath.Join(rule.HostPath, filepath.FromSlash(rel)), target); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			for rel := range previous[i] {
+				if _, ok := files[rel]; !ok {
+					removed = append(removed, path.Join(rule.ContainerPath, rel))
+				}
+			}
+			previous[i] = files
+		}
+		if err := tw.Close(); err != nil {
+			return errors.Wrap(err, "failed to archive changes")
+		}
+		if len(changed) == 0 && len(removed) == 0 {
+			continue
+		}
+		sort.Strings(changed)
+		sort.Strings(removed)
+
+		if err := c.syncIntoContainer(ctx, containerID, &archive, removed); err != nil {
+			return err
+		}
+		if opts.Restart {
+			if err := c.RestartContainer(ctx, containerID, 10*time.Second); err != nil {
+				return errors.Wrap(err, "failed to restart container after sync")
+			}
+		}
+		if opts.OnSync != nil {
+			opts.OnSync(changed, removed)
+		}
+	}
+}
+
+// addToArchive adds a host file or directory to a tar stream at target
+func addToArchive(tw *tar.Writer, hostPath, target string) error {
+	info, err := os.Lstat(hostPath)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(hostPath); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = strings.TrimPrefix(target, "/")
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(tw, file, header.Size)
+	return err
+}
+
+// syncIntoContainer removes paths in the container and extracts the archive
+// into it, which needs tar and rm in the image
+func (c *Client) syncIntoContainer(ctx context.Context, containerID string, archive *bytes.Buffer, removed []string) error {
+	var stderr bytes.Buffer
+	if len(removed) > 0 {
+		code, err := c.Exec(ctx, containerID, ExecOptions{
+			Command: append([]string{"rm", "-rf", "--"}, removed...),
+			Stdout:  io.Discard,
+			Stderr:  &stderr,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to remove files in the container")
+		}
+		if code != 0 {
+			return fmt.Errorf("removing files in the container failed: %s", strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	// An empty archive still has its end marker
+	if archive.Len() <= 1024 {
+		return nil
+	}
+	stderr.Reset()
+	code, err := c.Exec(ctx, containerID, ExecOptions{
+		Command: []string{"tar", "-xf", "-", "-C", "/"},
+		Stdin:   archive,
+		Stdout:  io.Discard,
+		Stderr:  &stderr,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to copy files into the container")
+	}
+	if code != 0 {
+		return fmt.Errorf("copying files into the container failed, does the image have tar? %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
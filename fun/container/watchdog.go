@@ -0,0 +1,369 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// LabelThrottled records the memory.high the watchdog set on a best-effort
+// container, which it lifts once the memory pressure is over
+const LabelThrottled = "fun.throttled"
+
+// Throttling lowers memory.high of a container to a share of its working set,
+// so the kernel reclaims its memory and slows it down while it allocates more,
+// instead of freezing it, which would free nothing
+const (
+	throttleShare     = 0.8
+	throttleMinMemory = 32 << 20
+)
+
+// Kinds of host pressure the watchdog reports
+const (
+	// PressureOOM means the kernel OOM killer ran since the last check
+	PressureOOM = "oom"
+	// PressureMemory means the available memory fell below the threshold
+	PressureMemory = "memory"
+	// PressureDisk means the free space of the container root fell below the threshold
+	PressureDisk = "disk"
+)
+
+// Actions the watchdog takes on best-effort (low priority) containers under
+// memory pressure
+const (
+	WatchdogActionNone     = "none"
+	WatchdogActionThrottle = "throttle"
+	WatchdogActionStop     = "stop"
+)
+
+// ParseWatchdogAction normalizes a watchdog action, empty is WatchdogActionNone
+func ParseWatchdogAction(action string) (string, error) {
+	switch action {
+	case "", WatchdogActionNone:
+		return WatchdogActionNone, nil
+	case WatchdogActionThrottle, WatchdogActionStop:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid watchdog action %q, expected none, throttle or stop", action)
+}
+
+// WatchdogConfig contains the thresholds and actions of the host watchdog
+type WatchdogConfig struct {
+	// MinMemoryAvailable and MinDiskFree are in bytes, 0 disables the check
+	MinMemoryAvailable int64
+	MinDiskFree        int64
+	// PruneImages also deletes unused images when the disk runs full
+	PruneImages bool
+	// Action is taken on best-effort containers under memory pressure
+	Action string
+}
+
+// PressureEvent is a threshold crossed on the host, or the OOM killer running
+type PressureEvent struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Watchdog watches the host for OOM kills, low memory and low disk space and
+// reclaims resources before the host becomes unusable
+type Watchdog struct {
+	client *Client
+	config WatchdogConfig
+	// alert is called when a threshold is crossed, not again until it recovered
+	alert func(event PressureEvent)
+
+	mutex       sync.Mutex
+	oomKills    uint64
+	memoryLow   bool
+	diskLow     bool
+	initialized bool
+}
+
+// NewWatchdog creates a host watchdog for the client's containers
+func NewWatchdog(client *Client, config WatchdogConfig) *Watchdog {
+	return &Watchdog{
+		client: client,
+		config: config,
+	}
+}
+
+// SetAlertHandler sets the function called when the host comes under pressure
+func (w *Watchdog) SetAlertHandler(alert func(event PressureEvent)) {
+	w.alert = alert
+}
+
+// Run checks the host every interval until ctx is done
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w.check(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// check compares the host against the thresholds once
+func (w *Watchdog) check(ctx context.Context) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// The OOM kill counter only tells something once there is a baseline
+	if kills, ok := hostOOMKills(); ok {
+		if w.initialized && kills > w.oomKills {
+			w.report(PressureEvent{
+				Kind:    PressureOOM,
+				Message: fmt.Sprintf("the kernel OOM killer ran %d times since the last check", kills-w.oomKills),
+				Time:    time.Now(),
+			})
+		}
+		w.oomKills = kills
+	}
+	w.initialized = true
+
+	if w.config.MinMemoryAvailable > 0 {
+		if available := hostMemoryAvailable(); available > 0 {
+			low := available < w.config.MinMemoryAvailable
+			if low && !w.memoryLow {
+				w.report(PressureEvent{
+					Kind:    PressureMemory,
+					Message: fmt.Sprintf("%d bytes of memory available, below the threshold of %d bytes", available, w.config.MinMemoryAvailable),
+					Time:    time.Now(),
+				})
+			}
+			if !low && w.memoryLow {
+				log.Printf("Watchdog: memory pressure ended, %d bytes available", available)
+			}
+			w.memoryLow = low
+			w.relieveMemory(ctx, low)
+		}
+	}
+
+	if w.config.MinDiskFree > 0 {
+		root := w.client.diskRoot(ctx)
+		if free, ok := DiskFree(root); ok {
+			low := free < w.config.MinDiskFree
+			if low && !w.diskLow {
+				w.report(PressureEvent{
+					Kind:    PressureDisk,
+					Message: fmt.Sprintf("%d bytes free under %s, below the threshold of %d bytes", free, root, w.config.MinDiskFree),
+					Time:    time.Now(),
+				})
+			}
+			w.diskLow = low
+			if low {
+				w.reclaimDisk(ctx)
+			}
+		}
+	}
+}
+
+// report logs a pressure event and passes it to the alert handler
+func (w *Watchdog) report(event PressureEvent) {
+	log.Printf("Watchdog: %s pressure: %s", event.Kind, event.Message)
+	if w.alert != nil {
+		w.alert(event)
+	}
+}
+
+// relieveMemory applies the configured action to best-effort containers while
+// memory is low, and lifts it once memory recovered
+func (w *Watchdog) relieveMemory(ctx context.Context, low bool) {
+	switch w.config.Action {
+	case WatchdogActionThrottle:
+		if err := w.client.throttleBestEffort(ctx, low); err != nil {
+			log.Printf("Warning: Watchdog failed to throttle containers: %v", err)
+		}
+	case WatchdogActionStop:
+		policy := PreemptionPolicy{
+			MinMemoryAvailable: w.config.MinMemoryAvailable,
+			StopTimeout:        10 * time.Second,
+			MaxPriority:        PriorityLow,
+		}
+		if !low {
+			if _, err := w.client.ResumePreempted(ctx, policy); err != nil {
+				log.Printf("Warning: Watchdog failed to resume a container: %v", err)
+			}
+			return
+		}
+		if _, err := w.client.RelievePressure(ctx, policy); err != nil {
+			log.Printf("Warning: Watchdog failed to stop a container: %v", err)
+		}
+	}
+}
+
+// reclaimDisk collects unreferenced image content and truncates the logs of
+// exited containers
+func (w *Watchdog) reclaimDisk(ctx context.Context) {
+	result, err := w.client.GarbageCollect(ctx, w.config.PruneImages)
+	if err != nil {
+		log.Printf("Warning: Watchdog image garbage collection skipped: %v", err)
+	} else {
+		log.Printf("Watchdog: image garbage collection reclaimed %d bytes, pruned %d images", result.ReclaimedBytes, len(result.PrunedImages))
+	}
+
+	reclaimed, err := w.client.TruncateExitedLogs(ctx)
+	if err != nil {
+		log.Printf("Warning: Watchdog failed to truncate logs: %v", err)
+	} else if reclaimed > 0 {
+		log.Printf("Watchdog: truncated %d bytes of logs of exited containers", reclaimed)
+	}
+}
+
+// hostOOMKills returns the number of kernel OOM kills since boot, false if
+// the kernel doesn't count them
+func hostOOMKills() (uint64, bool) {
+	file, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// throttleBestEffort lowers memory.high of the running low-priority containers,
+// or restores it on the ones it throttled when throttle is false. It needs
+// cgroup v2, v1 has no equivalent that reclaims without OOM kills.
+func (c *Client) throttleBestEffort(ctx context.Context, throttle bool) error {
+	if throttle && DetectCgroupMode() != CgroupV2 {
+		return fmt.Errorf("throttling needs cgroup v2, the host uses %s", DetectCgroupMode())
+	}
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			continue
+		}
+		if throttle == (labels[LabelThrottled] != "") || (throttle && labels[LabelPriority] != PriorityLow) {
+			continue
+		}
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+		status, err := task.Status(ctx)
+		if err != nil {
+			continue
+		}
+
+		if throttle {
+			if status.Status != containerd.Running {
+				continue
+			}
+			stats, err := c.ContainerStats(ctx, container.ID())
+			if err != nil {
+				continue
+			}
+			high := uint64(float64(stats.MemoryWorkingSet) * throttleShare)
+			if high < throttleMinMemory {
+				continue
+			}
+			value := strconv.FormatUint(high, 10)
+			if c.dryRunf("throttle best-effort container %s to %s bytes of memory", container.ID(), value) {
+				continue
+			}
+			if err := setMemoryHigh(ctx, task, value); err != nil {
+				return errors.Wrapf(err, "failed to throttle container %s", container.ID())
+			}
+			if _, err := container.SetLabels(ctx, map[string]string{LabelThrottled: value}); err != nil {
+				return errors.Wrapf(err, "failed to mark container %s as throttled", container.ID())
+			}
+			log.Printf("Watchdog: throttled best-effort container %s to %s bytes of memory", container.ID(), value)
+			continue
+		}
+
+		if c.dryRunf("lift the throttle of container %s", container.ID()) {
+			continue
+		}
+		// The container's own memory.high, if it had one, comes back
+		value := "max"
+		if spec, err := container.Spec(ctx); err == nil && spec.Linux != nil && spec.Linux.Resources != nil {
+			if high := spec.Linux.Resources.Unified["memory.high"]; high != "" {
+				value = high
+			}
+		}
+		if status.Status == containerd.Running || status.Status == containerd.Paused {
+			if err := setMemoryHigh(ctx, task, value); err != nil {
+				return errors.Wrapf(err, "failed to lift the throttle of container %s", container.ID())
+			}
+		}
+		if _, err := container.SetLabels(ctx, map[string]string{LabelThrottled: ""}); err != nil {
+			return errors.Wrapf(err, "failed to clear throttled marker of container %s", container.ID())
+		}
+		log.Printf("Watchdog: lifted the throttle of container %s", container.ID())
+	}
+	return nil
+}
+
+// setMemoryHigh updates memory.high of a running task's cgroup
+func setMemoryHigh(ctx context.Context, task containerd.Task, value string) error {
+	return task.Update(ctx, containerd.WithResources(&specs.LinuxResources{
+		Unified: map[string]string{"memory.high": value},
+	}))
+}
+
+// TruncateExitedLogs empties the log files of containers that aren't running
+// and returns the bytes freed. Their output is lost, so this is a last resort
+// when the disk runs full.
+func (c *Client) TruncateExitedLogs(ctx context.Context) (int64, error) {
+	ctx = c.withNamespace(ctx)
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	var freed int64
+	for _, container := range containers {
+		if task, err := container.Task(ctx, nil); err == nil {
+			if status, err := task.Status(ctx); err == nil && status.Status != containerd.Stopped {
+				continue
+			}
+		}
+		logPath := c.containerLogPath(container.ID())
+		for _, path := range append(rotatedLogPaths(logPath), logPath) {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+				continue
+			}
+			if c.dryRunf("truncate log file %s of exited container %s", path, container.ID()) {
+				continue
+			}
+			if err := os.Truncate(path, 0); err != nil {
+				log.Printf("Warning: Failed to truncate %s: %v", path, err)
+				continue
+			}
+			freed += info.Size()
+		}
+	}
+	return freed, nil
+}
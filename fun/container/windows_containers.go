@@ -3,8 +3,6 @@ package container
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,6 +26,9 @@ type WSL2Config struct {
 	Swap   int    // Swap in MB
 	DiskGB int    // Disk size in GB
 	Kernel string // Optional custom kernel path
+	// Expose the CRI API on the containerd socket inside the distribution
+	EnableCRI    bool
+	SandboxImage string
 }
 
 // DefaultWSL2Config returns default WSL2 configuration
@@ -86,51 +87,16 @@ func downloadWSLRootFS(ctx context.Context, targetPath string) error {
 	}
 
 	// Download a minimal Ubuntu rootfs specifically for containers
-	// We're using Ubuntu 20.04 LTS for compatibility
-	ubuntuURL := "https://cloud-images.ubuntu.com/minimal/releases/focal/release/ubuntu-20.04-minimal-cloudimg-amd64-root.tar.xz"
+	// We're using Ubuntu 20.04 LTS for compatibility, for the native architecture
+	// since WSL runs arm64 distributions on Windows on ARM
+	ubuntuURL := fmt.Sprintf("https://cloud-images.ubuntu.com/minimal/releases/focal/release/ubuntu-20.04-minimal-cloudimg-%s-root.tar.xz", HostArch())
 
-	// Create a temporary file to download to
-	tempFile, err := os.CreateTemp("", "ubuntu-rootfs-*.tar.xz")
-	if err != nil {
-		return errors.Wrap(err, "failed to create temporary file for rootfs download")
-	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	// Download the rootfs
+	// The tarball is kept in the artifact cache, so reinstalling the distribution doesn't download it again
 	fmt.Printf("Downloading Ubuntu rootfs for WSL2... This may take a while.\n")
-
-	// Create an HTTP client with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
-	}
-
-	// Create the request
-	req, err := http.NewRequestWithContext(ctx, "GET", ubuntuURL, nil)
-	if err != nil {
-		return errors.Wrap(err, "failed to create HTTP request")
-	}
-
-	// Send the request
-	resp, err := client.Do(req)
+	tarball, err := fetchArtifact(ctx, ubuntuURL, "20.04")
 	if err != nil {
 		return errors.Wrap(err, "failed to download rootfs")
 	}
-	defer resp.Body.Close()
-
-	// Check the response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download rootfs: %s", resp.Status)
-	}
-
-	// Copy the response body to the temporary file
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return errors.Wrap(err, "failed to save rootfs download")
-	}
-
-	// Close the file
-	tempFile.Close()
 
 	// Extract the rootfs using tar
 	fmt.Printf("Extracting rootfs...\n")
@@ -144,7 +110,7 @@ func downloadWSLRootFS(ctx context.Context, targetPath string) error {
 	// On Windows we need to use a special approach since tar might not be available
 	// We'll use PowerShell's Expand-Archive cmdlet
 	extractCmd := exec.CommandContext(ctx, "powershell.exe", "-Command",
-		fmt.Sprintf("Expand-Archive -Path \"%s\" -DestinationPath \"%s\"", tempFile.Name(), targetPath))
+		fmt.Sprintf("Expand-Archive -Path \"%s\" -DestinationPath \"%s\"", tarball, targetPath))
 	output, err := extractCmd.CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to extract rootfs: %s", string(output))
@@ -168,18 +134,18 @@ func InstallWSL2Components(ctx context.Context, config WSL2Config) error {
 
 	// Create a new WSL2 distribution
 	// First, ensure the directory exists for our distribution
-	homeDir, _ := os.UserHomeDir()
-	wslDir := filepath.Join(homeDir, ".fun", "wsl")
+	wslDir := wslInstallDir()
 	if err := os.MkdirAll(wslDir, 0755); err != nil {
 		return errors.Wrap(err, "failed to create WSL directory")
 	}
 
-	// Path for the rootfs
-	rootfsPath := filepath.Join(wslDir, "rootfs")
-
-	// Download the rootfs
-	if err := downloadWSLRootFS(ctx, rootfsPath); err != nil {
-		return errors.Wrap(err, "failed to download rootfs for WSL")
+	// Prefer the rootfs shipped with this release, download one otherwise
+	rootfsPath := bundledWSLRootFS()
+	if rootfsPath == "" {
+		rootfsPath = filepath.Join(wslDir, "rootfs")
+		if err := downloadWSLRootFS(ctx, rootfsPath); err != nil {
+			return errors.Wrap(err, "failed to download rootfs for WSL")
+		}
 	}
 
 	// Import the distribution
@@ -190,6 +156,11 @@ func InstallWSL2Components(ctx context.Context, config WSL2Config) error {
 		return errors.Wrapf(err, "failed to import WSL distribution: %s", string(output))
 	}
 
+	// Older WSL releases can't manage the disk, it then grows up to WSL's default size
+	if err := applyWSLDiskSettings(ctx, config); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+
 	// Configure the distribution
 	if err := configureWSL2Distribution(config); err != nil {
 		return errors.Wrap(err, "failed to configure WSL distribution")
@@ -362,12 +333,12 @@ func EnsureContainerdInWSL(ctx context.Context, config WSL2Config) error {
 		return errors.Wrapf(err, "failed to create containerd config directory in WSL: %s", string(output))
 	}
 
-	// Write a basic config file
-	configContent := `
-[plugins]
-  [plugins."io.containerd.grpc.v1.cri"]
-    sandbox_image = "k8s.gcr.io/pause:3.6"
-`
+	// Write a config file matching the one used for the embedded server
+	configContent := generateContainerdConfig(containerdConfigOptions{
+		Address:      "/run/containerd/containerd.sock",
+		EnableCRI:    config.EnableCRI,
+		SandboxImage: config.SandboxImage,
+	})
 	// We need to create a temporary file locally and then copy it to WSL
 	tempFile, err := os.CreateTemp("", "containerd-config")
 	if err != nil {
@@ -0,0 +1,78 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Locations of the Linux fun daemon inside the WSL2 distribution, when it runs
+// there as the agent and the Windows daemon only controls it
+const (
+	WSLAgentBinary       = "/usr/local/bin/fun"
+	WSLAgentConfig       = "/etc/fun/config.json"
+	WSLAgentStateDir     = "/var/lib/fun/containers"
+	WSLAgentAdminSocket  = "/run/fun/admin.sock"
+	WSLAgentDockerSocket = "/run/fun/docker.sock"
+)
+
+// bundledWSLAgent returns the Linux build of fun shipped with the Windows release
+func bundledWSLAgent() (string, error) {
+	sourceDir, err := bundledSourceDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(bundledArchDir(filepath.Join(sourceDir, "wsl")), "fun")
+	if !fileExists(path) {
+		return "", fmt.Errorf("bundled Linux fun binary not found at %s", path)
+	}
+	return path, nil
+}
+
+// WSLPath returns the path a Windows path is mounted at inside WSL, such as
+// /mnt/c/Users for C:\Users. Paths without a drive letter are returned unchanged.
+func WSLPath(path string) string {
+	if len(path) < 2 || path[1] != ':' {
+		return path
+	}
+	rest := strings.ReplaceAll(path[2:], `\`, "/")
+	return "/mnt/" + strings.ToLower(path[:1]) + rest
+}
+
+// InstallWSLAgent copies the bundled Linux build of fun into the distribution
+func InstallWSLAgent(ctx context.Context, config WSL2Config) error {
+	binary, err := bundledWSLAgent()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "wsl.exe", "--distribution", config.Distribution, "--user", "root",
+		"--", "install", "-D", "-m", "0755", WSLPath(binary), WSLAgentBinary)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to install fun in WSL: %s", string(output))
+	}
+	return nil
+}
+
+// WriteWSLAgentConfig stores the agent's configuration in the distribution
+func WriteWSLAgentConfig(ctx context.Context, config WSL2Config, data []byte) error {
+	cmd := exec.CommandContext(ctx, "wsl.exe", "--distribution", config.Distribution, "--user", "root",
+		"--", "sh", "-c", fmt.Sprintf("mkdir -p %s && cat > %s", filepath.ToSlash(filepath.Dir(WSLAgentConfig)), WSLAgentConfig))
+	cmd.Stdin = bytes.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to write the fun configuration in WSL: %s", string(output))
+	}
+	return nil
+}
+
+// WSLAgentCommand returns a command running fun with args inside the
+// distribution, using the configuration written by WriteWSLAgentConfig
+func WSLAgentCommand(ctx context.Context, config WSL2Config, args ...string) *exec.Cmd {
+	wslArgs := []string{"--distribution", config.Distribution, "--user", "root",
+		"--", WSLAgentBinary, "-config", WSLAgentConfig}
+	return exec.CommandContext(ctx, "wsl.exe", append(wslArgs, args...)...)
+}
@@ -0,0 +1,122 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WSLDiskName is the virtual disk wsl.exe --import creates for the distribution
+const WSLDiskName = "ext4.vhdx"
+
+// WSLDiskPath returns the path of the WSL2 distribution's virtual disk
+func WSLDiskPath(config WSL2Config) string {
+	return filepath.Join(wslInstallDir(), WSLDiskName)
+}
+
+// applyWSLDiskSettings makes the distribution's disk sparse, so trimmed blocks
+// are released on the host, and limits it to config.DiskGB. It needs WSL 2.5 or
+// newer and a stopped distribution.
+func applyWSLDiskSettings(ctx context.Context, config WSL2Config) error {
+	if err := wslCommand(ctx, "--manage", config.Distribution, "--set-sparse", "true"); err != nil {
+		return errors.Wrap(err, "failed to make the WSL disk sparse")
+	}
+	if config.DiskGB > 0 {
+		if err := wslCommand(ctx, "--manage", config.Distribution, "--resize", fmt.Sprintf("%dGB", config.DiskGB)); err != nil {
+			return errors.Wrap(err, "failed to resize the WSL disk")
+		}
+	}
+	return nil
+}
+
+// GetWSLDiskUsage returns the size and host usage of the distribution's disk
+func GetWSLDiskUsage(config WSL2Config) (*VMDiskUsage, error) {
+	path := WSLDiskPath(config)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("no WSL disk at %s: %w", path, err)
+	}
+	usage := &VMDiskUsage{Path: path, Size: int64(config.DiskGB) << 30, Allocated: allocatedSize(info)}
+
+	// The capacity is only readable with the Hyper-V module, assume DiskGB was applied otherwise
+	output, err := runPowerShell(context.Background(), fmt.Sprintf("(Get-VHD -Path %s -ErrorAction Stop).Size", psQuote(path)))
+	if err == nil {
+		if size, err := strconv.ParseInt(output, 10, 64); err == nil {
+			usage.Size = size
+		}
+	}
+	return usage, nil
+}
+
+// ResizeWSLDisk sets the capacity of the distribution's disk to sizeGB,
+// stopping the distribution first
+func ResizeWSLDisk(ctx context.Context, config WSL2Config, sizeGB int) error {
+	if err := StopWSL2Environment(config); err != nil {
+		return err
+	}
+	if err := wslCommand(ctx, "--manage", config.Distribution, "--resize", fmt.Sprintf("%dGB", sizeGB)); err != nil {
+		return errors.Wrap(err, "failed to resize the WSL disk")
+	}
+	return nil
+}
+
+// TrimWSLDisk discards the blocks freed inside the distribution, which releases
+// their host space while it runs once the disk is sparse
+func TrimWSLDisk(ctx context.Context, config WSL2Config) error {
+	if err := wslCommand(ctx, "--distribution", config.Distribution, "--user", "root", "--", "fstrim", "-a"); err != nil {
+		return errors.Wrap(err, "failed to trim the WSL disk")
+	}
+	return nil
+}
+
+// CompactWSLDisk trims the distribution's disk, stops the distribution and
+// compacts the virtual disk file. It returns the number of bytes released.
+func CompactWSLDisk(ctx context.Context, config WSL2Config) (int64, error) {
+	before, err := GetWSLDiskUsage(config)
+	if err != nil {
+		return 0, err
+	}
+	if err := TrimWSLDisk(ctx, config); err != nil {
+		return 0, err
+	}
+	if err := StopWSL2Environment(config); err != nil {
+		return 0, err
+	}
+
+	// Optimize-VHD needs the Hyper-V module, diskpart is always available
+	path := psQuote(before.Path)
+	script := fmt.Sprintf("if (Get-Command Optimize-VHD -ErrorAction SilentlyContinue) { Optimize-VHD -Path %s -Mode Full -ErrorAction Stop } "+
+		"else { $script = New-TemporaryFile; "+
+		"Set-Content $script \"select vdisk file=`\"$(%s)`\"`nattach vdisk readonly`ncompact vdisk`ndetach vdisk\"; "+
+		"diskpart /s $script; $code = $LASTEXITCODE; Remove-Item $script; if ($code -ne 0) { exit $code } }", path, path)
+	if _, err := runPowerShell(ctx, script); err != nil {
+		return 0, errors.Wrap(err, "failed to compact the WSL disk")
+	}
+
+	after, err := GetWSLDiskUsage(config)
+	if err != nil {
+		return 0, err
+	}
+	return before.Allocated - after.Allocated, nil
+}
+
+// psQuote quotes a value for use in a PowerShell script
+func psQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// runPowerShell runs a PowerShell script, returning its trimmed output
+func runPowerShell(ctx context.Context, script string) (string, error) {
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,179 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// wslBackupPaths are the paths, relative to /, carried over when the
+// distribution is reset: the agent's state and its config directory. Bind
+// mounts of Windows paths under /mnt are not affected by a reset at all.
+var wslBackupPaths = []string{"var/lib/fun", "etc/fun"}
+
+// wslBackupExcludes are left out of the backup: containerd's content and
+// snapshots, which a reset drops, and the agent config, which is generated
+// again for the new distribution
+var wslBackupExcludes = []string{"var/lib/fun/containers/containerd", "etc/fun/config.json"}
+
+// wslInstallDir is where the WSL2 distribution's virtual disk is stored
+func wslInstallDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".fun", "wsl")
+}
+
+// bundledWSLRootFS returns the rootfs tarball shipped with this release, empty
+// if the release doesn't include one
+func bundledWSLRootFS() string {
+	sourceDir, err := bundledSourceDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(bundledArchDir(filepath.Join(sourceDir, "wsl")), "rootfs.tar")
+	if !fileExists(path) {
+		return ""
+	}
+	return path
+}
+
+// wslCommand runs wsl.exe, returning its output in the error on failure
+func wslCommand(ctx context.Context, args ...string) error {
+	output, err := exec.CommandContext(ctx, "wsl.exe", args...).CombinedOutput()
+	if err != nil {
+		// wsl.exe writes UTF-16, drop the NUL bytes to keep the message readable
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(strings.ReplaceAll(string(output), "\x00", "")))
+	}
+	return nil
+}
+
+// ExportWSL2Distribution writes the distribution to a tarball that
+// ImportWSL2Distribution can install on this or another machine
+func ExportWSL2Distribution(ctx context.Context, config WSL2Config, path string) error {
+	if !IsWSL2DistributionAvailable(config.Distribution) {
+		return fmt.Errorf("WSL distribution %s is not installed", config.Distribution)
+	}
+	if err := StopWSL2Environment(config); err != nil {
+		return err
+	}
+	if err := wslCommand(ctx, "--export", config.Distribution, path); err != nil {
+		return errors.Wrap(err, "failed to export WSL distribution")
+	}
+	return nil
+}
+
+// ImportWSL2Distribution installs the distribution from a tarball written by
+// ExportWSL2Distribution
+func ImportWSL2Distribution(ctx context.Context, config WSL2Config, path string) error {
+	if IsWSL2DistributionAvailable(config.Distribution) {
+		return fmt.Errorf("WSL distribution %s is already installed, reset or unregister it first", config.Distribution)
+	}
+	if err := os.MkdirAll(wslInstallDir(), 0755); err != nil {
+		return errors.Wrap(err, "failed to create WSL directory")
+	}
+	if err := wslCommand(ctx, "--import", config.Distribution, wslInstallDir(), path, "--version", "2"); err != nil {
+		return errors.Wrap(err, "failed to import WSL distribution")
+	}
+	if err := applyWSLDiskSettings(ctx, config); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	return configureWSL2Distribution(config)
+}
+
+// ResetWSL2Distribution rebuilds the distribution from the bundled or
+// downloaded rootfs, which also upgrades it to the rootfs of this release.
+// Images and containers are lost, the agent's state and config directories
+// are migrated to the new distribution. If the migration fails they are left
+// in the returned backup file.
+func ResetWSL2Distribution(ctx context.Context, config WSL2Config) (string, error) {
+	backup := ""
+	if IsWSL2DistributionAvailable(config.Distribution) {
+		var err error
+		if backup, err = backupWSLState(ctx, config); err != nil {
+			return "", err
+		}
+		if err := wslCommand(ctx, "--unregister", config.Distribution); err != nil {
+			return backup, errors.Wrap(err, "failed to unregister WSL distribution")
+		}
+	}
+
+	if err := InstallWSL2Components(ctx, config); err != nil {
+		return backup, err
+	}
+
+	if backup == "" {
+		return "", nil
+	}
+	if err := restoreWSLState(ctx, config, backup); err != nil {
+		return backup, err
+	}
+	os.Remove(backup)
+	return "", nil
+}
+
+// backupWSLState archives wslBackupPaths to a file on the Windows side
+func backupWSLState(ctx context.Context, config WSL2Config) (string, error) {
+	if err := os.MkdirAll(wslInstallDir(), 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create WSL directory")
+	}
+	backup := filepath.Join(wslInstallDir(), "state-backup.tar")
+	file, err := os.Create(backup)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create state backup")
+	}
+	defer file.Close()
+
+	cmd := exec.CommandContext(ctx, "wsl.exe", "--distribution", config.Distribution, "--user", "root",
+		"--", "sh", "-c", wslBackupCommand())
+	cmd.Stdout = file
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		file.Close()
+		os.Remove(backup)
+		return "", errors.Wrapf(err, "failed to back up the distribution state: %s", stderr.String())
+	}
+	if err := file.Sync(); err != nil {
+		return "", errors.Wrap(err, "failed to back up the distribution state")
+	}
+	return backup, nil
+}
+
+// restoreWSLState extracts a backup of backupWSLState over the new distribution
+func restoreWSLState(ctx context.Context, config WSL2Config, backup string) error {
+	file, err := os.Open(backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to open state backup")
+	}
+	defer file.Close()
+
+	cmd := exec.CommandContext(ctx, "wsl.exe", "--distribution", config.Distribution, "--user", "root",
+		"--", "sh", "-c", "tar -C / -xpf -")
+	cmd.Stdin = file
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore the distribution state from %s: %s", backup, string(output))
+	}
+	return nil
+}
+
+// wslBackupCommand returns the shell command writing the backup to stdout
+func wslBackupCommand() string {
+	var b strings.Builder
+	b.WriteString("cd / && mkdir -p")
+	for _, path := range wslBackupPaths {
+		b.WriteString(" /" + path)
+	}
+	b.WriteString(" && tar -C / -cf -")
+	for _, path := range wslBackupExcludes {
+		b.WriteString(" --exclude=" + path)
+	}
+	for _, path := range wslBackupPaths {
+		b.WriteString(" " + path)
+	}
+	return b.String()
+}
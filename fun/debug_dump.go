@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"fun/config"
+	"fun/container"
+	"fun/events"
+	"fun/health"
+)
+
+const (
+	// dumpTimeout bounds the containerd queries of a dump, a hung containerd
+	// is what a dump is often taken for
+	dumpTimeout = 10 * time.Second
+	// dumpErrors is how many of the latest logged errors a dump lists
+	dumpErrors = 20
+)
+
+// diagnostics writes the state of a running daemon to its log on SIGUSR1 or
+// fun debug dump, for debugging a hung daemon without attaching a debugger
+// It exists from the start of the daemon, the parts that are set up later are
+// attached once they are, and left out of the dumps taken before.
+type diagnostics struct {
+	cfg     *config.Config
+	started time.Time
+	// logger writes to the daemon's log without the error journal, which would
+	// otherwise record the errors the dump lists once more
+	logger *log.Logger
+
+	// mutex keeps concurrent dumps from interleaving and guards the fields below
+	mutex   sync.Mutex
+	client  *container.Client
+	checker *health.Checker
+	journal *events.Journal
+}
+
+// attach adds the parts of the daemon set up since the last call to the dumps
+func (d *diagnostics) attach(client *container.Client, checker *health.Checker, journal *events.Journal) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.client = client
+	d.checker = checker
+	d.journal = journal
+}
+
+// Dump logs the daemon's state and returns it
+func (d *diagnostics) Dump() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var buf bytes.Buffer
+	d.write(&buf)
+	d.logger.Printf("Diagnostic dump\n%s", buf.String())
+	return buf.String()
+}
+
+// write writes the sections of a dump, each one is written even if another
+// can't be gathered
+func (d *diagnostics) write(w io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), dumpTimeout)
+	defer cancel()
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	fmt.Fprintf(w, "Fun Server %s (%s, %s/%s), pid %d, up %s\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH, os.Getpid(), time.Since(d.started).Round(time.Second))
+	fmt.Fprintf(w, "Goroutines: %d, heap: %d MB, from the OS: %d MB, GC cycles: %d\n", runtime.NumGoroutine(), memory.HeapAlloc>>20, memory.Sys>>20, memory.NumGC)
+
+	fmt.Fprintln(w, "\n=== Backends ===")
+	fmt.Fprintf(w, "containerd socket: %s, namespace: %s\n", d.cfg.ContainerdSocket, d.cfg.ContainerdNamespace)
+	if d.client != nil {
+		fmt.Fprintf(w, "containerd version: %s\n", d.client.Capabilities().Version)
+	}
+	if d.checker != nil {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHECK\tSTATE\tDURATION\tDETAIL")
+		for _, result := range d.checker.Ready(ctx).Checks {
+			state := "ok"
+			if !result.OK {
+				state = "failing"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Name, state, result.Duration.Round(time.Millisecond), result.Error)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(w, "\n=== Containers ===")
+	if d.client == nil {
+		fmt.Fprintln(w, "containerd is not available")
+	} else if containers, err := d.client.ListContainers(ctx); err != nil {
+		fmt.Fprintf(w, "Can't list containers: %v\n", err)
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tRESTARTS\tPRIORITY\tIMAGE")
+		for _, c := range containers {
+			status := c.Status
+			if c.CrashLooping {
+				status += " (crash looping)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", c.ID, c.Name, status, c.RestartCount, c.Priority, c.ImageRef)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(w, "\n=== Recent errors ===")
+	if d.journal == nil {
+		fmt.Fprintln(w, "The event journal is disabled")
+	} else if recent, err := d.journal.Query(events.Filter{Types: []string{events.TypeError}, Limit: dumpErrors}); err != nil {
+		fmt.Fprintf(w, "Can't read the event journal: %v\n", err)
+	} else if len(recent) == 0 {
+		fmt.Fprintln(w, "None")
+	} else {
+		for _, event := range recent {
+			fmt.Fprintf(w, "%s  %s\n", event.Time.Format(time.RFC3339), event.Message)
+		}
+	}
+
+	fmt.Fprintln(w, "\n=== Goroutines ===")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
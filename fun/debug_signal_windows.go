@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyDumpSignal does nothing, Windows has no SIGUSR1 and dumps are only
+// taken with fun debug dump
+func notifyDumpSignal(c chan<- os.Signal) {}
@@ -0,0 +1,699 @@
+package dockerapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/container"
+	"fun/logging"
+	"fun/sockets"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// APIVersion is the Docker Engine API version advertised by the shim
+const APIVersion = "1.41"
+
+// versionPrefix matches the optional /vX.Y prefix of Docker API paths
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+\.[0-9]+`)
+
+// Server exposes a subset of the Docker Engine API backed by a container.Client
+type Server struct {
+	client  *container.Client
+	version string
+	// socketGID is the group given access to the socket, -1 keeps the daemon's group
+	socketGID int
+
+	execMutex sync.Mutex
+	execs     map[string]*execInstance
+}
+
+// execRetention is how long an exec is kept for inspection after it finished,
+// or after it was created if it is never started
+const execRetention = 5 * time.Minute
+
+// execInstance tracks an exec created through the API until it is pruned
+type execInstance struct {
+	ID          string
+	ContainerID string
+	Options     container.ExecOptions
+	Running     bool
+	ExitCode    int
+	// Created and Finished decide when the exec is pruned
+	Created  time.Time
+	Finished time.Time
+}
+
+// createContainerRequest is the body of POST /containers/create
+type createContainerRequest struct {
+	Hostname   string            `json:"Hostname"`
+	Image      string            `json:"Image"`
+	Cmd        []string          `json:"Cmd"`
+	Entrypoint []string          `json:"Entrypoint"`
+	Env        []string          `json:"Env"`
+	Labels     map[string]string `json:"Labels"`
+	HostConfig struct {
+		Binds         []string `json:"Binds"`
+		Privileged    bool     `json:"Privileged"`
+		ExtraHosts    []string `json:"ExtraHosts"`
+		DNS           []string `json:"Dns"`
+		DNSSearch     []string `json:"DnsSearch"`
+		DNSOptions    []string `json:"DnsOptions"`
+		RestartPolicy struct {
+			Name string `json:"Name"`
+		} `json:"RestartPolicy"`
+		LogConfig struct {
+			Type   string            `json:"Type"`
+			Config map[string]string `json:"Config"`
+		} `json:"LogConfig"`
+
+		NanoCPUs             int64                `json:"NanoCpus"`
+		Memory               int64                `json:"Memory"`
+		MemorySwap           int64                `json:"MemorySwap"`
+		BlkioWeight          uint16               `json:"BlkioWeight"`
+		BlkioDeviceReadBps   []throttleDeviceJSON `json:"BlkioDeviceReadBps"`
+		BlkioDeviceWriteBps  []throttleDeviceJSON `json:"BlkioDeviceWriteBps"`
+		BlkioDeviceReadIOps  []throttleDeviceJSON `json:"BlkioDeviceReadIOps"`
+		BlkioDeviceWriteIOps []throttleDeviceJSON `json:"BlkioDeviceWriteIOps"`
+	} `json:"HostConfig"`
+}
+
+// throttleDeviceJSON is a Docker blkio device throttle
+type throttleDeviceJSON struct {
+	Path string `json:"Path"`
+	Rate uint64 `json:"Rate"`
+}
+
+// toThrottleDevices converts Docker device throttles
+func toThrottleDevices(devices []throttleDeviceJSON) []container.ThrottleDevice {
+	var result []container.ThrottleDevice
+	for _, d := range devices {
+		result = append(result, container.ThrottleDevice{Path: d.Path, Rate: d.Rate})
+	}
+	return result
+}
+
+// toLogOptions keeps the json-file log options our log driver implements,
+// the others such as compress, labels or tag are ignored like unknown ones of
+// other drivers, clients set them without checking what the daemon runs
+func toLogOptions(config map[string]string) map[string]string {
+	options := make(map[string]string)
+	for key, value := range config {
+		switch key {
+		case "max-size", "max-file":
+			options[key] = value
+		default:
+			log.Printf("Docker API: ignoring unsupported log option %s", key)
+		}
+	}
+	return options
+}
+
+// execCreateRequest is the body of POST /containers/{id}/exec
+type execCreateRequest struct {
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env"`
+	WorkingDir   string   `json:"WorkingDir"`
+	Tty          bool     `json:"Tty"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+}
+
+// NewServer creates a Docker API shim for the given client
+func NewServer(client *container.Client, version string) *Server {
+	return &Server{
+		client:    client,
+		version:   version,
+		execs:     make(map[string]*execInstance),
+		socketGID: -1,
+	}
+}
+
+// SetSocketGroup gives members of gid access to the socket, like the docker group
+func (s *Server) SetSocketGroup(gid int) {
+	s.socketGID = gid
+}
+
+// Handler returns the HTTP handler implementing the Docker API subset
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /_ping", s.handlePing)
+	mux.HandleFunc("HEAD /_ping", s.handlePing)
+	mux.HandleFunc("GET /version", s.handleVersion)
+
+	mux.HandleFunc("GET /containers/json", s.handleListContainers)
+	mux.HandleFunc("POST /containers/create", s.handleCreateContainer)
+	mux.HandleFunc("GET /containers/{id}/json", s.handleInspectContainer)
+	mux.HandleFunc("POST /containers/{id}/start", s.handleStartContainer)
+	mux.HandleFunc("POST /containers/{id}/stop", s.handleStopContainer)
+	mux.HandleFunc("DELETE /containers/{id}", s.handleRemoveContainer)
+	mux.HandleFunc("GET /containers/{id}/logs", s.handleContainerLogs)
+	mux.HandleFunc("POST /containers/{id}/exec", s.handleExecCreate)
+
+	mux.HandleFunc("POST /exec/{id}/start", s.handleExecStart)
+	mux.HandleFunc("GET /exec/{id}/json", s.handleExecInspect)
+
+	mux.HandleFunc("GET /images/json", s.handleListImages)
+	mux.HandleFunc("POST /images/create", s.handlePullImage)
+	mux.HandleFunc("DELETE /images/{name...}", s.handleRemoveImage)
+
+	// Strip the API version prefix so all versions hit the same routes
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = versionPrefix.ReplaceAllString(r.URL.Path, "")
+		logging.Debugf("Docker API: %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Api-Version", APIVersion)
+		w.Header().Set("Server", "fun/"+s.version)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves the Docker API on a Unix socket until the context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, socketPath string) error {
+	// The API controls all containers, so only the owner and the socket group may use it
+	listener, err := sockets.Listen(socketPath, s.socketGID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Docker API shim listening on %s", socketPath)
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves the Docker API shim on listener until ctx is cancelled
+// The listener may come from systemd socket activation.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	httpServer := &http.Server{Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("docker API shim failed: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"Version":       s.version,
+		"ApiVersion":    APIVersion,
+		"MinAPIVersion": "1.24",
+		"Os":            runtime.GOOS,
+		"Arch":          runtime.GOARCH,
+	})
+}
+
+func (s *Server) handleListContainers(w http.ResponseWriter, r *http.Request) {
+	containers, err := s.client.ListContainers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	all := r.URL.Query().Get("all") == "1" || r.URL.Query().Get("all") == "true"
+
+	result := []map[string]interface{}{}
+	for _, c := range containers {
+		if !all && c.Status != "running" {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"Id":      c.ID,
+			"Names":   []string{"/" + c.Name},
+			"Image":   c.ImageRef,
+			"Command": strings.Join(c.Command, " "),
+			"Created": c.CreatedAt.Unix(),
+			"State":   c.Status,
+			"Status":  c.Status,
+			"Labels":  c.Labels,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleCreateContainer(w http.ResponseWriter, r *http.Request) {
+	var req createContainerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Unnamed containers get a generated name
+	opts := container.CreateContainerOptions{
+		Name:           strings.TrimPrefix(r.URL.Query().Get("name"), "/"),
+		Image:          req.Image,
+		Env:            req.Env,
+		Labels:         req.Labels,
+		RestartPolicy:  req.HostConfig.RestartPolicy.Name,
+		PrivilegedMode: req.HostConfig.Privileged,
+		Hostname:       req.Hostname,
+		ExtraHosts:     req.HostConfig.ExtraHosts,
+		DNS:            req.HostConfig.DNS,
+		DNSSearch:      req.HostConfig.DNSSearch,
+		DNSOptions:     req.HostConfig.DNSOptions,
+		Resources: container.ResourceLimits{
+			CPUs:            float64(req.HostConfig.NanoCPUs) / 1e9,
+			Memory:          req.HostConfig.Memory,
+			MemorySwap:      req.HostConfig.MemorySwap,
+			BlkioWeight:     req.HostConfig.BlkioWeight,
+			DeviceReadBps:   toThrottleDevices(req.HostConfig.BlkioDeviceReadBps),
+			DeviceWriteBps:  toThrottleDevices(req.HostConfig.BlkioDeviceWriteBps),
+			DeviceReadIOps:  toThrottleDevices(req.HostConfig.BlkioDeviceReadIOps),
+			DeviceWriteIOps: toThrottleDevices(req.HostConfig.BlkioDeviceWriteIOps),
+		},
+		// The log driver is always our own, the options of json-file map onto it
+		LogOptions: toLogOptions(req.HostConfig.LogConfig.Config),
+	}
+
+	if len(req.Entrypoint) > 0 {
+		opts.Command = req.Entrypoint
+		opts.Args = req.Cmd
+	} else {
+		opts.Command = req.Cmd
+	}
+
+	for _, bind := range req.HostConfig.Binds {
+		mount, err := parseBind(bind)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts.Mounts = append(opts.Mounts, mount)
+	}
+
+	c, err := s.client.CreateContainer(r.Context(), opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"Id":       c.ID,
+		"Warnings": []string{},
+	})
+}
+
+// resolveContainer returns the ID of the container a request path names, by
+// ID, name or unique ID prefix like Docker does, writing a 404 if there is none
+func (s *Server) resolveContainer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, err := s.client.ResolveContainer(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return "", false
+	}
+	return id, true
+}
+
+func (s *Server) handleInspectContainer(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+	c, err := s.client.InspectContainer(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Id":      c.ID,
+		"Name":    "/" + c.Name,
+		"Created": c.CreatedAt.Format(time.RFC3339Nano),
+		"Image":   c.ImageRef,
+		"State":   containerState(c),
+		"Config": map[string]interface{}{
+			"Image":  c.ImageRef,
+			"Cmd":    c.Command,
+			"Env":    c.Env,
+			"Labels": c.Labels,
+		},
+	})
+}
+
+// containerState builds the Docker State object, including how the last run ended
+func containerState(c *container.Container) map[string]interface{} {
+	state := map[string]interface{}{
+		"Status":     c.Status,
+		"Running":    c.Status == "running",
+		"Paused":     c.Status == "paused",
+		"Restarting": false,
+		"OOMKilled":  false,
+		"ExitCode":   0,
+		"Error":      "",
+	}
+	if t := c.Termination; t != nil {
+		state["OOMKilled"] = t.OOMKilled
+		state["ExitCode"] = t.ExitCode
+		state["FinishedAt"] = t.FinishedAt.Format(time.RFC3339Nano)
+	}
+	return state
+}
+
+func (s *Server) handleStartContainer(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+	if err := s.client.StartContainer(r.Context(), id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleStopContainer(w http.ResponseWriter, r *http.Request) {
+	timeout := 10 * time.Second
+	if t, err := strconv.Atoi(r.URL.Query().Get("t")); err == nil {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	id, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+	if err := s.client.StopContainer(r.Context(), id, timeout); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRemoveContainer(w http.ResponseWriter, r *http.Request) {
+	force := r.URL.Query().Get("force") == "1" || r.URL.Query().Get("force") == "true"
+
+	id, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+	if err := s.client.RemoveContainer(r.Context(), id, force); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleContainerLogs(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+	w.WriteHeader(http.StatusOK)
+
+	out := &multiplexWriter{w: w, stream: 1, mutex: &sync.Mutex{}}
+	if err := s.client.GetContainerLogs(r.Context(), id, false, out); err != nil {
+		log.Printf("Docker API shim: failed to read logs: %v", err)
+	}
+}
+
+func (s *Server) handleExecCreate(w http.ResponseWriter, r *http.Request) {
+	var req execCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	containerID, ok := s.resolveContainer(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := newExecID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.execMutex.Lock()
+	s.pruneExecs()
+	s.execs[id] = &execInstance{
+		ID:          id,
+		ContainerID: containerID,
+		Created:     time.Now(),
+		Options: container.ExecOptions{
+			Command:    req.Cmd,
+			Env:        req.Env,
+			WorkingDir: req.WorkingDir,
+			TTY:        req.Tty,
+		},
+	}
+	s.execMutex.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]string{"Id": id})
+}
+
+func (s *Server) handleExecStart(w http.ResponseWriter, r *http.Request) {
+	s.execMutex.Lock()
+	exec, ok := s.execs[r.PathValue("id")]
+	s.execMutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such exec instance"))
+		return
+	}
+
+	// Docker clients hijack the connection and read a raw multiplexed stream
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("connection does not support hijacking"))
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer conn.Close()
+
+	s.execMutex.Lock()
+	exec.Running = true
+	s.execMutex.Unlock()
+
+	// The server stops watching hijacked connections, so cancel the process once
+	// the client goes away. Stdin isn't attached, the client only closes its side
+	// of the connection when it disconnects.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	contentType := "application/vnd.docker.multiplexed-stream"
+	if exec.Options.TTY {
+		contentType = "application/vnd.docker.raw-stream"
+	}
+
+	if r.Header.Get("Upgrade") != "" {
+		fmt.Fprintf(buf, "HTTP/1.1 101 UPGRADED\r\nContent-Type: %s\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n", contentType)
+	} else {
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\n\r\n", contentType)
+	}
+	buf.Flush()
+
+	opts := exec.Options
+	if opts.TTY {
+		opts.Stdout = conn
+	} else {
+		mutex := &sync.Mutex{}
+		opts.Stdout = &multiplexWriter{w: conn, stream: 1, mutex: mutex}
+		opts.Stderr = &multiplexWriter{w: conn, stream: 2, mutex: mutex}
+	}
+
+	exitCode, err := s.client.Exec(ctx, exec.ContainerID, opts)
+	if err != nil {
+		log.Printf("Docker API shim: exec failed: %v", err)
+	}
+
+	s.execMutex.Lock()
+	exec.Running = false
+	exec.ExitCode = exitCode
+	exec.Finished = time.Now()
+	s.execMutex.Unlock()
+}
+
+// newExecID returns a random 64 character hex ID, like the exec IDs of Docker
+func newExecID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pruneExecs forgets the execs that finished, or were never started, longer
+// than execRetention ago. The caller holds execMutex.
+func (s *Server) pruneExecs() {
+	cutoff := time.Now().Add(-execRetention)
+	for id, exec := range s.execs {
+		if exec.Running {
+			continue
+		}
+		last := exec.Finished
+		if last.IsZero() {
+			last = exec.Created
+		}
+		if last.Before(cutoff) {
+			delete(s.execs, id)
+		}
+	}
+}
+
+func (s *Server) handleExecInspect(w http.ResponseWriter, r *http.Request) {
+	s.execMutex.Lock()
+	defer s.execMutex.Unlock()
+
+	exec, ok := s.execs[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such exec instance"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ID":          exec.ID,
+		"ContainerID": exec.ContainerID,
+		"Running":     exec.Running,
+		"ExitCode":    exec.ExitCode,
+	})
+}
+
+func (s *Server) handleListImages(w http.ResponseWriter, r *http.Request) {
+	result := []map[string]interface{}{}
+	err := s.client.WalkImages(r.Context(), container.ImageListOptions{}, func(img container.ImageSummary) error {
+		result = append(result, map[string]interface{}{
+			"Id":       img.Digest,
+			"RepoTags": []string{img.Name},
+			"Created":  img.CreatedAt.Unix(),
+			"Size":     img.Size,
+			"Labels":   img.Labels,
+		})
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handlePullImage(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(map[string]string{"status": "Pulling from " + ref})
+
+	if _, err := s.client.PullImage(r.Context(), ref); err != nil {
+		encoder.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	encoder.Encode(map[string]string{"status": "Downloaded newer image for " + ref})
+}
+
+func (s *Server) handleRemoveImage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.client.RemoveImage(r.Context(), name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, []map[string]string{{"Untagged": name}})
+}
+
+// parseBind converts a Docker "src:dst[:mode]" bind specification to a mount, the
+// mode accepting ro, rw and the SELinux relabel options z and Z
+func parseBind(bind string) (specs.Mount, error) {
+	parts := strings.Split(bind, ":")
+	if len(parts) < 2 {
+		return specs.Mount{}, fmt.Errorf("invalid bind specification: %s", bind)
+	}
+
+	mode := ""
+	if len(parts) > 2 {
+		mode = parts[2]
+	}
+	options, err := container.ParseBindMode(mode)
+	if err != nil {
+		return specs.Mount{}, err
+	}
+
+	return specs.Mount{
+		Type:        "bind",
+		Source:      parts[0],
+		Destination: parts[1],
+		Options:     options,
+	}, nil
+}
+
+// multiplexWriter frames output using Docker's stdout/stderr stream multiplexing
+// Writers sharing an underlying stream must share the same mutex
+type multiplexWriter struct {
+	w      io.Writer
+	stream byte
+	mutex  *sync.Mutex
+}
+
+func (m *multiplexWriter) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	header := make([]byte, 8)
+	header[0] = m.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+
+	if _, err := m.w.Write(header); err != nil {
+		return 0, err
+	}
+	n, err := m.w.Write(p)
+	if f, ok := m.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the Docker API format
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"message": err.Error()})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"fun/config"
+	"fun/container"
+	"fun/sockets"
+)
+
+// doctorCheck is the outcome of a single doctor check
+type doctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// handleDoctorCommand checks the host setup and explains problems found
+func handleDoctorCommand(cfg *config.Config) {
+	checks := socketChecks(cfg)
+	checks = append(checks, hostDependencyChecks()...)
+	checks = append(checks, selinuxChecks(cfg)...)
+	checks = append(checks, containerdCheck(cfg))
+	checks = append(checks, clockCheck(cfg))
+	checks = append(checks, bundleChecks()...)
+	checks = append(checks, archChecks()...)
+
+	failed := 0
+	if structuredOutput() {
+		printOutput(checks)
+		for _, check := range checks {
+			if !check.OK {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+	for _, check := range checks {
+		status := "ok"
+		if !check.OK {
+			status = "warn"
+			failed++
+		}
+		fmt.Printf("[%s]\t%s: %s\n", status, check.Name, check.Detail)
+	}
+
+	fmt.Println("\nSecurity note: members of the socket group can use the containerd and Docker API")
+	fmt.Println("sockets, which lets them start privileged containers and mount any host path.")
+	fmt.Println("Like the docker group, membership is equivalent to root access on this host,")
+	fmt.Println("so only add trusted users. Leave socket_group empty to keep the sockets root-only.")
+
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) need attention\n", failed)
+		os.Exit(1)
+	}
+}
+
+// socketChecks checks the permissions and reachability of the daemon and containerd sockets
+func socketChecks(cfg *config.Config) []doctorCheck {
+	// A system containerd's socket keeps the group its own configuration gives it
+	paths := []struct {
+		name    string
+		path    string
+		managed bool
+	}{
+		{"admin socket", cfg.AdminSocket, true},
+		{"containerd socket", cfg.ContainerdSocket, cfg.EmbeddedContainerd},
+		{"Docker API socket", cfg.DockerAPISocket, true},
+	}
+
+	wantGID, groupErr := sockets.LookupGroup(cfg.SocketGroup)
+	var checks []doctorCheck
+	if groupErr != nil {
+		checks = append(checks, doctorCheck{Name: "socket group", Detail: groupErr.Error()})
+	}
+
+	for _, socket := range paths {
+		if socket.path == "" || strings.HasPrefix(socket.path, `\\.\pipe\`) {
+			continue
+		}
+		check := doctorCheck{Name: socket.name + " " + socket.path}
+
+		info, err := os.Stat(socket.path)
+		if err != nil {
+			check.Detail = "not found, is the service running?"
+			checks = append(checks, check)
+			continue
+		}
+
+		mode := info.Mode().Perm()
+		var problems []string
+		if mode&0007 != 0 {
+			problems = append(problems, fmt.Sprintf("mode %04o gives access to all users", mode))
+		}
+		gid, hasGID := fileGroup(info)
+		if hasGID && socket.managed && wantGID >= 0 && gid != wantGID {
+			problems = append(problems, fmt.Sprintf("owned by group %s instead of %s", groupName(gid), cfg.SocketGroup))
+		}
+		if conn, err := net.DialTimeout("unix", socket.path, time.Second); err != nil {
+			problems = append(problems, "not accessible to the current user")
+		} else {
+			conn.Close()
+		}
+
+		check.OK = len(problems) == 0
+		if check.OK {
+			check.Detail = fmt.Sprintf("mode %04o", mode)
+			if hasGID {
+				check.Detail += ", group " + groupName(gid)
+			}
+		} else {
+			check.Detail = strings.Join(problems, ", ")
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// hostDependencyChecks reports missing kernel modules, tools and cgroup controllers
+func hostDependencyChecks() []doctorCheck {
+	var checks []doctorCheck
+	for _, dep := range container.CheckHostDependencies() {
+		checks = append(checks, doctorCheck{Name: dep.Name, OK: dep.OK, Detail: dep.Detail})
+	}
+	return checks
+}
+
+// selinuxChecks reports the SELinux mode, sockets labeled in a way that gets
+// access to them denied, and recent denials of containers and the daemon
+func selinuxChecks(cfg *config.Config) []doctorCheck {
+	mode := container.SELinuxMode()
+	if mode == "disabled" {
+		return nil
+	}
+
+	checks := []doctorCheck{{
+		Name:   "SELinux",
+		OK:     true,
+		Detail: mode + ", bind mounts need the z or Z option to be relabeled for containers",
+	}}
+
+	for _, path := range []string{cfg.AdminSocket, cfg.DockerAPISocket} {
+		if path == "" {
+			continue
+		}
+		label, err := container.SELinuxFileLabel(path)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(label, "home_t") {
+			checks = append(checks, doctorCheck{
+				Name:   "SELinux label of " + path,
+				Detail: label + " is a home directory label, move the socket to /run/fun",
+			})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	denials, err := container.SELinuxDenials(ctx)
+	check := doctorCheck{Name: "SELinux denials"}
+	switch {
+	case err != nil:
+		check.OK = true
+		check.Detail = fmt.Sprintf("%v, run doctor as root to check the audit log", err)
+	case len(denials) == 0:
+		check.OK = true
+		check.Detail = "none for containers"
+	default:
+		check.Detail = fmt.Sprintf("%d for containers, the last one: %s", len(denials), denials[len(denials)-1])
+	}
+	return append(checks, check)
+}
+
+// containerdCheck checks that containerd is reachable and its version is supported
+func containerdCheck(cfg *config.Config) doctorCheck {
+	check := doctorCheck{Name: "containerd"}
+	client, err := container.NewClient(cfg.ContainerdSocket, cfg.ContainerdNamespace)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	defer client.Close()
+
+	caps := client.Capabilities()
+	var missing []string
+	if !caps.Transfer {
+		missing = append(missing, "transfer service")
+	}
+	if !caps.Sandbox {
+		missing = append(missing, "sandbox API")
+	}
+	check.OK = true
+	check.Detail = "version " + caps.Version
+	if len(missing) > 0 {
+		check.Detail += ", without " + strings.Join(missing, " and ")
+	}
+	return check
+}
+
+// clockCheck compares containerd's clock with the host's, which drift apart when
+// containerd runs in a VM or WSL and the host sleeps
+func clockCheck(cfg *config.Config) doctorCheck {
+	check := doctorCheck{Name: "containerd clock"}
+	client, err := container.NewClient(cfg.ContainerdSocket, cfg.ContainerdNamespace)
+	if err != nil {
+		check.Detail = "containerd is not reachable"
+		return check
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	offset, err := client.ClockOffset(ctx)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	offset = offset.Round(time.Millisecond)
+	check.OK = offset.Abs() < container.MaxClockDrift
+	if check.OK {
+		check.Detail = fmt.Sprintf("%s off the host clock", offset)
+	} else {
+		check.Detail = fmt.Sprintf("%s off the host clock, which breaks TLS and log ordering; "+
+			"the daemon corrects WSL, the macOS VM syncs with NTP", offset)
+	}
+	return check
+}
+
+// bundleChecks reports bundled components that will be upgraded on the next start
+// and bundled binaries modified since they were extracted
+func bundleChecks() []doctorCheck {
+	var checks []doctorCheck
+	for _, upgrade := range container.PendingBundleUpgrades() {
+		from := upgrade.From
+		if from == "" {
+			from = "not extracted"
+		}
+		checks = append(checks, doctorCheck{
+			Name:   "bundled " + upgrade.Component,
+			OK:     true,
+			Detail: fmt.Sprintf("%s, version %s is extracted when containerd restarts or with 'fun system upgrade-containerd'", from, upgrade.To),
+		})
+	}
+	for _, path := range []string{container.GetBundledContainerdPath(), container.GetBundledRuncPath()} {
+		if err := container.VerifyBundledBinary(path); err != nil {
+			checks = append(checks, doctorCheck{
+				Name:   "bundled " + filepath.Base(path),
+				Detail: fmt.Sprintf("%v, it is re-extracted when containerd starts", err),
+			})
+		}
+	}
+	return checks
+}
+
+// archChecks reports a build running emulated on another architecture, such as
+// the amd64 package installed on Windows on ARM
+func archChecks() []doctorCheck {
+	host := container.HostArch()
+	if host == runtime.GOARCH {
+		return nil
+	}
+	return []doctorCheck{{
+		Name:   "architecture",
+		Detail: fmt.Sprintf("this %s build runs emulated on an %s host, install the %s package", runtime.GOARCH, host, host),
+	}}
+}
+
+// groupName returns the name of a group, or its number if it has none
+func groupName(gid int) string {
+	if group, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		return group.Name
+	}
+	return strconv.Itoa(gid)
+}
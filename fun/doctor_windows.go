@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// fileGroup reports false, files have no owning group on Windows
+func fileGroup(info os.FileInfo) (int, bool) {
+	return 0, false
+}
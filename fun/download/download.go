@@ -0,0 +1,312 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"fun/logging"
+	"fun/tlsconfig"
+)
+
+const (
+	// defaultRetries is how many times a failed download is retried
+	defaultRetries = 4
+	// defaultWorkers bounds the downloads All runs at the same time
+	defaultWorkers = 4
+	// progressInterval throttles the progress callbacks of a download
+	progressInterval = 500 * time.Millisecond
+	// maxBackoff caps the wait between attempts
+	maxBackoff = 30 * time.Second
+)
+
+// Progress is called as a download advances, with total -1 while the server
+// didn't send the size. It is called from the downloading goroutine.
+type Progress func(url string, done, total int64)
+
+// File is a download to a local path
+type File struct {
+	URL  string
+	Path string
+	// Mode is the permission of the downloaded file, 0 uses 0644
+	Mode os.FileMode
+}
+
+// Stats describes a completed download
+type Stats struct {
+	URL      string        `json:"url"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+	Attempts int           `json:"attempts"`
+	// Error is why a failed download gave up
+	Error string `json:"error,omitempty"`
+}
+
+// Downloader fetches files over a shared HTTP client, so connections to the
+// same host are reused across downloads. Proxies are taken from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+type Downloader struct {
+	client    *http.Client
+	transport *http.Transport
+	// Retries is how many times a download failing with a network error or a
+	// server error is retried, continuing where it stopped when the server allows it
+	Retries int
+	// Workers bounds the downloads All runs at the same time
+	Workers int
+	// Progress, if set, is called as downloads advance
+	Progress Progress
+}
+
+var (
+	shared     *Downloader
+	sharedOnce sync.Once
+
+	reportMutex sync.Mutex
+	report      func(stats Stats)
+)
+
+// SetReport sets a function called with the stats of every download of the
+// process once it completed or failed, such as to send them to the orchestrator
+// It runs on the downloading goroutine, so slow work belongs in a goroutine.
+func SetReport(fn func(stats Stats)) {
+	reportMutex.Lock()
+	report = fn
+	reportMutex.Unlock()
+}
+
+// Shared returns the downloader used across the process
+func Shared() *Downloader {
+	sharedOnce.Do(func() { shared = New() })
+	return shared
+}
+
+// New creates a downloader with its own connection pool
+func New() *Downloader {
+	transport := tlsconfig.NewTransport(nil)
+	transport.MaxIdleConnsPerHost = defaultWorkers
+	// Kernels and rootfs tarballs take minutes on slow links, the context bounds them instead
+	return &Downloader{
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		Retries:   defaultRetries,
+		Workers:   defaultWorkers,
+	}
+}
+
+// SetTLSConfig restricts the TLS versions and cipher suites of the downloads,
+// it must be called before the downloader is used
+func (d *Downloader) SetTLSConfig(config *tls.Config) {
+	d.transport.TLSClientConfig = config.Clone()
+}
+
+// WithProgress returns a copy of the downloader sharing its connections and
+// reporting to progress
+func (d *Downloader) WithProgress(progress Progress) *Downloader {
+	clone := *d
+	clone.Progress = progress
+	return &clone
+}
+
+// Fetch downloads file, replacing its path only once the download completed
+func (d *Downloader) Fetch(ctx context.Context, file File) (Stats, error) {
+	stats, err := d.fetch(ctx, file)
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	reportMutex.Lock()
+	fn := report
+	reportMutex.Unlock()
+	if fn != nil {
+		fn(stats)
+	}
+	return stats, err
+}
+
+// fetch downloads file for Fetch
+func (d *Downloader) fetch(ctx context.Context, file File) (Stats, error) {
+	stats := Stats{URL: file.URL}
+	start := time.Now()
+
+	mode := file.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return stats, fmt.Errorf("failed to create directory for %s: %w", file.Path, err)
+	}
+	partial := file.Path + ".part"
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+	defer os.Remove(partial)
+
+	for {
+		stats.Attempts++
+		var retry bool
+		retry, err = d.attempt(ctx, file.URL, out)
+		if err == nil || !retry || stats.Attempts > d.Retries {
+			break
+		}
+		wait := min(time.Duration(1<<(stats.Attempts-1))*time.Second, maxBackoff)
+		logging.Debugf("Download of %s failed, retrying in %s: %v", file.URL, wait, err)
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(wait):
+			continue
+		}
+		break
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to download %s: %w", file.URL, err)
+	}
+	if err := os.Rename(partial, file.Path); err != nil {
+		return stats, fmt.Errorf("failed to store %s: %w", file.Path, err)
+	}
+
+	info, err := os.Stat(file.Path)
+	if err == nil {
+		stats.Bytes = info.Size()
+	}
+	stats.Duration = time.Since(start)
+	logging.Debugf("Downloaded %s: %d bytes in %s, %d attempts", file.URL, stats.Bytes, stats.Duration.Round(time.Millisecond), stats.Attempts)
+	return stats, nil
+}
+
+// attempt downloads url into out, continuing after the bytes out already holds
+// when the server supports ranges. It returns whether a failure is worth retrying.
+func (d *Downloader) attempt(ctx context.Context, url string, out *os.File) (bool, error) {
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusOK:
+		// The server sent everything again
+		if offset > 0 {
+			if err := out.Truncate(0); err != nil {
+				return false, err
+			}
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return false, err
+			}
+			offset = 0
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial content is no longer valid, start over on the next attempt
+		out.Truncate(0)
+		return true, fmt.Errorf("server rejected resuming at byte %d", offset)
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	var body io.Reader = resp.Body
+	if d.Progress != nil {
+		body = &progressReader{reader: resp.Body, url: url, done: offset, total: total, progress: d.Progress}
+	}
+	n, err := io.Copy(out, body)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	if total >= 0 && offset+n != total {
+		return true, fmt.Errorf("download ended after %d of %d bytes", offset+n, total)
+	}
+	if d.Progress != nil {
+		d.Progress(url, offset+n, offset+n)
+	}
+	return false, nil
+}
+
+// All downloads files using up to Workers connections at a time. It stops at
+// the first failure, cancelling the other downloads, and returns the stats of
+// the completed downloads in the order of files.
+func (d *Downloader) All(ctx context.Context, files []File) ([]Stats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stats := make([]Stats, len(files))
+	var mutex sync.Mutex
+	var first error
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(d.Workers, 1), len(files)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				result, err := d.Fetch(ctx, files[i])
+				mutex.Lock()
+				stats[i] = result
+				// The downloads cancelled by a failure fail later, keep the cause
+				if err != nil && first == nil {
+					first = err
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return stats, first
+}
+
+// progressReader reports the bytes read through it, at most every progressInterval
+type progressReader struct {
+	reader   io.Reader
+	url      string
+	done     int64
+	total    int64
+	progress Progress
+	last     time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.done += int64(n)
+	if now := time.Now(); now.Sub(r.last) >= progressInterval {
+		r.last = now
+		r.progress(r.url, r.done, r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,164 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"fun/container"
+	"fun/logging"
+)
+
+// stopTimeout is how long a singleton gets to stop when the host steps down
+const stopTimeout = 10 * time.Second
+
+// Grant is the outcome of a lease acquisition
+type Grant struct {
+	// Holder is the hostname holding the lease, Held whether that is this host
+	Holder string
+	Held   bool
+}
+
+// Leases grants the leases singletons need to run, such as through the orchestrator
+type Leases interface {
+	// Acquire acquires or renews a lease for ttl, or reports its current holder
+	Acquire(ctx context.Context, name string, ttl time.Duration) (Grant, error)
+	// Release gives up a lease so another host can take over right away
+	Release(ctx context.Context, name string) error
+}
+
+// Elector runs the singleton containers of the host while it holds their
+// leases and holds them back while another host does
+type Elector struct {
+	client *container.Client
+	leases Leases
+	ttl    time.Duration
+
+	// held are the leases this host holds, with the time it must have stepped
+	// down by if it can't renew them
+	held map[string]time.Time
+}
+
+// NewElector creates an elector acquiring leases for ttl, which must leave
+// time for a singleton to stop before the lease expires
+func NewElector(client *container.Client, leases Leases, ttl time.Duration) (*Elector, error) {
+	if ttl < 3*stopTimeout {
+		return nil, fmt.Errorf("singleton lease TTL must be at least %s", 3*stopTimeout)
+	}
+	return &Elector{client: client, leases: leases, ttl: ttl, held: make(map[string]time.Time)}, nil
+}
+
+// Run renews the leases three times per TTL until the context is cancelled,
+// then stops the singletons it leads and releases their leases so another
+// host can take over without waiting for them to expire
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			e.stepDown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile acquires the lease of every singleton and starts or holds back the
+// singleton accordingly
+func (e *Elector) reconcile(ctx context.Context) {
+	singletons, err := e.client.ListSingletons(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to list singleton containers: %v", err)
+		return
+	}
+
+	present := make(map[string]bool, len(singletons))
+	for _, singleton := range singletons {
+		present[singleton.Lease] = true
+		held, holder := e.acquire(ctx, singleton.Lease)
+
+		switch {
+		case held && singleton.Standby != "":
+			log.Printf("Acquired the lease of singleton %s, starting it", singleton.ID)
+			if err := e.client.StartContainer(ctx, singleton.ID); err != nil {
+				log.Printf("Error starting singleton %s: %v", singleton.ID, err)
+			}
+		case !held && singleton.Running:
+			log.Printf("Lease of singleton %s is held by %s, stopping it", singleton.ID, holder)
+			if err := e.client.StandbyContainer(ctx, singleton.ID, "lease held by "+holder, stopTimeout); err != nil {
+				log.Printf("Error stopping singleton %s: %v", singleton.ID, err)
+			}
+		}
+	}
+
+	// Leases of removed singletons are given up right away
+	for name := range e.held {
+		if !present[name] {
+			delete(e.held, name)
+			if err := e.leases.Release(ctx, name); err != nil {
+				log.Printf("Warning: Failed to release lease %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// acquire renews a lease and returns whether the host holds it and who does.
+// While the leases can't be reached the host keeps a lease until it would
+// expire, less the time to stop the singleton, so it never runs on two hosts.
+func (e *Elector) acquire(ctx context.Context, name string) (bool, string) {
+	requested := time.Now()
+	grant, err := e.leases.Acquire(ctx, name, e.ttl)
+	if err != nil {
+		logging.Debugf("Failed to renew lease %s: %v", name, err)
+		deadline, ok := e.held[name]
+		if ok && time.Now().Before(deadline) {
+			return true, ""
+		}
+		if ok {
+			log.Printf("Warning: Lease %s couldn't be renewed before it expires, stepping down", name)
+			delete(e.held, name)
+		}
+		return false, "an unreachable host"
+	}
+
+	if !grant.Held {
+		delete(e.held, name)
+		return false, grant.Holder
+	}
+	// The lease runs from when it was requested at the latest. Failed renewals
+	// are noticed a renewal interval late and the singleton needs time to stop.
+	e.held[name] = requested.Add(e.ttl - e.ttl/3 - stopTimeout)
+	return true, grant.Holder
+}
+
+// stepDown stops the singletons this host leads and releases their leases
+func (e *Elector) stepDown() {
+	if len(e.held) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*stopTimeout)
+	defer cancel()
+
+	singletons, err := e.client.ListSingletons(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to list singleton containers: %v", err)
+		return
+	}
+	for _, singleton := range singletons {
+		if _, ok := e.held[singleton.Lease]; !ok {
+			continue
+		}
+		if err := e.client.StandbyContainer(ctx, singleton.ID, "the daemon stopped", stopTimeout); err != nil {
+			// Still leading, the lease has to expire before another host takes over
+			log.Printf("Error stopping singleton %s: %v", singleton.ID, err)
+			continue
+		}
+		if err := e.leases.Release(ctx, singleton.Lease); err != nil {
+			log.Printf("Warning: Failed to release lease %s: %v", singleton.Lease, err)
+		}
+	}
+}
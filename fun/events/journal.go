@@ -0,0 +1,319 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// TypeDaemon is recorded when the daemon starts or stops
+	TypeDaemon = "daemon"
+	// TypeDeploy is recorded when a desired-state revision is applied or rolled back
+	TypeDeploy = "deploy"
+	// TypeCommand is recorded when an orchestrator command was executed or refused
+	TypeCommand = "command"
+	// TypeContainer is recorded when a container exits, crash-loops or is preempted
+	TypeContainer = "container"
+	// TypeHost is recorded when the host runs low on memory or disk space
+	TypeHost = "host"
+	// TypeAudit is recorded with every audit log entry
+	TypeAudit = "audit"
+	// TypeError is recorded with every error the daemon logs
+	TypeError = "error"
+)
+
+// segmentSuffix is the extension of the journal's segment files
+const segmentSuffix = ".jsonl"
+
+// Event is a single journal entry
+type Event struct {
+	// Seq orders the events, it keeps counting across restarts
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Subject string    `json:"subject,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Limits bound the events a journal keeps
+type Limits struct {
+	// MaxBytes is the size of the journal, the oldest events are dropped beyond it
+	MaxBytes int64
+	// MaxAge is how long events are kept, 0 keeps them until MaxBytes is reached
+	MaxAge time.Duration
+	// SegmentBytes is the size at which a new segment file is started
+	SegmentBytes int64
+}
+
+// Filter selects the events returned by Query
+type Filter struct {
+	// Since and Until bound the event times, zero values leave them open
+	Since time.Time
+	Until time.Time
+	// Types are the event types to return, empty returns all
+	Types []string
+	// Subject only returns the events about a container, command or image
+	Subject string
+	// Limit only returns the newest events, 0 returns all
+	Limit int
+}
+
+// Matches reports whether the filter selects event
+func (f Filter) Matches(event Event) bool {
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	if f.Subject != "" && event.Subject != f.Subject {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// segment is a journal file holding the events from first on
+type segment struct {
+	first uint64
+	size  int64
+	// last is when the newest event of the segment was recorded
+	last time.Time
+}
+
+// Journal keeps the daemon's events in append-only files on disk, so what
+// happened on the host can be looked into after the fact.
+// A nil Journal discards events, so callers don't need to check whether it is enabled.
+type Journal struct {
+	dir    string
+	limits Limits
+
+	mutex    sync.Mutex
+	segments []segment
+	next     uint64
+}
+
+// Open opens the journal in dir, creating it if needed
+func Open(dir string, limits Limits) (*Journal, error) {
+	if limits.MaxBytes <= 0 {
+		return nil, fmt.Errorf("event journal size must be positive")
+	}
+	if limits.SegmentBytes <= 0 || limits.SegmentBytes > limits.MaxBytes/4 {
+		limits.SegmentBytes = min(limits.MaxBytes/4, 1<<20)
+	}
+	// Events reveal what is deployed, keep them private to the daemon
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create event journal: %w", err)
+	}
+	j := &Journal{dir: dir, limits: limits, next: 1}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		j.segments = append(j.segments, segment{first: first, size: info.Size(), last: info.ModTime()})
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a].first < j.segments[b].first })
+
+	if len(j.segments) > 0 {
+		last := &j.segments[len(j.segments)-1]
+		if err := j.repairSegment(last); err != nil {
+			return nil, err
+		}
+		events, err := j.readSegment(last.first)
+		if err != nil {
+			return nil, err
+		}
+		j.next = last.first
+		if len(events) > 0 {
+			j.next = events[len(events)-1].Seq + 1
+		}
+	}
+	return j, nil
+}
+
+// Record appends an event, setting its time if unset. It never logs, so it
+// can be fed from the daemon's log output.
+func (j *Journal) Record(event Event) error {
+	if j == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	event.Seq = j.next
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	line = append(line, '\n')
+
+	if len(j.segments) == 0 || j.segments[len(j.segments)-1].size+int64(len(line)) > j.limits.SegmentBytes {
+		j.segments = append(j.segments, segment{first: j.next})
+	}
+	current := &j.segments[len(j.segments)-1]
+	file, err := os.OpenFile(j.segmentPath(current.first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open event journal: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write event journal: %w", err)
+	}
+	current.size += int64(len(line))
+	current.last = event.Time
+	j.next++
+
+	for j.size() > j.limits.MaxBytes && len(j.segments) > 1 {
+		j.dropOldest()
+	}
+	return nil
+}
+
+// Prune drops the segments whose events are all older than the maximum age
+// and returns how many it dropped. The newest segment is kept so the
+// sequence numbers keep counting.
+func (j *Journal) Prune() int {
+	if j == nil || j.limits.MaxAge <= 0 {
+		return 0
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	cutoff := time.Now().Add(-j.limits.MaxAge)
+	dropped := 0
+	for len(j.segments) > 1 && j.segments[0].last.Before(cutoff) {
+		j.dropOldest()
+		dropped++
+	}
+	return dropped
+}
+
+// Query returns the events selected by filter, oldest first
+func (j *Journal) Query(filter Filter) ([]Event, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.mutex.Lock()
+	segments := append([]segment(nil), j.segments...)
+	j.mutex.Unlock()
+
+	var events []Event
+	for i, seg := range segments {
+		if !filter.Since.IsZero() && seg.last.Before(filter.Since) {
+			continue
+		}
+		// Segments following one that ends after Until only hold later events
+		if !filter.Until.IsZero() && i > 0 && segments[i-1].last.After(filter.Until) {
+			break
+		}
+		segmentEvents, err := j.readSegment(seg.first)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range segmentEvents {
+			if filter.Matches(event) {
+				events = append(events, event)
+			}
+		}
+		// Only the newest events are needed, drop the older ones as we go
+		if filter.Limit > 0 && len(events) > filter.Limit {
+			events = append(events[:0], events[len(events)-filter.Limit:]...)
+		}
+	}
+	return events, nil
+}
+
+// dropOldest removes the oldest segment; the caller must hold the mutex.
+// A file that can't be removed is forgotten anyway so the journal stays in its
+// limits, Record can't log without feeding itself.
+func (j *Journal) dropOldest() {
+	os.Remove(j.segmentPath(j.segments[0].first))
+	j.segments = j.segments[1:]
+}
+
+// size returns the bytes in the journal; the caller must hold the mutex
+func (j *Journal) size() int64 {
+	var total int64
+	for _, seg := range j.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// readSegment reads the events of a segment. A line torn by a crash or being
+// written ends the segment, the events before it are kept.
+func (j *Journal) readSegment(first uint64) ([]Event, error) {
+	data, err := os.ReadFile(j.segmentPath(first))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event journal: %w", err)
+	}
+
+	var events []Event
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// repairSegment cuts a line torn by a crash off the end of the segment, so
+// appended events don't follow it
+func (j *Journal) repairSegment(seg *segment) error {
+	data, err := os.ReadFile(j.segmentPath(seg.first))
+	if err != nil {
+		return fmt.Errorf("failed to read event journal: %w", err)
+	}
+	valid := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if valid == int64(len(data)) {
+		return nil
+	}
+	if err := os.Truncate(j.segmentPath(seg.first), valid); err != nil {
+		return fmt.Errorf("failed to repair event journal: %w", err)
+	}
+	seg.size = valid
+	return nil
+}
+
+// segmentPath returns the file of the segment starting at first
+func (j *Journal) segmentPath(first uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
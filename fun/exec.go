@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"fun/container"
+)
+
+// execInContainer runs a command in a running container with the CLI's stdio
+// and returns its exit code. With tty the command gets a terminal: the CLI's
+// terminal is switched to raw mode for the duration and its size follows the
+// window. With interactive the CLI's input is forwarded.
+func execInContainer(ctx context.Context, client *container.Client, containerID string, opts container.ExecOptions, interactive bool) (int, error) {
+	opts.Stdout = os.Stdout
+	opts.Stderr = os.Stderr
+	if interactive {
+		opts.Stdin = os.Stdin
+	}
+
+	if opts.TTY && isTerminal(os.Stdin) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		opts.Resize = watchTerminalSize(ctx, os.Stdin)
+
+		// Without input the terminal only has to show the output
+		if interactive {
+			restore, err := makeRaw(os.Stdin)
+			if err != nil {
+				return -1, fmt.Errorf("failed to set up the terminal: %w", err)
+			}
+			defer restore()
+		}
+	}
+	return client.Exec(ctx, containerID, opts)
+}
@@ -0,0 +1,8 @@
+//go:build fips
+
+//go:debug fips140=on
+
+package main
+
+// Building with -tags fips enables the Go FIPS 140-3 cryptographic module, so
+// fips_mode can be set without starting the daemon with GODEBUG=fips140=on.
@@ -0,0 +1,161 @@
+package fleet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer is another funserver host in the same group
+type Peer struct {
+	HostID    string   `json:"host_id"`
+	Hostname  string   `json:"hostname"`
+	Addresses []string `json:"addresses,omitempty"`
+	// MeshPublicKey and MeshEndpoint are the WireGuard public key and host:port of the peer
+	MeshPublicKey string `json:"mesh_public_key,omitempty"`
+	MeshEndpoint  string `json:"mesh_endpoint,omitempty"`
+	// Status is the state the orchestrator last saw the peer in, such as "running"
+	Status   string    `json:"status,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Group is the peer group of the host, as assigned by the orchestrator
+type Group struct {
+	Name    string `json:"name"`
+	Project string `json:"project,omitempty"`
+	// Peers are the other hosts of the group, the host itself isn't listed
+	Peers     []Peer    `json:"peers"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Online returns the peers the orchestrator saw running within maxAge, sorted by hostname
+func (g Group) Online(maxAge time.Duration) []Peer {
+	var online []Peer
+	for _, peer := range g.Peers {
+		if peer.Status == "running" && time.Since(peer.LastSeen) <= maxAge {
+			online = append(online, peer)
+		}
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i].Hostname < online[j].Hostname })
+	return online
+}
+
+// Store keeps the host's peer group on disk, so it is known while the
+// orchestrator is unreachable, and tells subscribers when it changes
+type Store struct {
+	path string
+
+	mutex       sync.Mutex
+	group       *Group
+	subscribers []func(Group)
+}
+
+// NewStore creates a store without a group, saving groups to path
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Load reads the peer group stored in path, a missing file means the host has no group yet
+func Load(path string) (*Store, error) {
+	s := NewStore(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fleet group: %w", err)
+	}
+	group := &Group{}
+	if err := json.Unmarshal(data, group); err != nil {
+		return nil, fmt.Errorf("failed to parse fleet group: %w", err)
+	}
+	s.group = group
+	return s, nil
+}
+
+// Group returns the peer group and whether the host has one
+func (s *Store) Group() (Group, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.group == nil {
+		return Group{}, false
+	}
+	return *s.group, true
+}
+
+// Subscribe calls handler with the group whenever the orchestrator changes it,
+// such as to reconfigure the mesh or fail over routes to online peers
+func (s *Store) Subscribe(handler func(Group)) {
+	s.mutex.Lock()
+	s.subscribers = append(s.subscribers, handler)
+	s.mutex.Unlock()
+}
+
+// Update replaces the peer group and stores it. It returns whether the group
+// changed; subscribers are only told about changes.
+func (s *Store) Update(group Group) (bool, error) {
+	group.Peers = append([]Peer(nil), group.Peers...)
+	sort.Slice(group.Peers, func(i, j int) bool { return group.Peers[i].HostID < group.Peers[j].HostID })
+	if group.UpdatedAt.IsZero() {
+		group.UpdatedAt = time.Now()
+	}
+
+	s.mutex.Lock()
+	// Fresh last seen times aren't worth a write or waking the subscribers
+	if s.group != nil && sameGroup(*s.group, group) {
+		s.group = &group
+		s.mutex.Unlock()
+		return false, nil
+	}
+	if err := s.save(group); err != nil {
+		s.mutex.Unlock()
+		return false, err
+	}
+	s.group = &group
+	subscribers := append([]func(Group){}, s.subscribers...)
+	s.mutex.Unlock()
+
+	for _, handler := range subscribers {
+		handler(group)
+	}
+	return true, nil
+}
+
+// save writes the group atomically; the caller must hold the mutex
+func (s *Store) save(group Group) error {
+	data, err := json.MarshalIndent(group, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create fleet directory: %w", err)
+	}
+	if err := os.WriteFile(s.path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write fleet group: %w", err)
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// sameGroup compares groups ignoring when they were sent and when the peers were last seen
+func sameGroup(a, b Group) bool {
+	a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+	a.Peers = withoutLastSeen(a.Peers)
+	b.Peers = withoutLastSeen(b.Peers)
+	return reflect.DeepEqual(a, b)
+}
+
+// withoutLastSeen returns a copy of peers with LastSeen cleared
+func withoutLastSeen(peers []Peer) []Peer {
+	result := make([]Peer, len(peers))
+	for i, peer := range peers {
+		peer.LastSeen = time.Time{}
+		result[i] = peer
+	}
+	return result
+}
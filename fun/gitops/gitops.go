@@ -0,0 +1,334 @@
+package gitops
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/container"
+)
+
+// AppliedBy identifies GitOps syncs in the deployment history
+const AppliedBy = "gitops"
+
+// Config describes the repository the desired states are synced from
+type Config struct {
+	// Repo is the clone URL, https:// or an SSH remote such as git@host:org/apps.git
+	Repo   string
+	Branch string
+	// Path is the directory in the repository with a subdirectory per project
+	Path string
+	// Dir is where the repository is checked out on the host
+	Dir string
+	// SSHKey is the private key for SSH remotes, empty uses the ssh defaults
+	SSHKey string
+	// TokenFile holds an access token for HTTPS remotes
+	TokenFile string
+	// ProjectsPath keeps the projects synced from the repository, so the
+	// containers of those removed from it are torn down
+	ProjectsPath string
+	// Policy is the host's command policy, projects are checked against it
+	// like the desired states of the orchestrator
+	Policy *container.CommandPolicy
+}
+
+// Status is the outcome of the last sync
+type Status struct {
+	Commit   string
+	LastSync time.Time
+	// Error is why the repository couldn't be synced, project errors are reported per project
+	Error    string
+	Projects []ProjectStatus
+}
+
+// ProjectStatus is the outcome of the last sync of one project
+type ProjectStatus struct {
+	Project string
+	// Drift are the changes the host needed to match the repository
+	Drift []container.StateChange
+	// Revision is the deployment revision of the last applied drift
+	Revision int
+	Error    string
+}
+
+// Syncer pulls a repository and reconciles the projects in it with the host
+type Syncer struct {
+	client *container.Client
+	config Config
+
+	mutex  sync.Mutex
+	status Status
+}
+
+// NewSyncer creates a syncer for the repository in config
+func NewSyncer(client *container.Client, config Config) (*Syncer, error) {
+	if config.Repo == "" {
+		return nil, fmt.Errorf("no GitOps repository configured")
+	}
+	if config.Path != "" && !filepath.IsLocal(config.Path) {
+		return nil, fmt.Errorf("GitOps path %q must be relative to the repository", config.Path)
+	}
+	if config.Branch == "" {
+		config.Branch = "main"
+	}
+	if config.Policy == nil {
+		config.Policy = &container.CommandPolicy{}
+	}
+	return &Syncer{client: client, config: config}, nil
+}
+
+// Status returns the outcome of the last sync
+func (s *Syncer) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+// Run syncs right away and then every interval until the context is cancelled
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	log.Printf("Syncing desired states from %s (%s) every %s", s.config.Repo, s.config.Branch, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(ctx); err != nil {
+			log.Printf("Error syncing from %s: %v", s.config.Repo, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync pulls the branch and applies the projects whose containers drifted
+// from the repository. A broken project doesn't stop the others.
+func (s *Syncer) Sync(ctx context.Context) error {
+	status := Status{LastSync: time.Now()}
+	defer func() {
+		s.mutex.Lock()
+		s.status = status
+		s.mutex.Unlock()
+	}()
+
+	commit, err := s.pull(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	status.Commit = commit
+
+	projects, err := container.LoadProjectStates(filepath.Join(s.config.Dir, s.config.Path))
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+
+	short := commit
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	// Projects applied from the repository are torn down once they are removed from it
+	synced, err := s.loadSynced()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	inRepo := make(map[string]bool, len(projects))
+	for _, project := range projects {
+		inRepo[project.Project] = true
+		result := ProjectStatus{Project: project.Project}
+		if err := s.reconcile(ctx, project, short, &result); err != nil {
+			log.Printf("Error syncing project %s: %v", project.Project, err)
+			result.Error = err.Error()
+		} else {
+			synced[project.Project] = true
+		}
+		status.Projects = append(status.Projects, result)
+	}
+
+	for project := range synced {
+		if inRepo[project] {
+			continue
+		}
+		result := ProjectStatus{Project: project}
+		if err := s.remove(ctx, project, short, &result); err != nil {
+			log.Printf("Error removing project %s: %v", project, err)
+			result.Error = err.Error()
+		} else {
+			delete(synced, project)
+		}
+		status.Projects = append(status.Projects, result)
+	}
+	return s.saveSynced(synced)
+}
+
+// remove tears down the containers of a project that was removed from the repository
+func (s *Syncer) remove(ctx context.Context, project, commit string, result *ProjectStatus) error {
+	empty := container.DesiredState{Project: project}
+	diff, err := s.client.DiffDesiredState(ctx, empty)
+	if err != nil {
+		return err
+	}
+	if !diff.HasChanges() {
+		return nil
+	}
+	result.Drift = diff.Changes
+
+	revision, err := s.client.ApplyDesiredState(ctx, empty, AppliedBy, "removal of project "+project+" in "+commit)
+	if err != nil {
+		return err
+	}
+	result.Revision = revision.Revision
+	log.Printf("Removed project %s, which is no longer in %s, as revision %d", project, commit, revision.Revision)
+	return nil
+}
+
+// loadSynced returns the projects synced before, none if they aren't recorded
+func (s *Syncer) loadSynced() (map[string]bool, error) {
+	synced := map[string]bool{}
+	if s.config.ProjectsPath == "" {
+		return synced, nil
+	}
+	data, err := os.ReadFile(s.config.ProjectsPath)
+	if os.IsNotExist(err) {
+		return synced, nil
+	}
+	if err != nil {
+		return synced, fmt.Errorf("failed to read the synced projects: %w", err)
+	}
+	var projects []string
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return synced, fmt.Errorf("failed to parse the synced projects: %w", err)
+	}
+	for _, project := range projects {
+		synced[project] = true
+	}
+	return synced, nil
+}
+
+// saveSynced records the projects synced from the repository
+func (s *Syncer) saveSynced(synced map[string]bool) error {
+	if s.config.ProjectsPath == "" {
+		return nil
+	}
+	projects := make([]string, 0, len(synced))
+	for project := range synced {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	data, err := json.Marshal(projects)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.config.ProjectsPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to record the synced projects: %w", err)
+	}
+	return os.Rename(tmpPath, s.config.ProjectsPath)
+}
+
+// reconcile applies one project if the host drifted from it
+func (s *Syncer) reconcile(ctx context.Context, project container.ProjectState, commit string, result *ProjectStatus) error {
+	if project.Err != nil {
+		return project.Err
+	}
+	if err := s.client.VerifyManifest("git:"+project.Path, project.Manifest, project.Signature); err != nil {
+		return err
+	}
+	// The directory isn't signed, so a signature only vouches for the project the document names
+	if s.client.ManifestsSigned() && project.Declared != project.Project {
+		return fmt.Errorf("%s is signed without naming project %q", project.Path, project.Project)
+	}
+	if err := s.config.Policy.CheckDesiredState(project.State); err != nil {
+		return err
+	}
+
+	diff, err := s.client.DiffDesiredState(ctx, project.State)
+	if err != nil {
+		return err
+	}
+	if !diff.HasChanges() {
+		return nil
+	}
+	result.Drift = diff.Changes
+
+	revision, err := s.client.ApplyDesiredState(ctx, project.State, AppliedBy, "sync of "+commit)
+	if err != nil {
+		return err
+	}
+	result.Revision = revision.Revision
+	log.Printf("Synced project %s to %s as revision %d (%d changes)", project.Project, commit, revision.Revision, len(revision.Changes))
+	return nil
+}
+
+// pull clones the branch on the first sync and later resets the checkout to
+// the remote branch, discarding local edits. It returns the checked out commit.
+func (s *Syncer) pull(ctx context.Context) (string, error) {
+	if _, err := os.Stat(filepath.Join(s.config.Dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(s.config.Dir), 0700); err != nil {
+			return "", err
+		}
+		if err := os.RemoveAll(s.config.Dir); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, "", "clone", "--quiet", "--depth", "1", "--single-branch", "--branch", s.config.Branch, s.config.Repo, s.config.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		// The remote is updated too, in case the repository was reconfigured
+		if _, err := s.git(ctx, s.config.Dir, "remote", "set-url", "origin", s.config.Repo); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, s.config.Dir, "fetch", "--quiet", "--depth", "1", "origin", s.config.Branch); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, s.config.Dir, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, s.config.Dir, "clean", "--quiet", "-fdx"); err != nil {
+			return "", err
+		}
+	}
+	return s.git(ctx, s.config.Dir, "rev-parse", "HEAD")
+}
+
+// git runs a git command with the configured credentials
+func (s *Syncer) git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// Never wait for a password prompt in the daemon
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if s.config.SSHKey != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %q -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new", s.config.SSHKey))
+	}
+	if s.config.TokenFile != "" {
+		token, err := os.ReadFile(s.config.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read GitOps token: %w", err)
+		}
+		// Passed through the environment so the token doesn't show up in the process list
+		credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + strings.TrimSpace(string(token))))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials,
+		)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,181 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/logging"
+)
+
+// checkTimeout bounds a single check, a check that hangs counts as failed
+const checkTimeout = 5 * time.Second
+
+// Check is a condition the daemon depends on
+type Check struct {
+	Name string
+	// Liveness checks fail /healthz, meaning the daemon is wedged and must be
+	// restarted. All checks fail /readyz, meaning the daemon can't do its work.
+	Liveness bool
+	Run      func(ctx context.Context) error
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the outcome of the liveness or readiness checks
+type Report struct {
+	OK     bool      `json:"ok"`
+	Checks []Result  `json:"checks"`
+	Time   time.Time `json:"time"`
+}
+
+// Checker runs the daemon's health checks for the local API and the service manager's watchdog
+type Checker struct {
+	mutex      sync.Mutex
+	checks     []Check
+	heartbeats map[string]time.Time
+}
+
+// NewChecker creates a checker without checks
+func NewChecker() *Checker {
+	return &Checker{heartbeats: make(map[string]time.Time)}
+}
+
+// Add registers a check
+func (c *Checker) Add(check Check) {
+	c.mutex.Lock()
+	c.checks = append(c.checks, check)
+	c.mutex.Unlock()
+}
+
+// Heartbeat registers a liveness check failing when the returned function
+// wasn't called for maxAge, such as by a loop of the daemon on every iteration
+func (c *Checker) Heartbeat(name string, maxAge time.Duration) func() {
+	c.mutex.Lock()
+	c.heartbeats[name] = time.Now()
+	c.mutex.Unlock()
+
+	c.Add(Check{Name: name, Liveness: true, Run: func(ctx context.Context) error {
+		c.mutex.Lock()
+		last := c.heartbeats[name]
+		c.mutex.Unlock()
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("no progress for %s", age.Round(time.Second))
+		}
+		return nil
+	}})
+	return func() {
+		c.mutex.Lock()
+		c.heartbeats[name] = time.Now()
+		c.mutex.Unlock()
+	}
+}
+
+// Live runs the liveness checks
+func (c *Checker) Live(ctx context.Context) Report {
+	return c.run(ctx, true)
+}
+
+// Ready runs all checks
+func (c *Checker) Ready(ctx context.Context) Report {
+	return c.run(ctx, false)
+}
+
+// run runs the checks concurrently, only the liveness ones if liveOnly is set
+func (c *Checker) run(ctx context.Context, liveOnly bool) Report {
+	c.mutex.Lock()
+	var checks []Check
+	for _, check := range c.checks {
+		if check.Liveness || !liveOnly {
+			checks = append(checks, check)
+		}
+	}
+	c.mutex.Unlock()
+
+	report := Report{OK: true, Checks: make([]Result, len(checks)), Time: time.Now()}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			report.Checks[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		report.OK = report.OK && result.OK
+	}
+	return report
+}
+
+// runCheck runs a check within checkTimeout, a check that doesn't return in
+// time is reported as failed while it keeps running
+func runCheck(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", checkTimeout)
+	}
+	result := Result{Name: check.Name, OK: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// RunWatchdog calls notify every interval while the liveness checks pass, so
+// the service manager restarts the daemon once it stops making progress
+func (c *Checker) RunWatchdog(ctx context.Context, interval time.Duration, notify func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report := c.Live(ctx)
+		if !report.OK {
+			if !failing {
+				log.Printf("Warning: Liveness checks failing, withholding watchdog keepalives: %s", report.Failures())
+				failing = true
+			}
+			continue
+		}
+		failing = false
+		if err := notify(); err != nil {
+			logging.Debugf("Failed to send watchdog keepalive: %v", err)
+		}
+	}
+}
+
+// Failures describes the failed checks of a report
+func (r Report) Failures() string {
+	var failures []string
+	for _, result := range r.Checks {
+		if !result.OK {
+			failures = append(failures, result.Name+": "+result.Error)
+		}
+	}
+	return strings.Join(failures, "; ")
+}
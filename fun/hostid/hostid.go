@@ -0,0 +1,98 @@
+package hostid
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// namespace separates our IDs from other applications seeded by the same machine ID
+const namespace = "funserver-host-id"
+
+// uuidPattern matches a UUID in its canonical form
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Load returns the persistent host ID stored at path, generating it on first run
+// The ID is derived from the OS machine ID when there is one, so reinstalling
+// keeps the identity, and it never changes with the hostname.
+func Load(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		id := strings.TrimSpace(string(data))
+		if uuidPattern.MatchString(id) {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read host ID: %w", err)
+	}
+
+	seed := machineID()
+	if seed == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return "", fmt.Errorf("failed to generate host ID: %w", err)
+		}
+		seed = string(random)
+	}
+	id := newUUID(seed)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create host ID directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write host ID: %w", err)
+	}
+	return id, nil
+}
+
+// newUUID hashes seed into a version 5 style UUID, so the raw machine ID isn't disclosed
+func newUUID(seed string) string {
+	sum := sha256.Sum256([]byte(namespace + ":" + seed))
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// machineID returns the identifier the OS assigned to this installation, empty if unknown
+func machineID() string {
+	switch runtime.GOOS {
+	case "linux":
+		for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+			if data, err := os.ReadFile(path); err == nil {
+				if id := strings.TrimSpace(string(data)); id != "" {
+					return id
+				}
+			}
+		}
+	case "darwin":
+		output, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.Contains(line, "IOPlatformUUID") {
+				if _, value, ok := strings.Cut(line, "="); ok {
+					return strings.Trim(strings.TrimSpace(value), `"`)
+				}
+			}
+		}
+	case "windows":
+		output, err := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`, "/v", "MachineGuid").Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "MachineGuid" {
+				return fields[2]
+			}
+		}
+	}
+	return ""
+}
@@ -94,6 +94,9 @@ After=network.target docker.service
 Requires=docker.service
 
 [Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=60
 ExecStart=$INSTALL_DIR/fun --daemon
 Restart=always
 User=root
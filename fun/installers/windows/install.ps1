@@ -96,6 +96,12 @@ catch {
     Write-Message "Please install Docker Desktop for Windows from https://www.docker.com/products/docker-desktop" -IsError
 }
 
+# Register the Event Log source the daemon reports to
+if (-not [System.Diagnostics.EventLog]::SourceExists("Fun Server")) {
+    Write-Message "Registering the Fun Server Event Log source"
+    New-EventLog -LogName Application -Source "Fun Server"
+}
+
 # Install the service using the install-service.cmd script
 Write-Message "Installing Fun Server service"
 Start-Process -FilePath "$InstallDir\install-service.cmd" -ArgumentList "$InstallDir" -Wait -NoNewWindow
@@ -67,6 +67,16 @@ catch {
   Write-Message "Unable to uninstall service: $_" -IsError
 }
 
+# Unregister the Event Log source
+try {
+  if ([System.Diagnostics.EventLog]::SourceExists("Fun Server")) {
+    Remove-EventLog -Source "Fun Server"
+  }
+}
+catch {
+  Write-Message "Unable to unregister the Event Log source: $_" -IsError
+}
+
 # Remove from PATH environment variable
 $currentPath = [Environment]::GetEnvironmentVariable("PATH", "Machine")
 if ($currentPath.Contains($InstallDir)) {
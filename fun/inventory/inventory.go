@@ -0,0 +1,193 @@
+package inventory
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Inventory describes the host software relevant for vulnerability tracking
+type Inventory struct {
+	CollectedAt   time.Time `json:"collected_at"`
+	OS            string    `json:"os"`
+	OSVersion     string    `json:"os_version"`
+	KernelVersion string    `json:"kernel_version"`
+
+	// PackageManager is empty if pending updates can't be determined on this host
+	PackageManager  string          `json:"package_manager,omitempty"`
+	SecurityUpdates []PackageUpdate `json:"security_updates"`
+
+	// Runtimes maps components such as containerd and runc to their versions
+	Runtimes map[string]string `json:"runtimes"`
+}
+
+// PackageUpdate is a pending security update of an installed package
+type PackageUpdate struct {
+	Name             string `json:"name"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	AvailableVersion string `json:"available_version,omitempty"`
+}
+
+// RuntimeVersioner reports the version of the container runtime
+type RuntimeVersioner interface {
+	RuntimeVersion(ctx context.Context) (string, error)
+}
+
+// Collect gathers the host inventory
+// Failures of individual probes are left out of the result instead of failing
+// the whole collection, since the tools differ between distributions.
+func Collect(ctx context.Context, runtimeClient RuntimeVersioner) *Inventory {
+	inv := &Inventory{
+		CollectedAt:     time.Now(),
+		OS:              runtime.GOOS,
+		SecurityUpdates: []PackageUpdate{},
+		Runtimes:        make(map[string]string),
+	}
+
+	inv.OSVersion = osVersion()
+	inv.KernelVersion = kernelVersion(ctx)
+
+	if runtimeClient != nil {
+		if version, err := runtimeClient.RuntimeVersion(ctx); err == nil {
+			inv.Runtimes["containerd"] = version
+		}
+	}
+	if version, err := commandVersion(ctx, "runc", "--version"); err == nil {
+		inv.Runtimes["runc"] = version
+	}
+
+	if runtime.GOOS == "linux" {
+		manager, updates, err := securityUpdates(ctx)
+		if err == nil {
+			inv.PackageManager = manager
+			inv.SecurityUpdates = updates
+		}
+	}
+
+	return inv
+}
+
+// osVersion returns the distribution name and version
+func osVersion() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// kernelVersion returns the running kernel release
+func kernelVersion(ctx context.Context) string {
+	if runtime.GOOS == "linux" {
+		if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	if runtime.GOOS == "windows" {
+		output, err := exec.CommandContext(ctx, "cmd", "/c", "ver").Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(output))
+	}
+	output, err := exec.CommandContext(ctx, "uname", "-r").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// commandVersion returns the first line printed by a version command
+func commandVersion(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return line, nil
+}
+
+// securityUpdates lists pending security updates with the package manager of the host
+func securityUpdates(ctx context.Context) (string, []PackageUpdate, error) {
+	if _, err := exec.LookPath("apt-get"); err == nil {
+		updates, err := aptSecurityUpdates(ctx)
+		return "apt", updates, err
+	}
+	for _, manager := range []string{"dnf", "yum"} {
+		if _, err := exec.LookPath(manager); err == nil {
+			updates, err := dnfSecurityUpdates(ctx, manager)
+			return manager, updates, err
+		}
+	}
+	return "", nil, fmt.Errorf("no supported package manager found")
+}
+
+// aptInstLine matches "Inst name [installed] (available origin [arch])" lines of a simulated upgrade
+var aptInstLine = regexp.MustCompile(`^Inst (\S+) (?:\[(\S+)\] )?\((\S+) ([^)]*)\)`)
+
+// aptSecurityUpdates simulates an upgrade and keeps the packages from security origins
+func aptSecurityUpdates(ctx context.Context) ([]PackageUpdate, error) {
+	output, err := exec.CommandContext(ctx, "apt-get", "-s", "-o", "Debug::NoLocking=true", "upgrade").Output()
+	if err != nil {
+		return nil, fmt.Errorf("apt-get upgrade simulation failed: %w", err)
+	}
+	return parseAptUpgrade(string(output)), nil
+}
+
+// parseAptUpgrade parses the output of apt-get -s upgrade
+func parseAptUpgrade(output string) []PackageUpdate {
+	updates := []PackageUpdate{}
+	for _, line := range strings.Split(output, "\n") {
+		match := aptInstLine.FindStringSubmatch(line)
+		if match == nil || !strings.Contains(strings.ToLower(match[4]), "security") {
+			continue
+		}
+		updates = append(updates, PackageUpdate{
+			Name:             match[1],
+			InstalledVersion: match[2],
+			AvailableVersion: match[3],
+		})
+	}
+	return updates
+}
+
+// dnfSecurityUpdates lists the packages with pending security advisories
+func dnfSecurityUpdates(ctx context.Context, manager string) ([]PackageUpdate, error) {
+	output, err := exec.CommandContext(ctx, manager, "-q", "updateinfo", "list", "--security").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s updateinfo failed: %w", manager, err)
+	}
+	return parseUpdateInfo(string(output)), nil
+}
+
+// parseUpdateInfo parses "ADVISORY SEVERITY/sec PACKAGE-VERSION.ARCH" lines of dnf updateinfo
+func parseUpdateInfo(output string) []PackageUpdate {
+	updates := []PackageUpdate{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || seen[fields[2]] {
+			continue
+		}
+		seen[fields[2]] = true
+		updates = append(updates, PackageUpdate{Name: fields[2]})
+	}
+	return updates
+}
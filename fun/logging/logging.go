@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is a log verbosity level
+type Level int32
+
+// Log levels, from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// levelNames maps levels to their configuration names
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// current is the active level, it can be changed while the daemon runs
+var current atomic.Int32
+
+func init() {
+	current.Store(int32(LevelInfo))
+}
+
+// String returns the configuration name of the level
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLevel parses a level name such as "debug" or "info"
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug", "trace":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+}
+
+// SetLevel changes the active log level
+func SetLevel(name string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	previous := Level(current.Swap(int32(level)))
+	if previous != level {
+		log.Printf("Log level changed from %s to %s", previous, level)
+	}
+	return nil
+}
+
+// GetLevel returns the active log level
+func GetLevel() Level {
+	return Level(current.Load())
+}
+
+// Enabled reports whether messages at level are logged
+func Enabled(level Level) bool {
+	return level >= GetLevel()
+}
+
+// Debugf logs a message only when debug logging is enabled
+func Debugf(format string, args ...interface{}) {
+	if Enabled(LevelDebug) {
+		log.Printf("[debug] "+format, args...)
+	}
+}
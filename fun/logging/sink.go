@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"io"
+	"strings"
+)
+
+// EventSource is the name daemon logs are reported under in the platform log
+const EventSource = "Fun Server"
+
+// classify returns the severity of a formatted log line from its markers
+func classify(line string) Level {
+	switch {
+	case strings.Contains(line, "[debug] "):
+		return LevelDebug
+	case strings.Contains(line, "Warning:"):
+		return LevelWarn
+	case strings.Contains(line, "Error:"), strings.Contains(line, "Failed to "), strings.Contains(line, "failed to "):
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// levelSink passes the log lines at or above a level to a function
+type levelSink struct {
+	min    Level
+	handle func(level Level, line string)
+}
+
+// NewLevelSink returns a writer passing the log lines at min or above to
+// handle, such as to keep the errors the daemon logs in its event journal.
+// handle runs while the logger is locked and must not log itself.
+func NewLevelSink(min Level, handle func(level Level, line string)) io.Writer {
+	return &levelSink{min: min, handle: handle}
+}
+
+func (s *levelSink) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	if level := classify(line); level >= s.min {
+		s.handle(level, line)
+	}
+	return len(p), nil
+}
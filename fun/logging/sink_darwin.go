@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// priorities maps levels to the syslog priorities logger(1) forwards to os_log
+var priorities = map[Level]string{
+	LevelDebug: "user.debug",
+	LevelInfo:  "user.info",
+	LevelWarn:  "user.warning",
+	LevelError: "user.err",
+}
+
+// unifiedLogSink writes log lines to the macOS unified log through logger(1),
+// which keeps the daemon free of cgo. One logger process runs per priority.
+type unifiedLogSink struct {
+	mutex   sync.Mutex
+	loggers map[Level]*exec.Cmd
+	inputs  map[Level]io.WriteCloser
+}
+
+// NewSystemSink returns a writer sending log lines to the macOS unified log,
+// where they show up in Console and log show --predicate 'process == "logger"'
+func NewSystemSink() (io.WriteCloser, error) {
+	if _, err := exec.LookPath("logger"); err != nil {
+		return nil, errors.Wrap(err, "logger not found")
+	}
+	return &unifiedLogSink{
+		loggers: make(map[Level]*exec.Cmd),
+		inputs:  make(map[Level]io.WriteCloser),
+	}, nil
+}
+
+func (s *unifiedLogSink) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	level := classify(string(p))
+	input, ok := s.inputs[level]
+	if !ok {
+		cmd := exec.Command("logger", "-t", EventSource, "-p", priorities[level])
+		var err error
+		if input, err = cmd.StdinPipe(); err != nil {
+			return 0, err
+		}
+		if err := cmd.Start(); err != nil {
+			return 0, errors.Wrap(err, "failed to start logger")
+		}
+		s.loggers[level] = cmd
+		s.inputs[level] = input
+	}
+
+	// logger logs every line it reads as a message
+	if _, err := input.Write(p); err != nil {
+		// logger exited, start a new one with the next message
+		input.Close()
+		s.loggers[level].Wait()
+		delete(s.inputs, level)
+		delete(s.loggers, level)
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *unifiedLogSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for level, input := range s.inputs {
+		input.Close()
+		s.loggers[level].Wait()
+	}
+	s.inputs = make(map[Level]io.WriteCloser)
+	s.loggers = make(map[Level]*exec.Cmd)
+	return nil
+}
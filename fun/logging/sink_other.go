@@ -0,0 +1,11 @@
+//go:build !windows && !darwin
+
+package logging
+
+import "io"
+
+// NewSystemSink returns nil, only the Windows Event Log and the macOS unified log
+// have a sink
+func NewSystemSink() (io.WriteCloser, error) {
+	return nil, nil
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the event ID of all daemon messages, within the range EventCreate.exe accepts
+const eventID = 1
+
+// eventLogSink writes log lines to the Windows Event Log
+type eventLogSink struct {
+	log *eventlog.Log
+}
+
+// NewSystemSink returns a writer sending log lines to the Windows Event Log
+// The installer registers the event source, without it messages are still
+// logged but shown without a description template.
+func NewSystemSink() (io.WriteCloser, error) {
+	log, err := eventlog.Open(EventSource)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogSink{log: log}, nil
+}
+
+func (s *eventLogSink) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\r\n")
+	var err error
+	switch classify(line) {
+	case LevelError:
+		err = s.log.Error(eventID, line)
+	case LevelWarn:
+		err = s.log.Warning(eventID, line)
+	default:
+		err = s.log.Info(eventID, line)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *eventLogSink) Close() error {
+	return s.log.Close()
+}
@@ -2,21 +2,51 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"fun/admin"
+	"fun/artifacts"
+	"fun/audit"
 	"fun/cloud"
 	"fun/config"
 	"fun/container"
+	"fun/dockerapi"
+	"fun/download"
+	"fun/election"
+	"fun/events"
+	"fun/fleet"
+	"fun/gitops"
+	"fun/health"
+	"fun/hostid"
+	"fun/inventory"
+	"fun/logging"
+	"fun/power"
 	"fun/service"
+	"fun/sockets"
+	"fun/tasks"
+	"fun/telemetry"
+	"fun/tlsconfig"
+	"fun/tunnel"
 )
 
 // Version information
@@ -26,21 +56,42 @@ var (
 	GitCommit = "unknown"
 )
 
+// cloudSimulator replaces the orchestrator for cloud clients when set by fun dev cloud-sim
+var cloudSimulator *cloud.Simulator
+
 // Command line flags
 var (
 	daemonMode  bool
 	showVersion bool
 	configPath  string
+	dryRun      bool
+	// containerdTarget names one of the containerd_sockets to use instead of containerd_socket
+	containerdTarget string
+	// outputFormat is text, json or yaml, see output.go
+	outputFormat string
 )
 
 func init() {
 	flag.BoolVar(&daemonMode, "daemon", false, "Run in daemon mode")
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
 	flag.StringVar(&configPath, "config", config.GetDefaultConfigPath(), "Path to configuration file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the actions of mutating commands without executing them")
+	flag.StringVar(&containerdTarget, "containerd", "", "Name of the containerd_sockets entry commands use, e.g. system")
+	flag.StringVar(&outputFormat, "output", outputText, "Print the results of list, inspect and status commands as text, json or yaml")
 	flag.Parse()
 }
 
 func main() {
+	// The containerd shim runs this binary as the logging binary of containers,
+	// without the environment configuration is found in
+	if flag.Arg(0) == "log-driver" && os.Getenv("CONTAINER_ID") != "" {
+		if err := container.RunLogDriver(flag.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Show version if requested
 	if showVersion {
 		fmt.Printf("Fun Server %s\n", Version)
@@ -54,22 +105,39 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if cfg.ArtifactCacheDir != "" {
+		container.ArtifactCacheDir = cfg.ArtifactCacheDir
+	}
 
 	// If not in daemon mode, process CLI commands
 	if !daemonMode {
+		if containerdTarget != "" {
+			socket, ok := cfg.ContainerdSockets[containerdTarget]
+			if !ok {
+				fmt.Printf("Error: no containerd socket named %q in containerd_sockets\n", containerdTarget)
+				os.Exit(1)
+			}
+			cfg.ContainerdSocket = socket
+		}
 		handleCLICommands(cfg)
 		return
 	}
 
 	// Configure logging
-	setupLogging(cfg.LogFile, cfg.LogLevel)
+	setupLogging(cfg.LogFile, cfg.LogLevel, cfg.SystemLog)
+
+	// With the WSL agent the Windows daemon only controls the Linux one
+	if cfg.WSLAgent && container.IsRunningOnWindows() {
+		runWSLController(cfg)
+		return
+	}
 
 	// Run daemon mode
 	runDaemon(cfg)
 }
 
 // setupLogging configures the logging system
-func setupLogging(logFile, logLevel string) {
+func setupLogging(logFile, logLevel string, systemLog bool) {
 	// Create log directory if it doesn't exist
 	logDir := filepath.Dir(logFile)
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -82,11 +150,28 @@ func setupLogging(logFile, logLevel string) {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 
-	// Set log output to the file
-	log.SetOutput(file)
+	// Set log output to the file, and the platform log so native tooling surfaces errors
+	output := io.Writer(file)
+	var sinkErr error
+	if systemLog {
+		sink, err := logging.NewSystemSink()
+		if err != nil {
+			sinkErr = err
+		} else if sink != nil {
+			output = io.MultiWriter(file, sink)
+		}
+	}
+	log.SetOutput(output)
 	log.SetPrefix("[Fun] ")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 
+	if err := logging.SetLevel(logLevel); err != nil {
+		log.Printf("Warning: %v, using info", err)
+	}
+	if sinkErr != nil {
+		log.Printf("Warning: Failed to open the system log, logging to the file only: %v", sinkErr)
+	}
+
 	// Log startup message
 	log.Printf("Starting Fun Server version %s", Version)
 }
@@ -98,9 +183,30 @@ func handleCLICommands(cfg *config.Config) {
 		showHelp()
 		return
 	}
+	args, err := takeOutputFlag(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkOutputFormat(args); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Container commands are handled by the agent in the WSL2 distribution
+	if cfg.WSLAgent && container.IsRunningOnWindows() && wslAgentCommands[args[0]] {
+		forwardToWSLAgent(args)
+		return
+	}
 
 	// Create service instance
 	svc := service.New()
+	svc.WatchdogSec = cfg.SystemdWatchdogSec
+	svc.LogFile = cfg.LogFile
+	// Give the shutdown policy time to stop the containers before systemd kills the daemon
+	if policy, err := container.ParseShutdownPolicy(cfg.ShutdownPolicy); err == nil && policy != container.ShutdownLeaveRunning {
+		svc.StopTimeoutSec = int(container.ShutdownDuration(time.Duration(cfg.ShutdownTimeout)*time.Second).Seconds()) + 30
+	}
 
 	switch args[0] {
 	case "start":
@@ -118,6 +224,21 @@ func handleCLICommands(cfg *config.Config) {
 		}
 		fmt.Println("Fun Server stopped successfully")
 	case "status":
+		if structuredOutput() {
+			status, err := svc.Status()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			printOutput(statusOutput{
+				Service:    status,
+				CgroupMode: container.DetectCgroupMode(),
+				Containerd: containerdConnections(cfg),
+				Capacity:   container.HostCapacity(),
+				Reserved:   container.HostResources{CPUs: cfg.ReservedCPUs, MemoryBytes: int64(cfg.ReservedMemoryMB) << 20},
+			})
+			return
+		}
 		fmt.Println("Checking Fun Server status...")
 		status, err := svc.Status()
 		if err != nil {
@@ -125,6 +246,63 @@ func handleCLICommands(cfg *config.Config) {
 			os.Exit(1)
 		}
 		fmt.Printf("Fun Server is %s\n", status)
+		fmt.Printf("cgroup mode: %s\n", container.DetectCgroupMode())
+
+		fmt.Println("containerd:")
+		for _, conn := range containerdConnections(cfg) {
+			state := "not running"
+			if conn.Connected {
+				state = "running " + conn.Version
+			}
+			primary := ""
+			if conn.Primary {
+				primary = " (used by commands)"
+			}
+			fmt.Printf("  %-10s %s: %s%s\n", conn.Name, conn.Socket, state, primary)
+		}
+
+		capacity := container.HostCapacity()
+		fmt.Printf("Capacity: %.1f CPUs, %d MB memory\n", capacity.CPUs, capacity.MemoryBytes>>20)
+		fmt.Printf("Reserved for the host: %.1f CPUs, %d MB memory\n", cfg.ReservedCPUs, cfg.ReservedMemoryMB)
+	case "service":
+		if len(args) < 2 || args[1] != "install" {
+			fmt.Println("Usage: fun service install [--print] [--socket-activated]")
+			os.Exit(1)
+		}
+
+		fs := flag.NewFlagSet("service install", flag.ExitOnError)
+		printUnit := fs.Bool("print", false, "Print the systemd unit instead of installing it")
+		socketActivated := fs.Bool("socket-activated", false, "Let systemd hold the admin and Docker API sockets, so they accept connections while the daemon starts or restarts")
+		fs.Parse(args[2:])
+
+		gates := startupGates(cfg)
+		activation := service.ActivationSockets{
+			AdminSocket:     cfg.AdminSocket,
+			DockerAPISocket: cfg.DockerAPISocket,
+			SocketGroup:     cfg.SocketGroup,
+		}
+		if *printUnit || dryRun {
+			fmt.Print(svc.SystemdUnit(gates))
+			if *socketActivated {
+				fmt.Printf("\n# %s\n", svc.GetSocketFilePath())
+				fmt.Print(svc.SystemdSocketUnit(activation))
+			}
+			return
+		}
+		var err error
+		if *socketActivated {
+			err = svc.InstallSocketActivated(gates, activation)
+		} else {
+			err = svc.Install(gates)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Fun Server service installed at %s\n", svc.GetServiceFilePath())
+		if *socketActivated {
+			fmt.Printf("Its local API sockets are held by the socket unit %s\n", svc.GetSocketFilePath())
+		}
 	case "container":
 		if len(args) < 2 {
 			fmt.Println("Missing container subcommand")
@@ -132,6 +310,105 @@ func handleCLICommands(cfg *config.Config) {
 			os.Exit(1)
 		}
 		handleContainerCommands(cfg, args[1:])
+	case "image":
+		if len(args) < 2 {
+			fmt.Println("Missing image subcommand")
+			showImageHelp()
+			os.Exit(1)
+		}
+		handleImageCommands(cfg, args[1:])
+	case "network":
+		if len(args) < 2 {
+			fmt.Println("Missing network subcommand")
+			showNetworkHelp()
+			os.Exit(1)
+		}
+		handleNetworkCommands(cfg, args[1:])
+	case "namespace":
+		if len(args) < 2 {
+			fmt.Println("Missing namespace subcommand")
+			showNamespaceHelp()
+			os.Exit(1)
+		}
+		handleNamespaceCommands(cfg, args[1:])
+	case "vm":
+		if len(args) < 2 {
+			fmt.Println("Missing vm subcommand")
+			showVMHelp()
+			os.Exit(1)
+		}
+		handleVMCommands(args[1:])
+	case "system":
+		if len(args) < 2 {
+			fmt.Println("Missing system subcommand")
+			showSystemHelp()
+			os.Exit(1)
+		}
+		handleSystemCommands(cfg, args[1:])
+	case "debug":
+		if len(args) < 2 {
+			fmt.Println("Missing debug subcommand")
+			showDebugHelp()
+			os.Exit(1)
+		}
+		handleDebugCommands(cfg, args[1:])
+	case "dev":
+		if len(args) < 2 {
+			fmt.Println("Missing dev subcommand")
+			showDevHelp()
+			os.Exit(1)
+		}
+		handleDevCommands(cfg, args[1:])
+	case "cri":
+		handleCRICommand(cfg)
+	case "doctor":
+		handleDoctorCommand(cfg)
+	case "stdio-relay":
+		// Internal: the far end of the socket relays of the WSL controller
+		if len(args) < 2 {
+			fmt.Println("Usage: fun stdio-relay <socket>")
+			os.Exit(1)
+		}
+		if err := sockets.RelayStdio(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "ctr":
+		handleCtrCommand(cfg, args[1:])
+	case "nerdctl":
+		if len(args) < 2 {
+			fmt.Println("Missing nerdctl command")
+			showNerdctlHelp()
+			os.Exit(1)
+		}
+		handleNerdctlCommands(cfg, args[1:])
+	case "inventory":
+		handleInventoryCommand(cfg)
+	case "plan":
+		handlePlanCommand(cfg, args[1:])
+	case "apply":
+		handleApplyCommand(cfg, args[1:])
+	case "apply-all":
+		handleApplyAllCommand(cfg, args[1:])
+	case "history":
+		handleHistoryCommand(cfg)
+	case "fleet":
+		handleFleetCommand(cfg, args[1:])
+	case "tasks":
+		handleTasksCommand(cfg, args[1:])
+	case "events":
+		handleEventsCommand(cfg, args[1:])
+	case "artifacts":
+		handleArtifactsCommand(cfg, args[1:])
+	case "rollback":
+		handleRollbackCommand(cfg, args[1:])
+	case "migrate":
+		if len(args) < 2 {
+			fmt.Println("Missing migrate source")
+			showMigrateHelp()
+			os.Exit(1)
+		}
+		handleMigrateCommands(cfg, args[1:])
 	default:
 		fmt.Printf("Unknown command: %s\n", args[0])
 		showHelp()
@@ -146,7 +423,7 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 	}
 
 	// Create container client
-	client, err := container.NewClient(cfg.ContainerdSocket, cfg.ContainerdNamespace)
+	client, err := newContainerClient(cfg)
 	if err != nil {
 		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
 		os.Exit(1)
@@ -163,57 +440,434 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 
 	switch args[0] {
 	case "list":
-		fmt.Println("Listing containers...")
-		containers, err := client.GetContainers(ctx)
+		if !structuredOutput() {
+			fmt.Println("Listing containers...")
+		}
+		containers, err := client.ListContainers(ctx)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
+		if structuredOutput() {
+			printOutput(containers)
+			return
+		}
 
-		fmt.Println("ID\t\t\tIMAGE\t\t\tSTATUS")
+		fmt.Println("ID\t\t\tIMAGE\t\t\tSTATUS\t\tRESTARTS\tLAST EXIT")
 		for _, c := range containers {
-			task, err := c.Task(ctx, nil)
-			status := "created"
-			if err == nil {
-				s, _ := task.Status(ctx)
-				status = string(s.Status)
+			lastExit := "-"
+			if t := c.Termination; t != nil {
+				lastExit = fmt.Sprintf("%d (%s)", t.ExitCode, t.Reason)
+			}
+			fmt.Printf("%s\t%s\t%s\t%d\t%s\n", c.ID, c.ImageRef, c.Status, c.RestartCount, lastExit)
+		}
+
+	case "exec":
+		fs := flag.NewFlagSet("container exec", flag.ExitOnError)
+		interactive := fs.Bool("interactive", false, "Forward stdin to the command")
+		fs.BoolVar(interactive, "i", false, "Shorthand for --interactive")
+		tty := fs.Bool("tty", false, "Run the command in a terminal")
+		fs.BoolVar(tty, "t", false, "Shorthand for --tty")
+		workdir := fs.String("workdir", "", "Working directory inside the container")
+		fs.StringVar(workdir, "w", "", "Shorthand for --workdir")
+		var env stringSliceFlag
+		fs.Var(&env, "env", "Set an environment variable, KEY=VALUE (repeatable)")
+		fs.Var(&env, "e", "Shorthand for --env")
+		fs.Parse(expandShortFlags(fs, args[1:]))
+		if fs.NArg() < 2 {
+			fmt.Println("Usage: fun container exec [-i] [-t] [-e KEY=VALUE] [-w dir] <id> <command> [args...]")
+			os.Exit(1)
+		}
+
+		opts := container.ExecOptions{
+			Command:    fs.Args()[1:],
+			Env:        expandEnv(env),
+			WorkingDir: *workdir,
+			TTY:        *tty,
+		}
+		exitCode, err := execInContainer(ctx, client, resolveContainer(ctx, client, fs.Arg(0)), opts, *interactive)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+
+	case "stats":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun container stats <id>")
+			os.Exit(1)
+		}
+
+		stats, err := client.ContainerStats(ctx, resolveContainer(ctx, client, args[1]))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(stats)
+			return
+		}
+
+		fmt.Printf("cgroup:        %s\n", stats.CgroupVersion)
+		fmt.Printf("CPU time:      %s\n", time.Duration(stats.CPUUsageNanos))
+		fmt.Printf("Memory:        %d bytes (working set %d, limit %d)\n", stats.MemoryUsage, stats.MemoryWorkingSet, stats.MemoryLimit)
+		fmt.Printf("Swap:          %d bytes\n", stats.SwapUsage)
+		fmt.Printf("PIDs:          %d\n", stats.PidsCurrent)
+		fmt.Printf("Block I/O:     %d read, %d written\n", stats.IOReadBytes, stats.IOWriteBytes)
+		fmt.Printf("Network:       %d received, %d sent\n", stats.NetworkRxBytes, stats.NetworkTxBytes)
+
+	case "diff":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun container diff <id>")
+			os.Exit(1)
+		}
+
+		changes, err := client.ContainerDiff(ctx, resolveContainer(ctx, client, args[1]))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(changes)
+			return
+		}
+		for _, change := range changes {
+			fmt.Printf("%s %s\n", change.Kind, change.Path)
+		}
+
+	case "debug-bundle":
+		fs := flag.NewFlagSet("container debug-bundle", flag.ExitOnError)
+		output := fs.String("o", cfg.DebugBundleDir, "Directory the bundle is written to")
+		cores := fs.Bool("cores", cfg.DebugBundleCores, "Also copy core dumps")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 1 || *output == "" {
+			fmt.Println("Usage: fun container debug-bundle [-o dir] [--cores] <id>")
+			os.Exit(1)
+		}
+
+		containerID := resolveContainer(ctx, client, fs.Arg(0))
+		// The journal is only reachable while the daemon runs, the bundle is useful without it
+		history, err := admin.NewClient(cfg.AdminSocket).Events(ctx, events.Filter{Subject: containerID, Since: time.Now().Add(-24 * time.Hour)})
+		if err != nil {
+			logging.Debugf("Debug bundle without journal events: %v", err)
+		}
+		bundle, err := client.CaptureDebugBundle(ctx, containerID, container.DebugBundleOptions{Dir: *output, CoreDumps: *cores, Events: history})
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Debug bundle written to %s\n", bundle)
+
+	case "top":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun container top <id>")
+			os.Exit(1)
+		}
+
+		processes, err := client.Top(ctx, resolveContainer(ctx, client, args[1]))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(processes)
+			return
+		}
+
+		fmt.Println("PID\tUSER\t%CPU\t%MEM\tRSS\tTIME\t\tCOMMAND")
+		for _, p := range processes {
+			fmt.Printf("%d\t%s\t%.1f\t%.1f\t%d\t%s\t\t%s\n", p.PID, p.User, p.CPUPercent, p.MemPercent,
+				p.MemoryRSS/1024, p.CPUTime.Round(time.Second), p.Command)
+		}
+
+	case "inspect":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun container inspect <id>")
+			os.Exit(1)
+		}
+
+		c, err := client.InspectContainer(ctx, resolveContainer(ctx, client, args[1]))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Inspect prints JSON unless YAML is asked for
+		if outputFormat == outputYAML {
+			printOutput(c)
+			return
+		}
+
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+
+	case "sbom":
+		fs := flag.NewFlagSet("container sbom", flag.ExitOnError)
+		format := fs.String("format", container.SBOMFormatSPDX, "Output format: spdx or cyclonedx")
+		output := fs.String("output", "", "Output file (defaults to stdout)")
+		upload := fs.Bool("upload", false, "Attach the SBOM to the latest deployment record in the cloud")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Println("Usage: fun container sbom [--format spdx|cyclonedx] [--output file] [--upload] <id>")
+			os.Exit(1)
+		}
+
+		id := resolveContainer(ctx, client, fs.Arg(0))
+		sbom, err := client.ContainerSBOM(ctx, id)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		data, err := sbom.Encode(*format)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *output == "" {
+			fmt.Println(string(data))
+		} else if err := os.WriteFile(*output, data, 0644); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *upload {
+			revision := 0
+			if history := client.GetDeploymentHistory(); history != nil {
+				if revisions := history.List(); len(revisions) > 0 {
+					revision = revisions[len(revisions)-1].Revision
+				}
+			}
+			hostname, _ := os.Hostname()
+			cloudClient, cloudTunnel, err := newCloudClient(cfg)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if cloudTunnel != nil {
+				go cloudTunnel.Run(ctx)
+			}
+			if hostID, err := hostid.Load(cfg.HostIDPath); err == nil {
+				cloudClient.SetHostID(hostID)
+			}
+			if err := cloudClient.AttachSBOM(ctx, hostname, revision, id, *format, data); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
 			}
+			fmt.Fprintf(os.Stderr, "SBOM attached to deployment revision %d\n", revision)
+		}
+
+	case "export":
+		fs := flag.NewFlagSet("container export", flag.ExitOnError)
+		output := fs.String("output", "", "Output file (defaults to stdout)")
+		fs.StringVar(output, "o", "", "Shorthand for --output")
+		fs.Parse(args[1:])
+		// Accept the options after the ID too, as in export <id> -o rootfs.tar
+		id := fs.Arg(0)
+		if fs.NArg() > 1 {
+			fs.Parse(fs.Args()[1:])
+			if fs.NArg() > 0 {
+				id = ""
+			}
+		}
+		if id == "" {
+			fmt.Println("Usage: fun container export <id> [-o file]")
+			os.Exit(1)
+		}
+		// Errors go to stderr, stdout may be the archive
+		id, err := client.ResolveContainer(ctx, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-			image := "unknown"
-			i, err := c.Image(ctx)
-			if err == nil {
-				image = i.Name()
+		if *output == "" {
+			if err := client.ExportContainer(ctx, id, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
 			}
+			return
+		}
 
-			fmt.Printf("%s\t%s\t%s\n", c.ID(), image, status)
+		// Write to a temporary file so a failed export doesn't leave a truncated tarball
+		tmpPath := *output + ".tmp"
+		file, err := os.Create(tmpPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		err = client.ExportContainer(ctx, id, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmpPath, *output)
 		}
+		if err != nil {
+			os.Remove(tmpPath)
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported the root filesystem of %s to %s\n", id, *output)
 
 	case "create":
-		if len(args) < 3 {
-			fmt.Println("Usage: fun container create <name> <image> [command]")
-			os.Exit(1)
+		fs := flag.NewFlagSet("container create", flag.ExitOnError)
+		var devices, capAdd, capDrop, groupAdd stringSliceFlag
+		var extraHosts, dns, dnsSearch, dnsOptions stringSliceFlag
+		fs.Var(&devices, "device", "Map a host device into the container (host[:container[:rwm]])")
+		var hotplugDevices stringSliceFlag
+		fs.Var(&hotplugDevices, "hotplug-device", "Attach USB or serial devices whenever they are plugged in (/dev path glob or USB ID such as 0403:6001)")
+		fs.Var(&capAdd, "cap-add", "Add a Linux capability, e.g. NET_BIND_SERVICE")
+		fs.Var(&capDrop, "cap-drop", "Drop a Linux capability")
+		fs.Var(&groupAdd, "group-add", "Add a supplementary group (name or GID)")
+		privileged := fs.Bool("privileged", false, "Run the container in privileged mode")
+		network := fs.String("network", "", "Attach the container to a network")
+		ip := fs.String("ip", "", "Static IP address on the network")
+		hostname := fs.String("hostname", "", "Container hostname")
+		timezone := fs.String("timezone", "", "Timezone: host, none or a zone such as Europe/Berlin")
+		locale := fs.String("locale", "", "Locale: host, none or a locale such as de_DE.UTF-8")
+		pull := fs.String("pull", "missing", "Pull policy: always, missing or never")
+		restart := fs.String("restart", "no", "Restart policy: no, always, on-failure or unless-stopped")
+		priority := fs.String("priority", "normal", "Priority class: low, normal, high or critical")
+		fs.Var(&extraHosts, "add-host", "Add a custom host-to-IP mapping (host:ip)")
+		fs.Var(&dns, "dns", "Set a custom DNS server")
+		fs.Var(&dnsSearch, "dns-search", "Set a custom DNS search domain")
+		fs.Var(&dnsOptions, "dns-option", "Set a DNS resolver option")
+		startupCmd := fs.String("startup-cmd", "", "Startup probe command, other probes wait until it succeeds")
+		readinessCmd := fs.String("readiness-cmd", "", "Readiness probe command")
+		livenessCmd := fs.String("health-cmd", "", "Liveness probe command, failures restart the container")
+		probeInterval := fs.Int("health-interval", 10, "Seconds between probe runs")
+		var readBps, writeBps, readIOps, writeIOps stringSliceFlag
+		cpus := fs.Float64("cpus", 0, "Number of CPUs, e.g. 1.5")
+		cpusetCPUs := fs.String("cpuset-cpus", "", "CPUs the container is pinned to, e.g. 0-3,8")
+		cpusetMems := fs.String("cpuset-mems", "", "NUMA nodes the container allocates memory on, e.g. 0")
+		numaNode := fs.Int("numa-node", -1, "Pin the container to the CPUs and memory of a NUMA node")
+		memory := fs.String("memory", "", "Memory limit, e.g. 512m")
+		memorySwap := fs.String("memory-swap", "", "Memory plus swap limit, -1 for unlimited swap")
+		blkioWeight := fs.Uint("blkio-weight", 0, "Relative block I/O weight (10-1000)")
+		fs.Var(&readBps, "device-read-bps", "Limit read rate from a device (path:rate, e.g. /dev/sda:10m)")
+		fs.Var(&writeBps, "device-write-bps", "Limit write rate to a device (path:rate)")
+		fs.Var(&readIOps, "device-read-iops", "Limit read operations per second from a device (path:rate)")
+		fs.Var(&writeIOps, "device-write-iops", "Limit write operations per second to a device (path:rate)")
+		egressRate := fs.String("egress-rate", "", "Limit outgoing network bandwidth, e.g. 10mbit")
+		project := fs.String("project", "", "Project the container's usage is reported under")
+		service := fs.String("service", "", "Service the container is a replica of, it is named <project>-<service>-<replica>")
+		replica := fs.Int("replica", 1, "Replica index of the container within its service")
+		var logOpts stringSliceFlag
+		fs.Var(&logOpts, "log-opt", "Log option: max-size, max-file, rate or mode (key=value, repeatable)")
+		fs.Parse(args[1:])
+
+		// Replicas of a service are named after it
+		positional := fs.Args()
+		if *service == "" {
+			if len(positional) < 2 {
+				fmt.Println("Usage: fun container create [options] <name> <image> [command]")
+				fmt.Println("       fun container create [options] --service <service> <image> [command]")
+				os.Exit(1)
+			}
+		} else {
+			if len(positional) < 1 {
+				fmt.Println("Usage: fun container create [options] --service <service> <image> [command]")
+				os.Exit(1)
+			}
+			positional = append([]string{container.ServiceName(*project, *service, *replica)}, positional...)
 		}
 
-		name := args[1]
-		image := args[2]
+		name := positional[0]
+		image := positional[1]
 		var command []string
-		if len(args) > 3 {
-			command = args[3:]
+		if len(positional) > 2 {
+			command = positional[2:]
+		}
+
+		pullPolicy, err := container.ParseImagePullPolicy(*pull)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		resources, err := parseResourceFlags(*cpus, *memory, *memorySwap, *blkioWeight, *egressRate, readBps, writeBps, readIOps, writeIOps)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *numaNode >= 0 {
+			if resources.CpusetCPUs, resources.CpusetMems, err = container.DetectTopology().Placement(*numaNode); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *cpusetCPUs != "" {
+			resources.CpusetCPUs = *cpusetCPUs
+		}
+		if *cpusetMems != "" {
+			resources.CpusetMems = *cpusetMems
+		}
+
+		var deviceMappings []container.DeviceMapping
+		for _, d := range devices {
+			mapping, err := container.ParseDeviceMapping(d)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			deviceMappings = append(deviceMappings, mapping)
+		}
+
+		logOptions, err := container.ParseLogOptionFlags(logOpts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var labels map[string]string
+		if *project != "" {
+			labels = map[string]string{container.LabelProject: *project}
 		}
 
 		fmt.Printf("Creating container '%s' from image '%s'...\n", name, image)
 
 		c, err := client.CreateContainer(ctx, container.CreateContainerOptions{
-			Name:    name,
-			Image:   image,
-			Command: command,
+			Name:           name,
+			Service:        *service,
+			Replica:        *replica,
+			Image:          image,
+			Command:        command,
+			Labels:         labels,
+			PrivilegedMode: *privileged,
+			Devices:        deviceMappings,
+			HotplugDevices: hotplugDevices,
+			CapAdd:         capAdd,
+			CapDrop:        capDrop,
+			GroupAdd:       groupAdd,
+			Network:        *network,
+			IPAddress:      *ip,
+			PullPolicy:     pullPolicy,
+			RestartPolicy:  *restart,
+			Priority:       *priority,
+			Hostname:       *hostname,
+			Timezone:       *timezone,
+			Locale:         *locale,
+			ExtraHosts:     extraHosts,
+			DNS:            dns,
+			DNSSearch:      dnsSearch,
+			DNSOptions:     dnsOptions,
+			Resources:      resources,
+			HealthCheck:    healthCheckFromFlags(*startupCmd, *readinessCmd, *livenessCmd, *probeInterval),
+			LogOptions:     logOptions,
 		})
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
 
-		fmt.Printf("Container created with ID: %s\n", c.ID)
+		if !dryRun {
+			fmt.Printf("Container created with ID: %s\n", c.ID)
+		}
 
 	case "start":
 		if len(args) != 2 {
@@ -221,7 +875,7 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		id := args[1]
+		id := resolveContainer(ctx, client, args[1])
 		fmt.Printf("Starting container %s...\n", id)
 
 		if err := client.StartContainer(ctx, id); err != nil {
@@ -229,7 +883,9 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		fmt.Println("Container started successfully")
+		if !dryRun {
+			fmt.Println("Container started successfully")
+		}
 
 	case "stop":
 		if len(args) != 2 {
@@ -237,7 +893,7 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		id := args[1]
+		id := resolveContainer(ctx, client, args[1])
 		fmt.Printf("Stopping container %s...\n", id)
 
 		if err := client.StopContainer(ctx, id, 10*time.Second); err != nil {
@@ -245,7 +901,9 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		fmt.Println("Container stopped successfully")
+		if !dryRun {
+			fmt.Println("Container stopped successfully")
+		}
 
 	case "remove":
 		if len(args) < 2 {
@@ -253,7 +911,7 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		id := args[1]
+		id := resolveContainer(ctx, client, args[1])
 		force := len(args) > 2 && args[2] == "--force"
 
 		fmt.Printf("Removing container %s...\n", id)
@@ -263,20 +921,63 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 			os.Exit(1)
 		}
 
-		fmt.Println("Container removed successfully")
+		if !dryRun {
+			fmt.Println("Container removed successfully")
+		}
 
 	case "images":
-		fmt.Println("Listing images...")
-		images, err := client.ListImages(ctx)
+		fs := flag.NewFlagSet("container images", flag.ExitOnError)
+		name := fs.String("name", "", "Only list images whose name matches a glob pattern, e.g. docker.io/library/*")
+		var labels stringSliceFlag
+		fs.Var(&labels, "label", "Only list images with a label, key or key=value (repeatable)")
+		limit := fs.Int("limit", 0, "List at most this many images")
+		after := fs.String("after", "", "Continue a listing after this image name")
+		fs.Parse(args[1:])
+
+		labelFilters, err := container.ParseImageLabelFilters(labels)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
+		opts := container.ImageListOptions{Name: *name, Labels: labelFilters, After: *after, Limit: *limit}
+		if structuredOutput() {
+			page, err := client.ListImagePage(ctx, opts)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			printOutput(page)
+			return
+		}
 
+		// Images are printed as they are listed, sizes are read one image at a time
 		fmt.Println("REPOSITORY\t\tTAG\t\tDIGEST\t\tSIZE")
-		for _, img := range images {
-			size, _ := img.Size(ctx)
-			fmt.Printf("%s\t%s\t%s\t%.2f MB\n", img.Name(), "latest", img.Target().Digest.String()[:12], float64(size)/(1024*1024))
+		printImage := func(img container.ImageSummary) {
+			repository, tag := splitImageName(img.Name)
+			fmt.Printf("%s\t%s\t%s\t%.2f MB\n", repository, tag, strings.TrimPrefix(img.Digest, "sha256:")[:12], float64(img.Size)/(1024*1024))
+		}
+		if *limit == 0 {
+			err = client.WalkImages(ctx, opts, func(img container.ImageSummary) error {
+				printImage(img)
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		page, err := client.ListImagePage(ctx, opts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, img := range page.Images {
+			printImage(img)
+		}
+		if page.Next != "" {
+			fmt.Printf("\nMore images follow, continue with --after %s\n", page.Next)
 		}
 
 	default:
@@ -285,134 +986,3048 @@ func handleContainerCommands(cfg *config.Config, args []string) {
 	}
 }
 
-// showHelp displays usage information
-func showHelp() {
-	fmt.Println("Usage: fun [options] <command>")
-	fmt.Println("\nOptions:")
-	flag.PrintDefaults()
+// handleImageCommands handles image maintenance commands
+func handleImageCommands(cfg *config.Config, args []string) {
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "analyze":
+		analysis, err := client.AnalyzeImages(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(analysis)
+			return
+		}
+
+		fmt.Println("IMAGE\t\t\tLAYERS\tTOTAL\t\tSHARED\t\tUNIQUE")
+		for _, img := range analysis.Images {
+			fmt.Printf("%s\t%d\t%.2f MB\t%.2f MB\t%.2f MB\n", img.Name, img.Layers,
+				float64(img.TotalSize)/(1024*1024), float64(img.SharedSize)/(1024*1024), float64(img.UniqueSize)/(1024*1024))
+		}
+		fmt.Printf("\nLogical size: %.2f MB, stored size: %.2f MB, saved by sharing: %.2f MB\n",
+			float64(analysis.LogicalSize)/(1024*1024), float64(analysis.PhysicalSize)/(1024*1024),
+			float64(analysis.LogicalSize-analysis.PhysicalSize)/(1024*1024))
+
+	case "gc":
+		prune := len(args) > 1 && args[1] == "--prune"
+
+		fmt.Println("Collecting unreferenced content...")
+		result, err := client.GarbageCollect(ctx, prune)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if dryRun {
+			return
+		}
+		for _, name := range result.PrunedImages {
+			fmt.Printf("Pruned image %s\n", name)
+		}
+		fmt.Printf("Reclaimed %.2f MB in %s\n", float64(result.ReclaimedBytes)/(1024*1024), result.Duration.Round(time.Millisecond))
+
+	case "history":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun image history <ref>")
+			os.Exit(1)
+		}
+
+		details, err := client.InspectImage(ctx, args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(details.History)
+			return
+		}
+
+		// Newest step first, like docker history
+		fmt.Println("CREATED\t\t\tLAYER\t\tSIZE\t\tCREATED BY")
+		for i := len(details.History) - 1; i >= 0; i-- {
+			step := details.History[i]
+			created, layer := "-", "-"
+			if step.Created != nil {
+				created = step.Created.Format(time.RFC3339)
+			}
+			if step.Layer != "" {
+				layer = strings.TrimPrefix(step.Layer, "sha256:")[:12]
+			}
+			fmt.Printf("%s\t%s\t%.2f MB\t%s\n", created, layer, float64(step.Size)/(1024*1024), step.CreatedBy)
+		}
+
+	case "inspect":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun image inspect <ref>")
+			os.Exit(1)
+		}
+
+		details, err := client.InspectImage(ctx, args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Inspect prints JSON unless YAML is asked for
+		if outputFormat == outputYAML {
+			printOutput(details)
+			return
+		}
+
+		data, err := json.MarshalIndent(details, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+
+	default:
+		fmt.Printf("Unknown image command: %s\n", args[0])
+		showImageHelp()
+	}
+}
+
+// showImageHelp displays image command usage
+func showImageHelp() {
+	fmt.Println("Usage: fun image <command>")
 	fmt.Println("\nCommands:")
-	fmt.Println("  start        Start the Fun Server service")
-	fmt.Println("  stop         Stop the Fun Server service")
-	fmt.Println("  status       Check the status of Fun Server")
-	fmt.Println("  container    Manage containers")
-	fmt.Println("\nNote: Service installation and removal is handled by platform-specific installers.")
+	fmt.Println("  analyze        Show shared and unique layer sizes across images")
+	fmt.Println("  gc [--prune]   Remove unreferenced content, optionally pruning unused images")
+	fmt.Println("  history <ref>  Show the build steps and layer sizes of a local image")
+	fmt.Println("  inspect <ref>  Show the layers, ports, env and entrypoint of a local image")
+}
+
+// handleNetworkCommands handles network-related commands
+func handleNetworkCommands(cfg *config.Config, args []string) {
+	store, err := newIPAMStore(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("network create", flag.ExitOnError)
+		subnet := fs.String("subnet", "", "Subnet in CIDR notation, e.g. 10.89.0.0/24")
+		gateway := fs.String("gateway", "", "Gateway address (defaults to the first address)")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 1 || *subnet == "" {
+			fmt.Println("Usage: fun network create --subnet <cidr> [--gateway <ip>] <name>")
+			os.Exit(1)
+		}
+
+		if dryRun {
+			fmt.Printf("[dry-run] create network %s (subnet %s, gateway %s)\n", fs.Arg(0), *subnet, *gateway)
+			return
+		}
+		network, err := store.CreateNetwork(fs.Arg(0), *subnet, *gateway)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Network %s created (subnet %s, gateway %s)\n", network.Name, network.Subnet, network.Gateway)
+
+	case "list":
+		if structuredOutput() {
+			printOutput(store.ListNetworks())
+			return
+		}
+		fmt.Println("NAME\t\tSUBNET\t\t\tGATEWAY\t\tCONTAINERS")
+		for _, network := range store.ListNetworks() {
+			fmt.Printf("%s\t\t%s\t\t%s\t%d\n", network.Name, network.Subnet, network.Gateway, len(network.Allocations))
+		}
+
+	case "remove":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun network remove <name>")
+			os.Exit(1)
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] remove network %s\n", args[1])
+			return
+		}
+		if err := store.RemoveNetwork(args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Network removed successfully")
+
+	default:
+		fmt.Printf("Unknown network command: %s\n", args[0])
+		showNetworkHelp()
+	}
+}
+
+// showNetworkHelp displays network command usage
+func showNetworkHelp() {
+	fmt.Println("Usage: fun network <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  create --subnet <cidr> [--gateway <ip>] <name>  Create a network")
+	fmt.Println("  list                                            List networks")
+	fmt.Println("  remove <name>                                   Remove a network")
+}
+
+// handleNamespaceCommands finds containers outside the configured namespace and moves them into it
+func handleNamespaceCommands(cfg *config.Config, args []string) {
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "ls", "list":
+		summaries, err := client.ListNamespaces(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(summaries)
+			return
+		}
+		fmt.Println("NAMESPACE\t\tCONTAINERS\tIMAGES")
+		for _, summary := range summaries {
+			name := summary.Name
+			if summary.Current {
+				name += " *"
+			}
+			fmt.Printf("%-16s\t%d\t\t%d\n", name, len(summary.Containers), summary.Images)
+		}
+		for _, summary := range summaries {
+			if !summary.Current && len(summary.Containers) > 0 {
+				fmt.Printf("\n%d containers in namespace %s are not managed by Fun Server, move them with:\n", len(summary.Containers), summary.Name)
+				fmt.Printf("  fun namespace migrate --from %s\n", summary.Name)
+			}
+		}
+
+	case "migrate":
+		fs := flag.NewFlagSet("namespace migrate", flag.ExitOnError)
+		from := fs.String("from", "", "Namespace to move containers out of")
+		to := fs.String("to", cfg.ContainerdNamespace, "Namespace to move containers into")
+		keep := fs.Bool("keep", false, "Keep the containers in the source namespace")
+		fs.Parse(args[1:])
+
+		if *from == "" {
+			fmt.Println("Usage: fun namespace migrate --from <namespace> [--to <namespace>] [--keep] [container...]")
+			os.Exit(1)
+		}
+
+		result, err := client.WithNamespace(*to).MigrateNamespace(ctx, *from, fs.Args(), *keep)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if dryRun {
+			return
+		}
+		for _, id := range result.Moved {
+			fmt.Printf("Moved container %s to namespace %s\n", id, *to)
+		}
+		for _, failure := range result.Failures {
+			fmt.Printf("Failed: %s\n", failure)
+		}
+		fmt.Printf("Moved %d containers (%d failures)\n", len(result.Moved), len(result.Failures))
+		if len(result.Failures) > 0 {
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Printf("Unknown namespace command: %s\n", args[0])
+		showNamespaceHelp()
+		os.Exit(1)
+	}
+}
+
+// showNamespaceHelp displays namespace command usage
+func showNamespaceHelp() {
+	fmt.Println("Usage: fun namespace <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  ls                              List namespaces, * marks the configured one")
+	fmt.Println("  migrate --from <namespace> [--to <namespace>] [--keep] [container...]")
+	fmt.Println("                                  Move stopped containers with their images and changes")
+}
+
+// handleCRICommand prints the CRI endpoint and how to point a kubelet at it
+// enable_cri configures the embedded containerd, a system containerd serves CRI
+// as its own configuration says, so the plugin is checked on the socket itself.
+func handleCRICommand(cfg *config.Config) {
+	if cfg.EmbeddedContainerd && !cfg.EnableCRI {
+		fmt.Println("CRI is disabled. Set \"enable_cri\": true in the configuration and restart Fun Server.")
+		os.Exit(1)
+	}
+
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	caps := client.Capabilities()
+	criErr := client.RequireCRI()
+	client.Close()
+	if criErr != nil {
+		if cfg.EmbeddedContainerd {
+			fmt.Printf("The CRI plugin is not loaded in containerd %s, check %s.\n", caps.Version, embeddedContainerdLogFile(cfg))
+		} else {
+			fmt.Printf("The CRI plugin is not loaded in the containerd %s at %s. Enable it in its configuration, or set \"embedded_containerd\" and \"enable_cri\" to have Fun Server run one with CRI.\n", caps.Version, cfg.ContainerdSocket)
+		}
+		os.Exit(1)
+	}
+	if !caps.Sandbox {
+		fmt.Printf("Note: containerd %s has no sandbox API, pods run with the legacy CRI sandbox implementation.\n", caps.Version)
+	}
+
+	endpoint := container.GetCRIEndpoint(cfg.ContainerdSocket)
+	fmt.Printf("CRI endpoint: %s\n", endpoint)
+	fmt.Println("\nTo use it with Kubernetes:")
+	fmt.Printf("  k3s:     k3s server --container-runtime-endpoint %s\n", endpoint)
+	fmt.Printf("  kubelet: kubelet --container-runtime-endpoint=%s\n", endpoint)
+	if runtime.GOOS == "darwin" || container.IsRunningOnWindows() {
+		fmt.Println("\nNote: on macOS and Windows the endpoint is served inside the Linux VM/WSL2 distribution,")
+		fmt.Println("so the kubelet must run inside it and use unix:///run/containerd/containerd.sock.")
+	}
+}
+
+// handleCtrCommand runs ctr against the managed containerd, passing through its
+// input, output and exit code
+func handleCtrCommand(cfg *config.Config, args []string) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Println("Usage: fun ctr -- <ctr arguments>")
+		os.Exit(1)
+	}
+
+	cmd, err := container.CtrCommand(context.Background(), cfg.ContainerdSocket, cfg.ContainerdNamespace, args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// handleMigrateCommands handles migration from other container runtimes
+func handleMigrateCommands(cfg *config.Config, args []string) {
+	if args[0] != "docker" {
+		fmt.Printf("Unknown migrate source: %s\n", args[0])
+		showMigrateHelp()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("migrate docker", flag.ExitOnError)
+	dockerHost := fs.String("docker-host", "", "Docker daemon address (defaults to DOCKER_HOST)")
+	includeContainers := fs.Bool("containers", false, "Also recreate Docker containers")
+	runningOnly := fs.Bool("running", false, "Only migrate running containers")
+	fs.Parse(args[1:])
+
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	fmt.Println("Migrating from Docker...")
+	result, err := client.MigrateFromDocker(context.Background(), container.MigrateDockerOptions{
+		DockerHost:        *dockerHost,
+		IncludeContainers: *includeContainers,
+		RunningOnly:       *runningOnly,
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, name := range result.Images {
+		fmt.Printf("Imported image %s\n", name)
+	}
+	for _, name := range result.Containers {
+		fmt.Printf("Created container %s\n", name)
+	}
+	for _, failure := range result.Failures {
+		fmt.Printf("Failed: %s\n", failure)
+	}
+
+	fmt.Printf("Migrated %d images and %d containers (%d failures)\n", len(result.Images), len(result.Containers), len(result.Failures))
+	if len(result.Failures) > 0 {
+		os.Exit(1)
+	}
+}
+
+// showMigrateHelp displays migrate command usage
+func showMigrateHelp() {
+	fmt.Println("Usage: fun migrate docker [options]")
+	fmt.Println("\nOptions:")
+	fmt.Println("  --docker-host <addr>   Docker daemon address (defaults to DOCKER_HOST)")
+	fmt.Println("  --containers           Also recreate Docker containers")
+	fmt.Println("  --running              Only migrate running containers")
+}
+
+// newTLSConfig returns the TLS restrictions configured for outgoing connections
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	return tlsconfig.New(tlsconfig.Options{
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCipherSuites,
+		FIPS:         cfg.FIPSMode,
+	})
+}
+
+// newCloudClient creates a cloud client using the configured TLS restrictions and
+// jump host. The returned tunnel is nil without a cloud proxy and must be run for
+// ssh proxies to connect.
+func newCloudClient(cfg *config.Config) (*cloud.Client, *tunnel.Tunnel, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := cloud.New(cfg.CloudURL, cfg.APIKey)
+	client.SetFallbackURLs(cfg.CloudFallbackURLs)
+	if err := client.SetEndpointState(cfg.CloudEndpointStatePath); err != nil {
+		log.Printf("Warning: %v, starting on %s", err, cfg.CloudURL)
+	}
+	if err := client.SetCompression(cfg.CloudCompression); err != nil {
+		return nil, nil, err
+	}
+	if err := client.SetDesiredStateCache(cfg.DesiredStateCachePath); err != nil {
+		log.Printf("Warning: %v, fetching the desired state again", err)
+	}
+	if cloudSimulator != nil {
+		client.SetHandler(cloudSimulator.Handler())
+		return client, nil, nil
+	}
+	if tlsConfig != nil {
+		client.SetTLSConfig(tlsConfig)
+	}
+
+	if cfg.CloudProxy == "" {
+		return client, nil, nil
+	}
+	cloudTunnel, err := tunnel.New(tunnel.Config{
+		Proxy:     cfg.CloudProxy,
+		Identity:  cfg.CloudProxyIdentity,
+		KeepAlive: time.Duration(cfg.CloudProxyKeepAlive) * time.Second,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	client.SetDialContext(cloudTunnel.DialContext)
+	return client, cloudTunnel, nil
+}
+
+// newContainerClient creates a containerd client configured from the application config
+func newContainerClient(cfg *config.Config) (*container.Client, error) {
+	client, err := container.NewClient(cfg.ContainerdSocket, cfg.ContainerdNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	client.SetStateDir(filepath.Join(cfg.ContainerRoot, "state"))
+
+	idScheme, err := container.ParseIDScheme(cfg.ContainerIDScheme)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetIDScheme(idScheme)
+
+	// The daemon logs the actions it would take, CLI commands print them
+	if dryRun && daemonMode {
+		client.SetDryRun(log.Writer())
+	} else if dryRun {
+		client.SetDryRun(os.Stdout)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetTLSConfig(tlsConfig)
+	download.Shared().SetTLSConfig(tlsConfig)
+
+	cgroupDriver, err := container.ResolveCgroupDriver(cfg.CgroupDriver)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetCgroupDriver(cgroupDriver)
+
+	if err := container.ValidateTimezone(cfg.ContainerTimezone); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := container.ValidateLocale(cfg.ContainerLocale); err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetTimezoneDefaults(cfg.ContainerTimezone, cfg.ContainerLocale)
+	client.SetSecretsDir(cfg.SecretsDir)
+	client.SetLogDefaults(container.LogLimits{
+		MaxSize:  int64(cfg.ContainerLogMaxMB) << 20,
+		MaxFiles: cfg.ContainerLogMaxFiles,
+		Rate:     int64(cfg.ContainerLogRateKB) << 10,
+		Mode:     cfg.ContainerLogRateMode,
+	})
+
+	if err := container.ValidateImageGCKeep(cfg.ImageGCKeep); err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetImageGCPolicy(container.ImageGCPolicy{
+		Keep:   cfg.ImageGCKeep,
+		MinAge: time.Duration(cfg.ImageGCMinAge) * time.Second,
+	})
+
+	client.SetHostReservation(container.HostResources{
+		CPUs:        cfg.ReservedCPUs,
+		MemoryBytes: int64(cfg.ReservedMemoryMB) << 20,
+	})
+	client.SetAdmissionPolicy(container.AdmissionPolicy{
+		MinFreeDiskBytes: int64(cfg.AdmissionMinFreeDiskMB) << 20,
+		QueueTimeout:     time.Duration(cfg.AdmissionQueueTimeout) * time.Second,
+	})
+
+	ipam, err := newIPAMStore(cfg)
+	if err != nil {
+		log.Printf("Warning: Failed to load IPAM store: %v", err)
+	} else {
+		client.SetIPAMStore(ipam)
+	}
+
+	history, err := container.NewDeploymentHistory(filepath.Join(cfg.ContainerRoot, "deployments.json"))
+	if err != nil {
+		log.Printf("Warning: Failed to load deployment history: %v", err)
+	} else {
+		client.SetDeploymentHistory(history)
+	}
+
+	pullOptions := container.DefaultPullOptions()
+	pullOptions.MaxConcurrentDownloads = cfg.MaxConcurrentDownloads
+	pullOptions.Retries = cfg.PullRetries
+	client.SetPullOptions(pullOptions)
+	client.SetMaxHeavyOperations(cfg.MaxHeavyOperations)
+
+	auditLogger, err := audit.NewLogger(cfg.AuditLogPath)
+	if err != nil {
+		log.Printf("Warning: Failed to open audit log: %v", err)
+	} else {
+		client.SetAuditLogger(auditLogger)
+	}
+
+	// A broken policy file must not silently disable enforcement
+	trustPolicy, err := container.LoadTrustPolicy(cfg.TrustPolicyPath)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetTrustPolicy(trustPolicy)
+
+	// Without signing keys manifests from the cloud and Git are applied unsigned
+	if len(cfg.ManifestSigningKeys) > 0 {
+		verifier, err := container.LoadManifestVerifier(cfg.ManifestSigningKeys)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		client.SetManifestVerifier(verifier, cfg.CommandNoncePath, cfg.DesiredStateIssuedPath)
+	}
+
+	// Reuse existing Docker credentials for registry authentication
+	credentials, err := container.NewCredentialStore(cfg.DockerConfigPath, cfg.CredentialHelper)
+	if err != nil {
+		log.Printf("Warning: Failed to load registry credentials: %v", err)
+	} else {
+		client.SetCredentialStore(credentials)
+	}
+
+	return client, nil
+}
+
+// stringSliceFlag is a flag.Value that collects repeated string flags
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// newIPAMStore opens the IPAM store holding network definitions and address assignments
+func newIPAMStore(cfg *config.Config) (*container.IPAMStore, error) {
+	return container.NewIPAMStore(filepath.Join(cfg.ContainerRoot, "ipam.json"))
+}
+
+// showHelp displays usage information
+func showHelp() {
+	fmt.Println("Usage: fun [options] <command>")
+	fmt.Println("\nOptions:")
+	flag.PrintDefaults()
+	fmt.Println("\nCommands:")
+	fmt.Println("  start        Start the Fun Server service")
+	fmt.Println("  stop         Stop the Fun Server service")
+	fmt.Println("  status       Check the status of Fun Server")
+	fmt.Println("  service install [--print]  Install the systemd unit, ordered after the startup gates")
+	fmt.Println("    --socket-activated       Let systemd hold the local API sockets while the daemon starts or restarts")
+	fmt.Println("  container    Manage containers")
+	fmt.Println("  image        Inspect, analyze and clean up images")
+	fmt.Println("  network      Manage container networks")
+	fmt.Println("  namespace    List containerd namespaces and move containers between them")
+	fmt.Println("  migrate      Import containers and images from other runtimes")
+	fmt.Println("  vm           Manage the disk of the macOS VM and the WSL2 distribution")
+	fmt.Println("  system       Show the disk space used by images, containers and the VM")
+	fmt.Println("  cri          Show the CRI endpoint for Kubernetes kubelets")
+	fmt.Println("  doctor       Check socket permissions and host setup")
+	fmt.Println("  ctr          Run ctr against the managed containerd, as fun ctr -- <args>")
+	fmt.Println("  nerdctl      nerdctl and docker compatible commands such as run, ps and images")
+	fmt.Println("  inventory    Show the kernel, security updates and runtime versions reported to the cloud")
+	fmt.Println("  plan         Show the changes a desired-state document would make")
+	fmt.Println("  apply        Apply a desired-state document and record it as a revision")
+	fmt.Println("  apply-all    Apply the desired state of every project in a directory")
+	fmt.Println("  history      List the applied desired-state revisions")
+	fmt.Println("  rollback     Restore an earlier revision of the global state or a --project, the previous one by default")
+	fmt.Println("  fleet        List the peer hosts of this host's group, as fleet ls")
+	fmt.Println("  tasks        List the maintenance tasks (tasks ls) or run one now (tasks run <task>)")
+	fmt.Println("  events       Query the daemon's event journal, e.g. events --since 24h --type deploy")
+	fmt.Println("  artifacts    List or prune the cache of downloaded kernels, rootfs tarballs and binaries")
+	fmt.Println("  debug        Change the daemon's log level and collect profiles")
+	fmt.Println("  dev          Tools for developing the agent, such as a simulated cloud")
+	fmt.Println("\nNote: On macOS and Windows service installation and removal is handled by the installers.")
+}
+
+// resolveContainer returns the ID of the container a command line reference
+// names, a friendly name, project/service or unique ID prefix, exiting if it
+// matches none or several
+func resolveContainer(ctx context.Context, client *container.Client, ref string) string {
+	id, err := client.ResolveContainer(ctx, ref)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return id
+}
+
+// showContainerHelp displays container command usage
+func showContainerHelp() {
+	fmt.Println("Usage: fun container <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  list                   List all containers")
+	fmt.Println("  create [options] <n> <image>  Create a new container")
+	fmt.Println("      --device <host[:container[:rwm]]>  Map a host device")
+	fmt.Println("      --cap-add <cap>, --cap-drop <cap>  Add or drop a capability")
+	fmt.Println("      --group-add <group>                Add a supplementary group")
+	fmt.Println("      --privileged                       Run in privileged mode")
+	fmt.Println("      --network <name> [--ip <addr>]     Attach to a network with an optional static IP")
+	fmt.Println("      --pull <always|missing|never>      Image pull policy (default missing)")
+	fmt.Println("      --restart <policy>                 Restart policy: no, always, on-failure, unless-stopped")
+	fmt.Println("      --priority <class>                 low, normal, high or critical; lower ones are preempted first")
+	fmt.Println("      --hostname <name>                  Set the container hostname")
+	fmt.Println("      --timezone, --locale <host|none|value>  Timezone and locale, default from the config")
+	fmt.Println("      --add-host <host:ip>               Add an /etc/hosts entry")
+	fmt.Println("      --dns, --dns-search, --dns-option  Configure /etc/resolv.conf")
+	fmt.Println("      --startup-cmd <cmd>                Startup probe, gates the other probes")
+	fmt.Println("      --readiness-cmd <cmd>              Readiness probe, gates traffic and dependents")
+	fmt.Println("      --health-cmd <cmd>                 Liveness probe, restarts the container on failure")
+	fmt.Println("      --health-interval <seconds>        Seconds between probe runs (default 10)")
+	fmt.Println("      --cpus <n>, --memory <size>        Limit CPUs and memory")
+	fmt.Println("      --memory-swap <size|-1>            Limit memory plus swap")
+	fmt.Println("      --cpuset-cpus, --cpuset-mems <list>  Pin to CPUs and NUMA memory nodes, e.g. 0-3")
+	fmt.Println("      --numa-node <n>                    Pin to the CPUs and memory of a NUMA node")
+	fmt.Println("      --blkio-weight <10-1000>           Relative block I/O weight")
+	fmt.Println("      --device-{read,write}-{bps,iops} <path:rate>  Throttle block device I/O")
+	fmt.Println("      --egress-rate <rate>               Limit outgoing bandwidth, e.g. 10mbit (requires --network)")
+	fmt.Println("      --project <name>                   Project the container's usage is reported under")
+	fmt.Println("      --service <name>, --replica <n>    Create replica n of a service, named <project>-<service>-<n>")
+	fmt.Println("      --log-opt <key=value>              max-size, max-file, rate (bytes/s) or mode (block or drop)")
+	fmt.Println("  exec [-i] [-t] <id> <command> [args...]")
+	fmt.Println("                         Run a command in a running container, -it for an interactive shell")
+	fmt.Println("      -e, --env <KEY=VALUE>, -w, --workdir <dir>")
+	fmt.Println("  stats <id>             Show resource usage on cgroup v1 or v2 hosts")
+	fmt.Println("  top <id>               Show the processes running in the container")
+	fmt.Println("  diff <id>              List files added (A), changed (C) or deleted (D) since the image")
+	fmt.Println("  debug-bundle [-o dir] [--cores] <id>")
+	fmt.Println("                         Capture details, logs, filesystem changes and core dumps for debugging")
+	fmt.Println("  inspect <id>           Show container details, including the last exit code and OOM kills")
+	fmt.Println("  sbom [options] <id>    Export an SPDX or CycloneDX SBOM of the image and mounts")
+	fmt.Println("      --format <spdx|cyclonedx>, --output <file>, --upload")
+	fmt.Println("  export <id> [-o file]  Export the container's root filesystem as a tarball")
+	fmt.Println("  start <id>             Start a container")
+	fmt.Println("  stop <id>              Stop a container")
+	fmt.Println("  remove <id> [--force]  Remove a container")
+	fmt.Println("  images [options]       List images by name")
+	fmt.Println("      --name <pattern>, --label <key[=value]>, --limit <n>, --after <name>")
+	fmt.Println("\n<id> is a container ID, a unique ID prefix, a name or project/service.")
+}
+
+// handleDebugCommands processes debug subcommands, which talk to the running daemon
+func handleDebugCommands(cfg *config.Config, args []string) {
+	client := admin.NewClient(cfg.AdminSocket)
+	ctx := context.Background()
+
+	switch args[0] {
+	case "log-level":
+		level, err := client.GetLogLevel(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Log level: %s\n", level)
+
+	case "set-log-level":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun debug set-log-level <debug|info|warn|error>")
+			os.Exit(1)
+		}
+		if err := client.SetLogLevel(ctx, args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Log level set to %s\n", args[1])
+
+	case "on", "off":
+		level := "debug"
+		if args[0] == "off" {
+			level = cfg.LogLevel
+		}
+		if err := client.SetLogLevel(ctx, level); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Debug mode %s\n", args[0])
+
+	case "dump":
+		dump, err := client.DebugDump(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(dump)
+
+	case "pprof":
+		fs := flag.NewFlagSet("debug pprof", flag.ExitOnError)
+		seconds := fs.Int("seconds", 30, "Duration of CPU profiles and traces")
+		output := fs.String("output", "", "Output file (defaults to <profile>.pprof)")
+		fs.Parse(args[1:])
+
+		profile := "profile"
+		if fs.NArg() > 0 {
+			profile = fs.Arg(0)
+		}
+		path := *output
+		if path == "" {
+			path = profile + ".pprof"
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		if profile == "profile" || profile == "trace" {
+			fmt.Printf("Collecting %s for %d seconds...\n", profile, *seconds)
+		}
+		if err := client.Profile(ctx, profile, *seconds, file); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Profile written to %s, inspect it with: go tool pprof %s\n", path, path)
+
+	default:
+		fmt.Printf("Unknown debug subcommand: %s\n", args[0])
+		showDebugHelp()
+		os.Exit(1)
+	}
+}
+
+// handleInventoryCommand prints the host inventory as it would be reported to the cloud
+func handleInventoryCommand(cfg *config.Config) {
+	ctx := context.Background()
+
+	var runtimeClient inventory.RuntimeVersioner
+	if client, err := newContainerClient(cfg); err == nil {
+		defer client.Close()
+		runtimeClient = client
+	}
+
+	devices, err := container.ScanHostDevices()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to scan host devices: %v\n", err)
+	}
+
+	// The inventory is JSON unless YAML is asked for
+	if outputFormat == outputYAML {
+		printOutput(cloudInventory(inventory.Collect(ctx, runtimeClient), devices))
+		return
+	}
+	data, err := json.MarshalIndent(cloudInventory(inventory.Collect(ctx, runtimeClient), devices), "", "  ")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
+
+// handlePlanCommand prints the diff between the host and a desired-state document
+func handlePlanCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: fun plan <desired-state.json>")
+		os.Exit(1)
+	}
+
+	desired, err := container.ReadDesiredState(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	diff, err := admin.NewClient(cfg.AdminSocket).DiffDesiredState(context.Background(), desired)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if structuredOutput() {
+		printOutput(diff)
+		return
+	}
+
+	if !diff.HasChanges() {
+		fmt.Println("No changes, the host matches the desired state")
+		return
+	}
+	for _, change := range diff.Changes {
+		switch change.Action {
+		case container.DiffCreate:
+			fmt.Printf("+ %s (%s)\n", change.Name, change.Image)
+		case container.DiffDelete:
+			fmt.Printf("- %s\n", change.Name)
+		case container.DiffUpdate:
+			fmt.Printf("~ %s\n", change.Name)
+			for _, field := range change.Changes {
+				fmt.Printf("    %s: %q -> %q\n", field.Field, field.Current, field.Desired)
+			}
+		}
+	}
+	fmt.Printf("\nPlan: %d to change, %d unchanged\n", len(diff.Changes), len(diff.Unchanged))
+}
+
+// handleApplyCommand applies a desired-state document through the daemon
+func handleApplyCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	message := fs.String("message", "", "Note stored with the revision")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: fun apply [--message text] <desired-state.json>")
+		os.Exit(1)
+	}
+
+	desired, err := container.ReadDesiredState(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if dryRun {
+		// Dry runs only read from containerd, so they don't need the daemon
+		client := dryRunClient(cfg)
+		defer client.Close()
+		if _, err := client.ApplyDesiredState(context.Background(), desired, localUser(), *message); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	revision, err := admin.NewClient(cfg.AdminSocket).ApplyDesiredState(context.Background(), desired, localUser(), *message)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Applied revision %d (%d changes)\n", revision.Revision, len(revision.Changes))
+}
+
+// handleApplyAllCommand applies the desired state of every project below a
+// directory, each scoped to a project named after its directory
+func handleApplyAllCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("apply-all", flag.ExitOnError)
+	dir := fs.String("dir", "/etc/fun/apps", "Directory with a subdirectory per project")
+	message := fs.String("message", "", "Note stored with the revisions")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Println("Usage: fun apply-all [--dir /etc/fun/apps] [--message text]")
+		os.Exit(1)
+	}
+
+	projects, err := container.LoadProjectStates(*dir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(projects) == 0 {
+		fmt.Printf("No projects found, expected %s\n", filepath.Join(*dir, "<project>", container.ProjectStateFile))
+		os.Exit(1)
+	}
+
+	apply := admin.NewClient(cfg.AdminSocket).ApplyDesiredState
+	if dryRun {
+		// Dry runs only read from containerd, so they don't need the daemon
+		client := dryRunClient(cfg)
+		defer client.Close()
+		apply = client.ApplyDesiredState
+	}
+
+	// Projects are applied one by one, a failed project doesn't stop the others
+	failed := 0
+	fmt.Println("PROJECT\t\tRESULT")
+	for _, p := range projects {
+		project, err := p.Project, p.Err
+		var revision *container.DeploymentRevision
+		if err == nil {
+			revision, err = apply(context.Background(), p.State, localUser(), *message)
+		}
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%s\t\tfailed: %v\n", project, err)
+		case dryRun:
+			fmt.Printf("%s\t\t%d changes planned\n", project, len(revision.Changes))
+		default:
+			fmt.Printf("%s\t\trevision %d (%d changes)\n", project, revision.Revision, len(revision.Changes))
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d of %d projects failed\n", failed, len(projects))
+		os.Exit(1)
+	}
+}
+
+// handleHistoryCommand lists the applied desired-state revisions
+func handleHistoryCommand(cfg *config.Config) {
+	revisions, err := admin.NewClient(cfg.AdminSocket).DeploymentHistory(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if structuredOutput() {
+		printOutput(revisions)
+		return
+	}
+
+	fmt.Println("REVISION\tAPPLIED\t\t\tBY\t\tPROJECT\tCHANGES\tMESSAGE")
+	for _, r := range revisions {
+		project := r.State.Project
+		if project == "" {
+			project = "-"
+		}
+		fmt.Printf("%d\t\t%s\t%s\t\t%s\t%d\t%s\n", r.Revision, r.AppliedAt.Format(time.RFC3339), r.AppliedBy, project, len(r.Changes), r.Message)
+	}
+}
+
+// handleFleetCommand lists the peers the orchestrator grouped the host with
+func handleFleetCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 || (args[0] != "ls" && args[0] != "list") {
+		fmt.Println("Usage: fun fleet ls")
+		os.Exit(1)
+	}
+
+	group, err := admin.NewClient(cfg.AdminSocket).Fleet(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if structuredOutput() {
+		printOutput(group)
+		return
+	}
+
+	fmt.Printf("Group %s", group.Name)
+	if group.Project != "" {
+		fmt.Printf(" (project %s)", group.Project)
+	}
+	fmt.Printf(", updated %s\n\n", group.UpdatedAt.Format(time.RFC3339))
+	fmt.Println("HOSTNAME\t\tSTATUS\t\tLAST SEEN\t\t\tADDRESSES")
+	for _, peer := range group.Peers {
+		status := peer.Status
+		if status == "" {
+			status = "unknown"
+		}
+		lastSeen := "never"
+		if !peer.LastSeen.IsZero() {
+			lastSeen = peer.LastSeen.Format(time.RFC3339)
+		}
+		fmt.Printf("%-16s\t%-8s\t%-25s\t%s\n", peer.Hostname, status, lastSeen, strings.Join(peer.Addresses, ","))
+	}
+}
+
+// pruneArtifactCache applies the configured limits to the artifact cache
+func pruneArtifactCache(cfg *config.Config) (artifacts.PruneResult, error) {
+	cache, err := artifacts.Open(container.ArtifactCacheDir)
+	if err != nil {
+		return artifacts.PruneResult{}, err
+	}
+	return cache.Prune(artifacts.PrunePolicy{
+		MaxAge:   time.Duration(cfg.ArtifactCacheMaxDays) * 24 * time.Hour,
+		MaxBytes: int64(cfg.ArtifactCacheMaxMB) << 20,
+	})
+}
+
+// pruneDebugBundles applies the configured limits to the debug bundles
+func pruneDebugBundles(cfg *config.Config) (int, int64, error) {
+	return container.PruneDebugBundles(cfg.DebugBundleDir,
+		time.Duration(cfg.DebugBundleMaxDays)*24*time.Hour,
+		int64(cfg.DebugBundleMaxMB)<<20)
+}
+
+// handleArtifactsCommand lists or prunes the artifact cache, which the CLI reads directly
+func handleArtifactsCommand(cfg *config.Config, args []string) {
+	if len(args) == 0 || (args[0] != "ls" && args[0] != "prune") {
+		fmt.Println("Usage: fun artifacts <ls|prune>")
+		fmt.Println("  ls      List the cached artifacts, most recently used first")
+		fmt.Println("  prune   Drop artifacts past artifact_cache_max_days or beyond artifact_cache_max_mb")
+		os.Exit(1)
+	}
+
+	if args[0] == "prune" {
+		result, err := pruneArtifactCache(cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, entry := range result.Removed {
+			fmt.Printf("Removed %s\n", entry.URL)
+		}
+		fmt.Printf("Pruned %d artifacts, reclaimed %.2f MB\n", len(result.Removed), float64(result.ReclaimedBytes)/(1024*1024))
+		return
+	}
+
+	cache, err := artifacts.Open(container.ArtifactCacheDir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	entries, err := cache.Entries()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if structuredOutput() {
+		printOutput(entries)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tVERSION\tSIZE\tLAST USED\tURL")
+	for _, entry := range entries {
+		version := entry.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f MB\t%s ago\t%s\n", strings.TrimPrefix(entry.Digest, "sha256:")[:12], version,
+			float64(entry.Size)/(1024*1024), time.Since(entry.LastUsed).Round(time.Minute), entry.URL)
+	}
+	w.Flush()
+}
+
+// handleEventsCommand prints the events of the daemon's journal
+func handleEventsCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	since := fs.String("since", "24h", "Show events since a duration ago or an RFC 3339 time, empty for all")
+	until := fs.String("until", "", "Show events until a duration ago or an RFC 3339 time")
+	types := fs.String("type", "", "Comma separated event types: daemon, deploy, command, container, host, audit, error")
+	subject := fs.String("subject", "", "Only show events about a container, command or deployment revision")
+	limit := fs.Int("limit", 0, "Only show the newest events")
+	asJSON := fs.Bool("json", false, "Print the events as JSON, like --output json")
+	fs.Parse(args)
+
+	filter := events.Filter{Subject: *subject, Limit: *limit}
+	var err error
+	if filter.Since, err = parseEventTime(*since); err != nil {
+		fmt.Printf("Error: invalid --since: %v\n", err)
+		os.Exit(1)
+	}
+	if filter.Until, err = parseEventTime(*until); err != nil {
+		fmt.Printf("Error: invalid --until: %v\n", err)
+		os.Exit(1)
+	}
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+
+	result, err := admin.NewClient(cfg.AdminSocket).Events(context.Background(), filter)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON && !structuredOutput() {
+		outputFormat = outputJSON
+	}
+	if structuredOutput() {
+		printOutput(result)
+		return
+	}
+	if len(result) == 0 {
+		fmt.Println("No events")
+		return
+	}
+	for _, event := range result {
+		subject := event.Subject
+		if subject == "" {
+			subject = "-"
+		}
+		fmt.Printf("%s  %-9s  %-12s  %s\n", event.Time.Local().Format(time.RFC3339), event.Type, subject, event.Message)
+	}
+}
+
+// parseEventTime parses a duration ago, such as 24h, or an RFC 3339 time; empty is the zero time
+func parseEventTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleTasksCommand lists the daemon's maintenance tasks or runs one of them now
+func handleTasksCommand(cfg *config.Config, args []string) {
+	client := admin.NewClient(cfg.AdminSocket)
+	switch {
+	case len(args) == 1 && (args[0] == "ls" || args[0] == "list"):
+		statuses, err := client.Tasks(context.Background())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			printOutput(statuses)
+			return
+		}
+		fmt.Println("TASK\t\tINTERVAL\tLAST RUN\t\t\tNEXT RUN\t\t\tRESULT")
+		for _, status := range statuses {
+			interval := "manual"
+			if status.Interval > 0 {
+				interval = status.Interval.String()
+			}
+			lastRun, nextRun := "never", "-"
+			if !status.LastRun.IsZero() {
+				lastRun = status.LastRun.Format(time.RFC3339)
+			}
+			if status.Running {
+				nextRun = "running"
+			} else if !status.NextRun.IsZero() {
+				nextRun = status.NextRun.Format(time.RFC3339)
+			}
+			fmt.Printf("%-12s\t%-8s\t%-25s\t%-25s\t%s\n", status.Name, interval, lastRun, nextRun, taskResult(status))
+		}
+	case len(args) == 2 && args[0] == "run":
+		fmt.Printf("Running task %s...\n", args[1])
+		status, err := client.RunTask(context.Background(), args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if status.LastError != "" {
+			fmt.Printf("Error: task %s failed after %s: %s\n", status.Name, status.LastDuration.Round(time.Millisecond), status.LastError)
+			os.Exit(1)
+		}
+		fmt.Printf("Task %s finished in %s: %s\n", status.Name, status.LastDuration.Round(time.Millisecond), taskResult(*status))
+	default:
+		fmt.Println("Usage: fun tasks ls | fun tasks run <task>")
+		os.Exit(1)
+	}
+}
+
+// taskResult describes the outcome of the last run of a task
+func taskResult(status tasks.Status) string {
+	switch {
+	case status.LastRun.IsZero():
+		return "-"
+	case status.LastError != "":
+		return "failed: " + status.LastError
+	case status.LastResult == "":
+		return "nothing to do"
+	}
+	return status.LastResult
+}
+
+// handleRollbackCommand restores an earlier desired-state revision
+func handleRollbackCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	project := fs.String("project", "", "Project to roll back, the global state if empty")
+	fs.Parse(args)
+	revision := 0
+	if fs.NArg() > 1 {
+		fmt.Println("Usage: fun rollback [--project name] [revision]")
+		os.Exit(1)
+	}
+	if fs.NArg() == 1 {
+		n, err := strconv.Atoi(fs.Arg(0))
+		if err != nil || n <= 0 {
+			fmt.Printf("Error: invalid revision %q\n", fs.Arg(0))
+			os.Exit(1)
+		}
+		revision = n
+	}
+
+	if dryRun {
+		client := dryRunClient(cfg)
+		defer client.Close()
+		if _, err := client.Rollback(context.Background(), *project, revision, localUser()); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	result, err := admin.NewClient(cfg.AdminSocket).Rollback(context.Background(), *project, revision, localUser())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rolled back as revision %d: %s\n", result.Revision, result.Message)
+}
+
+// dryRunClient connects to containerd directly for dry runs of daemon operations
+func dryRunClient(cfg *config.Config) *container.Client {
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// localUser identifies the local user in the deployment history
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return "local:" + u.Username
+	}
+	return "local"
+}
+
+// showDebugHelp shows help for debug commands
+func showDebugHelp() {
+	fmt.Println("Usage: fun debug <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  log-level                       Show the daemon's log level")
+	fmt.Println("  set-log-level <level>           Change the log level without restarting (debug, info, warn, error)")
+	fmt.Println("  on | off                        Toggle debug logging")
+	fmt.Println("  dump                            Log goroutine stacks, containers, backend states and recent errors, like SIGUSR1")
+	fmt.Println("  pprof [profile] [--seconds N] [--output file]")
+	fmt.Println("                                  Save a profile: profile (CPU), heap, goroutine, allocs, block, mutex, trace")
+}
+
+// handleDevCommands processes commands for developing the agent itself
+func handleDevCommands(cfg *config.Config, args []string) {
+	switch args[0] {
+	case "cloud-sim":
+		fs := flag.NewFlagSet("dev cloud-sim", flag.ExitOnError)
+		listen := fs.String("listen", "127.0.0.1:8787", "Address of the simulated orchestrator API")
+		daemon := fs.Bool("daemon", false, "Also run the daemon in this process, connected to the simulator")
+		fs.Parse(args[1:])
+
+		simulator := cloud.NewSimulator()
+		server := &http.Server{Addr: *listen, Handler: simulator.Handler()}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Simulator failed: %v", err)
+			}
+		}()
+
+		fmt.Printf("Simulated cloud listening on http://%s\n", *listen)
+		fmt.Printf("  Queue a command:    curl -X POST http://%s/sim/v1/hosts/<hostname>/commands -d '{\"type\":\"rollback\"}'\n", *listen)
+		fmt.Printf("  Show host state:    curl http://%s/sim/v1/hosts\n", *listen)
+		fmt.Printf("  Deny confirmations: curl -X PUT http://%s/sim/v1/confirm -d '{\"confirmed\":false}'\n", *listen)
+		fmt.Printf("  Set desired state:  curl -X PUT http://%s/sim/v1/hosts/<hostname>/desired-state -d @desired-state.json\n", *listen)
+
+		if *daemon {
+			// The daemon talks to the simulator in-process, the listener is for the control API
+			cloudSimulator = simulator
+			cfg.CloudProxy = ""
+			runDaemon(cfg)
+			return
+		}
+
+		fmt.Printf("Point cloud_url of an agent at http://%s to use it, press Ctrl+C to stop\n", *listen)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		server.Close()
+
+	case "watch":
+		fs := flag.NewFlagSet("dev watch", flag.ExitOnError)
+		restart := fs.Bool("restart", false, "Restart the container after syncing changes")
+		interval := fs.Duration("interval", time.Second, "Time between scans for changes")
+		fs.Parse(args[1:])
+
+		if fs.NArg() < 2 {
+			fmt.Println("Usage: fun dev watch [--restart] [--interval 1s] <container> <host-path:container-path>...")
+			os.Exit(1)
+		}
+		var rules []container.WatchRule
+		for _, spec := range fs.Args()[1:] {
+			rule, err := container.ParseWatchRule(spec)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			rules = append(rules, rule)
+		}
+
+		client, err := newContainerClient(cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer client.Close()
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		id := resolveContainer(ctx, client, fs.Arg(0))
+		fmt.Printf("Watching %d path(s) for container %s, press Ctrl+C to stop\n", len(rules), id)
+		err = client.Watch(ctx, id, container.WatchOptions{
+			Rules:    rules,
+			Interval: *interval,
+			Restart:  *restart,
+			OnSync: func(changed, removed []string) {
+				fmt.Printf("%s synced %d changed and %d removed path(s)", time.Now().Format("15:04:05"), len(changed), len(removed))
+				if *restart {
+					fmt.Print(", restarted")
+				}
+				fmt.Println()
+			},
+		})
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Printf("Unknown dev command: %s\n", args[0])
+		showDevHelp()
+		os.Exit(1)
+	}
+}
+
+// showDevHelp displays dev command usage
+func showDevHelp() {
+	fmt.Println("Usage: fun dev <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  cloud-sim [--listen addr] [--daemon]")
+	fmt.Println("                                  Run a simulated orchestrator for testing cloud driven flows")
+	fmt.Println("  watch [--restart] [--interval 1s] <container> <host-path:container-path>...")
+	fmt.Println("                                  Sync changed files into a container, bind-mounted paths are left alone")
+}
+
+// embeddedStopTimeout is how long operations on the embedded containerd may take
+// to finish when the daemon stops
+const embeddedStopTimeout = 10 * time.Second
+
+// embeddedContainerdLogFile returns the log file of the embedded containerd, next to the daemon's
+func embeddedContainerdLogFile(cfg *config.Config) string {
+	return filepath.Join(filepath.Dir(cfg.LogFile), "containerd.log")
+}
+
+// startEmbeddedContainerd runs the bundled containerd on the containerd socket
+// through a Manager, whose client is configured like the CLI's. Linux containers
+// on macOS and Windows run in the VM and the WSL agent, so it only runs
+// containerd natively there.
+func startEmbeddedContainerd(cfg *config.Config, socketGID int) (*container.Manager, error) {
+	if container.IsRunningOnMacOS() {
+		return nil, fmt.Errorf("embedded_containerd is not supported on macOS, containerd runs in the LinuxKit VM")
+	}
+
+	dataDir := filepath.Join(cfg.ContainerRoot, "containerd")
+	serverConfig := container.DefaultServerConfig()
+	serverConfig.Root = filepath.Join(dataDir, "root")
+	serverConfig.State = filepath.Join(dataDir, "state")
+	serverConfig.Address = cfg.ContainerdSocket
+	serverConfig.LogFile = embeddedContainerdLogFile(cfg)
+	serverConfig.EnableCRI = cfg.EnableCRI
+	serverConfig.Native = true
+	// The CLI talks to containerd directly. containerd gives the group access
+	// itself each time it binds the socket, a system containerd is left alone.
+	if socketGID > 0 {
+		serverConfig.SocketGID = socketGID
+	}
+	if driver, err := container.ResolveCgroupDriver(cfg.CgroupDriver); err == nil {
+		serverConfig.SystemdCgroup = driver == container.CgroupDriverSystemd
+	}
+	if auditLogger, err := audit.NewLogger(cfg.AuditLogPath); err == nil {
+		serverConfig.Audit = auditLogger
+	}
+
+	manager := container.NewManager(container.ManagerConfig{
+		RunAs:        "both",
+		ServerConfig: serverConfig,
+		ClientSocket: cfg.ContainerdSocket,
+		Namespace:    cfg.ContainerdNamespace,
+		NewClient: func(socket string) (*container.Client, error) {
+			socketCfg := *cfg
+			socketCfg.ContainerdSocket = socket
+			return newContainerClient(&socketCfg)
+		},
+	})
+	// containerd is supervised by the daemon, it must not stop with the startup context
+	if err := manager.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// containerdConnections returns the status of the configured containerd sockets
+// and of the embedded server's socket, which may run next to a system containerd
+func containerdConnections(cfg *config.Config) []container.ConnectionStatus {
+	primary := "default"
+	if cfg.EmbeddedContainerd {
+		primary = container.ConnectionEmbedded
+	}
+	sockets := map[string]string{primary: cfg.ContainerdSocket}
+	for name, socket := range cfg.ContainerdSockets {
+		sockets[name] = socket
+	}
+	listed := make(map[string]bool)
+	for _, socket := range sockets {
+		listed[socket] = true
+	}
+	if funSocket := container.GetFunSocketPath(); !cfg.EmbeddedContainerd && !listed[funSocket] {
+		sockets[container.ConnectionEmbedded] = funSocket
+	}
+
+	var names []string
+	for name := range sockets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var statuses []container.ConnectionStatus
+	for _, name := range names {
+		status := container.ConnectionStatus{
+			Name:    name,
+			Socket:  sockets[name],
+			Primary: sockets[name] == cfg.ContainerdSocket,
+		}
+		if container.CheckContainerdRunning(status.Socket) {
+			if client, err := container.NewClient(status.Socket, cfg.ContainerdNamespace); err == nil {
+				status.Connected = true
+				status.Version = client.Capabilities().Version
+				client.Close()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// startupGates returns the startup conditions configured in cfg
+func startupGates(cfg *config.Config) service.StartupGates {
+	return service.StartupGates{
+		WaitForNetwork:  cfg.StartupWaitForNetwork,
+		WaitForTimeSync: cfg.StartupWaitForTimeSync,
+		WaitForPaths:    cfg.StartupWaitForPaths,
+		Timeout:         time.Duration(cfg.StartupTimeout) * time.Second,
+	}
+}
+
+// runDaemon starts the background service
+func runDaemon(cfg *config.Config) {
+	log.Println("Starting Fun Server daemon...")
+	timer := newStartupTimer()
+	if driver, err := container.ResolveCgroupDriver(cfg.CgroupDriver); err == nil {
+		log.Printf("Detected cgroup mode %s, using the %s cgroup driver", container.DetectCgroupMode(), driver)
+	}
+
+	// Create a context that will be canceled on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up signal handling
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal: %v\n", sig)
+		notifySystemd("STOPPING=1\nSTATUS=Shutting down")
+		cancel()
+	}()
+
+	// Log the state of the daemon on SIGUSR1, for debugging it without attaching
+	// a debugger. The signal is trapped first, so a daemon hung while starting
+	// dumps what it has instead of being killed. Dumps list logged errors, they
+	// are logged past the journal so it doesn't record them again.
+	diag := &diagnostics{
+		cfg:     cfg,
+		started: timer.start,
+		logger:  log.New(log.Writer(), log.Prefix(), log.Flags()),
+	}
+	dumpCh := make(chan os.Signal, 1)
+	notifyDumpSignal(dumpCh)
+	go func() {
+		defer signal.Stop(dumpCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-dumpCh:
+				diag.Dump()
+			}
+		}
+	}()
+
+	// What happens to the running containers when the daemon stops
+	shutdownPolicy, err := container.ParseShutdownPolicy(cfg.ShutdownPolicy)
+	if err != nil {
+		log.Printf("Warning: %v, leaving containers running on shutdown", err)
+		shutdownPolicy = container.ShutdownLeaveRunning
+	}
+
+	// Keep state changes, orchestrator commands and errors for fun events and support bundles
+	var journal *events.Journal
+	if cfg.EventJournalDir != "" {
+		var err error
+		journal, err = events.Open(cfg.EventJournalDir, events.Limits{
+			MaxBytes: int64(cfg.EventJournalMaxMB) << 20,
+			MaxAge:   time.Duration(cfg.EventJournalMaxDays) * 24 * time.Hour,
+		})
+		if err != nil {
+			log.Printf("Warning: Event journal is disabled: %v", err)
+			journal = nil
+		} else {
+			log.SetOutput(io.MultiWriter(log.Writer(), logging.NewLevelSink(logging.LevelError, func(_ logging.Level, line string) {
+				journal.Record(events.Event{Type: events.TypeError, Message: logMessage(line)})
+			})))
+		}
+	}
+	journal.Record(events.Event{Type: events.TypeDaemon, Message: fmt.Sprintf("Fun Server %s started", Version)})
+	diag.attach(nil, nil, journal)
+	timer.step("journal")
+
+	// Wait for the network, clock and paths the daemon depends on at boot
+	if err := service.WaitForStartup(ctx, startupGates(cfg)); err != nil {
+		log.Printf("Warning: %v, starting anyway", err)
+	}
+	timer.step("startup gates")
+
+	// Create cloud client
+	cloudClient, cloudTunnel, err := newCloudClient(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure the cloud connection: %v", err)
+	}
+	if cloudTunnel != nil {
+		log.Printf("Connecting to the cloud through the configured jump host")
+		go cloudTunnel.Run(ctx)
+	}
+	if cfg.FIPSMode {
+		log.Printf("FIPS mode enabled, using only FIPS 140-3 approved TLS settings")
+	}
+
+	// Identify this host by a persistent ID, hostnames collide and change
+	hostID, err := hostid.Load(cfg.HostIDPath)
+	if err != nil {
+		log.Printf("Warning: Failed to load host ID: %v", err)
+	} else {
+		log.Printf("Host ID: %s", hostID)
+		cloudClient.SetHostID(hostID)
+	}
+	host := newHostIdentity(hostID)
+
+	// Load the kernel modules and enable the sysctls containers need, minimal
+	// distributions often lack them and containers would fail late
+	changes, errs := container.ConfigureHostDependencies()
+	for _, change := range changes {
+		log.Printf("Host setup: %s", change)
+	}
+	for _, err := range errs {
+		log.Printf("Warning: %v", err)
+	}
+	for _, dep := range container.CheckHostDependencies() {
+		if !dep.OK {
+			log.Printf("Warning: %s: %s", dep.Name, dep.Detail)
+		}
+	}
+	timer.step("host setup")
+
+	// Let members of the socket group use the CLI, which talks to containerd directly
+	socketGID, err := sockets.LookupGroup(cfg.SocketGroup)
+	if err != nil {
+		log.Printf("Warning: %v, sockets are restricted to the daemon's user", err)
+		socketGID = -1
+	}
+
+	// Initialize containerd client, the embedded containerd is started first
+	var manager *container.Manager
+	var containerClient *container.Client
+	if cfg.EmbeddedContainerd {
+		notifySystemd("STATUS=Starting the embedded containerd")
+		manager, err = startEmbeddedContainerd(cfg, socketGID)
+		if err == nil {
+			containerClient = manager.GetClient()
+		}
+	} else {
+		notifySystemd("STATUS=Connecting to containerd")
+		containerClient, err = newContainerClient(cfg)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to connect to containerd: %v", err)
+	} else {
+		caps := containerClient.Capabilities()
+		log.Printf("Successfully connected to containerd %s (transfer service: %t, sandbox API: %t, CRI: %t)",
+			caps.Version, caps.Transfer, caps.Sandbox, caps.CRI)
+		if cfg.EnableCRI {
+			if err := containerClient.RequireCRI(); err != nil {
+				log.Printf("Warning: enable_cri is set but kubelets can't connect: %v", err)
+			} else if !caps.Sandbox {
+				log.Printf("Warning: containerd %s has no sandbox API, pods run with the legacy CRI sandbox implementation", caps.Version)
+			}
+		}
+		// The manager closes its client when it stops
+		if manager == nil {
+			defer containerClient.Close()
+		}
+
+		if snapshotter, err := containerClient.ConfigureSnapshotter(ctx); err != nil {
+			log.Printf("Warning: %v", err)
+		} else if snapshotter != "overlayfs" {
+			log.Printf("The kernel has no overlay filesystem, unpacking images with the %s snapshotter", snapshotter)
+		}
+	}
+
+	timer.step("containerd")
+
+	// Sockets systemd listens on when the daemon is started through its socket unit
+	activated, err := sockets.Activated()
+	if err != nil {
+		log.Printf("Warning: %v, listening on the configured sockets instead", err)
+	} else if len(activated) > 0 {
+		log.Printf("Using %d socket(s) passed by systemd", len(activated))
+	}
+
+	// Start the main service routines
+	var wg sync.WaitGroup
+
+	// Register host with cloud orchestrator in the background, so an unreachable
+	// orchestrator doesn't hold up READY until systemd's start timeout kills the daemon
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		registerHostWithRetry(ctx, cloudClient, containerClient, host)
+	}()
+
+	// Buffer alerts, metrics and audit records on disk so they survive losing
+	// connectivity, and forward them in order once the orchestrator is back
+	var spool *telemetry.Spool
+	if cfg.TelemetrySpoolDir != "" {
+		var err error
+		spool, err = telemetry.Open(cfg.TelemetrySpoolDir, telemetry.Limits{
+			MaxBytes:     int64(cfg.TelemetrySpoolMaxMB) << 20,
+			MinFreeBytes: int64(cfg.TelemetryMinFreeDiskMB) << 20,
+		})
+		if err != nil {
+			log.Printf("Warning: Telemetry store-and-forward is disabled: %v", err)
+			spool = nil
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				spool.Run(ctx, func(ctx context.Context, records []telemetry.Record, dropped uint64) error {
+					return sendTelemetry(ctx, cloudClient, host, records, dropped)
+				}, time.Duration(cfg.PollInterval)*time.Second)
+			}()
+		}
+	}
+
+	// Kernel, rootfs and binary downloads are reported like metrics
+	if spool != nil {
+		download.SetReport(func(stats download.Stats) {
+			spoolRecord(spool, telemetry.KindDownload, stats)
+		})
+	}
+
+	// Audit records are kept in the journal and forwarded to the orchestrator
+	if containerClient != nil {
+		containerClient.AuditLogger().SetForwarder(func(event audit.Event) {
+			journal.Record(events.Event{Time: event.Time, Type: events.TypeAudit, Subject: event.Subject, Message: auditMessage(event)})
+			if spool != nil {
+				spoolRecord(spool, telemetry.KindAudit, event)
+			}
+		})
+	}
+
+	// Sample container usage for the per-project reports sent to the cloud
+	var usage *container.UsageAccumulator
+	if containerClient != nil && cfg.UsageSampleInterval > 0 {
+		usage = container.NewUsageAccumulator(containerClient)
+		if spool != nil {
+			usage.SetSampleHook(func(stats map[string]*container.ContainerStats) {
+				spoolRecord(spool, telemetry.KindMetrics, stats)
+			})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usage.Run(ctx, time.Duration(cfg.UsageSampleInterval)*time.Second)
+		}()
+	}
+
+	// Probe state is reported to the orchestrator for critical containers
+	var monitor *container.HealthMonitor
+	if containerClient != nil {
+		monitor = container.NewHealthMonitor(containerClient)
+	}
+
+	// Alert the orchestrator as soon as a critical container exits, not at the next poll
+	if containerClient != nil {
+		containerClient.SetCriticalExitHook(func(containerID string, info container.TerminationInfo) {
+			journal.Record(events.Event{Time: info.FinishedAt, Type: events.TypeContainer, Subject: containerID,
+				Message: fmt.Sprintf("Critical container exited (%s, exit code %d)", info.Reason, info.ExitCode)})
+			go sendCriticalExitAlert(ctx, cloudClient, spool, host, containerID, info)
+		})
+		containerClient.SetCrashLoopHook(func(containerID string) {
+			journal.Record(events.Event{Type: events.TypeContainer, Subject: containerID, Message: "Container is crash-looping"})
+			go sendCrashLoopAlert(ctx, cfg, cloudClient, spool, journal, containerClient, host, containerID)
+		})
+		containerClient.SetPreemptionHook(func(event container.PreemptionEvent) {
+			journal.Record(events.Event{Time: event.Time, Type: events.TypeContainer, Subject: event.ContainerID,
+				Message: fmt.Sprintf("Preempted %s priority container: %s", event.Priority, event.Reason)})
+			go sendPreemptionAlert(ctx, cloudClient, spool, host, event)
+		})
+	}
+
+	// Record deployments, and attach SBOMs of newly deployed containers to the cloud deployment record
+	if containerClient != nil {
+		containerClient.SetDeploymentHook(func(revision container.DeploymentRevision) {
+			journal.Record(events.Event{Time: revision.AppliedAt, Type: events.TypeDeploy, Subject: strconv.Itoa(revision.Revision),
+				Message: fmt.Sprintf("Revision %d applied by %s with %d changes: %s", revision.Revision, revision.AppliedBy, len(revision.Changes), revision.Message)})
+			if cfg.AttachSBOMs {
+				go attachDeploymentSBOMs(ctx, cfg, cloudClient, containerClient, host, revision)
+			}
+		})
+	}
+
+	// A broken policy file must not silently let the orchestrator or Git do everything
+	policy, err := container.LoadCommandPolicy(cfg.CommandPolicyPath)
+	if err != nil {
+		log.Fatalf("Failed to load the command policy: %v", err)
+	}
+
+	// Keep the projects of a Git repository applied, the sync status is reported to the cloud
+	var syncer *gitops.Syncer
+	if containerClient != nil && cfg.GitOpsRepo != "" {
+		var err error
+		syncer, err = gitops.NewSyncer(containerClient, gitops.Config{
+			Repo:      cfg.GitOpsRepo,
+			Branch:    cfg.GitOpsBranch,
+			Path:      cfg.GitOpsPath,
+			Dir:       filepath.Join(cfg.ContainerRoot, "gitops"),
+			SSHKey:    cfg.GitOpsSSHKey,
+			TokenFile: cfg.GitOpsTokenFile,
+			// Kept outside the checkout, which is reset on every sync
+			ProjectsPath: filepath.Join(cfg.ContainerRoot, "gitops-projects.json"),
+			Policy:       policy,
+		})
+		if err != nil {
+			log.Printf("Warning: GitOps is disabled: %v", err)
+		} else {
+			interval := time.Duration(max(cfg.GitOpsInterval, 30)) * time.Second
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				syncer.Run(ctx, interval)
+			}()
+		}
+	}
+
+	// The peer group is kept across restarts so it is known before the orchestrator is reachable
+	fleetStore, err := fleet.Load(cfg.FleetPath)
+	if err != nil {
+		log.Printf("Warning: Ignoring the stored peer group: %v", err)
+		fleetStore = fleet.NewStore(cfg.FleetPath)
+	}
+
+	// Singleton containers only run on the host of the group holding their lease
+	if containerClient != nil {
+		elector, err := election.NewElector(containerClient, &cloudLeases{cloudClient, host, fleetStore}, time.Duration(cfg.SingletonLeaseTTL)*time.Second)
+		if err != nil {
+			log.Printf("Warning: Singleton containers won't be started: %v", err)
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				elector.Run(ctx)
+			}()
+		}
+	}
+
+	// Pull the images the orchestrator hints at ahead of its deployments
+	var prewarmer *container.Prewarmer
+	if containerClient != nil {
+		window, err := container.ParsePrePullWindow(cfg.PrePullWindow)
+		if err != nil {
+			log.Fatalf("Failed to parse the pre-pull window: %v", err)
+		}
+		prewarmer = container.NewPrewarmer(containerClient, window)
+	}
+
+	// Start the cloud communication service
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		loop := &cloudLoop{
+			cfg:             cfg,
+			cloudClient:     cloudClient,
+			containerClient: containerClient,
+			monitor:         monitor,
+			usage:           usage,
+			syncer:          syncer,
+			powerController: power.NewController(containerClient),
+			policy:          policy,
+			fleetStore:      fleetStore,
+			prewarmer:       prewarmer,
+			journal:         journal,
+			host:            host,
+		}
+		loop.run(ctx)
+	}()
+
+	// Attach USB and serial devices to the containers that select them as they
+	// are plugged in, and report the changed devices with the inventory
+	deviceChanges := make(chan struct{}, 1)
+	if containerClient != nil && runtime.GOOS == "linux" && cfg.DeviceScanInterval > 0 {
+		devices := container.NewDeviceManager(containerClient)
+		devices.SetChangeHandler(func(_ []container.HostDevice) {
+			select {
+			case deviceChanges <- struct{}{}:
+			default:
+			}
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices.Run(ctx, time.Duration(cfg.DeviceScanInterval)*time.Second)
+		}()
+	}
+
+	// Report OS packages and runtime versions so the orchestrator can flag vulnerable hosts
+	if cfg.InventoryInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runInventoryReports(ctx, cfg, cloudClient, containerClient, host, deviceChanges)
+		}()
+	}
+
+	// Health of the daemon for /healthz and /readyz, and the systemd watchdog
+	checker := daemonHealthChecks(cfg, cloudClient, containerClient)
+
+	// Start the container management service if containerd is available
+	if containerClient != nil {
+		beat := checker.Heartbeat("container-management", 2*time.Minute)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runContainerManagement(ctx, cfg, containerClient, monitor, beat)
+		}()
+	}
+
+	// Keep systemd's watchdog from restarting the daemon while it makes progress
+	if interval := service.WatchdogInterval(); interval > 0 {
+		log.Printf("Sending systemd watchdog keepalives every %s", interval)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checker.RunWatchdog(ctx, interval, func() error {
+				_, err := service.Notify("WATCHDOG=1")
+				return err
+			})
+		}()
+	}
+
+	// Publish container ports on the host, on macOS by relaying into the LinuxKit VM
+	if containerClient != nil {
+		forwarder := container.NewPortForwarder(containerClient)
+		if container.IsRunningOnMacOS() {
+			forwarder.SetBackendAddress(container.NewLinuxKitVMAddress(container.DefaultLinuxKitConfig()).Get)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwarder.Run(ctx, 5*time.Second)
+		}()
+	}
+
+	// Watch the host for OOM kills and low memory or disk space
+	if containerClient != nil && cfg.WatchdogInterval > 0 {
+		action, err := container.ParseWatchdogAction(cfg.WatchdogAction)
+		if err != nil {
+			log.Printf("Warning: %v, the watchdog only alerts and reclaims disk space", err)
+		}
+		watchdog := container.NewWatchdog(containerClient, container.WatchdogConfig{
+			MinMemoryAvailable: int64(cfg.WatchdogMinMemoryMB) << 20,
+			MinDiskFree:        int64(cfg.WatchdogMinDiskMB) << 20,
+			PruneImages:        cfg.ImageGCPruneUnused,
+			Action:             action,
+		})
+		watchdog.SetAlertHandler(func(event container.PressureEvent) {
+			journal.Record(events.Event{Time: event.Time, Type: events.TypeHost, Subject: event.Kind, Message: event.Message})
+			go sendPressureAlert(ctx, cloudClient, spool, host, event)
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchdog.Run(ctx, time.Duration(cfg.WatchdogInterval)*time.Second)
+		}()
+	}
+
+	// Run the periodic maintenance tasks, fun tasks run triggers them by hand
+	scheduler := maintenanceTasks(cfg, containerClient, prewarmer, journal)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scheduler.Run(ctx)
+	}()
+
+	// Dumps cover the containers and health checks from now on
+	diag.attach(containerClient, checker, journal)
+
+	// Start the admin API for runtime log level changes and profiling
+	adminListener := activated[sockets.ActivationAdmin]
+	if cfg.AdminSocket != "" || adminListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			adminServer := admin.NewServer()
+			adminServer.SetSocketGroup(socketGID)
+			if containerClient != nil {
+				adminServer.SetContainerClient(containerClient)
+			}
+			adminServer.SetFleet(fleetStore)
+			adminServer.SetTasks(scheduler)
+			adminServer.SetJournal(journal)
+			adminServer.SetHealth(checker)
+			adminServer.SetDiagnostics(diag.Dump)
+			if manager != nil {
+				adminServer.SetContainerdUpgrade(manager.UpgradeContainerd)
+			}
+			var err error
+			if adminListener != nil {
+				log.Printf("Admin API listening on the activated socket")
+				err = adminServer.Serve(ctx, adminListener)
+			} else {
+				err = adminServer.ListenAndServe(ctx, cfg.AdminSocket)
+			}
+			if err != nil {
+				log.Printf("Warning: Admin API stopped: %v", err)
+			}
+		}()
+	}
+
+	// Start the Docker-compatible API shim if configured
+	shimListener := activated[sockets.ActivationDockerAPI]
+	if containerClient == nil && shimListener != nil {
+		log.Printf("Warning: Docker API socket was activated but containerd is not available")
+		shimListener.Close()
+	}
+	if containerClient != nil && (cfg.DockerAPISocket != "" || shimListener != nil) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shim := dockerapi.NewServer(containerClient, Version)
+			shim.SetSocketGroup(socketGID)
+			var err error
+			if shimListener != nil {
+				log.Printf("Docker API shim listening on the activated socket")
+				err = shim.Serve(ctx, shimListener)
+			} else {
+				err = shim.ListenAndServe(ctx, cfg.DockerAPISocket)
+			}
+			if err != nil {
+				log.Printf("Warning: Docker API shim stopped: %v", err)
+			}
+		}()
+	}
+
+	timer.step("services")
+	log.Printf("Startup took %s", timer)
+
+	// containerd and the services depending on it are up, systemd may start the units ordered after the daemon
+	if containerClient != nil {
+		notifySystemd("READY=1\nSTATUS=Running, connected to containerd")
+	} else {
+		notifySystemd("READY=1\nSTATUS=Running without containerd, see the log")
+	}
+
+	// Wait for all goroutines to complete
+	wg.Wait()
+
+	// Stop or checkpoint the containers once nothing restarts them anymore
+	if containerClient != nil && shutdownPolicy != container.ShutdownLeaveRunning {
+		timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+		notifySystemd(fmt.Sprintf("STATUS=Applying the %s shutdown policy", shutdownPolicy))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), container.ShutdownDuration(timeout))
+		handled, err := containerClient.Shutdown(shutdownCtx, shutdownPolicy, timeout)
+		cancel()
+		if err != nil {
+			log.Printf("Warning: Shutdown policy %s failed: %v", shutdownPolicy, err)
+		}
+		log.Printf("Shutdown policy %s applied to %d containers", shutdownPolicy, handled)
+	}
+	// The embedded containerd goes last, the shutdown policy still needed it.
+	// Containers left running keep running in their shims.
+	if manager != nil {
+		stopCtx, cancel := context.WithTimeout(context.Background(), embeddedStopTimeout)
+		if err := manager.Stop(stopCtx); err != nil {
+			log.Printf("Warning: Failed to stop the embedded containerd: %v", err)
+		}
+		cancel()
+	}
+	journal.Record(events.Event{Type: events.TypeDaemon, Message: fmt.Sprintf("Fun Server %s stopped", Version)})
+	log.Println("Fun Server daemon shutdown complete")
+}
+
+// hostIdentity is the persistent ID of this host and its current hostname,
+// which may change while the daemon runs
+type hostIdentity struct {
+	id string
+
+	mu       sync.Mutex
+	hostname string
+}
+
+// newHostIdentity returns the identity of this host with its current hostname
+func newHostIdentity(id string) *hostIdentity {
+	h := &hostIdentity{id: id}
+	h.hostname = currentHostname()
+	return h
+}
+
+// currentHostname returns the OS hostname, or a placeholder if it can't be read
+func currentHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		log.Printf("Warning: Failed to get hostname: %v", err)
+		return "unknown-host"
+	}
+	return hostname
+}
+
+// Hostname returns the hostname the host is registered under
+func (h *hostIdentity) Hostname() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hostname
+}
+
+// refresh re-reads the hostname and returns the previous one if it changed
+func (h *hostIdentity) refresh() (previous string, changed bool) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "", false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hostname == h.hostname {
+		return "", false
+	}
+	previous, h.hostname = h.hostname, hostname
+	return previous, true
+}
+
+// registerHost registers the host with the orchestrator, previousHostname tells
+// it the host was renamed so it updates the existing record instead of adding one
+func registerHost(ctx context.Context, cloudClient *cloud.Client, containerClient *container.Client, host *hostIdentity, previousHostname string) error {
+	return cloudClient.RegisterHost(ctx, &cloud.RegistrationRequest{
+		HostID:           host.id,
+		Hostname:         host.Hostname(),
+		PreviousHostname: previousHostname,
+		Architecture:     container.HostArch(),
+		OS:               runtime.GOOS,
+		Version:          Version,
+		Labels:           []string{"funserver"},
+		Capacity:         cloudResources(container.HostCapacity()),
+		Allocatable:      allocatableResources(containerClient),
+		Topology:         cloudTopology(container.DetectTopology()),
+	})
+}
+
+// Backoff of host registration retries, while the orchestrator is unreachable
+const (
+	registrationRetryMin = 5 * time.Second
+	registrationRetryMax = 5 * time.Minute
+)
+
+// registerHostWithRetry registers the host, retrying with backoff until it
+// succeeds or ctx is done
+func registerHostWithRetry(ctx context.Context, cloudClient *cloud.Client, containerClient *container.Client, host *hostIdentity) {
+	backoff := registrationRetryMin
+	for {
+		err := registerHost(ctx, cloudClient, containerClient, host, "")
+		if err == nil {
+			log.Printf("Successfully registered host with cloud orchestrator")
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Warning: Failed to register host, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, registrationRetryMax)
+	}
+}
+
+// Backoff of task event resubscriptions, while containerd's event stream fails
+const (
+	taskEventsRetryMin = time.Second
+	taskEventsRetryMax = time.Minute
+)
+
+// watchTaskEvents runs the task event watcher until ctx is done, subscribing
+// again with backoff whenever the subscription fails, e.g. as containerd restarts
+func watchTaskEvents(ctx context.Context, containerClient *container.Client) {
+	backoff := taskEventsRetryMin
+	for {
+		started := time.Now()
+		err := containerClient.WatchTaskEvents(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// A subscription that held for a while starts the backoff over
+		if time.Since(started) > taskEventsRetryMax {
+			backoff = taskEventsRetryMin
+		}
+		log.Printf("Warning: Task event watcher stopped, subscribing again in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, taskEventsRetryMax)
+	}
+}
+
+// cloudLoop holds the clients, stores and controllers the cloud communication
+// loop reports on and runs the orchestrator's commands against
+type cloudLoop struct {
+	cfg             *config.Config
+	cloudClient     *cloud.Client
+	containerClient *container.Client
+	monitor         *container.HealthMonitor
+	usage           *container.UsageAccumulator
+	syncer          *gitops.Syncer
+	powerController *power.Controller
+	policy          *container.CommandPolicy
+	fleetStore      *fleet.Store
+	prewarmer       *container.Prewarmer
+	journal         *events.Journal
+	host            *hostIdentity
+}
+
+// run handles communication with the Fun orchestrator in the cloud
+func (l *cloudLoop) run(ctx context.Context) {
+	log.Println("Starting cloud communication service...")
+	ticker := time.NewTicker(time.Duration(l.cfg.PollInterval) * time.Second)
+	defer ticker.Stop()
+
+	// A desired state that failed to apply is retried even though it didn't change
+	var desiredSync desiredStateSync
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down cloud communication service...")
+			return
+		case <-ticker.C:
+			// Return to the preferred endpoint once it recovers from a failover
+			l.cloudClient.CheckEndpoints(ctx)
+
+			// Re-register under the new name when the host is renamed, the ID stays the same
+			if previous, changed := l.host.refresh(); changed {
+				log.Printf("Hostname changed from %s to %s, re-registering", previous, l.host.Hostname())
+				if err := registerHost(ctx, l.cloudClient, l.containerClient, l.host, previous); err != nil {
+					log.Printf("Error re-registering host: %v", err)
+				}
+			}
+			hostname := l.host.Hostname()
+
+			// Update status with cloud orchestrator
+			var report *container.UsageReport
+			if l.usage != nil {
+				report = l.usage.Flush()
+			}
+			err := l.cloudClient.UpdateStatus(ctx, &cloud.StatusUpdateRequest{
+				HostID:         l.host.id,
+				Hostname:       hostname,
+				Status:         "running",
+				Containers:     containerReports(ctx, l.containerClient, l.monitor),
+				Allocatable:    allocatableResources(l.containerClient),
+				Allocated:      allocatedResources(ctx, l.containerClient),
+				Usage:          cloudUsage(report),
+				GitOps:         cloudGitOps(l.cfg, l.syncer),
+				Endpoint:       l.cloudClient.Endpoint(),
+				FleetUpdatedAt: fleetUpdatedAt(l.fleetStore),
+				// TODO: Add resource usage metrics
+			})
+			if err != nil {
+				log.Printf("Error updating status: %v", err)
+				// Keep the usage for the next update so it isn't lost for billing
+				if report != nil {
+					l.usage.Restore(report)
+				}
+			}
+
+			l.runCommands(ctx)
+			desiredSync.sync(ctx, l, hostname)
+		}
+	}
+}
+
+// runCommands executes the commands the orchestrator queued for this host
+func (l *cloudLoop) runCommands(ctx context.Context) {
+	hostname := l.host.Hostname()
+	commands, err := l.cloudClient.FetchCommands(ctx, hostname)
+	if err != nil {
+		log.Printf("Error fetching commands: %v", err)
+		return
+	}
+
+	for _, command := range commands {
+		// Unverified commands and refused command types are reported right away, power commands included
+		command, err := verifyCloudCommand(l.cfg, l.containerClient, l.host.id, command)
+		if err == nil {
+			err = l.policy.CheckCommand(command.Type)
+		}
+		if err != nil {
+			log.Printf("Cloud command %s (%s) refused: %v", command.ID, command.Type, err)
+			l.journal.Record(events.Event{Type: events.TypeCommand, Subject: command.ID, Message: fmt.Sprintf("Refused %s command: %v", command.Type, err)})
+			if err := l.cloudClient.ReportCommandResult(ctx, hostname, command.ID, commandFailure(err)); err != nil {
+				log.Printf("Error reporting result of command %s: %v", command.ID, err)
+			}
+			continue
+		}
+
+		isPower := command.Type == cloud.CommandReboot || command.Type == cloud.CommandShutdown
+
+		// Power commands may wait hours for their maintenance window, and are
+		// fetched again until their result is reported
+		if isPower && !dryRun {
+			if stage, message, ok := l.powerController.Progress(command.ID); ok {
+				acknowledgePowerCommand(ctx, l.cloudClient, hostname, command, stage, message)
+				continue
+			}
+			l.journal.Record(events.Event{Type: events.TypeCommand, Subject: command.ID, Message: fmt.Sprintf("Scheduled %s command", command.Type)})
+			go runPowerCommand(ctx, l.cloudClient, l.powerController, hostname, command)
+			continue
+		}
+
+		result := &cloud.CommandResult{Success: true}
+		if isPower {
+			log.Printf("[dry-run] %s host (window %s to %s, drain timeout %ds)", command.Type,
+				command.WindowStart.Format(time.RFC3339), command.WindowEnd.Format(time.RFC3339), command.DrainTimeout)
+		} else if err := l.runCommand(ctx, command); err != nil {
+			log.Printf("Cloud command %s (%s) failed: %v", command.ID, command.Type, err)
+			result = commandFailure(err)
+		}
+		// The orchestrator must not mistake a described command for an executed one
+		if dryRun && result.Success {
+			result = &cloud.CommandResult{Success: false, Message: "not executed, the agent runs in dry-run mode"}
+		}
+		if result.Success {
+			l.journal.Record(events.Event{Type: events.TypeCommand, Subject: command.ID, Message: fmt.Sprintf("Executed %s command", command.Type)})
+		} else {
+			l.journal.Record(events.Event{Type: events.TypeCommand, Subject: command.ID, Message: fmt.Sprintf("Failed %s command: %s", command.Type, result.Message)})
+		}
+		if err := l.cloudClient.ReportCommandResult(ctx, hostname, command.ID, result); err != nil {
+			log.Printf("Error reporting result of command %s: %v", command.ID, err)
+		}
+	}
+}
+
+// verifyCloudCommand returns the command to execute for one the orchestrator
+// queued. On hosts configured with manifest signing keys that is the command it
+// signed, which must be meant for this host and not expired or executed before.
+func verifyCloudCommand(cfg *config.Config, containerClient *container.Client, hostID string, command cloud.Command) (cloud.Command, error) {
+	if len(cfg.ManifestSigningKeys) == 0 {
+		return command, nil
+	}
+	if containerClient == nil {
+		return command, fmt.Errorf("containerd is not available to verify the command's signature")
+	}
+	envelope, err := containerClient.VerifyCommand("cloud:"+command.ID, command.Signed, command.Signature, command.ID, hostID)
+	if err != nil {
+		return command, err
+	}
+	var signed cloud.SignedCommand
+	if err := json.Unmarshal(command.Signed, &signed); err != nil {
+		return command, fmt.Errorf("invalid signed command: %w", err)
+	}
+	// The desired state of a deploy command must belong to the signed project
+	if signed.Type == cloud.CommandDeploy {
+		var state struct {
+			Project string `json:"project"`
+		}
+		if err := json.Unmarshal(signed.State, &state); err != nil {
+			return command, fmt.Errorf("invalid desired state: %w", err)
+		}
+		if state.Project != envelope.Project {
+			return command, fmt.Errorf("desired state of project %q was signed for project %q", state.Project, envelope.Project)
+		}
+	}
+	return signed.Command, nil
+}
+
+// desiredStateSync tracks the desired state the orchestrator serves across polls
+type desiredStateSync struct {
+	// pending is set while an apply failed and is retried on the next poll
+	pending bool
+	// settled is set once the host was reconciled, against the orchestrator or
+	// the cached state when it couldn't be reached at startup
+	settled bool
+}
+
+// sync applies the desired state the orchestrator serves for the host when it
+// changed, an unchanged one only costs a Not Modified response. If the
+// orchestrator can't be reached at startup the host is reconciled against the
+// cached state once; later outages leave the host as it is, so changes made
+// meanwhile aren't reverted on every poll.
+func (s *desiredStateSync) sync(ctx context.Context, l *cloudLoop, hostname string) {
+	if l.containerClient == nil {
+		return
+	}
+	state, changed, err := l.cloudClient.FetchDesiredState(ctx, hostname)
+	if err != nil {
+		if state = l.cloudClient.CachedDesiredState(); state == nil || s.settled {
+			log.Printf("Error fetching desired state: %v", err)
+			return
+		}
+		log.Printf("Error fetching desired state, reconciling against the one fetched at %s: %v", state.FetchedAt.Format(time.RFC3339), err)
+	} else if state == nil || (!changed && !s.pending) {
+		s.pending = false
+		s.settled = true
+		return
+	}
+
+	s.settled = true
+	if err := applyCloudDesiredState(ctx, l.containerClient, l.policy, l.host.id, state); err != nil {
+		log.Printf("Error applying desired state: %v", err)
+		s.pending = true
+		return
+	}
+	s.pending = false
+}
+
+// applyCloudDesiredState applies a desired state served by the orchestrator if
+// the host differs from it. On hosts configured with manifest signing keys the
+// state is wrapped in a signed envelope, which must be meant for this host and
+// not expired or older than the last one applied.
+func applyCloudDesiredState(ctx context.Context, containerClient *container.Client, policy *container.CommandPolicy, hostID string, state *cloud.DesiredState) error {
+	document := state.State
+	var envelope *container.DesiredStateEnvelope
+	if containerClient.ManifestsSigned() {
+		verified, err := containerClient.VerifyDesiredState("cloud:desired-state", state.State, state.Signature, hostID)
+		if err != nil {
+			return err
+		}
+		envelope = &verified
+		document = verified.State
+	}
+	var desired container.DesiredState
+	if err := json.Unmarshal(document, &desired); err != nil {
+		return fmt.Errorf("invalid desired state: %w", err)
+	}
+	if err := policy.CheckDesiredState(desired); err != nil {
+		return err
+	}
+
+	diff, err := containerClient.DiffDesiredState(ctx, desired)
+	if err != nil {
+		return err
+	}
+	if diff.HasChanges() {
+		message := "desired state"
+		if state.ETag != "" {
+			message += " " + state.ETag
+		}
+		revision, err := containerClient.ApplyDesiredState(ctx, desired, "cloud", message)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied the orchestrator's desired state: revision %d (%d changes)", revision.Revision, len(revision.Changes))
+	}
+	if envelope != nil {
+		if err := containerClient.RecordDesiredState(*envelope); err != nil {
+			log.Printf("Warning: Failed to record the desired state issue time: %v", err)
+		}
+	}
+	return nil
+}
+
+// commandFailure builds the result of a failed command, with the details of
+// admission rejections and policy violations
+func commandFailure(err error) *cloud.CommandResult {
+	result := &cloud.CommandResult{Success: false, Message: err.Error()}
+	var admissionErr *container.AdmissionError
+	if errors.As(err, &admissionErr) {
+		result.Rejection = &cloud.AdmissionRejection{
+			Resource:  admissionErr.Resource,
+			Requested: admissionErr.Requested,
+			Available: admissionErr.Available,
+			Reason:    admissionErr.Reason,
+		}
+	}
+	var policyErr *container.CommandPolicyError
+	if errors.As(err, &policyErr) {
+		for _, v := range policyErr.Violations {
+			result.Violations = append(result.Violations, cloud.PolicyViolation{Rule: v.Rule, Subject: v.Subject, Reason: v.Reason})
+		}
+	}
+	return result
+}
+
+// runCommand executes a single orchestrator command
+func (l *cloudLoop) runCommand(ctx context.Context, command cloud.Command) error {
+	switch command.Type {
+	case cloud.CommandRollback:
+		if l.containerClient == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		// The restored revision may predate the current policy
+		target, err := l.containerClient.RollbackTarget(command.Project, command.Revision)
+		if err != nil {
+			return err
+		}
+		if err := l.policy.CheckDesiredState(target.State); err != nil {
+			return err
+		}
+		revision, err := l.containerClient.Rollback(ctx, command.Project, target.Revision, "cloud")
+		if err != nil {
+			return err
+		}
+		log.Printf("Rolled back on request of the orchestrator: revision %d (%s)", revision.Revision, revision.Message)
+		return nil
+	case cloud.CommandDeploy:
+		if l.containerClient == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		var desired container.DesiredState
+		if err := json.Unmarshal(command.State, &desired); err != nil {
+			return fmt.Errorf("invalid desired state: %w", err)
+		}
+		if err := l.policy.CheckDesiredState(desired); err != nil {
+			return err
+		}
+		revision, err := l.containerClient.ApplyDesiredState(ctx, desired, "cloud", command.Message)
+		if err != nil {
+			return err
+		}
+		log.Printf("Deployed on request of the orchestrator: revision %d (%s)", revision.Revision, revision.Message)
+		return nil
+	case cloud.CommandTrustPolicy:
+		if l.containerClient == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		return updateTrustPolicy(l.cfg, l.containerClient, command.Policy)
+	case cloud.CommandCriticalContainers:
+		if l.containerClient == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		if err := l.containerClient.SetCriticalContainers(ctx, command.Containers); err != nil {
+			return err
+		}
+		log.Printf("Marked %d containers as critical on request of the orchestrator", len(command.Containers))
+		return nil
+	case cloud.CommandFleet:
+		if command.Fleet == nil {
+			return fmt.Errorf("fleet command without a group")
+		}
+		changed, err := l.fleetStore.Update(fleetGroup(command.Fleet))
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("Joined fleet group %s with %d peers", command.Fleet.Name, len(command.Fleet.Peers))
+		}
+		return nil
+	case cloud.CommandPrePull:
+		if l.prewarmer == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		if err := l.policy.CheckImages(command.Images); err != nil {
+			return err
+		}
+		if err := l.prewarmer.Hint(command.Images, command.WindowEnd); err != nil {
+			return err
+		}
+		log.Printf("Queued %d images to pre-pull on request of the orchestrator", len(command.Images))
+		return nil
+	}
+	return fmt.Errorf("unknown command type %q", command.Type)
+}
+
+// fleetGroup converts a peer group from the cloud API
+func fleetGroup(group *cloud.FleetGroup) fleet.Group {
+	result := fleet.Group{Name: group.Name, Project: group.Project, UpdatedAt: group.UpdatedAt}
+	for _, p := range group.Peers {
+		result.Peers = append(result.Peers, fleet.Peer{
+			HostID:        p.HostID,
+			Hostname:      p.Hostname,
+			Addresses:     p.Addresses,
+			MeshPublicKey: p.MeshPublicKey,
+			MeshEndpoint:  p.MeshEndpoint,
+			Status:        p.Status,
+			LastSeen:      p.LastSeen,
+		})
+	}
+	return result
+}
+
+// cloudLeases grants the leases of singleton containers through the
+// orchestrator, which scopes them to the host's fleet group
+type cloudLeases struct {
+	client *cloud.Client
+	host   *hostIdentity
+	fleet  *fleet.Store
 }
 
-// showContainerHelp displays container command usage
-func showContainerHelp() {
-	fmt.Println("Usage: fun container <command>")
-	fmt.Println("\nCommands:")
-	fmt.Println("  list                   List all containers")
-	fmt.Println("  create <n> <image>  Create a new container")
-	fmt.Println("  start <id>             Start a container")
-	fmt.Println("  stop <id>              Stop a container")
-	fmt.Println("  remove <id> [--force]  Remove a container")
-	fmt.Println("  images                 List all images")
+// Acquire acquires or renews a lease. A host without a group is alone and
+// holds all of its leases.
+func (l *cloudLeases) Acquire(ctx context.Context, name string, ttl time.Duration) (election.Grant, error) {
+	if _, grouped := l.fleet.Group(); !grouped {
+		return election.Grant{Holder: l.host.Hostname(), Held: true}, nil
+	}
+	lease, err := l.client.AcquireLease(ctx, l.host.Hostname(), name, ttl)
+	if err != nil {
+		return election.Grant{}, err
+	}
+	return election.Grant{Holder: lease.Holder, Held: lease.HolderID == l.host.id}, nil
 }
 
-// runDaemon starts the background service
-func runDaemon(cfg *config.Config) {
-	log.Println("Starting Fun Server daemon...")
+// Release gives up a lease the host holds
+func (l *cloudLeases) Release(ctx context.Context, name string) error {
+	if _, grouped := l.fleet.Group(); !grouped {
+		return nil
+	}
+	return l.client.ReleaseLease(ctx, l.host.Hostname(), name)
+}
 
-	// Create a context that will be canceled on SIGINT or SIGTERM
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// fleetUpdatedAt returns when the host's peer group was last sent, nil if it has none
+func fleetUpdatedAt(store *fleet.Store) *time.Time {
+	group, ok := store.Group()
+	if !ok {
+		return nil
+	}
+	return &group.UpdatedAt
+}
 
-	// Set up signal handling
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+// updateTrustPolicy installs a content trust policy pushed by the orchestrator
+func updateTrustPolicy(cfg *config.Config, containerClient *container.Client, data json.RawMessage) error {
+	policy := &container.TrustPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return fmt.Errorf("invalid trust policy: %w", err)
+	}
+	if err := containerClient.InstallTrustPolicy(policy, cfg.TrustPolicyPath, "cloud"); err != nil {
+		return err
+	}
+	log.Printf("Installed content trust policy from the orchestrator")
+	return nil
+}
 
-	go func() {
-		sig := <-sigCh
-		log.Printf("Received signal: %v\n", sig)
-		cancel()
-	}()
+// sendAlert sends an alert to the orchestrator's alerts endpoint. Alerts that
+// can't be sent during an outage are queued in the telemetry spool instead, so
+// they still arrive once the orchestrator is back.
+func sendAlert(ctx context.Context, cloudClient *cloud.Client, spool *telemetry.Spool, host *hostIdentity, alert *cloud.Alert) error {
+	err := cloudClient.SendAlert(ctx, host.Hostname(), alert)
+	if err == nil || spool == nil {
+		return err
+	}
+	log.Printf("Warning: Failed to send %s alert, queueing it: %v", alert.Type, err)
+	return spool.Append(telemetry.KindEvent, alert)
+}
 
-	// Create cloud client
-	cloudClient := cloud.New(cfg.CloudURL, cfg.APIKey)
+// spoolRecord buffers a metrics sample or audit record for the orchestrator.
+// Records refused for backpressure were already logged by the spool.
+func spoolRecord(spool *telemetry.Spool, kind string, v interface{}) {
+	if err := spool.Append(kind, v); err != nil && !errors.Is(err, telemetry.ErrBackpressure) {
+		log.Printf("Warning: Failed to buffer %s record: %v", kind, err)
+	}
+}
 
-	// Register host with cloud orchestrator
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Printf("Warning: Failed to get hostname: %v", err)
-		hostname = "unknown-host"
+// sendTelemetry forwards a batch of the telemetry spool to the orchestrator
+func sendTelemetry(ctx context.Context, cloudClient *cloud.Client, host *hostIdentity, records []telemetry.Record, dropped uint64) error {
+	batch := &cloud.TelemetryBatch{Records: make([]cloud.TelemetryRecord, len(records)), Dropped: dropped}
+	for i, r := range records {
+		batch.Records[i] = cloud.TelemetryRecord{Seq: r.Seq, Kind: r.Kind, Time: r.Time, Data: r.Data}
+	}
+	return cloudClient.SendTelemetry(ctx, host.Hostname(), batch)
+}
+
+// Retries of critical exit alerts that could be neither sent nor queued, the
+// status reports carry the container's state once they give up
+const (
+	criticalAlertRetryMin = 5 * time.Second
+	criticalAlertRetryMax = 5 * time.Minute
+	criticalAlertRetryFor = time.Hour
+)
+
+// sendCriticalExitAlert tells the orchestrator that a critical container
+// exited, retrying with backoff while the alert can't be delivered
+func sendCriticalExitAlert(ctx context.Context, cloudClient *cloud.Client, spool *telemetry.Spool, host *hostIdentity, containerID string, info container.TerminationInfo) {
+	log.Printf("Critical container %s exited (%s, exit code %d)", containerID, info.Reason, info.ExitCode)
+	exitCode := info.ExitCode
+	alert := &cloud.Alert{
+		Type:        cloud.AlertCriticalContainerExit,
+		ContainerID: containerID,
+		ExitCode:    &exitCode,
+		OOMKilled:   info.OOMKilled,
+		Reason:      info.Reason,
+		Time:        info.FinishedAt,
+	}
+	deadline := time.Now().Add(criticalAlertRetryFor)
+	backoff := criticalAlertRetryMin
+	for {
+		err := sendAlert(ctx, cloudClient, spool, host, alert)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			log.Printf("Error sending alert for critical container %s, giving up: %v", containerID, err)
+			return
+		}
+		log.Printf("Warning: Failed to send alert for critical container %s, retrying in %v: %v", containerID, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, criticalAlertRetryMax)
 	}
+}
 
-	err = cloudClient.RegisterHost(ctx, &cloud.RegistrationRequest{
-		Hostname:     hostname,
-		Architecture: runtime.GOARCH,
-		OS:           runtime.GOOS,
-		Version:      Version,
-		Labels:       []string{"funserver"},
+// sendPressureAlert tells the orchestrator the host is running out of memory or disk space
+func sendPressureAlert(ctx context.Context, cloudClient *cloud.Client, spool *telemetry.Spool, host *hostIdentity, event container.PressureEvent) {
+	err := sendAlert(ctx, cloudClient, spool, host, &cloud.Alert{
+		Type:     cloud.AlertHostPressure,
+		Pressure: event.Kind,
+		Reason:   event.Message,
+		Time:     event.Time,
 	})
 	if err != nil {
-		log.Printf("Warning: Failed to register host: %v", err)
-	} else {
-		log.Printf("Successfully registered host with cloud orchestrator")
+		log.Printf("Error sending %s pressure alert: %v", event.Kind, err)
 	}
+}
 
-	// Initialize containerd client
-	containerClient, err := container.NewClient(cfg.ContainerdSocket, cfg.ContainerdNamespace)
+// sendPreemptionAlert tells the orchestrator a container was stopped to relieve resource pressure
+func sendPreemptionAlert(ctx context.Context, cloudClient *cloud.Client, spool *telemetry.Spool, host *hostIdentity, event container.PreemptionEvent) {
+	err := sendAlert(ctx, cloudClient, spool, host, &cloud.Alert{
+		Type:        cloud.AlertPreemption,
+		ContainerID: event.ContainerID,
+		Reason:      event.Reason,
+		Time:        event.Time,
+	})
 	if err != nil {
-		log.Printf("Warning: Failed to connect to containerd: %v", err)
-	} else {
-		log.Printf("Successfully connected to containerd")
-		defer containerClient.Close()
+		log.Printf("Error sending preemption alert for container %s: %v", event.ContainerID, err)
 	}
+}
 
-	// Start the main service routines
-	var wg sync.WaitGroup
+// sendCrashLoopAlert captures a debug bundle of a crash-looping container if
+// configured and tells the orchestrator where to find it
+func sendCrashLoopAlert(ctx context.Context, cfg *config.Config, cloudClient *cloud.Client, spool *telemetry.Spool, journal *events.Journal, containerClient *container.Client, host *hostIdentity, containerID string) {
+	alert := &cloud.Alert{
+		Type:        cloud.AlertCrashLoop,
+		ContainerID: containerID,
+		Time:        time.Now(),
+	}
+	if cfg.DebugBundleDir != "" {
+		// The journal shows what happened to the container before it started crash-looping
+		history, err := journal.Query(events.Filter{Subject: containerID, Since: time.Now().Add(-24 * time.Hour)})
+		if err != nil {
+			log.Printf("Warning: Failed to read the events of container %s: %v", containerID, err)
+		}
+		bundle, err := containerClient.CaptureDebugBundle(ctx, containerID, container.DebugBundleOptions{
+			Dir:       cfg.DebugBundleDir,
+			CoreDumps: cfg.DebugBundleCores,
+			Events:    history,
+		})
+		if err != nil {
+			log.Printf("Warning: Failed to capture debug bundle of container %s: %v", containerID, err)
+		} else {
+			log.Printf("Captured debug bundle of crash-looping container %s in %s", containerID, bundle)
+			alert.DebugBundle = bundle
+		}
+		if _, _, err := pruneDebugBundles(cfg); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if err := sendAlert(ctx, cloudClient, spool, host, alert); err != nil {
+		log.Printf("Error sending crash loop alert for container %s: %v", containerID, err)
+	}
+}
 
-	// Start the cloud communication service
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		runCloudCommunication(ctx, cfg, cloudClient, hostname)
-	}()
+// runPowerCommand reboots or shuts down the host on request of the orchestrator,
+// reporting progress along the way
+func runPowerCommand(ctx context.Context, cloudClient *cloud.Client, powerController *power.Controller, hostname string, command cloud.Command) {
+	log.Printf("Cloud command %s: %s requested", command.ID, command.Type)
 
-	// Start the container management service if containerd is available
-	if containerClient != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			runContainerManagement(ctx, cfg, containerClient)
-		}()
+	err := powerController.Execute(ctx, power.Request{
+		ID:           command.ID,
+		Action:       power.Action(command.Type),
+		WindowStart:  command.WindowStart,
+		WindowEnd:    command.WindowEnd,
+		DrainTimeout: time.Duration(command.DrainTimeout) * time.Second,
+	}, power.Hooks{
+		Confirm: func(ctx context.Context) (bool, error) {
+			return cloudClient.ConfirmCommand(ctx, hostname, command.ID)
+		},
+		Progress: func(stage, message string) {
+			log.Printf("Cloud command %s: %s: %s", command.ID, stage, message)
+			progress := &cloud.CommandProgress{Stage: stage, Message: message}
+			if err := cloudClient.ReportCommandProgress(ctx, hostname, command.ID, progress); err != nil {
+				log.Printf("Error reporting progress of command %s: %v", command.ID, err)
+			}
+		},
+	})
+
+	// The pending run reports the result, a refetch is only acknowledged
+	if errors.Is(err, power.ErrDuplicate) {
+		if stage, message, ok := powerController.Progress(command.ID); ok {
+			acknowledgePowerCommand(ctx, cloudClient, hostname, command, stage, message)
+		}
+		return
 	}
 
-	// Wait for all goroutines to complete
-	wg.Wait()
-	log.Println("Fun Server daemon shutdown complete")
+	result := &cloud.CommandResult{Success: true}
+	if err != nil {
+		log.Printf("Cloud command %s (%s) failed: %v", command.ID, command.Type, err)
+		result = &cloud.CommandResult{Success: false, Message: err.Error()}
+	}
+	if err := cloudClient.ReportCommandResult(ctx, hostname, command.ID, result); err != nil {
+		log.Printf("Error reporting result of command %s: %v", command.ID, err)
+	}
 }
 
-// runCloudCommunication handles communication with the Fun orchestrator in the cloud
-func runCloudCommunication(ctx context.Context, cfg *config.Config, cloudClient *cloud.Client, hostname string) {
-	log.Println("Starting cloud communication service...")
-	ticker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
+// acknowledgePowerCommand answers a power command fetched again while it is
+// pending with its current progress, instead of running it twice
+func acknowledgePowerCommand(ctx context.Context, cloudClient *cloud.Client, hostname string, command cloud.Command, stage, message string) {
+	logging.Debugf("Cloud command %s (%s) is already pending", command.ID, command.Type)
+	if stage == "" {
+		return
+	}
+	progress := &cloud.CommandProgress{Stage: stage, Message: message}
+	if err := cloudClient.ReportCommandProgress(ctx, hostname, command.ID, progress); err != nil {
+		log.Printf("Error reporting progress of command %s: %v", command.ID, err)
+	}
+}
+
+// runInventoryReports periodically sends the host software inventory to the
+// cloud, and when devices signalled on deviceChanges settle, with only the
+// devices rescanned
+func runInventoryReports(ctx context.Context, cfg *config.Config, cloudClient *cloud.Client, containerClient *container.Client, host *hostIdentity, deviceChanges <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(cfg.InventoryInterval) * time.Second)
 	defer ticker.Stop()
 
+	// A nil *container.Client must not end up as a non-nil interface
+	var runtimeClient inventory.RuntimeVersioner
+	if containerClient != nil {
+		runtimeClient = containerClient
+	}
+
+	var inv *inventory.Inventory
 	for {
+		// Device changes only rescan the devices, the rest is collected on the interval
+		if inv == nil {
+			inv = inventory.Collect(ctx, runtimeClient)
+		}
+		devices, err := container.ScanHostDevices()
+		if err != nil {
+			log.Printf("Warning: Failed to scan host devices: %v", err)
+		}
+
+		if err := cloudClient.ReportInventory(ctx, host.Hostname(), cloudInventory(inv, devices)); err != nil {
+			log.Printf("Error reporting inventory: %v", err)
+		} else {
+			logging.Debugf("Reported inventory: kernel %s, %d pending security updates", inv.KernelVersion, len(inv.SecurityUpdates))
+		}
+
 		select {
 		case <-ctx.Done():
-			log.Println("Shutting down cloud communication service...")
 			return
 		case <-ticker.C:
-			// Update status with cloud orchestrator
-			err := cloudClient.UpdateStatus(ctx, &cloud.StatusUpdateRequest{
-				Hostname: hostname,
-				Status:   "running",
-				// TODO: Add resource usage metrics
-			})
-			if err != nil {
-				log.Printf("Error updating status: %v", err)
+			inv = nil
+		case <-deviceChanges:
+			// Plugging in a hub or unplugging a bundle of devices changes them in
+			// bursts, report once they settle
+			settle := time.NewTimer(inventoryDeviceSettle)
+		debounce:
+			for {
+				select {
+				case <-ctx.Done():
+					settle.Stop()
+					return
+				case <-deviceChanges:
+					settle.Reset(inventoryDeviceSettle)
+				case <-settle.C:
+					break debounce
+				}
+			}
+		}
+	}
+}
+
+// inventoryDeviceSettle is how long device changes must stop before the
+// inventory is reported with the new devices
+const inventoryDeviceSettle = 10 * time.Second
+
+// attachDeploymentSBOMs uploads the SBOMs of the containers created or replaced by a deployment
+func attachDeploymentSBOMs(ctx context.Context, cfg *config.Config, cloudClient *cloud.Client, containerClient *container.Client, host *hostIdentity, revision container.DeploymentRevision) {
+	for _, change := range revision.Changes {
+		if change.Action == container.DiffDelete {
+			continue
+		}
+
+		sbom, err := containerClient.ContainerSBOM(ctx, change.ID)
+		if err == nil {
+			var data []byte
+			if data, err = sbom.Encode(cfg.SBOMFormat); err == nil {
+				err = cloudClient.AttachSBOM(ctx, host.Hostname(), revision.Revision, change.Name, cfg.SBOMFormat, data)
+			}
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to attach SBOM of container %s to revision %d: %v", change.Name, revision.Revision, err)
+		}
+	}
+}
+
+// cloudInventory converts a host inventory for the cloud API
+func cloudInventory(inv *inventory.Inventory, devices []container.HostDevice) *cloud.HostInventory {
+	result := &cloud.HostInventory{
+		CollectedAt:     inv.CollectedAt,
+		OS:              inv.OS,
+		OSVersion:       inv.OSVersion,
+		KernelVersion:   inv.KernelVersion,
+		PackageManager:  inv.PackageManager,
+		SecurityUpdates: []cloud.PackageUpdate{},
+		Runtimes:        inv.Runtimes,
+		AgentVersion:    Version,
+	}
+	for _, u := range inv.SecurityUpdates {
+		result.SecurityUpdates = append(result.SecurityUpdates, cloud.PackageUpdate{
+			Name:             u.Name,
+			InstalledVersion: u.InstalledVersion,
+			AvailableVersion: u.AvailableVersion,
+		})
+	}
+	for _, d := range devices {
+		result.Devices = append(result.Devices, cloud.HostDevice{
+			Path:         d.Path,
+			Kind:         d.Kind,
+			VendorID:     d.VendorID,
+			ProductID:    d.ProductID,
+			Serial:       d.Serial,
+			Manufacturer: d.Manufacturer,
+			Product:      d.Product,
+			ByID:         d.ByID,
+		})
+	}
+	return result
+}
+
+// cloudUsage converts a usage report for the cloud API
+func cloudUsage(report *container.UsageReport) *cloud.UsageReport {
+	if report == nil {
+		return nil
+	}
+	result := &cloud.UsageReport{PeriodStart: report.PeriodStart, PeriodEnd: report.PeriodEnd}
+	for _, p := range report.Projects {
+		result.Projects = append(result.Projects, cloud.ProjectUsage{
+			Project:         p.Project,
+			CPUSeconds:      p.CPUSeconds,
+			MemoryByteHours: p.MemoryByteHours,
+			NetworkRxBytes:  p.NetworkRxBytes,
+			NetworkTxBytes:  p.NetworkTxBytes,
+		})
+	}
+	return result
+}
+
+// cloudGitOps converts the last GitOps sync for the cloud API, nil before the first sync
+func cloudGitOps(cfg *config.Config, syncer *gitops.Syncer) *cloud.GitOpsStatus {
+	if syncer == nil {
+		return nil
+	}
+	status := syncer.Status()
+	if status.LastSync.IsZero() {
+		return nil
+	}
+	result := &cloud.GitOpsStatus{
+		Repo:     cfg.GitOpsRepo,
+		Branch:   cfg.GitOpsBranch,
+		Commit:   status.Commit,
+		LastSync: status.LastSync,
+		Error:    status.Error,
+	}
+	for _, p := range status.Projects {
+		project := cloud.GitOpsProject{Project: p.Project, Revision: p.Revision, Error: p.Error}
+		for _, change := range p.Drift {
+			project.Drift = append(project.Drift, fmt.Sprintf("%s %s", change.Action, change.Name))
+		}
+		result.Projects = append(result.Projects, project)
+	}
+	return result
+}
+
+// cloudResources converts host resources for the cloud API
+func cloudResources(r container.HostResources) *cloud.Resources {
+	return &cloud.Resources{CPUs: r.CPUs, MemoryBytes: r.MemoryBytes}
+}
+
+// cloudTopology converts the host topology for the cloud API
+func cloudTopology(t container.HostTopology) *cloud.Topology {
+	topology := &cloud.Topology{}
+	for _, node := range t.NUMANodes {
+		topology.NUMANodes = append(topology.NUMANodes, cloud.NUMANode{ID: node.ID, CPUs: node.CPUs})
+	}
+	return topology
+}
+
+// allocatableResources returns the resources left for workloads after the host reservation
+func allocatableResources(containerClient *container.Client) *cloud.Resources {
+	if containerClient == nil {
+		return nil
+	}
+	return cloudResources(containerClient.Allocatable())
+}
+
+// allocatedResources returns the resources claimed by container limits
+func allocatedResources(ctx context.Context, containerClient *container.Client) *cloud.Resources {
+	if containerClient == nil {
+		return nil
+	}
+	allocated, err := containerClient.AllocatedResources(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to compute allocated resources: %v", err)
+		return nil
+	}
+	return cloudResources(allocated)
+}
+
+// containerReports collects the per-container state sent with status updates
+func containerReports(ctx context.Context, containerClient *container.Client, monitor *container.HealthMonitor) []cloud.ContainerReport {
+	if containerClient == nil {
+		return nil
+	}
+
+	containers, err := containerClient.ListContainers(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to list containers for status update: %v", err)
+		return nil
+	}
+
+	var reports []cloud.ContainerReport
+	for _, c := range containers {
+		report := cloud.ContainerReport{
+			ID:           c.ID,
+			Image:        c.ImageRef,
+			Status:       c.Status,
+			RestartCount: c.RestartCount,
+			CrashLooping: c.CrashLooping,
+			Priority:     c.Priority,
+			Preempted:    c.Preempted,
+		}
+		if t := c.Termination; t != nil {
+			exitCode := t.ExitCode
+			report.ExitCode = &exitCode
+			report.OOMKilled = t.OOMKilled
+			report.TerminationReason = t.Reason
+		}
+		if c.Critical {
+			report.Critical = true
+			if c.Status == "running" && c.StartedAt != nil {
+				report.UptimeSeconds = int64(time.Since(*c.StartedAt).Seconds())
+			}
+			if status, ok := monitor.Status(c.ID); ok {
+				report.Health = &cloud.ContainerHealth{
+					Started:   status.Started,
+					Ready:     status.Ready,
+					Live:      status.Live,
+					LastProbe: status.LastProbe,
+					LastError: status.LastError,
+				}
 			}
 		}
+		reports = append(reports, report)
 	}
+	return reports
 }
 
 // runContainerManagement manages containers based on cloud orchestration
-func runContainerManagement(ctx context.Context, cfg *config.Config, containerClient *container.Client) {
+func runContainerManagement(ctx context.Context, cfg *config.Config, containerClient *container.Client, monitor *container.HealthMonitor, beat func()) {
 	log.Println("Starting container management service...")
 
+	// Clean up after a hard reboot before anything is started
+	actions, err := containerClient.Repair(ctx, container.RepairOptions{})
+	for _, action := range actions {
+		log.Printf("Repair: %s", action)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to repair containers: %v", err)
+	}
+
+	// Bring back containers drained before a reboot
+	if resumed, err := containerClient.ResumeDrained(ctx); err != nil {
+		log.Printf("Warning: Failed to resume drained containers: %v", err)
+	} else if resumed > 0 {
+		log.Printf("Resumed %d containers drained before the last reboot or daemon stop", resumed)
+	}
+
+	// Record exit codes and OOM kills as tasks exit
+	go watchTaskEvents(ctx, containerClient)
+
+	// Restart exited containers according to their restart policy, with backoff
+	supervisor := container.NewRestartSupervisor(containerClient, container.RestartBackoff{
+		InitialDelay: time.Second,
+		MaxDelay:     time.Duration(cfg.RestartMaxBackoff) * time.Second,
+		MaxRestarts:  cfg.RestartMaxAttempts,
+		Window:       time.Duration(cfg.RestartWindow) * time.Second,
+	})
+	go supervisor.Run(ctx)
+
+	// Run startup, readiness and liveness probes for containers that define them
+	monitor.SetRestartHandler(supervisor.RestartUnhealthy)
+	go monitor.Run(ctx)
+
 	// Simplified container management without compose functionality
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -423,13 +4038,275 @@ func runContainerManagement(ctx context.Context, cfg *config.Config, containerCl
 			log.Println("Shutting down container management service...")
 			return
 		case <-ticker.C:
+			// A loop stuck on containerd fails the daemon's liveness check
+			beat()
+
 			// Basic container health check
 			if err := containerClient.VerifyConnection(ctx); err != nil {
 				log.Printf("Connection to containerd lost: %v", err)
 				continue
 			}
 
-			// Container maintenance operations could be added here
+			// Pick up changed secrets in config file templates
+			if err := containerClient.RefreshConfigFiles(ctx); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+
+			// Stop lower-priority containers while the host is short of memory,
+			// and start them again once it has enough
+			preemption := container.PreemptionPolicy{
+				MinMemoryAvailable: int64(cfg.PreemptionMinMemoryMB) << 20,
+				StopTimeout:        10 * time.Second,
+			}
+			if event, err := containerClient.RelievePressure(ctx, preemption); err != nil {
+				log.Printf("Warning: Failed to preempt a container: %v", err)
+			} else if event == nil {
+				if _, err := containerClient.ResumePreempted(ctx, preemption); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// parseResourceFlags converts the resource limit flags of container create
+func parseResourceFlags(cpus float64, memory, memorySwap string, blkioWeight uint, egressRate string, readBps, writeBps, readIOps, writeIOps []string) (container.ResourceLimits, error) {
+	limits := container.ResourceLimits{
+		CPUs:        cpus,
+		BlkioWeight: uint16(blkioWeight),
+	}
+
+	var err error
+	if memory != "" {
+		if limits.Memory, err = container.ParseByteSize(memory); err != nil {
+			return limits, err
+		}
+	}
+	if memorySwap == "-1" {
+		limits.MemorySwap = -1
+	} else if memorySwap != "" {
+		if limits.MemorySwap, err = container.ParseByteSize(memorySwap); err != nil {
+			return limits, err
+		}
+	}
+	if egressRate != "" {
+		if limits.EgressRate, err = container.ParseBandwidth(egressRate); err != nil {
+			return limits, err
+		}
+	}
+
+	for _, t := range []struct {
+		specs  []string
+		target *[]container.ThrottleDevice
+	}{
+		{readBps, &limits.DeviceReadBps},
+		{writeBps, &limits.DeviceWriteBps},
+		{readIOps, &limits.DeviceReadIOps},
+		{writeIOps, &limits.DeviceWriteIOps},
+	} {
+		for _, spec := range t.specs {
+			device, err := container.ParseThrottleDevice(spec)
+			if err != nil {
+				return limits, err
+			}
+			*t.target = append(*t.target, device)
+		}
+	}
+
+	return limits, nil
+}
+
+// healthCheckFromFlags builds exec probes from shell commands, returning nil if none are set
+func healthCheckFromFlags(startup, readiness, liveness string, interval int) *container.HealthCheckConfig {
+	probe := func(command string) *container.Probe {
+		if command == "" {
+			return nil
+		}
+		return &container.Probe{
+			Type:          container.ProbeExec,
+			Command:       []string{"/bin/sh", "-c", command},
+			PeriodSeconds: interval,
+		}
+	}
+
+	if startup == "" && readiness == "" && liveness == "" {
+		return nil
+	}
+	return &container.HealthCheckConfig{
+		Startup:   probe(startup),
+		Readiness: probe(readiness),
+		Liveness:  probe(liveness),
+	}
+}
+
+// logMessage strips the prefix and timestamp the logger adds to a line
+func logMessage(line string) string {
+	line = strings.TrimPrefix(line, log.Prefix())
+	// The date and time fields of log.Ldate|log.Ltime
+	for i := 0; i < 2; i++ {
+		if _, rest, ok := strings.Cut(line, " "); ok {
+			line = rest
+		}
+	}
+	return line
+}
+
+// auditMessage describes an audit record for the event journal
+func auditMessage(event audit.Event) string {
+	message := event.Type
+	if event.Reason != "" {
+		message += ": " + event.Reason
+	}
+	if event.Actor != "" {
+		message += " (by " + event.Actor + ")"
+	}
+	return message
+}
+
+// startupTimer measures the steps of the daemon's startup, so a slow start
+// shows which step the time went to
+type startupTimer struct {
+	start time.Time
+	last  time.Time
+	steps []string
+}
+
+// newStartupTimer starts measuring the startup
+func newStartupTimer() *startupTimer {
+	now := time.Now()
+	return &startupTimer{start: now, last: now}
+}
+
+// step records the time since the previous step as the duration of name
+func (t *startupTimer) step(name string) {
+	now := time.Now()
+	t.steps = append(t.steps, fmt.Sprintf("%s %s", name, now.Sub(t.last).Round(time.Millisecond)))
+	t.last = now
+}
+
+// String returns the total startup time followed by the duration of each step
+func (t *startupTimer) String() string {
+	return fmt.Sprintf("%s (%s)", t.last.Sub(t.start).Round(time.Millisecond), strings.Join(t.steps, ", "))
+}
+
+// notifySystemd reports the daemon's state to systemd when it runs as a Type=notify unit
+func notifySystemd(state string) {
+	if _, err := service.Notify(state); err != nil {
+		logging.Debugf("Failed to notify systemd: %v", err)
+	}
+}
+
+// daemonHealthChecks registers the conditions the daemon's readiness depends on
+func daemonHealthChecks(cfg *config.Config, cloudClient *cloud.Client, containerClient *container.Client) *health.Checker {
+	checker := health.NewChecker()
+
+	checker.Add(health.Check{Name: "containerd", Run: func(ctx context.Context) error {
+		if containerClient == nil {
+			return fmt.Errorf("containerd is not available")
+		}
+		return containerClient.Ping(ctx)
+	}})
+
+	// On macOS, containerd runs in a LinuxKit VM
+	if container.IsRunningOnMacOS() {
+		checker.Add(health.Check{Name: "vm", Run: func(ctx context.Context) error {
+			if !container.IsLinuxKitVMRunning(container.DefaultLinuxKitConfig()) {
+				return fmt.Errorf("the LinuxKit VM is not running")
+			}
+			return nil
+		}})
+	}
+
+	// The orchestrator is polled every poll interval, missing a few polls is tolerated
+	maxSilence := 3 * time.Duration(cfg.PollInterval) * time.Second
+	checker.Add(health.Check{Name: "cloud", Run: func(ctx context.Context) error {
+		last := cloudClient.LastContact()
+		if last.IsZero() {
+			return fmt.Errorf("the orchestrator hasn't been reached yet")
 		}
+		if silence := time.Since(last); silence > maxSilence {
+			return fmt.Errorf("the orchestrator hasn't responded for %s", silence.Round(time.Second))
+		}
+		return nil
+	}})
+	return checker
+}
+
+// maintenanceTasks registers the periodic maintenance work of the daemon
+func maintenanceTasks(cfg *config.Config, containerClient *container.Client, prewarmer *container.Prewarmer, journal *events.Journal) *tasks.Scheduler {
+	scheduler := tasks.NewScheduler()
+	if journal != nil {
+		scheduler.Register(tasks.Task{
+			Name:        "event-journal",
+			Description: "Drop journal events past their maximum age",
+			Interval:    time.Hour,
+			Jitter:      5 * time.Minute,
+			Run: func(ctx context.Context) (string, error) {
+				if dropped := journal.Prune(); dropped > 0 {
+					return fmt.Sprintf("dropped %d segments", dropped), nil
+				}
+				return "", nil
+			},
+		})
+	}
+	scheduler.Register(tasks.Task{
+		Name:        "artifact-cache",
+		Description: "Prune downloaded kernels, rootfs tarballs and binaries not used recently",
+		Interval:    24 * time.Hour,
+		Jitter:      time.Hour,
+		Run: func(ctx context.Context) (string, error) {
+			result, err := pruneArtifactCache(cfg)
+			if err != nil || len(result.Removed) == 0 {
+				return "", err
+			}
+			return fmt.Sprintf("pruned %d artifacts, reclaimed %d bytes", len(result.Removed), result.ReclaimedBytes), nil
+		},
+	})
+	if cfg.DebugBundleDir != "" {
+		scheduler.Register(tasks.Task{
+			Name:        "debug-bundles",
+			Description: "Remove debug bundles and core dumps past their maximum age or size",
+			Interval:    24 * time.Hour,
+			Jitter:      time.Hour,
+			Run: func(ctx context.Context) (string, error) {
+				removed, freed, err := pruneDebugBundles(cfg)
+				if err != nil || removed == 0 {
+					return "", err
+				}
+				return fmt.Sprintf("removed %d bundles, reclaimed %d bytes", removed, freed), nil
+			},
+		})
 	}
+	if containerClient == nil {
+		return scheduler
+	}
+
+	// A zero interval disables scheduled GC, it can still be triggered
+	interval := time.Duration(cfg.ImageGCInterval) * time.Second
+	scheduler.Register(tasks.Task{
+		Name:        "image-gc",
+		Description: "Garbage collect unreferenced content and snapshots",
+		Interval:    interval,
+		Jitter:      interval / 10,
+		Run: func(ctx context.Context) (string, error) {
+			result, err := containerClient.GarbageCollect(ctx, cfg.ImageGCPruneUnused)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("reclaimed %d bytes, pruned %d images", result.ReclaimedBytes, len(result.PrunedImages)), nil
+		},
+	})
+
+	scheduler.Register(tasks.Task{
+		Name:        "pre-pull",
+		Description: "Pull the images the orchestrator plans to schedule",
+		Interval:    time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			if pulled := prewarmer.PullPending(ctx); pulled > 0 {
+				return fmt.Sprintf("pulled %d images", pulled), nil
+			}
+			return "", nil
+		},
+	})
+	return scheduler
 }
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"fun/config"
+	"fun/container"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// handleNerdctlCommands maps common nerdctl and docker CLI verbs and flags onto
+// funserver operations, so existing scripts keep working
+func handleNerdctlCommands(cfg *config.Config, args []string) {
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to connect to containerd: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "run", "create":
+		nerdctlRun(ctx, client, args[0], args[1:])
+
+	case "ps":
+		fs := flag.NewFlagSet("nerdctl ps", flag.ExitOnError)
+		all := fs.Bool("all", false, "Show all containers, not only running ones")
+		fs.BoolVar(all, "a", false, "Shorthand for --all")
+		quiet := fs.Bool("quiet", false, "Only show container IDs")
+		fs.BoolVar(quiet, "q", false, "Shorthand for --quiet")
+		fs.Parse(expandShortFlags(fs, args[1:]))
+
+		containers, err := client.ListContainers(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !*all {
+			running := []*container.Container{}
+			for _, c := range containers {
+				if c.Status == "running" {
+					running = append(running, c)
+				}
+			}
+			containers = running
+		}
+		if structuredOutput() {
+			printOutput(containers)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		if !*quiet {
+			fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tNAMES")
+		}
+		for _, c := range containers {
+			if *quiet {
+				fmt.Fprintln(w, c.ID)
+				continue
+			}
+			command := strings.Join(append(append([]string{}, c.Command...), c.Args...), " ")
+			fmt.Fprintf(w, "%s\t%s\t%q\t%s ago\t%s\t%s\n", c.ID, c.ImageRef, command,
+				time.Since(c.CreatedAt).Round(time.Second), c.Status, c.Name)
+		}
+		w.Flush()
+
+	case "images":
+		fs := flag.NewFlagSet("nerdctl images", flag.ExitOnError)
+		quiet := fs.Bool("quiet", false, "Only show image names")
+		fs.BoolVar(quiet, "q", false, "Shorthand for --quiet")
+		var filters stringSliceFlag
+		fs.Var(&filters, "filter", "Filter by reference=<pattern> or label=<key[=value]> (repeatable)")
+		fs.Var(&filters, "f", "Shorthand for --filter")
+		fs.Parse(expandShortFlags(fs, args[1:]))
+
+		opts, err := imageListFilters(filters)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if structuredOutput() {
+			images := []container.ImageSummary{}
+			err := client.WalkImages(ctx, opts, func(img container.ImageSummary) error {
+				images = append(images, img)
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			printOutput(images)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		if !*quiet {
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tSIZE")
+		}
+		err = client.WalkImages(ctx, opts, func(img container.ImageSummary) error {
+			if *quiet {
+				fmt.Fprintln(w, img.Name)
+				return nil
+			}
+			repository, tag := splitImageName(img.Name)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.2f MB\n", repository, tag, strings.TrimPrefix(img.Digest, "sha256:")[:12], float64(img.Size)/(1024*1024))
+			return nil
+		})
+		w.Flush()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "pull":
+		if len(args) != 2 {
+			fmt.Println("Usage: fun nerdctl pull <image>")
+			os.Exit(1)
+		}
+		ref, err := container.NormalizeImageRef(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := client.PullImage(ctx, ref); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !dryRun {
+			fmt.Println(ref)
+		}
+
+	case "rmi":
+		if len(args) < 2 {
+			fmt.Println("Usage: fun nerdctl rmi <image>...")
+			os.Exit(1)
+		}
+		for _, ref := range args[1:] {
+			if err := client.RemoveImage(ctx, ref); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if !dryRun {
+				fmt.Printf("Untagged: %s\n", ref)
+			}
+		}
+
+	case "start":
+		nerdctlEach(ctx, client, args, "start", func(id string) error {
+			return client.StartContainer(ctx, id)
+		})
+
+	case "stop", "restart":
+		fs := flag.NewFlagSet("nerdctl "+args[0], flag.ExitOnError)
+		seconds := fs.Int("time", 10, "Seconds to wait for the container to stop before killing it")
+		fs.IntVar(seconds, "t", 10, "Shorthand for --time")
+		fs.Parse(args[1:])
+
+		timeout := time.Duration(*seconds) * time.Second
+		verb := args[0]
+		nerdctlEach(ctx, client, append([]string{verb}, fs.Args()...), verb, func(id string) error {
+			if verb == "restart" {
+				return client.RestartContainer(ctx, id, timeout)
+			}
+			return client.StopContainer(ctx, id, timeout)
+		})
+
+	case "rm":
+		fs := flag.NewFlagSet("nerdctl rm", flag.ExitOnError)
+		force := fs.Bool("force", false, "Stop and remove running containers")
+		fs.BoolVar(force, "f", false, "Shorthand for --force")
+		fs.Parse(expandShortFlags(fs, args[1:]))
+
+		nerdctlEach(ctx, client, append([]string{"rm"}, fs.Args()...), "rm", func(id string) error {
+			return client.RemoveContainer(ctx, id, *force)
+		})
+
+	case "logs":
+		fs := flag.NewFlagSet("nerdctl logs", flag.ExitOnError)
+		follow := fs.Bool("follow", false, "Follow log output")
+		fs.BoolVar(follow, "f", false, "Shorthand for --follow")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Println("Usage: fun nerdctl logs [-f] <container>")
+			os.Exit(1)
+		}
+
+		if err := client.GetContainerLogs(ctx, resolveContainer(ctx, client, fs.Arg(0)), *follow, os.Stdout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "exec":
+		fs := flag.NewFlagSet("nerdctl exec", flag.ExitOnError)
+		interactive := fs.Bool("interactive", false, "Keep stdin open")
+		fs.BoolVar(interactive, "i", false, "Shorthand for --interactive")
+		tty := fs.Bool("tty", false, "Allocate a pseudo-TTY")
+		fs.BoolVar(tty, "t", false, "Shorthand for --tty")
+		workdir := fs.String("workdir", "", "Working directory inside the container")
+		fs.StringVar(workdir, "w", "", "Shorthand for --workdir")
+		var env stringSliceFlag
+		fs.Var(&env, "env", "Set an environment variable")
+		fs.Var(&env, "e", "Shorthand for --env")
+		fs.Parse(expandShortFlags(fs, args[1:]))
+		if fs.NArg() < 2 {
+			fmt.Println("Usage: fun nerdctl exec [-i] [-t] [-e KEY=VALUE] [-w dir] <container> <command> [args...]")
+			os.Exit(1)
+		}
+
+		opts := container.ExecOptions{
+			Command:    fs.Args()[1:],
+			Env:        expandEnv(env),
+			WorkingDir: *workdir,
+			TTY:        *tty,
+		}
+		exitCode, err := execInContainer(ctx, client, resolveContainer(ctx, client, fs.Arg(0)), opts, *interactive)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+
+	case "inspect":
+		if len(args) < 2 {
+			fmt.Println("Usage: fun nerdctl inspect <container>...")
+			os.Exit(1)
+		}
+
+		var containers []*container.Container
+		for _, ref := range args[1:] {
+			c, err := client.InspectContainer(ctx, resolveContainer(ctx, client, ref))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			containers = append(containers, c)
+		}
+		data, err := json.MarshalIndent(containers, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+
+	default:
+		fmt.Printf("Unknown nerdctl command: %s\n", args[0])
+		showNerdctlHelp()
+		os.Exit(1)
+	}
+}
+
+// nerdctlRun creates a container from nerdctl run/create flags, and for run starts it,
+// waiting for it to exit unless detached
+func nerdctlRun(ctx context.Context, client *container.Client, verb string, args []string) {
+	fs := flag.NewFlagSet("nerdctl "+verb, flag.ExitOnError)
+	name := fs.String("name", "", "Container name")
+	detach := fs.Bool("detach", false, "Run the container in the background")
+	fs.BoolVar(detach, "d", false, "Shorthand for --detach")
+	remove := fs.Bool("rm", false, "Remove the container when it exits")
+	fs.Bool("interactive", false, "Keep stdin open, the terminal is always attached")
+	fs.Bool("i", false, "Shorthand for --interactive")
+	fs.Bool("tty", false, "Allocate a pseudo-TTY, the terminal is always attached")
+	fs.Bool("t", false, "Shorthand for --tty")
+	var env, volumes, labels, publish stringSliceFlag
+	fs.Var(&env, "env", "Set an environment variable")
+	fs.Var(&env, "e", "Shorthand for --env")
+	fs.Var(&volumes, "volume", "Bind mount a host path (host:container[:mode], mode ro, rw, z or Z separated by commas)")
+	fs.Var(&volumes, "v", "Shorthand for --volume")
+	fs.Var(&labels, "label", "Set a label (key=value)")
+	fs.Var(&labels, "l", "Shorthand for --label")
+	fs.Var(&publish, "publish", "Publish a container port on the host ([host-ip:]host-port:container-port)")
+	fs.Var(&publish, "p", "Shorthand for --publish")
+	entrypoint := fs.String("entrypoint", "", "Override the image entrypoint")
+	restart := fs.String("restart", "no", "Restart policy: no, always, on-failure or unless-stopped")
+	network := fs.String("network", "", "Attach the container to a network")
+	fs.StringVar(network, "net", "", "Alias for --network")
+	ip := fs.String("ip", "", "Static IP address on the network")
+	hostname := fs.String("hostname", "", "Container hostname")
+	fs.StringVar(hostname, "h", "", "Shorthand for --hostname")
+	privileged := fs.Bool("privileged", false, "Run the container in privileged mode")
+	pull := fs.String("pull", "missing", "Pull policy: always, missing or never")
+	var devices, capAdd, capDrop, groupAdd, extraHosts, dns, dnsSearch, dnsOptions stringSliceFlag
+	fs.Var(&devices, "device", "Map a host device into the container (host[:container[:rwm]])")
+	fs.Var(&capAdd, "cap-add", "Add a Linux capability")
+	fs.Var(&capDrop, "cap-drop", "Drop a Linux capability")
+	fs.Var(&groupAdd, "group-add", "Add a supplementary group")
+	fs.Var(&extraHosts, "add-host", "Add a custom host-to-IP mapping (host:ip)")
+	fs.Var(&dns, "dns", "Set a custom DNS server")
+	fs.Var(&dnsSearch, "dns-search", "Set a custom DNS search domain")
+	fs.Var(&dnsOptions, "dns-opt", "Set a DNS resolver option")
+	fs.Var(&dnsOptions, "dns-option", "Alias for --dns-opt")
+	cpus := fs.Float64("cpus", 0, "Number of CPUs")
+	memory := fs.String("memory", "", "Memory limit, e.g. 512m")
+	fs.StringVar(memory, "m", "", "Shorthand for --memory")
+	memorySwap := fs.String("memory-swap", "", "Memory plus swap limit, -1 for unlimited swap")
+	var logOpts stringSliceFlag
+	fs.Var(&logOpts, "log-opt", "Log option: max-size, max-file, rate or mode (key=value)")
+	fs.Parse(expandShortFlags(fs, args))
+
+	if fs.NArg() < 1 {
+		fmt.Printf("Usage: fun nerdctl %s [options] <image> [command] [args...]\n", verb)
+		os.Exit(1)
+	}
+	if *remove && (*detach || verb == "create") {
+		fmt.Println("Error: --rm is only supported for containers run in the foreground")
+		os.Exit(1)
+	}
+
+	pullPolicy, err := container.ParseImagePullPolicy(*pull)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	resources, err := parseResourceFlags(*cpus, *memory, *memorySwap, 0, "", nil, nil, nil, nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	logOptions, err := container.ParseLogOptionFlags(logOpts)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := container.CreateContainerOptions{
+		Name:           *name,
+		Image:          fs.Arg(0),
+		Env:            expandEnv(env),
+		RestartPolicy:  *restart,
+		PrivilegedMode: *privileged,
+		CapAdd:         capAdd,
+		CapDrop:        capDrop,
+		GroupAdd:       groupAdd,
+		Network:        *network,
+		IPAddress:      *ip,
+		PullPolicy:     pullPolicy,
+		Hostname:       *hostname,
+		ExtraHosts:     extraHosts,
+		DNS:            dns,
+		DNSSearch:      dnsSearch,
+		DNSOptions:     dnsOptions,
+		Resources:      resources,
+		LogOptions:     logOptions,
+	}
+	if *entrypoint != "" {
+		opts.Command = []string{*entrypoint}
+		opts.Args = fs.Args()[1:]
+	} else if fs.NArg() > 1 {
+		opts.Command = fs.Args()[1:]
+	}
+
+	for _, p := range publish {
+		mapping, err := container.ParsePortMapping(p)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Ports = append(opts.Ports, mapping)
+	}
+	for _, d := range devices {
+		mapping, err := container.ParseDeviceMapping(d)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Devices = append(opts.Devices, mapping)
+	}
+	for _, volume := range volumes {
+		mount, err := parseVolume(volume)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Mounts = append(opts.Mounts, mount)
+	}
+	if len(labels) > 0 {
+		opts.Labels = make(map[string]string)
+		for _, label := range labels {
+			key, value, _ := strings.Cut(label, "=")
+			opts.Labels[key] = value
+		}
+	}
+
+	c, err := client.CreateContainer(ctx, opts)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if verb == "create" {
+		if !dryRun {
+			fmt.Println(c.ID)
+		}
+		return
+	}
+
+	// In the foreground the container's output goes to our stdio, not its log
+	start := client.StartContainerAttached
+	if *detach {
+		start = client.StartContainer
+	}
+	if err := start(ctx, c.ID); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *detach || dryRun {
+		if !dryRun {
+			fmt.Println(c.ID)
+		}
+		return
+	}
+
+	// The container's stdio is attached to ours, wait for it to exit like nerdctl does
+	exitCode, err := waitContainer(client, c.ID)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *remove {
+		if err := client.RemoveContainer(ctx, c.ID, true); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// waitContainer waits for the task of a container to exit and returns its exit code
+func waitContainer(client *container.Client, id string) (int, error) {
+	ctx := client.GetNamespacedContext()
+	c, err := client.GetContainer(ctx, id)
+	if err != nil {
+		return -1, err
+	}
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return -1, err
+	}
+	status := <-statusC
+	code, _, err := status.Result()
+	return int(code), err
+}
+
+// nerdctlEach runs action for every container referenced in args[1:], printing each reference on success
+func nerdctlEach(ctx context.Context, client *container.Client, args []string, verb string, action func(id string) error) {
+	if len(args) < 2 {
+		fmt.Printf("Usage: fun nerdctl %s <container>...\n", verb)
+		os.Exit(1)
+	}
+	for _, ref := range args[1:] {
+		if err := action(resolveContainer(ctx, client, ref)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Echo the reference as given, like nerdctl
+		if !dryRun {
+			fmt.Println(ref)
+		}
+	}
+}
+
+// expandShortFlags splits combined single-letter boolean flags such as -it or -dit
+// into separate flags, which the flag package doesn't support. Only arguments before
+// the first positional argument are rewritten, so container commands are untouched.
+func expandShortFlags(fs *flag.FlagSet, args []string) []string {
+	var expanded []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			return append(expanded, args[i:]...)
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		f := fs.Lookup(name)
+		if f == nil && !strings.HasPrefix(arg, "--") && combinedBoolFlags(fs, name) {
+			for _, r := range name {
+				expanded = append(expanded, "-"+string(r))
+			}
+			continue
+		}
+
+		expanded = append(expanded, arg)
+		if f != nil && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			expanded = append(expanded, args[i])
+		}
+	}
+	return expanded
+}
+
+// combinedBoolFlags reports whether every letter of name is a boolean flag
+func combinedBoolFlags(fs *flag.FlagSet, name string) bool {
+	for _, r := range name {
+		f := fs.Lookup(string(r))
+		if f == nil || !isBoolFlag(f) {
+			return false
+		}
+	}
+	return len(name) > 1
+}
+
+// isBoolFlag reports whether a flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// expandEnv completes KEY entries without a value from our environment, like docker does
+func expandEnv(env []string) []string {
+	var result []string
+	for _, e := range env {
+		if strings.Contains(e, "=") {
+			result = append(result, e)
+		} else if value, ok := os.LookupEnv(e); ok {
+			result = append(result, e+"="+value)
+		}
+	}
+	return result
+}
+
+// parseVolume converts a "host:container[:mode]" volume specification to a bind mount,
+// mode being ro or rw optionally followed by z or Z, e.g. "ro,Z"
+func parseVolume(volume string) (specs.Mount, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return specs.Mount{}, fmt.Errorf("invalid volume specification %s, only host:container[:mode] binds are supported", volume)
+	}
+
+	mode := ""
+	if len(parts) == 3 {
+		mode = parts[2]
+	}
+	options, err := container.ParseBindMode(mode)
+	if err != nil {
+		return specs.Mount{}, err
+	}
+
+	return specs.Mount{
+		Type:        "bind",
+		Source:      parts[0],
+		Destination: parts[1],
+		Options:     options,
+	}, nil
+}
+
+// splitImageName splits an image name into repository and tag
+func splitImageName(name string) (string, string) {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+	return name, "<none>"
+}
+
+// imageListFilters converts the reference and label filters of nerdctl images
+// into the options of an image listing
+func imageListFilters(filters []string) (container.ImageListOptions, error) {
+	var opts container.ImageListOptions
+	var labels []string
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		switch key {
+		case "reference":
+			if opts.Name != "" {
+				return opts, fmt.Errorf("only one reference filter is supported")
+			}
+			// Short names such as nginx:* match the normalized docker.io names
+			domain, _, hasDomain := strings.Cut(value, "/")
+			switch {
+			case !hasDomain:
+				value = "docker.io/library/" + value
+			case !strings.ContainsAny(domain, ".:") && domain != "localhost":
+				value = "docker.io/" + value
+			}
+			opts.Name = value
+		case "label":
+			labels = append(labels, value)
+		default:
+			return opts, fmt.Errorf("unsupported filter %q, expected reference=<pattern> or label=<key[=value]>", filter)
+		}
+	}
+	var err error
+	opts.Labels, err = container.ParseImageLabelFilters(labels)
+	return opts, err
+}
+
+// showNerdctlHelp displays the nerdctl compatible command usage
+func showNerdctlHelp() {
+	fmt.Println("Usage: fun nerdctl <command>")
+	fmt.Println("\nCommands accepting the common nerdctl and docker flags:")
+	fmt.Println("  run [options] <image> [command]     Create and start a container, in the foreground unless -d")
+	fmt.Println("  create [options] <image> [command]  Create a container")
+	fmt.Println("  ps [-a] [-q]                        List containers")
+	fmt.Println("  images [-q] [-f filter]             List images, filtered by reference=<pattern> or label=<key[=value]>")
+	fmt.Println("  pull <image>                        Pull an image")
+	fmt.Println("  rmi <image>...                      Remove images")
+	fmt.Println("  start <container>...                Start containers")
+	fmt.Println("  stop [-t seconds] <container>...    Stop containers")
+	fmt.Println("  restart [-t seconds] <container>... Restart containers")
+	fmt.Println("  rm [-f] <container>...              Remove containers")
+	fmt.Println("  logs [-f] <container>               Show container logs")
+	fmt.Println("  exec [-i] [-t] <container> <cmd>    Run a command in a running container")
+	fmt.Println("  inspect <container>...              Show container details as JSON")
+	fmt.Println("\nPublished ports (-p) are forwarded by the Fun Server daemon while the container runs.")
+}
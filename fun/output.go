@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"fun/container"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// outputCommands are the commands that print their result in the --output
+// format, other commands only print messages and refuse structured output
+// rather than printing text automation can't parse. The GitOps sync status has
+// no command of its own, it is reported to the orchestrator with the host status.
+var outputCommands = map[string]bool{
+	"status":            true,
+	"container list":    true,
+	"container images":  true,
+	"container inspect": true,
+	"container stats":   true,
+	"container top":     true,
+	"container diff":    true,
+	"image analyze":     true,
+	"image history":     true,
+	"image inspect":     true,
+	"network list":      true,
+	"namespace ls":      true,
+	"namespace list":    true,
+	"inventory":         true,
+	"plan":              true,
+	"history":           true,
+	"fleet ls":          true,
+	"fleet list":        true,
+	"tasks ls":          true,
+	"tasks list":        true,
+	"events":            true,
+	"artifacts ls":      true,
+	"doctor":            true,
+	"nerdctl ps":        true,
+	"nerdctl images":    true,
+}
+
+// statusOutput is the result of fun status
+type statusOutput struct {
+	// Service is the state of the service, such as running or stopped
+	Service    string                       `json:"service"`
+	CgroupMode container.CgroupMode         `json:"cgroup_mode"`
+	Containerd []container.ConnectionStatus `json:"containerd"`
+	Capacity   container.HostResources      `json:"capacity"`
+	// Reserved is kept free for the host
+	Reserved container.HostResources `json:"reserved"`
+}
+
+// structuredOutput reports whether commands print their result as JSON or YAML
+func structuredOutput() bool {
+	return outputFormat != outputText
+}
+
+// outputCommand returns the command of args as outputCommands names it and
+// how many arguments name it
+func outputCommand(args []string) (string, int) {
+	if len(args) > 1 && outputCommands[args[0]+" "+args[1]] {
+		return args[0] + " " + args[1], 2
+	}
+	return args[0], 1
+}
+
+// takeOutputFlag takes --output out of the arguments of a command that
+// prints its result, so it can follow the command like the command's own
+// flags, e.g. fun container list --output json. The arguments of other
+// commands are left alone, container sbom and debug pprof have an --output
+// flag of their own.
+func takeOutputFlag(args []string) ([]string, error) {
+	command, words := outputCommand(args)
+	if !outputCommands[command] {
+		return args, nil
+	}
+	rest := append([]string{}, args[:words]...)
+	for i := words; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "output" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag needs an argument: %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		outputFormat = value
+	}
+	return rest, nil
+}
+
+// checkOutputFormat validates --output for the command in args
+func checkOutputFormat(args []string) error {
+	switch outputFormat {
+	case outputText:
+		return nil
+	case outputJSON, outputYAML:
+	default:
+		return fmt.Errorf("unknown output format %q, expected text, json or yaml", outputFormat)
+	}
+	if command, _ := outputCommand(args); !outputCommands[command] {
+		return fmt.Errorf("%s doesn't print a result, --output %s is not supported", strings.Join(args[:min(2, len(args))], " "), outputFormat)
+	}
+	return nil
+}
+
+// printOutput prints v in the --output format. Field names come from the json
+// tags of the Go types in both formats, so they stay the same across them.
+func printOutput(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err == nil && outputFormat == outputYAML {
+		data, err = jsonToYAML(data)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		fmt.Println()
+	}
+}
+
+// jsonToYAML converts a JSON document to YAML in block style, keeping the order of the fields
+func jsonToYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	// JSON is YAML in flow style
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	var unstyle func(n *yaml.Node)
+	unstyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			unstyle(child)
+		}
+	}
+	unstyle(&node)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,221 @@
+package power
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"fun/container"
+)
+
+// Action is a power state change of the host
+type Action string
+
+const (
+	// Reboot restarts the host
+	Reboot Action = "reboot"
+	// Shutdown powers the host off
+	Shutdown Action = "shutdown"
+)
+
+// Progress stages reported while a power action runs
+const (
+	StageScheduled  = "scheduled"
+	StageConfirming = "confirming"
+	StageDraining   = "draining"
+	StageExecuting  = "executing"
+	StageCancelled  = "cancelled"
+)
+
+// DefaultDrainTimeout is how long each container gets to stop before it is killed
+const DefaultDrainTimeout = 30 * time.Second
+
+// ErrDuplicate is returned by Execute for a request with the ID of the pending
+// one, e.g. a command the orchestrator sent again before its result arrived
+var ErrDuplicate = errors.New("power action is already pending")
+
+// Request describes a power action and the maintenance window it must run in
+type Request struct {
+	// ID identifies the request, a request with the ID of the pending one is
+	// not run again
+	ID     string
+	Action Action
+	// WindowStart delays the action until the window opens, zero runs it right away
+	WindowStart time.Time
+	// WindowEnd refuses to start the action after the window closed, zero means no limit
+	WindowEnd time.Time
+	// DrainTimeout bounds the graceful stop of each container
+	DrainTimeout time.Duration
+}
+
+// Hooks connect a power action to the orchestrator
+type Hooks struct {
+	// Confirm asks the orchestrator whether the action should still go ahead
+	Confirm func(ctx context.Context) (bool, error)
+	// Progress reports the current stage
+	Progress func(stage, message string)
+}
+
+// Controller runs power actions, at most one at a time
+type Controller struct {
+	client *container.Client
+
+	mutex   sync.Mutex
+	pending bool
+	// pendingID, stage and message describe the pending request
+	pendingID string
+	stage     string
+	message   string
+}
+
+// NewController creates a power controller that drains the containers of client
+// client may be nil when containerd is unavailable, the drain is skipped then.
+func NewController(client *container.Client) *Controller {
+	return &Controller{client: client}
+}
+
+// Execute waits for the maintenance window, confirms with the orchestrator, drains
+// the containers and then reboots or shuts down the host
+// If the action can't be carried out, drained containers are started again.
+func (c *Controller) Execute(ctx context.Context, req Request, hooks Hooks) error {
+	if req.Action != Reboot && req.Action != Shutdown {
+		return fmt.Errorf("unknown power action %q", req.Action)
+	}
+
+	c.mutex.Lock()
+	if c.pending {
+		duplicate := req.ID != "" && req.ID == c.pendingID
+		c.mutex.Unlock()
+		if duplicate {
+			return ErrDuplicate
+		}
+		return fmt.Errorf("another power action is already pending")
+	}
+	c.pending = true
+	c.pendingID = req.ID
+	c.stage, c.message = "", ""
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.pending = false
+		c.pendingID = ""
+		c.mutex.Unlock()
+	}()
+
+	progress := func(stage, message string) {
+		c.mutex.Lock()
+		c.stage, c.message = stage, message
+		c.mutex.Unlock()
+		if hooks.Progress != nil {
+			hooks.Progress(stage, message)
+		}
+	}
+
+	// Wait for the maintenance window to open
+	if wait := time.Until(req.WindowStart); wait > 0 {
+		progress(StageScheduled, fmt.Sprintf("%s scheduled for %s", req.Action, req.WindowStart.Format(time.RFC3339)))
+		select {
+		case <-ctx.Done():
+			progress(StageCancelled, "daemon is shutting down")
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if !req.WindowEnd.IsZero() && time.Now().After(req.WindowEnd) {
+		progress(StageCancelled, "maintenance window has closed")
+		return fmt.Errorf("maintenance window closed at %s", req.WindowEnd.Format(time.RFC3339))
+	}
+
+	// The orchestrator has the final say, the fleet state may have changed meanwhile
+	if hooks.Confirm != nil {
+		progress(StageConfirming, "waiting for confirmation")
+		confirmed, err := hooks.Confirm(ctx)
+		if err != nil {
+			progress(StageCancelled, "confirmation failed")
+			return fmt.Errorf("failed to confirm %s: %w", req.Action, err)
+		}
+		if !confirmed {
+			progress(StageCancelled, "not confirmed by the orchestrator")
+			return fmt.Errorf("%s was not confirmed by the orchestrator", req.Action)
+		}
+	}
+
+	if c.client != nil {
+		timeout := req.DrainTimeout
+		if timeout <= 0 {
+			timeout = DefaultDrainTimeout
+		}
+		progress(StageDraining, "stopping containers")
+		drained, err := c.client.Drain(ctx, timeout)
+		if err != nil {
+			progress(StageCancelled, "drain failed")
+			c.resume()
+			return fmt.Errorf("failed to drain containers: %w", err)
+		}
+		log.Printf("Drained %d containers before %s", drained, req.Action)
+	}
+
+	progress(StageExecuting, fmt.Sprintf("host %s in progress", req.Action))
+	if err := run(req.Action); err != nil {
+		c.resume()
+		return err
+	}
+	return nil
+}
+
+// Progress returns the last stage and message reported for the pending request
+// with the given ID, ok is false if that request isn't pending
+func (c *Controller) Progress(id string) (stage, message string, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.pending || id == "" || id != c.pendingID {
+		return "", "", false
+	}
+	return c.stage, c.message, true
+}
+
+// resume starts the drained containers again after an aborted action
+func (c *Controller) resume() {
+	if c.client == nil {
+		return
+	}
+	if _, err := c.client.ResumeDrained(context.Background()); err != nil {
+		log.Printf("Warning: Failed to resume drained containers: %v", err)
+	}
+}
+
+// run executes the platform command for a power action
+func run(action Action) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		flag := "/r"
+		if action == Shutdown {
+			flag = "/s"
+		}
+		cmd = exec.Command("shutdown", flag, "/t", "0")
+	case "darwin":
+		flag := "-r"
+		if action == Shutdown {
+			flag = "-h"
+		}
+		cmd = exec.Command("shutdown", flag, "now")
+	default: // Linux and others
+		verb := "reboot"
+		if action == Shutdown {
+			verb = "poweroff"
+		}
+		cmd = exec.Command("systemctl", verb)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to %s host: %w, output: %s", action, err, string(output))
+	}
+	return nil
+}
@@ -6,14 +6,21 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
+
+	"fun/artifacts"
+	"fun/download"
 )
 
 const (
@@ -31,11 +38,19 @@ var (
 	}
 )
 
+// target is a platform/arch combination the binaries are bundled for
+type target struct {
+	platform string
+	arch     string
+	binDir   string
+}
+
 func main() {
 	platforms := []string{"darwin", "linux"} // Removed windows since we'll use Linux binaries in WSL2
 	arches := []string{"amd64", "arm64"}
 
 	// Create platform-specific directories
+	var targets []target
 	for _, platform := range platforms {
 		for _, arch := range arches {
 			// Skip unsupported combinations
@@ -47,85 +62,176 @@ func main() {
 			if err := os.MkdirAll(binDir, 0755); err != nil {
 				log.Fatalf("Fatal: Failed to create bin directory for %s-%s: %v\n", platform, arch, err)
 			}
+			targets = append(targets, target{platform: platform, arch: arch, binDir: binDir})
 		}
 	}
 
-	// Download dependencies for each platform/arch combination
-	for _, platform := range platforms {
-		for _, arch := range arches {
-			// Skip unsupported combinations
-			if platform == "darwin" && arch != runtime.GOARCH {
-				log.Printf("Warning: Skipping cross-compilation for %s-%s\n", platform, arch)
-				continue
-			}
+	// Archives are copied out of the artifact cache next to each other and
+	// extracted once all arrived
+	archiveDir, err := os.MkdirTemp("", "funserver-deps-")
+	if err != nil {
+		log.Fatalf("Fatal: Failed to create download directory: %v\n", err)
+	}
+	defer os.RemoveAll(archiveDir)
 
-			binDir := filepath.Join("bin", platform+"-"+arch)
+	// Download dependencies for all platform/arch combinations at once, through
+	// the cache the daemon uses so rebuilds don't download them again
+	var files []download.File
+	for _, t := range targets {
+		switch t.platform {
+		case "linux":
+			// Download both containerd and runc for Linux
+			files = append(files,
+				download.File{
+					URL: fmt.Sprintf("https://github.com/containerd/containerd/releases/download/v%s/containerd-%s-%s-%s.tar.gz",
+						containerdVersion, containerdVersion, t.platform, t.arch),
+					Path: containerdArchive(archiveDir, t),
+				},
+				download.File{
+					URL:  fmt.Sprintf("https://github.com/opencontainers/runc/releases/download/v%s/runc.%s", runcVersion, t.arch),
+					Path: filepath.Join(t.binDir, "runc"+binaryExt[t.platform]),
+					Mode: 0755,
+				},
+				// Download CNI plugins for Linux
+				download.File{
+					URL: fmt.Sprintf("https://github.com/containernetworking/plugins/releases/download/v%s/cni-plugins-%s-%s-v%s.tgz",
+						cniVersion, t.platform, t.arch, cniVersion),
+					Path: cniArchive(archiveDir, t),
+				},
+			)
 
-			switch platform {
-			case "linux":
-				// Download both containerd and runc for Linux
-				containerdURL := fmt.Sprintf("https://github.com/containerd/containerd/releases/download/v%s/containerd-%s-%s-%s.tar.gz",
-					containerdVersion, containerdVersion, platform, arch)
-				containerdBin := filepath.Join(binDir, "containerd"+binaryExt[platform])
-
-				err := downloadAndExtractContainerd(containerdURL, containerdBin)
-				if err != nil {
-					log.Fatalf("Fatal: Failed to download containerd for %s/%s: %v\n", platform, arch, err)
-				}
-
-				// Download runc for Linux
-				runcURL := fmt.Sprintf("https://github.com/opencontainers/runc/releases/download/v%s/runc.%s",
-					runcVersion, arch)
-				runcBin := filepath.Join(binDir, "runc"+binaryExt[platform])
-				err = downloadFile(runcURL, runcBin)
-				if err != nil {
-					log.Fatalf("Fatal: Failed to download runc for %s/%s: %v\n", platform, arch, err)
-				}
-				os.Chmod(runcBin, 0755)
-				os.Chmod(containerdBin, 0755)
+		case "darwin":
+			// Download LinuxKit for macOS
+			files = append(files, download.File{
+				URL:  fmt.Sprintf("https://github.com/linuxkit/linuxkit/releases/download/%s/linuxkit-%s-%s", linuxkitVersion, t.platform, t.arch),
+				Path: filepath.Join(t.binDir, "linuxkit"+binaryExt[t.platform]),
+				Mode: 0755,
+			})
+		}
+	}
 
-				// Download CNI plugins for Linux
-				cniURL := fmt.Sprintf("https://github.com/containernetworking/plugins/releases/download/v%s/cni-plugins-%s-%s-v%s.tgz",
-					cniVersion, platform, arch, cniVersion)
-				cniDir := filepath.Join(binDir, "cni")
-				err = downloadAndExtractCNI(cniURL, cniDir)
-				if err != nil {
-					log.Fatalf("Fatal: Failed to download CNI plugins for %s/%s: %v\n", platform, arch, err)
-				}
-
-			case "darwin":
-				// Download LinuxKit for macOS
-				linuxkitURL := fmt.Sprintf("https://github.com/linuxkit/linuxkit/releases/download/%s/linuxkit-%s-%s",
-					linuxkitVersion, platform, arch)
-				linuxkitBin := filepath.Join(binDir, "linuxkit"+binaryExt[platform])
-				err := downloadFile(linuxkitURL, linuxkitBin)
-				if err != nil {
-					log.Fatalf("Fatal: Failed to download LinuxKit for %s/%s: %v\n", platform, arch, err)
-				}
-				os.Chmod(linuxkitBin, 0755)
-			}
+	cacheDir := artifacts.DefaultDir()
+	cache, err := artifacts.Open(cacheDir)
+	if err != nil {
+		log.Fatalf("Fatal: %v\n", err)
+	}
+	// The release URLs carry their version, a new version is a new URL
+	requests := make([]artifacts.Request, len(files))
+	for i, file := range files {
+		requests[i] = artifacts.Request{URL: file.URL}
+	}
+	start := time.Now()
+	cached, err := cache.FetchAll(context.Background(), requests)
+	if err != nil {
+		log.Fatalf("Fatal: Failed to download dependencies: %v\n", err)
+	}
+	for i, file := range files {
+		if err := copyFile(cached[i], file.Path, file.Mode); err != nil {
+			log.Fatalf("Fatal: Failed to copy %s out of the artifact cache: %v\n", file.URL, err)
+		}
+	}
+	log.Printf("Fetched %d files through %s in %s\n", len(files), cacheDir, time.Since(start).Round(time.Millisecond))
+
+	for _, t := range targets {
+		if t.platform != "linux" {
+			continue
+		}
+		if err := extractContainerd(containerdArchive(archiveDir, t), filepath.Join(t.binDir, "containerd"+binaryExt[t.platform])); err != nil {
+			log.Fatalf("Fatal: Failed to extract containerd for %s/%s: %v\n", t.platform, t.arch, err)
+		}
+		if err := extractCNI(cniArchive(archiveDir, t), filepath.Join(t.binDir, "cni")); err != nil {
+			log.Fatalf("Fatal: Failed to extract CNI plugins for %s/%s: %v\n", t.platform, t.arch, err)
+		}
+
+		err := writeManifest(t.binDir, map[string]string{
+			"containerd": containerdVersion,
+			"runc":       runcVersion,
+			"cni":        cniVersion,
+		})
+		if err != nil {
+			log.Fatalf("Fatal: Failed to write version manifest for %s/%s: %v\n", t.platform, t.arch, err)
+		}
+		if err := writeChecksums(t.binDir); err != nil {
+			log.Fatalf("Fatal: Failed to write checksums for %s/%s: %v\n", t.platform, t.arch, err)
 		}
 	}
 }
 
-func downloadAndExtractContainerd(url, outputPath string) error {
-	resp, err := http.Get(url)
+// containerdArchive returns where the containerd release of t is downloaded
+func containerdArchive(archiveDir string, t target) string {
+	return filepath.Join(archiveDir, "containerd-"+t.platform+"-"+t.arch+".tar.gz")
+}
+
+// cniArchive returns where the CNI plugins release of t is downloaded
+func cniArchive(archiveDir string, t target) string {
+	return filepath.Join(archiveDir, "cni-plugins-"+t.platform+"-"+t.arch+".tgz")
+}
+
+// writeManifest records the component versions next to the binaries, so installed
+// agents re-extract components whose version changed
+func writeManifest(binDir string, versions map[string]string) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	return os.WriteFile(filepath.Join(binDir, "versions.json"), data, 0644)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+// writeChecksums records the sha256 of every binary next to the manifest, so
+// agents verify the binaries while extracting them
+func writeChecksums(binDir string) error {
+	checksums := map[string]string{}
+	err := filepath.Walk(binDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == ".json" {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(binDir, path)
+		if err != nil {
+			return err
+		}
+		checksums[filepath.ToSlash(rel)] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The checksums are read-only like the binaries they protect should be,
+	// an earlier run's file is replaced rather than written through
+	path := filepath.Join(binDir, "checksums.json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(path, data, 0444)
+}
+
+func extractContainerd(archive, outputPath string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	gr, err := gzip.NewReader(resp.Body)
+	gr, err := gzip.NewReader(file)
 	if err != nil {
 		return err
 	}
 	defer gr.Close()
 
 	tr := tar.NewReader(gr)
+	found := false
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -135,60 +241,76 @@ func downloadAndExtractContainerd(url, outputPath string) error {
 			return err
 		}
 
-		if strings.HasSuffix(header.Name, "containerd"+binaryExt[runtime.GOOS]) {
-			out, err := os.Create(outputPath)
-			if err != nil {
+		// ctr is bundled next to containerd for fun ctr
+		ctrPath := filepath.Join(filepath.Dir(outputPath), "ctr"+binaryExt[runtime.GOOS])
+		if strings.HasSuffix(header.Name, "/ctr"+binaryExt[runtime.GOOS]) {
+			if err := extractFile(tr, ctrPath); err != nil {
 				return err
 			}
-			defer out.Close()
+			continue
+		}
 
-			if _, err := io.Copy(out, tr); err != nil {
+		if strings.HasSuffix(header.Name, "containerd"+binaryExt[runtime.GOOS]) {
+			if err := extractFile(tr, outputPath); err != nil {
 				return err
 			}
-			return nil
+			found = true
 		}
 	}
-	return fmt.Errorf("containerd binary not found in archive")
+	if !found {
+		return fmt.Errorf("containerd binary not found in archive")
+	}
+	return nil
 }
 
-func downloadFile(url, outputPath string) error {
-	resp, err := http.Get(url)
+// copyFile copies a cached artifact to path, the cached file must stay unchanged
+func copyFile(src, path string, mode os.FileMode) error {
+	if mode == 0 {
+		mode = 0644
+	}
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	defer in.Close()
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
 
-	out, err := os.Create(outputPath)
+func extractFile(reader io.Reader, outputPath string) error {
+	out, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	_, err = io.Copy(out, reader)
 	return err
 }
 
-func downloadAndExtractCNI(url, outputDir string) error {
-	resp, err := http.Get(url)
+func extractCNI(archive, outputDir string) error {
+	file, err := os.Open(archive)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
-	}
+	defer file.Close()
 
 	// Create CNI directory if it doesn't exist
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return err
 	}
 
-	gr, err := gzip.NewReader(resp.Body)
+	gr, err := gzip.NewReader(file)
 	if err != nil {
 		return err
 	}
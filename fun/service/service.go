@@ -15,6 +15,17 @@ type Service struct {
 	DisplayName string
 	Description string
 	Executable  string
+	// WatchdogSec is how long systemd waits for a keepalive before it restarts
+	// the daemon, 0 disables the watchdog
+	WatchdogSec int
+	// StopTimeoutSec is how long systemd waits for the daemon to stop before it
+	// kills it, 0 keeps systemd's default
+	StopTimeoutSec int
+	// Requires are the units the daemon needs, it is started after them
+	Requires []string
+	// LogFile receives the daemon's standard output and error, such as panics,
+	// empty leaves them to the journal
+	LogFile string
 }
 
 // New creates a new Service instance
@@ -24,6 +35,7 @@ func New() *Service {
 		DisplayName: "Fun Server",
 		Description: "Fun Server communicates with the Fun orchestrator",
 		Executable:  getExecutablePath(),
+		Requires:    []string{"docker.service"},
 	}
 }
 
@@ -69,7 +81,12 @@ func getExecutablePath() string {
 	if err != nil {
 		// Return a sensible default if we can't determine the executable path
 		if runtime.GOOS == "windows" {
-			return filepath.Join(os.Getenv("PROGRAMFILES"), "Fun", "fun.exe")
+			// ProgramW6432 is the native Program Files, also for emulated builds on Windows on ARM
+			programFiles := os.Getenv("ProgramW6432")
+			if programFiles == "" {
+				programFiles = os.Getenv("PROGRAMFILES")
+			}
+			return filepath.Join(programFiles, "Fun Server", "fun.exe")
 		} else {
 			return "/usr/local/bin/fun"
 		}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"fun/sockets"
+)
+
+// gatePollInterval is how often startup gates check their condition
+const gatePollInterval = time.Second
+
+// StartupGates are the conditions the daemon waits for before starting, since at
+// boot it may be started before the network, the clock or containerd is ready
+type StartupGates struct {
+	// WaitForNetwork waits for a non-loopback interface with a routable address
+	WaitForNetwork bool
+	// WaitForTimeSync waits for the clock to be synchronized, TLS needs a correct clock
+	WaitForTimeSync bool
+	// WaitForPaths waits for files or sockets to exist, such as the containerd socket
+	WaitForPaths []string
+	// Timeout bounds the wait of each gate
+	Timeout time.Duration
+}
+
+// WaitForStartup waits for each gate in turn, returning an error naming the gates
+// that timed out. The caller decides whether to start anyway.
+func WaitForStartup(ctx context.Context, gates StartupGates) error {
+	var failed []string
+
+	wait := func(name string, ready func() bool) {
+		// Keep systemd from failing the start while the gate may still pass
+		Notify(fmt.Sprintf("STATUS=Waiting for %s\nEXTEND_TIMEOUT_USEC=%d", name, (gates.Timeout + time.Minute).Microseconds()))
+		if err := waitFor(ctx, gates.Timeout, ready); err != nil {
+			failed = append(failed, name)
+			return
+		}
+		log.Printf("Startup gate passed: %s", name)
+	}
+
+	if gates.WaitForNetwork {
+		wait("network", hasRoutableAddress)
+	}
+	if gates.WaitForTimeSync {
+		wait("time sync", clockSynchronized)
+	}
+	for _, path := range gates.WaitForPaths {
+		wait("path "+path, func() bool {
+			_, err := os.Stat(path)
+			return err == nil
+		})
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("timed out waiting for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// waitFor polls ready until it reports true, the timeout expires or ctx is canceled
+func waitFor(ctx context.Context, timeout time.Duration, ready func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(gatePollInterval)
+	defer ticker.Stop()
+	for {
+		if ready() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// hasRoutableAddress reports whether an up, non-loopback interface has a global unicast address
+func hasRoutableAddress() bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SystemdUnit returns the systemd unit of the service, ordered after the units
+// providing the startup gates so systemd starts the daemon once they are ready
+func (s *Service) SystemdUnit(gates StartupGates) string {
+	after := append([]string{"network.target"}, s.Requires...)
+	var wants []string
+	if gates.WaitForNetwork {
+		after = append(after, "network-online.target")
+		wants = append(wants, "network-online.target")
+	}
+	if gates.WaitForTimeSync {
+		after = append(after, "time-sync.target")
+		wants = append(wants, "time-sync.target")
+	}
+
+	// Gated paths need their filesystems mounted, and containerd's socket its service
+	mounts := make(map[string]bool)
+	for _, path := range gates.WaitForPaths {
+		if strings.HasPrefix(path, "/run/containerd/") {
+			after = append(after, "containerd.service")
+			wants = append(wants, "containerd.service")
+			continue
+		}
+		mounts[filepath.Dir(path)] = true
+	}
+	var mountPaths []string
+	for path := range mounts {
+		mountPaths = append(mountPaths, path)
+	}
+	sort.Strings(mountPaths)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", s.DisplayName)
+	fmt.Fprintf(&b, "After=%s\n", strings.Join(dedupe(after), " "))
+	if len(s.Requires) > 0 {
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(dedupe(s.Requires), " "))
+	}
+	if len(wants) > 0 {
+		fmt.Fprintf(&b, "Wants=%s\n", strings.Join(dedupe(wants), " "))
+	}
+	if len(mountPaths) > 0 {
+		fmt.Fprintf(&b, "RequiresMountsFor=%s\n", strings.Join(mountPaths, " "))
+	}
+	fmt.Fprintf(&b, "\n[Service]\n")
+	// The daemon reports ready once containerd is connected, see Notify
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "NotifyAccess=main\n")
+	if s.WatchdogSec > 0 {
+		fmt.Fprintf(&b, "WatchdogSec=%d\n", s.WatchdogSec)
+	}
+	if s.StopTimeoutSec > 0 {
+		fmt.Fprintf(&b, "TimeoutStopSec=%d\n", s.StopTimeoutSec)
+	}
+	fmt.Fprintf(&b, "ExecStart=%s --daemon\n", s.Executable)
+	fmt.Fprintf(&b, "Restart=always\n")
+	fmt.Fprintf(&b, "RestartSec=10\n")
+	fmt.Fprintf(&b, "User=root\n")
+	fmt.Fprintf(&b, "Group=root\n")
+	if s.LogFile != "" {
+		fmt.Fprintf(&b, "StandardOutput=append:%s\n", s.LogFile)
+		fmt.Fprintf(&b, "StandardError=append:%s\n", s.LogFile)
+	}
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// ActivationSockets are the local API sockets systemd listens on for a socket
+// activated daemon, empty paths are left out
+type ActivationSockets struct {
+	AdminSocket     string
+	DockerAPISocket string
+	// SocketGroup is given access to the sockets, empty keeps them root-only
+	SocketGroup string
+}
+
+// GetSocketFilePath returns the path of the systemd socket unit
+func (s *Service) GetSocketFilePath() string {
+	return "/etc/systemd/system/" + s.Name + ".socket"
+}
+
+// SystemdSocketUnit returns the systemd socket unit holding the daemon's local
+// API sockets, it also starts the daemon if a client connects while it is down
+func (s *Service) SystemdSocketUnit(activation ActivationSockets) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s local API sockets\n", s.DisplayName)
+	fmt.Fprintf(&b, "\n[Socket]\n")
+	if activation.AdminSocket != "" {
+		fmt.Fprintf(&b, "ListenStream=%s\n", activation.AdminSocket)
+		fmt.Fprintf(&b, "FileDescriptorName=%s\n", sockets.ActivationAdmin)
+	}
+	if activation.DockerAPISocket != "" {
+		fmt.Fprintf(&b, "ListenStream=%s\n", activation.DockerAPISocket)
+		fmt.Fprintf(&b, "FileDescriptorName=%s\n", sockets.ActivationDockerAPI)
+	}
+	fmt.Fprintf(&b, "SocketMode=%04o\n", sockets.Mode)
+	if activation.SocketGroup != "" {
+		fmt.Fprintf(&b, "SocketGroup=%s\n", activation.SocketGroup)
+	}
+	fmt.Fprintf(&b, "RemoveOnStop=yes\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=sockets.target\n")
+	return b.String()
+}
+
+// Install writes the systemd unit for gates and enables the service
+// Other platforms are installed by their installers.
+func (s *Service) Install(gates StartupGates) error {
+	return s.install(gates, nil)
+}
+
+// InstallSocketActivated installs the service like Install, and enables a
+// socket unit holding the local API sockets. The service still starts at boot,
+// the daemon polls the orchestrator whether or not a client connects, but the
+// sockets accept connections while it starts or restarts.
+func (s *Service) InstallSocketActivated(gates StartupGates, activation ActivationSockets) error {
+	if activation.AdminSocket == "" && activation.DockerAPISocket == "" {
+		return fmt.Errorf("socket activation needs the admin or the Docker API socket to be configured")
+	}
+	return s.install(gates, &activation)
+}
+
+// install writes the units and enables the service, or its socket if activation is set
+func (s *Service) install(gates StartupGates, activation *ActivationSockets) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("service installation on %s is handled by the platform installer", runtime.GOOS)
+	}
+
+	path := s.GetServiceFilePath()
+	if err := os.WriteFile(path, []byte(s.SystemdUnit(gates)), 0644); err != nil {
+		return fmt.Errorf("failed to write systemd unit: %w", err)
+	}
+
+	commands := [][]string{{"daemon-reload"}, {"enable", s.Name}}
+	if activation != nil {
+		if err := os.WriteFile(s.GetSocketFilePath(), []byte(s.SystemdSocketUnit(*activation)), 0644); err != nil {
+			return fmt.Errorf("failed to write systemd socket unit: %w", err)
+		}
+		commands = [][]string{{"daemon-reload"}, {"enable", s.Name + ".socket", s.Name + ".service"}}
+	}
+
+	for _, args := range commands {
+		output, err := exec.Command("systemctl", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to run systemctl %s: %w, output: %s", args[0], err, string(output))
+		}
+	}
+	return nil
+}
+
+// dedupe removes repeated entries, keeping the first occurrence
+func dedupe(list []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, item := range list {
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result
+}
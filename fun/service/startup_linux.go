@@ -0,0 +1,14 @@
+package service
+
+import "golang.org/x/sys/unix"
+
+// clockSynchronized reports whether the kernel considers the clock synchronized,
+// which NTP daemons such as systemd-timesyncd and chrony signal through adjtimex
+func clockSynchronized() bool {
+	var timex unix.Timex
+	state, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return false
+	}
+	return state != unix.TIME_ERROR && timex.Status&unix.STA_UNSYNC == 0
+}
@@ -0,0 +1,57 @@
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Names of the sockets in the systemd socket unit, set with FileDescriptorName
+const (
+	ActivationAdmin     = "admin"
+	ActivationDockerAPI = "docker"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Activated returns the listening sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName. It is empty when the daemon wasn't started
+// through a socket unit. The environment variables are cleared so processes
+// started by the daemon don't pick up the sockets too.
+func Activated() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+
+	pid, pidErr := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, countErr := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pidErr != nil || countErr != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := "fd" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener duplicates the descriptor, the inherited one is closed again
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use activated socket %s: %w", name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
@@ -0,0 +1,293 @@
+package sockets
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Kinds of the frames a relay carries the connections to a socket in, over the
+// standard input and output of a single command. A frame starts with the ID of
+// its connection, its kind and the length of its payload.
+const (
+	// frameOpen opens a connection to the socket
+	frameOpen byte = iota + 1
+	// frameData carries bytes of a connection
+	frameData
+	// frameClose ends the sender's half of a connection
+	frameClose
+)
+
+const (
+	frameHeaderSize = 9
+	// maxFramePayload bounds the payload of a frame, longer reads are split
+	maxFramePayload = 32 << 10
+	// relayBacklog is how many frames are queued for a connection before the
+	// relay waits for it to catch up, holding up the other connections
+	relayBacklog = 64
+)
+
+// relayConn is a connection carried by a relay
+type relayConn struct {
+	conn net.Conn
+	// frames carries the peer's data to conn, it is closed once the peer closed its half
+	frames chan []byte
+}
+
+// relaySession multiplexes connections over one stream in each direction
+type relaySession struct {
+	out        io.Writer
+	writeMutex sync.Mutex
+
+	mutex  sync.Mutex
+	conns  map[uint32]*relayConn
+	closed bool
+}
+
+func newRelaySession(out io.Writer) *relaySession {
+	return &relaySession{out: out, conns: map[uint32]*relayConn{}}
+}
+
+// write sends a frame to the peer
+func (s *relaySession) write(id uint32, kind byte, payload []byte) error {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:], id)
+	header[4] = kind
+	binary.BigEndian.PutUint32(header[5:], uint32(len(payload)))
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if _, err := s.out.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := s.out.Write(payload)
+	return err
+}
+
+// readFrame reads a frame sent by write
+func readFrame(r io.Reader) (uint32, byte, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:])
+	if length > maxFramePayload {
+		return 0, 0, nil, fmt.Errorf("relay frame of %d bytes exceeds the limit of %d", length, maxFramePayload)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[0:]), header[4], payload, nil
+}
+
+// add relays conn as connection id, until both halves are closed. With open, it
+// asks the peer to open the connection on its end first.
+func (s *relaySession) add(id uint32, conn net.Conn, open bool) error {
+	relay := &relayConn{conn: conn, frames: make(chan []byte, relayBacklog)}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return fmt.Errorf("relay is closed")
+	}
+	s.conns[id] = relay
+	s.mutex.Unlock()
+
+	if open {
+		if err := s.write(id, frameOpen, nil); err != nil {
+			s.mutex.Lock()
+			delete(s.conns, id)
+			s.mutex.Unlock()
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxFramePayload)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if s.write(id, frameData, buf[:n]) != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		s.write(id, frameClose, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		for data := range relay.frames {
+			if _, err := conn.Write(data); err != nil {
+				// Closing stops the other half, the rest of the peer's data is dropped
+				conn.Close()
+				for range relay.frames {
+				}
+				return
+			}
+		}
+		if unix, ok := conn.(*net.UnixConn); ok {
+			unix.CloseWrite()
+		}
+	}()
+	go func() {
+		wg.Wait()
+		conn.Close()
+	}()
+	return nil
+}
+
+// serve passes the frames read from r to their connections until r ends, then
+// closes the connections left
+func (s *relaySession) serve(r io.Reader, open func(id uint32)) error {
+	defer s.close()
+	reader := bufio.NewReader(r)
+	for {
+		id, kind, payload, err := readFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if kind == frameOpen {
+			if open != nil {
+				open(id)
+			}
+			continue
+		}
+
+		s.mutex.Lock()
+		relay := s.conns[id]
+		if kind == frameClose {
+			delete(s.conns, id)
+		}
+		s.mutex.Unlock()
+		if relay == nil {
+			continue
+		}
+		switch kind {
+		case frameData:
+			relay.frames <- payload
+		case frameClose:
+			close(relay.frames)
+		}
+	}
+}
+
+// close closes the connections of the session, no more can be added
+func (s *relaySession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for id, relay := range s.conns {
+		close(relay.frames)
+		relay.conn.Close()
+		delete(s.conns, id)
+	}
+}
+
+// isClosed reports whether the session ended
+func (s *relaySession) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// RelayStdio relays the connections RelayToCommand sends on stdin to the Unix
+// socket at path, and their replies to stdout, until stdin closes
+// It is the far end of RelayToCommand, e.g. inside a WSL distribution.
+func RelayStdio(path string) error {
+	session := newRelaySession(os.Stdout)
+	return session.serve(os.Stdin, func(id uint32) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			log.Printf("Warning: Failed to connect to %s: %v", path, err)
+			session.write(id, frameClose, nil)
+			return
+		}
+		if err := session.add(id, conn, false); err != nil {
+			conn.Close()
+		}
+	})
+}
+
+// RelayToCommand accepts connections on listener and relays them all through
+// the standard input and output of one long running command, until ctx is done
+// command builds the command, typically one that runs RelayStdio where the real
+// socket is. It is started with the first connection and started again for the
+// next one if it exited.
+func RelayToCommand(ctx context.Context, listener net.Listener, command func(ctx context.Context) *exec.Cmd) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var session *relaySession
+	var nextID uint32
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept on %s: %w", listener.Addr(), err)
+		}
+
+		if session == nil || session.isClosed() {
+			session, err = startRelay(ctx, listener.Addr(), command(ctx))
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				conn.Close()
+				continue
+			}
+		}
+		nextID++
+		if err := session.add(nextID, conn, true); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// startRelay starts the command of a relay and serves its output
+func startRelay(ctx context.Context, addr net.Addr, cmd *exec.Cmd) (*relaySession, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the relay for %s: %w", addr, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the relay for %s: %w", addr, err)
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = log.Writer()
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start the relay for %s: %w", addr, err)
+	}
+
+	session := newRelaySession(stdin)
+	go func() {
+		err := session.serve(stdout, nil)
+		stdin.Close()
+		if waitErr := cmd.Wait(); err == nil {
+			err = waitErr
+		}
+		if ctx.Err() == nil {
+			log.Printf("Warning: Relay for %s exited: %v", addr, err)
+		}
+	}()
+	return session, nil
+}
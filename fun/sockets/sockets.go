@@ -0,0 +1,67 @@
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// Mode is the permission of the daemon's Unix sockets, read and write for the
+// owner and the socket group
+const Mode = 0660
+
+// LookupGroup returns the GID of a group name or number, -1 for an empty name
+func LookupGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, fmt.Errorf("socket group %s not found: %w", name, err)
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// Listen listens on a Unix socket, replacing a stale one left behind by a
+// previous run, and secures it like Secure. Binding creates a new socket file,
+// so whoever binds a socket again must secure it again, Listen always does.
+func Listen(path string, gid int) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := Secure(path, gid); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Secure restricts a socket to Mode and hands it to gid, unless gid is negative
+// Windows has no socket groups, its sockets are left as they are.
+func Secure(path string, gid int) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if err := os.Chmod(path, Mode); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("failed to set group of %s: %w", path, err)
+		}
+	}
+	return nil
+}
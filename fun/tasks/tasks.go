@@ -0,0 +1,193 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownTask is returned when triggering a task that isn't registered
+	ErrUnknownTask = errors.New("unknown task")
+	// ErrTaskRunning is returned when triggering a task that is already running
+	ErrTaskRunning = errors.New("task is already running")
+)
+
+// Task is periodic maintenance work of the daemon, such as garbage collecting images
+type Task struct {
+	Name        string
+	Description string
+	// Interval is the time between runs, 0 only runs the task when triggered
+	Interval time.Duration
+	// Jitter is the most a run is delayed by at random, so hosts started
+	// together don't all run the task at the same time
+	Jitter time.Duration
+	// Run does the work and returns a summary of it, empty if there was nothing to do
+	Run func(ctx context.Context) (string, error)
+}
+
+// Status is the schedule of a task and the outcome of its last run
+type Status struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Interval    time.Duration `json:"interval"`
+	Running     bool          `json:"running"`
+	// NextRun is when the task runs next, zero for tasks only run when triggered
+	NextRun time.Time `json:"next_run,omitempty"`
+
+	LastRun      time.Time     `json:"last_run,omitempty"`
+	LastDuration time.Duration `json:"last_duration,omitempty"`
+	// LastTrigger is "schedule" or "manual"
+	LastTrigger string `json:"last_trigger,omitempty"`
+	LastResult  string `json:"last_result,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+
+	Runs     int `json:"runs"`
+	Failures int `json:"failures"`
+}
+
+// entry is a registered task and its status
+type entry struct {
+	task   Task
+	status Status
+}
+
+// Scheduler runs the registered tasks on their schedules and on demand,
+// never running a task twice at the same time
+type Scheduler struct {
+	mutex sync.Mutex
+	tasks map[string]*entry
+	order []string
+}
+
+// NewScheduler creates a scheduler without tasks
+func NewScheduler() *Scheduler {
+	return &Scheduler{tasks: make(map[string]*entry)}
+}
+
+// Register adds a task, it must be called before Run
+func (s *Scheduler) Register(task Task) error {
+	if task.Name == "" || task.Run == nil {
+		return fmt.Errorf("task needs a name and a function")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.tasks[task.Name]; ok {
+		return fmt.Errorf("task %s is already registered", task.Name)
+	}
+	s.tasks[task.Name] = &entry{task: task, status: Status{Name: task.Name, Description: task.Description, Interval: task.Interval}}
+	s.order = append(s.order, task.Name)
+	return nil
+}
+
+// List returns the status of every task in the order they were registered
+func (s *Scheduler) List() []Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	statuses := make([]Status, 0, len(s.order))
+	for _, name := range s.order {
+		statuses = append(statuses, s.tasks[name].status)
+	}
+	return statuses
+}
+
+// Run runs the scheduled tasks until the context is cancelled, each one first
+// an interval after the daemon started
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	s.mutex.Lock()
+	for _, name := range s.order {
+		if s.tasks[name].task.Interval <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			s.schedule(ctx, e)
+		}(s.tasks[name])
+	}
+	s.mutex.Unlock()
+	wg.Wait()
+}
+
+// schedule runs a task every interval, plus jitter, until the context is cancelled
+func (s *Scheduler) schedule(ctx context.Context, e *entry) {
+	for {
+		delay := e.task.Interval
+		if e.task.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(e.task.Jitter)))
+		}
+		s.mutex.Lock()
+		e.status.NextRun = time.Now().Add(delay)
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// A manual run in progress stands in for the scheduled one
+		if err := s.run(ctx, e, "schedule"); err != nil && !errors.Is(err, ErrTaskRunning) {
+			log.Printf("Warning: Task %s failed: %v", e.task.Name, err)
+		}
+	}
+}
+
+// Trigger runs a task right away, outside its schedule, and returns its status
+// once it finished. The error is only set if the task couldn't be started, the
+// outcome of the run is in the status.
+func (s *Scheduler) Trigger(ctx context.Context, name string) (Status, error) {
+	s.mutex.Lock()
+	e, ok := s.tasks[name]
+	s.mutex.Unlock()
+	if !ok {
+		return Status{}, fmt.Errorf("%w: %s", ErrUnknownTask, name)
+	}
+
+	err := s.run(ctx, e, "manual")
+	if errors.Is(err, ErrTaskRunning) {
+		return Status{}, fmt.Errorf("%w: %s", ErrTaskRunning, name)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return e.status, nil
+}
+
+// run runs a task unless it is already running and records the outcome
+func (s *Scheduler) run(ctx context.Context, e *entry, trigger string) error {
+	s.mutex.Lock()
+	if e.status.Running {
+		s.mutex.Unlock()
+		return ErrTaskRunning
+	}
+	e.status.Running = true
+	s.mutex.Unlock()
+
+	start := time.Now()
+	result, err := e.task.Run(ctx)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.status.Running = false
+	e.status.LastRun = start
+	e.status.LastDuration = time.Since(start)
+	e.status.LastTrigger = trigger
+	e.status.LastResult = result
+	e.status.LastError = ""
+	e.status.Runs++
+	if err != nil {
+		e.status.LastError = err.Error()
+		e.status.Failures++
+		return err
+	}
+	if result != "" {
+		log.Printf("Task %s: %s", e.task.Name, result)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fun/container"
+)
+
+// Record kinds
+const (
+	KindMetrics  = "metrics"
+	KindEvent    = "event"
+	KindAudit    = "audit"
+	KindDownload = "download"
+)
+
+// ErrBackpressure is returned when the spool refuses a record to keep the disk from filling
+var ErrBackpressure = errors.New("telemetry spool is full")
+
+const (
+	// segmentSuffix is the extension of the spool's segment files
+	segmentSuffix = ".jsonl"
+	// cursorFile records how far the orchestrator received the spool
+	cursorFile = "cursor"
+	// maxBatchRecords and maxBatchBytes bound a single upload
+	maxBatchRecords = 500
+	maxBatchBytes   = 1 << 20
+)
+
+// Record is a single buffered metrics sample, event or audit record
+type Record struct {
+	// Seq orders the records across kinds, the orchestrator drops ones it already has
+	Seq  uint64          `json:"seq"`
+	Kind string          `json:"kind"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Limits bound the disk space of a spool
+type Limits struct {
+	// MaxBytes is the size of the spool, the oldest records are dropped beyond it
+	MaxBytes int64
+	// SegmentBytes is the size at which a new segment file is started
+	SegmentBytes int64
+	// MinFreeBytes is the free disk space below which new metrics are refused
+	MinFreeBytes int64
+}
+
+// SendFunc uploads records in order, along with the number of records dropped
+// since the previous upload. Records are only removed once it succeeded.
+type SendFunc func(ctx context.Context, records []Record, dropped uint64) error
+
+// segment is a spool file holding the records from first on
+type segment struct {
+	first uint64
+	size  int64
+}
+
+// cursor is the persisted upload position of a spool
+type cursor struct {
+	// Acked is the last record the orchestrator received
+	Acked uint64 `json:"acked"`
+	// Dropped counts the records lost since then to retention or backpressure
+	Dropped uint64 `json:"dropped"`
+}
+
+// Spool buffers telemetry on disk while the orchestrator is unreachable and
+// forwards it in order once it is back
+type Spool struct {
+	dir    string
+	limits Limits
+	wake   chan struct{}
+
+	mutex    sync.Mutex
+	segments []segment
+	next     uint64
+	cursor   cursor
+	// pressured remembers that refusals were logged, so they are logged once
+	pressured bool
+}
+
+// Open opens the spool in dir, creating it if needed, and resumes after the
+// records already forwarded
+func Open(dir string, limits Limits) (*Spool, error) {
+	if limits.MaxBytes <= 0 {
+		return nil, fmt.Errorf("telemetry spool size must be positive")
+	}
+	if limits.SegmentBytes <= 0 || limits.SegmentBytes > limits.MaxBytes/4 {
+		limits.SegmentBytes = min(limits.MaxBytes/4, maxBatchBytes)
+	}
+	// Telemetry may include audit records, keep it private to the daemon
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create telemetry spool: %w", err)
+	}
+	s := &Spool{dir: dir, limits: limits, wake: make(chan struct{}, 1)}
+
+	data, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read telemetry cursor: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.cursor); err != nil {
+			log.Printf("Warning: Ignoring corrupt telemetry cursor: %v", err)
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segment{first: first, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].first < s.segments[j].first })
+
+	s.next = s.cursor.Acked + 1
+	if len(s.segments) > 0 {
+		last := &s.segments[len(s.segments)-1]
+		if err := s.repairSegment(last); err != nil {
+			return nil, err
+		}
+		records, err := s.readSegment(last.first)
+		if err != nil {
+			return nil, err
+		}
+		s.next = max(s.next, last.first)
+		if len(records) > 0 {
+			s.next = max(s.next, records[len(records)-1].Seq+1)
+		}
+	}
+	return s, nil
+}
+
+// Append buffers a record for the next upload. Metrics are refused once the
+// spool is three quarters full or the disk runs low, so events and audit
+// records keep their room; those are only bounded by the spool size.
+func (s *Spool) Append(kind string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s record: %w", kind, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if reason := s.pressure(kind); reason != "" {
+		s.cursor.Dropped++
+		if err := s.saveCursor(); err != nil {
+			log.Printf("Warning: Failed to record dropped telemetry: %v", err)
+		}
+		if !s.pressured {
+			log.Printf("Warning: Telemetry spool refuses records until the orchestrator catches up: %s", reason)
+			s.pressured = true
+		}
+		return ErrBackpressure
+	}
+	if s.pressured && s.pressure(KindMetrics) == "" {
+		log.Printf("Telemetry spool accepts records again")
+		s.pressured = false
+	}
+
+	line, err := json.Marshal(Record{Seq: s.next, Kind: kind, Time: time.Now(), Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s record: %w", kind, err)
+	}
+	line = append(line, '\n')
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size+int64(len(line)) > s.limits.SegmentBytes {
+		s.segments = append(s.segments, segment{first: s.next})
+	}
+	current := &s.segments[len(s.segments)-1]
+	file, err := os.OpenFile(s.segmentPath(current.first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open telemetry spool: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write telemetry spool: %w", err)
+	}
+	current.size += int64(len(line))
+	s.next++
+
+	s.enforceRetention()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pressure returns why a record of kind is refused, empty if it isn't; the
+// caller must hold the mutex
+func (s *Spool) pressure(kind string) string {
+	if kind != KindMetrics {
+		return ""
+	}
+	if s.limits.MinFreeBytes > 0 {
+		if free, ok := container.DiskFree(s.dir); ok && free < s.limits.MinFreeBytes {
+			return fmt.Sprintf("only %d MB of disk space left", free>>20)
+		}
+	}
+	if s.size() >= s.limits.MaxBytes/4*3 {
+		return fmt.Sprintf("%d MB buffered", s.size()>>20)
+	}
+	return ""
+}
+
+// enforceRetention drops the oldest segments while the spool is too large; the
+// caller must hold the mutex
+func (s *Spool) enforceRetention() {
+	for s.size() > s.limits.MaxBytes && len(s.segments) > 1 {
+		oldest, following := s.segments[0], s.segments[1]
+		if last := following.first - 1; last > s.cursor.Acked {
+			lost := last - max(s.cursor.Acked, oldest.first-1)
+			log.Printf("Warning: Telemetry spool is full, dropping %d records the orchestrator didn't receive", lost)
+			s.cursor.Dropped += lost
+			s.cursor.Acked = last
+		}
+		if err := os.Remove(s.segmentPath(oldest.first)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove telemetry segment: %v", err)
+		}
+		s.segments = s.segments[1:]
+		if err := s.saveCursor(); err != nil {
+			log.Printf("Warning: Failed to record dropped telemetry: %v", err)
+		}
+	}
+}
+
+// size returns the bytes in the spool; the caller must hold the mutex
+func (s *Spool) size() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Pending returns the number of records and bytes not yet forwarded
+func (s *Spool) Pending() (records uint64, bytes int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.next - 1 - s.cursor.Acked, s.size()
+}
+
+// Run forwards the spool whenever records are appended, retrying every
+// interval while the orchestrator is unreachable, until the context is cancelled
+func (s *Spool) Run(ctx context.Context, send SendFunc, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Forward(ctx, send); err != nil && ctx.Err() == nil {
+			records, _ := s.Pending()
+			log.Printf("Warning: Failed to forward telemetry, %d records buffered: %v", records, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// Forward sends the buffered records in order until the spool is empty or a send fails
+func (s *Spool) Forward(ctx context.Context, send SendFunc) error {
+	for {
+		records, dropped, err := s.batch()
+		if err != nil || (len(records) == 0 && dropped == 0) {
+			return err
+		}
+		if err := send(ctx, records, dropped); err != nil {
+			return err
+		}
+		var last uint64
+		if len(records) > 0 {
+			last = records[len(records)-1].Seq
+		}
+		if err := s.ack(last, dropped); err != nil {
+			return err
+		}
+	}
+}
+
+// batch reads the next records to upload and the count of dropped ones
+func (s *Spool) batch() ([]Record, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var records []Record
+	var size int
+	for i, seg := range s.segments {
+		if i+1 < len(s.segments) && s.segments[i+1].first <= s.cursor.Acked+1 {
+			continue
+		}
+		segmentRecords, err := s.readSegment(seg.first)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, record := range segmentRecords {
+			if record.Seq <= s.cursor.Acked {
+				continue
+			}
+			if len(records) == maxBatchRecords || (size+len(record.Data) > maxBatchBytes && len(records) > 0) {
+				return records, s.cursor.Dropped, nil
+			}
+			records = append(records, record)
+			size += len(record.Data)
+		}
+	}
+	return records, s.cursor.Dropped, nil
+}
+
+// ack records that the orchestrator received the records up to last and
+// learned of dropped lost ones, and removes the segments it no longer needs
+func (s *Spool) ack(last, dropped uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cursor.Acked = max(s.cursor.Acked, last)
+	s.cursor.Dropped -= min(dropped, s.cursor.Dropped)
+
+	// The last segment is kept as it is still appended to
+	for len(s.segments) > 1 && s.segments[1].first <= s.cursor.Acked+1 {
+		if err := os.Remove(s.segmentPath(s.segments[0].first)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove telemetry segment: %v", err)
+		}
+		s.segments = s.segments[1:]
+	}
+	return s.saveCursor()
+}
+
+// saveCursor persists the cursor atomically; the caller must hold the mutex
+func (s *Spool) saveCursor() error {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, cursorFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write telemetry cursor: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readSegment reads the records of a segment. A line torn by a crash ends the
+// segment, the records before it are kept.
+func (s *Spool) readSegment(first uint64) ([]Record, error) {
+	data, err := os.ReadFile(s.segmentPath(first))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read telemetry spool: %w", err)
+	}
+
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Warning: Skipping the rest of telemetry segment %d: %v", first, err)
+			break
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// repairSegment cuts a line torn by a crash off the end of the segment, so
+// appended records don't follow it
+func (s *Spool) repairSegment(seg *segment) error {
+	data, err := os.ReadFile(s.segmentPath(seg.first))
+	if err != nil {
+		return fmt.Errorf("failed to read telemetry spool: %w", err)
+	}
+	valid := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if valid == int64(len(data)) {
+		return nil
+	}
+	log.Printf("Warning: Discarding a torn record at the end of telemetry segment %d", seg.first)
+	if err := os.Truncate(s.segmentPath(seg.first), valid); err != nil {
+		return fmt.Errorf("failed to repair telemetry spool: %w", err)
+	}
+	seg.size = valid
+	return nil
+}
+
+// segmentPath returns the file of the segment starting at first
+func (s *Spool) segmentPath(first uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
@@ -0,0 +1,80 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"fun/container"
+
+	"golang.org/x/sys/unix"
+)
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	return err == nil
+}
+
+// makeRaw puts the terminal f into raw mode, so keys such as Ctrl-C reach the
+// container instead of the CLI, and returns the function restoring it
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	saved, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *saved
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, saved) }, nil
+}
+
+// terminalSize returns the size of the terminal f
+func terminalSize(f *os.File) (container.TerminalSize, error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return container.TerminalSize{}, err
+	}
+	return container.TerminalSize{Width: ws.Col, Height: ws.Row}, nil
+}
+
+// watchTerminalSize sends the size of the terminal f and then its new size
+// whenever the window is resized, until ctx is cancelled
+func watchTerminalSize(ctx context.Context, f *os.File) <-chan container.TerminalSize {
+	sizes := make(chan container.TerminalSize, 1)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+
+	go func() {
+		defer signal.Stop(winch)
+		for {
+			if size, err := terminalSize(f); err == nil {
+				// Only the latest size matters, drop one not picked up yet
+				select {
+				case <-sizes:
+				default:
+				}
+				sizes <- size
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-winch:
+			}
+		}
+	}()
+	return sizes
+}
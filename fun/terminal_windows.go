@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"fun/container"
+
+	"golang.org/x/sys/windows"
+)
+
+// isTerminal reports whether f is a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
+
+// makeRaw puts the console f into raw mode with virtual terminal input, so keys
+// such as Ctrl-C reach the container instead of the CLI, and returns the
+// function restoring it. The console's output is switched to processing the
+// container's escape sequences until then.
+func makeRaw(f *os.File) (func(), error) {
+	in := windows.Handle(f.Fd())
+	var savedIn uint32
+	if err := windows.GetConsoleMode(in, &savedIn); err != nil {
+		return nil, err
+	}
+	raw := savedIn &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT)
+	if err := windows.SetConsoleMode(in, raw|windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		return nil, err
+	}
+
+	out := windows.Handle(os.Stdout.Fd())
+	var savedOut uint32
+	outChanged := windows.GetConsoleMode(out, &savedOut) == nil &&
+		windows.SetConsoleMode(out, savedOut|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+
+	return func() {
+		windows.SetConsoleMode(in, savedIn)
+		if outChanged {
+			windows.SetConsoleMode(out, savedOut)
+		}
+	}, nil
+}
+
+// terminalSize returns the size of the console window, f is the console's input
+func terminalSize(f *os.File) (container.TerminalSize, error) {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(os.Stdout.Fd()), &info); err != nil {
+		return container.TerminalSize{}, err
+	}
+	return container.TerminalSize{
+		Width:  uint16(info.Window.Right - info.Window.Left + 1),
+		Height: uint16(info.Window.Bottom - info.Window.Top + 1),
+	}, nil
+}
+
+// watchTerminalSize sends the size of the console and then its new size
+// whenever the window is resized, until ctx is cancelled. Consoles don't
+// signal resizes, the size is polled instead.
+func watchTerminalSize(ctx context.Context, f *os.File) <-chan container.TerminalSize {
+	sizes := make(chan container.TerminalSize, 1)
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+
+		var last container.TerminalSize
+		for {
+			if size, err := terminalSize(f); err == nil && size != last {
+				last = size
+				// Only the latest size matters, drop one not picked up yet
+				select {
+				case <-sizes:
+				default:
+				}
+				sizes <- size
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return sizes
+}
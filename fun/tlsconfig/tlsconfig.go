@@ -0,0 +1,121 @@
+package tlsconfig
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Options restrict the TLS connections made by the daemon
+type Options struct {
+	// MinVersion is "1.2" or "1.3", empty keeps the Go default
+	MinVersion string
+	// CipherSuites are Go cipher suite names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	// empty keeps the Go defaults. TLS 1.3 suites are not configurable.
+	CipherSuites []string
+	// FIPS limits connections to FIPS 140-3 approved versions, suites and curves,
+	// and requires the Go FIPS module to be enabled
+	FIPS bool
+}
+
+// fipsCipherSuites are the TLS 1.2 suites approved for FIPS mode
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// FIPSEnabled reports whether the binary runs with the Go FIPS 140-3 module enabled,
+// either built with -tags fips or started with GODEBUG=fips140=on
+func FIPSEnabled() bool {
+	return fips140.Enabled()
+}
+
+// New returns the client TLS configuration for opts, nil if opts change nothing
+func New(opts Options) (*tls.Config, error) {
+	if opts.MinVersion == "" && len(opts.CipherSuites) == 0 && !opts.FIPS {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	switch opts.MinVersion {
+	case "":
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid TLS minimum version %q, expected 1.2 or 1.3", opts.MinVersion)
+	}
+
+	for _, name := range opts.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	if opts.FIPS {
+		if !FIPSEnabled() {
+			return nil, fmt.Errorf("FIPS mode requires a binary built with -tags fips or started with GODEBUG=fips140=on")
+		}
+		if config.MinVersion < tls.VersionTLS12 {
+			config.MinVersion = tls.VersionTLS12
+		}
+		if len(config.CipherSuites) == 0 {
+			config.CipherSuites = fipsCipherSuites
+		}
+		for _, id := range config.CipherSuites {
+			if !containsSuite(fipsCipherSuites, id) {
+				return nil, fmt.Errorf("cipher suite %s is not allowed in FIPS mode", tls.CipherSuiteName(id))
+			}
+		}
+		config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+
+	return config, nil
+}
+
+// NewTransport returns the HTTP transport the daemon's outgoing clients are
+// built on: Go's default transport, proxies from the environment and config,
+// which may be nil for the Go defaults. The config is cloned, since HTTP/2 and
+// callers may add to it.
+func NewTransport(config *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if config != nil {
+		transport.TLSClientConfig = config.Clone()
+	}
+	return transport
+}
+
+// cipherSuite returns the ID of a secure cipher suite by name
+func cipherSuite(name string) (uint16, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
+
+// containsSuite reports whether suites contains id
+func containsSuite(suites []uint16, id uint16) bool {
+	for _, suite := range suites {
+		if suite == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DefaultKeepAlive is the keepalive interval used unless configured otherwise
+const DefaultKeepAlive = 30 * time.Second
+
+// maxRestartBackoff bounds the delay between attempts to re-establish an SSH tunnel
+const maxRestartBackoff = time.Minute
+
+// Config describes how to reach the cloud through a jump host
+type Config struct {
+	// Proxy is socks5://[user:password@]host:port or ssh://[user@]host[:port]
+	Proxy string
+	// Identity is the private key used for SSH tunnels, empty uses the ssh defaults
+	Identity string
+	// KeepAlive is the interval of TCP and SSH keepalives
+	KeepAlive time.Duration
+}
+
+// Tunnel dials connections through a SOCKS5 proxy, either configured directly or
+// provided by an ssh process forwarding through a bastion host
+type Tunnel struct {
+	config Config
+	target *url.URL
+	dialer proxy.ContextDialer
+
+	// localAddr is the SOCKS5 address of the ssh process, ready is closed once it listens
+	localAddr string
+	mutex     sync.Mutex
+	ready     chan struct{}
+}
+
+// New creates a tunnel for config
+func New(config Config) (*Tunnel, error) {
+	target, err := url.Parse(config.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud proxy %q: %w", config.Proxy, err)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("invalid cloud proxy %q: no host", config.Proxy)
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = DefaultKeepAlive
+	}
+
+	t := &Tunnel{config: config, target: target, ready: make(chan struct{})}
+	forward := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: config.KeepAlive}
+
+	switch target.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if target.User != nil {
+			password, _ := target.User.Password()
+			auth = &proxy.Auth{User: target.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", target.Host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		t.dialer = dialer.(proxy.ContextDialer)
+		close(t.ready)
+
+	case "ssh":
+		if _, err := exec.LookPath("ssh"); err != nil {
+			return nil, fmt.Errorf("ssh tunnels require the ssh client: %w", err)
+		}
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+		t.localAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		dialer, err := proxy.SOCKS5("tcp", t.localAddr, nil, forward)
+		if err != nil {
+			return nil, err
+		}
+		t.dialer = dialer.(proxy.ContextDialer)
+
+	default:
+		return nil, fmt.Errorf("invalid cloud proxy scheme %q, expected socks5 or ssh", target.Scheme)
+	}
+
+	return t, nil
+}
+
+// Run keeps the ssh process of an SSH tunnel running until ctx is canceled,
+// re-establishing it whenever it exits. It returns immediately for SOCKS5 proxies.
+func (t *Tunnel) Run(ctx context.Context) {
+	if t.target.Scheme != "ssh" {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := t.runSSH(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A tunnel that stayed up for a while failed on its own, retry quickly
+		if time.Since(started) > maxRestartBackoff {
+			backoff = time.Second
+		}
+		log.Printf("SSH tunnel to %s exited: %v, reconnecting in %v", t.target.Host, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRestartBackoff)
+	}
+}
+
+// runSSH runs a single ssh process providing a SOCKS5 proxy on localAddr
+func (t *Tunnel) runSSH(ctx context.Context) error {
+	keepAlive := int(t.config.KeepAlive.Seconds())
+	args := []string{
+		"-N",
+		"-D", t.localAddr,
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", fmt.Sprintf("ServerAliveInterval=%d", max(keepAlive, 1)),
+		"-o", "ServerAliveCountMax=3",
+	}
+	if t.config.Identity != "" {
+		args = append(args, "-i", t.config.Identity)
+	}
+	if port := t.target.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	destination := t.target.Hostname()
+	if t.target.User != nil {
+		destination = t.target.User.Username() + "@" + destination
+	}
+	args = append(args, destination)
+
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Wait in the background so readiness can be polled while ssh runs
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			conn, err := net.DialTimeout("tcp", t.localAddr, time.Second)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			log.Printf("SSH tunnel to %s established", t.target.Host)
+			t.markReady()
+			return <-done
+		}
+	}
+}
+
+// markReady unblocks dials waiting for the first SSH tunnel
+func (t *Tunnel) markReady() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	select {
+	case <-t.ready:
+	default:
+		close(t.ready)
+	}
+}
+
+// DialContext connects to address through the tunnel, waiting for an SSH tunnel
+// to be established first
+func (t *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("cloud tunnel not established: %w", ctx.Err())
+	}
+	return t.dialer.DialContext(ctx, network, address)
+}
+
+// freePort returns a local TCP port that is currently unused
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port for the ssh tunnel: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"fun/admin"
+	"fun/config"
+	"fun/container"
+)
+
+// gb converts bytes to gigabytes for display
+func gb(bytes int64) float64 {
+	return float64(bytes) / (1 << 30)
+}
+
+// handleVMCommands manages the LinuxKit VM that runs containerd on macOS and the
+// WSL2 distribution on Windows
+func handleVMCommands(args []string) {
+	switch args[0] {
+	case "disk":
+		if len(args) < 2 {
+			showVMHelp()
+			os.Exit(1)
+		}
+		if container.IsRunningOnWindows() {
+			handleWSLDiskCommands(args[1:])
+		} else {
+			handleVMDiskCommands(args[1:])
+		}
+	case "reset", "export", "import":
+		handleWSLDistroCommands(args)
+	default:
+		fmt.Printf("Unknown vm command: %s\n", args[0])
+		showVMHelp()
+		os.Exit(1)
+	}
+}
+
+// handleVMDiskCommands resizes, compacts and moves the disk of the macOS VM
+func handleVMDiskCommands(args []string) {
+	vm := container.DefaultLinuxKitConfig()
+	switch args[0] {
+	case "info":
+		usage, err := container.GetVMDiskUsage(vm)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Path: %s\n", usage.Path)
+		fmt.Printf("Size: %.2f GB, allocated on the host: %.2f GB\n", gb(usage.Size), gb(usage.Allocated))
+
+	case "resize":
+		if len(args) < 2 {
+			fmt.Println("Usage: fun vm disk resize <size-gb>")
+			os.Exit(1)
+		}
+		sizeGB, err := strconv.Atoi(args[1])
+		if err != nil || sizeGB <= 0 {
+			fmt.Printf("Error: invalid size %q, expected a number of GB\n", args[1])
+			os.Exit(1)
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] resize the VM disk to %d GB\n", sizeGB)
+			return
+		}
+		if err := container.ResizeVMDisk(vm, sizeGB); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("VM disk resized to %d GB, the VM sees the new size on its next start\n", sizeGB)
+
+	case "compact":
+		if dryRun {
+			fmt.Println("[dry-run] compact the VM disk")
+			return
+		}
+		released, err := container.CompactVMDisk(vm)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("VM disk compacted, released %.2f GB\n", gb(released))
+
+	case "move":
+		if len(args) < 2 {
+			fmt.Println("Usage: fun vm disk move <directory>")
+			os.Exit(1)
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] move the VM disk to %s\n", args[1])
+			return
+		}
+		if err := container.MoveVMDisk(vm, args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("VM disk moved to %s\n", args[1])
+
+	default:
+		fmt.Printf("Unknown vm disk command: %s\n", args[0])
+		showVMHelp()
+		os.Exit(1)
+	}
+}
+
+// handleWSLDiskCommands shows, resizes and compacts the disk of the WSL2 distribution
+func handleWSLDiskCommands(args []string) {
+	wsl := container.DefaultWSL2Config()
+	ctx := context.Background()
+	switch args[0] {
+	case "info":
+		usage, err := container.GetWSLDiskUsage(wsl)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Path: %s\n", usage.Path)
+		fmt.Printf("Size: %.2f GB, allocated on the host: %.2f GB\n", gb(usage.Size), gb(usage.Allocated))
+
+	case "resize":
+		if len(args) < 2 {
+			fmt.Println("Usage: fun vm disk resize <size-gb>")
+			os.Exit(1)
+		}
+		sizeGB, err := strconv.Atoi(args[1])
+		if err != nil || sizeGB <= 0 {
+			fmt.Printf("Error: invalid size %q, expected a number of GB\n", args[1])
+			os.Exit(1)
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] stop the WSL distribution and resize its disk to %d GB\n", sizeGB)
+			return
+		}
+		if err := container.ResizeWSLDisk(ctx, wsl, sizeGB); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("WSL disk resized to %d GB\n", sizeGB)
+
+	case "compact":
+		if dryRun {
+			fmt.Println("[dry-run] trim, stop and compact the WSL disk")
+			return
+		}
+		released, err := container.CompactWSLDisk(ctx, wsl)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("WSL disk compacted, released %.2f GB\n", gb(released))
+
+	case "move":
+		fmt.Println("Error: moving the disk is not supported for the WSL2 distribution, use fun vm export and import")
+		os.Exit(1)
+
+	default:
+		fmt.Printf("Unknown vm disk command: %s\n", args[0])
+		showVMHelp()
+		os.Exit(1)
+	}
+}
+
+// handleWSLDistroCommands rebuilds, exports and imports the WSL2 distribution
+func handleWSLDistroCommands(args []string) {
+	if !container.IsRunningOnWindows() {
+		fmt.Printf("Error: fun vm %s manages the WSL2 distribution and is only available on Windows\n", args[0])
+		os.Exit(1)
+	}
+	wsl := container.DefaultWSL2Config()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "reset":
+		if dryRun {
+			fmt.Printf("[dry-run] rebuild the WSL distribution %s, keeping its state and config\n", wsl.Distribution)
+			return
+		}
+		backup, err := container.ResetWSL2Distribution(ctx, wsl)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			if backup != "" {
+				fmt.Printf("The state and config are saved in %s\n", backup)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("WSL distribution %s rebuilt, images have to be pulled again\n", wsl.Distribution)
+
+	case "export", "import":
+		if len(args) < 2 {
+			fmt.Printf("Usage: fun vm %s <file.tar>\n", args[0])
+			os.Exit(1)
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] %s the WSL distribution %s using %s\n", args[0], wsl.Distribution, args[1])
+			return
+		}
+		var err error
+		if args[0] == "export" {
+			err = container.ExportWSL2Distribution(ctx, wsl, args[1])
+		} else {
+			err = container.ImportWSL2Distribution(ctx, wsl, args[1])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("WSL distribution %s %sed\n", wsl.Distribution, args[0])
+	}
+}
+
+// showVMHelp displays vm command usage
+func showVMHelp() {
+	fmt.Println("Usage: fun vm <command>")
+	fmt.Println("\nCommands for the macOS VM:")
+	fmt.Println("  disk info                 Show the size of the VM disk and the host space it uses")
+	fmt.Println("  disk resize <size-gb>     Grow the VM disk")
+	fmt.Println("  disk compact              Release the host space of blocks zeroed in the VM")
+	fmt.Println("  disk move <directory>     Move the VM disk to another volume")
+	fmt.Println("\nThe VM has to be stopped to change its disk. On Windows, info, resize and compact")
+	fmt.Println("manage the disk of the WSL2 distribution and stop it as needed.")
+	fmt.Println("\nCommands for the WSL2 distribution on Windows:")
+	fmt.Println("  reset                     Rebuild the distribution from the bundled rootfs, keeping state and config")
+	fmt.Println("  export <file.tar>         Save the distribution, e.g. as a golden image for other machines")
+	fmt.Println("  import <file.tar>         Install the distribution from an exported file")
+}
+
+// handleSystemCommands reports on and repairs the resources used by Fun Server
+func handleSystemCommands(cfg *config.Config, args []string) {
+	switch args[0] {
+	case "df":
+		showDiskUsage(cfg)
+	case "repair":
+		repairSystem(cfg, args[1:])
+	case "upgrade-containerd":
+		upgradeContainerd(cfg)
+	default:
+		fmt.Printf("Unknown system command: %s\n", args[0])
+		showSystemHelp()
+		os.Exit(1)
+	}
+}
+
+// repairSystem cleans up or rebuilds containers left inconsistent by a hard reboot
+func repairSystem(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	removeUnrepairable := fs.Bool("remove-unrepairable", false, "Remove containers whose snapshot and image are both gone")
+	fs.Parse(args)
+
+	client, err := newContainerClient(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	actions, err := client.Repair(context.Background(), container.RepairOptions{RemoveUnrepairable: *removeUnrepairable})
+	for _, action := range actions {
+		fmt.Println(action)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(actions) == 0 {
+		fmt.Println("No inconsistencies found")
+	}
+}
+
+// upgradeContainerd has the daemon restart its embedded containerd on the
+// bundled binaries of this release, the containers keep running
+func upgradeContainerd(cfg *config.Config) {
+	upgrades, err := admin.NewClient(cfg.AdminSocket).UpgradeContainerd(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(upgrades) == 0 {
+		fmt.Println("The bundled binaries are up to date")
+		return
+	}
+	for _, upgrade := range upgrades {
+		from := upgrade.From
+		if from == "" {
+			from = "not extracted"
+		}
+		fmt.Printf("Upgraded %s from %s to %s\n", upgrade.Component, from, upgrade.To)
+	}
+}
+
+// showDiskUsage reports the disk space used by images, containers and the VM
+func showDiskUsage(cfg *config.Config) {
+	fmt.Println("TYPE\t\tCOUNT\tSIZE")
+	if client, err := newContainerClient(cfg); err != nil {
+		fmt.Printf("Warning: Failed to connect to containerd: %v\n", err)
+	} else {
+		defer client.Close()
+		ctx := context.Background()
+
+		if analysis, err := client.AnalyzeImages(ctx); err == nil {
+			fmt.Printf("Images\t\t%d\t%.2f GB\n", len(analysis.Images), gb(analysis.PhysicalSize))
+		} else {
+			fmt.Printf("Warning: Failed to analyze images: %v\n", err)
+		}
+		if containers, err := client.ListContainers(ctx); err == nil {
+			fmt.Printf("Containers\t%d\n", len(containers))
+		} else {
+			fmt.Printf("Warning: Failed to list containers: %v\n", err)
+		}
+	}
+
+	// The VM disk only exists where containerd runs in the LinuxKit VM
+	if usage, err := container.GetVMDiskUsage(container.DefaultLinuxKitConfig()); err == nil {
+		fmt.Printf("VM disk\t\t1\t%.2f GB allocated of %.2f GB (%s)\n", gb(usage.Allocated), gb(usage.Size), usage.Path)
+	}
+	if container.IsRunningOnWindows() {
+		wsl := container.DefaultWSL2Config()
+		if usage, err := container.GetWSLDiskUsage(wsl); err == nil {
+			fmt.Printf("WSL disk\t1\t%.2f GB allocated of %.2f GB (%s, %s)\n", gb(usage.Allocated), gb(usage.Size), wsl.Distribution, usage.Path)
+		}
+	}
+}
+
+// showSystemHelp displays system command usage
+func showSystemHelp() {
+	fmt.Println("Usage: fun system <command>")
+	fmt.Println("\nCommands:")
+	fmt.Println("  df                   Show the disk space used by images, containers and the VM")
+	fmt.Println("  repair [--remove-unrepairable]  Clean up dead tasks and rebuild missing snapshots")
+	fmt.Println("  upgrade-containerd   Restart the embedded containerd on the bundled binaries of this release")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"fun/config"
+	"fun/container"
+	"fun/sockets"
+)
+
+// wslAgentCommands are run by the agent in the WSL2 distribution with wsl_agent,
+// they work on the containers it runs. The others manage the service, the
+// distribution and the host, and run on Windows.
+var wslAgentCommands = map[string]bool{
+	"container": true,
+	"image":     true,
+	"network":   true,
+	"namespace": true,
+	"system":    true,
+	"cri":       true,
+	"ctr":       true,
+	"nerdctl":   true,
+	"plan":      true,
+	"apply":     true,
+	"apply-all": true,
+	"history":   true,
+	"rollback":  true,
+	"tasks":     true,
+	"events":    true,
+	"artifacts": true,
+	"migrate":   true,
+}
+
+// wslAgentConfig returns the configuration of the agent in the WSL2 distribution
+// Files stay shared with Windows through /mnt, sockets and container data live in
+// the distribution since the Windows filesystem can't hold them.
+func wslAgentConfig(cfg *config.Config) *config.Config {
+	agent := *cfg
+	agent.WSLAgent = false
+	agent.SystemLog = false
+	agent.LogFile = "/var/log/fun/fun.log"
+	agent.AdminSocket = container.WSLAgentAdminSocket
+	agent.ContainerdSocket = "/run/containerd/containerd.sock"
+	agent.ContainerdSockets = nil
+	agent.ContainerRoot = container.WSLAgentStateDir
+	agent.StartupWaitForPaths = nil
+	if cfg.DockerAPISocket != "" {
+		agent.DockerAPISocket = container.WSLAgentDockerSocket
+	}
+	agent.HostIDPath = container.WSLPath(cfg.HostIDPath)
+	agent.DesiredStateCachePath = container.WSLPath(cfg.DesiredStateCachePath)
+	agent.CommandNoncePath = container.WSLPath(cfg.CommandNoncePath)
+	agent.DesiredStateIssuedPath = container.WSLPath(cfg.DesiredStateIssuedPath)
+	agent.TelemetrySpoolDir = container.WSLPath(cfg.TelemetrySpoolDir)
+	agent.EventJournalDir = container.WSLPath(cfg.EventJournalDir)
+	agent.ArtifactCacheDir = container.WSLPath(cfg.ArtifactCacheDir)
+	agent.TrustPolicyPath = container.WSLPath(cfg.TrustPolicyPath)
+	agent.AuditLogPath = container.WSLPath(cfg.AuditLogPath)
+	agent.CommandPolicyPath = container.WSLPath(cfg.CommandPolicyPath)
+	agent.FleetPath = container.WSLPath(cfg.FleetPath)
+	agent.SecretsDir = container.WSLPath(cfg.SecretsDir)
+	agent.DebugBundleDir = container.WSLPath(cfg.DebugBundleDir)
+	agent.CloudProxyIdentity = container.WSLPath(cfg.CloudProxyIdentity)
+	agent.DockerConfigPath = container.WSLPath(cfg.DockerConfigPath)
+	agent.GitOpsSSHKey = container.WSLPath(cfg.GitOpsSSHKey)
+	agent.GitOpsTokenFile = container.WSLPath(cfg.GitOpsTokenFile)
+	agent.ManifestSigningKeys = nil
+	for _, key := range cfg.ManifestSigningKeys {
+		agent.ManifestSigningKeys = append(agent.ManifestSigningKeys, container.WSLPath(key))
+	}
+	if cfg.CredentialHelper == "wincred" {
+		agent.CredentialHelper = ""
+	}
+	return &agent
+}
+
+// forwardToWSLAgent runs a CLI command with the agent in the WSL2 distribution,
+// passing through its input, output and exit code
+func forwardToWSLAgent(args []string) {
+	var global []string
+	if dryRun {
+		global = append(global, "-dry-run")
+	}
+	if containerdTarget != "" {
+		global = append(global, "-containerd", containerdTarget)
+	}
+	if outputFormat != outputText {
+		global = append(global, "-output", outputFormat)
+	}
+
+	cmd := container.WSLAgentCommand(context.Background(), container.DefaultWSL2Config(), append(global, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Printf("Error: failed to run the command in WSL: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runWSLController runs the daemon as the controller of the agent in the WSL2
+// distribution: it starts the distribution and the agent, restarts the agent
+// when it exits and relays the admin and Docker API sockets to it
+func runWSLController(cfg *config.Config) {
+	log.Println("Starting Fun Server controller for the WSL agent...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal: %v\n", sig)
+		cancel()
+	}()
+
+	wsl := container.DefaultWSL2Config()
+	if err := container.StartWSL2Environment(ctx, wsl); err != nil {
+		log.Fatalf("Failed to start the WSL distribution: %v", err)
+	}
+	if err := container.EnsureContainerdInWSL(ctx, wsl); err != nil {
+		log.Fatalf("Failed to install containerd in WSL: %v", err)
+	}
+	if err := container.InstallWSLAgent(ctx, wsl); err != nil {
+		log.Fatalf("Failed to install the WSL agent: %v", err)
+	}
+	data, err := json.MarshalIndent(wslAgentConfig(cfg), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal the WSL agent configuration: %v", err)
+	}
+	if err := container.WriteWSLAgentConfig(ctx, wsl, data); err != nil {
+		log.Fatalf("Failed to configure the WSL agent: %v", err)
+	}
+
+	socketGID, err := sockets.LookupGroup(cfg.SocketGroup)
+	if err != nil {
+		log.Printf("Warning: %v, the relayed sockets are only accessible to their owner", err)
+		socketGID = -1
+	}
+
+	// Each socket is relayed through one wsl.exe kept running for all its connections
+	var wg sync.WaitGroup
+	relays := []struct {
+		path  string
+		agent string
+	}{
+		{cfg.AdminSocket, container.WSLAgentAdminSocket},
+		{cfg.DockerAPISocket, container.WSLAgentDockerSocket},
+	}
+	for _, relay := range relays {
+		if relay.path == "" {
+			continue
+		}
+		if strings.HasPrefix(relay.path, `\\.\pipe\`) {
+			log.Printf("Warning: Named pipe %s can't be relayed to the WSL agent, use a socket path", relay.path)
+			continue
+		}
+		listener, err := sockets.Listen(relay.path, socketGID)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		agentSocket := relay.agent
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sockets.RelayToCommand(ctx, listener, func(ctx context.Context) *exec.Cmd {
+				return container.WSLAgentCommand(ctx, wsl, "stdio-relay", agentSocket)
+			})
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}()
+		log.Printf("Relaying %s to %s in WSL", relay.path, agentSocket)
+	}
+
+	// The agent is restarted when it exits, e.g. after WSL shut the distribution down
+	for ctx.Err() == nil {
+		cmd := container.WSLAgentCommand(ctx, wsl, "-daemon")
+		cmd.Stdout = log.Writer()
+		cmd.Stderr = log.Writer()
+		log.Printf("Starting the fun agent in WSL distribution %s", wsl.Distribution)
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("Warning: The WSL agent exited: %v, restarting", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	wg.Wait()
+	if err := container.StopWSL2Environment(wsl); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	log.Println("Fun Server controller stopped")
+}